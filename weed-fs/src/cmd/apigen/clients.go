@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The Python and Java clients have one class per server, and one method per
+// operation, taking its path parameter, its query parameters, left out when
+// None or null, and for POST and PUT a body. They only use the standard
+// library of each language, and return the status, headers and body of the
+// response, failing on an error status, since the responses have no schema.
+
+// writeJsonParameters are left out of the clients, which want plain json.
+var writeJsonParameters = map[string]bool{"callback": true, "pretty": true}
+
+var pythonKeywords = map[string]bool{"and": true, "as": true, "assert": true, "async": true, "await": true,
+	"class": true, "def": true, "del": true, "for": true, "from": true, "global": true, "if": true,
+	"import": true, "in": true, "is": true, "lambda": true, "not": true, "or": true, "pass": true,
+	"raise": true, "return": true, "try": true, "while": true, "with": true, "yield": true}
+
+var javaKeywords = map[string]bool{"abstract": true, "case": true, "catch": true, "char": true, "class": true,
+	"default": true, "do": true, "else": true, "final": true, "for": true, "if": true, "import": true,
+	"int": true, "long": true, "new": true, "package": true, "private": true, "public": true,
+	"return": true, "static": true, "switch": true, "this": true, "throw": true, "try": true, "while": true}
+
+// clientOperation is an operation as the clients call it.
+type clientOperation struct {
+	method    string
+	path      string
+	name      []string // the words of the method name
+	pathParam string
+	query     []string
+	body      bool
+	doc       string
+}
+
+// clientOperations lists the operations of the server in the order of their
+// paths and methods. The method names are the words of the path, prefixed
+// with the method for the paths of several methods or not read with GET,
+// e.g. dir_assign, or post_fid and delete_fid.
+func clientOperations(paths map[string]map[string]*operation) []clientOperation {
+	var ops []clientOperation
+	for _, p := range sortedPaths(paths) {
+		methods := paths[p]
+		for _, method := range sortedMethods(methods) {
+			op := methods[method]
+			c := clientOperation{method: strings.ToUpper(method), path: p, body: method == "post" || method == "put"}
+			if len(methods) > 1 || method != "get" {
+				c.name = append(c.name, method)
+			}
+			c.name = append(c.name, words(strings.NewReplacer("/", ".", "{", "", "}", "").Replace(p))...)
+			for _, param := range op.Parameters {
+				switch {
+				case param.In == "path":
+					c.pathParam = param.Name
+				case !writeJsonParameters[param.Name]:
+					c.query = append(c.query, param.Name)
+				}
+			}
+			c.doc = c.method + " " + p
+			if op.Summary != "" {
+				c.doc += ": " + op.Summary
+			}
+			c.doc += "."
+			if op.Role != "" {
+				c.doc += " Needs the role " + op.Role + "."
+			}
+			ops = append(ops, c)
+		}
+	}
+	return ops
+}
+
+func sortedPaths(paths map[string]map[string]*operation) []string {
+	keys := make([]string, 0, len(paths))
+	for k := range paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedMethods(methods map[string]*operation) []string {
+	keys := make([]string, 0, len(methods))
+	for k := range methods {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedServers(documents map[string]map[string]map[string]*operation) []string {
+	keys := make([]string, 0, len(documents))
+	for k := range documents {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// words splits a parameter name, e.g. mv.from, user.name or lastFileName, into
+// lower case words.
+func words(name string) []string {
+	var words []string
+	for _, field := range strings.FieldsFunc(name, func(r rune) bool { return r == '.' || r == '-' || r == '_' }) {
+		start := 0
+		for i := 1; i < len(field); i++ {
+			if field[i] >= 'A' && field[i] <= 'Z' && field[i-1] >= 'a' && field[i-1] <= 'z' {
+				words = append(words, strings.ToLower(field[start:i]))
+				start = i
+			}
+		}
+		words = append(words, strings.ToLower(field[start:]))
+	}
+	return words
+}
+
+func pythonName(words []string) string {
+	name := strings.Join(words, "_")
+	if pythonKeywords[name] {
+		name += "_"
+	}
+	return name
+}
+
+func javaName(words []string) string {
+	var b strings.Builder
+	for i, word := range words {
+		if i > 0 {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		b.WriteString(word)
+	}
+	if javaKeywords[b.String()] {
+		b.WriteString("_")
+	}
+	return b.String()
+}
+
+func className(server string) string {
+	return strings.ToUpper(server[:1]) + server[1:]
+}
+
+const pythonHeader = `# Code generated by apigen from the routes and the handlers of cmd/weed. DO NOT EDIT.
+
+"""Clients of the weed master, volume and filer servers, generated from their
+OpenAPI documents, e.g.
+
+    fid = Master("localhost:9333").dir_assign().json()["fid"]
+
+Each method sends one request, with the query parameters which are not None,
+and returns the Response, or raises WeedError for an error status. The servers
+answer json, read with Response.json(), except for the file contents.
+"""
+
+import json
+import urllib.error
+import urllib.parse
+import urllib.request
+
+
+class WeedError(Exception):
+    """The response of a request failing with an error status."""
+
+    def __init__(self, response):
+        Exception.__init__(self, "%d: %s" % (response.status, response.body[:200].decode("utf-8", "replace")))
+        self.response = response
+
+
+class Response(object):
+    def __init__(self, status, headers, body):
+        self.status = status
+        self.headers = headers
+        self.body = body
+
+    def json(self):
+        return json.loads(self.body.decode("utf-8"))
+
+
+class _Client(object):
+    def __init__(self, url, timeout=30):
+        if "://" not in url:
+            url = "http://" + url
+        self.url = url.rstrip("/")
+        self.timeout = timeout
+
+    def _send(self, method, path, query, body=None, headers=None):
+        url = self.url + path
+        params = [(name, value) for name, value in query if value is not None]
+        if params:
+            url += "?" + urllib.parse.urlencode(params)
+        request = urllib.request.Request(url, data=body, headers=headers or {}, method=method)
+        try:
+            with urllib.request.urlopen(request, timeout=self.timeout) as response:
+                return Response(response.status, response.headers, response.read())
+        except urllib.error.HTTPError as e:
+            raise WeedError(Response(e.code, e.headers, e.read()))
+
+    @staticmethod
+    def _path(value):
+        return "/" + urllib.parse.quote(str(value).lstrip("/"), safe="/")
+`
+
+func pythonClient(documents map[string]map[string]map[string]*operation) []byte {
+	var b bytes.Buffer
+	b.WriteString(pythonHeader)
+	for _, server := range sortedServers(documents) {
+		fmt.Fprintf(&b, "\n\nclass %s(_Client):\n    \"\"\"The %s server.\"\"\"\n", className(server), server)
+		for _, op := range clientOperations(documents[server]) {
+			args := []string{"self"}
+			path := fmt.Sprintf("%q", op.path)
+			if op.pathParam != "" {
+				name := pythonName(words(op.pathParam))
+				args = append(args, name)
+				path = fmt.Sprintf("self._path(%s)", name)
+				if prefix := strings.TrimSuffix(op.path[:strings.Index(op.path, "{")], "/"); prefix != "" {
+					path = fmt.Sprintf("%q + %s", prefix, path)
+				}
+			}
+			var query []string
+			for _, param := range op.query {
+				name := pythonName(words(param))
+				args = append(args, name+"=None")
+				query = append(query, fmt.Sprintf("(%q, %s)", param, name))
+			}
+			body := ""
+			if op.body {
+				args = append(args, "body=None", "headers=None")
+				body = ", body, headers"
+			}
+			doc := strings.Replace(strings.Replace(op.doc, `\`, `\\`, -1), `"""`, `\"\"\"`, -1)
+			fmt.Fprintf(&b, "\n    def %s(%s):\n", pythonName(op.name), strings.Join(args, ", "))
+			fmt.Fprintf(&b, "        \"\"\"%s\"\"\"\n", doc)
+			fmt.Fprintf(&b, "        return self._send(%q, %s, [%s]%s)\n", op.method, path, strings.Join(query, ", "), body)
+		}
+	}
+	return b.Bytes()
+}
+
+const javaHeader = `// Code generated by apigen from the routes and the handlers of cmd/weed. DO NOT EDIT.
+
+package weedfs;
+
+import java.io.ByteArrayOutputStream;
+import java.io.IOException;
+import java.io.InputStream;
+import java.io.OutputStream;
+import java.io.UnsupportedEncodingException;
+import java.net.HttpURLConnection;
+import java.net.URL;
+import java.net.URLEncoder;
+import java.nio.charset.StandardCharsets;
+import java.util.List;
+import java.util.Map;
+
+/**
+ * Clients of the weed master, volume and filer servers, generated from their
+ * OpenAPI documents, e.g.
+ *
+ * <pre>
+ * String json = new WeedClient.Master("localhost:9333").dirAssign(null, null, null, null, null, null, null, null).text();
+ * </pre>
+ *
+ * Each method sends one request, with the query parameters which are not null,
+ * and returns the Response, or throws a WeedException for an error status. The
+ * servers answer json, except for the file contents.
+ */
+public final class WeedClient {
+    private WeedClient() {
+    }
+
+    /** The response of a request failing with an error status. */
+    public static final class WeedException extends IOException {
+        public final transient Response response;
+
+        WeedException(Response response) {
+            super(response.status + ": " + response.text());
+            this.response = response;
+        }
+    }
+
+    public static final class Response {
+        public final int status;
+        public final Map<String, List<String>> headers;
+        public final byte[] body;
+
+        Response(int status, Map<String, List<String>> headers, byte[] body) {
+            this.status = status;
+            this.headers = headers;
+            this.body = body;
+        }
+
+        public String text() {
+            return new String(body, StandardCharsets.UTF_8);
+        }
+    }
+
+    public abstract static class Client {
+        private final String url;
+        private int timeoutMillis = 30000;
+
+        Client(String url) {
+            if (!url.contains("://")) {
+                url = "http://" + url;
+            }
+            while (url.endsWith("/")) {
+                url = url.substring(0, url.length() - 1);
+            }
+            this.url = url;
+        }
+
+        public void setTimeoutMillis(int timeoutMillis) {
+            this.timeoutMillis = timeoutMillis;
+        }
+
+        Response send(String method, String path, String[] query, byte[] body, String contentType) throws IOException {
+            StringBuilder target = new StringBuilder(url).append(path);
+            char separator = '?';
+            for (int i = 0; i < query.length; i += 2) {
+                if (query[i + 1] != null) {
+                    target.append(separator).append(encode(query[i])).append('=').append(encode(query[i + 1]));
+                    separator = '&';
+                }
+            }
+            HttpURLConnection connection = (HttpURLConnection) new URL(target.toString()).openConnection();
+            try {
+                connection.setRequestMethod(method);
+                connection.setConnectTimeout(timeoutMillis);
+                connection.setReadTimeout(timeoutMillis);
+                if (body != null) {
+                    connection.setDoOutput(true);
+                    if (contentType != null) {
+                        connection.setRequestProperty("Content-Type", contentType);
+                    }
+                    connection.setFixedLengthStreamingMode(body.length);
+                    try (OutputStream out = connection.getOutputStream()) {
+                        out.write(body);
+                    }
+                }
+                int status = connection.getResponseCode();
+                InputStream in = status >= 400 ? connection.getErrorStream() : connection.getInputStream();
+                Response response = new Response(status, connection.getHeaderFields(), readAll(in));
+                if (status >= 400) {
+                    throw new WeedException(response);
+                }
+                return response;
+            } finally {
+                connection.disconnect();
+            }
+        }
+
+        static String path(String value) {
+            String[] segments = value.replaceFirst("^/+", "").split("/", -1);
+            for (int i = 0; i < segments.length; i++) {
+                segments[i] = encode(segments[i]).replace("+", "%20");
+            }
+            return "/" + String.join("/", segments);
+        }
+
+        private static String encode(String value) {
+            try {
+                return URLEncoder.encode(value, "UTF-8");
+            } catch (UnsupportedEncodingException e) {
+                throw new AssertionError(e);
+            }
+        }
+
+        private static byte[] readAll(InputStream in) throws IOException {
+            ByteArrayOutputStream out = new ByteArrayOutputStream();
+            if (in == null) {
+                return out.toByteArray();
+            }
+            try {
+                byte[] buffer = new byte[8192];
+                for (int n; (n = in.read(buffer)) > 0; ) {
+                    out.write(buffer, 0, n);
+                }
+            } finally {
+                in.close();
+            }
+            return out.toByteArray();
+        }
+    }
+`
+
+func javaClient(documents map[string]map[string]map[string]*operation) []byte {
+	var b bytes.Buffer
+	b.WriteString(javaHeader)
+	for _, server := range sortedServers(documents) {
+		class := className(server)
+		fmt.Fprintf(&b, "\n    /** The %s server. */\n    public static final class %s extends Client {\n", server, class)
+		fmt.Fprintf(&b, "        public %s(String url) {\n            super(url);\n        }\n", class)
+		for _, op := range clientOperations(documents[server]) {
+			var args, query []string
+			path := fmt.Sprintf("%q", op.path)
+			if op.pathParam != "" {
+				name := javaName(words(op.pathParam))
+				args = append(args, "String "+name)
+				path = fmt.Sprintf("path(%s)", name)
+				if prefix := strings.TrimSuffix(op.path[:strings.Index(op.path, "{")], "/"); prefix != "" {
+					path = fmt.Sprintf("%q + %s", prefix, path)
+				}
+			}
+			for _, param := range op.query {
+				name := javaName(words(param))
+				args = append(args, "String "+name)
+				query = append(query, fmt.Sprintf("%q, %s", param, name))
+			}
+			body := "null, null"
+			if op.body {
+				args = append(args, "byte[] body", "String contentType")
+				body = "body, contentType"
+			}
+			fmt.Fprintf(&b, "\n        /** %s */\n", strings.Replace(op.doc, "*/", "*&#47;", -1))
+			fmt.Fprintf(&b, "        public Response %s(%s) throws IOException {\n", javaName(op.name), strings.Join(args, ", "))
+			fmt.Fprintf(&b, "            return send(%q, %s, new String[] {%s}, %s);\n        }\n", op.method, path, strings.Join(query, ", "), body)
+		}
+		b.WriteString("    }\n")
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
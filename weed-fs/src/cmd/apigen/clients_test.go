@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testDocuments() map[string]map[string]map[string]*operation {
+	param := func(name string, in string) parameter {
+		return parameter{Name: name, In: in, Schema: map[string]string{"type": "string"}}
+	}
+	return map[string]map[string]map[string]*operation{
+		"master": {
+			"/dir/assign": {"get": {Parameters: []parameter{param("callback", "query"), param("count", "query"), param("diskType", "query")}}},
+		},
+		"filer": {
+			"/{path}": {
+				"get":  {Parameters: []parameter{param("path", "path"), param("lastFileName", "query")}},
+				"post": {Summary: "Uploads a file", Parameters: []parameter{param("path", "path"), param("mv.from", "query")}},
+			},
+			"/search": {"get": {Role: "monitor", Parameters: []parameter{param("from", "query"), param("q", "query")}}},
+		},
+	}
+}
+
+func TestClientOperations(t *testing.T) {
+	var names []string
+	for _, op := range clientOperations(testDocuments()["filer"]) {
+		names = append(names, pythonName(op.name)+"/"+javaName(op.name)+" "+op.doc)
+	}
+	expected := "search/search GET /search. Needs the role monitor.," +
+		"get_path/getPath GET /{path}.," +
+		"post_path/postPath POST /{path}: Uploads a file."
+	if strings.Join(names, ",") != expected {
+		t.Error("the operations are", names)
+	}
+	for name, expected := range map[string]string{"mv.from": "mv_from", "lastFileName": "last_file_name", "from": "from_", "user.name": "user_name"} {
+		if got := pythonName(words(name)); got != expected {
+			t.Error(name, "is named", got)
+		}
+	}
+	if got := javaName(words("mv.from")); got != "mvFrom" {
+		t.Error("mv.from is named", got)
+	}
+	java := string(javaClient(testDocuments()))
+	for _, method := range []string{
+		"public Response dirAssign(String count, String diskType) throws IOException",
+		"public Response postPath(String path, String mvFrom, byte[] body, String contentType) throws IOException",
+		`send("GET", path(path), new String[] {"lastFileName", lastFileName}, null, null)`,
+	} {
+		if !strings.Contains(java, method) {
+			t.Error("the java client lacks", method)
+		}
+	}
+}
+
+func TestPythonClient(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not installed")
+	}
+	dir, err := ioutil.TempDir("", "weedfs_apigen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "weedfs_client.py"), pythonClient(testDocuments()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(`{"request": "` + r.Method + " " + r.URL.EscapedPath() + "?" + r.URL.RawQuery + " " + string(body) + `"}`))
+	}))
+	defer server.Close()
+	script := `
+import sys
+from weedfs_client import Filer, Master, WeedError
+print(Master(sys.argv[1]).dir_assign(count=2).json()["request"])
+filer = Filer(sys.argv[1])
+print(filer.post_path("/photos/a b.jpg", mv_from="/old/a.jpg", body=b"data").json()["request"])
+print(filer.get_path("photos/", last_file_name="a").json()["request"])
+try:
+    filer.get_path("missing")
+except WeedError as e:
+    print(e.response.status)
+`
+	cmd := exec.Command(python, "-c", script, strings.TrimPrefix(server.URL, "http://"))
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(err, string(out))
+	}
+	expected := "GET /dir/assign?count=2 \n" +
+		"POST /photos/a%20b.jpg?mv.from=%2Fold%2Fa.jpg data\n" +
+		"GET /photos/?lastFileName=a \n" +
+		"404\n"
+	if string(out) != expected {
+		t.Errorf("the python client sent\n%s", out)
+	}
+}
@@ -0,0 +1,455 @@
+// apigen generates the OpenAPI documents of the master, volume and filer
+// servers from the routes they register and from their handlers, into a Go
+// file of cmd/weed served at /openapi.json. It is run by go generate in
+// cmd/weed, which also generates the Python and Java clients of the servers
+// from the documents into -clients; with -check, it only fails if the
+// generated files are out of date.
+//
+// Each route registered with mux.HandleFunc in runMaster, runVolume or runFiler
+// is an operation. Its summary is the first sentence of the doc comment of the
+// handler, and its methods are the ones the doc comment shows, e.g.
+// "//   POST /vol/grow?count=2", or the cases of a switch on r.Method, and GET
+// otherwise. Its query parameters are the ones the handler reads, and the
+// functions it passes the request to, with r.FormValue, r.URL.Query().Get or
+// r.Form[...]. The roles of requireRole and audited are kept as x-weed-role and
+// x-weed-audited.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	dir     = flag.String("dir", ".", "folder of the cmd/weed sources")
+	out     = flag.String("out", "openapi_generated.go", "generated file, in -dir")
+	clients = flag.String("clients", "../../../clients", "folder of the generated clients, relative to -dir")
+	check   = flag.Bool("check", false, "only check that the generated files are up to date")
+)
+
+// servers are the functions registering the routes of each server.
+var servers = map[string]string{"runMaster": "master", "runVolume": "volume", "runFiler": "filer"}
+
+// pathParameters names the part of the path after the prefix routes.
+var pathParameters = map[string]string{"volume /": "fid", "master /get/": "fid", "filer /": "path", "filer /webhdfs/v1/": "path"}
+
+var docMethod = regexp.MustCompile(`^\s+(GET|POST|PUT|DELETE|HEAD)\s+/`)
+
+type operation struct {
+	Summary    string              `json:"summary,omitempty"`
+	Parameters []parameter         `json:"parameters,omitempty"`
+	Responses  map[string]response `json:"responses"`
+	Role       string              `json:"x-weed-role,omitempty"`
+	Audited    bool                `json:"x-weed-audited,omitempty"`
+}
+
+type parameter struct {
+	Name     string            `json:"name"`
+	In       string            `json:"in"`
+	Required bool              `json:"required,omitempty"`
+	Schema   map[string]string `json:"schema"`
+}
+
+type response struct {
+	Description string `json:"description"`
+}
+
+type generator struct {
+	fset  *token.FileSet
+	funcs map[string]*ast.FuncDecl
+}
+
+func main() {
+	flag.Parse()
+	g := &generator{fset: token.NewFileSet(), funcs: make(map[string]*ast.FuncDecl)}
+	files, err := filepath.Glob(filepath.Join(*dir, "*.go"))
+	if err != nil {
+		fail(err)
+	}
+	var parsed []*ast.File
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") || filepath.Base(name) == *out {
+			continue
+		}
+		f, err := parser.ParseFile(g.fset, name, nil, parser.ParseComments)
+		if err != nil {
+			fail(err)
+		}
+		parsed = append(parsed, f)
+		for _, d := range f.Decls {
+			if fd, ok := d.(*ast.FuncDecl); ok && fd.Recv == nil {
+				g.funcs[fd.Name.Name] = fd
+			}
+		}
+	}
+
+	documents := make(map[string]map[string]map[string]*operation)
+	for run, server := range servers {
+		if fd := g.funcs[run]; fd != nil {
+			documents[server] = g.routes(server, fd)
+		}
+	}
+	var b bytes.Buffer
+	b.WriteString("// Code generated by apigen from the routes and the handlers of cmd/weed. DO NOT EDIT.\n\npackage main\n\n")
+	b.WriteString("// openapiDocuments are the OpenAPI documents of the servers, without their version.\n")
+	b.WriteString("var openapiDocuments = map[string]string{\n")
+	names := make([]string, 0, len(documents))
+	for server := range documents {
+		names = append(names, server)
+	}
+	sort.Strings(names)
+	for _, server := range names {
+		doc := map[string]interface{}{
+			"openapi": "3.0.3",
+			"info":    map[string]string{"title": "weed " + server, "version": ""},
+			"paths":   documents[server],
+		}
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			fail(err)
+		}
+		literal := "`" + string(data) + "`"
+		if bytes.ContainsRune(data, '`') {
+			literal = strconv.Quote(string(data))
+		}
+		fmt.Fprintf(&b, "\t%q: %s,\n", server, literal)
+	}
+	b.WriteString("}\n")
+
+	generated := map[string][]byte{
+		filepath.Join(*dir, *out):                                                                 b.Bytes(),
+		filepath.Join(*dir, *clients, "python", "weedfs_client.py"):                               pythonClient(documents),
+		filepath.Join(*dir, *clients, "java", "src", "main", "java", "weedfs", "WeedClient.java"): javaClient(documents),
+	}
+	for target, data := range generated {
+		if *check {
+			if existing, err := ioutil.ReadFile(target); err != nil || !bytes.Equal(existing, data) {
+				fail(fmt.Errorf("%s is out of date, run go generate in cmd/weed", target))
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			fail(err)
+		}
+		if err := ioutil.WriteFile(target, data, 0644); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "apigen:", err)
+	os.Exit(1)
+}
+
+// routes finds the mux.HandleFunc calls of the function registering the routes of the server.
+func (g *generator) routes(server string, run *ast.FuncDecl) map[string]map[string]*operation {
+	paths := make(map[string]map[string]*operation)
+	ast.Inspect(run.Body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "HandleFunc" {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		route, _ := strconv.Unquote(lit.Value)
+		path, pathParameter := route, ""
+		if name, ok := pathParameters[server+" "+route]; ok {
+			path, pathParameter = route+"{"+name+"}", name
+		}
+		h := &handlerInfo{}
+		g.unwrap(call.Args[1], h)
+		operations := make(map[string]*operation)
+		for method, params := range h.methods(g) {
+			op := &operation{Summary: h.summary, Role: h.role, Audited: h.audited, Responses: map[string]response{"200": {"OK"}}}
+			if pathParameter != "" {
+				op.Parameters = append(op.Parameters, parameter{Name: pathParameter, In: "path", Required: true, Schema: map[string]string{"type": "string"}})
+			}
+			for _, p := range params {
+				op.Parameters = append(op.Parameters, parameter{Name: p, In: "query", Schema: map[string]string{"type": "string"}})
+			}
+			operations[strings.ToLower(method)] = op
+		}
+		paths[path] = operations
+		return true
+	})
+	return paths
+}
+
+// handlerInfo is what the wrappers of a handler tell about it, and the handler itself.
+type handlerInfo struct {
+	role    string
+	audited bool
+	summary string
+	fn      *ast.FuncType
+	body    *ast.BlockStmt
+	doc     *ast.CommentGroup
+}
+
+// unwrap follows requireRole(role, h), audited(log, h) and the functions
+// returning a handler down to the handler.
+func (g *generator) unwrap(e ast.Expr, h *handlerInfo) bool {
+	switch e := e.(type) {
+	case *ast.Ident:
+		fd := g.funcs[e.Name]
+		if fd == nil || !isHandler(fd.Type) {
+			return false
+		}
+		h.fn, h.body, h.doc = fd.Type, fd.Body, fd.Doc
+		h.summary = summary(fd.Name.Name, fd.Doc)
+		return true
+	case *ast.FuncLit:
+		if !isHandler(e.Type) {
+			return false
+		}
+		h.fn, h.body = e.Type, e.Body
+		return true
+	case *ast.CallExpr:
+		name := ""
+		if id, ok := e.Fun.(*ast.Ident); ok {
+			name = id.Name
+		}
+		switch name {
+		case "requireRole":
+			h.role = roleName(e.Args[0])
+		case "audited":
+			h.audited = true
+		}
+		for i := len(e.Args) - 1; i >= 0; i-- {
+			if g.unwrap(e.Args[i], h) {
+				return true
+			}
+		}
+		// a function returning the handler, e.g. auditHandler(masterAuditLog)
+		if fd := g.funcs[name]; fd != nil {
+			found := false
+			ast.Inspect(fd.Body, func(n ast.Node) bool {
+				if ret, ok := n.(*ast.ReturnStmt); ok && !found && len(ret.Results) == 1 {
+					if lit, ok := ret.Results[0].(*ast.FuncLit); ok && g.unwrap(lit, h) {
+						found = true
+					}
+				}
+				return !found
+			})
+			if found {
+				h.doc, h.summary = fd.Doc, summary(fd.Name.Name, fd.Doc)
+			}
+			return found
+		}
+	}
+	return false
+}
+
+func roleName(e ast.Expr) string {
+	switch e := e.(type) {
+	case *ast.Ident:
+		return strings.ToLower(strings.TrimPrefix(e.Name, "role"))
+	case *ast.BinaryExpr:
+		return roleName(e.X) + "|" + roleName(e.Y)
+	}
+	return ""
+}
+
+// isHandler tells if the function takes an http.ResponseWriter and an *http.Request.
+func isHandler(t *ast.FuncType) bool {
+	return len(t.Params.List) == 2 && requestName(t) != "" && t.Results == nil
+}
+
+// requestName is the name of the *http.Request parameter of the function, or "".
+func requestName(t *ast.FuncType) string {
+	for _, field := range t.Params.List {
+		star, ok := field.Type.(*ast.StarExpr)
+		if !ok {
+			continue
+		}
+		if sel, ok := star.X.(*ast.SelectorExpr); ok && sel.Sel.Name == "Request" && len(field.Names) == 1 {
+			return field.Names[0].Name
+		}
+	}
+	return ""
+}
+
+// summary is the first sentence of the doc comment, without the function name.
+func summary(name string, doc *ast.CommentGroup) string {
+	if doc == nil {
+		return ""
+	}
+	var words []string
+	for _, line := range strings.Split(doc.Text(), "\n") {
+		if strings.TrimSpace(line) == "" || docMethod.MatchString(line) {
+			break
+		}
+		words = append(words, strings.Fields(line)...)
+	}
+	text := strings.Join(words, " ")
+	// up to the first ". " followed by a capital, not the one of "e.g. "
+	for i := 0; ; i += 2 {
+		j := strings.Index(text[i:], ". ")
+		if j < 0 {
+			break
+		}
+		if i += j; text[i+2] >= 'A' && text[i+2] <= 'Z' {
+			text = text[:i]
+			break
+		}
+	}
+	text = strings.TrimSuffix(strings.TrimSuffix(text, ":"), ".")
+	text = strings.TrimPrefix(text, name+" ")
+	if text == "" {
+		return ""
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+// methods maps the methods of the handler to its query parameters.
+func (h *handlerInfo) methods(g *generator) map[string][]string {
+	if h.body == nil {
+		return map[string][]string{"GET": nil}
+	}
+	r := requestName(h.fn)
+	methods := make(map[string][]string)
+	// a switch on r.Method dispatching to other handlers
+	ast.Inspect(h.body, func(n ast.Node) bool {
+		sw, ok := n.(*ast.SwitchStmt)
+		if !ok || !isSelector(sw.Tag, r, "Method") {
+			return true
+		}
+		for _, stmt := range sw.Body.List {
+			clause := stmt.(*ast.CaseClause)
+			params := g.parameters(&ast.BlockStmt{List: clause.Body}, r, map[string]bool{})
+			for _, e := range clause.List {
+				if lit, ok := e.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					method, _ := strconv.Unquote(lit.Value)
+					methods[method] = params
+				}
+			}
+		}
+		return false
+	})
+	if len(methods) > 0 {
+		return methods
+	}
+	params := g.parameters(h.body, r, map[string]bool{})
+	if h.doc != nil {
+		for _, line := range strings.Split(h.doc.Text(), "\n") {
+			if m := docMethod.FindStringSubmatch(line); m != nil {
+				methods[m[1]] = params
+			}
+		}
+	}
+	if len(methods) == 0 {
+		methods["GET"] = params
+	}
+	return methods
+}
+
+// parameters lists the query parameters read from the request named r in the
+// body, and in the functions of the package the request is passed to.
+func (g *generator) parameters(body *ast.BlockStmt, r string, visited map[string]bool) []string {
+	seen := make(map[string]bool)
+	var params []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			params = append(params, name)
+		}
+	}
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			if sel, ok := n.Fun.(*ast.SelectorExpr); ok && len(n.Args) == 1 {
+				name := stringLiteral(n.Args[0])
+				switch {
+				case name == "":
+				case (sel.Sel.Name == "FormValue" || sel.Sel.Name == "PostFormValue") && isIdent(sel.X, r):
+					add(name)
+				case sel.Sel.Name == "Get" && isQuery(sel.X, r):
+					add(name)
+				}
+			}
+			// the request passed on to another function of the package
+			if id, ok := n.Fun.(*ast.Ident); ok && !visited[id.Name] {
+				if fd := g.funcs[id.Name]; fd != nil {
+					for i, arg := range n.Args {
+						if isIdent(arg, r) {
+							if name := paramName(fd.Type, i); name != "" {
+								visited[id.Name] = true
+								for _, p := range g.parameters(fd.Body, name, visited) {
+									add(p)
+								}
+							}
+						}
+					}
+				}
+			}
+		case *ast.IndexExpr:
+			if isSelector(n.X, r, "Form") {
+				if name := stringLiteral(n.Index); name != "" {
+					add(name)
+				}
+			}
+		}
+		return true
+	})
+	sort.Strings(params)
+	return params
+}
+
+func paramName(t *ast.FuncType, index int) string {
+	i := 0
+	for _, field := range t.Params.List {
+		for _, name := range field.Names {
+			if i == index {
+				return name.Name
+			}
+			i++
+		}
+	}
+	return ""
+}
+
+func stringLiteral(e ast.Expr) string {
+	if lit, ok := e.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+		s, _ := strconv.Unquote(lit.Value)
+		return s
+	}
+	return ""
+}
+
+func isIdent(e ast.Expr, name string) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == name
+}
+
+func isSelector(e ast.Expr, x string, field string) bool {
+	sel, ok := e.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == field && isIdent(sel.X, x)
+}
+
+// isQuery matches r.URL.Query().
+func isQuery(e ast.Expr, r string) bool {
+	call, ok := e.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "Query" && isSelector(sel.X, r, "URL")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+const testSource = `package main
+
+func runMaster() {
+	mux.HandleFunc("/dir/assign", dirAssignHandler)
+	mux.HandleFunc("/vol/grow", requireRole(roleAdmin, audited(masterAudit, volumeGrowHandler)))
+	mux.HandleFunc("/get/", redirectHandler)
+	mux.HandleFunc("/vol/status", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/submit", submitHandler)
+}
+
+// dirAssignHandler assigns a file id, e.g. 3,01637037d6. The rest is not the summary.
+func dirAssignHandler(w http.ResponseWriter, r *http.Request) {
+	count := r.FormValue("count")
+	if r.URL.Query().Get("replication") != "" {
+		assignIn(r, count)
+	}
+}
+
+func assignIn(req *http.Request, count string) {
+	_ = req.Form["dataCenter"]
+}
+
+// volumeGrowHandler grows the volumes:
+//
+//	POST /vol/grow?count=2
+func volumeGrowHandler(w http.ResponseWriter, r *http.Request) {
+	r.FormValue("count")
+}
+
+func redirectHandler(w http.ResponseWriter, r *http.Request) {}
+
+func submitHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "PUT":
+		r.FormValue("collection")
+	case "DELETE":
+	}
+}
+`
+
+func TestRoutes(t *testing.T) {
+	g := &generator{fset: token.NewFileSet(), funcs: make(map[string]*ast.FuncDecl)}
+	f, err := parser.ParseFile(g.fset, "master.go", testSource, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range f.Decls {
+		if fd, ok := d.(*ast.FuncDecl); ok {
+			g.funcs[fd.Name.Name] = fd
+		}
+	}
+	data, _ := json.Marshal(g.routes("master", g.funcs["runMaster"]))
+	var paths map[string]map[string]struct {
+		Summary    string
+		Parameters []parameter
+		Role       string `json:"x-weed-role"`
+		Audited    bool   `json:"x-weed-audited"`
+	}
+	json.Unmarshal(data, &paths)
+	names := func(params []parameter) (s string) {
+		for _, p := range params {
+			s += p.In + ":" + p.Name + " "
+		}
+		return
+	}
+
+	assign := paths["/dir/assign"]["get"]
+	if assign.Summary != "Assigns a file id, e.g. 3,01637037d6" {
+		t.Error("the summary is", assign.Summary)
+	}
+	if s := names(assign.Parameters); s != "query:count query:dataCenter query:replication " {
+		t.Error("the parameters of /dir/assign are", s)
+	}
+	grow, ok := paths["/vol/grow"]["post"]
+	if !ok || len(paths["/vol/grow"]) != 1 || grow.Role != "admin" || !grow.Audited || grow.Summary != "Grows the volumes" {
+		t.Error("/vol/grow is", paths["/vol/grow"])
+	}
+	if get, ok := paths["/get/{fid}"]["get"]; !ok || names(get.Parameters) != "path:fid " {
+		t.Error("/get/ is", paths["/get/{fid}"])
+	}
+	if _, ok := paths["/vol/status"]["get"]; !ok {
+		t.Error("/vol/status is", paths["/vol/status"])
+	}
+	submit := paths["/submit"]
+	if len(submit) != 3 || names(submit["put"].Parameters) != "query:collection " || len(submit["delete"].Parameters) != 0 {
+		t.Error("/submit is", submit)
+	}
+}
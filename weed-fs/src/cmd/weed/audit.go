@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"pkg/util"
+	"strconv"
+	"time"
+)
+
+// The admin operations changing the cluster, e.g. deleting a collection or a
+// volume, draining a volume server or changing settings, are recorded in the
+// audit.log of the master -mdir, or of the first volume server -dir, and listed
+// with /audit on the master, or /admin/audit on a volume server:
+//
+//   GET /audit?since=1700000000&limit=100
+//   {"entries":[{"Time":"...","Principal":"admin","RemoteAddr":"10.0.0.3:52314",
+//     "Operation":"/ui/action","Params":{"action":"drain","node":"10.0.0.5:8080"},"Status":303}]}
+
+// statusRecorder keeps the status the handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// audited records each call of the admin handler in the audit log, once it is handled.
+func audited(auditLog *util.AuditLog, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(recorder, r)
+		r.ParseForm()
+		params := make(map[string]string)
+		for name := range r.Form {
+			params[name] = r.Form.Get(name)
+		}
+		principal := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			principal = host
+		}
+		if user, _, ok := r.BasicAuth(); ok {
+			principal = user
+		}
+		if p := requestPrincipal(r); p != nil {
+			principal = p.name
+		}
+		recordAudit(auditLog, &util.AuditEntry{Principal: principal, RemoteAddr: r.RemoteAddr, Operation: r.URL.Path, Params: params, Status: recorder.status})
+	}
+}
+
+func recordAudit(auditLog *util.AuditLog, entry *util.AuditEntry) {
+	entry.Time = time.Now()
+	if err := auditLog.Record(entry); err != nil {
+		log.Println("Failed to record admin operation", entry.Operation, "in the audit log:", err)
+	}
+}
+
+func auditHandler(auditLog *util.AuditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var since time.Time
+		if seconds, err := strconv.ParseInt(r.FormValue("since"), 10, 64); err == nil {
+			since = time.Unix(seconds, 0)
+		}
+		limit, err := strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		entries, err := auditLog.Entries(since, limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			writeJson(w, r, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJson(w, r, map[string]interface{}{"entries": entries})
+	}
+}
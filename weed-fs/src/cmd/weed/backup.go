@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"pkg/topology"
+	"strconv"
+)
+
+func init() {
+	cmdBackup.Run = runBackup // break init cycle
+	IsDebug = cmdBackup.Flag.Bool("debug", false, "enable debug mode")
+}
+
+var cmdBackup = &Command{
+	UsageLine: "backup -dir=/tmp -volumeId=234 -target=/mnt/backup",
+	Short:     "incrementally back up a volume to a remote path",
+	Long: `Backup copies the .idx and .dat files of a volume to the target folder,
+  which is usually a remote storage mounted locally, e.g., an S3 bucket via s3fs.
+  If the volume was backed up to the target before, only the part appended
+  since the last backup is copied. If the volume has been compacted since,
+  the files are copied again entirely. The .key file of an encrypted volume is
+  copied too, still wrapped with the master key of the volume server.
+
+  With -snapshot=nightly, the volumes of a snapshot taken on the master with
+  /vol/snapshot?name=nightly are backed up instead, each up to its cut point,
+  so together they make a consistent copy of the cluster. Run it on each volume
+  server, with its -dir, and -server set to its address; it backs up the volumes
+  the manifest lists on it, and saves the manifest as nightly.snapshot.json in
+  the target. Release the snapshot on the master once all of them are done.
+
+  `,
+}
+
+var (
+	backupDir        = cmdBackup.Flag.String("dir", "/tmp", "data directory of the volume")
+	backupVolumeId   = cmdBackup.Flag.Int("volumeId", -1, "a non-negative volume id. The volume should already exist in the dir.")
+	backupTarget     = cmdBackup.Flag.String("target", "", "backup folder, usually a mounted remote storage")
+	backupCollection = cmdBackup.Flag.String("collection", "", "collection of the volume, if any")
+	backupSnapshot   = cmdBackup.Flag.String("snapshot", "", "back up the volumes of this snapshot, instead of -volumeId")
+	backupMaster     = cmdBackup.Flag.String("master", "localhost:9333", "master with the snapshot manifest")
+	backupServer     = cmdBackup.Flag.String("server", "localhost:8080", "address of the volume server of -dir, as the master knows it")
+)
+
+func runBackup(cmd *Command, args []string) bool {
+	if *backupSnapshot != "" && *backupTarget != "" {
+		return runSnapshotBackup()
+	}
+	if *backupVolumeId == -1 || *backupTarget == "" {
+		return false
+	}
+	fileName := volumeFileName(*backupCollection, *backupVolumeId)
+	//index first, so that every backed up index entry points to backed up data
+	for _, ext := range []string{".key", ".idx", ".dat"} {
+		copied, err := copyVolumeFile(path.Join(*backupDir, fileName+ext), path.Join(*backupTarget, fileName+ext), -1)
+		if ext == ".key" && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Backup Volume [ERROR] %s\n", err)
+		}
+		fmt.Println("Backed up", fileName+ext, "to", *backupTarget, "copied", copied, "bytes")
+	}
+	return true
+}
+
+// runSnapshotBackup copies the volumes of the snapshot on this volume server up to their cuts.
+func runSnapshotBackup() bool {
+	var s topology.Snapshot
+	if err := getJson("http://"+*backupMaster+"/vol/snapshot/manifest?name="+*backupSnapshot, &s); err != nil {
+		log.Fatalf("Backup Snapshot [ERROR] %s\n", err)
+	}
+	if s.Name == "" {
+		log.Fatalf("Backup Snapshot [ERROR] snapshot %s is not found on %s\n", *backupSnapshot, *backupMaster)
+	}
+	count := 0
+	for _, v := range s.Volumes {
+		if v.Url != *backupServer {
+			continue
+		}
+		fileName := volumeFileName(v.Collection, int(v.Id))
+		sizes := map[string]int64{".key": -1, ".idx": v.IndexSize, ".dat": v.DataSize}
+		for _, ext := range []string{".key", ".idx", ".dat"} {
+			copied, err := copyVolumeFile(path.Join(*backupDir, fileName+ext), path.Join(*backupTarget, fileName+ext), sizes[ext])
+			if ext == ".key" && os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				log.Fatalf("Backup Volume %d of snapshot %s [ERROR] %s\n", v.Id, s.Name, err)
+			}
+			debug("Backed up", fileName+ext, "to", *backupTarget, "copied", copied, "bytes")
+		}
+		count++
+	}
+	data, _ := json.MarshalIndent(&s, "", "  ")
+	if err := ioutil.WriteFile(path.Join(*backupTarget, s.Name+".snapshot.json"), data, 0644); err != nil {
+		log.Fatalf("Backup Snapshot [ERROR] %s\n", err)
+	}
+	fmt.Println("Backed up", count, "volumes of snapshot", s.Name, "from", *backupServer, "to", *backupTarget)
+	return true
+}
+
+// volumeFileName is the volume file name without the extension,
+// the same as storage.Volume.FileName() without the directory.
+func volumeFileName(collection string, volumeId int) string {
+	if collection == "" {
+		return strconv.Itoa(volumeId)
+	}
+	return collection + "_" + strconv.Itoa(volumeId)
+}
+
+// copyVolumeFile appends to dst the part of src after dst's current length,
+// up to size bytes of src, or all of it if size is negative.
+// If dst is not a prefix of src any more, dst is rewritten entirely.
+func copyVolumeFile(src, dst string, size int64) (int64, error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+	dstFile, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer dstFile.Close()
+	srcStat, err := srcFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	dstStat, err := dstFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		size = srcStat.Size()
+	} else if size > srcStat.Size() {
+		return 0, errors.New(src + " is shorter than the cut of the snapshot, it was vacuumed since")
+	}
+	offset := dstStat.Size()
+	if offset > size || !hasSameTail(srcFile, dstFile, offset) {
+		debug("full copy of", src, "to", dst)
+		offset = 0
+		if err = dstFile.Truncate(0); err != nil {
+			return 0, err
+		}
+	}
+	if _, err = srcFile.Seek(offset, 0); err != nil {
+		return 0, err
+	}
+	if _, err = dstFile.Seek(offset, 0); err != nil {
+		return 0, err
+	}
+	return io.CopyN(dstFile, srcFile, size-offset)
+}
+
+func hasSameTail(a, b *os.File, offset int64) bool {
+	size := int64(4096)
+	if offset < size {
+		size = offset
+	}
+	bufA, bufB := make([]byte, size), make([]byte, size)
+	if _, err := a.ReadAt(bufA, offset-size); err != nil {
+		return false
+	}
+	if _, err := b.ReadAt(bufB, offset-size); err != nil {
+		return false
+	}
+	return bytes.Equal(bufA, bufB)
+}
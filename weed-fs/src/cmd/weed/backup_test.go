@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"pkg/storage"
+	"pkg/topology"
+	"pkg/util"
+	"strings"
+	"testing"
+)
+
+func writeTestNeedle(t *testing.T, s *storage.Store, vid storage.VolumeId, fid string, data []byte) {
+	n := new(storage.Needle)
+	n.ParsePath(fid)
+	n.Data = data
+	n.Checksum = storage.NewCRC(n.Data)
+	if _, err := s.Write(vid, n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weedfs_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source, target := path.Join(dir, "source"), path.Join(dir, "target")
+	os.Mkdir(source, 0755)
+	os.Mkdir(target, 0755)
+	s := storage.NewStore(0, "", "", []string{source}, []int{1})
+	defer s.Close()
+	if err = s.AddVolume("7", "", "000"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestNeedle(t, s, 7, "01637037d6", bytes.Repeat([]byte("a"), 8192))
+	writeTestNeedle(t, s, 7, "02637037d6", bytes.Repeat([]byte("b"), 8192))
+
+	defer func(d, target, collection string, vid int) {
+		*backupDir, *backupTarget, *backupCollection, *backupVolumeId = d, target, collection, vid
+	}(*backupDir, *backupTarget, *backupCollection, *backupVolumeId)
+	*backupDir, *backupTarget, *backupCollection, *backupVolumeId = source, target, "", 7
+	sameFiles := func(ext string) bool {
+		a, _ := ioutil.ReadFile(path.Join(source, "7"+ext))
+		b, _ := ioutil.ReadFile(path.Join(target, "7"+ext))
+		return len(a) > 0 && bytes.Equal(a, b)
+	}
+
+	if !runBackup(cmdBackup, nil) {
+		t.Fatal("the backup did not run")
+	}
+	if !sameFiles(".dat") || !sameFiles(".idx") {
+		t.Fatal("the first backup is not a full copy")
+	}
+
+	// mark the backed up data, a full copy would overwrite the mark
+	dat, err := os.OpenFile(path.Join(target, "7.dat"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := dat.Stat()
+	backedUp := stat.Size()
+	dat.WriteAt([]byte("X"), 100)
+	dat.Close()
+
+	// a new needle, and a changed one, which is appended too
+	writeTestNeedle(t, s, 7, "03637037d6", []byte("new"))
+	writeTestNeedle(t, s, 7, "01637037d6", []byte("changed"))
+	copied, err := copyVolumeFile(path.Join(source, "7.dat"), path.Join(target, "7.dat"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceData, _ := ioutil.ReadFile(path.Join(source, "7.dat"))
+	targetData, _ := ioutil.ReadFile(path.Join(target, "7.dat"))
+	if copied != int64(len(sourceData))-backedUp || len(targetData) != len(sourceData) {
+		t.Fatal("copied", copied, "bytes after", backedUp, "of", len(sourceData))
+	}
+	if targetData[100] != 'X' || !bytes.Equal(targetData[backedUp:], sourceData[backedUp:]) {
+		t.Error("the backup was not only appended to")
+	}
+	if !runBackup(cmdBackup, nil) || !sameFiles(".idx") {
+		t.Error("the index is not backed up")
+	}
+
+	// once the backup is no longer a prefix of the volume, it is copied again
+	ioutil.WriteFile(path.Join(target, "7.dat"), bytes.Repeat([]byte("Y"), 5000), 0644)
+	if !runBackup(cmdBackup, nil) || !sameFiles(".dat") {
+		t.Error("a changed backup is not copied again")
+	}
+}
+
+func TestRestoreRegistersTheVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weedfs_restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backup, data := path.Join(dir, "backup"), path.Join(dir, "data")
+	os.Mkdir(backup, 0755)
+	os.Mkdir(data, 0755)
+	backedUp := storage.NewStore(0, "", "", []string{backup}, []int{1})
+	if err = backedUp.AddVolume("7", "", "000"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestNeedle(t, backedUp, 7, "01637037d6", []byte("restored content"))
+	backedUp.Close()
+
+	// the master
+	defer func(previous *topology.Topology) { topo = previous }(topo)
+	defer func(latency *util.LatencyStats) { masterLatency = latency }(masterLatency)
+	topo = topology.NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	masterLatency = util.NewLatencyStats(nil)
+	masterMux := http.NewServeMux()
+	masterMux.HandleFunc("/dir/join", dirJoinHandler)
+	master := httptest.NewServer(masterMux)
+	defer master.Close()
+
+	// the volume server, without the volume
+	defer func(previous *storage.Store) { store = previous }(store)
+	store = storage.NewStore(8080, "127.0.0.1", "", []string{data}, []int{1})
+	defer store.Close()
+	volumeMux := http.NewServeMux()
+	volumeMux.HandleFunc("/admin/assign_volume", assignVolumeHandler)
+	volumeServer := httptest.NewServer(volumeMux)
+	defer volumeServer.Close()
+
+	defer func(target, d, server, collection string, vid int) {
+		*restoreTarget, *restoreDir, *restoreVolumeServer, *restoreCollection, *restoreVolumeId = target, d, server, collection, vid
+	}(*restoreTarget, *restoreDir, *restoreVolumeServer, *restoreCollection, *restoreVolumeId)
+	*restoreTarget, *restoreDir, *restoreCollection, *restoreVolumeId = backup, data, "", 7
+	*restoreVolumeServer = strings.TrimPrefix(volumeServer.URL, "http://")
+	if !runRestore(cmdRestore, nil) {
+		t.Fatal("the restore did not run")
+	}
+	if !store.HasVolume(7) {
+		t.Fatal("the restored volume is not loaded")
+	}
+	n := new(storage.Needle)
+	n.ParsePath("01637037d6")
+	if _, err = store.Read(7, n); err != nil || string(n.Data) != "restored content" {
+		t.Error("read the restored needle", err, string(n.Data))
+	}
+
+	// the next heartbeat registers the restored volume with the master
+	if err = store.Join(strings.TrimPrefix(master.URL, "http://")); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	dirLookupHandler(w, httptest.NewRequest("GET", "/dir/lookup?volumeId=7", nil))
+	var reply struct{ Locations []map[string]string }
+	if err = json.Unmarshal(w.Body.Bytes(), &reply); err != nil || len(reply.Locations) != 1 || reply.Locations[0]["url"] != "127.0.0.1:8080" {
+		t.Error("the master looks up the restored volume at", w.Code, w.Body.String())
+	}
+}
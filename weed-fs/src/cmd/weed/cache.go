@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"pkg/directory"
+	"pkg/operation"
+	"pkg/storage"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	cmdCache.Run = runCache // break init cycle
+	IsDebug = cmdCache.Flag.Bool("debug", false, "enable debug mode")
+}
+
+var cmdCache = &Command{
+	UsageLine: "cache -port=8090 -master=localhost:9333 -cacheMB=1024",
+	Short:     "start a read-through cache volume server",
+	Long: `start a volume server that holds no volumes of its own, but caches the files
+  read through it, e.g. at an edge site serving a remote weed-fs cluster.
+
+  GET /3,01637037d6.jpg  serve the file from the cache, or on a miss look up the volume
+                         on the master, read the file from a replica, and cache it
+
+  Files are cached by file id and extension, and the least recently read ones are evicted after
+  -cacheMB. Files larger than -cacheMB are streamed from the cluster without being cached.
+  Concurrent misses of the same file share one read from the cluster. Writes and deletes should
+  go to the cluster directly; a deleted file can still be served from the cache until it is
+  evicted. /stats shows the cache hits, and the reads from the cluster.
+
+  `,
+}
+
+var (
+	cport        = cmdCache.Flag.Int("port", 8090, "http listen port")
+	cacheMaster  = cmdCache.Flag.String("master", "localhost:9333", "master server of the cluster being cached")
+	cacheMB      = cmdCache.Flag.Int("cacheMB", 1024, "memory in MB to keep the cached files")
+	cReadTimeout = cmdCache.Flag.Int("readTimeout", 5, "connection read timeout in seconds")
+	cSecureKey   = cmdCache.Flag.String("secureKey", "", "secret shared with the cluster to verify signed urls for reads, and sign the reads from the cluster. Empty disables signing")
+	cCorsOrigins = cmdCache.Flag.String("corsOrigins", "", "comma separated origins allowed for browser based clients, \"*\" for any origin. Empty disables CORS")
+
+	fileCache    *util.LRUCache
+	fileFetches  util.SingleFlight // the misses in flight, shared by the concurrent reads of a file
+	cacheLatency *util.LatencyStats
+
+	cacheHttpOptions = newHttpServerOptions(&cmdCache.Flag)
+)
+
+// cachedFile is a file read from the cluster, always fetched gzipped if the cluster stores it gzipped.
+type cachedFile struct {
+	header http.Header
+	data   []byte
+}
+
+// errFileTooLarge is returned by fetchFile for a file larger than the cache.
+var errFileTooLarge = errors.New("file larger than the cache")
+
+// fetchedFile is the result of a miss, shared by the concurrent reads of the file.
+type fetchedFile struct {
+	file   *cachedFile
+	status int
+}
+
+// cachedHeaders are the response headers kept with a cached file.
+var cachedHeaders = []string{"Content-Type", "Content-Encoding", "Last-Modified", "Cache-Control"}
+
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeJson(w, r, map[string]string{"error": "the cache only serves reads"})
+		return
+	}
+	vid, fid, ext := directory.ParsePath(r.URL.Path)
+	volumeId, err := storage.NewVolumeId(vid)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJson(w, r, map[string]string{"error": "unknown file id " + r.URL.Path[1:]})
+		return
+	}
+	if *cSecureKey != "" {
+		if err := util.VerifyFileIdSignature(*cSecureKey, util.SignedRead, vid+","+fid, r.URL.Query()); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			writeJson(w, r, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	defer cacheLatency.Observe("read", vid+","+fid, time.Now())
+	// the volume servers pick the content type and encoding by the extension, so it is part of the key
+	key := vid + "," + fid + ext
+	var file *cachedFile
+	if cached, ok := fileCache.Get(key); ok {
+		file = cached.(*cachedFile)
+	} else {
+		fetched, _, err := fileFetches.Do(key, func() (interface{}, error) {
+			file, status, err := fetchFile(volumeId, vid+","+fid, ext)
+			if err == nil {
+				fileCache.Set(key, file, int64(len(file.data)))
+			}
+			return &fetchedFile{file: file, status: status}, err
+		})
+		if err == errFileTooLarge {
+			streamFile(w, r, volumeId, vid+","+fid, ext)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(fetched.(*fetchedFile).status)
+			writeJson(w, r, map[string]string{"error": err.Error()})
+			return
+		}
+		file = fetched.(*fetchedFile).file
+	}
+	for name, values := range file.header {
+		w.Header()[name] = values
+	}
+	data := file.data
+	if file.header.Get("Content-Encoding") == "gzip" && !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Del("Content-Encoding")
+		data = storage.UnGzipData(data)
+	}
+	lastModified, _ := time.Parse(http.TimeFormat, file.header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", lastModified, bytes.NewReader(data))
+}
+
+// replicaRequest looks up a random replica of the volume, and returns the
+// request reading the file from it, or the http status to reply with if it fails.
+func replicaRequest(volumeId storage.VolumeId, fileId, ext string) (*http.Request, int, error) {
+	lookup, err := operation.Lookup(*cacheMaster, volumeId)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	if len(lookup.Locations) == 0 {
+		return nil, http.StatusNotFound, errors.New("volume id " + volumeId.String() + " not found")
+	}
+	location := lookup.Locations[rand.Intn(len(lookup.Locations))]
+	fileUrl := directory.FileUrl(location.PublicUrl, fileId, ext)
+	if *cSecureKey != "" {
+		fileUrl += "?" + util.SignFileId(*cSecureKey, util.SignedRead, fileId, time.Now().Unix()+60)
+	}
+	req, err := http.NewRequest("GET", fileUrl, nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return req, http.StatusOK, nil
+}
+
+// fetchFile reads the file from a random replica of the volume, and returns
+// the http status to reply with if it fails. A file larger than the cache is
+// not read, and fails with errFileTooLarge.
+func fetchFile(volumeId storage.VolumeId, fileId, ext string) (*cachedFile, int, error) {
+	req, status, err := replicaRequest(volumeId, fileId, ext)
+	if err != nil {
+		return nil, status, err
+	}
+	// the file is cached as stored, and un-gzipped for clients that do not accept gzip
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, errors.New("reading " + fileId + " from " + req.URL.Host + " got " + resp.Status)
+	}
+	maxSize := int64(*cacheMB) * 1024 * 1024
+	if resp.ContentLength > maxSize {
+		return nil, http.StatusOK, errFileTooLarge
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, http.StatusOK, errFileTooLarge
+	}
+	file := &cachedFile{header: make(http.Header), data: data}
+	for _, name := range cachedHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			file.header.Set(name, value)
+		}
+	}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(name, storage.PairNamePrefix) {
+			file.header[name] = values
+		}
+	}
+	return file, http.StatusOK, nil
+}
+
+// streamFile copies the file from a random replica of the volume to the
+// response, as it is read, for the files too large for the cache.
+func streamFile(w http.ResponseWriter, r *http.Request, volumeId storage.VolumeId, fileId, ext string) {
+	req, status, err := replicaRequest(volumeId, fileId, ext)
+	if err != nil {
+		w.WriteHeader(status)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	for _, name := range []string{"Accept-Encoding", "Range", "If-Modified-Since"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method != "HEAD" {
+		io.Copy(w, resp.Body)
+	}
+}
+
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	m := make(map[string]interface{})
+	m["Version"] = VERSION
+	m["Cache"] = fileCache.ToMap()
+	m["Fetches"] = fileFetches.ToMap()
+	m["Latency"] = cacheLatency.ToMap()
+	writeJson(w, r, m)
+}
+
+func runCache(cmd *Command, args []string) bool {
+	fileCache = util.NewLRUCache(int64(*cacheMB) * 1024 * 1024)
+	cacheLatency = util.NewLatencyStats(map[string]time.Duration{})
+
+	http.HandleFunc("/", cacheHandler)
+	http.HandleFunc("/stats", cacheStatsHandler)
+
+	log.Println("Start Weed cache server", VERSION, "at port", strconv.Itoa(*cport), "for master", *cacheMaster)
+	e := cacheHttpOptions.listenAndServe(*cport, withCors(*cCorsOrigins, http.DefaultServeMux), *cReadTimeout)
+	if e != nil {
+		log.Fatalf("Fail to start:%s", e.Error())
+	}
+	return true
+}
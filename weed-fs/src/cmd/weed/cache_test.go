@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"pkg/util"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheHandlerSharesMissesAndStreamsLargeFiles(t *testing.T) {
+	var reads int32
+	large := strings.Repeat("x", 2*1024*1024)
+	volumeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reads, 1)
+		time.Sleep(50 * time.Millisecond)
+		if r.URL.Path == "/3,02637037d6" {
+			w.Write([]byte(large))
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer volumeServer.Close()
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"locations":[{"url":"` + volumeServer.Listener.Addr().String() + `","publicUrl":"` + volumeServer.Listener.Addr().String() + `"}]}`))
+	}))
+	defer master.Close()
+	defer func(m string, mb int) { *cacheMaster, *cacheMB = m, mb }(*cacheMaster, *cacheMB)
+	*cacheMaster, *cacheMB = master.Listener.Addr().String(), 1
+	fileCache = util.NewLRUCache(1024 * 1024)
+	cacheLatency = util.NewLatencyStats(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			cacheHandler(w, httptest.NewRequest("GET", "/3,01637037d6", nil))
+			if w.Code != http.StatusOK || w.Body.String() != "hello" {
+				t.Error("got", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if reads := atomic.LoadInt32(&reads); reads != 1 {
+		t.Error("the concurrent misses read the file", reads, "times from the cluster")
+	}
+
+	w := httptest.NewRecorder()
+	cacheHandler(w, httptest.NewRequest("GET", "/3,02637037d6", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != len(large) {
+		t.Error("the large file got", w.Code, "with", w.Body.Len(), "bytes")
+	}
+	if _, ok := fileCache.Get("3,02637037d6"); ok {
+		t.Error("cached a file larger than the cache")
+	}
+}
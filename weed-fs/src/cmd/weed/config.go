@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"pkg/util"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The flags of the commands can also be set in a weed.toml file, with a section
+// per command, and with WEED_<COMMAND>_<FLAG> environment variables, e.g.
+// WEED_MASTER_PORT=9333 or WEED_VOLUME_MAXCONCURRENTWRITES=64. The command
+// line wins over the environment, which wins over the file. The file is the
+// -config one, else $WEED_CONFIG, else ./weed.toml or /etc/weedfs/weed.toml
+// if there is one. The server command reads the flags of its master, volume
+// and filer from their own sections.
+
+var configFile = flag.String("config", "", "weed.toml configuration file. Empty means $WEED_CONFIG, ./weed.toml or /etc/weedfs/weed.toml")
+
+var defaultConfigFiles = []string{"weed.toml", "/etc/weedfs/weed.toml"}
+
+func init() {
+	cmdConfig.Run = runConfig // break init cycle
+}
+
+var cmdConfig = &Command{
+	UsageLine: "config master -port=9334",
+	Short:     "print the effective configuration of a command",
+	Long: `print the flags a command would run with, from its command line, the WEED_*
+  environment variables, the weed.toml file, or the defaults, in the weed.toml format.
+  Each flag is followed by where its value comes from, and keys, passwords and secrets are hidden.
+
+    [master]
+    port = 9333                   # default
+    mdir = "/data/master"         # /etc/weedfs/weed.toml
+    volumeSizeLimitMB = 1024      # WEED_MASTER_VOLUMESIZELIMITMB
+
+  `,
+}
+
+// configKey is the section and the key of the flag of the command. The
+// server flags with a prefix, like master.port, are in the prefix section.
+func configKey(cmd *Command, name string) (section, key string) {
+	if i := strings.Index(name, "."); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return cmd.Name(), name
+}
+
+func configEnvName(section, key string) string {
+	return "WEED_" + strings.ToUpper(section+"_"+key)
+}
+
+// loadConfigFile reads the configuration file, if any.
+func loadConfigFile() (map[string]map[string]string, string, error) {
+	fileName := *configFile
+	if fileName == "" {
+		fileName = os.Getenv("WEED_CONFIG")
+	}
+	if fileName == "" {
+		for _, f := range defaultConfigFiles {
+			if _, err := os.Stat(f); err == nil {
+				fileName = f
+				break
+			}
+		}
+		if fileName == "" {
+			return nil, "", nil
+		}
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fileName, err
+	}
+	sections, err := util.ParseToml(data)
+	if err != nil {
+		return nil, fileName, errors.New(fileName + ": " + err.Error())
+	}
+	return sections, fileName, nil
+}
+
+// applyConfig sets the flags not on the command line from the environment or
+// the configuration file, and returns where the value of each flag set comes from.
+func applyConfig(cmd *Command) (map[string]string, error) {
+	sources := make(map[string]string)
+	cmd.Flag.Visit(func(f *flag.Flag) { sources[f.Name] = "command line" })
+	sections, fileName, err := loadConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || sources[f.Name] != "" {
+			return
+		}
+		section, key := configKey(cmd, f.Name)
+		env := configEnvName(section, key)
+		if value, ok := os.LookupEnv(env); ok {
+			sources[f.Name] = env
+			if e := f.Value.Set(value); e != nil {
+				err = errors.New(env + ": " + e.Error())
+			}
+		} else if value, ok := sections[section][key]; ok {
+			sources[f.Name] = fileName
+			if e := f.Value.Set(value); e != nil {
+				err = errors.New(fileName + ": [" + section + "] " + key + ": " + e.Error())
+			}
+		}
+	})
+	return sources, err
+}
+
+func runConfig(cmd *Command, args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	var target *Command
+	for _, c := range commands {
+		if c.Name() == args[0] && c.Run != nil && c != cmdConfig {
+			target = c
+		}
+	}
+	if target == nil {
+		fmt.Fprintf(os.Stderr, "weed config: unknown command %q\n", args[0])
+		return false
+	}
+	target.Flag.Parse(args[1:])
+	sources, err := applyConfig(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "weed config: %s\n", err)
+		setExitStatus(1)
+		return true
+	}
+	lines := make(map[string][]string)
+	var sections []string
+	target.Flag.VisitAll(func(f *flag.Flag) {
+		section, key := configKey(target, f.Name)
+		if _, ok := lines[section]; !ok {
+			sections = append(sections, section)
+		}
+		source := sources[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		line := key + " = " + configValue(f)
+		lines[section] = append(lines[section], fmt.Sprintf("%-30s # %s", line, source))
+	})
+	sort.Strings(sections)
+	for i, section := range sections {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println("[" + section + "]")
+		for _, line := range lines[section] {
+			fmt.Println(line)
+		}
+	}
+	return true
+}
+
+// configValue is the flag value in the weed.toml format, with secrets hidden.
+func configValue(f *flag.Flag) string {
+	value := f.Value.(flag.Getter).Get()
+	if s, ok := value.(string); ok {
+		if s != "" && (strings.HasSuffix(f.Name, "Key") || strings.HasSuffix(f.Name, "Password") || strings.HasSuffix(f.Name, "Secret")) {
+			s = "<hidden>"
+		}
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(value)
+}
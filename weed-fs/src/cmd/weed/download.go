@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"pkg/operation"
+)
+
+var (
+	downloadServer   *string
+	downloadOutput   *string
+	downloadAuth     *string
+	downloadParallel *int
+)
+
+func init() {
+	cmdDownload.Run = runDownload // break init cycle
+	IsDebug = cmdDownload.Flag.Bool("debug", false, "enable debug mode")
+	downloadServer = cmdDownload.Flag.String("server", "localhost:9333", "weedfs master location")
+	downloadOutput = cmdDownload.Flag.String("o", "", "the file written, instead of the standard output")
+	downloadAuth = cmdDownload.Flag.String("auth", "", "the signed query string of the reads of the file, from /dir/sign?op=read&count=<chunks+1> for a chunked file")
+	downloadParallel = cmdDownload.Flag.Int("parallel", 4, "how many chunks of a chunked file are read at a time")
+}
+
+var cmdDownload = &Command{
+	UsageLine: "download -server=localhost:9333 [-o=file] fid",
+	Short:     "download a file, reading the chunks of a chunked file in parallel",
+	Long: `download writes the file of the fid to the standard output, or to the -o file.
+
+  The chunks of a file uploaded with weed upload -maxMB are read -parallel at a
+  time, each retried alone on the other replicas, and written in order, or each
+  at its offset in the -o file.
+
+  `,
+}
+
+func runDownload(cmd *Command, args []string) bool {
+	if len(args) != 1 {
+		return false
+	}
+	var w io.Writer = os.Stdout
+	if *downloadOutput != "" {
+		file, err := os.Create(*downloadOutput)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			setExitStatus(1)
+			return true
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := operation.DownloadChunked(context.Background(), *downloadServer, args[0], *downloadAuth, w, *downloadParallel); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to download", args[0], ":", err)
+		setExitStatus(1)
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"pkg/storage"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type collectionRule struct {
+	prefix     string
+	collection string
+}
+
+var (
+	filerCollections []collectionRule // longest prefix first
+	filerVersions    *versionLimits
+)
+
+// parseCollectionRules parses the -collections rules, e.g.
+// "/photos/=photos;/docs/=docs", longest prefix first.
+func parseCollectionRules(s string) ([]collectionRule, error) {
+	var rules []collectionRule
+	for _, rule := range strings.Split(s, ";") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		i := strings.Index(rule, "=")
+		if i <= 0 || !strings.HasPrefix(rule, "/") {
+			return nil, errors.New("-collections: " + rule + " should be /path/prefix=collection")
+		}
+		collection := strings.TrimSpace(rule[i+1:])
+		if err := storage.CheckCollectionName(collection); err != nil {
+			return nil, errors.New("-collections: " + err.Error())
+		}
+		rules = append(rules, collectionRule{prefix: rule[:i], collection: collection})
+	}
+	sort.Slice(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	return rules, nil
+}
+
+// collectionFor returns the collection the files under the path are stored in.
+func collectionFor(fullFileName string) string {
+	for _, rule := range filerCollections {
+		if strings.HasPrefix(fullFileName, rule.prefix) {
+			return rule.collection
+		}
+	}
+	return *filerCollection
+}
+
+// versionLimits are the numbers of previous versions kept by collection.
+type versionLimits struct {
+	byCollection map[string]int
+	others       int
+}
+
+// parseVersionLimits parses the -maxVersions limits, e.g. "docs=10,photos=0,3"
+// keeps 10 versions in docs, none in photos, and 3 in the other collections.
+func parseVersionLimits(s string) (*versionLimits, error) {
+	limits := &versionLimits{byCollection: make(map[string]int)}
+	for _, limit := range strings.Split(s, ",") {
+		if limit = strings.TrimSpace(limit); limit == "" {
+			continue
+		}
+		collection, count, found := strings.Cut(limit, "=")
+		if !found {
+			collection, count = "", limit
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return nil, errors.New("-maxVersions: " + limit + " should be collection=count, or count for the other collections")
+		}
+		if found {
+			limits.byCollection[collection] = n
+		} else {
+			limits.others = n
+		}
+	}
+	return limits, nil
+}
+
+func (l *versionLimits) of(collection string) int {
+	if n, ok := l.byCollection[collection]; ok {
+		return n
+	}
+	return l.others
+}
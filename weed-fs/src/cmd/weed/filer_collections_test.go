@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCollectionFor(t *testing.T) {
+	rules, err := parseCollectionRules("/photos/=photos; /photos/raw/=raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filerCollections = rules
+	defer func() { filerCollections = nil }()
+	for fullFileName, expected := range map[string]string{
+		"/photos/a.jpg":     "photos",
+		"/photos/raw/a.cr2": "raw",
+		"/docs/a.txt":       *filerCollection,
+	} {
+		if collection := collectionFor(fullFileName); collection != expected {
+			t.Error(fullFileName, "is in", collection, "instead of", expected)
+		}
+	}
+	for _, invalid := range []string{"photos=photos", "/photos/=../x", "/photos/"} {
+		if _, err := parseCollectionRules(invalid); err == nil {
+			t.Error("accepted", invalid)
+		}
+	}
+}
+
+func TestParseVersionLimits(t *testing.T) {
+	limits, err := parseVersionLimits("docs=10,photos=0,3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.of("docs") != 10 || limits.of("photos") != 0 || limits.of("") != 3 || limits.of("other") != 3 {
+		t.Error("unexpected limits", limits)
+	}
+	if limits, _ = parseVersionLimits("0"); limits.of("docs") != 0 {
+		t.Error("versioning is not disabled by 0")
+	}
+	for _, invalid := range []string{"docs=x", "-1", "docs=-2"} {
+		if _, err := parseVersionLimits(invalid); err == nil {
+			t.Error("accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,855 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"pkg/filer"
+	"pkg/notification"
+	"pkg/operation"
+	"pkg/storage"
+	"pkg/util"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -s3Port, the filer also serves the S3 api, path style, on top of its
+// paths: each bucket is a sub directory of -s3Dir, and each object the file
+// of its key under it. The S3 headers are kept as X-Weed-Meta-* pairs of the
+// files, the md5 of the content as S3-Etag, the Content-Type as
+// S3-Content-Type, and the x-amz-meta-* headers under their own names.
+// The empty buckets are kept as the files of -s3Dir.s3/buckets/, and the
+// multipart uploads in progress under -s3Dir.s3/uploads/.
+
+const (
+	s3Namespace   = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat  = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys     = 1000
+	s3Heads       = 8 // the files read at a time for their size and etag when listing
+	s3EtagPair    = "S3-Etag"
+	s3ContentPair = "S3-Content-Type"
+)
+
+var s3BucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+var s3ErrorStatus = map[string]int{
+	"AccessDenied":              http.StatusForbidden,
+	"InvalidAccessKeyId":        http.StatusForbidden,
+	"RequestTimeTooSkewed":      http.StatusForbidden,
+	"SignatureDoesNotMatch":     http.StatusForbidden,
+	"XAmzContentSHA256Mismatch": http.StatusBadRequest,
+	"BadDigest":                 http.StatusBadRequest,
+	"BucketNotEmpty":            http.StatusConflict,
+	"EntityTooLarge":            http.StatusBadRequest,
+	"InternalError":             http.StatusInternalServerError,
+	"InvalidArgument":           http.StatusBadRequest,
+	"InvalidBucketName":         http.StatusBadRequest,
+	"InvalidPart":               http.StatusBadRequest,
+	"InvalidPartOrder":          http.StatusBadRequest,
+	"InvalidRange":              http.StatusRequestedRangeNotSatisfiable,
+	"MalformedXML":              http.StatusBadRequest,
+	"MethodNotAllowed":          http.StatusMethodNotAllowed,
+	"NoSuchBucket":              http.StatusNotFound,
+	"NoSuchKey":                 http.StatusNotFound,
+	"NoSuchUpload":              http.StatusNotFound,
+	"NotImplemented":            http.StatusNotImplemented,
+	"ServiceUnavailable":        http.StatusServiceUnavailable,
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, code string, message string) {
+	status, ok := s3ErrorStatus[code]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+	writeS3Xml(w, status, s3Error{Code: code, Message: message, Resource: r.URL.Path})
+}
+
+func writeS3Xml(w http.ResponseWriter, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		status, data = http.StatusInternalServerError, nil
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func s3Handler(w http.ResponseWriter, r *http.Request) {
+	bucket, key := r.URL.Path, ""
+	if i := strings.Index(strings.TrimPrefix(bucket, "/"), "/"); i >= 0 {
+		bucket, key = bucket[:i+1], bucket[i+2:]
+	}
+	bucket = strings.TrimPrefix(bucket, "/")
+	identity, err := s3Authenticate(r, time.Now())
+	if err != nil {
+		writeS3Failure(w, r, err)
+		return
+	}
+	switch {
+	case bucket == "" && !identity.hasBucket(""), bucket != "" && !identity.allows(bucket, s3Action(r, key)):
+		writeS3Error(w, r, "AccessDenied", "the access key is not allowed "+r.Method+" "+r.URL.Path)
+	case bucket == "" && r.Method == "GET":
+		s3ListBucketsHandler(w, r, identity)
+	case bucket == "":
+		writeS3Error(w, r, "MethodNotAllowed", "only GET lists the buckets")
+	case !s3BucketName.MatchString(bucket):
+		writeS3Error(w, r, "InvalidBucketName", bucket+" is not a valid bucket name")
+	case key == "":
+		s3BucketHandler(w, r, bucket)
+	case strings.HasSuffix(key, "/") && r.Method == "PUT":
+		// the folder objects of some tools, the directories being implicit
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+	case path.Clean("/"+key) != "/"+key:
+		writeS3Error(w, r, "InvalidArgument", "the keys are paths without empty, . or .. parts")
+	default:
+		s3ObjectHandler(w, r, bucket, key)
+	}
+}
+
+func s3BucketHandler(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	switch {
+	case r.Method == "PUT":
+		s3CreateBucketHandler(w, r, bucket)
+	case r.Method == "HEAD":
+		if exists, err := s3BucketExists(bucket); err != nil || !exists {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == "DELETE":
+		s3DeleteBucketHandler(w, r, bucket)
+	case r.Method == "GET" && query.Has("location"):
+		writeS3Xml(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: s3Namespace})
+	case r.Method == "GET" && query.Has("uploads"):
+		s3ListUploadsHandler(w, r, bucket)
+	case r.Method == "GET":
+		s3ListObjectsHandler(w, r, bucket)
+	case r.Method == "POST" && query.Has("delete"):
+		s3DeleteObjectsHandler(w, r, bucket)
+	default:
+		writeS3Error(w, r, "MethodNotAllowed", r.Method+" is not allowed on a bucket")
+	}
+}
+
+func s3ObjectHandler(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	query := r.URL.Query()
+	if exists, err := s3BucketExists(bucket); err != nil || !exists {
+		writeS3Error(w, r, "NoSuchBucket", bucket+" does not exist")
+		return
+	}
+	switch {
+	case r.Method == "POST" && query.Has("uploads"):
+		s3CreateUploadHandler(w, r, bucket, key)
+	case r.Method == "POST" && query.Has("uploadId"):
+		s3CompleteUploadHandler(w, r, bucket, key)
+	case r.Method == "PUT" && query.Has("uploadId"):
+		s3UploadPartHandler(w, r, bucket, key)
+	case r.Method == "GET" && query.Has("uploadId"):
+		s3ListPartsHandler(w, r, bucket, key)
+	case r.Method == "DELETE" && query.Has("uploadId"):
+		s3AbortUploadHandler(w, r, bucket, key)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		writeS3Error(w, r, "NotImplemented", "the objects are not copied, but uploaded again")
+	case r.Method == "PUT":
+		s3PutObjectHandler(w, r, bucket, key)
+	case r.Method == "GET" || r.Method == "HEAD":
+		s3GetObjectHandler(w, r, bucket, key)
+	case r.Method == "DELETE":
+		s3DeleteObjectHandler(w, r, bucket, key)
+	default:
+		writeS3Error(w, r, "MethodNotAllowed", r.Method+" is not allowed on an object")
+	}
+}
+
+func s3Root() string {
+	return strings.TrimSuffix(*fS3Dir, "/") + "/"
+}
+
+func s3BucketDir(bucket string) string {
+	return s3Root() + bucket + "/"
+}
+
+// s3BucketFile marks an existing bucket, until it is deleted, even without objects.
+func s3BucketFile(bucket string) string {
+	return s3Root() + ".s3/buckets/" + bucket
+}
+
+func s3BucketExists(bucket string) (bool, error) {
+	if _, err := filerStore.FindFile(s3BucketFile(bucket)); err != filer.ErrNotFound {
+		return err == nil, err
+	}
+	entries, err := filerStore.ListEntries(s3BucketDir(bucket), "", "", 1)
+	return len(entries) > 0, err
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+func s3ListBucketsHandler(w http.ResponseWriter, r *http.Request, identity *s3Identity) {
+	created := make(map[string]string)
+	err := s3ListAll(s3Root()+".s3/buckets/", "", func(entry filer.FileEntry) error {
+		if info, e := s3Head(entry.Id, ""); e == nil {
+			created[entry.Name] = info.lastModified
+		} else {
+			created[entry.Name] = time.Unix(0, 0).UTC().Format(s3TimeFormat)
+		}
+		return nil
+	})
+	if err == nil {
+		// the buckets created by uploading to the filer directly
+		err = s3ListAll(s3Root(), "", func(entry filer.FileEntry) error {
+			name := strings.TrimSuffix(entry.Name, "/")
+			if _, found := created[name]; !found && strings.HasSuffix(entry.Name, "/") && s3BucketName.MatchString(name) {
+				created[name] = time.Unix(0, 0).UTC().Format(s3TimeFormat)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	var buckets []s3Bucket
+	for name, date := range created {
+		if identity.hasBucket(name) {
+			buckets = append(buckets, s3Bucket{Name: name, CreationDate: date})
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	writeS3Xml(w, http.StatusOK, struct {
+		XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+		Xmlns   string     `xml:"xmlns,attr"`
+		Owner   s3Owner    `xml:"Owner"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Owner: s3Owner{"weed", "weed"}, Buckets: buckets})
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+func s3CreateBucketHandler(w http.ResponseWriter, r *http.Request, bucket string) {
+	io.Copy(ioutil.Discard, r.Body)
+	if _, err := filerStore.FindFile(s3BucketFile(bucket)); err == nil {
+		w.Header().Set("Location", "/"+bucket)
+		return
+	}
+	fid, err := s3StoreFile(s3BucketFile(bucket), "", "application/json", strings.NewReader("{}"), nil, "")
+	if err == nil {
+		if err = filerStore.CreateFile(s3BucketFile(bucket), fid); err != nil {
+			deleteFileId(fid)
+		}
+	}
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+}
+
+func s3DeleteBucketHandler(w http.ResponseWriter, r *http.Request, bucket string) {
+	entries, err := filerStore.ListEntries(s3BucketDir(bucket), "", "", 1)
+	if err == nil && len(entries) == 0 {
+		entries, err = filerStore.ListEntries(s3UploadsDir(bucket), "", "", 1)
+	}
+	if err == nil && len(entries) > 0 {
+		writeS3Error(w, r, "BucketNotEmpty", bucket+" has objects or uploads in progress")
+		return
+	}
+	fid, err := filerStore.DeleteFile(s3BucketFile(bucket))
+	if err == filer.ErrNotFound {
+		writeS3Error(w, r, "NoSuchBucket", bucket+" does not exist")
+		return
+	}
+	if err == nil {
+		err = deleteFileId(fid)
+	}
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func s3PutObjectHandler(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	pairs := make(map[string]string)
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			pairs[http.CanonicalHeaderKey(name[len("x-amz-meta-"):])] = values[0]
+		}
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		pairs[s3ContentPair] = contentType
+	}
+	fullFileName := s3BucketDir(bucket) + key
+	fid, size, etag, err := s3StoreObject(fullFileName, r.Body, pairs, int64(*fS3ChunkMB)<<20)
+	if err == nil && r.Header.Get("Content-Md5") != "" {
+		if sum, _ := hex.DecodeString(etag); base64.StdEncoding.EncodeToString(sum) != r.Header.Get("Content-Md5") {
+			deleteFileId(fid)
+			writeS3Error(w, r, "BadDigest", "the Content-MD5 is not of the content")
+			return
+		}
+	}
+	if err == nil {
+		err = s3CreateObject(fullFileName, fid, size, pairs)
+	}
+	if err != nil {
+		writeS3Failure(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+}
+
+// s3StoreObject stores the body as one file, or in chunks of chunkSize if
+// larger, and returns its fid, size and md5.
+func s3StoreObject(fullFileName string, body io.Reader, pairs map[string]string, chunkSize int64) (fid string, size int64, etag string, err error) {
+	content, etag, cleanup, err := s3Spool(body, chunkSize)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer cleanup()
+	pairs[s3EtagPair] = etag
+	if content.Size() <= chunkSize {
+		fid, err = s3StoreFile(fullFileName, path.Base(fullFileName), pairs[s3ContentPair], content, pairs, "")
+		return fid, content.Size(), etag, err
+	}
+	fid, err = operation.UploadChunked(*filerMaster, path.Base(fullFileName), pairs[s3ContentPair], content, content.Size(), operation.ChunkedOptions{
+		ChunkSize: chunkSize, Collection: collectionFor(fullFileName), Replication: *filerReplication, Parallelism: 4, Pairs: pairs})
+	if err != nil && fid != "" {
+		deleteFileId(fid)
+	}
+	return fid, content.Size(), etag, err
+}
+
+// s3Spool reads the body, in memory up to inMemory bytes, or else into a
+// temporary file removed by cleanup, and returns it with its md5.
+func s3Spool(body io.Reader, inMemory int64) (content *io.SectionReader, etag string, cleanup func(), err error) {
+	h := md5.New()
+	body = io.TeeReader(body, h)
+	data, err := ioutil.ReadAll(io.LimitReader(body, inMemory+1))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if int64(len(data)) <= inMemory {
+		return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), hex.EncodeToString(h.Sum(nil)), func() {}, nil
+	}
+	spool, err := ioutil.TempFile("", "weedfs_s3")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	cleanup = func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	if _, err = spool.Write(data); err == nil {
+		var rest int64
+		if rest, err = io.Copy(spool, body); err == nil {
+			return io.NewSectionReader(spool, 0, int64(len(data))+rest), hex.EncodeToString(h.Sum(nil)), cleanup, nil
+		}
+	}
+	cleanup()
+	return nil, "", nil, err
+}
+
+// s3StoreFile uploads the data as a new file of the collection of fullFileName,
+// with the query, e.g. cm=true, and returns its fid. The files without a name
+// are kept as they are, and not gzipped.
+func s3StoreFile(fullFileName string, filename string, mimeType string, content io.Reader, pairs map[string]string, query string) (string, error) {
+	assignResult, err := operation.Assign(*filerMaster, 1, collectionFor(fullFileName), *filerReplication)
+	if err != nil {
+		return "", err
+	}
+	uploadUrl := "http://" + assignResult.Url + "/" + assignResult.Fid + "?" + query
+	if assignResult.Auth != "" {
+		uploadUrl += "&" + assignResult.Auth
+	}
+	if _, err = operation.UploadMimeContext(context.Background(), uploadUrl, filename, mimeType, content, pairs); err != nil {
+		return "", err
+	}
+	return assignResult.Fid, nil
+}
+
+// s3CreateObject points the key to the fid, keeping or deleting the fid it replaces.
+func s3CreateObject(fullFileName string, fid string, size int64, pairs map[string]string) error {
+	oldFid, _ := filerStore.FindFile(fullFileName)
+	if err := filerStore.CreateFile(fullFileName, fid); err != nil {
+		deleteFileId(fid)
+		return err
+	}
+	eventType := notification.Create
+	if oldFid != "" {
+		eventType = notification.Update
+		if err := keepVersion(fullFileName, oldFid); err != nil {
+			log.Println("failed to keep or delete overwritten file", oldFid, err)
+		}
+	}
+	notifyFilerEvent(&notification.Event{Type: eventType, Path: fullFileName, Fid: fid, OldFid: oldFid,
+		Size: size, Mime: pairs[s3ContentPair], Meta: pairs})
+	return nil
+}
+
+func s3GetObjectHandler(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	fullFileName := s3BucketDir(bucket) + key
+	fid, err := filerStore.FindFile(fullFileName)
+	if err != nil {
+		writeS3Error(w, r, "NoSuchKey", key+" does not exist")
+		return
+	}
+	resp, err := s3ReadFile(r, fid, path.Ext(key))
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified:
+	case http.StatusNotFound:
+		writeS3Error(w, r, "NoSuchKey", key+" is not found on the volume servers")
+		return
+	case http.StatusRequestedRangeNotSatisfiable:
+		writeS3Error(w, r, "InvalidRange", "the range is not satisfiable")
+		return
+	default:
+		writeS3Error(w, r, "InternalError", fid+" answered "+resp.Status)
+		return
+	}
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Range", "Last-Modified"} {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	s3ObjectHeaders(w.Header(), resp.Header, fid)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(resp.StatusCode)
+	if r.Method != "HEAD" {
+		io.Copy(w, resp.Body)
+	}
+}
+
+// s3ObjectHeaders sets the S3 headers of the object from the X-Weed-Meta-*
+// pairs of its file.
+func s3ObjectHeaders(header http.Header, fileHeader http.Header, fid string) {
+	etag := fileHeader.Get(storage.PairNamePrefix + s3EtagPair)
+	if etag == "" {
+		etag = fid
+	}
+	header.Set("ETag", `"`+etag+`"`)
+	for name, values := range fileHeader {
+		if !strings.HasPrefix(name, storage.PairNamePrefix) {
+			continue
+		}
+		switch pair := name[len(storage.PairNamePrefix):]; {
+		case pair == s3ContentPair:
+			header.Set("Content-Type", values[0])
+		case !strings.HasPrefix(pair, "S3-"):
+			header.Set("X-Amz-Meta-"+pair, values[0])
+		}
+	}
+}
+
+// s3ReadFile reads the file fid from a volume server, as asked by r, as it is
+// stored, and with its X-Weed-Meta-* pairs.
+func s3ReadFile(r *http.Request, fid string, ext string) (*http.Response, error) {
+	lookupResult, err := lookupFileId(fid)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, "http://"+lookupResult.Locations[0].Url+"/"+fid+ext+filerAuth(util.SignedRead, fid), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"Range", "If-Modified-Since"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	// not gzipped, for the Content-Length and the ranges of the content itself
+	req.Header.Set("Accept-Encoding", "identity")
+	return http.DefaultClient.Do(req)
+}
+
+type s3FileInfo struct {
+	size         int64
+	lastModified string
+	modified     time.Time
+	etag         string
+}
+
+// s3Head reads the size, last modified time and etag of the file fid, of its
+// content un-gzipped with the extension of its name.
+func s3Head(fid string, ext string) (*s3FileInfo, error) {
+	req, _ := http.NewRequest("HEAD", "/", nil)
+	resp, err := s3ReadFile(req, fid, ext)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fid + " answered " + resp.Status)
+	}
+	info := &s3FileInfo{size: resp.ContentLength, etag: resp.Header.Get(storage.PairNamePrefix + s3EtagPair)}
+	if info.etag == "" {
+		info.etag = fid
+	}
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		lastModified = time.Unix(0, 0)
+	}
+	info.lastModified, info.modified = lastModified.UTC().Format(s3TimeFormat), lastModified
+	return info, nil
+}
+
+func s3DeleteObjectHandler(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	if err := s3DeleteObject(s3BucketDir(bucket) + key); err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// s3DeleteObject deletes the file, keeping it as a version if its collection
+// keeps versions. A missing file is deleted already.
+func s3DeleteObject(fullFileName string) error {
+	fid, err := filerStore.DeleteFile(fullFileName)
+	if err == filer.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	notifyFilerEvent(&notification.Event{Type: notification.Delete, Path: fullFileName, Fid: fid})
+	return keepVersion(fullFileName, fid)
+}
+
+func s3DeleteObjectsHandler(w http.ResponseWriter, r *http.Request, bucket string) {
+	var request struct {
+		Quiet  bool
+		Object []struct{ Key string }
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&request); err != nil {
+		writeS3Error(w, r, "MalformedXML", err.Error())
+		return
+	}
+	if len(request.Object) > s3MaxKeys {
+		writeS3Error(w, r, "MalformedXML", "more than "+strconv.Itoa(s3MaxKeys)+" objects")
+		return
+	}
+	type deleteError struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	result := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Deleted []struct{ Key string }
+		Error   []deleteError
+	}{Xmlns: s3Namespace}
+	for _, object := range request.Object {
+		err := s3DeleteObject(s3BucketDir(bucket) + object.Key)
+		if err != nil {
+			result.Error = append(result.Error, deleteError{object.Key, "InternalError", err.Error()})
+		} else if !request.Quiet {
+			result.Deleted = append(result.Deleted, struct{ Key string }{object.Key})
+		}
+	}
+	writeS3Xml(w, http.StatusOK, result)
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+	fid          string
+	modified     time.Time
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	MaxKeys               int
+	Delimiter             string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3Prefix
+}
+
+// s3ListObjectsHandler lists the objects, with ListObjects and ListObjectsV2,
+// in the order of their keys, grouping the keys under their common prefixes
+// with the "/" delimiter.
+func s3ListObjectsHandler(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	if exists, err := s3BucketExists(bucket); err != nil || !exists {
+		writeS3Error(w, r, "NoSuchBucket", bucket+" does not exist")
+		return
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	if delimiter != "" && delimiter != "/" {
+		writeS3Error(w, r, "NotImplemented", "the only delimiter is /")
+		return
+	}
+	maxKeys := s3MaxKeys
+	if value := query.Get("max-keys"); value != "" {
+		var err error
+		if maxKeys, err = strconv.Atoi(value); err != nil || maxKeys < 0 {
+			writeS3Error(w, r, "InvalidArgument", "max-keys should be a positive number")
+			return
+		}
+		if maxKeys > s3MaxKeys {
+			maxKeys = s3MaxKeys
+		}
+	}
+	result := s3ListResult{Xmlns: s3Namespace, Name: bucket, Prefix: prefix, MaxKeys: maxKeys, Delimiter: delimiter}
+	after := query.Get("marker")
+	isV2 := query.Get("list-type") == "2"
+	if isV2 {
+		after = query.Get("start-after")
+		result.StartAfter, result.ContinuationToken = after, query.Get("continuation-token")
+		if token, err := base64.URLEncoding.DecodeString(result.ContinuationToken); err == nil && len(token) > 0 {
+			after = string(token)
+		}
+	} else {
+		result.Marker = &after
+	}
+
+	var items []s3Object // the objects, and the common prefixes without a fid
+	err := s3Walk(s3BucketDir(bucket), "", prefix, delimiter, after, maxKeys+1, func(item s3Object) {
+		items = append(items, item)
+	})
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	if len(items) > maxKeys {
+		items, result.IsTruncated = items[:maxKeys], true
+		last := ""
+		if maxKeys > 0 {
+			last = items[maxKeys-1].Key
+		}
+		if isV2 {
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+		} else if delimiter != "" {
+			result.NextMarker = last
+		}
+	}
+	if err = s3HeadObjects(items); err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		result.EncodingType = "url"
+		encode = url.PathEscape
+		result.Prefix, result.StartAfter, result.NextMarker = encode(result.Prefix), encode(result.StartAfter), encode(result.NextMarker)
+		if result.Marker != nil {
+			marker := encode(after)
+			result.Marker = &marker
+		}
+	}
+	for _, item := range items {
+		if item.fid == "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{encode(item.Key)})
+		} else {
+			item.Key = encode(item.Key)
+			result.Contents = append(result.Contents, item)
+		}
+	}
+	if isV2 {
+		keyCount := len(items)
+		result.KeyCount = &keyCount
+	}
+	writeS3Xml(w, http.StatusOK, result)
+}
+
+// s3Walk lists the keys after after, with the prefix, under the bucket sub
+// directory rel, in order, until limit of them, and the common prefixes of
+// the keys instead with the "/" delimiter.
+func s3Walk(bucketDir string, rel string, prefix string, delimiter string, after string, limit int, add func(s3Object)) error {
+	count := 0
+	err := s3WalkDir(bucketDir, rel, prefix, delimiter, after, func(item s3Object) bool {
+		add(item)
+		count++
+		return count < limit
+	})
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+func s3WalkDir(bucketDir string, rel string, prefix string, delimiter string, after string, add func(s3Object) bool) error {
+	namePrefix := ""
+	if strings.HasPrefix(prefix, rel) {
+		namePrefix = prefix[len(rel):]
+		if i := strings.Index(namePrefix, "/"); i >= 0 {
+			namePrefix = namePrefix[:i+1]
+		}
+	}
+	lastFileName := ""
+	if strings.HasPrefix(after, rel) {
+		lastFileName = after[len(rel):]
+		if i := strings.Index(lastFileName, "/"); i >= 0 {
+			lastFileName = lastFileName[:i]
+		}
+	}
+	for {
+		entries, err := filerStore.ListEntries(bucketDir+rel, lastFileName, namePrefix, s3MaxKeys)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			key := rel + entry.Name
+			lastFileName = entry.Name
+			if !strings.HasSuffix(key, "/") {
+				if key > after && strings.HasPrefix(key, prefix) && !add(s3Object{Key: key, fid: entry.Id, StorageClass: "STANDARD"}) {
+					return errStopWalk
+				}
+				continue
+			}
+			if after >= key && !strings.HasPrefix(after, key) {
+				continue
+			}
+			if delimiter != "" && strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+				// the common prefix of the keys of the directory, once some are after after
+				if key > after || key != after && s3HasKeys(bucketDir, key, after) {
+					if !add(s3Object{Key: key}) {
+						return errStopWalk
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key) {
+				if err = s3WalkDir(bucketDir, key, prefix, delimiter, after, add); err != nil {
+					return err
+				}
+			}
+		}
+		if len(entries) < s3MaxKeys {
+			return nil
+		}
+	}
+}
+
+var errStopWalk = errors.New("enough keys")
+
+// s3HasKeys tells if the directory rel has keys after after.
+func s3HasKeys(bucketDir string, rel string, after string) bool {
+	found := false
+	s3WalkDir(bucketDir, rel, rel, "", after, func(s3Object) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// s3HeadObjects fills in the size, last modified time and etag of the objects,
+// s3Heads at a time.
+func s3HeadObjects(objects []s3Object) error {
+	var failure error
+	var lock sync.Mutex
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < s3Heads && i < len(objects); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				info, err := s3Head(objects[i].fid, path.Ext(objects[i].Key))
+				if err != nil {
+					lock.Lock()
+					failure = err
+					lock.Unlock()
+					continue
+				}
+				objects[i].Size, objects[i].LastModified, objects[i].ETag = info.size, info.lastModified, `"`+info.etag+`"`
+				objects[i].modified = info.modified
+			}
+		}()
+	}
+	for i := range objects {
+		if objects[i].fid != "" {
+			indexes <- i
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	return failure
+}
+
+// s3ListAll calls do for all the entries of the directory with the prefix.
+func s3ListAll(dir string, prefix string, do func(filer.FileEntry) error) error {
+	lastFileName := ""
+	for {
+		entries, err := filerStore.ListEntries(dir, lastFileName, prefix, s3MaxKeys)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = do(entry); err != nil {
+				return err
+			}
+			lastFileName = entry.Name
+		}
+		if len(entries) < s3MaxKeys {
+			return nil
+		}
+	}
+}
+
+// s3ReadAll reads the whole content of a small file of the gateway.
+func s3ReadAll(fid string) ([]byte, error) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp, err := s3ReadFile(req, fid, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fid + " answered " + resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
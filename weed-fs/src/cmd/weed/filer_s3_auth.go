@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -s3Config, the requests to the S3 api are signed with the AWS Signature
+// Version 4, in the Authorization header or in the query of a presigned url,
+// by the access key of an identity allowed the action on the bucket:
+//
+//	{"identities": [
+//	  {"name": "backup", "accessKey": "AKID1", "secretKey": "...",
+//	   "buckets": ["backups"], "actions": ["Read", "Write", "List"]},
+//	  {"name": "admin", "accessKey": "AKID2", "secretKey": "...",
+//	   "buckets": ["*"], "actions": ["Admin"]}
+//	]}
+//
+// Read is the GET and HEAD of objects, Write their uploads and deletes, List
+// the listings of the objects and uploads, and Admin, allowed everything,
+// creates and deletes the buckets. Each identity lists its own buckets. Without -s3Config, the requests are not
+// authenticated.
+
+const (
+	s3ActionRead  = "Read"
+	s3ActionWrite = "Write"
+	s3ActionList  = "List"
+	s3ActionAdmin = "Admin"
+
+	s3MaxSkew        = 15 * time.Minute
+	s3MaxPresigned   = 7 * 24 * time.Hour
+	s3MaxStreamChunk = 16 << 20
+)
+
+type s3Identity struct {
+	Name      string   `json:"name"`
+	AccessKey string   `json:"accessKey"`
+	SecretKey string   `json:"secretKey"`
+	Buckets   []string `json:"buckets"` // "*" for all of them
+	Actions   []string `json:"actions"`
+}
+
+// s3Identities are the identities of -s3Config by access key, nil without it.
+var s3Identities map[string]*s3Identity
+
+func loadS3Identities(fileName string) (map[string]*s3Identity, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Identities []*s3Identity `json:"identities"`
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, errors.New("-s3Config: " + err.Error())
+	}
+	identities := make(map[string]*s3Identity)
+	for _, identity := range config.Identities {
+		if identity.AccessKey == "" || identity.SecretKey == "" {
+			return nil, errors.New("-s3Config: identity " + identity.Name + " has no access key or secret key")
+		}
+		if _, found := identities[identity.AccessKey]; found {
+			return nil, errors.New("-s3Config: access key " + identity.AccessKey + " is of several identities")
+		}
+		for _, action := range identity.Actions {
+			if action != s3ActionRead && action != s3ActionWrite && action != s3ActionList && action != s3ActionAdmin {
+				return nil, errors.New("-s3Config: unknown action " + action + " of identity " + identity.Name)
+			}
+		}
+		identities[identity.AccessKey] = identity
+	}
+	return identities, nil
+}
+
+// allows tells if the identity, nil if anonymous, may do the action on the
+// bucket, or on some bucket if bucket is empty.
+func (identity *s3Identity) allows(bucket string, action string) bool {
+	if identity == nil {
+		return s3Identities == nil
+	}
+	if !identity.hasBucket(bucket) {
+		return false
+	}
+	for _, a := range identity.Actions {
+		if a == action || a == s3ActionAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (identity *s3Identity) hasBucket(bucket string) bool {
+	if identity == nil {
+		return s3Identities == nil
+	}
+	for _, b := range identity.Buckets {
+		if b == "*" || b == bucket || bucket == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// s3Action is the action of the request on the bucket, or on its key.
+func s3Action(r *http.Request, key string) string {
+	query := r.URL.Query()
+	switch {
+	case key == "" && (r.Method == "PUT" || r.Method == "DELETE"):
+		return s3ActionAdmin
+	case key == "" && r.Method == "POST":
+		return s3ActionWrite
+	case key == "":
+		return s3ActionList
+	case (r.Method == "GET" || r.Method == "HEAD") && !query.Has("uploadId"):
+		return s3ActionRead
+	default:
+		return s3ActionWrite
+	}
+}
+
+// s3RequestError is the S3 error code and message of a request refused, or of
+// its body failing to be read.
+type s3RequestError struct {
+	code    string
+	message string
+}
+
+func (e *s3RequestError) Error() string {
+	return e.code + ": " + e.message
+}
+
+// s3Authenticate finds the identity signing the request, nil for an anonymous
+// request or without -s3Config, and checks its signature. The body of a request signed with its
+// payload is replaced with one failing at its end if it is not of the hash
+// signed, or decoding and checking the chunks of a streaming upload.
+func s3Authenticate(r *http.Request, now time.Time) (*s3Identity, error) {
+	if s3Identities == nil {
+		return nil, nil
+	}
+	query := r.URL.Query()
+	presigned := false
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	switch authorization := r.Header.Get("Authorization"); {
+	case strings.HasPrefix(authorization, util.AwsV4Algorithm+" "):
+		for _, field := range strings.Split(authorization[len(util.AwsV4Algorithm)+1:], ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		if amzDate = r.Header.Get("X-Amz-Date"); amzDate == "" {
+			return nil, &s3RequestError{"AccessDenied", "the X-Amz-Date header is missing"}
+		}
+		if payloadHash = r.Header.Get("X-Amz-Content-Sha256"); payloadHash == "" {
+			return nil, &s3RequestError{"InvalidArgument", "the X-Amz-Content-Sha256 header is missing"}
+		}
+	case authorization != "":
+		return nil, &s3RequestError{"AccessDenied", "only the AWS Signature Version 4 is supported"}
+	case query.Get("X-Amz-Algorithm") == util.AwsV4Algorithm:
+		credential, signedHeaders, signature = query.Get("X-Amz-Credential"), query.Get("X-Amz-SignedHeaders"), query.Get("X-Amz-Signature")
+		amzDate, payloadHash, presigned = query.Get("X-Amz-Date"), util.UnsignedPayload, true
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > s3MaxPresigned {
+			return nil, &s3RequestError{"AccessDenied", "X-Amz-Expires should be up to 7 days"}
+		}
+		if signedAt, err := time.Parse(util.AwsV4TimeFormat, amzDate); err == nil && now.After(signedAt.Add(time.Duration(expires)*time.Second)) {
+			return nil, &s3RequestError{"AccessDenied", "the presigned url expired"}
+		}
+	default:
+		return nil, nil
+	}
+
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[3] != "s3" || scope[4] != "aws4_request" {
+		return nil, &s3RequestError{"AccessDenied", "the credential should be accesskey/day/region/s3/aws4_request"}
+	}
+	identity := s3Identities[scope[0]]
+	if identity == nil {
+		return nil, &s3RequestError{"InvalidAccessKeyId", "the access key " + scope[0] + " is unknown"}
+	}
+	signedAt, err := time.Parse(util.AwsV4TimeFormat, amzDate)
+	if err != nil || amzDate[:8] != scope[1] {
+		return nil, &s3RequestError{"AccessDenied", "the X-Amz-Date should be the day of the credential"}
+	}
+	if signedAt.After(now.Add(s3MaxSkew)) || !presigned && signedAt.Before(now.Add(-s3MaxSkew)) {
+		return nil, &s3RequestError{"RequestTimeTooSkewed", "the request was signed more than 15 minutes away from now"}
+	}
+	headers := strings.Split(signedHeaders, ";")
+	hasHost := false
+	for _, name := range headers {
+		hasHost = hasHost || name == "host"
+	}
+	if !hasHost {
+		return nil, &s3RequestError{"AccessDenied", "the host header should be signed"}
+	}
+	expected := util.AwsV4Signature(r, headers, payloadHash, identity.SecretKey, amzDate, scope[2], "s3")
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, &s3RequestError{"SignatureDoesNotMatch", "the signature is not of the request and the secret key"}
+	}
+
+	switch payloadHash {
+	case util.UnsignedPayload:
+	case "STREAMING-AWS4-HMAC-SHA256-PAYLOAD", "STREAMING-UNSIGNED-PAYLOAD-TRAILER":
+		decodedLength, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			return nil, &s3RequestError{"InvalidArgument", "the X-Amz-Decoded-Content-Length header is missing"}
+		}
+		chunks := &s3ChunkedReader{reader: bufio.NewReader(r.Body), closer: r.Body, previous: signature}
+		if payloadHash == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+			chunks.signingKey = util.AwsV4SigningKey(identity.SecretKey, scope[1], scope[2], "s3")
+			chunks.amzDate, chunks.scope = amzDate, strings.Join(scope[1:], "/")
+		}
+		r.Body, r.ContentLength = chunks, decodedLength
+	default:
+		if _, err := hex.DecodeString(payloadHash); err != nil || len(payloadHash) != 64 {
+			return nil, &s3RequestError{"NotImplemented", "the payload " + payloadHash + " is not supported"}
+		}
+		r.Body = &s3PayloadReader{body: r.Body, hash: sha256.New(), expected: payloadHash}
+	}
+	return identity, nil
+}
+
+var errS3PayloadMismatch = &s3RequestError{"XAmzContentSHA256Mismatch", "the content is not of the X-Amz-Content-Sha256 signed"}
+
+// s3PayloadReader fails at the end of the body if it is not of the sha256 signed.
+type s3PayloadReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (p *s3PayloadReader) Read(b []byte) (int, error) {
+	n, err := p.body.Read(b)
+	p.hash.Write(b[:n])
+	if err == io.EOF && hex.EncodeToString(p.hash.Sum(nil)) != p.expected {
+		err = errS3PayloadMismatch
+	}
+	return n, err
+}
+
+func (p *s3PayloadReader) Close() error {
+	return p.body.Close()
+}
+
+// s3ChunkedReader decodes the aws-chunked body of a streaming upload, each
+// chunk "<hex size>;chunk-signature=<signature>\r\n<data>\r\n" checked
+// against the previous signature with the signing key, or without signatures
+// and with trailing headers, not checked, for an unsigned payload.
+type s3ChunkedReader struct {
+	reader     *bufio.Reader
+	closer     io.Closer
+	signingKey []byte // nil for an unsigned payload
+	amzDate    string
+	scope      string
+	previous   string
+	chunk      []byte
+	done       bool
+}
+
+func (c *s3ChunkedReader) Read(b []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+func (c *s3ChunkedReader) readChunk() error {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	sizeField, extension, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 || size > s3MaxStreamChunk {
+		return &s3RequestError{"InvalidArgument", "invalid chunk size " + sizeField}
+	}
+	c.chunk = make([]byte, size)
+	if _, err = io.ReadFull(c.reader, c.chunk); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if c.signingKey != nil {
+		signature := strings.TrimPrefix(extension, "chunk-signature=")
+		expected := util.AwsV4ChunkSignature(c.signingKey, c.amzDate, c.scope, c.previous, c.chunk)
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return &s3RequestError{"SignatureDoesNotMatch", "the signature of a chunk is not of its content"}
+		}
+		c.previous = signature
+	}
+	if size > 0 {
+		if crlf, err := c.reader.ReadString('\n'); err != nil || crlf != "\r\n" {
+			return &s3RequestError{"InvalidArgument", "a chunk does not end with CRLF"}
+		}
+		return nil
+	}
+	// the last chunk, followed by the trailing headers up to an empty line, if any
+	c.done = true
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil || strings.TrimRight(line, "\r\n") == "" {
+			return nil
+		}
+	}
+}
+
+func (c *s3ChunkedReader) Close() error {
+	return c.closer.Close()
+}
+
+// writeS3Failure writes the error of a request, the ones of its body included.
+func writeS3Failure(w http.ResponseWriter, r *http.Request, err error) {
+	if authError, ok := err.(*s3RequestError); ok {
+		writeS3Error(w, r, authError.code, authError.message)
+		return
+	}
+	writeS3Error(w, r, "InternalError", err.Error())
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadS3Identities(t *testing.T) {
+	file, err := ioutil.TempFile("", "weedfs_s3_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	for config, expected := range map[string]string{
+		`{"identities":[{"name":"a","accessKey":"A","secretKey":"s","buckets":["b"],"actions":["Read"]}]}`: "",
+		`{"identities":[{"name":"a","accessKey":"A","secretKey":"s","actions":["Delete"]}]}`:               "unknown action Delete",
+		`{"identities":[{"name":"a","accessKey":"A","secretKey":""}]}`:                                     "no access key or secret key",
+		`{"identities":[{"accessKey":"A","secretKey":"s"},{"accessKey":"A","secretKey":"t"}]}`:             "is of several identities",
+		`{"identities":`: "-s3Config",
+	} {
+		ioutil.WriteFile(file.Name(), []byte(config), 0644)
+		identities, err := loadS3Identities(file.Name())
+		if expected == "" && (err != nil || identities["A"] == nil) || expected != "" && (err == nil || !strings.Contains(err.Error(), expected)) {
+			t.Error(config, "loaded", identities, err)
+		}
+	}
+}
+
+func TestS3Authentication(t *testing.T) {
+	gateway, closeGateway := withS3Gateway(t)
+	defer closeGateway()
+	defer func() { s3Identities = nil }()
+	s3Identities = map[string]*s3Identity{
+		"ADMIN":  {Name: "admin", AccessKey: "ADMIN", SecretKey: "admin secret", Buckets: []string{"*"}, Actions: []string{"Admin"}},
+		"BACKUP": {Name: "backup", AccessKey: "BACKUP", SecretKey: "backup secret", Buckets: []string{"backups"}, Actions: []string{"Read", "Write", "List"}},
+		"WEB":    {Name: "web", AccessKey: "WEB", SecretKey: "web secret", Buckets: []string{"images"}, Actions: []string{"Read"}},
+	}
+	do := func(accessKey string, secretKey string, method string, path string, body []byte, payloadHash string, signedAt time.Time) (int, string) {
+		req, _ := http.NewRequest(method, gateway.URL+path, bytes.NewReader(body))
+		if accessKey != "" {
+			req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+			util.SignAwsV4(req, accessKey, secretKey, "us-east-1", "s3", signedAt)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	sha := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	now := time.Now()
+	for _, c := range []struct {
+		accessKey, secretKey, method, path string
+		body                               string
+		payloadHash                        string
+		signedAt                           time.Time
+		status                             int
+		code                               string
+	}{
+		{"", "", "GET", "/", "", "", now, http.StatusForbidden, "AccessDenied"},
+		{"NOBODY", "secret", "GET", "/", "", util.UnsignedPayload, now, http.StatusForbidden, "InvalidAccessKeyId"},
+		{"ADMIN", "not the secret", "PUT", "/backups", "", util.UnsignedPayload, now, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"ADMIN", "admin secret", "PUT", "/backups", "", util.UnsignedPayload, now.Add(-time.Hour), http.StatusForbidden, "RequestTimeTooSkewed"},
+		{"BACKUP", "backup secret", "PUT", "/backups", "", util.UnsignedPayload, now, http.StatusForbidden, "AccessDenied"},
+		{"ADMIN", "admin secret", "PUT", "/backups", "", util.EmptyPayloadHash, now, http.StatusOK, ""},
+		{"ADMIN", "admin secret", "PUT", "/images", "", util.UnsignedPayload, now, http.StatusOK, ""},
+		{"BACKUP", "backup secret", "PUT", "/backups/db.tar", "dump", sha([]byte("dump")), now, http.StatusOK, ""},
+		{"BACKUP", "backup secret", "PUT", "/backups/db.tar", "tampered", sha([]byte("dump")), now, http.StatusBadRequest, "XAmzContentSHA256Mismatch"},
+		{"BACKUP", "backup secret", "GET", "/backups/db.tar", "", util.EmptyPayloadHash, now, http.StatusOK, "dump"},
+		{"BACKUP", "backup secret", "GET", "/backups?list-type=2", "", util.EmptyPayloadHash, now, http.StatusOK, "<Key>db.tar</Key>"},
+		{"BACKUP", "backup secret", "PUT", "/images/a.png", "png", util.UnsignedPayload, now, http.StatusForbidden, "AccessDenied"},
+		{"WEB", "web secret", "PUT", "/images/a.png", "png", util.UnsignedPayload, now, http.StatusForbidden, "AccessDenied"},
+		{"WEB", "web secret", "GET", "/backups/db.tar", "", util.UnsignedPayload, now, http.StatusForbidden, "AccessDenied"},
+		{"ADMIN", "admin secret", "PUT", "/images/a+b c.png", "png", util.UnsignedPayload, now, http.StatusOK, ""},
+		{"WEB", "web secret", "GET", "/images/a+b c.png", "", util.UnsignedPayload, now, http.StatusOK, "png"},
+		{"WEB", "web secret", "GET", "/", "", util.UnsignedPayload, now, http.StatusOK, "<Name>images</Name>"},
+	} {
+		status, body := do(c.accessKey, c.secretKey, c.method, c.path, []byte(c.body), c.payloadHash, c.signedAt)
+		if status != c.status || !strings.Contains(body, c.code) {
+			t.Error(c.accessKey, c.method, c.path, "got", status, body)
+		}
+	}
+	if _, body := do("WEB", "web secret", "GET", "/", nil, util.UnsignedPayload, now); strings.Contains(body, "backups") {
+		t.Error("the buckets of the others are listed", body)
+	}
+
+	// a presigned url, valid until it expires
+	presigned := func(signedAt time.Time) int {
+		req, _ := http.NewRequest("GET", gateway.URL+"/backups/db.tar", nil)
+		util.PresignAwsV4(req, "BACKUP", "backup secret", "us-east-1", "s3", signedAt, time.Hour)
+		resp, err := http.Get(req.URL.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := presigned(now.Add(-30 * time.Minute)); status != http.StatusOK {
+		t.Error("the presigned url is refused", status)
+	}
+	if status := presigned(now.Add(-2 * time.Hour)); status != http.StatusForbidden {
+		t.Error("the presigned url expired", status)
+	}
+
+	// a streaming upload, each chunk signed after the previous one
+	streamed := func(tamper bool) (int, string) {
+		content := bytes.Repeat([]byte("0123456789"), 1000)
+		req, _ := http.NewRequest("PUT", gateway.URL+"/backups/streamed.bin", nil)
+		req.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+		req.Header.Set("X-Amz-Decoded-Content-Length", strconv.Itoa(len(content)))
+		util.SignAwsV4(req, "BACKUP", "backup secret", "us-east-1", "s3", now)
+		authorization := req.Header.Get("Authorization")
+		previous := authorization[strings.LastIndex(authorization, "=")+1:]
+		amzDate := req.Header.Get("X-Amz-Date")
+		key := util.AwsV4SigningKey("backup secret", amzDate[:8], "us-east-1", "s3")
+		var body bytes.Buffer
+		for _, chunk := range [][]byte{content[:6000], content[6000:], nil} {
+			previous = util.AwsV4ChunkSignature(key, amzDate, amzDate[:8]+"/us-east-1/s3/aws4_request", previous, chunk)
+			body.WriteString(strconv.FormatInt(int64(len(chunk)), 16) + ";chunk-signature=" + previous + "\r\n")
+			body.Write(chunk)
+			body.WriteString("\r\n")
+		}
+		data := body.Bytes()
+		if tamper {
+			data[len(data)/2] ^= 1
+		}
+		req.Body, req.ContentLength = ioutil.NopCloser(bytes.NewReader(data)), int64(len(data))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+	if status, body := streamed(false); status != http.StatusOK {
+		t.Fatal("streaming upload", status, body)
+	}
+	if status, body := do("BACKUP", "backup secret", "GET", "/backups/streamed.bin", nil, util.UnsignedPayload, now); status != http.StatusOK || body != strings.Repeat("0123456789", 1000) {
+		t.Error("read the streamed upload", status, len(body))
+	}
+	if status, body := streamed(true); status != http.StatusForbidden || !strings.Contains(body, "SignatureDoesNotMatch") {
+		t.Error("a tampered chunk is accepted", status, body)
+	}
+}
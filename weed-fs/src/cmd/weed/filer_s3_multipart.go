@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"pkg/filer"
+	"pkg/operation"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A multipart upload is kept under -s3Dir.s3/uploads/<bucket>/<uploadId>/,
+// as the info file of its key, content type and x-amz-meta-* headers, and
+// the part.00001 files of its parts, each uploaded as the chunk of a chunked
+// file. Completing the upload stores the chunk manifest of the listed parts
+// as the object, and deletes the parts not listed.
+
+const (
+	s3MaxPartSize   = 1 << 30 // each part is one file, held whole by the volume servers
+	s3MaxPartNumber = 10000
+)
+
+type s3UploadInfo struct {
+	Key       string            `json:"key"`
+	Initiated int64             `json:"initiated"`
+	Mime      string            `json:"mime,omitempty"`
+	Pairs     map[string]string `json:"pairs,omitempty"`
+}
+
+func s3UploadsDir(bucket string) string {
+	return s3Root() + ".s3/uploads/" + bucket + "/"
+}
+
+func s3UploadDir(bucket string, uploadId string) string {
+	return s3UploadsDir(bucket) + uploadId + "/"
+}
+
+func s3PartFile(bucket string, uploadId string, partNumber int) string {
+	return s3UploadDir(bucket, uploadId) + fmt.Sprintf("part.%05d", partNumber)
+}
+
+func s3CreateUploadHandler(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	info := s3UploadInfo{Key: key, Initiated: time.Now().Unix(), Mime: r.Header.Get("Content-Type"), Pairs: make(map[string]string)}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			info.Pairs[http.CanonicalHeaderKey(name[len("x-amz-meta-"):])] = values[0]
+		}
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	uploadId := hex.EncodeToString(id)
+	data, _ := json.Marshal(info)
+	infoFile := s3UploadDir(bucket, uploadId) + "info"
+	fid, err := s3StoreFile(infoFile, "", "application/json", bytes.NewReader(data), nil, "")
+	if err == nil {
+		if err = filerStore.CreateFile(infoFile, fid); err != nil {
+			deleteFileId(fid)
+		}
+	}
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	writeS3Xml(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: uploadId})
+}
+
+// s3ReadUpload reads the info of the upload of the key, writing NoSuchUpload
+// if there is none.
+func s3ReadUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) (uploadId string, info *s3UploadInfo) {
+	uploadId = r.URL.Query().Get("uploadId")
+	fid, err := filerStore.FindFile(s3UploadDir(bucket, uploadId) + "info")
+	if err == filer.ErrNotFound || strings.Contains(uploadId, "/") {
+		writeS3Error(w, r, "NoSuchUpload", "the upload does not exist")
+		return "", nil
+	}
+	var data []byte
+	if err == nil {
+		data, err = s3ReadAll(fid)
+	}
+	info = new(s3UploadInfo)
+	if err == nil {
+		err = json.Unmarshal(data, info)
+	}
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return "", nil
+	}
+	if info.Key != key {
+		writeS3Error(w, r, "NoSuchUpload", "the upload is not of "+key)
+		return "", nil
+	}
+	return uploadId, info
+}
+
+func s3PartNumber(w http.ResponseWriter, r *http.Request) int {
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		writeS3Error(w, r, "InvalidArgument", "the partNumber should be from 1 to "+strconv.Itoa(s3MaxPartNumber))
+		return 0
+	}
+	return partNumber
+}
+
+func s3UploadPartHandler(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	partNumber := s3PartNumber(w, r)
+	if partNumber == 0 {
+		return
+	}
+	uploadId, info := s3ReadUpload(w, r, bucket, key)
+	if info == nil {
+		return
+	}
+	if r.ContentLength > s3MaxPartSize {
+		writeS3Error(w, r, "EntityTooLarge", "the parts are up to 1GB")
+		return
+	}
+	content, etag, cleanup, err := s3Spool(io.LimitReader(r.Body, s3MaxPartSize+1), int64(*fS3ChunkMB)<<20)
+	if err != nil {
+		writeS3Failure(w, r, err)
+		return
+	}
+	defer cleanup()
+	if content.Size() > s3MaxPartSize {
+		writeS3Error(w, r, "EntityTooLarge", "the parts are up to 1GB")
+		return
+	}
+	partFile := s3PartFile(bucket, uploadId, partNumber)
+	// without a name, the part is kept as it is, as the chunk of the object
+	fid, err := s3StoreFile(s3BucketDir(bucket)+key, "", "application/octet-stream", content, map[string]string{s3EtagPair: etag}, "")
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	oldFid, _ := filerStore.FindFile(partFile)
+	if err = filerStore.CreateFile(partFile, fid); err != nil {
+		deleteFileId(fid)
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	if oldFid != "" {
+		deleteFileId(oldFid)
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+}
+
+// s3ListParts lists the parts uploaded, in order, by part number.
+func s3ListParts(bucket string, uploadId string) (map[int]string, []int, error) {
+	fids := make(map[int]string)
+	var numbers []int
+	err := s3ListAll(s3UploadDir(bucket, uploadId), "part.", func(entry filer.FileEntry) error {
+		if partNumber, err := strconv.Atoi(strings.TrimPrefix(entry.Name, "part.")); err == nil {
+			fids[partNumber] = entry.Id
+			numbers = append(numbers, partNumber)
+		}
+		return nil
+	})
+	sort.Ints(numbers)
+	return fids, numbers, err
+}
+
+func s3CompleteUploadHandler(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	var request struct {
+		Part []struct {
+			PartNumber int
+			ETag       string
+		}
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 4<<20)).Decode(&request); err != nil || len(request.Part) == 0 {
+		writeS3Error(w, r, "MalformedXML", "expecting the parts of the upload")
+		return
+	}
+	uploadId, info := s3ReadUpload(w, r, bucket, key)
+	if info == nil {
+		return
+	}
+	fids, numbers, err := s3ListParts(bucket, uploadId)
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	fullFileName := s3BucketDir(bucket) + key
+	manifest := &operation.ChunkManifest{Name: path.Base(key), Mime: info.Mime, Pairs: make(map[string]string)}
+	listed := make(map[int]bool)
+	md5s := md5.New()
+	for i, part := range request.Part {
+		if i > 0 && part.PartNumber <= request.Part[i-1].PartNumber {
+			writeS3Error(w, r, "InvalidPartOrder", "the parts should be listed in ascending order")
+			return
+		}
+		fid, found := fids[part.PartNumber]
+		var partInfo *s3FileInfo
+		if found {
+			partInfo, err = s3Head(fid, "")
+		}
+		if !found || err != nil || partInfo.etag != strings.Trim(part.ETag, `"`) {
+			writeS3Error(w, r, "InvalidPart", "part "+strconv.Itoa(part.PartNumber)+" is not uploaded with its etag")
+			return
+		}
+		listed[part.PartNumber] = true
+		sum, _ := hex.DecodeString(partInfo.etag)
+		md5s.Write(sum)
+		if partInfo.size > 0 {
+			manifest.Chunks = append(manifest.Chunks, operation.ChunkInfo{Fid: fid, Offset: manifest.Size, Size: partInfo.size, Md5: partInfo.etag})
+			manifest.Size += partInfo.size
+		}
+	}
+	etag := hex.EncodeToString(md5s.Sum(nil)) + "-" + strconv.Itoa(len(request.Part))
+	for name, value := range info.Pairs {
+		manifest.Pairs[name] = value
+	}
+	manifest.Pairs[s3EtagPair] = etag
+	if info.Mime != "" {
+		manifest.Pairs[s3ContentPair] = info.Mime
+	}
+	data, _ := json.Marshal(manifest)
+	fid, err := s3StoreFile(fullFileName, "", "application/json", bytes.NewReader(data), manifest.Pairs, "cm=true")
+	if err == nil {
+		err = s3CreateObject(fullFileName, fid, manifest.Size, manifest.Pairs)
+	}
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	for _, partNumber := range numbers {
+		if !listed[partNumber] {
+			deleteFileId(fids[partNumber])
+		}
+	}
+	s3DeleteUpload(bucket, uploadId, numbers)
+	writeS3Xml(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Xmlns: s3Namespace, Location: "/" + bucket + "/" + key, Bucket: bucket, Key: key, ETag: `"` + etag + `"`})
+}
+
+// s3DeleteUpload deletes the entries of the upload, and the file of its info,
+// but not the files of its parts.
+func s3DeleteUpload(bucket string, uploadId string, numbers []int) {
+	for _, partNumber := range numbers {
+		filerStore.DeleteFile(s3PartFile(bucket, uploadId, partNumber))
+	}
+	if fid, err := filerStore.DeleteFile(s3UploadDir(bucket, uploadId) + "info"); err == nil {
+		deleteFileId(fid)
+	}
+}
+
+func s3AbortUploadHandler(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	uploadId, info := s3ReadUpload(w, r, bucket, key)
+	if info == nil {
+		return
+	}
+	fids, numbers, err := s3ListParts(bucket, uploadId)
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	for _, partNumber := range numbers {
+		deleteFileId(fids[partNumber])
+	}
+	s3DeleteUpload(bucket, uploadId, numbers)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type s3Part struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+func s3ListPartsHandler(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	uploadId, info := s3ReadUpload(w, r, bucket, key)
+	if info == nil {
+		return
+	}
+	query := r.URL.Query()
+	maxParts, err := strconv.Atoi(query.Get("max-parts"))
+	if err != nil || maxParts <= 0 || maxParts > s3MaxKeys {
+		maxParts = s3MaxKeys
+	}
+	marker, _ := strconv.Atoi(query.Get("part-number-marker"))
+	fids, numbers, err := s3ListParts(bucket, uploadId)
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	result := struct {
+		XMLName              xml.Name `xml:"ListPartsResult"`
+		Xmlns                string   `xml:"xmlns,attr"`
+		Bucket               string
+		Key                  string
+		UploadId             string
+		PartNumberMarker     int
+		NextPartNumberMarker int
+		MaxParts             int
+		IsTruncated          bool
+		Part                 []s3Part
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: uploadId, PartNumberMarker: marker, MaxParts: maxParts}
+	for _, partNumber := range numbers {
+		if partNumber <= marker {
+			continue
+		}
+		if len(result.Part) == maxParts {
+			result.IsTruncated = true
+			break
+		}
+		partInfo, err := s3Head(fids[partNumber], "")
+		if err != nil {
+			writeS3Error(w, r, "InternalError", err.Error())
+			return
+		}
+		result.Part = append(result.Part, s3Part{partNumber, partInfo.lastModified, `"` + partInfo.etag + `"`, partInfo.size})
+		result.NextPartNumberMarker = partNumber
+	}
+	writeS3Xml(w, http.StatusOK, result)
+}
+
+type s3UploadEntry struct {
+	Key       string
+	UploadId  string
+	Initiated string
+}
+
+func s3ListUploadsHandler(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	var uploads []s3UploadEntry
+	err := s3ListAll(s3UploadsDir(bucket), "", func(entry filer.FileEntry) error {
+		uploadId := strings.TrimSuffix(entry.Name, "/")
+		fid, err := filerStore.FindFile(s3UploadDir(bucket, uploadId) + "info")
+		if err != nil {
+			return nil
+		}
+		var info s3UploadInfo
+		if data, err := s3ReadAll(fid); err != nil || json.Unmarshal(data, &info) != nil {
+			return nil
+		}
+		if strings.HasPrefix(info.Key, prefix) {
+			uploads = append(uploads, s3UploadEntry{info.Key, uploadId, time.Unix(info.Initiated, 0).UTC().Format(s3TimeFormat)})
+		}
+		return nil
+	})
+	if err != nil {
+		writeS3Error(w, r, "InternalError", err.Error())
+		return
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Key != uploads[j].Key {
+			return uploads[i].Key < uploads[j].Key
+		}
+		return uploads[i].UploadId < uploads[j].UploadId
+	})
+	writeS3Xml(w, http.StatusOK, struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket      string
+		Prefix      string
+		MaxUploads  int
+		IsTruncated bool
+		Upload      []s3UploadEntry
+	}{Xmlns: s3Namespace, Bucket: bucket, Prefix: prefix, MaxUploads: s3MaxKeys, Upload: uploads})
+}
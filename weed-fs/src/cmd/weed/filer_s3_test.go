@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"pkg/directory"
+	"pkg/filer"
+	"pkg/storage"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// withS3Gateway runs the S3 api of a filer over an embedded store, with the
+// test store as its only volume server.
+func withS3Gateway(t *testing.T) (*httptest.Server, func()) {
+	restoreStore := withTestStore(t, []byte("unchunked"))
+	dir, err := ioutil.TempDir("", "weedfs_s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousStore, previousVersions := filerStore, filerVersions
+	previous := []string{*vSecureKey, *fSecureKey, *masterNode, *filerMaster, *ip}
+	previousPort, previousChunkMB := *vport, *fS3ChunkMB
+	if filerStore, err = filer.NewEmbeddedStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	filerVersions, _ = parseVersionLimits("0")
+	*vSecureKey, *fSecureKey = "secret", "secret"
+	volumeLatency = util.NewLatencyStats(nil)
+	volumeServer := startChunkServer(t, "3,02637037e0")
+	*filerMaster = *masterNode
+	gateway := httptest.NewServer(http.HandlerFunc(s3Handler))
+	return gateway, func() {
+		gateway.Close()
+		volumeServer.Close()
+		filerStore.Close()
+		os.RemoveAll(dir)
+		filerStore, filerVersions = previousStore, previousVersions
+		*vSecureKey, *fSecureKey, *masterNode, *filerMaster, *ip = previous[0], previous[1], previous[2], previous[3], previous[4]
+		*vport, *fS3ChunkMB = previousPort, previousChunkMB
+		restoreStore()
+	}
+}
+
+func s3Do(t *testing.T, method string, url string, body []byte, header map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp, data
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestS3Gateway(t *testing.T) {
+	gateway, closeGateway := withS3Gateway(t)
+	defer closeGateway()
+	url := gateway.URL
+
+	if resp, body := s3Do(t, "PUT", url+"/photos/a.txt", []byte("a"), nil); resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "NoSuchBucket") {
+		t.Fatal("uploaded to a missing bucket", resp.Status, string(body))
+	}
+	if resp, _ := s3Do(t, "PUT", url+"/photos", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatal("create bucket", resp.Status)
+	}
+	if resp, body := s3Do(t, "GET", url+"/", nil, nil); !strings.Contains(string(body), "<Name>photos</Name>") {
+		t.Fatal("list buckets", resp.Status, string(body))
+	}
+	if resp, _ := s3Do(t, "PUT", url+"/Not_A_Bucket", nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("created an invalid bucket", resp.Status)
+	}
+
+	resp, _ := s3Do(t, "PUT", url+"/photos/2024/a.txt", []byte("hello"), map[string]string{"Content-Type": "text/plain", "X-Amz-Meta-Camera": "nikon"})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"`+md5Hex([]byte("hello"))+`"` {
+		t.Fatal("put", resp.Status, resp.Header)
+	}
+	resp, body := s3Do(t, "GET", url+"/photos/2024/a.txt", nil, nil)
+	if string(body) != "hello" || resp.Header.Get("Content-Type") != "text/plain" || resp.Header.Get("X-Amz-Meta-Camera") != "nikon" ||
+		resp.Header.Get("ETag") != `"`+md5Hex([]byte("hello"))+`"` || resp.Header.Get("X-Weed-Meta-Camera") != "" {
+		t.Fatal("get", resp.Status, string(body), resp.Header)
+	}
+	if resp, body = s3Do(t, "GET", url+"/photos/2024/a.txt", nil, map[string]string{"Range": "bytes=1-3"}); resp.StatusCode != http.StatusPartialContent || string(body) != "ell" {
+		t.Fatal("get a range", resp.Status, string(body))
+	}
+	if resp, _ = s3Do(t, "HEAD", url+"/photos/2024/a.txt", nil, nil); resp.StatusCode != http.StatusOK || resp.ContentLength != 5 {
+		t.Fatal("head", resp.Status, resp.ContentLength)
+	}
+	if resp, _ = s3Do(t, "PUT", url+"/photos/2024/a.txt", []byte("hello"), map[string]string{"Content-Md5": "bm90IHRoZSBtZDUgb2YgaXQ="}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("put with another md5", resp.Status)
+	}
+	if resp, _ = s3Do(t, "GET", url+"/photos/2024/none.txt", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("get a missing key", resp.Status)
+	}
+
+	// an object over -s3ChunkMB is stored in chunks
+	*fS3ChunkMB = 1
+	big := make([]byte, 2500000)
+	for i := range big {
+		big[i] = byte(i * 7)
+	}
+	if resp, _ = s3Do(t, "PUT", url+"/photos/big.bin", big, nil); resp.StatusCode != http.StatusOK {
+		t.Fatal("put big", resp.Status)
+	}
+	fid, _ := filerStore.FindFile("/buckets/photos/big.bin")
+	if n := readFileId(t, fid); !n.IsChunkManifest() {
+		t.Fatal("the big object should be chunked")
+	}
+	if resp, body = s3Do(t, "GET", url+"/photos/big.bin", nil, nil); !bytes.Equal(body, big) || resp.Header.Get("ETag") != `"`+md5Hex(big)+`"` {
+		t.Fatal("get big", resp.Status, len(body), resp.Header.Get("ETag"))
+	}
+	s3Do(t, "PUT", url+"/photos/2024/b.txt", []byte("b"), nil)
+	s3Do(t, "PUT", url+"/photos/top.txt", []byte("top"), nil)
+
+	list := func(query string) s3ListResult {
+		resp, body := s3Do(t, "GET", url+"/photos?"+query, nil, nil)
+		var result s3ListResult
+		if err := xml.Unmarshal(body, &result); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("list", query, resp.Status, string(body))
+		}
+		return result
+	}
+	keys := func(result s3ListResult) string {
+		var keys []string
+		for _, prefix := range result.CommonPrefixes {
+			keys = append(keys, prefix.Prefix)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key+":"+strconv.FormatInt(object.Size, 10))
+		}
+		return strings.Join(keys, ",")
+	}
+	if result := list("delimiter=/"); keys(result) != "2024/,big.bin:2500000,top.txt:3" || result.IsTruncated {
+		t.Error("list with the delimiter", keys(result))
+	}
+	first := list("list-type=2&max-keys=2")
+	if keys(first) != "2024/a.txt:5,2024/b.txt:1" || !first.IsTruncated || *first.KeyCount != 2 || first.Contents[0].ETag != `"`+md5Hex([]byte("hello"))+`"` {
+		t.Fatal("list the first page", keys(first), first.IsTruncated)
+	}
+	if next := list("list-type=2&max-keys=2&continuation-token=" + first.NextContinuationToken); keys(next) != "big.bin:2500000,top.txt:3" || next.IsTruncated {
+		t.Error("list the next page", keys(next))
+	}
+	if result := list("prefix=2024/b"); keys(result) != "2024/b.txt:1" {
+		t.Error("list the prefix", keys(result))
+	}
+	if result := list("marker=2024/a.txt&delimiter=/"); keys(result) != "2024/,big.bin:2500000,top.txt:3" {
+		t.Error("list after a key under a common prefix", keys(result))
+	}
+	if result := list("marker=2024/&delimiter=/"); keys(result) != "big.bin:2500000,top.txt:3" {
+		t.Error("list after the common prefix", keys(result))
+	}
+	if result := list("prefix=2024/&delimiter=/&marker=2024/a.txt"); keys(result) != "2024/b.txt:1" {
+		t.Error("list after the marker", keys(result))
+	}
+
+	deleteRequest := []byte(`<Delete><Object><Key>2024/a.txt</Key></Object><Object><Key>2024/b.txt</Key></Object></Delete>`)
+	if resp, body = s3Do(t, "POST", url+"/photos?delete", deleteRequest, nil); strings.Count(string(body), "<Deleted>") != 2 {
+		t.Fatal("delete objects", resp.Status, string(body))
+	}
+	if result := list(""); keys(result) != "big.bin:2500000,top.txt:3" {
+		t.Error("list after deleting", keys(result))
+	}
+	if resp, body = s3Do(t, "DELETE", url+"/photos", nil, nil); resp.StatusCode != http.StatusConflict || !strings.Contains(string(body), "BucketNotEmpty") {
+		t.Fatal("deleted a bucket with objects", resp.Status)
+	}
+	s3Do(t, "DELETE", url+"/photos/big.bin", nil, nil)
+	if resp, _ = s3Do(t, "DELETE", url+"/photos/top.txt", nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatal("delete", resp.Status)
+	}
+	if resp, _ = s3Do(t, "HEAD", url+"/photos", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatal("the empty bucket should exist", resp.Status)
+	}
+	if resp, _ = s3Do(t, "DELETE", url+"/photos", nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatal("delete bucket", resp.Status)
+	}
+	if resp, _ = s3Do(t, "HEAD", url+"/photos", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("the deleted bucket should not exist", resp.Status)
+	}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	gateway, closeGateway := withS3Gateway(t)
+	defer closeGateway()
+	url := gateway.URL + "/backups"
+	s3Do(t, "PUT", url, nil, nil)
+
+	initiate := func() string {
+		resp, body := s3Do(t, "POST", url+"/db/dump.tar?uploads", nil, map[string]string{"Content-Type": "application/x-tar", "X-Amz-Meta-Host": "db1"})
+		var result struct{ UploadId string }
+		if err := xml.Unmarshal(body, &result); err != nil || result.UploadId == "" {
+			t.Fatal("initiate", resp.Status, string(body))
+		}
+		return result.UploadId
+	}
+	uploadPart := func(uploadId string, partNumber int, data []byte) string {
+		resp, body := s3Do(t, "PUT", url+"/db/dump.tar?partNumber="+strconv.Itoa(partNumber)+"&uploadId="+uploadId, data, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("upload part", partNumber, resp.Status, string(body))
+		}
+		return resp.Header.Get("ETag")
+	}
+	uploadId := initiate()
+	parts := [][]byte{bytes.Repeat([]byte("first part "), 1000), []byte("second part"), []byte("not listed")}
+	etags := make([]string, 3)
+	for _, i := range []int{1, 0, 2} {
+		etags[i] = uploadPart(uploadId, i+1, parts[i])
+	}
+	if resp, body := s3Do(t, "GET", url+"/db/dump.tar?uploadId="+uploadId, nil, nil); strings.Count(string(body), "<Part>") != 3 || !strings.Contains(string(body), "<Size>11</Size>") {
+		t.Fatal("list parts", resp.Status, string(body))
+	}
+	if resp, body := s3Do(t, "GET", url+"?uploads", nil, nil); !strings.Contains(string(body), "<UploadId>"+uploadId+"</UploadId>") {
+		t.Fatal("list uploads", resp.Status, string(body))
+	}
+
+	complete := func(etags ...string) (*http.Response, []byte) {
+		request := "<CompleteMultipartUpload>"
+		for i, etag := range etags {
+			request += "<Part><PartNumber>" + strconv.Itoa(i+1) + "</PartNumber><ETag>" + etag + "</ETag></Part>"
+		}
+		return s3Do(t, "POST", url+"/db/dump.tar?uploadId="+uploadId, []byte(request+"</CompleteMultipartUpload>"), nil)
+	}
+	if resp, body := complete(etags[0], etags[0]); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "InvalidPart") {
+		t.Fatal("completed with a wrong etag", resp.Status, string(body))
+	}
+	resp, body := complete(etags[0], etags[1])
+	sum0, _ := hex.DecodeString(md5Hex(parts[0]))
+	sum1, _ := hex.DecodeString(md5Hex(parts[1]))
+	etag := `"` + md5Hex(append(sum0, sum1...)) + `-2"`
+	var completed struct{ ETag string }
+	if err := xml.Unmarshal(body, &completed); err != nil || completed.ETag != etag {
+		t.Fatal("complete", resp.Status, string(body))
+	}
+
+	content := append(append([]byte{}, parts[0]...), parts[1]...)
+	resp, body = s3Do(t, "GET", url+"/db/dump.tar", nil, nil)
+	if !bytes.Equal(body, content) || resp.Header.Get("ETag") != etag || resp.Header.Get("Content-Type") != "application/x-tar" || resp.Header.Get("X-Amz-Meta-Host") != "db1" {
+		t.Fatal("read the completed upload", resp.Status, len(body), resp.Header)
+	}
+	if resp, body = s3Do(t, "GET", url+"/db/dump.tar", nil, map[string]string{"Range": "bytes=10990-11005"}); string(body) != string(content[10990:11006]) {
+		t.Fatal("read a range across the parts", resp.Status, string(body))
+	}
+	fid, _ := filerStore.FindFile("/buckets/backups/db/dump.tar")
+	manifest := readFileId(t, fid)
+	if !manifest.IsChunkManifest() || !strings.Contains(string(manifest.Data), etags[1][1:len(etags[1])-1]) {
+		t.Fatal("the object should be the manifest of its parts", string(manifest.Data))
+	}
+	if resp, body = s3Do(t, "GET", url+"?uploads", nil, nil); strings.Contains(string(body), "<Upload>") {
+		t.Fatal("the completed upload is still listed", string(body))
+	}
+	entries, _ := filerStore.ListEntries("/buckets/.s3/uploads/backups/", "", "", 10)
+	if len(entries) != 0 {
+		t.Error("the entries of the upload are left behind", entries)
+	}
+
+	// an aborted upload deletes its parts
+	uploadId = initiate()
+	uploadPart(uploadId, 1, []byte("aborted"))
+	partFid, _ := filerStore.FindFile(s3PartFile("backups", uploadId, 1))
+	if resp, _ = s3Do(t, "DELETE", url+"/db/dump.tar?uploadId="+uploadId, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatal("abort", resp.Status)
+	}
+	if id, _ := directory.ParseFileId(partFid); readNeedle(3, &storage.Needle{Id: id.Key, Cookie: id.Hashcode}) {
+		t.Error("the part of the aborted upload should be deleted")
+	}
+	if resp, _ = s3Do(t, "PUT", url+"/db/dump.tar?partNumber=1&uploadId="+uploadId, []byte("late"), nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal("uploaded a part to an aborted upload", resp.Status)
+	}
+}
+
+// readFileId reads the needle of the fid from the test store.
+func readFileId(t *testing.T, fid string) *storage.Needle {
+	id, err := directory.ParseFileId(fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &storage.Needle{Id: id.Key, Cookie: id.Hashcode}
+	if !readNeedle(id.VolumeId, n) {
+		t.Fatal(fid, "is not found")
+	}
+	return n
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"pkg/filer"
+	"pkg/notification"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -webhdfs, the filer also serves the WebHDFS REST api of Hadoop under
+// /webhdfs/v1/, on top of its paths, for the webhdfs:// file system built in
+// Hadoop and Spark, e.g. webhdfs://filer:8888/logs/2024/ is the filer
+// directory /logs/2024/. The filer is both the name node and the data node:
+// OPEN and CREATE are redirected to the same url with data=true, where the
+// content is read with ranges, or written in chunks of -webhdfsChunkMB.
+// The directories made by MKDIRS are kept, even while empty, by the files
+// /.webhdfs/dirs/<path>/.dir, hidden from the WebHDFS listings.
+
+const (
+	webhdfsPrefix   = "/webhdfs/v1"
+	webhdfsRoot     = "/.webhdfs"
+	webhdfsDirsRoot = webhdfsRoot + "/dirs"
+	webhdfsDirFile  = ".dir"
+)
+
+type webhdfsException struct {
+	status    int
+	className string
+}
+
+// webhdfsExceptions are the java classes of the exceptions, and their status
+// as WebHDFS answers them, for the clients to throw them again.
+var webhdfsExceptions = map[string]webhdfsException{
+	"AccessControlException":           {http.StatusForbidden, "org.apache.hadoop.security.AccessControlException"},
+	"FileAlreadyExistsException":       {http.StatusForbidden, "org.apache.hadoop.fs.FileAlreadyExistsException"},
+	"FileNotFoundException":            {http.StatusNotFound, "java.io.FileNotFoundException"},
+	"IllegalArgumentException":         {http.StatusBadRequest, "java.lang.IllegalArgumentException"},
+	"IOException":                      {http.StatusInternalServerError, "java.io.IOException"},
+	"ParentNotDirectoryException":      {http.StatusForbidden, "org.apache.hadoop.fs.ParentNotDirectoryException"},
+	"PathIsNotEmptyDirectoryException": {http.StatusForbidden, "org.apache.hadoop.fs.PathIsNotEmptyDirectoryException"},
+	"UnsupportedOperationException":    {http.StatusBadRequest, "java.lang.UnsupportedOperationException"},
+}
+
+func writeWebhdfsError(w http.ResponseWriter, r *http.Request, exception string, message string) {
+	e := webhdfsExceptions[exception]
+	w.WriteHeader(e.status)
+	writeJson(w, r, map[string]interface{}{"RemoteException": map[string]string{
+		"exception": exception, "javaClassName": e.className, "message": message}})
+}
+
+// webhdfsFileStatus is the FileStatus of WebHDFS, its times in milliseconds.
+type webhdfsFileStatus struct {
+	AccessTime       int64  `json:"accessTime"`
+	BlockSize        int64  `json:"blockSize"`
+	Group            string `json:"group"`
+	Length           int64  `json:"length"`
+	ModificationTime int64  `json:"modificationTime"`
+	Owner            string `json:"owner"`
+	PathSuffix       string `json:"pathSuffix"`
+	Permission       string `json:"permission"`
+	Replication      int    `json:"replication"`
+	Type             string `json:"type"`
+}
+
+func webhdfsFile(name string, size int64, modified time.Time) webhdfsFileStatus {
+	millis := modified.UnixNano() / int64(time.Millisecond)
+	return webhdfsFileStatus{AccessTime: millis, BlockSize: int64(*fWebhdfsChunkMB) << 20, Group: "weed", Length: size,
+		ModificationTime: millis, Owner: "weed", PathSuffix: name, Permission: "644", Replication: 1, Type: "FILE"}
+}
+
+func webhdfsDirectory(name string) webhdfsFileStatus {
+	return webhdfsFileStatus{Group: "weed", Owner: "weed", PathSuffix: name, Permission: "755", Type: "DIRECTORY"}
+}
+
+// webhdfsHandler serves the WebHDFS operations on the filer path after /webhdfs/v1:
+//
+//	GET    /webhdfs/v1/<path>?op=GETFILESTATUS, LISTSTATUS, OPEN or GETHOMEDIRECTORY
+//	PUT    /webhdfs/v1/<path>?op=CREATE, MKDIRS or RENAME
+//	DELETE /webhdfs/v1/<path>?op=DELETE
+func webhdfsHandler(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/" + strings.TrimPrefix(r.URL.Path, webhdfsPrefix))
+	if p == webhdfsRoot || strings.HasPrefix(p, webhdfsRoot+"/") {
+		writeWebhdfsError(w, r, "AccessControlException", webhdfsRoot+" is kept by the filer")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		webhdfsGetHandler(w, r, p)
+	case "PUT":
+		webhdfsPutHandler(w, r, p)
+	case "DELETE":
+		webhdfsDeleteHandler(w, r, p)
+	default:
+		writeWebhdfsError(w, r, "UnsupportedOperationException", r.Method+" is not supported")
+	}
+}
+
+func webhdfsGetHandler(w http.ResponseWriter, r *http.Request, p string) {
+	switch op := strings.ToUpper(r.URL.Query().Get("op")); op {
+	case "GETFILESTATUS":
+		status, err := webhdfsStatus(p)
+		if err != nil {
+			writeWebhdfsError(w, r, "IOException", err.Error())
+			return
+		}
+		if status == nil {
+			writeWebhdfsError(w, r, "FileNotFoundException", "File does not exist: "+p)
+			return
+		}
+		writeJson(w, r, map[string]interface{}{"FileStatus": status})
+	case "LISTSTATUS":
+		statuses, err := webhdfsListStatus(p)
+		if err != nil {
+			writeWebhdfsError(w, r, "IOException", err.Error())
+			return
+		}
+		if statuses == nil {
+			writeWebhdfsError(w, r, "FileNotFoundException", "File "+p+" does not exist.")
+			return
+		}
+		writeJson(w, r, map[string]interface{}{"FileStatuses": map[string]interface{}{"FileStatus": statuses}})
+	case "OPEN":
+		webhdfsOpenHandler(w, r, p)
+	case "GETHOMEDIRECTORY":
+		home := "/"
+		if user := r.URL.Query().Get("user.name"); user != "" {
+			home = "/user/" + user
+		}
+		writeJson(w, r, map[string]string{"Path": home})
+	default:
+		writeWebhdfsError(w, r, "UnsupportedOperationException", "GET "+op+" is not supported")
+	}
+}
+
+func webhdfsPutHandler(w http.ResponseWriter, r *http.Request, p string) {
+	switch op := strings.ToUpper(r.URL.Query().Get("op")); op {
+	case "CREATE":
+		webhdfsCreateHandler(w, r, p)
+	case "MKDIRS":
+		webhdfsMkdirsHandler(w, r, p)
+	case "RENAME":
+		webhdfsRenameHandler(w, r, p)
+	default:
+		writeWebhdfsError(w, r, "UnsupportedOperationException", "PUT "+op+" is not supported")
+	}
+}
+
+// webhdfsMarkerDir is the directory of the files keeping the directories made
+// under p, and p itself with its .dir file.
+func webhdfsMarkerDir(p string) string {
+	return webhdfsDirsRoot + strings.TrimSuffix(p, "/") + "/"
+}
+
+func webhdfsDirExists(p string) (bool, error) {
+	if p == "/" {
+		return true, nil
+	}
+	for _, dir := range []string{p + "/", webhdfsMarkerDir(p)} {
+		entries, err := filerStore.ListEntries(dir, "", "", 1)
+		if err != nil || len(entries) > 0 {
+			return len(entries) > 0, err
+		}
+	}
+	return false, nil
+}
+
+// webhdfsStatus is the status of the file or directory, nil if it does not exist.
+func webhdfsStatus(p string) (*webhdfsFileStatus, error) {
+	if p != "/" {
+		fid, err := filerStore.FindFile(p)
+		if err == nil {
+			info, err := s3Head(fid, path.Ext(p))
+			if err != nil {
+				return nil, err
+			}
+			status := webhdfsFile("", info.size, info.modified)
+			return &status, nil
+		}
+		if err != filer.ErrNotFound {
+			return nil, err
+		}
+	}
+	if exists, err := webhdfsDirExists(p); err != nil || !exists {
+		return nil, err
+	}
+	status := webhdfsDirectory("")
+	return &status, nil
+}
+
+// webhdfsListStatus lists the files and directories of the directory, in the
+// order of their names, or the file itself, and nil if it does not exist.
+func webhdfsListStatus(p string) ([]webhdfsFileStatus, error) {
+	status, err := webhdfsStatus(p)
+	if err != nil || status == nil {
+		return nil, err
+	}
+	if status.Type == "FILE" {
+		return []webhdfsFileStatus{*status}, nil
+	}
+	dir := strings.TrimSuffix(p, "/") + "/"
+	fids := make(map[string]string) // by name, empty for the directories
+	err = s3ListAll(dir, "", func(entry filer.FileEntry) error {
+		if dir+entry.Name != webhdfsRoot+"/" {
+			fids[strings.TrimSuffix(entry.Name, "/")] = entry.Id
+		}
+		return nil
+	})
+	if err == nil {
+		err = s3ListAll(webhdfsMarkerDir(p), "", func(entry filer.FileEntry) error {
+			if strings.HasSuffix(entry.Name, "/") {
+				fids[strings.TrimSuffix(entry.Name, "/")] = ""
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fids))
+	for name := range fids {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]s3Object, len(names))
+	for i, name := range names {
+		files[i] = s3Object{Key: name, fid: fids[name]}
+	}
+	if err = s3HeadObjects(files); err != nil {
+		return nil, err
+	}
+	statuses := make([]webhdfsFileStatus, len(files))
+	for i, file := range files {
+		if file.fid == "" {
+			statuses[i] = webhdfsDirectory(file.Key)
+		} else {
+			statuses[i] = webhdfsFile(file.Key, file.Size, file.modified)
+		}
+	}
+	return statuses, nil
+}
+
+// webhdfsRedirect answers the first step of OPEN and CREATE, sent to the name
+// node, with the url of the data node reading or writing the content: the
+// same url with data=true, in the Location header, or in the json answered
+// with noredirect=true.
+func webhdfsRedirect(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	query.Set("data", "true")
+	scheme := "http://"
+	if r.TLS != nil {
+		scheme = "https://"
+	}
+	location := scheme + r.Host + r.URL.EscapedPath() + "?" + query.Encode()
+	if r.URL.Query().Get("noredirect") == "true" {
+		writeJson(w, r, map[string]string{"Location": location})
+		return
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// webhdfsOpenHandler reads the length bytes of the file from the offset, or
+// up to its end without a length.
+func webhdfsOpenHandler(w http.ResponseWriter, r *http.Request, p string) {
+	fid, err := filerStore.FindFile(p)
+	if err == filer.ErrNotFound {
+		writeWebhdfsError(w, r, "FileNotFoundException", "File does not exist: "+p)
+		return
+	}
+	if err != nil {
+		writeWebhdfsError(w, r, "IOException", err.Error())
+		return
+	}
+	if r.URL.Query().Get("data") != "true" {
+		webhdfsRedirect(w, r)
+		return
+	}
+	offset, length := int64(0), int64(-1)
+	if value := r.URL.Query().Get("offset"); value != "" {
+		if offset, err = strconv.ParseInt(value, 10, 64); err != nil || offset < 0 {
+			writeWebhdfsError(w, r, "IllegalArgumentException", "offset should be a positive number")
+			return
+		}
+	}
+	if value := r.URL.Query().Get("length"); value != "" {
+		if length, err = strconv.ParseInt(value, 10, 64); err != nil || length < 0 {
+			writeWebhdfsError(w, r, "IllegalArgumentException", "length should be a positive number")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if length == 0 {
+		w.Header().Set("Content-Length", "0")
+		return
+	}
+	req, _ := http.NewRequestWithContext(r.Context(), "GET", "/", nil)
+	if length > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+length-1, 10))
+	} else if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := s3ReadFile(req, fid, path.Ext(p))
+	if err != nil {
+		writeWebhdfsError(w, r, "IOException", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// reading from the end of the file
+		w.Header().Set("Content-Length", "0")
+		return
+	default:
+		writeWebhdfsError(w, r, "IOException", fid+" answered "+resp.Status)
+		return
+	}
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	io.Copy(w, resp.Body)
+}
+
+// webhdfsParentFile is the parent directory of p which is a file, if any.
+func webhdfsParentFile(p string) (string, error) {
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		if _, err := filerStore.FindFile(dir); err != filer.ErrNotFound {
+			if err != nil {
+				return "", err
+			}
+			return dir, nil
+		}
+	}
+	return "", nil
+}
+
+// webhdfsCreateHandler writes the file, making its parent directories, and
+// fails if it exists unless overwrite=true.
+func webhdfsCreateHandler(w http.ResponseWriter, r *http.Request, p string) {
+	if exists, err := webhdfsDirExists(p); err != nil || exists {
+		if err != nil {
+			writeWebhdfsError(w, r, "IOException", err.Error())
+		} else {
+			writeWebhdfsError(w, r, "FileAlreadyExistsException", p+" already exists as a directory")
+		}
+		return
+	}
+	if _, err := filerStore.FindFile(p); err == nil && r.URL.Query().Get("overwrite") != "true" {
+		writeWebhdfsError(w, r, "FileAlreadyExistsException", p+" already exists")
+		return
+	}
+	if parent, err := webhdfsParentFile(p); err != nil || parent != "" {
+		if err != nil {
+			writeWebhdfsError(w, r, "IOException", err.Error())
+		} else {
+			writeWebhdfsError(w, r, "ParentNotDirectoryException", "Parent path is not a directory: "+parent)
+		}
+		return
+	}
+	if r.URL.Query().Get("data") != "true" {
+		webhdfsRedirect(w, r)
+		return
+	}
+	pairs := make(map[string]string)
+	fid, size, _, err := s3StoreObject(p, r.Body, pairs, int64(*fWebhdfsChunkMB)<<20)
+	if err == nil {
+		err = s3CreateObject(p, fid, size, pairs)
+	}
+	if err != nil {
+		writeWebhdfsError(w, r, "IOException", err.Error())
+		return
+	}
+	w.Header().Set("Location", "webhdfs://"+r.Host+p)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// webhdfsMkdirsHandler makes the directory, and its parent directories.
+func webhdfsMkdirsHandler(w http.ResponseWriter, r *http.Request, p string) {
+	if _, err := filerStore.FindFile(p); err == nil {
+		writeWebhdfsError(w, r, "FileAlreadyExistsException", "Path is not a directory: "+p)
+		return
+	}
+	if parent, err := webhdfsParentFile(p); err != nil || parent != "" {
+		if err != nil {
+			writeWebhdfsError(w, r, "IOException", err.Error())
+		} else {
+			writeWebhdfsError(w, r, "ParentNotDirectoryException", "Parent path is not a directory: "+parent)
+		}
+		return
+	}
+	if err := webhdfsMkdir(p); err != nil {
+		writeWebhdfsError(w, r, "IOException", err.Error())
+		return
+	}
+	writeJson(w, r, map[string]bool{"boolean": true})
+}
+
+// webhdfsMkdir keeps the directory with its .dir file, unless it exists already.
+func webhdfsMkdir(p string) error {
+	exists, err := webhdfsDirExists(p)
+	if err != nil || exists {
+		return err
+	}
+	marker := webhdfsMarkerDir(p) + webhdfsDirFile
+	fid, err := s3StoreFile(marker, "", "application/json", strings.NewReader("{}"), nil, "")
+	if err == nil {
+		if err = filerStore.CreateFile(marker, fid); err != nil {
+			deleteFileId(fid)
+		}
+	}
+	return err
+}
+
+// webhdfsRenameHandler moves the file or directory to the destination, or into
+// it if it is a directory, and answers false if the source does not exist, if
+// the destination exists, or if its parent directory does not. As in HDFS, the
+// directory of the source is kept, even if left empty.
+func webhdfsRenameHandler(w http.ResponseWriter, r *http.Request, p string) {
+	destination := r.URL.Query().Get("destination")
+	if !strings.HasPrefix(destination, "/") {
+		writeWebhdfsError(w, r, "IllegalArgumentException", "the destination should be an absolute path")
+		return
+	}
+	to := path.Clean(destination)
+	if to == webhdfsRoot || strings.HasPrefix(to, webhdfsRoot+"/") {
+		writeWebhdfsError(w, r, "AccessControlException", webhdfsRoot+" is kept by the filer")
+		return
+	}
+	renamed, err := webhdfsRename(p, to)
+	if err != nil {
+		writeWebhdfsError(w, r, "IOException", err.Error())
+		return
+	}
+	writeJson(w, r, map[string]bool{"boolean": renamed})
+}
+
+func webhdfsRename(from string, to string) (bool, error) {
+	if from == "/" || strings.HasPrefix(to, from+"/") {
+		return false, nil
+	}
+	status, err := webhdfsStatus(from)
+	if err != nil || status == nil || from == to {
+		return err == nil && status != nil, err
+	}
+	if exists, err := webhdfsDirExists(to); err != nil {
+		return false, err
+	} else if exists {
+		to = path.Join(to, path.Base(from))
+	}
+	if target, err := webhdfsStatus(to); err != nil || target != nil {
+		return false, err
+	}
+	if exists, err := webhdfsDirExists(path.Dir(to)); err != nil || !exists {
+		return false, err
+	}
+	if status.Type == "FILE" {
+		fid, _ := filerStore.FindFile(from)
+		if err = filerStore.MoveFile(from, to); err != nil {
+			return false, err
+		}
+		notifyFilerEvent(&notification.Event{Type: notification.Move, Path: to, OldPath: from, Fid: fid})
+		return true, webhdfsMkdir(path.Dir(from))
+	}
+	for _, dirs := range [][2]string{{from + "/", to + "/"}, {webhdfsMarkerDir(from), webhdfsMarkerDir(to)}} {
+		entries, err := filerStore.ListEntries(dirs[0], "", "", 1)
+		if err == nil && len(entries) > 0 {
+			err = filerStore.MoveDirectory(dirs[0], dirs[1])
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	notifyFilerEvent(&notification.Event{Type: notification.Move, Path: to + "/", OldPath: from + "/"})
+	return true, webhdfsMkdir(path.Dir(from))
+}
+
+// webhdfsDeleteHandler deletes the file, or the directory, with all its files
+// if recursive=true, and answers false if it does not exist, keeping its parent
+// directory. The files of the collections keeping versions are kept as
+// previous versions.
+func webhdfsDeleteHandler(w http.ResponseWriter, r *http.Request, p string) {
+	if op := strings.ToUpper(r.URL.Query().Get("op")); op != "DELETE" {
+		writeWebhdfsError(w, r, "UnsupportedOperationException", "DELETE "+op+" is not supported")
+		return
+	}
+	deleted, err := webhdfsDelete(p, r.URL.Query().Get("recursive") == "true")
+	if err == errWebhdfsNotEmpty {
+		writeWebhdfsError(w, r, "PathIsNotEmptyDirectoryException", p+" is non empty: Directory is not empty")
+		return
+	}
+	if err != nil {
+		writeWebhdfsError(w, r, "IOException", err.Error())
+		return
+	}
+	writeJson(w, r, map[string]bool{"boolean": deleted})
+}
+
+var errWebhdfsNotEmpty = errors.New("the directory is not empty")
+
+func webhdfsDelete(p string, recursive bool) (bool, error) {
+	if p == "/" {
+		return false, nil
+	}
+	if _, err := filerStore.FindFile(p); err == nil {
+		if err = s3DeleteObject(p); err != nil {
+			return false, err
+		}
+		return true, webhdfsMkdir(path.Dir(p))
+	} else if err != filer.ErrNotFound {
+		return false, err
+	}
+	if exists, err := webhdfsDirExists(p); err != nil || !exists {
+		return false, err
+	}
+	if !recursive {
+		entries, err := filerStore.ListEntries(p+"/", "", "", 1)
+		if err != nil {
+			return false, err
+		}
+		markers, err := filerStore.ListEntries(webhdfsMarkerDir(p), "", "", 2)
+		if err != nil {
+			return false, err
+		}
+		if len(entries) > 0 || len(markers) > 1 || len(markers) == 1 && markers[0].Name != webhdfsDirFile {
+			return false, errWebhdfsNotEmpty
+		}
+	}
+	err := webhdfsWalk(p+"/", func(fullFileName string, fid string) error {
+		return s3DeleteObject(fullFileName)
+	})
+	if err == nil {
+		err = webhdfsWalk(webhdfsMarkerDir(p), func(fullFileName string, fid string) error {
+			if _, err := filerStore.DeleteFile(fullFileName); err != nil {
+				return err
+			}
+			return deleteFileId(fid)
+		})
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, webhdfsMkdir(path.Dir(p))
+}
+
+// webhdfsWalk calls do for each file under the directory, in its sub
+// directories too.
+func webhdfsWalk(dir string, do func(fullFileName string, fid string) error) error {
+	return s3ListAll(dir, "", func(entry filer.FileEntry) error {
+		if strings.HasSuffix(entry.Name, "/") {
+			return webhdfsWalk(dir+entry.Name, do)
+		}
+		return do(dir+entry.Name, entry.Id)
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhdfs(t *testing.T) {
+	_, closeGateway := withS3Gateway(t)
+	defer closeGateway()
+	previousChunkMB := *fWebhdfsChunkMB
+	defer func() { *fWebhdfsChunkMB = previousChunkMB }()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhdfs/v1/", webhdfsHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	url := server.URL + "/webhdfs/v1"
+
+	status := func(p string) (int, webhdfsFileStatus, string) {
+		resp, body := s3Do(t, "GET", url+p+"?op=GETFILESTATUS", nil, nil)
+		var result struct{ FileStatus webhdfsFileStatus }
+		json.Unmarshal(body, &result)
+		return resp.StatusCode, result.FileStatus, string(body)
+	}
+	list := func(p string) []string {
+		resp, body := s3Do(t, "GET", url+p+"?op=LISTSTATUS", nil, nil)
+		var result struct {
+			FileStatuses struct{ FileStatus []webhdfsFileStatus }
+		}
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &result) != nil {
+			t.Fatal("list", p, resp.Status, string(body))
+		}
+		var names []string
+		for _, s := range result.FileStatuses.FileStatus {
+			names = append(names, s.PathSuffix+":"+s.Type)
+		}
+		return names
+	}
+	boolean := func(method string, p string) (int, bool, string) {
+		resp, body := s3Do(t, method, url+p, nil, nil)
+		var result struct{ Boolean bool }
+		json.Unmarshal(body, &result)
+		return resp.StatusCode, result.Boolean, string(body)
+	}
+	create := func(p string, data []byte) (int, string) {
+		resp, body := s3Do(t, "PUT", url+p, data, nil)
+		return resp.StatusCode, string(body)
+	}
+	open := func(query string) string {
+		resp, body := s3Do(t, "GET", url+query, nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("open", query, resp.Status, string(body))
+		}
+		return string(body)
+	}
+
+	if code, s, _ := status("/"); code != http.StatusOK || s.Type != "DIRECTORY" {
+		t.Fatal("the root", code, s)
+	}
+	if code, _, body := status("/logs/a.txt"); code != http.StatusNotFound || !strings.Contains(body, "java.io.FileNotFoundException") {
+		t.Fatal("a missing file", code, body)
+	}
+
+	// directories exist once made, even while empty
+	if code, ok, body := boolean("PUT", "/logs/2024?op=MKDIRS"); code != http.StatusOK || !ok {
+		t.Fatal("mkdirs", code, body)
+	}
+	if code, s, _ := status("/logs"); code != http.StatusOK || s.Type != "DIRECTORY" {
+		t.Error("the parent directory", code, s)
+	}
+	if names := list("/"); strings.Join(names, ",") != "logs:DIRECTORY" {
+		t.Error("the root is listed as", names)
+	}
+
+	// CREATE is redirected to the data node, and writes the content there
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	req, _ := http.NewRequest("PUT", url+"/logs/2024/a.txt?op=CREATE&user.name=spark", nil)
+	resp, err := noRedirect.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusTemporaryRedirect || !strings.Contains(location, "data=true") {
+		t.Fatal("the redirect of CREATE", resp.Status, location)
+	}
+	if code, body := create(strings.TrimPrefix(location, url), []byte("hello, hadoop")); code != http.StatusCreated {
+		t.Fatal("create", code, body)
+	}
+	if code, body := create("/logs/2024/a.txt?op=CREATE", []byte("again")); code != http.StatusForbidden || !strings.Contains(body, "FileAlreadyExistsException") {
+		t.Error("overwritten without overwrite=true", code, body)
+	}
+	if code, body := create("/logs/2024/a.txt?op=CREATE&overwrite=true", []byte("hello, weed-fs")); code != http.StatusCreated {
+		t.Error("overwrite", code, body)
+	}
+	if code, body := create("/logs/2024/a.txt/b?op=CREATE", []byte("b")); code != http.StatusForbidden || !strings.Contains(body, "ParentNotDirectoryException") {
+		t.Error("created under a file", code, body)
+	}
+	if code, s, _ := status("/logs/2024/a.txt"); code != http.StatusOK || s.Type != "FILE" || s.Length != 14 || s.ModificationTime == 0 {
+		t.Error("the file status", code, s)
+	}
+	if data := open("/logs/2024/a.txt?op=OPEN"); data != "hello, weed-fs" {
+		t.Error("open", data)
+	}
+	if data := open("/logs/2024/a.txt?op=OPEN&offset=7&length=4"); data != "weed" {
+		t.Error("open a range", data)
+	}
+	if data := open("/logs/2024/a.txt?op=OPEN&offset=14"); data != "" {
+		t.Error("open at the end", data)
+	}
+
+	// a file larger than -webhdfsChunkMB, stored in chunks
+	*fWebhdfsChunkMB = 1
+	big := bytes.Repeat([]byte("0123456789abcdef"), 160000)
+	if code, body := create("/logs/2024/big.bin?op=CREATE", big); code != http.StatusCreated {
+		t.Fatal("create a big file", code, body)
+	}
+	if code, s, _ := status("/logs/2024/big.bin"); code != http.StatusOK || s.Length != int64(len(big)) {
+		t.Error("the big file status", code, s)
+	}
+	if data := open("/logs/2024/big.bin?op=OPEN&offset=1048570&length=20"); data != string(big[1048570:1048590]) {
+		t.Error("open across the chunks", data)
+	}
+	if names := list("/logs/2024"); strings.Join(names, ",") != "a.txt:FILE,big.bin:FILE" {
+		t.Error("the directory is listed as", names)
+	}
+
+	// renames fail if the destination exists, and move into directories
+	if code, ok, _ := boolean("PUT", "/logs/2024/a.txt?op=RENAME&destination=/logs/2024/big.bin"); code != http.StatusOK || ok {
+		t.Error("renamed over an existing file", code)
+	}
+	if code, ok, _ := boolean("PUT", "/logs/2024?op=RENAME&destination=/missing/2024"); code != http.StatusOK || ok {
+		t.Error("renamed into a missing directory", code)
+	}
+	if code, ok, body := boolean("PUT", "/logs/2024?op=RENAME&destination=/archive"); code != http.StatusOK || !ok {
+		t.Fatal("rename a directory", code, body)
+	}
+	if code, _, _ := status("/logs/2024"); code != http.StatusNotFound {
+		t.Error("the renamed directory is still there", code)
+	}
+	boolean("PUT", "/old?op=MKDIRS")
+	if code, ok, body := boolean("PUT", "/archive/a.txt?op=RENAME&destination=/old"); code != http.StatusOK || !ok {
+		t.Error("rename into a directory", code, body)
+	}
+	if data := open("/old/a.txt?op=OPEN"); data != "hello, weed-fs" {
+		t.Error("the renamed file", data)
+	}
+
+	// deletes
+	if code, _, body := boolean("DELETE", "/archive?op=DELETE"); code != http.StatusForbidden || !strings.Contains(body, "PathIsNotEmptyDirectoryException") {
+		t.Error("deleted a directory with files", code, body)
+	}
+	if code, ok, body := boolean("DELETE", "/archive?op=DELETE&recursive=true"); code != http.StatusOK || !ok {
+		t.Error("delete recursively", code, body)
+	}
+	if code, ok, _ := boolean("DELETE", "/archive?op=DELETE"); code != http.StatusOK || ok {
+		t.Error("deleted a missing directory", code)
+	}
+	if code, ok, _ := boolean("DELETE", "/old/a.txt?op=DELETE"); code != http.StatusOK || !ok {
+		t.Error("delete a file", code)
+	}
+	if code, s, _ := status("/old"); code != http.StatusOK || s.Type != "DIRECTORY" {
+		t.Error("the emptied directory", code, s)
+	}
+	if code, ok, _ := boolean("DELETE", "/old?op=DELETE"); code != http.StatusOK || !ok {
+		t.Error("delete an empty directory", code)
+	}
+	if names := list("/"); strings.Join(names, ",") != "logs:DIRECTORY" {
+		t.Error("the root is listed as", names)
+	}
+	if code, _, body := boolean("GET", "/logs?op=GETCONTENTSUMMARY"); code != http.StatusBadRequest || !strings.Contains(body, "UnsupportedOperationException") {
+		t.Error("an unsupported operation", code, body)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"pkg/filer"
+	"pkg/util"
+	"sort"
+	"strings"
+)
+
+// With -websitePort, the filer also serves -websiteDir as a static website:
+// the content is read from the volume servers and served under the path
+// itself, instead of redirecting to the volume servers.
+
+// websiteHeaders are the volume server response headers passed on to the browsers.
+var websiteHeaders = []string{"Content-Type", "Content-Encoding", "Content-Length", "Last-Modified"}
+
+type cacheControlRule struct {
+	prefix string
+	value  string
+}
+
+var websiteCacheControl []cacheControlRule
+
+// parseCacheControl parses the -websiteCacheControl rules, e.g.
+// "/assets/=public, max-age=86400;/=no-cache", longest prefix first.
+func parseCacheControl(s string) ([]cacheControlRule, error) {
+	var rules []cacheControlRule
+	for _, rule := range strings.Split(s, ";") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		i := strings.Index(rule, "=")
+		if i <= 0 || !strings.HasPrefix(rule, "/") {
+			return nil, errors.New("-websiteCacheControl: " + rule + " should be /path/prefix=header value")
+		}
+		rules = append(rules, cacheControlRule{prefix: rule[:i], value: strings.TrimSpace(rule[i+1:])})
+	}
+	sort.Slice(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	return rules, nil
+}
+
+func cacheControlFor(urlPath string) string {
+	for _, rule := range websiteCacheControl {
+		if strings.HasPrefix(urlPath, rule.prefix) {
+			return rule.value
+		}
+	}
+	return ""
+}
+
+func websiteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	urlPath := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && urlPath != "/" {
+		urlPath += "/"
+	}
+	root := strings.TrimSuffix(*fWebsiteDir, "/")
+	fullFileName := root + urlPath
+	if strings.HasSuffix(fullFileName, "/") {
+		fullFileName += "index.html"
+	}
+	fid, err := filerStore.FindFile(fullFileName)
+	if err == filer.ErrNotFound && !strings.HasSuffix(urlPath, "/") {
+		// a directory with an index.html, asked for without the trailing slash
+		if _, e := filerStore.FindFile(fullFileName + "/index.html"); e == nil {
+			http.Redirect(w, r, urlPath+"/", http.StatusMovedPermanently)
+			return
+		}
+	}
+	if err == nil {
+		serveWebsiteFile(w, r, fullFileName, fid, urlPath, http.StatusOK)
+		return
+	}
+	if err != filer.ErrNotFound {
+		log.Println("website: find", fullFileName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if *fWebsiteNotFound != "" {
+		notFoundName := root + "/" + strings.TrimPrefix(*fWebsiteNotFound, "/")
+		if fid, err = filerStore.FindFile(notFoundName); err == nil {
+			serveWebsiteFile(w, r, notFoundName, fid, urlPath, http.StatusNotFound)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// serveWebsiteFile copies the file from a volume server to the response, with the status.
+// The conditional requests for existing files are passed on to the volume server.
+func serveWebsiteFile(w http.ResponseWriter, r *http.Request, fullFileName, fid, urlPath string, status int) {
+	lookupResult, err := lookupFileId(fid)
+	if err != nil {
+		log.Println("website: lookup", fid, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "GET", "http://"+lookupResult.Locations[0].Url+"/"+fid+path.Ext(fullFileName)+filerAuth(util.SignedRead, fid), nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if acceptEncoding := r.Header.Get("Accept-Encoding"); acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && status == http.StatusOK {
+		req.Header.Set("If-Modified-Since", ims)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Println("website: read", fid, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		status = http.StatusNotModified
+	default:
+		log.Println("website: read", fid, "got", resp.Status)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	for _, name := range websiteHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.Header().Set("Vary", "Accept-Encoding")
+	setResponseHeaders(w.Header(), headersFor(filerHeaders, fullFileName))
+	if cacheControl := cacheControlFor(urlPath); cacheControl != "" && status != http.StatusNotFound {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	w.WriteHeader(status)
+	io.Copy(w, resp.Body)
+}
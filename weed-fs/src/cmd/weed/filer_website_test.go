@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"pkg/filer"
+	"strings"
+	"testing"
+)
+
+func TestCacheControlFor(t *testing.T) {
+	rules, err := parseCacheControl("/=no-cache; /assets/=public, max-age=86400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	websiteCacheControl = rules
+	defer func() { websiteCacheControl = nil }()
+	for urlPath, expected := range map[string]string{
+		"/index.html":     "no-cache",
+		"/assets/app.js":  "public, max-age=86400",
+		"/assetsfile.txt": "no-cache",
+	} {
+		if value := cacheControlFor(urlPath); value != expected {
+			t.Error(urlPath, "got", value, "expected", expected)
+		}
+	}
+	for _, invalid := range []string{"assets/=public", "/assets/", "=public"} {
+		if _, err := parseCacheControl(invalid); err == nil {
+			t.Error("accepted", invalid)
+		}
+	}
+}
+
+func TestWebsiteHandler(t *testing.T) {
+	// one server acts as the master and as the volume server of the files
+	var volumeServer string
+	contents := map[string]string{"/3,01.html": "home", "/3,02.html": "guide", "/3,03.html": "missing", "/3,04.css": "body{}"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dir/lookup" {
+			w.Write([]byte(`{"locations":[{"url":"` + volumeServer + `","publicUrl":"` + volumeServer + `"}]}`))
+			return
+		}
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		content, ok := contents[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("X-Volume", "not passed on")
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+	volumeServer = strings.TrimPrefix(server.URL, "http://")
+
+	dir, err := ioutil.TempDir("", "weedfs_website")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := filer.NewEmbeddedStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for name, fid := range map[string]string{"/www/index.html": "3,01", "/www/guide/index.html": "3,02", "/www/404.html": "3,03", "/www/assets/site.css": "3,04"} {
+		store.CreateFile(name, fid)
+	}
+	previousStore, previousMaster := filerStore, *filerMaster
+	filerStore, *filerMaster = store, volumeServer
+	websiteCacheControl, _ = parseCacheControl("/assets/=max-age=60")
+	defer func() {
+		filerStore, *filerMaster, websiteCacheControl = previousStore, previousMaster, nil
+	}()
+
+	for _, c := range []struct {
+		method, path    string
+		ifModifiedSince bool
+		status          int
+		body, header    string
+	}{
+		{"GET", "/", false, http.StatusOK, "home", ""},
+		{"GET", "/guide/", false, http.StatusOK, "guide", ""},
+		{"GET", "/guide", false, http.StatusMovedPermanently, "", "Location: /guide/"},
+		{"GET", "/../index.html", false, http.StatusOK, "home", ""},
+		{"GET", "/assets/site.css", false, http.StatusOK, "body{}", "Cache-Control: max-age=60"},
+		{"GET", "/assets/site.css", true, http.StatusNotModified, "", ""},
+		{"GET", "/nothing.html", false, http.StatusNotFound, "missing", ""},
+		{"GET", "/nothing.html", true, http.StatusNotFound, "missing", ""},
+		{"POST", "/", false, http.StatusMethodNotAllowed, "", ""},
+	} {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if c.ifModifiedSince {
+			r.Header.Set("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+		}
+		w := httptest.NewRecorder()
+		websiteHandler(w, r)
+		if w.Code != c.status || (w.Body.String() != c.body && c.status != http.StatusMovedPermanently) {
+			t.Error(c.method, c.path, "got", w.Code, w.Body.String())
+		}
+		if w.Header().Get("X-Volume") != "" {
+			t.Error(c.path, "passed on the volume server headers")
+		}
+		if c.header != "" {
+			name := strings.SplitN(c.header, ": ", 2)
+			if w.Header().Get(name[0]) != name[1] {
+				t.Error(c.path, "got", name[0], w.Header().Get(name[0]))
+			}
+		}
+	}
+}
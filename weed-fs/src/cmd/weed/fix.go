@@ -44,12 +44,17 @@ func runFix(cmd *Command, args []string) bool {
   }
   defer indexFile.Close()
 
-  //skip the volume super block
-  dataFile.Seek(storage.SuperBlockSize, 0)
+  //skip the volume super block, padded to the needle alignment
+  header := make([]byte, storage.SuperBlockSize)
+  if _, e = dataFile.Read(header); e != nil {
+    log.Fatalf("Read Volume Super Block [ERROR] %s\n", e)
+  }
+  alignment := storage.SuperBlockAlignment(header)
+  dataFile.Seek(storage.DataStart(alignment), 0)
 
-  n, length := storage.ReadNeedle(dataFile)
+  n, length := storage.ReadAlignedNeedle(dataFile, alignment)
   nm := storage.NewNeedleMap(indexFile)
-  offset := uint32(storage.SuperBlockSize)
+  offset := uint32(storage.DataStart(alignment))
   for n != nil {
     debug("key", n.Id, "volume offset", offset, "data_size", n.Size, "length", length)
     if n.Size > 0 {
@@ -57,7 +62,7 @@ func runFix(cmd *Command, args []string) bool {
       debug("saved", count, "with error", pe)
     }
     offset += length
-    n, length = storage.ReadNeedle(dataFile)
+    n, length = storage.ReadAlignedNeedle(dataFile, alignment)
   }
   return true
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"pkg/util"
+	"strconv"
+	"strings"
+)
+
+// The gRPC services of pkg/operation/master.proto are served over HTTP/2
+// without TLS, with the protocol buffer encoding of pkg/util, and without a
+// gRPC library: each call of a method is one request message, answered with
+// one response message, see
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+// A method is answered by the http handler of the same api, with the fields of
+// the request message as its form values, and its protocol buffer response.
+
+const (
+	grpcOK            = 0
+	grpcInvalidArg    = 3
+	grpcUnimplemented = 12
+	grpcInternal      = 13
+
+	// the largest request message taken
+	grpcMaxMessage = 64 * 1024
+)
+
+// serveGrpc serves the gRPC methods, by path, e.g. /weedfs.Master/Assign.
+func serveGrpc(port int, methods map[string]http.HandlerFunc) {
+	mux := http.NewServeMux()
+	for method, handler := range methods {
+		mux.HandleFunc(method, handler)
+	}
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux, Protocols: protocols}
+	log.Println("Serving gRPC at port", port)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("Fail to start gRPC:%s", err.Error())
+	}
+}
+
+// grpcMethod answers a gRPC method with the handler, called with the fields of
+// the request message as form values, named by fields, and the Accept header
+// of a protocol buffer answer. The errors of the api are in the response
+// messages, so the calls answered by the handler have the status OK.
+func grpcMethod(fields map[int]string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		message, status, err := readGrpcMessage(r.Body)
+		if err != nil {
+			writeGrpcStatus(w, status, err.Error())
+			return
+		}
+		form := make(url.Values)
+		err = util.DecodeProto(message, func(field int, varint uint64, bytes []byte) error {
+			if name, ok := fields[field]; ok {
+				if bytes != nil {
+					form.Set(name, string(bytes))
+				} else {
+					form.Set(name, strconv.FormatUint(varint, 10))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			writeGrpcStatus(w, grpcInvalidArg, err.Error())
+			return
+		}
+		call, _ := http.NewRequest("GET", "/", nil)
+		call = call.WithContext(r.Context())
+		call.RemoteAddr, call.Form, call.PostForm = r.RemoteAddr, form, make(url.Values)
+		call.Header.Set("Accept", "application/x-protobuf")
+		answer := &grpcAnswer{header: make(http.Header)}
+		handler(answer, call)
+		if answer.header.Get("Content-Type") != "application/x-protobuf" {
+			writeGrpcStatus(w, grpcInternal, "The answer is not a protocol buffer message: "+strconv.Itoa(answer.status))
+			return
+		}
+		frame := make([]byte, 5, 5+answer.body.Len())
+		binary.BigEndian.PutUint32(frame[1:], uint32(answer.body.Len()))
+		w.Write(append(frame, answer.body.Bytes()...))
+		writeGrpcStatus(w, grpcOK, "")
+	}
+}
+
+// readGrpcMessage reads the one request message of a call.
+func readGrpcMessage(body io.Reader) ([]byte, int, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, grpcInvalidArg, err
+	}
+	if prefix[0] != 0 {
+		return nil, grpcUnimplemented, errors.New("Compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessage {
+		return nil, grpcInvalidArg, errors.New("The message is larger than " + strconv.Itoa(grpcMaxMessage) + " bytes")
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, grpcInvalidArg, err
+	}
+	if n, _ := io.Copy(ioutil.Discard, io.LimitReader(body, 1)); n > 0 {
+		return nil, grpcUnimplemented, errors.New("Only one request message is taken")
+	}
+	return message, grpcOK, nil
+}
+
+// writeGrpcStatus ends the call with its status, in the trailers.
+func writeGrpcStatus(w http.ResponseWriter, status int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(status))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(message))
+	}
+}
+
+// grpcAnswer keeps the answer of the http handler of a gRPC method.
+type grpcAnswer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (a *grpcAnswer) Header() http.Header {
+	return a.header
+}
+
+func (a *grpcAnswer) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+}
+
+func (a *grpcAnswer) Write(data []byte) (int, error) {
+	a.WriteHeader(http.StatusOK)
+	return a.body.Write(data)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pkg/topology"
+	"pkg/util"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startGrpcServer serves the methods over HTTP/2 without TLS, as serveGrpc,
+// and returns a client speaking it.
+func startGrpcServer(methods map[string]http.HandlerFunc) (*httptest.Server, *http.Client) {
+	mux := http.NewServeMux()
+	for method, handler := range methods {
+		mux.HandleFunc(method, handler)
+	}
+	server := httptest.NewUnstartedServer(mux)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return server, &http.Client{Transport: transport}
+}
+
+// grpcCall calls the method with the message, and returns the status and the
+// response message.
+func grpcCall(t *testing.T, client *http.Client, server, method string, message *util.ProtoBuffer) (string, []byte) {
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message.Bytes())))
+	resp, err := client.Post(server+method, "application/grpc", bytes.NewReader(append(frame, message.Bytes()...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.ProtoMajor != 2 || resp.Header.Get("Content-Type") != "application/grpc+proto" {
+		t.Fatal(method, "got", resp.Proto, resp.Status, resp.Header, err)
+	}
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return resp.Trailer.Get("Grpc-Status"), nil
+	}
+	return resp.Trailer.Get("Grpc-Status"), body[5:]
+}
+
+func TestMasterGrpcMethods(t *testing.T) {
+	previous := topo
+	defer func() { topo = previous }()
+	defer func(latency *util.LatencyStats) { masterLatency = latency }(masterLatency)
+	topo = topology.NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	masterLatency = util.NewLatencyStats(nil)
+	values := url.Values{"ip": {"127.0.0.1"}, "port": {"8080"}, "publicUrl": {"files.example.com"}, "maxVolumeCount": {"7"},
+		"volumes": {`[{"Id":3,"RepType":"000","Version":2}]`}, "grpcPort": {"18080"}}
+	r := httptest.NewRequest("POST", "/dir/join", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	dirJoinHandler(httptest.NewRecorder(), r)
+	server, client := startGrpcServer(masterGrpcMethods)
+	defer server.Close()
+
+	fields := func(message []byte) map[int][]string {
+		decoded := make(map[int][]string)
+		if err := util.DecodeProto(message, func(field int, varint uint64, bytes []byte) error {
+			decoded[field] = append(decoded[field], string(bytes))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+	lookup := new(util.ProtoBuffer)
+	lookup.EncodeString(1, "3")
+	status, message := grpcCall(t, client, server.URL, "/weedfs.Master/Lookup", lookup)
+	locations := fields(message)[1]
+	if status != "0" || len(locations) != 1 {
+		t.Fatal("the lookup got", status, fields(message))
+	}
+	if location := fields([]byte(locations[0])); location[1][0] != "127.0.0.1:8080" || location[2][0] != "files.example.com" ||
+		location[4][0] != "127.0.0.1:18080" {
+		t.Error("the lookup got the location", location)
+	}
+	lookup = new(util.ProtoBuffer)
+	lookup.EncodeString(1, "4")
+	if status, message = grpcCall(t, client, server.URL, "/weedfs.Master/Lookup", lookup); status != "0" || len(fields(message)[2]) != 1 {
+		t.Error("the lookup of a missing volume got", status, fields(message))
+	}
+
+	// the errors of the assigns are in their messages, with their codes
+	assign := new(util.ProtoBuffer)
+	assign.EncodeUint64(1, 2)
+	assign.EncodeString(2, "9x9")
+	status, message = grpcCall(t, client, server.URL, "/weedfs.Master/Assign", assign)
+	if status != "0" || len(fields(message)[5]) != 1 || fields(message)[7][0] != topology.AssignInvalidRequest {
+		t.Error("the assign got", status, fields(message))
+	}
+
+	frame := []byte{1, 0, 0, 0, 0}
+	resp, err := client.Post(server.URL+"/weedfs.Master/Lookup", "application/grpc", bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if status := resp.Trailer.Get("Grpc-Status"); status != "12" {
+		t.Error("a compressed message got the status", status)
+	}
+	if resp, err = client.Post(server.URL+"/weedfs.Master/Lookup", "application/json", nil); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Error("a call that is not gRPC got", resp.Status)
+	}
+}
+
+func TestVolumeGrpcRead(t *testing.T) {
+	defer withTestStore(t, []byte("read over grpc"))()
+	defer func(key string) { *vSecureKey = key }(*vSecureKey)
+	*vSecureKey = "secret"
+	volumeLatency = util.NewLatencyStats(nil)
+	server, client := startGrpcServer(volumeGrpcMethods)
+	defer server.Close()
+
+	read := func(fid string) map[int]string {
+		request := new(util.ProtoBuffer)
+		request.EncodeString(1, fid)
+		// the reads are signed until the master tells which collections need it
+		request.EncodeString(2, util.SignFileId("secret", util.SignedRead, strings.Split(fid, ".")[0], time.Now().Unix()+60))
+		status, message := grpcCall(t, client, server.URL, "/weedfs.Volume/Read", request)
+		if status != "0" {
+			t.Fatal("the read of", fid, "got the status", status)
+		}
+		response := make(map[int]string)
+		util.DecodeProto(message, func(field int, varint uint64, bytes []byte) error {
+			response[field] = string(bytes)
+			return nil
+		})
+		return response
+	}
+	// un-gzipped, as a GET without gzip
+	if response := read("3,01637037d6.txt"); response[1] != "read over grpc" || !strings.HasPrefix(response[3], "text/plain") || response[2] != "" {
+		t.Error("the read got", response)
+	}
+	if response := read("3,01637037d7"); response[2] != "404 Not Found" || response[1] != "" {
+		t.Error("the read with another cookie got", response)
+	}
+	if response := read("x"); response[2] == "" {
+		t.Error("the read of an invalid file id got", response)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// httpServerOptions are the keep-alive, header size, TLS and HTTP/2 flags
+// shared by the master, volume and filer servers.
+type httpServerOptions struct {
+	idleTimeout          *int
+	maxHeaderBytes       *int
+	tlsPort              *int
+	certFile             *string
+	keyFile              *string
+	maxConcurrentStreams *int
+	clientCaFile         *string // nil unless the server verifies client certificates
+}
+
+func newHttpServerOptions(f *flag.FlagSet) *httpServerOptions {
+	return &httpServerOptions{
+		idleTimeout:          f.Int("idleTimeout", 120, "keep-alive connection idle timeout in seconds"),
+		maxHeaderBytes:       f.Int("maxHeaderBytes", http.DefaultMaxHeaderBytes, "maximum size of request headers in bytes"),
+		tlsPort:              f.Int("tlsPort", 0, "additional HTTPS and HTTP/2 listen port for public clients, with -certFile and -keyFile. 0 disables it"),
+		certFile:             f.String("certFile", "", "TLS certificate file for -tlsPort"),
+		keyFile:              f.String("keyFile", "", "TLS private key file for -tlsPort"),
+		maxConcurrentStreams: f.Int("http2MaxStreams", 250, "maximum concurrent HTTP/2 streams per connection on -tlsPort"),
+	}
+}
+
+func (o *httpServerOptions) newServer(port int, handler http.Handler, readTimeout int) *http.Server {
+	var tlsConfig *tls.Config
+	if o.clientCaFile != nil && *o.clientCaFile != "" {
+		pem, err := ioutil.ReadFile(*o.clientCaFile)
+		if err != nil {
+			log.Fatalf("-clientCaFile: %s", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("-clientCaFile: no certificate found in %s", *o.clientCaFile)
+		}
+		tlsConfig = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+	return &http.Server{
+		TLSConfig:      tlsConfig,
+		Addr:           ":" + strconv.Itoa(port),
+		Handler:        handler,
+		ReadTimeout:    time.Duration(readTimeout) * time.Second,
+		IdleTimeout:    time.Duration(*o.idleTimeout) * time.Second,
+		MaxHeaderBytes: *o.maxHeaderBytes,
+		HTTP2:          &http.HTTP2Config{MaxConcurrentStreams: *o.maxConcurrentStreams},
+	}
+}
+
+// listenAndServe serves plain HTTP on port, which the servers use among
+// themselves, and, if configured, HTTPS with HTTP/2 on the TLS port.
+func (o *httpServerOptions) listenAndServe(port int, handler http.Handler, readTimeout int) error {
+	if *o.tlsPort > 0 {
+		if *o.certFile == "" || *o.keyFile == "" {
+			log.Fatalf("-tlsPort needs both -certFile and -keyFile")
+		}
+		tlsServer := o.newServer(*o.tlsPort, handler, readTimeout)
+		go func() {
+			log.Println("Serving HTTPS at port", *o.tlsPort)
+			if e := tlsServer.ListenAndServeTLS(*o.certFile, *o.keyFile); e != nil {
+				log.Fatalf("Fail to start HTTPS:%s", e.Error())
+			}
+		}()
+	}
+	return o.newServer(port, handler, readTimeout).ListenAndServe()
+}
@@ -1,22 +1,31 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"errors"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"path"
+	"pkg/directory"
 	"pkg/replication"
 	"pkg/storage"
 	"pkg/topology"
+	"pkg/util"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 func init() {
 	cmdMaster.Run = runMaster // break init cycle
 	IsDebug = cmdMaster.Flag.Bool("debug", false, "enable debug mode")
+	masterHttpOptions.clientCaFile = cmdMaster.Flag.String("clientCaFile", "", "CA certificates verifying the client certificates on -tlsPort, for -roles")
 }
 
 var cmdMaster = &Command{
@@ -25,49 +34,387 @@ var cmdMaster = &Command{
 	Long: `start a master server to provide volume=>location mapping service
   and sequence number of file ids
 
+  With -secureKey, /dir/assign also returns a signed "auth" query string for the upload of
+  the count file ids assigned, fid and fid_1 to fid_<count-1>, and
+  /dir/sign?fid=3,01637037d6&op=read|write|delete&seconds=300 mints signed urls, valid up to a
+  day, for that exact file id, or with &count=N for fid and fid_1 to fid_<N-1> as assigned
+  together, e.g. to resume a chunked upload, for the clients sending the -secureKey as "Authorization: Bearer
+  <secureKey>", or with -roles for the principals listing the op in their sign key, e.g.
+  sign = "read,write", and the admins.
+
+  Every endpoint is also served under /v1/, e.g. /v1/dir/assign, and answers with its version in
+  X-Weed-Api-Version. The unversioned paths are v1 and stay compatible with it; a change to the
+  shape of the answers, e.g. of /dir/lookup, will come as /v2/ next to them, so clients pinning
+  /v1/ or the unversioned paths are not broken. Unknown versions are answered with 404.
+  /openapi.json describes the endpoints, their methods and parameters, as an OpenAPI 3
+  document generated from the handlers; the volume server and the filer serve theirs too.
+
+  /dir/assign and /dir/lookup return protocol buffer messages, as described in
+  pkg/operation/master.proto, for requests with "Accept: application/x-protobuf".
+  With -grpcPort, they are also served as the Master service of master.proto to
+  gRPC clients, over HTTP/2 without TLS, the errors in the response messages.
+
+  With -memcachePort, memcache clients can also look up volumes with "get 3" or "get 3,01637037d6",
+  getting the /dir/lookup json responses from an in-memory copy refreshed when volumes move.
+  With -dnsPort, 3.volume.weed.internal resolves to A records of the replicas of volume 3,
+  and AAAA records of the IPv6 only ones, for load balancers and systems that only speak DNS.
+
+  Volume servers can register with an IPv6 -ip, e.g. -ip=2001:db8::1, bracketed in their urls,
+  [2001:db8::1]:8080, in the lookups and the replication. The ips of the -conf racks match
+  whichever way they are written, e.g. 2001:db8:0::1.
+
+  When a layout runs out of writable volumes, /dir/assign creates -volumeGrowthCount volumes,
+  or ?preallocate=N volumes if specified, allocating the replicas of each volume in parallel.
+  /dir/assign?explain=true adds an "explain" object to the json response, with the volumes of
+  the layout, why each one the assign could not pick is excluded, e.g. sealed, full, or with a
+  replica not matching the constraint, how many volumes were grown for the assign, and the
+  free slots of each volume server, which weigh where new volumes are placed.
+  -placementSeed=N makes the random placements and picks the same from run to run, given the
+  same volume servers and the same requests, for the integration tests of the placement.
+
+  With -capacityMargin=N, once the free volume slots of the volume servers can only hold fewer
+  than N more volumes of a layout, its assigns are delayed by -capacityLowDelayMs, or rejected
+  with 507 and a "Capacity low" error with -capacityLowAction=reject, before they fail with
+  "No free volumes left!". The layouts under the margin are listed in /dir/status and in the
+  recent events, and -capacityWebhook gets a json event when a layout goes under the margin,
+  "capacity_low", and when it has room again, "capacity_ok".
+
+  A failed assign answers with a "code" next to its "error", for clients and autoscalers to
+  react: "no_capacity" when there is no volume and no free slot to create one, "volumes_full"
+  when the volumes are full or sealed and no free slot is left to grow more,
+  "replication_unavailable" when the free slots or the live replicas are too few for the
+  replication, e.g. all on one rack for 010, "capacity_low" under -capacityMargin, and
+  "invalid_request". Its "counts" tell the volumes of the layout, writable, full and
+  unavailable, the free slots and the volume servers with some, on the servers the assign
+  could use. /stats counts the failed assigns by code in AssignFailures.
+  The answer also has a "hint" on how to react, and a Retry-After header, with "retryAfter" in
+  seconds, when retrying later can help: 2s for "growing", answered with 503 to the assigns of
+  a layout while another assign grows its volumes, instead of growing more, 60s for
+  "capacity_low", and 2 heartbeats for "replication_unavailable", for restarting servers.
+
+  The bytes used by each layout and data center are sampled every -capacitySampleSeconds, and
+  /dir/capacity projects the days until they are full at the rate they grew over the last
+  -capacityWindowHours, in the growing volumes and in new volumes on the free slots. The room
+  of a layout counts all the free slots, as if the other layouts did not grow. DaysUntilFull
+  is -1 for the ones not growing, or sampled only once. /dir/status and /ui/ show it too.
+
+  /get/3,01637037d6.jpg serves a file without the lookup step, by redirecting to a volume server,
+  or with -readMode=proxy by streaming the content through the master.
+
+  The -conf file may group data centers into <Region name="..."> elements, for clusters spanning
+  regions. Replication type 1000 places the 2 copies of a volume in different regions.
+
+  Volume servers tag their disks with -diskType, e.g. ssd. /dir/assign?diskType=ssd and
+  /vol/grow?diskType=ssd only use volumes on, or create volumes on, volume servers with that disk type.
+  A collection of the -conf file can set its storage class, e.g. <Collection name="logs"
+  diskType="archive"/>: its volumes are then only created on, and its files only assigned to,
+  the volume servers of that disk type, and an assign asking for another disk type fails. When
+  there is no free slot left on them, the error tells the disk type. A volume of the collection
+  found on a volume server of another disk type is listed in the recent events.
+
+  Volume servers can also carry -labels, e.g. env=prod,disk=nvme. ?constraint=env=prod&&disk=nvme,
+  url encoded, on /dir/assign and /vol/grow only uses volume servers whose labels match every
+  key=value or key!=value term. The -conf file can set a constraint for a collection with
+  <Collections><Collection name="photos" constraint="env=prod"/></Collections>, which always applies.
+  A collection can also limit its uploads, e.g. maxSizeMB="10" contentTypes="image/jpeg,image/*",
+  checked by the volume servers, which answer 413 or 415 to the uploads over the limits. The
+  replicas check them again, unless the write is signed with -secureKey as sent by a replica.
+  With signedReads="true", the volume servers only serve the files of the collection with
+  signed urls, from /dir/sign, or /get/ for the clients allowed to sign reads, while the
+  other collections stay public.
+  <Header name="Cache-Control">public, max-age=86400</Header> elements in a collection add
+  response headers to the reads of its files, e.g. for a CDN in front of the volume servers.
+  An Expires value of +N is N seconds after the read.
+
+  File ids are reserved -sequenceBatchSize at a time, and only the largest reserved id is saved,
+  so a restarted master never hands out an id twice. /seq/status shows the next file id, and
+  /seq/bump?next=N moves it forward, e.g. after restoring an older -mdir.
+
+  Two clusters both taking writes, e.g. mirroring each other with weed mirror, can partition the
+  volume ids with -volumeIdPartition, 0/2 on one master and 1/2 on the other, or ranges such as
+  1-999999 and 1000000-1999999. Their file ids then never collide, as a file id starts with its
+  volume id, and the volumes of both can later be merged under one master. A new volume gets the
+  id of the partition after the highest one in use, and /vol/grow fails once a range is used up.
+  /dir/status shows the partition.
+
+  The file ids of the volumes renumbered by weed merge are posted to /dir/redirects as
+  "old_fid new_fid" lines, kept in -mdir/fid_redirects.txt, so the old file ids keep resolving:
+  /dir/lookup?volumeId=3,01637037d6 answers with the locations of the new volume, and the new
+  file id as "fid", and /get/3,01637037d6 serves the new file. A lookup by volume id alone can
+  not be redirected, as the old volume id is usually used by another volume. /stats counts the
+  lookups by file id and the redirected ones.
+
+  Requests slower than their -latencyBudgets are logged with the file or volume id, and
+  counted per endpoint at /stats, along with the most recent slow ones.
+
+  A volume server is dead after -deadNodeSeconds without heartbeats, timed by the master's clock.
+  /dir/status shows each volume server's LastHeartbeatAge in seconds, its ClockSkew against the
+  master, and Slow for the ones whose heartbeats are late but not yet dead.
+
+  With -writeAffinity, /dir/assign locates the client ip in the -conf file like a volume server,
+  and prefers volumes whose first replica is in the client's data center.
+
+  Volumes can be grouped into collections with ?collection=name on /dir/assign and /vol/grow.
+  /col/delete?collection=name removes every volume of the collection from all its replicas,
+  and reports the result of each volume. The deleted volumes are remembered in -mdir, and a
+  replica of one reported later, e.g. by a volume server that was down during the delete, is
+  held as an orphan: it is not looked up nor assigned to, but counts against the free slots of
+  its server. /vol/orphans lists them, /vol/orphans/adopt?volume=N registers the orphans of
+  volume N back into its collection, and /vol/orphans/purge?volume=N removes them from their
+  volume servers. /vol/grow?volume=N creates the one volume N, if no volume N exists and it
+  was not deleted, e.g. for a volume moved from another cluster by weed merge.
+
+  /vol/replicas counts the volumes of each replication type by their number of live replicas,
+  and lists the under replicated ones, the most exposed first, with the volume servers of their
+  remaining replicas. "Lost" counts the volumes left without any live replica.
+
+  With -replicateDelaySeconds=N, a volume missing a replica for N seconds, e.g. after its
+  volume server died, is copied from one of its live replicas onto a volume server the
+  placement picks, and the copy is registered as the missing replica. The copies only start
+  within -replicateWindow, e.g. 01:00-05:00 in local time, and at most -replicateMaxPerNode run
+  on a volume server, as source or target, and -replicateMaxPerRack in a rack, the volumes
+  missing a replica the longest first. A failed copy is retried after a backoff doubling from
+  -pulseSeconds up to an hour. The source replica is pinned while it is copied, so it is not
+  vacuumed, and the copy catches up with its writes until a round copies nothing. An update or
+  a delete of an existing file between the last round and the registration of the copy can
+  still miss it; the volume takes no new files while under replicated. /vol/replicate/status
+  lists the missing replicas, with their failures, and the running and recent copies.
+
+  The volume servers send the read counts of their volumes with the heartbeats. With
+  -hotVolumeReads=N, every -hotVolumeCheckSeconds a sealed volume read N times per second or
+  more, over all its replicas, is copied onto one more volume server, the one with the most
+  free slots, up to -hotVolumeMirrors extra copies. The mirrors are read only replicas, in the
+  lookups and deleted with the volume, and are removed one by one once the reads stay under
+  N/2 per second for -hotVolumeCooldownMinutes, or all at once before the volume is unsealed.
+  They are kept in -mdir/mirrored_volumes.json. /vol/hot lists the read rates and the mirrors.
+
+  Volumes are growing, sealed, readonly after write errors, or compacting. Only growing volumes
+  take new files. A volume reaching -volumeSizeLimitMB is sealed on all its replicas, and stays
+  sealed after vacuuming. /vol/seal?volume=3 and /vol/unseal?volume=3 seal and unseal a volume.
+
+  /vol/clone?volume=3 copies the sealed volume 3 under the next volume id, on the volume servers
+  of its replicas, e.g. for a test environment or a point-in-time export. The copies share the
+  data file of the volume, reflinked or hard linked, until the volume or the clone changes it,
+  and the clone starts sealed, so it can be unsealed to take new files.
+
+  /vol/snapshot?name=nightly&ttl=3600 takes a snapshot of all the volumes for a backup. Each
+  volume is cut on one of its replicas, at the end of its data and index files, briefly holding
+  its writes, and pinned there for ttl seconds, so it is not vacuumed and its deleted files are
+  not erased until /vol/snapshot/release?name=nightly. The manifest, with the cut of each volume
+  and the next file id of the sequence, is saved in -mdir/snapshots, and read back with
+  /vol/snapshot/manifest?name=nightly by weed backup -snapshot=nightly, which copies the volumes
+  up to their cuts. The volumes are cut one after the other, without stopping the uploads, so
+  a file assigned before the snapshot may still miss it if it is uploaded after its volume is cut.
+
+  /vol/simulate reports which volume replicas a placement change would copy or remove, and
+  the bytes to transfer, on a copy of the current topology, without changing anything:
+    ?action=decommission&node=10.0.0.5:8080   move every volume off the volume server
+    ?action=rebalance                          even out the used slots of the volume servers
+    ?action=replication&collection=photos&replication=010
+                                               change the replication type of a collection
+
+  The web UI at /ui/ shows the topology, the volume layouts and the recent events.
+  Its admin actions are only taken from its own pages, with an Origin or a Referer
+  header of the master's host.
+
+  The admin operations, /col/delete, /dir/redirects, /seq/bump, /vol/clone, /vol/grow,
+  /vol/orphans/adopt, /vol/orphans/purge, /vol/seal, /vol/snapshot, /vol/snapshot/release,
+  /vol/unseal, /vol/vacuum and the /ui/action ones, are appended to audit.log in -mdir, with the time, the basic auth
+  user or the client address, and the parameters. /audit?since=<unix time>&limit=100 lists them.
+
+  With -roles, the endpoints other than assign, lookup, join and get need a token, sent
+  as "Authorization: Bearer <token>" or as the basic auth password, or a client certificate on
+  -tlsPort verified with -clientCaFile, with one of the roles of the -roles file:
+    monitor    /dir/capacity, /dir/status, /stats, /seq/status, /vol/hot, /vol/orphans, /vol/replicas, /vol/status,
+               /vol/replicate/status, /vol/simulate, /vol/snapshot/manifest, /ui/, /audit
+    operator   also /dir/redirects, /vol/clone, /vol/grow, /vol/orphans/adopt, /vol/seal, /vol/snapshot, /vol/snapshot/release, /vol/unseal, /vol/vacuum, /ui/action
+    admin      also /col/delete, /seq/bump, /vol/orphans/purge
+  The file has a section per principal, e.g. [monitoring] role = "monitor" token = "4f1c...".
+
+  With -clusterSecret, only the volume servers signing their heartbeats with the same
+  -clusterSecret can register, so a rogue server on the network can not receive files or replicas.
+
   `,
 }
 
+const (
+	defaultSignedUrlSeconds = 300
+	maxSignedUrlSeconds     = 24 * 3600
+	// a gzipped heartbeat is read up to the size net/http parses of a plain form
+	maxHeartbeatBytes = 10 << 20
+)
+
 var (
-	mport             = cmdMaster.Flag.Int("port", 9333, "http listen port")
-	metaFolder        = cmdMaster.Flag.String("mdir", "/tmp", "data directory to store mappings")
-	volumeSizeLimitMB = cmdMaster.Flag.Uint("volumeSizeLimitMB", 32*1024, "Default Volume Size in MegaBytes")
-	mpulse            = cmdMaster.Flag.Int("pulseSeconds", 5, "number of seconds between heartbeats")
-	confFile          = cmdMaster.Flag.String("conf", "/etc/weedfs/weedfs.conf", "xml configuration file")
-	defaultRepType    = cmdMaster.Flag.String("defaultReplicationType", "000", "Default replication type if not specified.")
-	mReadTimeout      = cmdMaster.Flag.Int("readTimeout", 5, "connection read timeout in seconds")
-	mMaxCpu           = cmdMaster.Flag.Int("maxCpu", 0, "maximum number of CPUs. 0 means all available CPUs")
+	mport                = cmdMaster.Flag.Int("port", 9333, "http listen port")
+	metaFolder           = cmdMaster.Flag.String("mdir", "/tmp", "data directory to store mappings")
+	volumeSizeLimitMB    = cmdMaster.Flag.Uint("volumeSizeLimitMB", 32*1024, "Default Volume Size in MegaBytes")
+	volumeFileCountLimit = cmdMaster.Flag.Int("volumeFileCountLimit", 0, "maximum number of files in one volume, to bound the index memory for small files. 0 means no limit")
+	volumeGrowthCount    = cmdMaster.Flag.Int("volumeGrowthCount", 0, "number of volumes created when a layout runs out of writable volumes. 0 means 7, 6 or 3 for 1, 2 or 3 copies")
+	mpulse               = cmdMaster.Flag.Int("pulseSeconds", 5, "number of seconds between heartbeats")
+	sequenceBatchSize    = cmdMaster.Flag.Int("sequenceBatchSize", 10000, "number of file ids reserved with one write of the sequence file")
+	volumeIdPartition    = cmdMaster.Flag.String("volumeIdPartition", "", "ids of the new volumes, e.g. 1/2 for the odd ids or 1000-1999, so that two active clusters never share a volume id. Empty means all the ids")
+	deadNodeSeconds      = cmdMaster.Flag.Int("deadNodeSeconds", 0, "seconds without heartbeats before a volume server is considered dead. 0 means 4 times -pulseSeconds")
+	confFile             = cmdMaster.Flag.String("conf", "/etc/weedfs/weedfs.conf", "xml configuration file")
+	defaultRepType       = cmdMaster.Flag.String("defaultReplicationType", "000", "Default replication type if not specified.")
+	writeAffinity        = cmdMaster.Flag.Bool("writeAffinity", false, "prefer assigning volumes in the data center of the client, located by its ip with the -conf file")
+	mReadTimeout         = cmdMaster.Flag.Int("readTimeout", 5, "connection read timeout in seconds")
+	mRequestTimeout      = cmdMaster.Flag.Int("requestTimeout", 30, "seconds before a call to a volume server, e.g. to create a volume, is given up. 0 means no limit")
+	mSecureKey           = cmdMaster.Flag.String("secureKey", "", "secret shared with the volume servers to sign urls. Empty disables signing")
+	mReadMode            = cmdMaster.Flag.String("readMode", "redirect", "how /get/fid serves the file: \"redirect\" to a volume server, or \"proxy\" the content through the master")
+	mCorsOrigins         = cmdMaster.Flag.String("corsOrigins", "", "comma separated origins allowed for browser based clients, \"*\" for any origin. Empty disables CORS")
+	mMaxCpu              = cmdMaster.Flag.Int("maxCpu", 0, "maximum number of CPUs. 0 means all available CPUs")
+	garbageThreshold     = cmdMaster.Flag.Float64("garbageThreshold", 0.3, "threshold to vacuum and reclaim spaces")
+	vacuumPerNode        = cmdMaster.Flag.Int("vacuumMaxPerNode", 1, "maximum number of volumes compacted at the same time on one volume server. 0 means no limit")
+	vacuumPerRack        = cmdMaster.Flag.Int("vacuumMaxPerRack", 2, "maximum number of volumes compacted at the same time in one rack. 0 means no limit")
+	mLatencyBudgets      = cmdMaster.Flag.String("latencyBudgets", "assign=100ms,lookup=50ms", "comma separated endpoint=duration budgets, requests over them are logged and counted in /stats")
+	adminUser            = cmdMaster.Flag.String("adminUser", "admin", "user name for the admin actions on the web UI")
+	adminPassword        = cmdMaster.Flag.String("adminPassword", "", "password for the admin actions on the web UI. Empty disables the admin actions")
+	memcachePort         = cmdMaster.Flag.Int("memcachePort", 0, "port to also serve volume id lookups with the memcache text protocol. 0 disables it")
+	mGrpcPort            = cmdMaster.Flag.Int("grpcPort", 0, "port to also serve the assigns and the lookups with gRPC. 0 disables it")
+	dnsPort              = cmdMaster.Flag.Int("dnsPort", 0, "udp port to also serve volume locations as A and AAAA records of <vid>.<dnsDomain>. 0 disables it")
+	dnsDomain            = cmdMaster.Flag.String("dnsDomain", "volume.weed.internal", "domain of the volume names served with -dnsPort")
+	mRolesFile           = cmdMaster.Flag.String("roles", "", "toml file of the tokens and client certificates allowed to call the admin endpoints, and their roles. Empty allows everyone")
+	mClusterSecret       = cmdMaster.Flag.String("clusterSecret", "", "secret the volume servers sign their heartbeats with. Empty lets any server join")
+	capacityMargin       = cmdMaster.Flag.Int("capacityMargin", 0, "number of volumes the free slots should still hold for a layout, below which its assigns are throttled. 0 disables the throttling")
+	capacityLowAction    = cmdMaster.Flag.String("capacityLowAction", "delay", "what to do with the assigns of a layout under -capacityMargin: \"delay\" them by -capacityLowDelayMs, or \"reject\" them")
+	capacityLowDelayMs   = cmdMaster.Flag.Int("capacityLowDelayMs", 500, "milliseconds the assigns of a layout under -capacityMargin are delayed by")
+	capacityWebhook      = cmdMaster.Flag.String("capacityWebhook", "", "url to post a json event to when a layout goes under -capacityMargin, and when it has room again")
+	capacitySampleSecs   = cmdMaster.Flag.Int("capacitySampleSeconds", 60, "seconds between the samples of the used bytes the capacity forecast is computed from. 0 disables the forecast")
+	capacityWindowHours  = cmdMaster.Flag.Int("capacityWindowHours", 24, "hours of samples the write rates of the capacity forecast are computed over")
+	hotVolumeReads       = cmdMaster.Flag.Float64("hotVolumeReads", 0, "reads per second of a sealed volume over which it is mirrored onto more volume servers. 0 disables the mirrors")
+	hotVolumeMirrors     = cmdMaster.Flag.Int("hotVolumeMirrors", 2, "maximum number of mirrors of a hot volume, beyond its replication")
+	hotVolumeCooldown    = cmdMaster.Flag.Int("hotVolumeCooldownMinutes", 30, "minutes the reads of a mirrored volume stay under half -hotVolumeReads before a mirror is removed")
+	hotVolumeCheckSecs   = cmdMaster.Flag.Int("hotVolumeCheckSeconds", 60, "seconds between the checks of the read rates of the volumes")
+	replicateDelaySecs   = cmdMaster.Flag.Int("replicateDelaySeconds", 0, "seconds a volume misses a replica before it is copied onto another volume server. 0 disables the re-replication")
+	replicateWindow      = cmdMaster.Flag.String("replicateWindow", "", "daily window the re-replication copies start in, e.g. 01:00-05:00 in local time. Empty is any time")
+	replicateMaxPerNode  = cmdMaster.Flag.Int("replicateMaxPerNode", 1, "maximum number of re-replication copies running on a volume server, as source or target")
+	replicateMaxPerRack  = cmdMaster.Flag.Int("replicateMaxPerRack", 2, "maximum number of re-replication copies running in a rack, as source or target. 0 is no limit")
+	placementSeed        = cmdMaster.Flag.Int64("placementSeed", 0, "seed of the random placement of new volumes and picks of the assigns, for reproducible tests. 0 seeds from the clock")
+	mFaults              = cmdMaster.Flag.String("faults", "", "faults injected for testing, e.g. fsync.fail=0.1 to fail saving the file id sequence. Never set it in production")
+
+	masterHttpOptions = newHttpServerOptions(&cmdMaster.Flag)
 )
 
 var topo *topology.Topology
 var vg *replication.VolumeGrowth
+var masterLatency *util.LatencyStats
+var masterAuditLog *util.AuditLog
 
 func dirLookupHandler(w http.ResponseWriter, r *http.Request) {
-	vid := r.FormValue("volumeId")
+	vid, newFid := r.FormValue("volumeId"), ""
 	commaSep := strings.Index(vid, ",")
 	if commaSep > 0 {
+		if newFid = redirectedFid(vid); newFid != "" {
+			vid = newFid
+			commaSep = strings.Index(vid, ",")
+		}
 		vid = vid[0:commaSep]
 	}
+	defer masterLatency.Observe("lookup", vid, time.Now())
 	volumeId, err := storage.NewVolumeId(vid)
 	if err == nil {
 		machines := topo.Lookup(volumeId)
-		if machines != nil {
+		if machines != nil && len(*machines) > 0 {
 			ret := []map[string]string{}
 			for _, dn := range *machines {
-				ret = append(ret, map[string]string{"url": dn.Url(), "publicUrl": dn.PublicUrl})
+				location := map[string]string{"url": dn.Url(), "publicUrl": dn.PublicUrl}
+				if dn.AdminPort != 0 {
+					location["adminUrl"] = dn.AdminUrl()
+				}
+				if dn.GrpcPort != 0 {
+					location["grpcUrl"] = dn.GrpcUrl()
+				}
+				ret = append(ret, location)
 			}
-			writeJson(w, r, map[string]interface{}{"locations": ret})
+			m := map[string]interface{}{"locations": ret}
+			if newFid != "" {
+				m["fid"] = newFid
+			}
+			writeLookupResponse(w, r, m)
 		} else {
 			w.WriteHeader(http.StatusNotFound)
-			writeJson(w, r, map[string]string{"error": "volume id " + volumeId.String() + " not found. "})
+			writeLookupResponse(w, r, map[string]string{"error": "volume id " + volumeId.String() + " not found. "})
 		}
 	} else {
 		w.WriteHeader(http.StatusNotAcceptable)
-		writeJson(w, r, map[string]string{"error": "unknown volumeId format " + vid})
+		writeLookupResponse(w, r, map[string]string{"error": "unknown volumeId format " + vid})
+	}
+}
+
+// getHandler serves /get/fid for clients that can not look up the volume themselves,
+// by redirecting to a random replica or proxying the content, depending on -readMode.
+// The url is signed for reading if the client may get signed read urls.
+func getHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeJson(w, r, map[string]string{"error": "Only GET and HEAD are served at /get/"})
+		return
+	}
+	vid, fid, ext := directory.ParsePath(r.URL.Path)
+	if newFid := redirectedFid(vid + "," + fid); newFid != "" {
+		commaSep := strings.Index(newFid, ",")
+		vid, fid = newFid[:commaSep], newFid[commaSep+1:]
+	}
+	volumeId, err := storage.NewVolumeId(vid)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJson(w, r, map[string]string{"error": "unknown file id " + r.URL.Path[len("/get/"):]})
+		return
+	}
+	machines := topo.Lookup(volumeId)
+	if machines == nil || len(*machines) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": "volume id " + volumeId.String() + " not found. "})
+		return
+	}
+	dn := (*machines)[rand.Intn(len(*machines))]
+	query := r.URL.Query()
+	if *mSecureKey != "" && maySign(r, util.SignedRead) {
+		if signed, err := url.ParseQuery(util.SignFileId(*mSecureKey, util.SignedRead, vid+","+fid, time.Now().Unix()+defaultSignedUrlSeconds)); err == nil {
+			for k, v := range signed {
+				query[k] = v
+			}
+		}
+	}
+	path := "/" + vid + "," + fid + ext
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	if *mReadMode != "proxy" {
+		http.Redirect(w, r, "http://"+dn.PublicUrl+path, http.StatusFound)
+		return
+	}
+	req, err := http.NewRequest(r.Method, "http://"+dn.Url()+path, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
 	}
+	for _, name := range []string{"Accept-Encoding", "If-Modified-Since", "Range"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
 }
 
 func dirAssignHandler(w http.ResponseWriter, r *http.Request) {
+	start, fid := time.Now(), ""
+	defer func() { masterLatency.Observe("assign", fid, start) }()
 	c, e := strconv.Atoi(r.FormValue("count"))
 	if e != nil {
 		c = 1
@@ -78,62 +425,329 @@ func dirAssignHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	rt, err := storage.NewReplicationTypeFromString(repType)
 	if err != nil {
-		w.WriteHeader(http.StatusNotAcceptable)
-		writeJson(w, r, map[string]string{"error": err.Error()})
+		writeAssignError(w, r, http.StatusNotAcceptable, topology.AssignInvalidRequest, err.Error(), nil, nil)
 		return
 	}
-	if topo.GetVolumeLayout(rt).GetActiveVolumeCount() <= 0 {
-		if topo.FreeSpace() <= 0 {
-			w.WriteHeader(http.StatusNotFound)
-			writeJson(w, r, map[string]string{"error": "No free volumes left!"})
+	collection := r.FormValue("collection")
+	if err := storage.CheckCollectionName(collection); err != nil {
+		writeAssignError(w, r, http.StatusNotAcceptable, topology.AssignInvalidRequest, err.Error(), nil, nil)
+		return
+	}
+	filter, err := topo.NodeFilter(collection, r.FormValue("diskType"), r.FormValue("constraint"))
+	if err != nil {
+		writeAssignError(w, r, http.StatusNotAcceptable, topology.AssignInvalidRequest, err.Error(), nil, nil)
+		return
+	}
+	growthCount := *volumeGrowthCount
+	if preallocate := r.FormValue("preallocate"); preallocate != "" {
+		if growthCount, err = strconv.Atoi(preallocate); err != nil || growthCount <= 0 {
+			writeAssignError(w, r, http.StatusNotAcceptable, topology.AssignInvalidRequest, "preallocate "+preallocate+" is not a positive integer", nil, nil)
 			return
+		}
+	}
+	diskType, _ := topo.StorageClass(collection, r.FormValue("diskType"))
+	if growable, low := capacity.check(collection, rt, diskType, r.FormValue("constraint"), filter); low {
+		if capacity.reject {
+			_, counts := topo.AssignFailure(collection, rt, filter)
+			writeAssignError(w, r, http.StatusInsufficientStorage, topology.AssignCapacityLow, "Capacity low: the free volume slots can only hold "+
+				strconv.Itoa(growable)+" more volumes of replication "+string(rt)+", under the margin of "+strconv.Itoa(capacity.margin), counts, nil)
+			return
+		}
+		time.Sleep(capacity.delay)
+	}
+	dataCenter := ""
+	if *writeAffinity {
+		dataCenter = topo.LocateDataCenter(util.RemoteIp(r.RemoteAddr))
+	}
+	var explanation *topology.AssignExplanation
+	explain := func(grown int) {
+		if r.FormValue("explain") == "true" {
+			explanation = topo.ExplainAssign(collection, rt, dataCenter, filter)
+			explanation.Grown = grown
+		}
+	}
+	grown := 0
+	if topo.GetVolumeLayout(collection, rt).GetActiveVolumeCountMatching(filter) <= 0 {
+		if topology.FreeSpaceMatching(topo, filter) <= 0 {
+			explain(0)
+			code, counts := topo.AssignFailure(collection, rt, filter)
+			writeAssignError(w, r, http.StatusNotFound, code, noFreeVolumesMessage(diskType), counts, explanation)
+			return
+		}
+		key, ok := startGrowing(collection, rt, diskType, r.FormValue("constraint"))
+		if !ok {
+			explain(0)
+			writeAssignError(w, r, http.StatusServiceUnavailable, topology.AssignGrowing, "Volumes are being grown for this layout", nil, explanation)
+			return
+		}
+		if growthCount > 0 {
+			grown, _ = vg.GrowByCountAndType(growthCount, collection, rt, topo, filter)
 		} else {
-			vg.GrowByType(rt, topo)
+			grown, _ = vg.GrowByType(collection, rt, topo, filter)
 		}
+		stopGrowing(key)
 	}
-	fid, count, dn, err := topo.PickForWrite(rt, c)
+	explain(grown)
+	fid, count, dn, err := topo.PickForWrite(collection, rt, c, dataCenter, filter)
 	if err == nil {
-		writeJson(w, r, map[string]interface{}{"fid": fid, "url": dn.Url(), "publicUrl": dn.PublicUrl, "count": count})
+		m := map[string]interface{}{"fid": fid, "url": dn.Url(), "publicUrl": dn.PublicUrl, "count": count}
+		if *mSecureKey != "" {
+			m["auth"] = util.SignFileIds(*mSecureKey, util.SignedWrite, fid, count, time.Now().Unix()+defaultSignedUrlSeconds)
+		}
+		if explanation != nil {
+			m["explain"] = explanation
+		}
+		writeAssignResponse(w, r, m)
 	} else {
+		code, counts := topo.AssignFailure(collection, rt, filter)
+		writeAssignError(w, r, http.StatusNotAcceptable, code, err.Error(), counts, explanation)
+	}
+}
+
+// assignFailures counts the failed assigns by code, for /stats.
+var (
+	assignFailures     = make(map[string]int64)
+	assignFailuresLock sync.Mutex
+)
+
+// writeAssignError answers the assign with the error, its code, one of the
+// topology.Assign* codes, the hint of assignRetry with its Retry-After, and the
+// counts of the layout if there are some. With ?explain=true the explanation is
+// added, in json only.
+func writeAssignError(w http.ResponseWriter, r *http.Request, status int, code string, err string, counts *topology.AssignCounts, explanation *topology.AssignExplanation) {
+	assignFailuresLock.Lock()
+	assignFailures[code]++
+	assignFailuresLock.Unlock()
+	retryAfter, hint := assignRetry(code)
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	w.WriteHeader(status)
+	if wantsProtobuf(r) {
+		writeAssignResponse(w, r, map[string]string{"error": err, "code": code, "hint": hint})
+		return
+	}
+	m := map[string]interface{}{"error": err, "code": code, "hint": hint}
+	if retryAfter > 0 {
+		m["retryAfter"] = retryAfter
+	}
+	if counts != nil {
+		m["counts"] = counts
+	}
+	if explanation != nil {
+		m["explain"] = explanation
+	}
+	writeJson(w, r, m)
+}
+
+func dirSignHandler(w http.ResponseWriter, r *http.Request) {
+	if *mSecureKey == "" {
 		w.WriteHeader(http.StatusNotAcceptable)
-		writeJson(w, r, map[string]string{"error": err.Error()})
+		writeJson(w, r, map[string]string{"error": "The master has no secure key to sign urls"})
+		return
 	}
+	fid, op := r.FormValue("fid"), r.FormValue("op")
+	if op == "" {
+		op = util.SignedRead
+	}
+	if op != util.SignedRead && op != util.SignedWrite && op != util.SignedDelete {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "op should be read, write or delete"})
+		return
+	}
+	if !maySign(r, op) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="weed master"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJson(w, r, map[string]string{"error": "Signing " + op + " urls needs the -secureKey or a principal of -roles allowed to sign them"})
+		return
+	}
+	seconds, err := strconv.ParseInt(r.FormValue("seconds"), 10, 64)
+	if err != nil || seconds <= 0 {
+		seconds = defaultSignedUrlSeconds
+	}
+	if seconds > maxSignedUrlSeconds {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "seconds should be at most " + strconv.Itoa(maxSignedUrlSeconds)})
+		return
+	}
+	if _, err := directory.ParseFileId(fid); err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "unknown fid format " + fid})
+		return
+	}
+	volumeId, err := directory.ParseVolumeId(fid)
+	var machines *[]*topology.DataNode
+	if err == nil {
+		machines = topo.Lookup(volumeId)
+	}
+	if machines == nil || len(*machines) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": "volume of " + fid + " not found"})
+		return
+	}
+	// count signs the file ids assigned together from fid, e.g. to resume a chunked upload
+	count, err := strconv.Atoi(r.FormValue("count"))
+	if err != nil || count < 1 {
+		count = 1
+	}
+	expires := time.Now().Unix() + seconds
+	auth := util.SignFileIds(*mSecureKey, op, fid, count, expires)
+	writeJson(w, r, map[string]interface{}{"url": directory.FileUrl((*machines)[0].PublicUrl, fid, "") + "?" + auth, "auth": auth, "expires": expires})
 }
 
 func dirJoinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJson(w, r, map[string]string{"error": err.Error()})
+			return
+		}
+		defer gz.Close()
+		r.Body = io.NopCloser(io.LimitReader(gz, maxHeartbeatBytes))
+	}
+	if err := verifyJoin(r); err != nil {
+		log.Println("Refused the join of", r.RemoteAddr, "with port", r.FormValue("port")+":", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
 	ip := r.FormValue("ip")
 	if ip == "" {
-		ip = r.RemoteAddr[0:strings.Index(r.RemoteAddr, ":")]
+		ip = util.RemoteIp(r.RemoteAddr)
 	}
 	port, _ := strconv.Atoi(r.FormValue("port"))
 	maxVolumeCount, _ := strconv.Atoi(r.FormValue("maxVolumeCount"))
-	s := r.RemoteAddr[0:strings.Index(r.RemoteAddr, ":")+1] + r.FormValue("port")
+	s := util.JoinHostPort(util.RemoteIp(r.RemoteAddr), port)
 	publicUrl := r.FormValue("publicUrl")
 	volumes := new([]storage.VolumeInfo)
 	json.Unmarshal([]byte(r.FormValue("volumes")), volumes)
-	debug(s, "volumes", r.FormValue("volumes"))
-	topo.RegisterVolumes(*volumes, ip, port, publicUrl, maxVolumeCount)
+	dn, changed := topo.RegisterVolumes(*volumes, ip, port, publicUrl, maxVolumeCount, r.FormValue("diskType"), topology.ParseLabels(r.FormValue("labels")))
+	dn.AdminPort, _ = strconv.Atoi(r.FormValue("adminPort"))
+	dn.GrpcPort, _ = strconv.Atoi(r.FormValue("grpcPort"))
+	lostVolumes := new([]storage.VolumeId)
+	if json.Unmarshal([]byte(r.FormValue("lostVolumes")), lostVolumes) == nil {
+		topo.UnRegisterLostVolumes(dn, *lostVolumes)
+	}
+	reads := make(map[storage.VolumeId]uint64)
+	if json.Unmarshal([]byte(r.FormValue("reads")), &reads) == nil {
+		topo.RecordReads(dn, reads)
+	}
+	if sentAt, err := strconv.ParseInt(r.FormValue("time"), 10, 64); err == nil {
+		dn.ClockSkew = sentAt - dn.LastSeen
+	}
+	debug(s, "sent", len(*volumes), "volumes,", changed, "changed")
+	writeJson(w, r, map[string]interface{}{"UploadPolicies": topo.UploadPolicies(), "SignedReads": topo.SignedReadCollections(), "ResponseHeaders": topo.ResponseHeaders()})
+}
+
+// verifyJoin checks that the joining volume server signed the heartbeat with
+// the cluster secret, if -clusterSecret is set. A client certificate is not
+// enough, as the ones of the -roles principals share the -clientCaFile.
+func verifyJoin(r *http.Request) error {
+	if *mClusterSecret == "" {
+		return nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	if r.PostForm.Get("sig") == "" {
+		return errors.New("The heartbeat is not signed with the cluster secret")
+	}
+	return util.VerifyValuesSignature(*mClusterSecret, r.PostForm, 5*time.Minute)
 }
 
 func dirStatusHandler(w http.ResponseWriter, r *http.Request) {
 	m := make(map[string]interface{})
 	m["Version"] = VERSION
 	m["Topology"] = topo.ToMap()
+	if p := topo.VolumeIdPartition(); p != nil {
+		m["VolumeIdPartition"] = p.String()
+	}
+	if capacity.margin > 0 {
+		m["Capacity"] = capacity.ToMap()
+	}
+	if report := topo.CapacityForecast(); report != nil {
+		m["CapacityForecast"] = report
+	}
 	writeJson(w, r, m)
 }
 
-func volumeGrowHandler(w http.ResponseWriter, r *http.Request) {
-	count := 0
-	rt, err := storage.NewReplicationTypeFromString(r.FormValue("replication"))
+func growVolumes(collection string, replication string, countString string, diskType string, constraint string) (count int, err error) {
+	if err = storage.CheckCollectionName(collection); err != nil {
+		return
+	}
+	rt, err := storage.NewReplicationTypeFromString(replication)
 	if err == nil {
-		if count, err = strconv.Atoi(r.FormValue("count")); err == nil {
-			if topo.FreeSpace() < count*rt.GetCopyCount() {
-				err = errors.New("Only " + strconv.Itoa(topo.FreeSpace()) + " volumes left! Not enough for " + strconv.Itoa(count*rt.GetCopyCount()))
+		if count, err = strconv.Atoi(countString); err == nil {
+			var filter topology.NodeFilter
+			if filter, err = topo.NodeFilter(collection, diskType, constraint); err != nil {
+				return
+			}
+			if freeSpace := topology.FreeSpaceMatching(topo, filter); freeSpace < count*rt.GetCopyCount() {
+				diskType, _ = topo.StorageClass(collection, diskType)
+				err = errors.New("Only " + strconv.Itoa(freeSpace) + " volumes left" + onDiskType(diskType) + "! Not enough for " + strconv.Itoa(count*rt.GetCopyCount()))
 			} else {
-				count, err = vg.GrowByCountAndType(count, rt, topo)
+				count, err = vg.GrowByCountAndType(count, collection, rt, topo, filter)
 			}
 		}
 	}
+	return
+}
+
+// noFreeVolumesMessage tells there is no free volume slot, on the volume servers
+// of the disk type if there is one.
+func noFreeVolumesMessage(diskType string) string {
+	return "No free volumes left" + onDiskType(diskType) + "!"
+}
+
+func onDiskType(diskType string) string {
+	if diskType == "" {
+		return ""
+	}
+	return " on the volume servers with -diskType=" + diskType
+}
+
+func masterStatsHandler(w http.ResponseWriter, r *http.Request) {
+	m := make(map[string]interface{})
+	m["Version"] = VERSION
+	m["Latency"] = masterLatency.ToMap()
+	m["Redirects"] = fidRedirects.ToMap()
+	assignFailuresLock.Lock()
+	failures := make(map[string]int64, len(assignFailures))
+	for code, count := range assignFailures {
+		failures[code] = count
+	}
+	assignFailuresLock.Unlock()
+	m["AssignFailures"] = failures
+	writeJson(w, r, m)
+}
+
+func sequenceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	m := make(map[string]interface{})
+	m["Version"] = VERSION
+	m["Sequence"] = topo.Sequence().ToMap()
+	writeJson(w, r, m)
+}
+
+func sequenceBumpHandler(w http.ResponseWriter, r *http.Request) {
+	next, err := strconv.ParseUint(r.FormValue("next"), 10, 64)
+	if err == nil {
+		err = topo.Sequence().Bump(next)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, topo.Sequence().ToMap())
+}
+
+func volumeGrowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("volume") != "" {
+		volumeGrowWithIdHandler(w, r)
+		return
+	}
+	count, err := growVolumes(r.FormValue("collection"), r.FormValue("replication"), r.FormValue("count"), r.FormValue("diskType"), r.FormValue("constraint"))
 	if err != nil {
 		w.WriteHeader(http.StatusNotAcceptable)
 		writeJson(w, r, map[string]string{"error": err.Error()})
@@ -143,6 +757,34 @@ func volumeGrowHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// volumeGrowWithIdHandler creates the one volume of ?volume=N, e.g. for weed merge.
+func volumeGrowWithIdHandler(w http.ResponseWriter, r *http.Request) {
+	vid, err := storage.NewVolumeId(r.FormValue("volume"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "Unknown volume " + r.FormValue("volume")})
+		return
+	}
+	err = storage.CheckCollectionName(r.FormValue("collection"))
+	var rt storage.ReplicationType
+	if err == nil {
+		rt, err = storage.NewReplicationTypeFromString(r.FormValue("replication"))
+	}
+	var filter topology.NodeFilter
+	if err == nil {
+		filter, err = topo.NodeFilter(r.FormValue("collection"), r.FormValue("diskType"), r.FormValue("constraint"))
+	}
+	if err == nil {
+		err = vg.GrowVolume(vid, r.FormValue("collection"), rt, topo, filter)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, map[string]interface{}{"count": 1, "volume": vid})
+}
+
 func volumeStatusHandler(w http.ResponseWriter, r *http.Request) {
   m := make(map[string]interface{})
   m["Version"] = VERSION
@@ -150,30 +792,260 @@ func volumeStatusHandler(w http.ResponseWriter, r *http.Request) {
   writeJson(w, r, m)
 }
 
+func volumeVacuumHandler(w http.ResponseWriter, r *http.Request) {
+	threshold := *garbageThreshold
+	if gcThreshold := r.FormValue("garbageThreshold"); gcThreshold != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(gcThreshold, 64); err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			writeJson(w, r, map[string]string{"error": "garbageThreshold " + gcThreshold + " is not a valid float number"})
+			return
+		}
+	}
+	debug("garbageThreshold =", threshold)
+	writeJson(w, r, map[string]interface{}{"queued": topo.Vacuum(threshold)})
+}
+
+// volumeCloneHandler copies the sealed volume of ?volume=N under a new volume id.
+func volumeCloneHandler(w http.ResponseWriter, r *http.Request) {
+	vid, err := storage.NewVolumeId(r.FormValue("volume"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "volume " + r.FormValue("volume") + " is not a valid volume id"})
+		return
+	}
+	newVid, err := topo.CloneVolume(vid)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, map[string]string{"volume": vid.String(), "clone": newVid.String()})
+}
+
+func volumeSealHandler(w http.ResponseWriter, r *http.Request) {
+	setVolumeState(w, r, storage.VolumeSealed)
+}
+
+func volumeUnsealHandler(w http.ResponseWriter, r *http.Request) {
+	setVolumeState(w, r, storage.VolumeGrowing)
+}
+
+func setVolumeState(w http.ResponseWriter, r *http.Request, state storage.VolumeState) {
+	volumeId, err := storage.NewVolumeId(r.FormValue("volume"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "volume " + r.FormValue("volume") + " is not a valid volume id"})
+		return
+	}
+	if err = topo.SetVolumeState(volumeId, state); err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, map[string]string{"volume": volumeId.String(), "state": string(state)})
+}
+
+// volumeSimulateHandler reports the volume copies a placement change would take,
+// without making them.
+func volumeSimulateHandler(w http.ResponseWriter, r *http.Request) {
+	simulation := topology.NewSimulation(topo)
+	var result *topology.SimulationResult
+	var err error
+	switch r.FormValue("action") {
+	case "decommission":
+		result, err = simulation.Decommission(r.FormValue("node"))
+	case "rebalance":
+		result = simulation.Rebalance()
+	case "replication":
+		var repType storage.ReplicationType
+		if repType, err = storage.NewReplicationTypeFromString(r.FormValue("replication")); err == nil {
+			result, err = simulation.ChangeReplication(r.FormValue("collection"), repType)
+		}
+	default:
+		err = errors.New("action should be decommission, rebalance or replication")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, result)
+}
+
+func volumeVacuumStatusHandler(w http.ResponseWriter, r *http.Request) {
+	m := make(map[string]interface{})
+	m["Version"] = VERSION
+	m["Vacuum"] = topo.ToVacuumMap()
+	writeJson(w, r, m)
+}
+
+// volumeReplicateStatusHandler lists the volumes missing a replica, and the copies
+// re-replicating them, when -replicateDelaySeconds is set.
+func volumeReplicateStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := topo.ToReplicationMap()
+	if status == nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": "The re-replication is disabled, -replicateDelaySeconds is 0"})
+		return
+	}
+	status["Version"] = VERSION
+	writeJson(w, r, status)
+}
+
+// volumeReplicasHandler lists the volumes of each replication type by their number of
+// live replicas, with the under replicated ones, e.g. after a volume server failed.
+func volumeReplicasHandler(w http.ResponseWriter, r *http.Request) {
+	report := topo.ReplicaReport()
+	underReplicated, lost := 0, 0
+	for _, h := range report {
+		underReplicated += len(h.UnderReplicated)
+		lost += h.Counts[0].Volumes
+	}
+	writeJson(w, r, map[string]interface{}{"Version": VERSION, "Replication": report, "UnderReplicated": underReplicated, "Lost": lost})
+}
+
+// volumeHotHandler lists the read rates of the volumes at the last check, and their mirrors.
+func volumeHotHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, r, map[string]interface{}{"Version": VERSION, "HotVolumeReads": *hotVolumeReads, "Volumes": topo.HotVolumes()})
+}
+
+func collectionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	collection := r.FormValue("collection")
+	if collection == "" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "collection is required"})
+		return
+	}
+	results, err := topo.DeleteCollection(collection)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, map[string]interface{}{"collection": collection, "volumes": results})
+}
+
 func runMaster(cmd *Command, args []string) bool {
 	if *mMaxCpu < 1 {
 		*mMaxCpu = runtime.NumCPU()
 	}
 	runtime.GOMAXPROCS(*mMaxCpu)
+	budgets, err := util.ParseLatencyBudgets(*mLatencyBudgets)
+	if err != nil {
+		log.Fatalf("-latencyBudgets: %s", err)
+	}
+	masterLatency = util.NewLatencyStats(budgets)
+	util.RequestTimeout = time.Duration(*mRequestTimeout) * time.Second
+	if err = util.SetFaults(*mFaults); err != nil {
+		log.Fatalf("-faults: %s", err)
+	}
 	topo = topology.NewTopology("topo", *confFile, *metaFolder, "weed", uint64(*volumeSizeLimitMB)*1024*1024, *mpulse)
+	topo.SetVacuumLimits(*vacuumPerNode, *vacuumPerRack)
+	topo.SetDeadNodeSeconds(*deadNodeSeconds)
+	if err = topo.SetDeletedVolumesFile(path.Join(*metaFolder, "deleted_volumes.json")); err != nil {
+		log.Fatalf("Can not load the deleted volumes: %s", err)
+	}
+	if fidRedirects, err = directory.NewFidRedirects(path.Join(*metaFolder, "fid_redirects.txt")); err != nil {
+		log.Fatalf("Can not load the file id redirects: %s", err)
+	}
+	if *placementSeed != 0 {
+		topo.SetRandSource(rand.NewSource(*placementSeed))
+	}
+	topo.Sequence().SetBatchSize(*sequenceBatchSize)
+	partition, err := topology.ParseVolumeIdPartition(*volumeIdPartition)
+	if err != nil {
+		log.Fatalf("-volumeIdPartition: %s", err)
+	}
+	topo.SetVolumeIdPartition(partition)
+	if *capacityLowAction != "delay" && *capacityLowAction != "reject" {
+		log.Fatalf("-capacityLowAction should be delay or reject, not %s", *capacityLowAction)
+	}
+	capacity = newCapacityGuard(*capacityMargin, *capacityLowAction == "reject", time.Duration(*capacityLowDelayMs)*time.Millisecond, *capacityWebhook)
 	vg = replication.NewDefaultVolumeGrowth()
+	topo.SetVolumeFileCountLimit(*volumeFileCountLimit)
 	log.Println("Volume Size Limit is", *volumeSizeLimitMB, "MB")
-	http.HandleFunc("/dir/assign", dirAssignHandler)
-	http.HandleFunc("/dir/lookup", dirLookupHandler)
-	http.HandleFunc("/dir/join", dirJoinHandler)
-	http.HandleFunc("/dir/status", dirStatusHandler)
-	http.HandleFunc("/vol/grow", volumeGrowHandler)
-  http.HandleFunc("/vol/status", volumeStatusHandler)
+	if masterAuditLog, err = util.NewAuditLog(path.Join(*metaFolder, "audit.log")); err != nil {
+		log.Fatalf("Audit log [ERROR] %s", err)
+	}
+	if *mRolesFile != "" {
+		if masterRoles, err = loadRoles(*mRolesFile); err != nil {
+			log.Fatalf("-roles: %s", err)
+		}
+		log.Println("Admin endpoints are limited to the", len(masterRoles), "principals of", *mRolesFile)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/audit", requireRole(roleMonitor, auditHandler(masterAuditLog)))
+	mux.HandleFunc("/col/delete", audited(masterAuditLog, requireRole(roleAdmin, collectionDeleteHandler)))
+	mux.HandleFunc("/dir/assign", dirAssignHandler)
+	mux.HandleFunc("/dir/capacity", requireRole(roleMonitor, dirCapacityHandler))
+	mux.HandleFunc("/dir/lookup", dirLookupHandler)
+	mux.HandleFunc("/dir/redirects", audited(masterAuditLog, requireRole(roleOperator, dirRedirectsHandler)))
+	mux.HandleFunc("/dir/join", dirJoinHandler)
+	mux.HandleFunc("/dir/sign", dirSignHandler)
+	mux.HandleFunc("/dir/status", requireRole(roleMonitor, dirStatusHandler))
+	mux.HandleFunc("/get/", getHandler)
+	mux.HandleFunc("/openapi.json", openapiHandler("master"))
+	mux.HandleFunc("/stats", requireRole(roleMonitor, masterStatsHandler))
+	mux.HandleFunc("/seq/status", requireRole(roleMonitor, sequenceStatusHandler))
+	mux.HandleFunc("/seq/bump", audited(masterAuditLog, requireRole(roleAdmin, sequenceBumpHandler)))
+	mux.HandleFunc("/vol/clone", audited(masterAuditLog, requireRole(roleOperator, volumeCloneHandler)))
+	mux.HandleFunc("/vol/grow", audited(masterAuditLog, requireRole(roleOperator, volumeGrowHandler)))
+	mux.HandleFunc("/vol/hot", requireRole(roleMonitor, volumeHotHandler))
+	mux.HandleFunc("/vol/orphans", requireRole(roleMonitor, volumeOrphansHandler))
+	mux.HandleFunc("/vol/orphans/adopt", audited(masterAuditLog, requireRole(roleOperator, volumeOrphanAdoptHandler)))
+	mux.HandleFunc("/vol/orphans/purge", audited(masterAuditLog, requireRole(roleAdmin, volumeOrphanPurgeHandler)))
+	mux.HandleFunc("/vol/replicas", requireRole(roleMonitor, volumeReplicasHandler))
+	mux.HandleFunc("/vol/replicate/status", requireRole(roleMonitor, volumeReplicateStatusHandler))
+	mux.HandleFunc("/vol/seal", audited(masterAuditLog, requireRole(roleOperator, volumeSealHandler)))
+	mux.HandleFunc("/vol/simulate", requireRole(roleMonitor, volumeSimulateHandler))
+	mux.HandleFunc("/vol/snapshot", audited(masterAuditLog, requireRole(roleOperator, volumeSnapshotHandler)))
+	mux.HandleFunc("/vol/snapshot/manifest", requireRole(roleMonitor, volumeSnapshotManifestHandler))
+	mux.HandleFunc("/vol/snapshot/release", audited(masterAuditLog, requireRole(roleOperator, volumeSnapshotReleaseHandler)))
+	mux.HandleFunc("/vol/unseal", audited(masterAuditLog, requireRole(roleOperator, volumeUnsealHandler)))
+	mux.HandleFunc("/vol/status", requireRole(roleMonitor, volumeStatusHandler))
+	mux.HandleFunc("/vol/vacuum", audited(masterAuditLog, requireRole(roleOperator, volumeVacuumHandler)))
+	mux.HandleFunc("/vol/vacuum/status", requireRole(roleMonitor, volumeVacuumStatusHandler))
+	mux.HandleFunc("/ui/", requireRole(roleMonitor, masterUiHandler))
+	mux.HandleFunc("/ui/action", audited(masterAuditLog, requireRole(roleOperator, masterUiActionHandler)))
 
 	topo.StartRefreshWritableVolumes()
+	if *capacitySampleSecs > 0 {
+		topo.StartCapacitySampling(time.Duration(*capacitySampleSecs)*time.Second, time.Duration(*capacityWindowHours)*time.Hour)
+	}
+	if *hotVolumeReads > 0 {
+		err = topo.StartHotVolumeMirroring(*hotVolumeReads, *hotVolumeMirrors, time.Duration(*hotVolumeCooldown)*time.Minute,
+			time.Duration(*hotVolumeCheckSecs)*time.Second, path.Join(*metaFolder, "mirrored_volumes.json"))
+		if err != nil {
+			log.Fatalf("Can not load the mirrored volumes: %s", err)
+		}
+	}
+	if *replicateDelaySecs > 0 {
+		window, err := topology.ParseDailyWindow(*replicateWindow)
+		if err != nil {
+			log.Fatalf("Invalid -replicateWindow: %s", err)
+		}
+		topo.StartReplication(time.Duration(*replicateDelaySecs)*time.Second, window, *replicateMaxPerNode, *replicateMaxPerRack,
+			time.Duration(*mpulse)*time.Second)
+	}
+	go func() {
+		for {
+			time.Sleep(15 * time.Minute)
+			topo.Vacuum(*garbageThreshold)
+		}
+	}()
+	if *memcachePort > 0 {
+		go serveMemcacheLookups(*memcachePort)
+	}
+	if *mGrpcPort > 0 {
+		go serveGrpc(*mGrpcPort, masterGrpcMethods)
+	}
+	if *dnsPort > 0 {
+		go serveDnsLookups(*dnsPort, *dnsDomain)
+	}
 
 	log.Println("Start Weed Master", VERSION, "at port", strconv.Itoa(*mport))
-	srv := &http.Server{
-		Addr:        ":" + strconv.Itoa(*mport),
-		Handler:     http.DefaultServeMux,
-		ReadTimeout: time.Duration(*mReadTimeout) * time.Second,
-	}
-	e := srv.ListenAndServe()
+	e := masterHttpOptions.listenAndServe(*mport, withCors(*mCorsOrigins, versionedApi(mux)), *mReadTimeout)
 	if e != nil {
 		log.Fatalf("Fail to start:%s", e.Error())
 	}
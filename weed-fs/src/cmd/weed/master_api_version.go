@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// masterApiVersions are the versions of the master endpoints served under
+// /v1/ and so on. The unversioned paths are the first version, and stay so.
+var masterApiVersions = []int{1}
+
+// versionedApi serves the endpoints of the mux under the prefix of each version,
+// e.g. /v1/dir/assign, and every answer tells its version in X-Weed-Api-Version.
+// A later version changing the shape of the answers, e.g. of /dir/lookup, gets
+// its own prefix, while deployed clients keep calling the unversioned paths.
+func versionedApi(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, rest := apiVersion(r.URL.Path)
+		if version == 0 {
+			w.Header().Set("X-Weed-Api-Version", "1")
+			mux.ServeHTTP(w, r)
+			return
+		}
+		for _, v := range masterApiVersions {
+			if v == version {
+				w.Header().Set("X-Weed-Api-Version", strconv.Itoa(version))
+				http.StripPrefix(r.URL.Path[:len(r.URL.Path)-len(rest)], mux).ServeHTTP(w, r)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]interface{}{"error": "API version v" + strconv.Itoa(version) + " is not supported", "versions": masterApiVersions})
+	})
+}
+
+// apiVersion splits /v1/dir/assign into 1 and /dir/assign, and returns 0 for
+// the unversioned paths.
+func apiVersion(path string) (int, string) {
+	if !strings.HasPrefix(path, "/v") {
+		return 0, path
+	}
+	slash := strings.Index(path[1:], "/")
+	if slash < 0 {
+		return 0, path
+	}
+	version, err := strconv.Atoi(path[2 : slash+1])
+	if err != nil || version <= 0 {
+		return 0, path
+	}
+	return version, path[slash+1:]
+}
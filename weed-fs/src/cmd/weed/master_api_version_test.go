@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApiVersion(t *testing.T) {
+	for path, expected := range map[string]struct {
+		version int
+		rest    string
+	}{
+		"/dir/assign":    {0, "/dir/assign"},
+		"/v1/dir/assign": {1, "/dir/assign"},
+		"/v12/dir":       {12, "/dir"},
+		"/v1":            {0, "/v1"},
+		"/v0/dir/assign": {0, "/v0/dir/assign"},
+		"/vol/status":    {0, "/vol/status"},
+		"/v-1/dir":       {0, "/v-1/dir"},
+	} {
+		if version, rest := apiVersion(path); version != expected.version || rest != expected.rest {
+			t.Error(path, "split into", version, rest)
+		}
+	}
+}
+
+func TestVersionedApi(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir/assign", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	handler := versionedApi(mux)
+	for _, c := range []struct {
+		path, version string
+		status        int
+		body          string
+	}{
+		{"/dir/assign", "1", http.StatusOK, "/dir/assign"},
+		{"/v1/dir/assign", "1", http.StatusOK, "/dir/assign"},
+		{"/v2/dir/assign", "", http.StatusNotFound, "{\"error\":\"API version v2 is not supported\",\"versions\":[1]}"},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", c.path, nil))
+		if w.Code != c.status || w.Body.String() != c.body || w.Header().Get("X-Weed-Api-Version") != c.version {
+			t.Error(c.path, "got", w.Code, w.Body.String(), "version", w.Header().Get("X-Weed-Api-Version"))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"pkg/storage"
+	"pkg/topology"
+	"strconv"
+	"sync"
+)
+
+// assignGrowingRetrySeconds is how long the assigns of a layout whose volumes
+// are being grown are told to wait, about the time to create the volumes.
+const assignGrowingRetrySeconds = 2
+
+// growingLayouts are the layouts an assign is growing volumes for, by
+// collection, replication, disk type and constraint. The other assigns of the
+// layout are answered "growing" meanwhile, instead of growing more volumes.
+var (
+	growingLayouts     = make(map[string]bool)
+	growingLayoutsLock sync.Mutex
+)
+
+// startGrowing marks the layout as growing, or returns false if another assign
+// is growing it already.
+func startGrowing(collection string, rt storage.ReplicationType, diskType string, constraint string) (string, bool) {
+	key := collection + "/" + string(rt) + "/" + diskType + "/" + constraint
+	growingLayoutsLock.Lock()
+	defer growingLayoutsLock.Unlock()
+	if growingLayouts[key] {
+		return key, false
+	}
+	growingLayouts[key] = true
+	return key, true
+}
+
+func stopGrowing(key string) {
+	growingLayoutsLock.Lock()
+	defer growingLayoutsLock.Unlock()
+	delete(growingLayouts, key)
+}
+
+// assignRetry tells the clients of a failed assign when to retry, in seconds
+// for Retry-After, 0 if retrying will not help until the cluster changes, and
+// how to react, in the "hint" of the answer.
+func assignRetry(code string) (int, string) {
+	switch code {
+	case topology.AssignGrowing:
+		return assignGrowingRetrySeconds, "growing volumes, retry in " + strconv.Itoa(assignGrowingRetrySeconds) + "s"
+	case topology.AssignCapacityLow:
+		return 60, "capacity low, retry in 60s"
+	case topology.AssignReplicationUnavailable:
+		// a volume server restarting is back within a couple of heartbeats
+		seconds := 2 * *mpulse
+		return seconds, "not enough volume servers for the replication, retry in " + strconv.Itoa(seconds) + "s"
+	case topology.AssignNoCapacity:
+		return 0, "no free volume slot, add volume servers before retrying"
+	case topology.AssignVolumesFull:
+		return 0, "volumes full, add volume servers or vacuum before retrying"
+	}
+	return 0, "the request is invalid, retrying will not help"
+}
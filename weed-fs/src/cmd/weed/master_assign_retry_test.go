@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"pkg/storage"
+	"pkg/topology"
+	"testing"
+)
+
+func TestStartGrowing(t *testing.T) {
+	key, ok := startGrowing("docs", storage.Copy001, "ssd", "")
+	if !ok {
+		t.Fatal("the layout is already growing")
+	}
+	if _, ok := startGrowing("docs", storage.Copy001, "ssd", ""); ok {
+		t.Error("grew the layout twice at the same time")
+	}
+	other, ok := startGrowing("docs", storage.Copy001, "hdd", "")
+	if !ok {
+		t.Error("another disk type is not another layout")
+	}
+	stopGrowing(other)
+	stopGrowing(key)
+	if key, ok = startGrowing("docs", storage.Copy001, "ssd", ""); !ok {
+		t.Error("the layout is still growing once stopped")
+	}
+	stopGrowing(key)
+}
+
+func TestWriteAssignErrorRetryAfter(t *testing.T) {
+	for _, c := range []struct {
+		code       string
+		status     int
+		retryAfter string
+	}{
+		{topology.AssignGrowing, http.StatusServiceUnavailable, "2"},
+		{topology.AssignCapacityLow, http.StatusServiceUnavailable, "60"},
+		{topology.AssignReplicationUnavailable, http.StatusNotAcceptable, "10"},
+		{topology.AssignNoCapacity, http.StatusNotFound, ""},
+		{topology.AssignVolumesFull, http.StatusNotAcceptable, ""},
+		{"invalid", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		writeAssignError(w, httptest.NewRequest("GET", "/dir/assign", nil), c.status, c.code, "failed", nil, nil)
+		var reply map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || w.Code != c.status {
+			t.Fatal(c.code, "got", w.Code, w.Body.String())
+		}
+		if w.Header().Get("Retry-After") != c.retryAfter || reply["code"] != c.code || reply["hint"] == "" {
+			t.Error(c.code, "got Retry-After", w.Header().Get("Retry-After"), "and", reply)
+		}
+		if _, ok := reply["retryAfter"]; ok != (c.retryAfter != "") {
+			t.Error(c.code, "got retryAfter", reply["retryAfter"])
+		}
+	}
+}
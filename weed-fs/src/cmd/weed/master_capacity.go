@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"pkg/storage"
+	"pkg/topology"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// capacityGuard throttles the assigns of a layout once the free volume slots of
+// its volume servers can only hold -capacityMargin more of its volumes, so the
+// clients slow down, or get a clear error, while there is still room, instead
+// of writing at full speed until "No free volumes left!". The webhook is told
+// when a layout gets low, and when it has room again.
+type capacityGuard struct {
+	margin  int           // volumes a layout should still be able to grow, 0 disables the guard
+	reject  bool          // the assigns of the low layouts are rejected, instead of delayed
+	delay   time.Duration // added to the assigns of the low layouts
+	webhook string
+
+	lock sync.Mutex
+	low  map[string]int // the growable volumes of the low layouts, by capacityLayoutName
+}
+
+// capacityEvent is posted to the webhook.
+type capacityEvent struct {
+	Event       string // capacity_low, or capacity_ok when the layout has room again
+	Collection  string
+	Replication string
+	DiskType    string `json:",omitempty"`
+	Constraint  string `json:",omitempty"`
+	Growable    int    // volumes the free slots can still hold
+	Margin      int
+	Time        int64
+}
+
+var capacity *capacityGuard
+
+func newCapacityGuard(margin int, reject bool, delay time.Duration, webhook string) *capacityGuard {
+	return &capacityGuard{margin: margin, reject: reject, delay: delay, webhook: webhook, low: make(map[string]int)}
+}
+
+func capacityLayoutName(collection string, rt storage.ReplicationType, diskType, constraint string) string {
+	name := "collection " + strconv.Quote(collection) + " replication " + string(rt)
+	if diskType != "" {
+		name += " diskType " + diskType
+	}
+	if constraint != "" {
+		name += " constraint " + constraint
+	}
+	return name
+}
+
+// check counts the volumes the layout can still grow, and tells if it is under the margin.
+func (g *capacityGuard) check(collection string, rt storage.ReplicationType, diskType, constraint string, filter topology.NodeFilter) (int, bool) {
+	if g == nil || g.margin <= 0 {
+		return 0, false
+	}
+	growable := topology.FreeSpaceMatching(topo, filter) / rt.GetCopyCount()
+	low := growable < g.margin
+	name := capacityLayoutName(collection, rt, diskType, constraint)
+	g.lock.Lock()
+	_, wasLow := g.low[name]
+	if low {
+		g.low[name] = growable
+	} else {
+		delete(g.low, name)
+	}
+	g.lock.Unlock()
+	if low != wasLow {
+		e := &capacityEvent{Event: "capacity_ok", Collection: collection, Replication: string(rt), DiskType: diskType,
+			Constraint: constraint, Growable: growable, Margin: g.margin, Time: time.Now().Unix()}
+		if low {
+			e.Event = "capacity_low"
+			topo.RecordEvent("Capacity low:", name, "can only grow", growable, "more volumes")
+		} else {
+			topo.RecordEvent("Capacity ok:", name, "can grow", growable, "more volumes")
+		}
+		go g.notify(e)
+	}
+	return growable, low
+}
+
+func (g *capacityGuard) notify(e *capacityEvent) {
+	if g.webhook == "" {
+		return
+	}
+	data, _ := json.Marshal(e)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(g.webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Println("Capacity webhook", g.webhook, "failed:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Println("Capacity webhook", g.webhook, "answered", resp.Status)
+	}
+}
+
+// ToMap lists the low layouts, with the volumes they can still grow.
+func (g *capacityGuard) ToMap() map[string]interface{} {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	names := make([]string, 0, len(g.low))
+	for name := range g.low {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	low := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		low = append(low, map[string]interface{}{"Layout": name, "Growable": g.low[name]})
+	}
+	return map[string]interface{}{"Margin": g.margin, "Low": low}
+}
+
+// dirCapacityHandler projects the days until each layout and data center is full,
+// from the used bytes sampled every -capacitySampleSeconds.
+func dirCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	report := topo.CapacityForecast()
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": "The capacity is not sampled, -capacitySampleSeconds is 0"})
+		return
+	}
+	writeJson(w, r, map[string]interface{}{"Version": VERSION, "Forecast": report})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"pkg/storage"
+	"pkg/topology"
+	"testing"
+	"time"
+)
+
+func TestCapacityGuard(t *testing.T) {
+	events := make(chan capacityEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e capacityEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer webhook.Close()
+	expectEvent := func(event string, growable int) {
+		select {
+		case e := <-events:
+			if e.Event != event || e.Growable != growable || e.Collection != "docs" || e.Margin != 3 {
+				t.Errorf("expected %s with %d growable, got %+v", event, growable, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the webhook was not told", event)
+		}
+	}
+
+	previous := topo
+	defer func() { topo = previous }()
+	topo = topology.NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	topo.RegisterVolumes(nil, "127.0.0.1", 8080, "", 4, "hdd", nil)
+
+	var disabled *capacityGuard
+	if _, low := disabled.check("docs", storage.Copy000, "", "", nil); low {
+		t.Error("a disabled guard throttled")
+	}
+	g := newCapacityGuard(3, false, 0, webhook.URL)
+	if growable, low := g.check("docs", storage.Copy000, "", "", nil); growable != 4 || low {
+		t.Error("4 free slots, got", growable, low)
+	}
+	if growable, low := g.check("docs", storage.Copy001, "", "", nil); growable != 2 || !low {
+		t.Error("4 free slots for 2 copies, got", growable, low)
+	}
+	expectEvent("capacity_low", 2)
+	if _, low := g.check("docs", storage.Copy001, "", "", nil); !low {
+		t.Error("the layout is no longer low")
+	}
+	if low := g.ToMap()["Low"].([]map[string]interface{}); len(low) != 1 || low[0]["Growable"] != 2 {
+		t.Error("unexpected low layouts", low)
+	}
+
+	topo.RegisterVolumes(nil, "127.0.0.2", 8080, "", 4, "hdd", nil)
+	if growable, low := g.check("docs", storage.Copy001, "", "", nil); growable != 4 || low {
+		t.Error("8 free slots for 2 copies, got", growable, low)
+	}
+	expectEvent("capacity_ok", 4)
+	if low := g.ToMap()["Low"].([]map[string]interface{}); len(low) != 0 {
+		t.Error("unexpected low layouts", low)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
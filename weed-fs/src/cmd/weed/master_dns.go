@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"pkg/storage"
+	"strconv"
+	"strings"
+)
+
+// A small DNS server resolving <vid>.<dnsDomain>, e.g. 3.volume.weed.internal,
+// to A and AAAA records of the volume replicas, for load balancers and other
+// systems that only speak DNS. Only single A or AAAA queries over udp are
+// answered, from the lookup table. The ports of the replicas are not in DNS, so all the volume
+// servers should listen on the same port.
+
+const (
+	dnsTypeA      = 1
+	dnsTypeAAAA   = 28
+	dnsClassIN    = 1
+	dnsHeaderSize = 12
+
+	dnsRcodeFormatError = 1
+	dnsRcodeNameError   = 3
+	dnsRcodeNotImpl     = 4
+)
+
+func serveDnsLookups(port int, domain string) {
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatalf("Fail to start dns lookups:%s", err.Error())
+	}
+	log.Println("Serving volume lookups as", "<vid>."+domain, "with dns at udp port", port)
+	domain = "." + strings.ToLower(strings.Trim(domain, "."))
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Println("dns lookups read error:", err)
+			continue
+		}
+		if response := dnsResponse(buf[:n], domain); response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// dnsResponse answers the query, or returns nil for packets that are not queries.
+func dnsResponse(query []byte, domain string) []byte {
+	if len(query) < dnsHeaderSize || query[2]&0x80 != 0 {
+		return nil
+	}
+	name, end, ok := dnsQuestion(query)
+	if !ok || binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return dnsReply(query, dnsHeaderSize, dnsRcodeFormatError, nil)
+	}
+	qtype, qclass := binary.BigEndian.Uint16(query[end-4:end-2]), binary.BigEndian.Uint16(query[end-2:end])
+	if query[2]&0x78 != 0 || qclass != dnsClassIN {
+		return dnsReply(query, end, dnsRcodeNotImpl, nil)
+	}
+	if !strings.HasSuffix(name, domain) {
+		return dnsReply(query, end, dnsRcodeNameError, nil)
+	}
+	volumeId, err := storage.NewVolumeId(strings.TrimSuffix(name, domain))
+	if err != nil {
+		return dnsReply(query, end, dnsRcodeNameError, nil)
+	}
+	ips, ok := getLookupTable().ips[volumeId]
+	if !ok {
+		return dnsReply(query, end, dnsRcodeNameError, nil)
+	}
+	// the name exists, but may have no records of the type
+	var records []net.IP
+	for _, ip := range ips {
+		if qtype == dnsTypeA && ip.To4() != nil || qtype == dnsTypeAAAA && ip.To4() == nil {
+			records = append(records, ip)
+		}
+	}
+	return dnsReply(query, end, 0, records)
+}
+
+// dnsQuestion reads the name of the first question, in lower case without the
+// trailing dot, and returns where the question ends.
+func dnsQuestion(query []byte) (name string, end int, ok bool) {
+	var labels []string
+	i := dnsHeaderSize
+	for i < len(query) && query[i] != 0 {
+		length := int(query[i])
+		if length > 63 || i+1+length > len(query) {
+			return "", 0, false
+		}
+		labels = append(labels, strings.ToLower(string(query[i+1:i+1+length])))
+		i += 1 + length
+	}
+	end = i + 1 + 4
+	if end > len(query) {
+		return "", 0, false
+	}
+	return strings.Join(labels, "."), end, true
+}
+
+// dnsReply copies the header and the question of the query, and adds the A
+// records of the IPv4 addresses and the AAAA records of the IPv6 ones.
+func dnsReply(query []byte, questionEnd int, rcode byte, ips []net.IP) []byte {
+	reply := make([]byte, questionEnd, questionEnd+len(ips)*28)
+	copy(reply, query[:questionEnd])
+	reply[2] = 0x80 | 0x04 | query[2]&0x79 // response, authoritative, keeps the opcode and recursion desired
+	reply[3] = rcode
+	qdcount := uint16(1)
+	if questionEnd <= dnsHeaderSize {
+		qdcount = 0
+	}
+	binary.BigEndian.PutUint16(reply[4:6], qdcount)
+	binary.BigEndian.PutUint16(reply[6:8], uint16(len(ips)))
+	binary.BigEndian.PutUint16(reply[8:10], 0)
+	binary.BigEndian.PutUint16(reply[10:12], 0)
+	ttl := uint32(*mpulse)
+	for _, ip := range ips {
+		rtype, address := uint16(dnsTypeA), ip.To4()
+		if address == nil {
+			rtype, address = dnsTypeAAAA, ip.To16()
+		}
+		record := make([]byte, 12+len(address))
+		binary.BigEndian.PutUint16(record[0:2], 0xC000|dnsHeaderSize) // the name of the question
+		binary.BigEndian.PutUint16(record[2:4], rtype)
+		binary.BigEndian.PutUint16(record[4:6], dnsClassIN)
+		binary.BigEndian.PutUint32(record[6:10], ttl)
+		binary.BigEndian.PutUint16(record[10:12], uint16(len(address)))
+		copy(record[12:], address)
+		reply = append(reply, record...)
+	}
+	return reply
+}
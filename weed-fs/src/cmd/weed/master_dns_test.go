@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"pkg/storage"
+	"strings"
+	"testing"
+)
+
+func init() {
+	// the lookups are answered from a fixed table, instead of the topology
+	startLookupTableOnce.Do(func() {})
+	currentLookupTable.Store(&lookupTable{ips: map[storage.VolumeId][]net.IP{
+		3: {net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("fd00::1")},
+	}})
+}
+
+func dnsQuery(name string, qtype uint16) []byte {
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, 0, 0, dnsClassIN)
+	binary.BigEndian.PutUint16(query[len(query)-4:], qtype)
+	return query
+}
+
+func TestDnsResponse(t *testing.T) {
+	domain := ".volume.weed.internal"
+	for _, c := range []struct {
+		query   []byte
+		rcode   byte
+		answers []string
+	}{
+		{dnsQuery("3.volume.weed.internal", dnsTypeA), 0, []string{"10.0.0.1", "10.0.0.2"}},
+		{dnsQuery("3.Volume.Weed.Internal", dnsTypeA), 0, []string{"10.0.0.1", "10.0.0.2"}},
+		{dnsQuery("3.volume.weed.internal", dnsTypeAAAA), 0, []string{"fd00::1"}},
+		{dnsQuery("4.volume.weed.internal", dnsTypeA), dnsRcodeNameError, nil},
+		{dnsQuery("x.volume.weed.internal", dnsTypeA), dnsRcodeNameError, nil},
+		{dnsQuery("3.example.com", dnsTypeA), dnsRcodeNameError, nil},
+		{dnsQuery("3.volume.weed.internal", 15), 0, nil},
+	} {
+		reply := dnsResponse(c.query, domain)
+		if len(reply) < dnsHeaderSize || reply[2]&0x80 == 0 || reply[0] != 0x12 || reply[1] != 0x34 {
+			t.Fatal("not a reply to the query", c.query, reply)
+		}
+		if reply[3] != c.rcode || int(binary.BigEndian.Uint16(reply[6:8])) != len(c.answers) {
+			t.Error("query", c.query, "got rcode", reply[3], "and", binary.BigEndian.Uint16(reply[6:8]), "answers")
+			continue
+		}
+		offset := len(c.query)
+		for _, expected := range c.answers {
+			size := int(binary.BigEndian.Uint16(reply[offset+10 : offset+12]))
+			if ip := net.IP(reply[offset+12 : offset+12+size]); !ip.Equal(net.ParseIP(expected)) {
+				t.Error("query", c.query, "answered", ip, "expected", expected)
+			}
+			offset += 12 + size
+		}
+		if offset != len(reply) {
+			t.Error("query", c.query, "got", len(reply)-offset, "trailing bytes")
+		}
+	}
+
+	notImplemented := dnsQuery("3.volume.weed.internal", dnsTypeA)
+	notImplemented[2] |= 0x10 // a status request, not a standard query
+	if reply := dnsResponse(notImplemented, domain); reply[3] != dnsRcodeNotImpl {
+		t.Error("an opcode other than a query got rcode", reply[3])
+	}
+	broken := dnsQuery("3.volume.weed.internal", dnsTypeA)
+	broken[dnsHeaderSize] = 60 // a label longer than the packet
+	if reply := dnsResponse(broken, domain); reply[3] != dnsRcodeFormatError {
+		t.Error("a broken name got rcode", reply[3])
+	}
+	response := dnsQuery("3.volume.weed.internal", dnsTypeA)
+	response[2] |= 0x80
+	if dnsResponse(response, domain) != nil || dnsResponse([]byte{1, 2, 3}, domain) != nil {
+		t.Error("answered a packet that is not a query")
+	}
+}
+
+func FuzzDnsResponse(f *testing.F) {
+	f.Add(dnsQuery("3.volume.weed.internal", dnsTypeA))
+	f.Add(dnsQuery("3.volume.weed.internal", dnsTypeAAAA))
+	f.Add(dnsQuery("4.volume.weed.internal", dnsTypeA))
+	f.Add([]byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 63})
+	f.Fuzz(func(t *testing.T, query []byte) {
+		reply := dnsResponse(query, ".volume.weed.internal")
+		if reply != nil && (len(reply) < dnsHeaderSize || reply[2]&0x80 == 0) {
+			t.Fatal("the reply to", query, "is not a dns response:", reply)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"pkg/storage"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lookupTable is an in-memory copy of the volume locations, for the lookups
+// served outside of http. It is rebuilt whenever the locations change, and
+// never modified, so it is read without locks.
+type lookupTable struct {
+	responses map[storage.VolumeId][]byte   // the /dir/lookup json responses
+	ips       map[storage.VolumeId][]net.IP // the distinct addresses of the replicas, IPv4 or IPv6
+}
+
+const (
+	lookupTableInterval = 100 * time.Millisecond
+)
+
+var (
+	currentLookupTable   atomic.Value // *lookupTable
+	startLookupTableOnce sync.Once
+)
+
+// getLookupTable returns the current lookup table, starting to keep it up to date on the first call.
+func getLookupTable() *lookupTable {
+	startLookupTableOnce.Do(func() {
+		currentLookupTable.Store(buildLookupTable())
+		go refreshLookupTable()
+	})
+	return currentLookupTable.Load().(*lookupTable)
+}
+
+func refreshLookupTable() {
+	changes := topo.LocationChanges()
+	for {
+		time.Sleep(lookupTableInterval)
+		if c := topo.LocationChanges(); c != changes {
+			changes = c
+			currentLookupTable.Store(buildLookupTable())
+		}
+	}
+}
+
+func buildLookupTable() *lookupTable {
+	table := &lookupTable{responses: make(map[storage.VolumeId][]byte), ips: make(map[storage.VolumeId][]net.IP)}
+	resolved := make(map[string]net.IP)
+	for vid, dataNodes := range topo.VolumeLocations() {
+		ret := []map[string]string{}
+		seen := make(map[string]bool)
+		for _, dn := range dataNodes {
+			location := map[string]string{"url": dn.Url(), "publicUrl": dn.PublicUrl}
+			if dn.AdminPort != 0 {
+				location["adminUrl"] = dn.AdminUrl()
+			}
+			if dn.GrpcPort != 0 {
+				location["grpcUrl"] = dn.GrpcUrl()
+			}
+			ret = append(ret, location)
+			ip, ok := resolved[dn.Ip]
+			if !ok {
+				ip = resolveIP(dn.Ip)
+				resolved[dn.Ip] = ip
+			}
+			if ip != nil && !seen[ip.String()] {
+				seen[ip.String()] = true
+				table.ips[vid] = append(table.ips[vid], ip)
+			}
+		}
+		table.responses[vid], _ = json.Marshal(map[string]interface{}{"locations": ret})
+	}
+	return table
+}
+
+// resolveIP resolves the volume server -ip, which can also be a host name, to
+// its IPv4 address, or its IPv6 address if it has none.
+func resolveIP(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+		return ip
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return ips[0]
+}
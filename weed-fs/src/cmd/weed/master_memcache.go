@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"pkg/directory"
+	"strconv"
+	"strings"
+)
+
+// The volume id lookups are also served with the text protocol of memcache,
+// for clients needing lookups faster than over http:
+//
+//   get 3 7,01637037d6
+//   VALUE 3 0 63
+//   {"locations":[{"publicUrl":"localhost:8080","url":"localhost:8080"}]}
+//   VALUE 7,01637037d6 0 63
+//   ...
+//   END
+//
+// The values are the /dir/lookup responses, served from the lookup table.
+
+func serveMemcacheLookups(port int) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatalf("Fail to start memcache lookups:%s", err.Error())
+	}
+	log.Println("Serving volume lookups with the memcache protocol at port", port)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("memcache lookups accept error:", err)
+			continue
+		}
+		go handleMemcacheConn(conn)
+	}
+}
+
+func handleMemcacheConn(conn net.Conn) {
+	defer conn.Close()
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "get", "gets":
+			table := getLookupTable()
+			for _, key := range fields[1:] {
+				volumeId, err := directory.ParseVolumeId(key)
+				if err != nil {
+					continue
+				}
+				if value, ok := table.responses[volumeId]; ok {
+					writer.WriteString("VALUE " + key + " 0 " + strconv.Itoa(len(value)) + "\r\n")
+					writer.Write(value)
+					writer.WriteString("\r\n")
+				}
+			}
+			writer.WriteString("END\r\n")
+		case "version":
+			writer.WriteString("VERSION " + VERSION + "\r\n")
+		case "quit":
+			writer.Flush()
+			return
+		default:
+			writer.WriteString("ERROR\r\n")
+		}
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
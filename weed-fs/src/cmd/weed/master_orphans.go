@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"pkg/storage"
+)
+
+// volumeOrphansHandler lists the replicas of deleted volumes still reported by the
+// volume servers, e.g. by a server that was down when its collection was deleted.
+func volumeOrphansHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, r, map[string]interface{}{"Version": VERSION, "Orphans": topo.OrphanVolumes()})
+}
+
+// volumeOrphanAdoptHandler registers the orphan replicas of ?volume= back into their layout.
+func volumeOrphanAdoptHandler(w http.ResponseWriter, r *http.Request) {
+	volumeId, err := storage.NewVolumeId(r.FormValue("volume"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "volume " + r.FormValue("volume") + " is not a valid volume id"})
+		return
+	}
+	count, err := topo.AdoptOrphanVolume(volumeId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, map[string]interface{}{"volume": volumeId.String(), "adopted": count})
+}
+
+// volumeOrphanPurgeHandler removes the orphan replicas of ?volume= from their volume servers.
+func volumeOrphanPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	volumeId, err := storage.NewVolumeId(r.FormValue("volume"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "volume " + r.FormValue("volume") + " is not a valid volume id"})
+		return
+	}
+	result, err := topo.PurgeOrphanVolume(volumeId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if len(result.Errors) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	writeJson(w, r, result)
+}
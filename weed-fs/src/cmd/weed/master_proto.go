@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"pkg/util"
+	"strings"
+)
+
+// Protocol buffer encodings of the /dir/assign and /dir/lookup responses,
+// following pkg/operation/master.proto.
+
+// masterGrpcMethods are the methods of the Master service, served on -grpcPort.
+var masterGrpcMethods = map[string]http.HandlerFunc{
+	"/weedfs.Master/Assign": grpcMethod(map[int]string{1: "count", 2: "replication"}, dirAssignHandler),
+	"/weedfs.Master/Lookup": grpcMethod(map[int]string{1: "volumeId"}, dirLookupHandler),
+}
+
+func wantsProtobuf(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/x-protobuf")
+}
+
+func writeProtobuf(w http.ResponseWriter, b *util.ProtoBuffer) {
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(b.Bytes())
+}
+
+func writeAssignResponse(w http.ResponseWriter, r *http.Request, obj interface{}) {
+	if !wantsProtobuf(r) {
+		writeJson(w, r, obj)
+		return
+	}
+	b := new(util.ProtoBuffer)
+	switch m := obj.(type) {
+	case map[string]string:
+		b.EncodeString(5, m["error"])
+		if code := m["code"]; code != "" {
+			b.EncodeString(7, code)
+		}
+		if hint := m["hint"]; hint != "" {
+			b.EncodeString(8, hint)
+		}
+	case map[string]interface{}:
+		b.EncodeString(1, m["fid"].(string))
+		b.EncodeString(2, m["url"].(string))
+		b.EncodeString(3, m["publicUrl"].(string))
+		b.EncodeUint64(4, uint64(m["count"].(int)))
+		if auth, ok := m["auth"].(string); ok {
+			b.EncodeString(6, auth)
+		}
+	}
+	writeProtobuf(w, b)
+}
+
+func writeLookupResponse(w http.ResponseWriter, r *http.Request, obj interface{}) {
+	if !wantsProtobuf(r) {
+		writeJson(w, r, obj)
+		return
+	}
+	b := new(util.ProtoBuffer)
+	switch m := obj.(type) {
+	case map[string]string:
+		b.EncodeString(2, m["error"])
+	case map[string]interface{}:
+		for _, location := range m["locations"].([]map[string]string) {
+			l := new(util.ProtoBuffer)
+			l.EncodeString(1, location["url"])
+			l.EncodeString(2, location["publicUrl"])
+			if adminUrl := location["adminUrl"]; adminUrl != "" {
+				l.EncodeString(3, adminUrl)
+			}
+			l.EncodeString(4, location["grpcUrl"])
+			b.EncodeMessage(1, l)
+		}
+	}
+	writeProtobuf(w, b)
+}
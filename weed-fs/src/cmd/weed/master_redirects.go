@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"pkg/directory"
+)
+
+// fidRedirects keeps the old file ids of the volumes renumbered by weed merge resolving,
+// in /dir/lookup with a file id, and in /get/.
+var fidRedirects *directory.FidRedirects
+
+// redirectedFid returns the new file id of a redirected file id, or "" if it is not redirected.
+func redirectedFid(fid string) string {
+	fileId, err := directory.ParseFileId(fid)
+	if err != nil {
+		return ""
+	}
+	if to, ok := fidRedirects.Resolve(fileId); ok {
+		return to.String()
+	}
+	return ""
+}
+
+// dirRedirectsHandler adds the "old_fid new_fid" lines of the posted body to the redirects.
+func dirRedirectsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeJson(w, r, map[string]string{"error": "POST the \"old_fid new_fid\" lines"})
+		return
+	}
+	count, err := fidRedirects.Add(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, map[string]interface{}{"added": count})
+}
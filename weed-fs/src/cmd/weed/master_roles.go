@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"pkg/util"
+	"strings"
+)
+
+// With -roles, the master endpoints other than the client ones, i.e. assign,
+// lookup, join and get, need a role, given to tokens and client
+// certificates in a toml file, with a section per principal:
+//
+//   [monitoring]
+//   role = "monitor"
+//   token = "4f1c0d8e..."        # sent as Authorization: Bearer 4f1c0d8e...
+//
+//   [uploader]
+//   role = "monitor"
+//   token = "9a7e2b31..."
+//   sign = "read,write"          # may get signed urls for these ops from /dir/sign
+//
+//   [ops.example.com]
+//   role = "admin"
+//   certificate = "ops.example.com"   # common name of a client certificate on
+//                                     # -tlsPort, verified with -clientCaFile
+//
+// The token can also be the basic auth password, for the web UI. A monitor can
+// only read the status, an operator can also grow, seal, vacuum and drain, and
+// an admin can also delete collections and bump the file id sequence. Only the
+// principals listing the ops in sign, and the admins, get signed urls.
+
+type role int
+
+const (
+	roleNone role = iota
+	roleMonitor
+	roleOperator
+	roleAdmin
+)
+
+var roleNames = map[string]role{"monitor": roleMonitor, "operator": roleOperator, "admin": roleAdmin}
+
+type principal struct {
+	name        string
+	role        role
+	token       string
+	certificate string
+	sign        map[string]bool // ops of the signed urls it may get
+}
+
+var masterRoles []*principal // nil when -roles is not set, and everyone is allowed
+
+func loadRoles(fileName string) ([]*principal, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := util.ParseToml(data)
+	if err != nil {
+		return nil, errors.New(fileName + ": " + err.Error())
+	}
+	var principals []*principal
+	for name, keys := range sections {
+		if name == "" {
+			continue
+		}
+		p := &principal{name: name, role: roleNames[keys["role"]], token: keys["token"], certificate: keys["certificate"], sign: make(map[string]bool)}
+		if p.role == roleNone {
+			return nil, errors.New(fileName + ": [" + name + "] role should be monitor, operator or admin")
+		}
+		if p.token == "" && p.certificate == "" {
+			return nil, errors.New(fileName + ": [" + name + "] needs a token or a certificate")
+		}
+		for _, op := range strings.Split(keys["sign"], ",") {
+			switch op = strings.TrimSpace(op); op {
+			case "":
+			case util.SignedRead, util.SignedWrite, util.SignedDelete:
+				p.sign[op] = true
+			default:
+				return nil, errors.New(fileName + ": [" + name + "] sign should list read, write or delete")
+			}
+		}
+		principals = append(principals, p)
+	}
+	return principals, nil
+}
+
+// requestPrincipal finds the principal with the token or the verified
+// client certificate of the request, and the highest role if several match.
+func requestPrincipal(r *http.Request) *principal {
+	var tokens []string
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		tokens = append(tokens, strings.TrimSpace(auth[len("Bearer "):]))
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		tokens = append(tokens, password)
+	}
+	var commonNames []string
+	if r.TLS != nil {
+		for _, chain := range r.TLS.VerifiedChains {
+			commonNames = append(commonNames, chain[0].Subject.CommonName)
+		}
+	}
+	var found *principal
+	for _, p := range masterRoles {
+		matched := false
+		for _, token := range tokens {
+			if p.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) == 1 {
+				matched = true
+			}
+		}
+		for _, commonName := range commonNames {
+			if p.certificate != "" && commonName == p.certificate {
+				matched = true
+			}
+		}
+		if matched && (found == nil || p.role > found.role) {
+			found = p
+		}
+	}
+	return found
+}
+
+// requireRole only lets the requests of principals with at least the role
+// through, when -roles is set.
+func requireRole(min role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if masterRoles == nil {
+			h(w, r)
+			return
+		}
+		p := requestPrincipal(r)
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="weed master"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			writeJson(w, r, map[string]string{"error": "A token or a client certificate is required"})
+			return
+		}
+		if p.role < min {
+			w.WriteHeader(http.StatusForbidden)
+			writeJson(w, r, map[string]string{"error": p.name + " is not allowed to " + r.URL.Path})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// maySign tells if the request may get urls signed for op: with -roles, for the
+// principals with op in their sign key and the admins, else for the requests
+// sending the -secureKey itself as "Authorization: Bearer <secureKey>".
+func maySign(r *http.Request, op string) bool {
+	if masterRoles != nil {
+		p := requestPrincipal(r)
+		return p != nil && (p.role == roleAdmin || p.sign[op])
+	}
+	auth := r.Header.Get("Authorization")
+	return *mSecureKey != "" && strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[len("Bearer "):])), []byte(*mSecureKey)) == 1
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"pkg/util"
+	"testing"
+)
+
+const testRoles = `
+[monitoring]
+role = "monitor"
+token = "monitor-token"
+
+[uploader]
+role = "monitor"
+token = "uploader-token"
+sign = "read,write"
+
+[operations]
+role = "operator"
+token = "operator-token"
+
+[ops.example.com]
+role = "admin"
+certificate = "ops.example.com"
+`
+
+func withRoles(t *testing.T, roles string) func() {
+	dir, err := ioutil.TempDir("", "weedfs_roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := path.Join(dir, "roles.toml")
+	ioutil.WriteFile(fileName, []byte(roles), 0644)
+	principals, err := loadRoles(fileName)
+	os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterRoles = principals
+	return func() { masterRoles = nil }
+}
+
+func withBearer(token string) *http.Request {
+	r := httptest.NewRequest("GET", "/vol/status", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func withCertificate(commonName string) *http.Request {
+	r := httptest.NewRequest("GET", "/vol/status", nil)
+	certificate := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+	return r
+}
+
+func TestLoadRolesRejectsInvalidPrincipals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weedfs_roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, roles := range []string{
+		"[a]\nrole = \"root\"\ntoken = \"t\"\n",
+		"[a]\nrole = \"admin\"\n",
+		"[a]\nrole = \"monitor\"\ntoken = \"t\"\nsign = \"read,erase\"\n",
+	} {
+		fileName := path.Join(dir, "roles.toml")
+		ioutil.WriteFile(fileName, []byte(roles), 0644)
+		if _, err := loadRoles(fileName); err == nil {
+			t.Errorf("loaded the invalid roles %q", roles)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	serve := func(min role, r *http.Request) int {
+		w := httptest.NewRecorder()
+		requireRole(min, handler)(w, r)
+		return w.Code
+	}
+	if code := serve(roleAdmin, httptest.NewRequest("GET", "/vol/status", nil)); code != http.StatusOK {
+		t.Error("without -roles, got", code)
+	}
+	defer withRoles(t, testRoles)()
+
+	basicAuth := httptest.NewRequest("GET", "/vol/status", nil)
+	basicAuth.SetBasicAuth("anyone", "operator-token")
+	for _, c := range []struct {
+		min      role
+		r        *http.Request
+		expected int
+	}{
+		{roleMonitor, httptest.NewRequest("GET", "/vol/status", nil), http.StatusUnauthorized},
+		{roleMonitor, withBearer("wrong-token"), http.StatusUnauthorized},
+		{roleMonitor, withBearer("monitor-token"), http.StatusOK},
+		{roleOperator, withBearer("monitor-token"), http.StatusForbidden},
+		{roleOperator, withBearer("operator-token"), http.StatusOK},
+		{roleOperator, basicAuth, http.StatusOK},
+		{roleAdmin, withBearer("operator-token"), http.StatusForbidden},
+		{roleAdmin, withCertificate("ops.example.com"), http.StatusOK},
+		{roleMonitor, withCertificate("other.example.com"), http.StatusUnauthorized},
+	} {
+		if code := serve(c.min, c.r); code != c.expected {
+			t.Error("role", c.min, "with", c.r.Header, "got", code, "expected", c.expected)
+		}
+	}
+}
+
+func TestMaySign(t *testing.T) {
+	defer func(key string) { *mSecureKey = key }(*mSecureKey)
+	*mSecureKey = "secret"
+	if !maySign(withBearer("secret"), util.SignedDelete) {
+		t.Error("without -roles, the secure key should sign")
+	}
+	if maySign(withBearer("other"), util.SignedRead) || maySign(httptest.NewRequest("GET", "/dir/sign", nil), util.SignedRead) {
+		t.Error("without -roles, only the secure key should sign")
+	}
+
+	defer withRoles(t, testRoles)()
+	for _, c := range []struct {
+		r        *http.Request
+		op       string
+		expected bool
+	}{
+		{withBearer("uploader-token"), util.SignedWrite, true},
+		{withBearer("uploader-token"), util.SignedDelete, false},
+		{withBearer("operator-token"), util.SignedRead, false},
+		{withCertificate("ops.example.com"), util.SignedDelete, true},
+		{withBearer("secret"), util.SignedRead, false},
+	} {
+		if signs := maySign(c.r, c.op); signs != c.expected {
+			t.Error(c.r.Header, "signing", c.op, "got", signs, "expected", c.expected)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"pkg/topology"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The manifests of the snapshots are kept in the snapshots folder of -mdir,
+// one <name>.json each, for weed backup -snapshot to read back.
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+func snapshotManifestPath(name string) string {
+	return path.Join(*metaFolder, "snapshots", name+".json")
+}
+
+func loadSnapshotManifest(name string) (*topology.Snapshot, error) {
+	if !snapshotNamePattern.MatchString(name) {
+		return nil, errors.New("Snapshot name " + name + " should only have letters, digits, '_', '-' and '.'")
+	}
+	data, err := ioutil.ReadFile(snapshotManifestPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("Snapshot " + name + " is not found")
+		}
+		return nil, err
+	}
+	s := new(topology.Snapshot)
+	return s, json.Unmarshal(data, s)
+}
+
+// volumeSnapshotHandler takes a snapshot of all the volumes, named ?name= or
+// after the time, pinned for ?ttl= seconds, 1 hour by default, and saves its manifest.
+func volumeSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		name = time.Now().UTC().Format("20060102T150405")
+	}
+	ttl := 3600
+	if r.FormValue("ttl") != "" {
+		var err error
+		if ttl, err = strconv.Atoi(r.FormValue("ttl")); err != nil || ttl <= 0 {
+			w.WriteHeader(http.StatusNotAcceptable)
+			writeJson(w, r, map[string]string{"error": "ttl " + r.FormValue("ttl") + " should be a positive number of seconds"})
+			return
+		}
+	}
+	if !snapshotNamePattern.MatchString(name) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "Snapshot name " + name + " should only have letters, digits, '_', '-' and '.'"})
+		return
+	}
+	if _, err := os.Stat(snapshotManifestPath(name)); err == nil {
+		w.WriteHeader(http.StatusConflict)
+		writeJson(w, r, map[string]string{"error": "Snapshot " + name + " already exists"})
+		return
+	}
+	s, err := topo.Snapshot(name, time.Duration(ttl)*time.Second)
+	if err == nil {
+		sort.Slice(s.Volumes, func(i, j int) bool { return s.Volumes[i].Id < s.Volumes[j].Id })
+		var data []byte
+		if data, err = json.MarshalIndent(s, "", "  "); err == nil {
+			if err = os.MkdirAll(path.Dir(snapshotManifestPath(name)), 0755); err == nil {
+				err = ioutil.WriteFile(snapshotManifestPath(name), data, 0644)
+			}
+		}
+		if err != nil {
+			topo.ReleaseSnapshot(s)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, s)
+}
+
+// volumeSnapshotManifestHandler returns the manifest of ?name=, or the names of all the snapshots.
+func volumeSnapshotManifestHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		names := []string{}
+		files, _ := ioutil.ReadDir(path.Join(*metaFolder, "snapshots"))
+		for _, f := range files {
+			if strings.HasSuffix(f.Name(), ".json") {
+				names = append(names, strings.TrimSuffix(f.Name(), ".json"))
+			}
+		}
+		writeJson(w, r, map[string]interface{}{"snapshots": names})
+		return
+	}
+	s, err := loadSnapshotManifest(name)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, s)
+}
+
+// volumeSnapshotReleaseHandler unpins the volumes of the snapshot ?name=,
+// once backed up. The manifest is kept.
+func volumeSnapshotReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := loadSnapshotManifest(r.FormValue("name"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if err = topo.ReleaseSnapshot(s); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, map[string]string{"name": s.Name, "released": strconv.Itoa(len(s.Volumes)) + " volumes"})
+}
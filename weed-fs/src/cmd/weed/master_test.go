@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"pkg/topology"
+	"pkg/util"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinRegistersTheAdminPort(t *testing.T) {
+	previous := topo
+	defer func() { topo = previous }()
+	defer func(latency *util.LatencyStats) { masterLatency = latency }(masterLatency)
+	topo = topology.NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	masterLatency = util.NewLatencyStats(nil)
+
+	lookup := func() map[string]string {
+		w := httptest.NewRecorder()
+		dirLookupHandler(w, httptest.NewRequest("GET", "/dir/lookup?volumeId=3", nil))
+		var reply struct{ Locations []map[string]string }
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || len(reply.Locations) != 1 {
+			t.Fatal("lookup got", w.Code, w.Body.String())
+		}
+		return reply.Locations[0]
+	}
+	join := func(adminPort, grpcPort string) {
+		values := url.Values{"ip": {"127.0.0.1"}, "port": {"8080"}, "maxVolumeCount": {"7"},
+			"volumes": {`[{"Id":3,"RepType":"000","Version":2}]`}}
+		if adminPort != "" {
+			values.Set("adminPort", adminPort)
+		}
+		if grpcPort != "" {
+			values.Set("grpcPort", grpcPort)
+		}
+		r := httptest.NewRequest("POST", "/dir/join", strings.NewReader(values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		dirJoinHandler(w, r)
+		if w.Code != 200 {
+			t.Fatal("join got", w.Code, w.Body.String())
+		}
+	}
+
+	join("8081", "18080")
+	if location := lookup(); location["url"] != "127.0.0.1:8080" || location["adminUrl"] != "127.0.0.1:8081" || location["grpcUrl"] != "127.0.0.1:18080" {
+		t.Error("with -adminPort and -grpcPort, the lookup got", location)
+	}
+	join("", "")
+	if location := lookup(); location["url"] != "127.0.0.1:8080" || location["adminUrl"] != "" || location["grpcUrl"] != "" {
+		t.Error("without -adminPort and -grpcPort, the lookup got", location)
+	}
+}
+
+func TestVolumeReplicateStatusHandler(t *testing.T) {
+	previous := topo
+	defer func() { topo = previous }()
+	topo = topology.NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+
+	w := httptest.NewRecorder()
+	volumeReplicateStatusHandler(w, httptest.NewRequest("GET", "/vol/replicate/status", nil))
+	if w.Code != 404 {
+		t.Error("without -replicateDelaySeconds, got", w.Code, w.Body.String())
+	}
+	window, _ := topology.ParseDailyWindow("01:00-05:00")
+	topo.StartReplication(10*time.Minute, window, 1, 2, time.Hour)
+	w = httptest.NewRecorder()
+	volumeReplicateStatusHandler(w, httptest.NewRequest("GET", "/vol/replicate/status", nil))
+	var status struct {
+		DelaySeconds int
+		Window       string
+		Missing      []interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || w.Code != 200 {
+		t.Fatal("status got", w.Code, w.Body.String())
+	}
+	if status.DelaySeconds != 600 || status.Window != "01:00-05:00" || len(status.Missing) != 0 {
+		t.Error("unexpected status", w.Body.String())
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var masterUiTemplate = template.Must(template.New("master").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Weed File System Master</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 16px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.message { background: #ffe; padding: 8px; }
+</style>
+</head>
+<body>
+<h1>Weed File System Master {{.Version}}</h1>
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+<h2>Topology</h2>
+<p>{{.Topology.Free}} free of {{.Topology.Max}} volumes</p>
+<table>
+<tr><th>Data Center</th><th>Rack</th><th>Data Node</th><th>Volumes</th><th>Max</th><th>Free</th><th></th></tr>
+{{range $dc := .Topology.DataCenters}}{{range $rack := $dc.Racks}}{{range $dn := $rack.DataNodes}}
+<tr>
+<td>{{$dc.Id}}</td><td>{{$rack.Id}}</td>
+<td><a href="http://{{$dn.PublicUrl}}/ui/">{{$dn.Url}}</a>{{if $dn.Draining}} (draining){{end}}</td>
+<td>{{$dn.Volumes}}</td><td>{{$dn.Max}}</td><td>{{$dn.Free}}</td>
+<td>{{if $.AdminEnabled}}<form method="POST" action="/ui/action">
+<input type="hidden" name="node" value="{{$dn.Url}}">
+{{if $dn.Draining}}<button name="action" value="undrain">Undrain</button>{{else}}<button name="action" value="drain">Drain</button>{{end}}
+</form>{{end}}</td>
+</tr>
+{{end}}{{end}}{{end}}
+</table>
+<h2>Volume Layouts</h2>
+<table>
+<tr><th>Collection</th><th>Replication</th><th>Writable</th><th>Read Only</th></tr>
+{{range .Topology.layouts}}
+<tr><td>{{.collection}}</td><td>{{.replication}}</td><td>{{range .writables}}{{.}} {{end}}</td><td>{{range .readonly}}{{.}} {{end}}</td></tr>
+{{end}}
+</table>
+{{with .Capacity}}
+<h2>Capacity Forecast</h2>
+<table>
+<tr><th>Collection</th><th>Replication</th><th>Data Center</th><th>Used</th><th>Free</th><th>Per Day</th><th>Days Until Full</th></tr>
+{{range .Layouts}}{{template "projection" .}}{{end}}
+{{range .DataCenters}}{{template "projection" .}}{{end}}
+{{with .Cluster}}<tr><td colspan="3">cluster</td>{{template "projectionBytes" .}}</tr>{{end}}
+</table>
+{{end}}
+{{if .AdminEnabled}}
+<h2>Actions</h2>
+<form method="POST" action="/ui/action">
+Collection <input name="collection" size="10">
+Replication <input name="replication" value="{{.DefaultReplication}}" size="3">
+Disk Type <input name="diskType" size="4">
+Constraint <input name="constraint" size="16">
+Count <input name="count" value="1" size="3">
+<button name="action" value="grow">Grow Volumes</button>
+</form>
+<form method="POST" action="/ui/action">
+Garbage Threshold <input name="garbageThreshold" value="{{.GarbageThreshold}}" size="4">
+<button name="action" value="vacuum">Vacuum</button>
+</form>
+{{end}}
+<h2>Recent Events</h2>
+<table>
+{{range .Events}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Message}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+{{define "projection"}}<tr><td>{{.Collection}}</td><td>{{.Replication}}</td><td>{{.DataCenter}}</td>{{template "projectionBytes" .}}</tr>
+{{end}}
+{{define "projectionBytes"}}<td>{{.UsedBytes}}</td><td>{{.FreeBytes}}</td><td>{{.BytesPerDay}}</td>
+<td>{{if lt .DaysUntilFull 0.0}}-{{else}}{{printf "%.1f" .DaysUntilFull}}{{end}}</td>{{end}}
+`))
+
+func masterUiHandler(w http.ResponseWriter, r *http.Request) {
+	m := make(map[string]interface{})
+	m["Version"] = VERSION
+	m["Topology"] = topo.ToMap()
+	m["Events"] = topo.RecentEvents()
+	m["Capacity"] = topo.CapacityForecast()
+	m["AdminEnabled"] = *adminPassword != "" || masterRoles != nil
+	m["DefaultReplication"] = *defaultRepType
+	m["GarbageThreshold"] = *garbageThreshold
+	m["Message"] = r.FormValue("message")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := masterUiTemplate.Execute(w, m); err != nil {
+		debug("master ui error:", err)
+	}
+}
+
+// masterUiActionHandler runs the admin actions of the web UI, for the -adminUser,
+// or with -roles for the operators, checked before by requireRole.
+func masterUiActionHandler(w http.ResponseWriter, r *http.Request) {
+	if masterRoles == nil && *adminPassword == "" {
+		http.Error(w, "admin actions are disabled", http.StatusForbidden)
+		return
+	}
+	if user, password, ok := r.BasicAuth(); masterRoles == nil && (!ok || !isAdmin(user, password)) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="weed master"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSameOrigin(r) {
+		http.Error(w, "admin actions are only taken from the pages of the master", http.StatusForbidden)
+		return
+	}
+	var message string
+	switch r.FormValue("action") {
+	case "grow":
+		if count, err := growVolumes(r.FormValue("collection"), r.FormValue("replication"), r.FormValue("count"), r.FormValue("diskType"), r.FormValue("constraint")); err != nil {
+			message = "Failed to grow volumes: " + err.Error()
+		} else {
+			message = "Grew " + strconv.Itoa(count) + " volumes"
+		}
+	case "vacuum":
+		threshold, err := strconv.ParseFloat(r.FormValue("garbageThreshold"), 64)
+		if err != nil {
+			threshold = *garbageThreshold
+		}
+		message = "Queued " + strconv.Itoa(topo.Vacuum(threshold)) + " volumes to vacuum"
+	case "drain", "undrain":
+		dn := topo.FindDataNode(r.FormValue("node"))
+		if dn == nil {
+			message = "Data node " + r.FormValue("node") + " is not found"
+		} else if r.FormValue("action") == "drain" {
+			topo.Drain(dn)
+			message = "Draining " + dn.Url()
+		} else {
+			topo.Undrain(dn)
+			message = "Undrained " + dn.Url()
+		}
+	default:
+		message = "Unknown action " + r.FormValue("action")
+	}
+	http.Redirect(w, r, "/ui/?message="+url.QueryEscape(message), http.StatusSeeOther)
+}
+
+func isAdmin(user, password string) bool {
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(*adminUser)) == 1
+	passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(*adminPassword)) == 1
+	return userOk && passwordOk
+}
+
+// isSameOrigin tells if the request was sent from a page of the master itself,
+// by its Origin header, or its Referer without one. The browsers send the
+// credentials of the admin with the forms posted from other sites too.
+func isSameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(source)
+	return source != "" && err == nil && u.Host != "" && u.Host == r.Host
+}
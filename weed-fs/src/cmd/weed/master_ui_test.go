@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMasterUiActionChecksTheOrigin(t *testing.T) {
+	saved := *adminPassword
+	*adminPassword = "secret"
+	defer func() { *adminPassword = saved }()
+
+	for _, c := range []struct {
+		origin, referer string
+		password        string
+		status          int
+	}{
+		{"http://master:9333", "", "secret", http.StatusSeeOther},
+		{"", "http://master:9333/ui/", "secret", http.StatusSeeOther},
+		{"http://evil.example", "http://master:9333/ui/", "secret", http.StatusForbidden},
+		{"null", "", "secret", http.StatusForbidden},
+		{"", "", "secret", http.StatusForbidden},
+		{"http://master:9333", "", "wrong", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("POST", "http://master:9333/ui/action", strings.NewReader(url.Values{"action": {"none"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(*adminUser, c.password)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.referer != "" {
+			r.Header.Set("Referer", c.referer)
+		}
+		w := httptest.NewRecorder()
+		masterUiActionHandler(w, r)
+		if w.Code != c.status {
+			t.Errorf("origin %q referer %q password %q: status %d, expecting %d", c.origin, c.referer, c.password, w.Code, c.status)
+		}
+	}
+}
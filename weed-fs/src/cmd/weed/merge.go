@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"pkg/directory"
+	"pkg/operation"
+	"pkg/storage"
+	"pkg/topology"
+	"pkg/util"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	cmdMerge.Run = runMerge // break init cycle
+	IsDebug = cmdMerge.Flag.Bool("debug", false, "enable debug mode")
+}
+
+var cmdMerge = &Command{
+	UsageLine: "merge -sourceMaster=old:9333 -master=localhost:9333 -table=fids.txt [-dryRun]",
+	Short:     "copy the volumes of another cluster into this cluster",
+	Long: `Merge absorbs the volumes of a source cluster into a destination cluster.
+  Each volume of the source is created on the destination with /vol/grow?volume=N,
+  with its collection and replication type, and its live files are copied into it,
+  keeping their keys and cookies, so a file keeps its file id.
+
+  A source volume whose id is already used on the destination is renumbered to
+  the next free id, within the -volumeIdPartition of the destination master if it
+  has one. The files of the renumbered volumes change their file ids, and the
+  -table file lists them as "old_fid new_fid" lines, so that the clients can map
+  their old file ids to the new ones. The file ids not in the table are unchanged.
+  The lines are also posted to /dir/redirects of the destination master, unless
+  -redirect=false, so the old file ids keep resolving in /dir/lookup and /get/.
+
+  Stop the writes to the source cluster first, e.g. by sealing its volumes with
+  /vol/seal, as the files written during the copy may be missed. With -dryRun,
+  merge only prints which volumes would be copied and renumbered.
+
+  `,
+}
+
+var (
+	mergeSourceMaster = cmdMerge.Flag.String("sourceMaster", "", "master of the cluster to absorb")
+	mergeMaster       = cmdMerge.Flag.String("master", "localhost:9333", "master of the cluster to copy the volumes into")
+	mergeTable        = cmdMerge.Flag.String("table", "merge_fids.txt", "file to write the file id translation table to")
+	mergeCollection   = cmdMerge.Flag.String("collection", "", "only copy the volumes of this collection. Empty copies all of them")
+	mergeSecureKey    = cmdMerge.Flag.String("secureKey", "", "secret of the volume servers, to sign the writes, and the exports of the collections with signed reads")
+	mergeDryRun       = cmdMerge.Flag.Bool("dryRun", false, "only print the volumes that would be copied and renumbered")
+	mergeRedirect     = cmdMerge.Flag.Bool("redirect", true, "register the renumbered file ids on the destination master, so the old ones keep resolving")
+)
+
+// mergeVolume is a volume of the source cluster, and the id it gets on the destination.
+type mergeVolume struct {
+	Id         storage.VolumeId
+	Collection string
+	RepType    storage.ReplicationType
+	Url        string // a volume server of the source with a replica of it
+	NewId      storage.VolumeId
+}
+
+func runMerge(cmd *Command, args []string) bool {
+	if *mergeSourceMaster == "" {
+		return false
+	}
+	sources, err := listClusterVolumes(*mergeSourceMaster)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can not list the volumes of", *mergeSourceMaster, ":", err)
+		setExitStatus(1)
+		return true
+	}
+	destinations, err := listClusterVolumes(*mergeMaster)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can not list the volumes of", *mergeMaster, ":", err)
+		setExitStatus(1)
+		return true
+	}
+	var status struct{ VolumeIdPartition string }
+	if err = getJson("http://"+*mergeMaster+"/dir/status", &status); err != nil {
+		fmt.Fprintln(os.Stderr, "Can not read the status of", *mergeMaster, ":", err)
+		setExitStatus(1)
+		return true
+	}
+	partition, err := topology.ParseVolumeIdPartition(status.VolumeIdPartition)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		setExitStatus(1)
+		return true
+	}
+	var volumes []*mergeVolume
+	for _, v := range sources {
+		if *mergeCollection == "" || v.Collection == *mergeCollection {
+			volumes = append(volumes, v)
+		}
+	}
+	if err = planVolumeIds(volumes, sources, destinations, partition); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		setExitStatus(1)
+		return true
+	}
+	for _, v := range volumes {
+		if v.NewId != v.Id {
+			fmt.Println("volume", v.Id, "of", v.Url, "=> volume", v.NewId, "collection", v.Collection, "replication", v.RepType)
+		} else {
+			fmt.Println("volume", v.Id, "of", v.Url, "collection", v.Collection, "replication", v.RepType)
+		}
+	}
+	if *mergeDryRun {
+		return true
+	}
+
+	tableFile, err := os.Create(*mergeTable)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		setExitStatus(1)
+		return true
+	}
+	defer tableFile.Close()
+	table := bufio.NewWriter(tableFile)
+	defer table.Flush()
+	var copied, failed int
+	for _, v := range volumes {
+		var redirects bytes.Buffer
+		count, err := copyMergedVolume(v, io.MultiWriter(table, &redirects))
+		copied += count
+		if *mergeRedirect && redirects.Len() > 0 {
+			if redirectErr := postRedirects(&redirects); redirectErr != nil {
+				fmt.Fprintln(os.Stderr, "Registering the renumbered file ids of volume", v.Id, "failed:", redirectErr)
+				if err == nil {
+					err = redirectErr
+				}
+			}
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintln(os.Stderr, "Merging volume", v.Id, "failed after", count, "files:", err)
+			continue
+		}
+		fmt.Println("Merged volume", v.Id, "as volume", v.NewId, "with", count, "files")
+	}
+	fmt.Println("Merged", len(volumes)-failed, "volumes of", *mergeSourceMaster, "into", *mergeMaster+",", copied, "files copied,", failed, "volumes failed")
+	if failed > 0 {
+		setExitStatus(1)
+	}
+	return true
+}
+
+// listClusterVolumes lists the volumes of a cluster by id, from the /vol/status of its master.
+func listClusterVolumes(master string) (map[storage.VolumeId]*mergeVolume, error) {
+	var status struct {
+		Volumes struct {
+			DataCenters map[string]map[string]map[string][]storage.VolumeInfo
+			AdminUrls   map[string]string
+		}
+	}
+	if err := getJson("http://"+master+"/vol/status", &status); err != nil {
+		return nil, err
+	}
+	volumes := make(map[storage.VolumeId]*mergeVolume)
+	for _, racks := range status.Volumes.DataCenters {
+		for _, nodes := range racks {
+			for node, infos := range nodes {
+				for _, info := range infos {
+					if _, ok := volumes[info.Id]; !ok {
+						volumes[info.Id] = &mergeVolume{Id: info.Id, Collection: info.Collection, RepType: info.RepType, Url: adminUrl(status.Volumes.AdminUrls, node)}
+					}
+				}
+			}
+		}
+	}
+	return volumes, nil
+}
+
+// planVolumeIds keeps the ids of the volumes free on the destination, and gives
+// the others the next ids of the partition not used by either cluster.
+func planVolumeIds(volumes []*mergeVolume, sources, destinations map[storage.VolumeId]*mergeVolume, partition *topology.VolumeIdPartition) error {
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Id < volumes[j].Id })
+	var highest storage.VolumeId
+	for _, used := range []map[storage.VolumeId]*mergeVolume{sources, destinations} {
+		for vid := range used {
+			if vid > highest && partition.Contains(vid) {
+				highest = vid
+			}
+		}
+	}
+	for _, v := range volumes {
+		if _, taken := destinations[v.Id]; !taken {
+			v.NewId = v.Id
+			continue
+		}
+		next, err := partition.Next(highest)
+		if err != nil {
+			return err
+		}
+		v.NewId, highest = next, next
+	}
+	return nil
+}
+
+// copyMergedVolume creates the volume on the destination, and copies the live
+// files of the source volume into it, from the /admin/export of the source.
+func copyMergedVolume(v *mergeVolume, table io.Writer) (int, error) {
+	values := url.Values{"volume": {v.NewId.String()}, "collection": {v.Collection}, "replication": {string(v.RepType)}}
+	var grow struct{ Error string }
+	if err := getJson("http://"+*mergeMaster+"/vol/grow?"+values.Encode(), &grow); err != nil {
+		return 0, err
+	}
+	if grow.Error != "" {
+		return 0, errors.New(grow.Error)
+	}
+	lookupResult, err := operation.Lookup(*mergeMaster, v.NewId)
+	if err != nil {
+		return 0, err
+	}
+	if len(lookupResult.Locations) == 0 {
+		return 0, errors.New("Volume " + v.NewId.String() + " not found on " + *mergeMaster)
+	}
+	destination := lookupResult.Locations[0].Url
+
+	resp, err := http.Get("http://" + v.Url + "/admin/export?" + signedDumpQuery(*mergeSecureKey, url.Values{"volume": {v.Id.String()}}))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New("Export of volume " + v.Id.String() + " from " + v.Url + ": " + resp.Status)
+	}
+	count := 0
+	tr := tar.NewReader(resp.Body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		fid := header.Name
+		newFid := v.NewId.String() + fid[strings.Index(fid, ","):]
+		var pairs map[string]string
+		if pairsJson, ok := header.PAXRecords["WEEDFS.pairs"]; ok {
+			json.Unmarshal([]byte(pairsJson), &pairs)
+		}
+		// uploaded without an extension, the content is stored as exported, gzipped or not
+		uploadUrl := directory.FileUrl(destination, newFid, "") + "?ts=" + strconv.FormatInt(header.ModTime.Unix(), 10)
+		if *mergeSecureKey != "" {
+			uploadUrl += "&" + util.SignFileId(*mergeSecureKey, util.SignedWriteAt, newFid, time.Now().Unix()+defaultSignedUrlSeconds)
+		}
+		if _, err = operation.Upload(uploadUrl, newFid, tr, pairs); err != nil {
+			return count, errors.New(fid + ": " + err.Error())
+		}
+		if newFid != fid {
+			io.WriteString(table, fid+" "+newFid+"\n")
+		}
+		count++
+	}
+}
+
+// postRedirects adds the "old_fid new_fid" lines to the redirects of the destination master.
+func postRedirects(lines io.Reader) error {
+	resp, err := http.Post("http://"+*mergeMaster+"/dir/redirects", "text/plain", lines)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var ret struct{ Error string }
+	if err = json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	return nil
+}
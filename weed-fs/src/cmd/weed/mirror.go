@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"pkg/directory"
+	"pkg/notification"
+	"pkg/operation"
+	"pkg/storage"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	cmdMirror.Run = runMirror // break init cycle
+	IsDebug = cmdMirror.Flag.Bool("debug", false, "enable debug mode")
+}
+
+var cmdMirror = &Command{
+	UsageLine: "mirror -source=redis://localhost:6379/weed-events -sourceMaster=site1:9333 -master=site2:9333",
+	Short:     "replay the writes and deletes of a cluster on another cluster, for disaster recovery",
+	Long: `Mirror tails the change stream of a source cluster, the redis stream its
+  volume servers and filer publish their file events to with
+  -notify=redis://host:6379/stream, and replays the events on a destination
+  cluster, in order, reading the files from the source cluster.
+
+  The writes and deletes taken by the source volume servers are replayed on
+  the -master of the destination: a new file gets a file id assigned there,
+  in the collection renamed by -collections, and the source file id is mapped
+  to it, so that its updates and deletes go to the same destination file. The
+  events of the source filer are replayed on the destination -filer by path,
+  so run with -master or -filer, or both if the files written through the
+  filer are not needed by file id on the destination.
+
+  The id of the last replayed entry of the stream is saved in -dir after each
+  batch, with the file id map, and the mirror resumes after it when restarted.
+  The stream should be kept long enough for the mirror to be restarted, with
+  maxlen on the -notify url. An event failing -retries times is skipped.
+
+  GET /stats on -port reports the events replayed, skipped and failed, and
+  the lag: the age of the last replayed entry while the mirror is behind, 0
+  once it caught up.
+
+  The source volume servers and filer drop the events they can not publish,
+  when the message queue is down or too slow. Their events are numbered, and
+  the mirror logs each gap, counts the events lost in /stats, which then
+  answers 500, so monitoring sees the destination is missing writes; the
+  files written meanwhile should be copied again, e.g. with weed sync. A gap
+  across a restart of the mirror is not seen.
+
+  `,
+}
+
+var (
+	mirrorSource          = cmdMirror.Flag.String("source", "", "redis stream the source cluster publishes its file events to, e.g. redis://localhost:6379/weed-events")
+	mirrorSourceMaster    = cmdMirror.Flag.String("sourceMaster", "localhost:9333", "master of the source cluster, to read the files from")
+	mirrorSourceSecureKey = cmdMirror.Flag.String("sourceSecureKey", "", "secret of the source volume servers, to sign the reads of collections with signed reads")
+	mirrorMaster          = cmdMirror.Flag.String("master", "", "master of the destination cluster, to replay the events of the source volume servers on. Empty skips them")
+	mirrorFiler           = cmdMirror.Flag.String("filer", "", "filer of the destination cluster, to replay the events of the source filer on. Empty skips them")
+	mirrorSecureKey       = cmdMirror.Flag.String("secureKey", "", "secret of the destination volume servers, to sign the overwrites and deletes")
+	mirrorCollections     = cmdMirror.Flag.String("collections", "", "collections renamed on the destination, e.g. photos:photos-dr,docs:archive")
+	mirrorReplication     = cmdMirror.Flag.String("replication", "", "replication of the files on the destination. Empty is the default of the destination master")
+	mirrorDir             = cmdMirror.Flag.String("dir", ".", "directory of the checkpoint and of the file id map")
+	mirrorPort            = cmdMirror.Flag.Int("port", 9334, "http port for /stats. 0 disables it")
+	mirrorBatch           = cmdMirror.Flag.Int("batch", 100, "stream entries read at a time, the checkpoint is saved after each batch")
+	mirrorRetries         = cmdMirror.Flag.Int("retries", 10, "attempts to replay an event before skipping it")
+)
+
+// mirror replays the events of the stream, and keeps the stats of the replay.
+type mirror struct {
+	collections map[string]string
+	fids        *fidMap
+
+	lock                           sync.Mutex
+	applied, skipped, failed, lost uint64
+	lastSeq                        map[string]uint64 // the number of the last event of each origin
+	checkpoint                     string
+	lastEntryTime                  time.Time
+	caughtUp                       bool
+}
+
+func runMirror(cmd *Command, args []string) bool {
+	if *mirrorSource == "" || (*mirrorMaster == "" && *mirrorFiler == "") {
+		return false
+	}
+	reader, err := notification.NewStreamReader(*mirrorSource)
+	if err != nil {
+		log.Fatalf("-source: %s", err)
+	}
+	collections, err := parseCollectionMapping(*mirrorCollections)
+	if err != nil {
+		log.Fatalf("-collections: %s", err)
+	}
+	fids, err := openFidMap(filepath.Join(*mirrorDir, "mirror.fids"))
+	if err != nil {
+		log.Fatalf("Can not open the file id map: %s", err)
+	}
+	checkpointFile := filepath.Join(*mirrorDir, "mirror.checkpoint")
+	checkpoint := "0"
+	if data, err := ioutil.ReadFile(checkpointFile); err == nil {
+		checkpoint = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Can not read the checkpoint: %s", err)
+	}
+	m := &mirror{collections: collections, fids: fids, checkpoint: checkpoint, lastSeq: make(map[string]uint64)}
+
+	if *mirrorPort != 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+			stats := m.ToMap()
+			if stats["Lost"].(uint64) > 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			writeJson(w, r, stats)
+		})
+		go func() {
+			log.Fatal(http.ListenAndServe(":"+strconv.Itoa(*mirrorPort), mux))
+		}()
+	}
+
+	log.Println("Mirroring", *mirrorSource, "after", checkpoint)
+	for {
+		entries, err := reader.Read(checkpoint, *mirrorBatch, 5*time.Second)
+		if err != nil {
+			log.Println("Can not read", *mirrorSource, ":", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		m.lock.Lock()
+		m.caughtUp = len(entries) == 0
+		m.lock.Unlock()
+		if len(entries) == 0 {
+			continue
+		}
+		for _, entry := range entries {
+			m.replay(entry)
+			checkpoint = entry.Id
+		}
+		if err = writeFileAtomically(checkpointFile, []byte(checkpoint+"\n")); err != nil {
+			log.Println("Can not save the checkpoint:", err)
+		}
+	}
+}
+
+// replay applies the event of the entry, retrying with a growing wait.
+func (m *mirror) replay(entry *notification.StreamEntry) {
+	e := entry.Event
+	m.checkSeq(entry)
+	var applied bool
+	var err error
+	for attempt := 1; attempt <= *mirrorRetries; attempt++ {
+		if applied, err = m.apply(e); err == nil {
+			break
+		}
+		debug("replay of", e.Type, e.Fid, e.Path, "failed:", err)
+		if attempt < *mirrorRetries {
+			wait := time.Duration(attempt) * time.Second
+			if wait > time.Minute {
+				wait = time.Minute
+			}
+			time.Sleep(wait)
+		}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	switch {
+	case err != nil:
+		m.failed++
+		log.Println("Skipping", e.Type, "of", e.Fid, e.Path, "at", entry.Id, ":", err)
+	case applied:
+		m.applied++
+	default:
+		m.skipped++
+	}
+	m.checkpoint, m.lastEntryTime = entry.Id, notification.EntryTime(entry.Id)
+}
+
+// checkSeq counts the events the source dropped before publishing the one of the
+// entry, i.e. the writes and deletes the destination misses, from the gaps in
+// the numbers of the events of its origin.
+func (m *mirror) checkSeq(entry *notification.StreamEntry) {
+	e := entry.Event
+	if e.Origin == "" {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	last, seen := m.lastSeq[e.Origin]
+	if e.Seq <= last {
+		return
+	}
+	if seen && e.Seq > last+1 {
+		m.lost += e.Seq - last - 1
+		log.Println("Lost", e.Seq-last-1, "events of", e.Origin, "before", entry.Id+": the source dropped them, and the destination misses their writes and deletes")
+	}
+	m.lastSeq[e.Origin] = e.Seq
+}
+
+// apply replays the event on the destination. It returns false for the events
+// not mirrored, and for the files gone from the source since.
+func (m *mirror) apply(e *notification.Event) (bool, error) {
+	switch {
+	case e.Source == "volume" && *mirrorMaster != "":
+		return m.applyVolumeEvent(e)
+	case e.Source == "filer" && *mirrorFiler != "":
+		return applyFilerEvent(e)
+	}
+	return false, nil
+}
+
+func (m *mirror) applyVolumeEvent(e *notification.Event) (bool, error) {
+	dstFid, mapped := m.fids.get(e.Fid)
+	switch e.Type {
+	case notification.Create, notification.Update:
+		// read and written without an extension, the content is copied as stored, gzipped or not
+		file, err := fetchSourceFile(e.Fid, "")
+		if file == nil || err != nil {
+			return false, err
+		}
+		var uploadUrl, auth string
+		if mapped {
+			location, err := lookupMirrorFid(dstFid)
+			if err != nil {
+				return false, err
+			}
+			uploadUrl, auth = directory.FileUrl(location, dstFid, ""), mirrorAuth(util.SignedWriteAt, dstFid)
+		} else {
+			collection, ok := m.collections[e.Collection]
+			if !ok {
+				collection = e.Collection
+			}
+			assignResult, err := operation.Assign(*mirrorMaster, 1, collection, *mirrorReplication)
+			if err != nil {
+				return false, err
+			}
+			dstFid, uploadUrl, auth = assignResult.Fid, directory.FileUrl(assignResult.Url, assignResult.Fid, ""), assignResult.Auth
+		}
+		uploadUrl += "?ts=" + strconv.FormatInt(file.lastModified, 10)
+		if *mirrorSecureKey != "" {
+			// signed by the mirror, the write keeps the time of the source
+			auth = mirrorAuth(util.SignedWriteAt, dstFid)
+		}
+		if auth != "" {
+			uploadUrl += "&" + auth
+		}
+		if _, err = operation.Upload(uploadUrl, dstFid, bytes.NewReader(file.data), file.pairs); err != nil {
+			return false, err
+		}
+		if !mapped {
+			return true, m.fids.set(e.Fid, dstFid)
+		}
+	case notification.Delete:
+		if !mapped {
+			return false, nil
+		}
+		location, err := lookupMirrorFid(dstFid)
+		if err != nil {
+			return false, err
+		}
+		deleteUrl := directory.FileUrl(location, dstFid, "")
+		if auth := mirrorAuth(util.SignedDelete, dstFid); auth != "" {
+			deleteUrl += "?" + auth
+		}
+		if err = operation.Delete(deleteUrl); err != nil {
+			return false, err
+		}
+		return true, m.fids.remove(e.Fid)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func applyFilerEvent(e *notification.Event) (bool, error) {
+	filerUrl := "http://" + *mirrorFiler + escapePath(e.Path)
+	switch e.Type {
+	case notification.Create, notification.Update:
+		file, err := fetchSourceFile(e.Fid, path.Ext(e.Path))
+		if file == nil || err != nil {
+			return false, err
+		}
+		_, err = operation.Upload(filerUrl+"?ts="+strconv.FormatInt(file.lastModified, 10), path.Base(e.Path), bytes.NewReader(file.data), file.pairs)
+		return err == nil, err
+	case notification.Delete:
+		return true, operation.Delete(filerUrl)
+	case notification.Move:
+		resp, err := http.Post(filerUrl+"?mv.from="+escapePath(e.OldPath), "", nil)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		if resp.StatusCode/100 != 2 {
+			message, _ := ioutil.ReadAll(resp.Body)
+			return false, errors.New("Move failed: " + string(message))
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// sourceFile is the content of a file on the source cluster, as uploaded.
+type sourceFile struct {
+	data         []byte
+	pairs        map[string]string
+	lastModified int64
+}
+
+// fetchSourceFile reads the file from the source cluster, with the extension of
+// its name for the mime type, or returns nil if it is gone from the source.
+func fetchSourceFile(fid, ext string) (*sourceFile, error) {
+	volumeId, err := directory.ParseVolumeId(fid)
+	if err != nil {
+		return nil, errors.New("Invalid fid " + fid)
+	}
+	lookupResult, err := operation.Lookup(*mirrorSourceMaster, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	if len(lookupResult.Locations) == 0 {
+		return nil, nil
+	}
+	fileUrl := directory.FileUrl(lookupResult.Locations[0].Url, fid, ext)
+	if *mirrorSourceSecureKey != "" {
+		fileUrl += "?" + util.SignFileId(*mirrorSourceSecureKey, util.SignedRead, fid, time.Now().Unix()+defaultSignedUrlSeconds)
+	}
+	req, err := http.NewRequest("GET", fileUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the content un-gzipped, as it is uploaded again
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Reading " + fileUrl + ": " + resp.Status)
+	}
+	file := &sourceFile{pairs: make(map[string]string), lastModified: time.Now().Unix()}
+	if file.data, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, err
+	}
+	for name := range resp.Header {
+		if strings.HasPrefix(name, storage.PairNamePrefix) {
+			file.pairs[name[len(storage.PairNamePrefix):]] = resp.Header.Get(name)
+		}
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		file.lastModified = lastModified.Unix()
+	}
+	return file, nil
+}
+
+func lookupMirrorFid(fid string) (string, error) {
+	volumeId, err := directory.ParseVolumeId(fid)
+	if err != nil {
+		return "", errors.New("Invalid fid " + fid)
+	}
+	lookupResult, err := operation.Lookup(*mirrorMaster, volumeId)
+	if err != nil {
+		return "", err
+	}
+	if len(lookupResult.Locations) == 0 {
+		return "", errors.New("Volume " + volumeId.String() + " not found on " + *mirrorMaster)
+	}
+	return lookupResult.Locations[0].Url, nil
+}
+
+// mirrorAuth signs the url to the file id on the destination, if -secureKey is set.
+func mirrorAuth(op string, fid string) string {
+	if *mirrorSecureKey == "" {
+		return ""
+	}
+	return util.SignFileId(*mirrorSecureKey, op, fid, time.Now().Unix()+defaultSignedUrlSeconds)
+}
+
+func (m *mirror) ToMap() map[string]interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	lag := 0.0
+	if !m.caughtUp && !m.lastEntryTime.IsZero() {
+		lag = time.Since(m.lastEntryTime).Seconds()
+	}
+	return map[string]interface{}{
+		"Applied":    m.applied,
+		"Skipped":    m.skipped,
+		"Failed":     m.failed,
+		"Lost":       m.lost,
+		"Checkpoint": m.checkpoint,
+		"CaughtUp":   m.caughtUp,
+		"LagSeconds": lag,
+		"Files":      m.fids.size(),
+	}
+}
+
+// parseCollectionMapping parses "a:b,c:d" into a => b, c => d.
+func parseCollectionMapping(s string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("expecting source:destination, got " + pair)
+		}
+		mapping[parts[0]] = parts[1]
+	}
+	return mapping, nil
+}
+
+// fidMap maps the source file ids to the destination ones. It is kept in a
+// file of "source destination" lines, and "source" lines for the removals,
+// rewritten without the removed and replaced ones when opened.
+type fidMap struct {
+	lock sync.Mutex
+	fids map[string]string
+	file *os.File
+}
+
+func openFidMap(fileName string) (*fidMap, error) {
+	m := &fidMap{fids: make(map[string]string)}
+	if f, err := os.Open(fileName); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			switch len(fields) {
+			case 1:
+				delete(m.fids, fields[0])
+			case 2:
+				m.fids[fields[0]] = fields[1]
+			}
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for src, dst := range m.fids {
+		b.WriteString(src + " " + dst + "\n")
+	}
+	if err := writeFileAtomically(fileName, b.Bytes()); err != nil {
+		return nil, err
+	}
+	var err error
+	m.file, err = os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+	return m, err
+}
+
+func (m *fidMap) get(src string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	dst, ok := m.fids[src]
+	return dst, ok
+}
+
+func (m *fidMap) set(src, dst string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.fids[src] = dst
+	_, err := m.file.WriteString(src + " " + dst + "\n")
+	return err
+}
+
+func (m *fidMap) remove(src string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.fids, src)
+	_, err := m.file.WriteString(src + "\n")
+	return err
+}
+
+func (m *fidMap) size() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.fids)
+}
+
+// writeFileAtomically writes to a temporary file, renamed over the file once complete.
+func writeFileAtomically(fileName string, data []byte) error {
+	tmp := fileName + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileName)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	cmdNfs.Run = runNfs // break init cycle
+	IsDebug = cmdNfs.Flag.Bool("debug", false, "enable debug mode")
+}
+
+var cmdNfs = &Command{
+	UsageLine: "nfs -port=2049 -filer=localhost:8888 -export=/exports/",
+	Short:     "start an NFSv3 gateway to a filer directory, for legacy applications",
+	Long: `start an NFSv3 server exporting a filer directory, for applications that can
+  only read and write files on a mounted file system. The NFS and MOUNT programs
+  are both served over tcp on -port, without portmap and without locking, so
+  clients mount with:
+
+    mount -t nfs -o vers=3,proto=tcp,port=2049,mountport=2049,mountproto=tcp,nolock host:/exports /mnt
+
+  The filer only keeps the file ids of the paths, so the gateway fills in the
+  rest. The file handles are ids given to the paths as they are looked up, and
+  are stale after the gateway restarts, except the handle of -export. The sizes
+  and last modified times come from the volume servers; the directories always
+  look changed, so the clients see the files added through the filer directly.
+  Every file has the mode 0644, every directory 0755, and both the owner -uid
+  and -gid; SETATTR only changes the size.
+
+  A written file is kept in a spool file under -spoolDir, and uploaded whole to
+  the filer on COMMIT, which the clients send on close, or once it is left alone
+  for -flushSeconds. Until then the other filer clients see its previous content.
+  A READ gets only the 1MB blocks of the file it covers, with ranged GETs, and
+  the blocks are cached by file id up to -cacheMB. A write first copies the whole
+  file to its spool. A filer or a volume server call is given up after 30s, and
+  the copy of a whole file at less than 1MB/s.
+
+  The filer has no empty directories: MKDIR keeps one in the gateway's memory
+  until a file is written in it, and RMDIR removes only those. RENAME over an
+  existing file deletes it first, so it is not atomic. LINK, SYMLINK and MKNOD
+  are not supported. The calls are not authenticated: AUTH_SYS credentials are
+  accepted from any client in -allowedClients.
+
+  `,
+}
+
+var (
+	nfsPort           = cmdNfs.Flag.Int("port", 2049, "tcp listen port of the NFS and MOUNT programs")
+	nfsFiler          = cmdNfs.Flag.String("filer", "localhost:8888", "filer server location")
+	nfsExport         = cmdNfs.Flag.String("export", "/", "filer directory exported")
+	nfsAllowedClients = cmdNfs.Flag.String("allowedClients", "", "comma separated networks of the clients allowed to connect, e.g. 10.0.0.0/8,192.168.1.5/32. Empty allows everyone")
+	nfsSpoolDir       = cmdNfs.Flag.String("spoolDir", os.TempDir(), "local directory to keep the files being written")
+	nfsFlushSeconds   = cmdNfs.Flag.Int("flushSeconds", 30, "seconds a written file is left alone, without a COMMIT, before it is uploaded")
+	nfsCacheMB        = cmdNfs.Flag.Int("cacheMB", 256, "memory in MB to keep the blocks of the files read")
+	nfsUid            = cmdNfs.Flag.Int("uid", 65534, "owner of the files and directories, nobody by default")
+	nfsGid            = cmdNfs.Flag.Int("gid", 65534, "group of the files and directories, nogroup by default")
+)
+
+const (
+	rpcCall  = 0
+	rpcReply = 1
+
+	rpcMsgAccepted = 0
+	rpcMsgDenied   = 1
+
+	rpcSuccess      = 0
+	rpcProgUnavail  = 1
+	rpcProgMismatch = 2
+	rpcProcUnavail  = 3
+	rpcGarbageArgs  = 4
+
+	rpcMismatch    = 0
+	rpcAuthError   = 1
+	rpcAuthTooWeak = 5
+
+	rpcAuthNone = 0
+	rpcAuthSys  = 1
+
+	nfsProgram   = 100003
+	mountProgram = 100005
+
+	// the largest call taken, a WRITE of nfsMaxData with its arguments
+	nfsMaxCall = nfsMaxData + 4096
+	nfsMaxData = 1 << 20
+	// the calls of a connection answered at the same time
+	nfsConcurrentCalls = 16
+)
+
+func runNfs(cmd *Command, args []string) bool {
+	var allowed []*net.IPNet
+	for _, network := range strings.Split(*nfsAllowedClients, ",") {
+		if network = strings.TrimSpace(network); network == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			log.Fatalf("Invalid -allowedClients: %s", err)
+		}
+		allowed = append(allowed, ipNet)
+	}
+	g := newNfsGateway(*nfsFiler, *nfsExport, *nfsSpoolDir, int64(*nfsCacheMB)*1024*1024)
+	go g.flushIdleSpools(time.Duration(*nfsFlushSeconds) * time.Second)
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(*nfsPort))
+	if err != nil {
+		log.Fatalf("Fail to start:%s", err.Error())
+	}
+	log.Println("Start Weed NFS gateway", VERSION, "at port", strconv.Itoa(*nfsPort), "exporting", g.root, "of the filer", *nfsFiler)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("nfs accept error:", err)
+			continue
+		}
+		if !isAllowedClient(conn.RemoteAddr(), allowed) {
+			debug("nfs refused the client", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go g.serveConn(conn)
+	}
+}
+
+func isAllowedClient(addr net.Addr, allowed []*net.IPNet) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range allowed {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveConn reads the rpc calls of the connection, in records of fragments, see
+// RFC 5531, and writes back their replies as they are answered.
+func (g *nfsGateway) serveConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var writeLock sync.Mutex
+	calls := make(chan bool, nfsConcurrentCalls)
+	for {
+		var call []byte
+		for last := false; !last; {
+			var header [4]byte
+			if _, err := io.ReadFull(reader, header[:]); err != nil {
+				return
+			}
+			size := binary.BigEndian.Uint32(header[:])
+			last, size = size&0x80000000 != 0, size&0x7fffffff
+			if len(call)+int(size) > nfsMaxCall {
+				debug("nfs call too large from", conn.RemoteAddr())
+				return
+			}
+			fragment := make([]byte, size)
+			if _, err := io.ReadFull(reader, fragment); err != nil {
+				return
+			}
+			call = append(call, fragment...)
+		}
+		calls <- true
+		go func() {
+			defer func() { <-calls }()
+			reply := g.rpcReply(call)
+			if reply == nil {
+				return
+			}
+			record := make([]byte, 4, 4+len(reply))
+			binary.BigEndian.PutUint32(record, uint32(len(reply))|0x80000000)
+			writeLock.Lock()
+			conn.Write(append(record, reply...))
+			writeLock.Unlock()
+		}()
+	}
+}
+
+// rpcReply answers an rpc call of the NFS or the MOUNT program, or returns nil
+// for a message that is not a call.
+func (g *nfsGateway) rpcReply(call []byte) []byte {
+	r := &xdrReader{data: call}
+	xid, msgType := r.uint32(), r.uint32()
+	rpcVersion, program, version, procedure := r.uint32(), r.uint32(), r.uint32(), r.uint32()
+	credentials := r.uint32()
+	r.opaque(400)
+	r.uint32()
+	r.opaque(400)
+	if r.err != nil || msgType != rpcCall {
+		return nil
+	}
+	w := &xdrWriter{}
+	w.uint32(xid)
+	w.uint32(rpcReply)
+	if rpcVersion != 2 {
+		w.uint32(rpcMsgDenied)
+		w.uint32(rpcMismatch)
+		w.uint32(2)
+		w.uint32(2)
+		return w.Bytes()
+	}
+	if credentials != rpcAuthNone && credentials != rpcAuthSys {
+		w.uint32(rpcMsgDenied)
+		w.uint32(rpcAuthError)
+		w.uint32(rpcAuthTooWeak)
+		return w.Bytes()
+	}
+	w.uint32(rpcMsgAccepted)
+	w.uint32(rpcAuthNone)
+	w.opaque(nil)
+	var procedures map[uint32]func(g *nfsGateway, args *xdrReader, w *xdrWriter)
+	switch program {
+	case nfsProgram:
+		procedures = nfsProcedures
+	case mountProgram:
+		procedures = mountProcedures
+	default:
+		w.uint32(rpcProgUnavail)
+		return w.Bytes()
+	}
+	if version != 3 {
+		w.uint32(rpcProgMismatch)
+		w.uint32(3)
+		w.uint32(3)
+		return w.Bytes()
+	}
+	serve, ok := procedures[procedure]
+	if !ok {
+		w.uint32(rpcProcUnavail)
+		return w.Bytes()
+	}
+	results := &xdrWriter{}
+	serve(g, r, results)
+	if r.err != nil {
+		w.uint32(rpcGarbageArgs)
+		return w.Bytes()
+	}
+	w.uint32(rpcSuccess)
+	w.Write(results.Bytes())
+	return w.Bytes()
+}
+
+const (
+	mnt3OK       = 0
+	mnt3ErrNoEnt = 2
+	mnt3ErrIO    = 5
+)
+
+// mountProcedures are the MOUNT v3 procedures, see RFC 1813 appendix I. The
+// mounts are not recorded, so DUMP lists none.
+var mountProcedures = map[uint32]func(g *nfsGateway, args *xdrReader, w *xdrWriter){
+	0: func(g *nfsGateway, args *xdrReader, w *xdrWriter) {},
+	// MNT
+	1: func(g *nfsGateway, args *xdrReader, w *xdrWriter) {
+		dir := args.string(1024)
+		if args.err != nil {
+			return
+		}
+		dir = dirPath(dir)
+		if !strings.HasPrefix(dir, g.root) {
+			w.uint32(mnt3ErrNoEnt)
+			return
+		}
+		if _, err := g.stat(dir); err != nil {
+			if err == errNfsNotFound {
+				w.uint32(mnt3ErrNoEnt)
+			} else {
+				w.uint32(mnt3ErrIO)
+			}
+			return
+		}
+		w.uint32(mnt3OK)
+		w.opaque(g.handle(dir))
+		w.uint32(1)
+		w.uint32(rpcAuthSys)
+	},
+	// DUMP
+	2: func(g *nfsGateway, args *xdrReader, w *xdrWriter) {
+		w.bool(false)
+	},
+	// UMNT
+	3: func(g *nfsGateway, args *xdrReader, w *xdrWriter) {
+		args.string(1024)
+	},
+	// UMNTALL
+	4: func(g *nfsGateway, args *xdrReader, w *xdrWriter) {},
+	// EXPORT, to any client
+	5: func(g *nfsGateway, args *xdrReader, w *xdrWriter) {
+		export := strings.TrimSuffix(g.root, "/")
+		if export == "" {
+			export = "/"
+		}
+		w.bool(true)
+		w.string(export)
+		w.bool(false)
+		w.bool(false)
+	},
+}
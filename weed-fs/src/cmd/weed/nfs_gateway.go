@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"pkg/operation"
+	"pkg/util"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the attributes of a file are read again from its volume server after this
+	nfsAttrCacheTime = 2 * time.Second
+	// the size of the file handles: the run of the gateway, then the id of the path
+	nfsHandleSize = 16
+	nfsRootId     = 1
+	// the contents are read and cached by blocks of this size, a READ's largest
+	nfsBlockSize = nfsMaxData
+	// a filer call, or the read of a block, is given up after this
+	nfsCallTimeout = 30 * time.Second
+)
+
+var (
+	nfsTransport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		ResponseHeaderTimeout: nfsCallTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   nfsConcurrentCalls,
+	}
+	nfsClient = &http.Client{Transport: nfsTransport, Timeout: nfsCallTimeout}
+	// for the whole files, bounded by nfsTransferTimeout
+	nfsTransferClient = &http.Client{Transport: nfsTransport}
+)
+
+// nfsGateway maps the NFS file handles to the paths under the exported filer
+// directory, and the NFS operations to filer calls. The filer only keeps
+// path => fid, so the handles are ids given to the paths as they are looked
+// up, kept in memory; the handles of a previous run are stale, except the one
+// of the exported directory. A file is written to a local spool file, and
+// uploaded whole on COMMIT, or once left alone for the flush delay. The lock of
+// the gateway and the lock of a spool are never held together.
+type nfsGateway struct {
+	filer    string // host:port
+	root     string // the exported directory, ending with "/"
+	spoolDir string
+	boot     uint64 // tells this run's handles and write verifier from the previous ones
+
+	lock   sync.Mutex
+	paths  map[uint64]string // a directory's path ends with "/"
+	ids    map[string]uint64
+	nextId uint64
+	dirs   map[string]time.Time // empty directories made by MKDIR, until they hold a file
+	attrs  map[string]*nfsAttr  // recently read attributes of the files
+	spools map[string]*nfsSpool // the files being written, by path
+
+	blocks  *util.LRUCache // blocks of the file contents, by fid and index
+	fetches util.SingleFlight
+}
+
+// nfsAttr is what the gateway knows of a file or a directory.
+type nfsAttr struct {
+	dir   bool
+	fid   string
+	size  int64
+	mtime time.Time
+
+	fetched time.Time
+}
+
+// nfsSpool is a file being written, and its content so far.
+type nfsSpool struct {
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	mtime   time.Time
+	dirty   bool
+	touched time.Time // the last write, flush or read
+}
+
+// nfsDirEntry is a file or a sub directory listed by the filer.
+type nfsDirEntry struct {
+	name string
+	dir  bool
+}
+
+var (
+	errNfsNotFound = errors.New("not found")
+	errNfsExists   = errors.New("already exists")
+)
+
+func newNfsGateway(filer, export, spoolDir string, cacheSize int64) *nfsGateway {
+	root := dirPath(export)
+	g := &nfsGateway{filer: filer, root: root, spoolDir: spoolDir, boot: uint64(rand.Int63()) | 1,
+		paths: map[uint64]string{nfsRootId: root}, ids: map[string]uint64{root: nfsRootId}, nextId: nfsRootId + 1,
+		dirs: make(map[string]time.Time), attrs: make(map[string]*nfsAttr), spools: make(map[string]*nfsSpool),
+		blocks: util.NewLRUCache(cacheSize)}
+	return g
+}
+
+// dirPath is the directory as the gateway keeps it, from the root and ending with "/".
+func dirPath(dir string) string {
+	if dir = strings.Trim(dir, "/"); dir == "" {
+		return "/"
+	}
+	return "/" + dir + "/"
+}
+
+// handle returns the file handle of the path, giving it an id if it has none yet.
+// The handle of the exported directory is the same on every run.
+func (g *nfsGateway) handle(p string) []byte {
+	g.lock.Lock()
+	id, ok := g.ids[p]
+	if !ok {
+		id = g.nextId
+		g.nextId++
+		g.ids[p], g.paths[id] = id, p
+	}
+	g.lock.Unlock()
+	fh := make([]byte, nfsHandleSize)
+	if id != nfsRootId {
+		binary.BigEndian.PutUint64(fh, g.boot)
+	}
+	binary.BigEndian.PutUint64(fh[8:], id)
+	return fh
+}
+
+// fileId is the inode number of the path, its handle id.
+func (g *nfsGateway) fileId(p string) uint64 {
+	return binary.BigEndian.Uint64(g.handle(p)[8:])
+}
+
+// resolve returns the path of the file handle.
+func (g *nfsGateway) resolve(fh []byte) (string, uint32) {
+	if len(fh) != nfsHandleSize {
+		return "", nfs3ErrBadHandle
+	}
+	boot, id := binary.BigEndian.Uint64(fh), binary.BigEndian.Uint64(fh[8:])
+	if id == nfsRootId && boot == 0 {
+		return g.root, nfs3OK
+	}
+	if boot != g.boot {
+		return "", nfs3ErrStale
+	}
+	g.lock.Lock()
+	p, ok := g.paths[id]
+	g.lock.Unlock()
+	if !ok {
+		return "", nfs3ErrStale
+	}
+	return p, nfs3OK
+}
+
+// isUnder tells if the path is the file, or is in the directory, from.
+func isUnder(p, from string) bool {
+	return p == from || strings.HasSuffix(from, "/") && strings.HasPrefix(p, from)
+}
+
+// renameHandles keeps the handles of the path, and of everything under it for a
+// directory, on their new paths.
+func (g *nfsGateway) renameHandles(from, to string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for p, id := range g.ids {
+		if isUnder(p, from) {
+			newPath := to + p[len(from):]
+			delete(g.ids, p)
+			g.ids[newPath], g.paths[id] = id, newPath
+		}
+	}
+	for p, made := range g.dirs {
+		if isUnder(p, from) {
+			delete(g.dirs, p)
+			g.dirs[to+p[len(from):]] = made
+		}
+	}
+	for p, spool := range g.spools {
+		if isUnder(p, from) {
+			delete(g.spools, p)
+			g.spools[to+p[len(from):]] = spool
+		}
+	}
+	for p := range g.attrs {
+		if isUnder(p, from) {
+			delete(g.attrs, p)
+		}
+	}
+}
+
+// stat returns the attributes of the file or the directory.
+func (g *nfsGateway) stat(p string) (*nfsAttr, error) {
+	if strings.HasSuffix(p, "/") {
+		if !g.dirExists(p) {
+			return nil, errNfsNotFound
+		}
+		// the filer keeps no times of the directories, so their changes are
+		// always looked for, also those made through the filer directly
+		return &nfsAttr{dir: true, size: 4096, mtime: time.Now()}, nil
+	}
+	if attr := g.knownAttr(p, false); attr != nil {
+		return attr, nil
+	}
+	var checksum struct {
+		Fid          string
+		Size         int64
+		LastModified int64
+		Error        string
+	}
+	resp, err := nfsClient.Get("http://" + g.filer + escapePath(p) + "?checksum=true")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNfsNotFound
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil && json.Unmarshal(body, &checksum) != nil {
+		err = errors.New(resp.Status + ": " + string(body))
+	}
+	if err == nil && checksum.Error != "" {
+		err = errors.New(checksum.Error)
+	}
+	if err != nil {
+		return nil, err
+	}
+	attr := &nfsAttr{fid: checksum.Fid, size: checksum.Size, mtime: time.Unix(checksum.LastModified, 0), fetched: time.Now()}
+	g.lock.Lock()
+	g.attrs[p] = attr
+	g.lock.Unlock()
+	return attr, nil
+}
+
+// dirExists tells if the directory has any file under it, or was made by MKDIR.
+func (g *nfsGateway) dirExists(dir string) bool {
+	g.lock.Lock()
+	_, made := g.dirs[dir]
+	g.lock.Unlock()
+	return dir == g.root || made || g.hasFilerEntries(dir)
+}
+
+func (g *nfsGateway) hasFilerEntries(dir string) bool {
+	entries, _, err := g.listPage(dir, "", 1)
+	return err == nil && len(entries) > 0
+}
+
+// listPage lists up to limit entries of the filer directory after lastFileName.
+func (g *nfsGateway) listPage(dir, lastFileName string, limit int) (entries []nfsDirEntry, next string, err error) {
+	var listing struct {
+		Subdirectories []struct{ Name string }
+		Files          []struct{ Name string }
+		LastFileName   string
+		More           bool
+	}
+	listUrl := "http://" + g.filer + escapePath(dir) + "?lastFileName=" + url.QueryEscape(lastFileName)
+	if limit > 0 {
+		listUrl += "&limit=" + strconv.Itoa(limit)
+	}
+	if err = getJsonWith(nfsClient, listUrl, &listing); err != nil {
+		return nil, "", err
+	}
+	for _, d := range listing.Subdirectories {
+		entries = append(entries, nfsDirEntry{name: d.Name, dir: true})
+	}
+	for _, f := range listing.Files {
+		entries = append(entries, nfsDirEntry{name: f.Name})
+	}
+	if listing.More {
+		next = listing.LastFileName
+	}
+	return entries, next, nil
+}
+
+// list returns all the entries of the directory, with the empty directories
+// made by MKDIR in it, in the same order on each call.
+func (g *nfsGateway) list(dir string) ([]nfsDirEntry, error) {
+	var all []nfsDirEntry
+	seen := make(map[string]bool)
+	for lastFileName := ""; ; {
+		entries, next, err := g.listPage(dir, lastFileName, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			seen[e.name] = true
+		}
+		all = append(all, entries...)
+		if next == "" {
+			break
+		}
+		lastFileName = next
+	}
+	g.lock.Lock()
+	var made []string
+	for p := range g.dirs {
+		if name := strings.TrimSuffix(strings.TrimPrefix(p, dir), "/"); strings.HasPrefix(p, dir) && name != "" && !strings.Contains(name, "/") && !seen[name] {
+			made = append(made, name)
+		}
+	}
+	g.lock.Unlock()
+	sort.Strings(made)
+	for _, name := range made {
+		all = append(all, nfsDirEntry{name: name, dir: true})
+	}
+	return all, nil
+}
+
+// lookup returns the path of the name in the directory, with its attributes.
+func (g *nfsGateway) lookup(dir, name string) (string, *nfsAttr, error) {
+	switch name {
+	case ".":
+		attr, err := g.stat(dir)
+		return dir, attr, err
+	case "..":
+		if dir == g.root {
+			attr, err := g.stat(dir)
+			return dir, attr, err
+		}
+		parent := dirPath(path.Dir(strings.TrimSuffix(dir, "/")))
+		attr, err := g.stat(parent)
+		return parent, attr, err
+	}
+	attr, err := g.stat(dir + name)
+	if err == errNfsNotFound {
+		attr, err = g.stat(dir + name + "/")
+		return dir + name + "/", attr, err
+	}
+	return dir + name, attr, err
+}
+
+// create uploads an empty file, so it is listed right away.
+func (g *nfsGateway) create(p string) error {
+	g.discardSpool(p)
+	ctx, cancel := context.WithTimeout(context.Background(), nfsCallTimeout)
+	defer cancel()
+	_, err := operation.UploadContext(ctx, "http://"+g.filer+escapePath(p), path.Base(p), bytes.NewReader(nil), nil)
+	if err == nil {
+		g.fileChanged(p)
+	}
+	return err
+}
+
+// fileChanged forgets the attributes of the file, and the directories made by
+// MKDIR above it, which the filer now has.
+func (g *nfsGateway) fileChanged(p string) {
+	g.lock.Lock()
+	delete(g.attrs, p)
+	for dir := range g.dirs {
+		if strings.HasPrefix(p, dir) {
+			delete(g.dirs, dir)
+		}
+	}
+	g.lock.Unlock()
+}
+
+func (g *nfsGateway) mkdir(dir string) {
+	g.lock.Lock()
+	g.dirs[dir] = time.Now()
+	g.lock.Unlock()
+}
+
+func (g *nfsGateway) remove(p string) error {
+	g.discardSpool(p)
+	req, _ := http.NewRequest("DELETE", "http://"+g.filer+escapePath(p), nil)
+	resp, err := nfsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	g.fileChanged(p)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return errNfsNotFound
+	case http.StatusOK, http.StatusAccepted:
+		return nil
+	}
+	return errors.New("Unexpected status " + resp.Status)
+}
+
+// rmdir only removes the empty directories made by MKDIR, as the filer's
+// directories exist as long as they hold files.
+func (g *nfsGateway) rmdir(dir string) error {
+	g.lock.Lock()
+	_, made := g.dirs[dir]
+	g.lock.Unlock()
+	entries, err := g.list(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return errNfsExists
+	}
+	if !made {
+		return errNfsNotFound
+	}
+	g.lock.Lock()
+	delete(g.dirs, dir)
+	g.lock.Unlock()
+	return nil
+}
+
+// rename moves a file or a directory in the filer, after flushing what is
+// written under it. The filer does not overwrite, so an existing file at the
+// new path is deleted first, and an empty directory made by MKDIR is dropped.
+func (g *nfsGateway) rename(from, to string) error {
+	g.lock.Lock()
+	var spools []string
+	for p := range g.spools {
+		if isUnder(p, from) {
+			spools = append(spools, p)
+		}
+	}
+	_, madeFrom := g.dirs[from]
+	g.lock.Unlock()
+	for _, p := range spools {
+		if err := g.flush(p); err != nil {
+			return err
+		}
+	}
+	if !strings.HasSuffix(to, "/") {
+		if err := g.remove(to); err != nil && err != errNfsNotFound {
+			return err
+		}
+	}
+	if !madeFrom || g.hasFilerEntries(from) {
+		resp, err := nfsClient.Post("http://"+g.filer+escapePath(to)+"?mv.from="+url.QueryEscape(from), "", nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			return errNfsNotFound
+		case http.StatusNotAcceptable:
+			return errNfsExists
+		default:
+			return errors.New("Unexpected status " + resp.Status)
+		}
+		g.fileChanged(to)
+	}
+	g.lock.Lock()
+	delete(g.dirs, to)
+	g.lock.Unlock()
+	g.renameHandles(from, to)
+	return nil
+}
+
+// read returns up to count bytes of the file from the offset, and whether it
+// reached the end, from its spool, or from the blocks of its content.
+func (g *nfsGateway) read(p string, offset int64, count int) ([]byte, bool, error) {
+	g.lock.Lock()
+	spool := g.spools[p]
+	g.lock.Unlock()
+	if spool != nil {
+		spool.lock.Lock()
+		if spool.file != nil {
+			defer spool.lock.Unlock()
+			spool.touched = time.Now()
+			if offset >= spool.size {
+				return nil, true, nil
+			}
+			if int64(count) > spool.size-offset {
+				count = int(spool.size - offset)
+			}
+			data := make([]byte, count)
+			_, err := spool.file.ReadAt(data, offset)
+			return data, offset+int64(count) >= spool.size, err
+		}
+		spool.lock.Unlock()
+	}
+	attr, err := g.stat(p)
+	if err != nil {
+		return nil, false, err
+	}
+	if offset >= attr.size {
+		return nil, true, nil
+	}
+	end := offset + int64(count)
+	if end > attr.size {
+		end = attr.size
+	}
+	data := make([]byte, 0, end-offset)
+	for at := offset; at < end; {
+		index := at / nfsBlockSize
+		block, err := g.block(p, attr, index)
+		if err != nil {
+			return nil, false, err
+		}
+		from, to := at-index*nfsBlockSize, end-index*nfsBlockSize
+		if to > int64(len(block)) {
+			to = int64(len(block))
+		}
+		if from >= to {
+			// the file changed since its attributes were read
+			return data, true, nil
+		}
+		data = append(data, block[from:to]...)
+		at += to - from
+	}
+	return data, end == attr.size, nil
+}
+
+// block returns the block of the file's content at the index, read with a
+// ranged GET. The blocks are cached by fid, which a changed file does not keep.
+func (g *nfsGateway) block(p string, attr *nfsAttr, index int64) ([]byte, error) {
+	key := attr.fid + "/" + strconv.FormatInt(index, 10)
+	if cached, ok := g.blocks.Get(key); ok {
+		return cached.([]byte), nil
+	}
+	fetched, _, err := g.fetches.Do(key, func() (interface{}, error) {
+		start := index * nfsBlockSize
+		req, _ := http.NewRequest("GET", "http://"+g.filer+escapePath(p), nil)
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(start+nfsBlockSize-1, 10))
+		resp, err := nfsClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// the whole file, e.g. an empty one
+			if _, err = io.CopyN(ioutil.Discard, resp.Body, start); err == io.EOF {
+				return []byte{}, nil
+			} else if err != nil {
+				return nil, err
+			}
+		case http.StatusRequestedRangeNotSatisfiable:
+			return []byte{}, nil
+		case http.StatusNotFound:
+			return nil, errNfsNotFound
+		default:
+			return nil, errors.New("Unexpected status " + resp.Status)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, nfsBlockSize))
+		if err != nil {
+			return nil, err
+		}
+		// the file may have changed since its attributes were read
+		if strings.Contains(resp.Request.URL.Path, "/"+attr.fid) {
+			g.blocks.Set(key, data, int64(len(data)))
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fetched.([]byte), nil
+}
+
+// nfsTransferTimeout is the time given to download or upload a whole file of
+// the size, at 1MB/s at least.
+func nfsTransferTimeout(size int64) time.Duration {
+	return nfsCallTimeout + time.Duration(size>>20)*time.Second
+}
+
+// download copies the whole content of the file to the writer.
+func (g *nfsGateway) download(p string, w io.Writer) (int64, error) {
+	attr, err := g.stat(p)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nfsTransferTimeout(attr.size))
+	defer cancel()
+	req, _ := http.NewRequest("GET", "http://"+g.filer+escapePath(p), nil)
+	resp, err := nfsTransferClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, errNfsNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New("Unexpected status " + resp.Status)
+	}
+	return io.Copy(w, resp.Body)
+}
+
+// spool returns the spool of the file, starting it from the file's content.
+func (g *nfsGateway) spool(p string) (*nfsSpool, error) {
+	g.lock.Lock()
+	spool := g.spools[p]
+	g.lock.Unlock()
+	if spool != nil {
+		return spool, nil
+	}
+	file, err := ioutil.TempFile(g.spoolDir, "weed-nfs-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file.Name())
+	size, err := g.download(p, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	spool = &nfsSpool{file: file, size: size, mtime: time.Now(), touched: time.Now()}
+	g.lock.Lock()
+	if existing := g.spools[p]; existing != nil {
+		g.lock.Unlock()
+		file.Close()
+		return existing, nil
+	}
+	g.spools[p] = spool
+	g.lock.Unlock()
+	return spool, nil
+}
+
+// dropSpool forgets the closed spool of the file, unless it was replaced already.
+func (g *nfsGateway) dropSpool(p string, spool *nfsSpool) {
+	g.lock.Lock()
+	if g.spools[p] == spool {
+		delete(g.spools, p)
+	}
+	g.lock.Unlock()
+}
+
+// lockedSpool returns the spool of the file locked, once it is not discarded.
+func (g *nfsGateway) lockedSpool(p string) (*nfsSpool, error) {
+	for {
+		spool, err := g.spool(p)
+		if err != nil {
+			return nil, err
+		}
+		spool.lock.Lock()
+		if spool.file != nil {
+			return spool, nil
+		}
+		spool.lock.Unlock()
+		g.dropSpool(p, spool)
+	}
+}
+
+func (g *nfsGateway) write(p string, offset int64, data []byte) error {
+	spool, err := g.lockedSpool(p)
+	if err != nil {
+		return err
+	}
+	defer spool.lock.Unlock()
+	if _, err = spool.file.WriteAt(data, offset); err != nil {
+		return err
+	}
+	if end := offset + int64(len(data)); end > spool.size {
+		spool.size = end
+	}
+	spool.mtime, spool.touched, spool.dirty = time.Now(), time.Now(), true
+	return nil
+}
+
+func (g *nfsGateway) truncate(p string, size int64) error {
+	spool, err := g.lockedSpool(p)
+	if err != nil {
+		return err
+	}
+	defer spool.lock.Unlock()
+	if err = spool.file.Truncate(size); err != nil {
+		return err
+	}
+	spool.size = size
+	spool.mtime, spool.touched, spool.dirty = time.Now(), time.Now(), true
+	return nil
+}
+
+// flush uploads the spooled file, if written since its last upload, with its
+// last write as its last modified time.
+func (g *nfsGateway) flush(p string) error {
+	g.lock.Lock()
+	spool := g.spools[p]
+	g.lock.Unlock()
+	if spool == nil {
+		return nil
+	}
+	uploaded, err := spool.upload(g.filer, p)
+	if uploaded {
+		g.fileChanged(p)
+	}
+	return err
+}
+
+// upload uploads the spool to the filer path, if written since its last upload.
+func (spool *nfsSpool) upload(filer, p string) (bool, error) {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	spool.touched = time.Now()
+	if spool.file == nil || !spool.dirty {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nfsTransferTimeout(spool.size))
+	defer cancel()
+	uploadUrl := "http://" + filer + escapePath(p) + "?ts=" + strconv.FormatInt(spool.mtime.Unix(), 10)
+	if _, err := operation.UploadContext(ctx, uploadUrl, path.Base(p), io.NewSectionReader(spool.file, 0, spool.size), nil); err != nil {
+		return false, err
+	}
+	spool.dirty = false
+	return true, nil
+}
+
+func (g *nfsGateway) discardSpool(p string) {
+	g.lock.Lock()
+	spool := g.spools[p]
+	delete(g.spools, p)
+	g.lock.Unlock()
+	if spool != nil {
+		spool.lock.Lock()
+		spool.file.Close()
+		spool.file = nil
+		spool.lock.Unlock()
+	}
+}
+
+// flushIdleSpools uploads the files written but left alone for the delay,
+// without a COMMIT, and closes the spools of the uploaded files left alone.
+func (g *nfsGateway) flushIdleSpools(delay time.Duration) {
+	for {
+		time.Sleep(delay / 2)
+		g.flushIdle(delay)
+	}
+}
+
+func (g *nfsGateway) flushIdle(delay time.Duration) {
+	g.lock.Lock()
+	spools := make(map[string]*nfsSpool, len(g.spools))
+	for p, spool := range g.spools {
+		spools[p] = spool
+	}
+	g.lock.Unlock()
+	for p, spool := range spools {
+		spool.lock.Lock()
+		idle, dirty := time.Since(spool.touched) >= delay, spool.dirty
+		if idle && !dirty {
+			spool.file.Close()
+			spool.file = nil
+		}
+		spool.lock.Unlock()
+		if !idle {
+			continue
+		}
+		if !dirty {
+			g.dropSpool(p, spool)
+		} else if err := g.flush(p); err != nil {
+			debug("nfs failed to upload", p, ":", err)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFiler keeps the files of the filer calls of the nfs gateway in memory.
+type fakeFiler struct {
+	lock     sync.Mutex
+	fids     map[string]string // by path
+	contents map[string][]byte // by fid
+	nextFid  int
+	ranges   []string // of the reads of the contents
+	// if set, an upload is sent to it when it arrives, then waits for a reply
+	uploading chan bool
+}
+
+func startFakeFiler() (*fakeFiler, *httptest.Server) {
+	f := &fakeFiler{fids: make(map[string]string), contents: make(map[string][]byte)}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeFiler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	uploading := f.uploading
+	f.lock.Unlock()
+	if r.Method == "POST" && r.FormValue("mv.from") == "" && uploading != nil {
+		uploading <- true
+		<-uploading
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/fid/"):
+		f.ranges = append(f.ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(f.contents[p[len("/fid/"):]]))
+	case r.Method == "GET" && strings.HasSuffix(p, "/"):
+		f.list(w, r)
+	case r.Method == "GET":
+		fid, ok := f.fids[p]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+		} else if r.FormValue("checksum") == "true" {
+			writeJson(w, r, map[string]interface{}{"Fid": fid, "Size": len(f.contents[fid]), "LastModified": 1700000000})
+		} else {
+			http.Redirect(w, r, "/fid/"+fid, http.StatusFound)
+		}
+	case r.Method == "DELETE":
+		if _, ok := f.fids[p]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.fids, p)
+		w.WriteHeader(http.StatusAccepted)
+	case r.FormValue("mv.from") != "":
+		from, moved := r.FormValue("mv.from"), false
+		for name, fid := range f.fids {
+			if isUnder(name, from) {
+				if _, exists := f.fids[p+name[len(from):]]; exists {
+					w.WriteHeader(http.StatusNotAcceptable)
+					return
+				}
+				delete(f.fids, name)
+				f.fids[p+name[len(from):]], moved = fid, true
+			}
+		}
+		if !moved {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		f.nextFid++
+		fid := "3," + strconv.Itoa(f.nextFid)
+		f.fids[p], f.contents[fid] = fid, data
+		w.WriteHeader(http.StatusCreated)
+		writeJson(w, r, map[string]interface{}{"name": p, "fid": fid, "size": len(data)})
+	}
+}
+
+func (f *fakeFiler) list(w http.ResponseWriter, r *http.Request) {
+	entries := make(map[string]bool)
+	for name := range f.fids {
+		if strings.HasPrefix(name, r.URL.Path) {
+			rest := name[len(r.URL.Path):]
+			if i := strings.Index(rest, "/"); i >= 0 {
+				entries[rest[:i+1]] = true
+			} else {
+				entries[rest] = true
+			}
+		}
+	}
+	var names []string
+	for name := range entries {
+		if name > r.FormValue("lastFileName") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil {
+		limit = 2
+	}
+	m := map[string]interface{}{"More": len(names) > limit}
+	if len(names) > limit {
+		names = names[:limit]
+		m["LastFileName"] = names[limit-1]
+	}
+	var dirs, files []map[string]string
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			dirs = append(dirs, map[string]string{"name": strings.TrimSuffix(name, "/")})
+		} else {
+			files = append(files, map[string]string{"name": name, "fid": f.fids[r.URL.Path+name]})
+		}
+	}
+	m["Subdirectories"], m["Files"] = dirs, files
+	writeJson(w, r, m)
+}
+
+func (f *fakeFiler) content(p string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return string(f.contents[f.fids[p]])
+}
+
+// encodeRpcCall encodes a call of the procedure, with AUTH_SYS credentials.
+func encodeRpcCall(program, procedure uint32, args func(w *xdrWriter)) []byte {
+	w := &xdrWriter{}
+	for _, v := range []uint32{0x1234, rpcCall, 2, program, 3, procedure, rpcAuthSys} {
+		w.uint32(v)
+	}
+	w.opaque(make([]byte, 20))
+	w.uint32(rpcAuthNone)
+	w.opaque(nil)
+	if args != nil {
+		args(w)
+	}
+	return w.Bytes()
+}
+
+// call returns the results of a successful call, after their nfs status.
+func call(t *testing.T, g *nfsGateway, program, procedure uint32, expected uint32, args func(w *xdrWriter)) *xdrReader {
+	t.Helper()
+	reply := g.rpcReply(encodeRpcCall(program, procedure, args))
+	r := &xdrReader{data: reply}
+	if xid, msgType, accepted := r.uint32(), r.uint32(), r.uint32(); xid != 0x1234 || msgType != rpcReply || accepted != rpcMsgAccepted {
+		t.Fatal("procedure", procedure, "got the reply", reply)
+	}
+	r.uint32()
+	r.opaque(400)
+	if acceptStat := r.uint32(); acceptStat != rpcSuccess {
+		t.Fatal("procedure", procedure, "got the accept status", acceptStat)
+	}
+	if status := r.uint32(); status != expected {
+		t.Fatal("procedure", procedure, "got the status", status, "expected", expected)
+	}
+	return r
+}
+
+func dirOpArgs(fh []byte, name string) func(w *xdrWriter) {
+	return func(w *xdrWriter) {
+		w.opaque(fh)
+		w.string(name)
+	}
+}
+
+// skipAttr skips a post_op_attr, and returns the size in it, or -1.
+func skipAttr(r *xdrReader) int64 {
+	if !r.bool() {
+		return -1
+	}
+	r.fixed(20)
+	size := r.uint64()
+	r.fixed(56)
+	return int64(size)
+}
+
+func readDirNames(t *testing.T, g *nfsGateway, dir []byte, count uint32) (names []string, eof bool) {
+	r := call(t, g, nfsProgram, 16, nfs3OK, func(w *xdrWriter) {
+		w.opaque(dir)
+		w.uint64(0)
+		w.fixed(make([]byte, 8))
+		w.uint32(count)
+	})
+	skipAttr(r)
+	r.fixed(8)
+	for r.bool() {
+		r.uint64()
+		names = append(names, r.string(nfsMaxName))
+		r.uint64()
+	}
+	return names, r.bool()
+}
+
+func TestNfsGateway(t *testing.T) {
+	filer, server := startFakeFiler()
+	defer server.Close()
+	spoolDir, _ := ioutil.TempDir("", "weed_nfs")
+	defer os.RemoveAll(spoolDir)
+	g := newNfsGateway(server.URL[len("http://"):], "/exports/", spoolDir, 1<<20)
+	mount := func(dir string) func(w *xdrWriter) {
+		return func(w *xdrWriter) { w.string(dir) }
+	}
+	call(t, g, mountProgram, 1, mnt3ErrNoEnt, mount("/other"))
+	root := call(t, g, mountProgram, 1, mnt3OK, mount("/exports")).opaque(64)
+	if fh := g.handle("/exports/"); string(fh) != string(root) || binary.BigEndian.Uint64(root) != 0 {
+		t.Fatal("the root handle should not change with the runs", root)
+	}
+
+	// a file is uploaded empty when created, then whole on COMMIT
+	call(t, g, nfsProgram, 3, nfs3ErrNoEnt, dirOpArgs(root, "a.txt"))
+	r := call(t, g, nfsProgram, 8, nfs3OK, func(w *xdrWriter) {
+		dirOpArgs(root, "a.txt")(w)
+		w.uint32(nfsGuarded)
+		w.fixed(make([]byte, 6*4))
+	})
+	r.bool()
+	fh := r.opaque(64)
+	call(t, g, nfsProgram, 8, nfs3ErrExist, func(w *xdrWriter) {
+		dirOpArgs(root, "a.txt")(w)
+		w.uint32(nfsGuarded)
+		w.fixed(make([]byte, 6*4))
+	})
+	for offset, data := range map[uint64]string{0: "hello ", 6: "world"} {
+		r = call(t, g, nfsProgram, 7, nfs3OK, func(w *xdrWriter) {
+			w.opaque(fh)
+			w.uint64(offset)
+			w.uint32(uint32(len(data)))
+			w.uint32(nfsUnstable)
+			w.string(data)
+		})
+		r.bool()
+		skipAttr(r)
+		if count, committed := r.uint32(), r.uint32(); count != uint32(len(data)) || committed != nfsUnstable {
+			t.Fatal("write got", count, committed)
+		}
+	}
+	r = call(t, g, nfsProgram, 1, nfs3OK, func(w *xdrWriter) { w.opaque(fh) })
+	r.fixed(20)
+	if size := r.uint64(); size != 11 {
+		t.Fatal("the written file has the size", size)
+	}
+	if content := filer.content("/exports/a.txt"); content != "" {
+		t.Fatal("uploaded before the commit:", content)
+	}
+	call(t, g, nfsProgram, 21, nfs3OK, func(w *xdrWriter) {
+		w.opaque(fh)
+		w.uint64(0)
+		w.uint32(0)
+	})
+	if content := filer.content("/exports/a.txt"); content != "hello world" {
+		t.Fatal("committed", content)
+	}
+	g.discardSpool("/exports/a.txt")
+	read := func(fh []byte, offset uint64) (string, bool) {
+		r := call(t, g, nfsProgram, 6, nfs3OK, func(w *xdrWriter) {
+			w.opaque(fh)
+			w.uint64(offset)
+			w.uint32(100)
+		})
+		skipAttr(r)
+		r.uint32()
+		eof := r.bool()
+		return string(r.opaque(nfsMaxData)), eof
+	}
+	if data, eof := read(fh, 6); data != "world" || !eof {
+		t.Fatal("read", data, eof)
+	}
+
+	// an empty directory only lives in the gateway, until a file is moved in it
+	r = call(t, g, nfsProgram, 9, nfs3OK, func(w *xdrWriter) {
+		dirOpArgs(root, "sub")(w)
+		w.fixed(make([]byte, 6*4))
+	})
+	r.bool()
+	sub := r.opaque(64)
+	if names, eof := readDirNames(t, g, root, 4096); strings.Join(names, " ") != ". .. a.txt sub" || !eof {
+		t.Fatal("listed", names, eof)
+	}
+	if names, eof := readDirNames(t, g, root, 150); len(names) == 0 || len(names) == 4 || eof {
+		t.Fatal("listed more than the count", names, eof)
+	}
+	call(t, g, nfsProgram, 16, nfs3ErrTooSmall, func(w *xdrWriter) {
+		w.opaque(root)
+		w.uint64(0)
+		w.fixed(make([]byte, 8))
+		w.uint32(10)
+	})
+	call(t, g, nfsProgram, 14, nfs3OK, func(w *xdrWriter) {
+		dirOpArgs(root, "a.txt")(w)
+		dirOpArgs(sub, "b.txt")(w)
+	})
+	if content := filer.content("/exports/sub/b.txt"); content != "hello world" {
+		t.Fatal("moved", content)
+	}
+	if data, _ := read(fh, 0); data != "hello world" {
+		t.Fatal("the handle should follow the file it was moved", data)
+	}
+	call(t, g, nfsProgram, 13, nfs3ErrNotEmpty, dirOpArgs(root, "sub"))
+	call(t, g, nfsProgram, 12, nfs3ErrIsDir, dirOpArgs(root, "sub"))
+	call(t, g, nfsProgram, 12, nfs3OK, dirOpArgs(sub, "b.txt"))
+	call(t, g, nfsProgram, 3, nfs3ErrNoEnt, dirOpArgs(sub, "b.txt"))
+	call(t, g, nfsProgram, 13, nfs3ErrNoEnt, dirOpArgs(root, "sub"))
+
+	// the empty directories are renamed in the gateway
+	mkdir := func(dir []byte, name string) []byte {
+		r := call(t, g, nfsProgram, 9, nfs3OK, func(w *xdrWriter) {
+			dirOpArgs(dir, name)(w)
+			w.fixed(make([]byte, 6*4))
+		})
+		r.bool()
+		return r.opaque(64)
+	}
+	a := mkdir(root, "a")
+	mkdir(a, "b")
+	call(t, g, nfsProgram, 14, nfs3OK, func(w *xdrWriter) {
+		dirOpArgs(a, "b")(w)
+		dirOpArgs(a, "c")(w)
+	})
+	if names, _ := readDirNames(t, g, a, 4096); strings.Join(names, " ") != ". .. c" {
+		t.Fatal("listed", names)
+	}
+	if names, _ := readDirNames(t, g, root, 4096); strings.Join(names, " ") != ". .. a" {
+		t.Fatal("listed", names)
+	}
+
+	stale := g.handle("/exports/sub/")
+	stale[0] ^= 1
+	call(t, g, nfsProgram, 1, nfs3ErrStale, func(w *xdrWriter) { w.opaque(stale) })
+	call(t, g, nfsProgram, 10, nfs3ErrNotSupp, func(w *xdrWriter) {
+		dirOpArgs(root, "link")(w)
+		w.fixed(make([]byte, 6*4))
+		w.string("a.txt")
+	})
+}
+
+func TestNfsGatewayReadsRanges(t *testing.T) {
+	filer, server := startFakeFiler()
+	defer server.Close()
+	g := newNfsGateway(server.URL[len("http://"):], "/", os.TempDir(), 4<<20)
+	content := make([]byte, 5*nfsBlockSize/2)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	filer.fids["/big"], filer.contents["3,1"] = "3,1", content
+
+	// only the blocks read are fetched, once
+	for _, c := range []struct {
+		offset, count int64
+		ranges        []string
+	}{
+		{nfsBlockSize + 10, 100, []string{"bytes=1048576-2097151"}},
+		{nfsBlockSize - 50, 100, []string{"bytes=0-1048575"}},
+		{2*nfsBlockSize + 10, nfsBlockSize, []string{"bytes=2097152-3145727"}},
+		{10, 100, nil},
+	} {
+		filer.ranges = nil
+		data, eof, err := g.read("/big", c.offset, int(c.count))
+		end := c.offset + c.count
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		if err != nil || !bytes.Equal(data, content[c.offset:end]) || eof != (end == int64(len(content))) {
+			t.Fatal("read at", c.offset, "got", len(data), eof, err)
+		}
+		if strings.Join(filer.ranges, " ") != strings.Join(c.ranges, " ") {
+			t.Fatal("read at", c.offset, "fetched", filer.ranges)
+		}
+	}
+	if data, eof, err := g.read("/big", int64(len(content)), 100); len(data) != 0 || !eof || err != nil {
+		t.Fatal("read at the end got", len(data), eof, err)
+	}
+}
+
+func TestNfsGatewayFlushesBesideIdleSpools(t *testing.T) {
+	filer, server := startFakeFiler()
+	defer server.Close()
+	spoolDir, _ := ioutil.TempDir("", "weed_nfs")
+	defer os.RemoveAll(spoolDir)
+	g := newNfsGateway(server.URL[len("http://"):], "/", spoolDir, 1<<20)
+	if err := g.create("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.write("/a.txt", 0, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	filer.lock.Lock()
+	filer.uploading = make(chan bool)
+	filer.lock.Unlock()
+	flushed := make(chan error)
+	go func() { flushed <- g.flush("/a.txt") }()
+	// the upload is under way, with the spool locked
+	<-filer.uploading
+	idle := make(chan bool)
+	go func() {
+		g.flushIdle(0)
+		close(idle)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	filer.uploading <- true
+	for _, done := range []func() bool{
+		func() bool { return <-flushed == nil },
+		func() bool { <-idle; return true },
+	} {
+		result := make(chan bool)
+		go func() { result <- done() }()
+		select {
+		case ok := <-result:
+			if !ok {
+				t.Fatal("the flush failed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the flush and the idle spools deadlocked")
+		}
+	}
+	if content := filer.content("/a.txt"); content != "hello" {
+		t.Fatal("flushed", content)
+	}
+}
+
+func TestNfsRpcReply(t *testing.T) {
+	g := newNfsGateway("localhost:1", "/", os.TempDir(), 1<<20)
+	acceptStatus := func(call []byte) uint32 {
+		r := &xdrReader{data: g.rpcReply(call)}
+		r.fixed(12)
+		r.uint32()
+		r.opaque(400)
+		return r.uint32()
+	}
+	if status := acceptStatus(encodeRpcCall(100000, 0, nil)); status != rpcProgUnavail {
+		t.Error("an unknown program got", status)
+	}
+	if status := acceptStatus(encodeRpcCall(nfsProgram, 22, nil)); status != rpcProcUnavail {
+		t.Error("an unknown procedure got", status)
+	}
+	if status := acceptStatus(encodeRpcCall(nfsProgram, 1, func(w *xdrWriter) { w.uint32(100) })); status != rpcGarbageArgs {
+		t.Error("a truncated handle got", status)
+	}
+	wrongVersion := encodeRpcCall(nfsProgram, 0, nil)
+	binary.BigEndian.PutUint32(wrongVersion[16:], 4)
+	if status := acceptStatus(wrongVersion); status != rpcProgMismatch {
+		t.Error("nfs v4 got", status)
+	}
+	kerberos := encodeRpcCall(nfsProgram, 0, nil)
+	binary.BigEndian.PutUint32(kerberos[24:], 6)
+	if reply := g.rpcReply(kerberos); binary.BigEndian.Uint32(reply[8:]) != rpcMsgDenied {
+		t.Error("kerberos credentials were accepted")
+	}
+	reply := encodeRpcCall(nfsProgram, 0, nil)
+	binary.BigEndian.PutUint32(reply[4:], rpcReply)
+	if g.rpcReply(reply) != nil || g.rpcReply([]byte{1, 2, 3}) != nil {
+		t.Error("answered a message that is not a call")
+	}
+}
+
+func FuzzNfsRpcReply(f *testing.F) {
+	filer, server := startFakeFiler()
+	defer server.Close()
+	filer.fids["/a.txt"], filer.contents["3,1"] = "3,1", []byte("hello")
+	g := newNfsGateway(server.URL[len("http://"):], "/", os.TempDir(), 1<<20)
+	root := g.handle("/")
+	f.Add(encodeRpcCall(mountProgram, 1, func(w *xdrWriter) { w.string("/") }))
+	f.Add(encodeRpcCall(nfsProgram, 3, dirOpArgs(root, "a.txt")))
+	f.Add(encodeRpcCall(nfsProgram, 16, func(w *xdrWriter) {
+		w.opaque(root)
+		w.uint64(0)
+		w.fixed(make([]byte, 8))
+		w.uint32(4096)
+	}))
+	f.Fuzz(func(t *testing.T, call []byte) {
+		reply := g.rpcReply(call)
+		if reply != nil && (len(reply) < 12 || binary.BigEndian.Uint32(reply[4:]) != rpcReply) {
+			t.Fatal("the reply to", call, "is not an rpc reply:", reply)
+		}
+	})
+}
+
+func TestIsAllowedClient(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	allowed := []*net.IPNet{network}
+	for ip, expected := range map[string]bool{"10.1.2.3": true, "192.168.1.5": false} {
+		if isAllowedClient(&net.TCPAddr{IP: net.ParseIP(ip)}, allowed) != expected {
+			t.Error(ip, "should be allowed:", expected)
+		}
+	}
+	if !isAllowedClient(&net.TCPAddr{IP: net.ParseIP("192.168.1.5")}, nil) {
+		t.Error("without -allowedClients, every client should be allowed")
+	}
+}
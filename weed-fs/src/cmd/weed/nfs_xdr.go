@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// errGarbageArgs is returned for calls whose arguments can not be decoded.
+var errGarbageArgs = errors.New("garbage arguments")
+
+// xdrReader decodes the XDR of the rpc calls, see RFC 4506. The first error
+// sticks, and the later reads return zero values.
+type xdrReader struct {
+	data []byte
+	err  error
+}
+
+func (r *xdrReader) fixed(n int) []byte {
+	padded := (n + 3) &^ 3
+	if r.err != nil || n < 0 || padded > len(r.data) {
+		r.err = errGarbageArgs
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[padded:]
+	return b
+}
+
+func (r *xdrReader) uint32() uint32 {
+	if b := r.fixed(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *xdrReader) uint64() uint64 {
+	if b := r.fixed(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+// opaque reads variable length data of at most max bytes.
+func (r *xdrReader) opaque(max int) []byte {
+	n := r.uint32()
+	if n > uint32(max) {
+		r.err = errGarbageArgs
+		return nil
+	}
+	return r.fixed(int(n))
+}
+
+func (r *xdrReader) string(max int) string {
+	return string(r.opaque(max))
+}
+
+// xdrWriter encodes the XDR of the rpc replies.
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) fixed(b []byte) {
+	w.Write(b)
+	if pad := len(b) & 3; pad != 0 {
+		w.Write(make([]byte, 4-pad))
+	}
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+func (w *xdrWriter) opaque(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.fixed(b)
+}
+
+func (w *xdrWriter) string(s string) {
+	w.opaque([]byte(s))
+}
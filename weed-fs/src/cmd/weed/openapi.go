@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+//go:generate go run ../apigen -dir . -out openapi_generated.go
+
+// openapiHandler serves the OpenAPI document of the server, generated from its
+// routes and handlers by go generate, with the version of the binary:
+//
+//	GET /openapi.json
+func openapiHandler(server string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(openapiDocuments[server]), &doc); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			writeJson(w, r, map[string]string{"error": err.Error()})
+			return
+		}
+		if info, ok := doc["info"].(map[string]interface{}); ok {
+			info["version"] = VERSION
+		}
+		writeJson(w, r, doc)
+	}
+}
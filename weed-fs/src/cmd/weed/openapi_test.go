@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenapiHandler(t *testing.T) {
+	for server, path := range map[string]string{"master": "/dir/assign", "volume": "/{fid}", "filer": "/{path}"} {
+		w := httptest.NewRecorder()
+		openapiHandler(server)(w, httptest.NewRequest("GET", "/openapi.json", nil))
+		var doc struct {
+			Openapi string
+			Info    struct{ Title, Version string }
+			Paths   map[string]map[string]interface{}
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || w.Code != 200 {
+			t.Fatal(server, "got", w.Code, err)
+		}
+		if doc.Openapi != "3.0.3" || doc.Info.Title != "weed "+server || doc.Info.Version != VERSION {
+			t.Error(server, "document is", doc.Openapi, doc.Info)
+		}
+		if _, ok := doc.Paths[path]["get"]; !ok || doc.Paths["/openapi.json"] == nil {
+			t.Error(server, "document lacks", path, "or /openapi.json")
+		}
+	}
+}
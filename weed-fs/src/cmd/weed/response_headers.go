@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"pkg/util"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The volume servers add the response headers configured per collection on
+// the master, and the filer the ones of its -headers file, per path prefix:
+//
+//   ["/www/assets/"]
+//   Cache-Control = "public, max-age=86400"
+//   Expires = "+86400"        # 86400 seconds after the request
+//
+//   ["/"]
+//   Access-Control-Allow-Origin = "*"
+//
+// Only the section with the longest prefix of the path applies.
+
+type headerRule struct {
+	prefix  string
+	headers map[string]string
+}
+
+func loadHeaderRules(fileName string) ([]headerRule, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := util.ParseToml(data)
+	if err != nil {
+		return nil, errors.New(fileName + ": " + err.Error())
+	}
+	var rules []headerRule
+	for prefix, keys := range sections {
+		if prefix == "" {
+			if len(keys) > 0 {
+				return nil, errors.New(fileName + ": the headers should be in a [\"/path/prefix\"] section")
+			}
+			continue
+		}
+		rule := headerRule{prefix: strings.Trim(prefix, "\""), headers: make(map[string]string)}
+		if !strings.HasPrefix(rule.prefix, "/") {
+			return nil, errors.New(fileName + ": [" + prefix + "] should be a path prefix starting with /")
+		}
+		for name, value := range keys {
+			rule.headers[http.CanonicalHeaderKey(name)] = value
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	return rules, nil
+}
+
+// headersFor returns the headers of the longest prefix of the path, nil if none.
+func headersFor(rules []headerRule, urlPath string) map[string]string {
+	for _, rule := range rules {
+		if strings.HasPrefix(urlPath, rule.prefix) {
+			return rule.headers
+		}
+	}
+	return nil
+}
+
+// setResponseHeaders sets the configured headers, with Expires = "+N" set to N seconds from now.
+func setResponseHeaders(header http.Header, headers map[string]string) {
+	for name, value := range headers {
+		if name == "Expires" && strings.HasPrefix(value, "+") {
+			if seconds, err := strconv.Atoi(value[1:]); err == nil {
+				value = time.Now().Add(time.Duration(seconds) * time.Second).UTC().Format(http.TimeFormat)
+			}
+		}
+		header.Set(name, value)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"pkg/storage"
+	"pkg/util"
+	"strconv"
+)
+
+func init() {
+	cmdRestore.Run = runRestore // break init cycle
+	IsDebug = cmdRestore.Flag.Bool("debug", false, "enable debug mode")
+}
+
+var cmdRestore = &Command{
+	UsageLine: "restore -target=/mnt/backup -volumeId=234 -dir=/tmp -volumeServer=localhost:8080",
+	Short:     "restore a backed up volume onto a volume server",
+	Long: `Restore copies the backed up .dat and .idx files of a volume into the data
+  directory of a volume server, and asks the volume server to load the volume.
+  The volume server reports the restored volume to the master with its next heartbeat.
+
+  `,
+}
+
+var (
+	restoreTarget       = cmdRestore.Flag.String("target", "", "backup folder that the volume was backed up to")
+	restoreVolumeId     = cmdRestore.Flag.Int("volumeId", -1, "a non-negative volume id. The volume should not exist in the dir.")
+	restoreDir          = cmdRestore.Flag.String("dir", "/tmp", "data directory of the volume server")
+	restoreVolumeServer = cmdRestore.Flag.String("volumeServer", "localhost:8080", "volume server that owns the data directory")
+	restoreCollection   = cmdRestore.Flag.String("collection", "", "collection of the volume, if any")
+)
+
+func runRestore(cmd *Command, args []string) bool {
+	if *restoreVolumeId == -1 || *restoreTarget == "" {
+		return false
+	}
+	fileName := volumeFileName(*restoreCollection, *restoreVolumeId)
+	if _, err := os.Stat(path.Join(*restoreDir, fileName+".dat")); err == nil {
+		log.Fatalf("Restore Volume [ERROR] volume %s already exists in %s\n", fileName, *restoreDir)
+	}
+	repType, err := readReplicationType(path.Join(*restoreTarget, fileName+".dat"))
+	if err != nil {
+		log.Fatalf("Restore Volume [ERROR] %s\n", err)
+	}
+	for _, ext := range []string{".key", ".idx", ".dat"} {
+		copied, err := copyVolumeFile(path.Join(*restoreTarget, fileName+ext), path.Join(*restoreDir, fileName+ext), -1)
+		if ext == ".key" && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Restore Volume [ERROR] %s\n", err)
+		}
+		fmt.Println("Restored", fileName+ext, "to", *restoreDir, "copied", copied, "bytes")
+	}
+	if err = loadVolume(*restoreVolumeServer, strconv.Itoa(*restoreVolumeId), *restoreCollection, repType); err != nil {
+		log.Fatalf("Load Volume [ERROR] %s\n", err)
+	}
+	fmt.Println("Volume", fileName, "is loaded on", *restoreVolumeServer)
+	return true
+}
+
+func readReplicationType(dataFileName string) (storage.ReplicationType, error) {
+	dataFile, err := os.Open(dataFileName)
+	if err != nil {
+		return storage.CopyNil, err
+	}
+	defer dataFile.Close()
+	header := make([]byte, storage.SuperBlockSize)
+	if _, err = dataFile.Read(header); err != nil {
+		return storage.CopyNil, err
+	}
+	return storage.NewReplicationTypeFromByte(header[1])
+}
+
+func loadVolume(server string, vid string, collection string, repType storage.ReplicationType) error {
+	values := make(url.Values)
+	values.Add("volume", vid)
+	values.Add("collection", collection)
+	values.Add("replicationType", repType.String())
+	jsonBlob, err := util.Post("http://"+server+"/admin/assign_volume", values)
+	if err != nil {
+		return err
+	}
+	var ret struct {
+		Error string
+	}
+	if err = json.Unmarshal(jsonBlob, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	return nil
+}
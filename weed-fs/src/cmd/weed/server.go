@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	cmdServer.Run = runServer // break init cycle
+	// every master, volume and filer flag is also a server flag, with the command as prefix
+	for prefix, cmd := range map[string]*Command{"master.": cmdMaster, "volume.": cmdVolume, "filer.": cmdFiler} {
+		cmd.Flag.VisitAll(func(f *flag.Flag) {
+			if f.Name != "debug" {
+				cmdServer.Flag.Var(f.Value, prefix+f.Name, f.Usage)
+			}
+		})
+	}
+}
+
+var cmdServer = &Command{
+	UsageLine: "server -dir=/tmp/weed -volume.max=7",
+	Short:     "start a master, a volume server and a filer in one process",
+	Long: `start a master, a volume server and, with -filer, a filer in one process, for
+  development environments and small deployments with a single machine.
+
+  The master data, the volumes and the filer meta data are kept in the master, volume
+  and filer sub directories of -dir, unless -master.mdir, -volume.dir or -filer.dir are
+  set. The volume server and the filer use the master of the process. Each master,
+  volume and filer flag can be set with the command as prefix, e.g.
+  -master.port=9333 -volume.port=8080 -volume.max=7 -filer.port=8888.
+
+  There is one volume server in the process, which can hold volumes in several
+  directories with a comma separated -volume.dir. Settings shared by the whole process,
+  -requestTimeout and -faults, are taken from the volume server flags.
+
+  `,
+}
+
+var (
+	serverDir   = cmdServer.Flag.String("dir", "/tmp/weed", "directory for the master, volume and filer data")
+	serverFiler = cmdServer.Flag.Bool("filer", true, "also start a filer")
+)
+
+func runServer(cmd *Command, args []string) bool {
+	set := make(map[string]bool)
+	cmd.Flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, dir := range map[string]*string{"master.mdir": metaFolder, "volume.dir": volumeFolder, "filer.dir": filerDir} {
+		if !set[name] {
+			*dir = path.Join(*serverDir, strings.TrimSuffix(name, path.Ext(name)))
+		}
+		for _, d := range strings.Split(*dir, ",") {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				log.Fatalf("Can not create %s: %s", d, err)
+			}
+		}
+	}
+	master := "localhost:" + strconv.Itoa(*mport)
+	if !set["volume.mserver"] {
+		*masterNode = master
+	}
+	if !set["filer.master"] {
+		*filerMaster = master
+	}
+
+	go runMaster(cmdMaster, nil)
+	// the volume server starts once the master answers, so its settings shared
+	// by the whole process are the last ones set, and its first heartbeat is not lost
+	if err := waitForServer(master, 30*time.Second); err != nil {
+		log.Fatalf("Master did not start: %s", err)
+	}
+	if *serverFiler {
+		go runFiler(cmdFiler, nil)
+	}
+	return runVolume(cmdVolume, nil)
+}
+
+// waitForServer waits until the server answers http requests.
+func waitForServer(server string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := http.Get("http://" + server + "/stats")
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
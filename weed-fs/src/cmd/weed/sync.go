@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"pkg/operation"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	cmdSync.Run = runSync // break init cycle
+	IsDebug = cmdSync.Flag.Bool("debug", false, "enable debug mode")
+}
+
+var cmdSync = &Command{
+	UsageLine: "sync -filer=localhost:8888 -dir=/local/dir -path=/remote/dir/ [-download] [-delete]",
+	Short:     "sync a local directory with a filer directory, copying only the differences",
+	Long: `Sync compares the files under a local directory with the files under a
+  filer directory, and uploads the files that are missing or different on the
+  filer. With -download, it downloads the files missing or different locally
+  instead. With -delete, the files only on the destination are deleted.
+
+  Files are different if their sizes or last modified times differ. The
+  uploaded files keep the local modification time on the filer, and the
+  downloaded files get the modification time of the filer, so unchanged files
+  are skipped the next time. With -checksum, files of the same size are
+  compared by their md5 instead, computed on the volume servers.
+
+  -concurrency files are copied at the same time, within -limitKBps overall.
+
+  `,
+}
+
+var (
+	syncFiler       = cmdSync.Flag.String("filer", "localhost:8888", "filer server location")
+	syncDir         = cmdSync.Flag.String("dir", "", "local directory")
+	syncPath        = cmdSync.Flag.String("path", "/", "filer directory")
+	syncDownload    = cmdSync.Flag.Bool("download", false, "download from the filer, instead of uploading to it")
+	syncDelete      = cmdSync.Flag.Bool("delete", false, "delete the files that are only on the destination")
+	syncChecksum    = cmdSync.Flag.Bool("checksum", false, "compare files of the same size by md5, instead of by last modified time")
+	syncConcurrency = cmdSync.Flag.Int("concurrency", 4, "number of files copied at the same time")
+	syncLimitKBps   = cmdSync.Flag.Int("limitKBps", 0, "bandwidth limit in KB per second for all the copies. 0 means no limit")
+	syncDryRun      = cmdSync.Flag.Bool("dryRun", false, "only print what would be copied or deleted")
+)
+
+// remoteFile is a file under the filer directory, with the size, md5 and
+// last modified time returned by the /checksum of its volume server.
+type remoteFile struct {
+	Fid          string
+	Size         int64
+	Md5          string
+	LastModified int64
+}
+
+func runSync(cmd *Command, args []string) bool {
+	if *syncDir == "" {
+		return false
+	}
+	if *syncConcurrency < 1 {
+		*syncConcurrency = 1
+	}
+	remoteDir := strings.TrimSuffix(*syncPath, "/") + "/"
+	local, err := listLocalFiles(*syncDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can not list", *syncDir, ":", err)
+		setExitStatus(1)
+		return true
+	}
+	remote, err := listRemoteFiles(remoteDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can not list", remoteDir, "on", *syncFiler, ":", err)
+		setExitStatus(1)
+		return true
+	}
+	var limiter *bandwidthLimiter
+	if *syncLimitKBps > 0 {
+		limiter = newBandwidthLimiter(int64(*syncLimitKBps) * 1024)
+	}
+
+	var names []string
+	for name := range local {
+		names = append(names, name)
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var failed, copied, deleted int
+	var lock sync.Mutex
+	report := func(action, name string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			failed++
+			fmt.Fprintln(os.Stderr, action, name, "failed:", err)
+			return
+		}
+		if action == "delete" {
+			deleted++
+		} else {
+			copied++
+		}
+		fmt.Println(action, name)
+	}
+
+	tasks := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < *syncConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range tasks {
+				localPath, remotePath := filepath.Join(*syncDir, filepath.FromSlash(name)), remoteDir+name
+				l, r := local[name], remote[name]
+				// the remote file is only deleted when uploading, without comparing it
+				if r != nil && (l != nil || *syncDownload) {
+					if err := fetchChecksum(remotePath, r); err != nil {
+						report("compare", name, err)
+						continue
+					}
+				}
+				action, err := syncAction(localPath, l, r, *syncDownload, *syncDelete, *syncChecksum)
+				if action == "" || err != nil {
+					if err != nil {
+						report("compare", name, err)
+					}
+					continue
+				}
+				if !*syncDryRun {
+					switch action {
+					case "upload":
+						err = syncUpload(localPath, remotePath, l, limiter)
+					case "download":
+						err = syncDownloadFile(remotePath, localPath, r, limiter)
+					case "delete":
+						if *syncDownload {
+							err = os.Remove(localPath)
+						} else {
+							err = operation.Delete("http://" + *syncFiler + escapePath(remotePath))
+						}
+					}
+				}
+				report(action, name, err)
+			}
+		}()
+	}
+	for _, name := range names {
+		tasks <- name
+	}
+	close(tasks)
+	wg.Wait()
+
+	fmt.Println("Synced", *syncDir, "and", *syncFiler+remoteDir+":", copied, "copied,", deleted, "deleted,", failed, "failed")
+	if failed > 0 {
+		setExitStatus(1)
+	}
+	return true
+}
+
+// syncAction decides what to do with a file, given its local and remote
+// versions, either of which may be nil: "upload", "download", "delete" or "".
+func syncAction(localPath string, local os.FileInfo, remote *remoteFile, download, delete, byChecksum bool) (string, error) {
+	copyAction, source, destination := "upload", local != nil, remote != nil
+	if download {
+		copyAction, source, destination = "download", remote != nil, local != nil
+	}
+	if !source {
+		if destination && delete {
+			return "delete", nil
+		}
+		return "", nil
+	}
+	if !destination || local.Size() != remote.Size {
+		return copyAction, nil
+	}
+	if !byChecksum {
+		if local.ModTime().Unix() != remote.LastModified {
+			return copyAction, nil
+		}
+		return "", nil
+	}
+	sum, err := fileMd5(localPath)
+	if err != nil {
+		return "", err
+	}
+	if sum != remote.Md5 {
+		return copyAction, nil
+	}
+	return "", nil
+}
+
+// listLocalFiles returns the regular files under the directory, by their slash separated path relative to it.
+func listLocalFiles(dir string) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = info
+		return nil
+	})
+	if os.IsNotExist(err) && *syncDownload {
+		return files, nil
+	}
+	return files, err
+}
+
+// listRemoteFiles returns the files under the filer directory, recursively, by their path relative to it.
+func listRemoteFiles(dir string) (map[string]*remoteFile, error) {
+	files := make(map[string]*remoteFile)
+	var list func(sub string) error
+	list = func(sub string) error {
+		lastFileName := ""
+		for {
+			var listing struct {
+				Subdirectories []struct{ Name string }
+				Files          []struct{ Name, Fid string }
+				LastFileName   string
+				More           bool
+			}
+			listUrl := "http://" + *syncFiler + escapePath(dir+sub) + "?lastFileName=" + url.QueryEscape(lastFileName)
+			if err := getJson(listUrl, &listing); err != nil {
+				return err
+			}
+			for _, f := range listing.Files {
+				files[sub+f.Name] = &remoteFile{Fid: f.Fid}
+			}
+			for _, d := range listing.Subdirectories {
+				if err := list(sub + d.Name + "/"); err != nil {
+					return err
+				}
+			}
+			if !listing.More {
+				return nil
+			}
+			lastFileName = listing.LastFileName
+		}
+	}
+	return files, list("")
+}
+
+// fetchChecksum fills in the size, md5 and last modified time of the remote file.
+func fetchChecksum(remotePath string, r *remoteFile) error {
+	var checksum struct {
+		Size         int64
+		Md5          string
+		LastModified int64
+		Error        string
+	}
+	if err := getJson("http://"+*syncFiler+escapePath(remotePath)+"?checksum=true", &checksum); err != nil {
+		return err
+	}
+	if checksum.Error != "" {
+		return errors.New(checksum.Error)
+	}
+	r.Size, r.Md5, r.LastModified = checksum.Size, checksum.Md5, checksum.LastModified
+	return nil
+}
+
+func syncUpload(localPath, remotePath string, info os.FileInfo, limiter *bandwidthLimiter) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	uploadUrl := "http://" + *syncFiler + escapePath(remotePath) + "?ts=" + strconv.FormatInt(info.ModTime().Unix(), 10)
+	_, err = operation.Upload(uploadUrl, path.Base(remotePath), limiter.reader(f), nil)
+	return err
+}
+
+// syncDownloadFile downloads to a temporary file next to the local file,
+// and renames it in place once complete, with the remote modification time.
+func syncDownloadFile(remotePath, localPath string, r *remoteFile, limiter *bandwidthLimiter) error {
+	resp, err := http.Get("http://" + *syncFiler + escapePath(remotePath))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Unexpected status " + resp.Status)
+	}
+	if err = os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(localPath), ".weed-sync-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, limiter.reader(resp.Body))
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		modTime := time.Unix(r.LastModified, 0)
+		if err = os.Chtimes(tmp.Name(), modTime, modTime); err == nil {
+			err = os.Rename(tmp.Name(), localPath)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func fileMd5(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func getJson(url string, v interface{}) error {
+	return getJsonWith(http.DefaultClient, url, v)
+}
+
+func getJsonWith(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		return errors.New(resp.Status + ": " + string(body))
+	}
+	return nil
+}
+
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// bandwidthLimiter slows down the readers it wraps, so that together they
+// read no more than bytesPerSecond on average.
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	total          int64
+	lock           sync.Mutex
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// reader wraps r, or returns it as is without a limit.
+func (l *bandwidthLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, limiter: l}
+}
+
+// wait sleeps until n more bytes are within the limit.
+func (l *bandwidthLimiter) wait(n int) {
+	l.lock.Lock()
+	if l.start.IsZero() {
+		l.start = time.Now()
+	}
+	l.total += int64(n)
+	due := l.start.Add(time.Duration(l.total * int64(time.Second) / l.bytesPerSecond))
+	l.lock.Unlock()
+	time.Sleep(time.Until(due))
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := r.r.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
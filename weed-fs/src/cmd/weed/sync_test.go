@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncAction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weedfs_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	localPath := filepath.Join(dir, "a.txt")
+	ioutil.WriteFile(localPath, []byte("hello"), 0644)
+	modTime := time.Unix(1380000000, 0)
+	os.Chtimes(localPath, modTime, modTime)
+	local, _ := os.Stat(localPath)
+	const helloMd5 = "5d41402abc4b2a76b9719d911017c592"
+
+	for _, c := range []struct {
+		local                      os.FileInfo
+		remote                     *remoteFile
+		download, delete, checksum bool
+		expected                   string
+	}{
+		{local, nil, false, false, false, "upload"},
+		{local, &remoteFile{Size: 5, LastModified: 1380000000}, false, false, false, ""},
+		{local, &remoteFile{Size: 5, LastModified: 1380000001}, false, false, false, "upload"},
+		{local, &remoteFile{Size: 6, LastModified: 1380000000}, false, false, false, "upload"},
+		{local, &remoteFile{Size: 5, LastModified: 1380000001, Md5: helloMd5}, false, false, true, ""},
+		{local, &remoteFile{Size: 5, LastModified: 1380000000, Md5: "other"}, false, false, true, "upload"},
+		{nil, &remoteFile{Size: 5}, false, false, false, ""},
+		{nil, &remoteFile{Size: 5}, false, true, false, "delete"},
+		{nil, &remoteFile{Size: 5}, true, false, false, "download"},
+		{local, &remoteFile{Size: 5, LastModified: 1380000001}, true, false, false, "download"},
+		{local, nil, true, false, false, ""},
+		{local, nil, true, true, false, "delete"},
+	} {
+		action, err := syncAction(localPath, c.local, c.remote, c.download, c.delete, c.checksum)
+		if err != nil || action != c.expected {
+			t.Errorf("local %v, remote %+v, download %v, delete %v, checksum %v: got %q %v, expected %q",
+				c.local != nil, c.remote, c.download, c.delete, c.checksum, action, err, c.expected)
+		}
+	}
+}
+
+func TestListRemoteFiles(t *testing.T) {
+	// a filer with two files per page
+	listings := map[string]string{
+		"/docs/?lastFileName=":         `{"Subdirectories":[{"Name":"sub dir"}],"Files":[{"Name":"a","Fid":"3,01"},{"Name":"b","Fid":"3,02"}],"LastFileName":"b","More":true}`,
+		"/docs/?lastFileName=b":        `{"Files":[{"Name":"c","Fid":"3,03"}]}`,
+		"/docs/sub dir/?lastFileName=": `{"Files":[{"Name":"d","Fid":"4,01"}]}`,
+	}
+	filer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listing, ok := listings[r.URL.Path+"?"+r.URL.RawQuery]
+		if !ok {
+			t.Error("unexpected listing of", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(listing))
+	}))
+	defer filer.Close()
+	defer func(filer string) { *syncFiler = filer }(*syncFiler)
+	*syncFiler = strings.TrimPrefix(filer.URL, "http://")
+
+	files, err := listRemoteFiles("/docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"a": "3,01", "b": "3,02", "c": "3,03", "sub dir/d": "4,01"}
+	if len(files) != len(expected) {
+		t.Fatal("listed", files)
+	}
+	for name, fid := range expected {
+		if files[name] == nil || files[name].Fid != fid {
+			t.Error(name, "listed as", files[name])
+		}
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	var nilLimiter *bandwidthLimiter
+	if r := bytes.NewReader(nil); nilLimiter.reader(r) != r {
+		t.Error("no limit should not wrap the reader")
+	}
+	limiter := newBandwidthLimiter(100 * 1024)
+	start := time.Now()
+	data, err := ioutil.ReadAll(limiter.reader(bytes.NewReader(make([]byte, 50*1024))))
+	if err != nil || len(data) != 50*1024 {
+		t.Fatal("read", len(data), err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Error("read 50KB at 100KBps in", elapsed)
+	}
+}
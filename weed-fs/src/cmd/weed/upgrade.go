@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"pkg/storage"
+	"pkg/util"
+	"sort"
+)
+
+func init() {
+	cmdUpgrade.Run = runUpgrade // break init cycle
+	IsDebug = cmdUpgrade.Flag.Bool("debug", false, "enable debug mode")
+}
+
+var cmdUpgrade = &Command{
+	UsageLine: "upgrade -master=localhost:9333 [-dryRun]",
+	Short:     "rewrite the volumes of older needle formats in the current one",
+	Long: `Upgrade lists the volumes of the cluster whose needle format version is
+  older than the current one, and asks each volume server holding a replica of
+  them to rewrite it with /admin/upgrade_volume, one volume at a time, so the
+  cluster keeps serving. A volume is locked while it is rewritten, like during
+  a vacuum.
+
+  Volumes of older versions are read and written in their own version until
+  they are upgraded, so upgrading weed-fs never needs to convert the volumes at
+  once. Volume servers skip the volumes of a version newer than theirs, written
+  by a newer weed-fs, instead of corrupting them.
+
+  `,
+}
+
+var (
+	upgradeMaster = cmdUpgrade.Flag.String("master", "localhost:9333", "master server location")
+	upgradeDryRun = cmdUpgrade.Flag.Bool("dryRun", false, "only print the volume replicas that would be upgraded")
+)
+
+type volumeReplica struct {
+	Url string
+	storage.VolumeInfo
+}
+
+// adminUrl is where the /admin/ api of the volume server is called, from the
+// AdminUrls of /vol/status, which lists the servers serving it on another port.
+func adminUrl(adminUrls map[string]string, server string) string {
+	if admin, ok := adminUrls[server]; ok {
+		return admin
+	}
+	return server
+}
+
+func runUpgrade(cmd *Command, args []string) bool {
+	var status struct {
+		Volumes struct {
+			DataCenters map[string]map[string]map[string][]storage.VolumeInfo
+			AdminUrls   map[string]string
+		}
+	}
+	if err := getJson("http://"+*upgradeMaster+"/vol/status", &status); err != nil {
+		fmt.Fprintln(os.Stderr, "Can not list the volumes of", *upgradeMaster, ":", err)
+		setExitStatus(1)
+		return true
+	}
+	var replicas []*volumeReplica
+	for _, racks := range status.Volumes.DataCenters {
+		for _, nodes := range racks {
+			for node, infos := range nodes {
+				for _, info := range infos {
+					if info.Version < storage.CurrentVersion {
+						replicas = append(replicas, &volumeReplica{Url: adminUrl(status.Volumes.AdminUrls, node), VolumeInfo: info})
+					}
+				}
+			}
+		}
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		if replicas[i].Id != replicas[j].Id {
+			return replicas[i].Id < replicas[j].Id
+		}
+		return replicas[i].Url < replicas[j].Url
+	})
+	if *upgradeDryRun {
+		for _, r := range replicas {
+			fmt.Println("volume", r.Id, "on", r.Url, "is needle version", r.Version)
+		}
+		fmt.Println(len(replicas), "volume replicas to upgrade")
+		return true
+	}
+	var failed int
+	for _, r := range replicas {
+		var result struct{ Error string }
+		body, err := util.Post("http://"+r.Url+"/admin/upgrade_volume", url.Values{"volume": {r.Id.String()}})
+		if err == nil {
+			err = json.Unmarshal(body, &result)
+		}
+		if err == nil && result.Error != "" {
+			err = errors.New(result.Error)
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintln(os.Stderr, "Upgrading volume", r.Id, "on", r.Url, "failed:", err)
+			continue
+		}
+		fmt.Println("Upgraded volume", r.Id, "on", r.Url, "from needle version", r.Version, "to", storage.CurrentVersion)
+	}
+	fmt.Println(len(replicas)-failed, "volume replicas upgraded,", failed, "failed")
+	if failed > 0 {
+		setExitStatus(1)
+	}
+	return true
+}
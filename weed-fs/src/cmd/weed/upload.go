@@ -2,22 +2,33 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"net/url"
+	"mime"
 	"os"
+	"path/filepath"
+	"pkg/directory"
 	"pkg/operation"
-	"pkg/util"
-	"strconv"
 )
 
-var uploadReplication *string
+var (
+	uploadReplication *string
+	uploadCollection  *string
+	uploadMaxMB       *int
+	uploadResume      *string
+	uploadAuth        *string
+	uploadParallel    *int
+)
 
 func init() {
 	cmdUpload.Run = runUpload // break init cycle
 	IsDebug = cmdUpload.Flag.Bool("debug", false, "verbose debug information")
 	server = cmdUpload.Flag.String("server", "localhost:9333", "weedfs master location")
-	uploadReplication = cmdUpload.Flag.String("replication", "000", "replication type(000,001,010,100,110,200)")
+	uploadReplication = cmdUpload.Flag.String("replication", "000", "replication type(000,001,010,100,110,200,1000)")
+	uploadCollection = cmdUpload.Flag.String("collection", "", "optional collection name")
+	uploadMaxMB = cmdUpload.Flag.Int("maxMB", 0, "split the files larger than this many MB into chunks of it, 0 for no chunks")
+	uploadResume = cmdUpload.Flag.String("resume", "", "the fid of the manifest of an interrupted chunked upload of the file, to upload its missing chunks")
+	uploadAuth = cmdUpload.Flag.String("auth", "", "the signed query string of the writes to the resumed file, from /dir/sign?op=write&count=<chunks+1>")
+	uploadParallel = cmdUpload.Flag.Int("parallel", 4, "how many chunks of a file are uploaded at a time")
 }
 
 var cmdUpload = &Command{
@@ -27,45 +38,34 @@ var cmdUpload = &Command{
   It uses consecutive file keys for the list of files.
   e.g. If the file1 uses key k, file2 can be read via k_1
 
-  `,
-}
+  With -maxMB, the files larger than it are uploaded in chunks of that size, each
+  a file of its own, and a chunk manifest, whose fid is the one printed, and which
+  serves the whole file. An interrupted chunked upload is finished with
+    weed upload -resume=<manifest fid> [-auth=<signed query string>] file
+  sending only the chunks the volume servers miss. The chunks are sent -parallel
+  at a time, each retried alone, and weed download reads them back the same way.
 
-type AssignResult struct {
-	Fid       string "fid"
-	Url       string "url"
-	PublicUrl string "publicUrl"
-	Count     int
-	Error     string "error"
+  `,
 }
 
-func assign(count int) (*AssignResult, error) {
-	values := make(url.Values)
-	values.Add("count", strconv.Itoa(count))
-	values.Add("replication", *uploadReplication)
-	jsonBlob, err := util.Post("http://"+*server+"/dir/assign", values)
-	debug("assign result :", string(jsonBlob))
-	if err != nil {
-		return nil, err
-	}
-	var ret AssignResult
-	err = json.Unmarshal(jsonBlob, &ret)
-	if err != nil {
-		return nil, err
-	}
-	if ret.Count <= 0 {
-		return nil, errors.New(ret.Error)
-	}
-	return &ret, nil
+func assign(count int) (*operation.AssignResult, error) {
+	ret, err := operation.Assign(*server, count, *uploadCollection, *uploadReplication)
+	debug("assign result :", ret, err)
+	return ret, err
 }
 
-func upload(filename string, server string, fid string) (int, error) {
+func upload(filename string, server string, fid string, auth string) (int, error) {
 	debug("Start uploading file:", filename)
 	fh, err := os.Open(filename)
 	if err != nil {
 		debug("Failed to open file:", filename)
 		return 0, err
 	}
-	ret, e := operation.Upload("http://"+server+"/"+fid, filename, fh)
+	uploadUrl := directory.FileUrl(server, fid, "")
+	if auth != "" {
+		uploadUrl += "?" + auth
+	}
+	ret, e := operation.Upload(uploadUrl, filename, fh, nil)
 	if e != nil {
 	  return 0, e
 	}
@@ -79,18 +79,27 @@ type SubmitResult struct {
 }
 
 func submit(files []string) []SubmitResult {
-	ret, err := assign(len(files))
+	results := make([]SubmitResult, len(files))
+	var plain []int // the indexes of the files uploaded whole, with consecutive keys
+	for index, file := range files {
+		if stat, err := os.Stat(file); err == nil && *uploadMaxMB > 0 && stat.Size() > int64(*uploadMaxMB)*1024*1024 {
+			results[index] = uploadChunked(file, stat.Size())
+		} else {
+			plain = append(plain, index)
+		}
+	}
+	if len(plain) == 0 {
+		return results
+	}
+	ret, err := assign(len(plain))
 	if err != nil {
 		fmt.Println(err)
 		return nil
 	}
-	results := make([]SubmitResult, len(files))
-	for index, file := range files {
-		fid := ret.Fid
-		if index > 0 {
-			fid = fid + "_" + strconv.Itoa(index)
-		}
-		results[index].Size, err = upload(file, ret.PublicUrl, fid)
+	fids := directory.FileIds(ret.Fid, len(plain))
+	for i, index := range plain {
+		fid := fids[i]
+		results[index].Size, err = upload(files[index], ret.PublicUrl, fid, ret.Auth)
 		if err != nil {
 			fid = ""
 			results[index].Error = err.Error()
@@ -100,12 +109,53 @@ func submit(files []string) []SubmitResult {
 	return results
 }
 
+// uploadChunked uploads the file in chunks of -maxMB.
+func uploadChunked(filename string, size int64) (result SubmitResult) {
+	debug("Start uploading file in chunks:", filename)
+	fh, err := os.Open(filename)
+	if err == nil {
+		defer fh.Close()
+		options := operation.ChunkedOptions{ChunkSize: int64(*uploadMaxMB) * 1024 * 1024, Collection: *uploadCollection, Replication: *uploadReplication, Parallelism: *uploadParallel}
+		result.Fid, err = operation.UploadChunked(*server, filepath.Base(filename), mime.TypeByExtension(filepath.Ext(filename)), fh, size, options)
+	}
+	if err != nil {
+		// the fid of the manifest is kept to resume the upload
+		result.Error = err.Error()
+	} else {
+		result.Size = int(size)
+	}
+	return result
+}
+
+// resumeUpload finishes the chunked upload of the file to the manifest of -resume.
+func resumeUpload(filename string) (result SubmitResult) {
+	result.Fid = *uploadResume
+	fh, err := os.Open(filename)
+	if err == nil {
+		defer fh.Close()
+		err = operation.ResumeChunked(*server, *uploadResume, *uploadAuth, fh, *uploadParallel)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	} else if stat, err := fh.Stat(); err == nil {
+		result.Size = int(stat.Size())
+	}
+	return result
+}
+
 func runUpload(cmd *Command, args []string) bool {
 	*IsDebug = true
 	if len(cmdUpload.Flag.Args()) == 0 {
 		return false
 	}
-	results := submit(args)
+	var results []SubmitResult
+	if *uploadResume != "" && len(args) != 1 {
+		results = []SubmitResult{{Error: "-resume takes the one file of the manifest"}}
+	} else if *uploadResume != "" {
+		results = []SubmitResult{resumeUpload(args[0])}
+	} else {
+		results = submit(args)
+	}
 	bytes, _ := json.Marshal(results)
 	fmt.Print(string(bytes))
 	return true
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"pkg/storage"
+	"pkg/topology"
+	"sort"
+	"strconv"
+)
+
+func init() {
+	cmdVerify.Run = runVerify // break init cycle
+	IsDebug = cmdVerify.Flag.Bool("debug", false, "enable debug mode")
+}
+
+var cmdVerify = &Command{
+	UsageLine: "verify -master=localhost:9333 -manifest=/mnt/backup/nightly.snapshot.json",
+	Short:     "check a restored cluster against the manifest of its backup",
+	Long: `Verify cross-checks a cluster restored from a snapshot backup, made with
+  weed backup -snapshot, against the manifest saved with the backup, to prove
+  that the backup can be restored, e.g. in a disaster recovery drill.
+
+  Every volume of the manifest should be on the cluster, in the same collection,
+  with the number of files of the manifest on each of its replicas. The backed up
+  files of each volume, in the folder of the manifest or -backup, should also be
+  as long as its cut in the snapshot. Unless -checksums=false, the live files of
+  each replica are read and checked by its volume server, with /admin/digest,
+  signed with -secureKey for the collections with signed reads, and should match
+  the backed up ones, read the same way. The backed up volumes
+  are opened like a volume server opens them, so the folder has to be writable,
+  and the volumes encrypted at rest need the -encryptionKeyFile of the servers.
+
+  Each discrepancy is printed, and the exit status is 1 if there is any. The
+  volumes of the cluster not in the manifest are listed, but are not discrepancies.
+
+  `,
+}
+
+var (
+	verifyMaster    = cmdVerify.Flag.String("master", "localhost:9333", "master of the restored cluster")
+	verifyManifest  = cmdVerify.Flag.String("manifest", "", "manifest of the snapshot, saved by weed backup -snapshot")
+	verifyBackup    = cmdVerify.Flag.String("backup", "", "folder of the backed up volumes, by default the folder of the manifest")
+	verifyChecksums = cmdVerify.Flag.Bool("checksums", true, "read and compare the files of the volumes, not only their counts")
+	verifyKeyFile   = cmdVerify.Flag.String("encryptionKeyFile", "", "master key of the volumes encrypted at rest")
+	verifySecureKey = cmdVerify.Flag.String("secureKey", "", "secret of the volume servers, to sign the digests of the collections with signed reads")
+)
+
+// verifyReplica is a replica of a volume on the restored cluster.
+type verifyReplica struct {
+	Url  string
+	Info storage.VolumeInfo
+}
+
+func runVerify(cmd *Command, args []string) bool {
+	if *verifyManifest == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(*verifyManifest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		setExitStatus(1)
+		return true
+	}
+	var s topology.Snapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		fmt.Fprintln(os.Stderr, "Can not read the manifest", *verifyManifest, ":", err)
+		setExitStatus(1)
+		return true
+	}
+	backupDir := *verifyBackup
+	if backupDir == "" {
+		backupDir = path.Dir(*verifyManifest)
+	}
+	replicas, err := listVolumeReplicas(*verifyMaster)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can not list the volumes of", *verifyMaster, ":", err)
+		setExitStatus(1)
+		return true
+	}
+	var backup *storage.Store
+	if *verifyChecksums {
+		if backup, err = openBackupStore(backupDir, len(s.Volumes)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			setExitStatus(1)
+			return true
+		}
+		defer backup.Close()
+	}
+
+	discrepancies := 0
+	report := func(v *topology.SnapshotVolume, a ...interface{}) {
+		discrepancies++
+		fmt.Println(append([]interface{}{"volume", v.Id, "FAILED:"}, a...)...)
+	}
+	inManifest := make(map[storage.VolumeId]bool)
+	for _, v := range s.Volumes {
+		inManifest[v.Id] = true
+		before := discrepancies
+		fileName := volumeFileName(v.Collection, int(v.Id))
+		sizes := map[string]int64{".dat": v.DataSize, ".idx": v.IndexSize}
+		for _, ext := range []string{".idx", ".dat"} {
+			if stat, err := os.Stat(path.Join(backupDir, fileName+ext)); err != nil {
+				report(v, "backup", err)
+			} else if stat.Size() != sizes[ext] {
+				report(v, "backup", fileName+ext, "has", stat.Size(), "bytes, the snapshot cut it at", sizes[ext])
+			}
+		}
+		if len(replicas[v.Id]) == 0 {
+			report(v, "not on the cluster")
+			continue
+		}
+		var expected *storage.VolumeDigest
+		if backup != nil {
+			if expected, err = backup.VolumeDigest(v.Id.String()); err != nil {
+				report(v, "can not read the backup:", err)
+			}
+		}
+		for _, r := range replicas[v.Id] {
+			if r.Info.Collection != v.Collection {
+				report(v, "on", r.Url, "is in collection", strconv.Quote(r.Info.Collection), "instead of", strconv.Quote(v.Collection))
+			}
+			if r.Info.FileCount != v.FileCount {
+				report(v, "on", r.Url, "has", r.Info.FileCount, "files in its index, the snapshot has", v.FileCount)
+			}
+			if expected == nil {
+				continue
+			}
+			var digest storage.VolumeDigest
+			if err = getJson("http://"+r.Url+"/admin/digest?"+signedDumpQuery(*verifySecureKey, url.Values{"volume": {v.Id.String()}}), &digest); err != nil {
+				report(v, "on", r.Url, "can not be read:", err)
+			} else if digest.FileCount != expected.FileCount || digest.Bytes != expected.Bytes || digest.Digest != expected.Digest {
+				report(v, "on", r.Url, "has", digest.FileCount, "live files of", digest.Bytes, "bytes, digest", digest.Digest+",",
+					"the backup has", expected.FileCount, "live files of", expected.Bytes, "bytes, digest", expected.Digest)
+			}
+		}
+		if discrepancies == before {
+			fmt.Println("volume", v.Id, "ok on", len(replicas[v.Id]), "replicas")
+		}
+	}
+	var extra []int
+	for vid := range replicas {
+		if !inManifest[vid] {
+			extra = append(extra, int(vid))
+		}
+	}
+	sort.Ints(extra)
+	for _, vid := range extra {
+		fmt.Println("volume", vid, "is on the cluster, but not in snapshot", s.Name)
+	}
+	fmt.Println("Verified", len(s.Volumes), "volumes of snapshot", s.Name, "on", *verifyMaster+":", discrepancies, "discrepancies,", len(extra), "volumes not in the snapshot")
+	if discrepancies > 0 {
+		setExitStatus(1)
+	}
+	return true
+}
+
+// listVolumeReplicas lists the replicas of each volume of a cluster, from the /vol/status of its master.
+func listVolumeReplicas(master string) (map[storage.VolumeId][]*verifyReplica, error) {
+	var status struct {
+		Volumes struct {
+			DataCenters map[string]map[string]map[string][]storage.VolumeInfo
+			AdminUrls   map[string]string
+		}
+	}
+	if err := getJson("http://"+master+"/vol/status", &status); err != nil {
+		return nil, err
+	}
+	replicas := make(map[storage.VolumeId][]*verifyReplica)
+	for _, racks := range status.Volumes.DataCenters {
+		for _, nodes := range racks {
+			for node, infos := range nodes {
+				for _, info := range infos {
+					replicas[info.Id] = append(replicas[info.Id], &verifyReplica{Url: adminUrl(status.Volumes.AdminUrls, node), Info: info})
+				}
+			}
+		}
+	}
+	return replicas, nil
+}
+
+// openBackupStore opens the backed up volumes, with the master key if they are encrypted.
+func openBackupStore(dir string, count int) (*storage.Store, error) {
+	store := storage.NewStore(0, "", "", []string{dir}, []int{count})
+	if *verifyKeyFile != "" {
+		data, err := ioutil.ReadFile(*verifyKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		masterKey, err := storage.ParseMasterKey(data)
+		if err == nil {
+			err = store.SetMasterKey(masterKey)
+		}
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
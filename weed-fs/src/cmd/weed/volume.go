@@ -1,17 +1,28 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
+	"errors"
 	"log"
 	"math/rand"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path"
+	"pkg/directory"
+	"pkg/notification"
 	"pkg/operation"
 	"pkg/storage"
+	"pkg/util"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,51 +36,695 @@ var cmdVolume = &Command{
 	Short:     "start a volume server",
 	Long: `start a volume server to provide storage spaces
 
+  The web UI at /ui/ shows the volumes on this server.
+
+  POST /3,01637037d6?append=true   append the uploaded content to the existing file,
+                                   which should be uploaded with the same file name
+
+  GET /3,01637037d6 with Range: bytes=0-65535
+                                   a range of the file, of its content as uploaded, never
+                                   gzipped, answered with 206 and its Content-Range
+  HEAD /3,01637037d6               the headers of the GET, with its Content-Length, e.g. for
+                                   the size and the X-Weed-Meta-* pairs of the file
+
+  PUT /3,01637037d6?size=1048576&filename=movie.mp4
+                                   create a file of the size, up to 256MB, then write its ranges in any
+                                   order, e.g. in parallel, each with a PUT and its
+                                   Content-Range: bytes 0-65535/1048576; the answers list the
+                                   ranges missing, and the file is stored and replicated with
+                                   the last one. Unfinished files are dropped after
+                                   -partialUploadHours
+
+  POST /3,01637037d6?cm=true       upload the json manifest of a chunked file, listing the fids,
+                                   offsets, sizes and MD5s of its chunks, uploaded as files of
+                                   their own; a GET serves the chunks in order, with ranges, and
+                                   a DELETE deletes them too. A manifest marked pending is kept
+                                   but not served, and one uploaded complete is refused with 409
+                                   while chunks are missing; see weed upload -maxMB
+  GET /3,01637037d6?chunks=missing the manifest and the indexes of its chunks missing, or not
+                                   of their size and MD5, to resume the upload; ?cm=false
+                                   returns the manifest itself
+
+  GET /multi_get?volumeId=3&fid=01637037d6.jpg&fid=0263c1d2e8.jpg
+                                   several files of one volume in one multipart/mixed
+                                   response, e.g. for pages of thumbnails stored together
+
+  GET /checksum?fid=3,01637037d6.jpg
+                                   the size, CRC32-C and MD5 of the file as a GET returns it,
+                                   computed on the server, to compare with a local copy
+
+  GET /admin/export?volume=3         all files of the volume as a tar, read in the order they
+                                   are on disk, for exports and backups
+
+  GET /admin/settings?maxConcurrentWrites=64&readOnly=true
+                                   change settings while the server runs, without dropping
+                                   the requests in flight, and list them
+
+  POST /admin/upgrade_volume?volume=3
+                                   rewrite a volume of an older needle format in the current
+                                   one, like a vacuum; weed upgrade does it for a whole cluster
+
+  POST /admin/clone_volume?volume=3&newVolume=9
+                                   copy the sealed volume 3 as volume 9, sharing its data file
+                                   until one of them changes it; see /vol/clone on the master
+
+  POST /admin/offload_volume?volume=3
+                                   upload the data file of the sealed volume 3 to the -remote
+                                   tier, and read it from there by blocks of 1MB, cached in
+                                   -remoteCacheMB, dropping the local copy; the index stays here
+  POST /admin/recall_volume?volume=3
+                                   download the data file of the offloaded volume 3 back, and
+                                   remove its remote copy
+
+  POST /admin/mirror_volume?volume=3&collection=&source=10.0.0.2:8080
+                                   copy the sealed volume 3 from the server source, from its
+                                   /admin/volume_file?volume=3&ext=.dat, .idx and .key, as an
+                                   extra read only replica of a hot volume; see -hotVolumeReads
+                                   on the master
+
+  POST /admin/replicate_volume?volume=3&collection=&source=10.0.0.2:8080
+                                   copy volume 3 from the server source, where a snapshot pins
+                                   it, in place of a replica lost with its server: the .idx and
+                                   the .dat, then what they grew by meanwhile, from ?offset=,
+                                   until nothing changed; see -replicateDelaySeconds on the master
+
+  GET /admin/digest?volume=3         the count, the size and a digest of the live files of the
+                                   volume, whatever their order on disk, checking each file;
+                                   see weed verify
+
+  POST /admin/snapshot?name=nightly&volumes=3,4&ttl=3600
+                                   the data and index sizes of the volumes, where the snapshot
+                                   cuts them, pinning them for ttl seconds: they are not
+                                   vacuumed, and deleted files are not erased, until
+                                   /admin/snapshot/release?name=nightly; see /vol/snapshot
+
+  With -trashSeconds, a deleted file is only dropped from the index, and kept in the trash of
+  its volume, even through vacuums, until it is erased after -trashSeconds. Meanwhile
+  /admin/trash?volume=3 lists it, and /admin/undelete?fid=3,01637037d6 brings it back on all
+  the replicas.
+
+  -dir can list one directory per disk, e.g. -dir=/disk1,/disk2 -max=7,5. When a directory
+  fails, only its volumes are dropped, and the server keeps serving the others.
+  /admin/reload_dir?dir=/disk1 brings the directory back after the disk is replaced.
+
+  With -adminPort, the /admin/ api is only served on that port, so it can be firewalled apart
+  from the files on -port. The master learns the port with the heartbeats, calls the admin api
+  there, and lists it as "adminUrl" in the lookups and in the AdminUrls of /vol/status, for the
+  tools; reads and writes keep using "url". With -grpcPort, the files are also read with the
+  Volume gRPC service of pkg/operation/volume.proto, over HTTP/2 without TLS, on that port,
+  which the master learns the same way and lists as "grpcUrl" in the lookups.
+
+  The files of the collections read with signed urls, and of every collection until the first
+  heartbeat tells which ones are, are only served with signed urls, and the reads without one
+  are answered 503 until then. /admin/digest, /admin/export, /admin/modified_since, /admin/trash
+  and /admin/volume_file of their volumes need a query signed with -secureKey, as sent by the
+  other volume servers, weed merge -secureKey and weed verify -secureKey. /admin/undelete needs
+  one whenever there is a -secureKey, like the deletes.
+
+  A write keeps the last modified time of its ts=unix seconds parameter, as the replicas, weed
+  merge, weed mirror and the filer send, only if it is signed with -secureKey for op=write_at,
+  or op=replicate for the replicas; the write urls the master hands to the clients do not allow
+  it. Without -secureKey, any write can. Only the writes signed for op=replicate skip the upload
+  limits of the collection, which the first replica checked.
+
+  With -remote, the sealed volumes offloaded with /admin/offload_volume keep only their index on
+  this server, and their files are read from the bucket by blocks, the ones read last kept in
+  -remoteCacheMB of memory; /stats shows the cache hits and the blocks read from the bucket as
+  "RemoteTier". The deletes only drop the files from the index, and the vacuums, clones,
+  mirrors and snapshots of an offloaded volume need it recalled first.
+
+  With -readCacheMB, recently read files are kept in memory, and /stats shows the cache hits.
+  Concurrent reads of the same file share one read of the volume, e.g. when a stampede hits a
+  popular file; /stats counts them as "Coalesced".
+
+  A server with many volumes can run out of file descriptors, as each volume keeps its data,
+  index and trash files open. With -maxOpenFiles, the least recently used files are closed
+  when more are open, and opened again when used. /stats shows the open files, and how often
+  they are closed and opened again, as a budget too small for the hot volumes shows in Reopens.
+
+  With -needleAlignment=4096, each file of the volumes created on SSDs starts on a page of
+  the device, so reading it reads no page more than needed, at the cost of padding the small
+  files to a page. The alignment is kept in each volume, and a vacuum moves the volumes
+  created with another alignment to the current one.
+
+  With -maxConcurrentWrites, extra uploads wait up to -writeQueueSeconds for a slot, and are
+  then rejected with 503 and Retry-After, so reads stay responsive during ingest spikes.
+
+  Replicated writes are logged in replication.intents in the first -dir before they are sent
+  to the other replicas, which all have to answer within -requestTimeout, or the write is
+  rolled back and fails, so a stuck replica can not hold an upload open. After a crash, the
+  writes cut short are sent to the replicas again, or deleted from them if the write was
+  rolled back locally. A replica sent the write it took already, as the last one of the
+  volume, does not append it twice; /stats counts these as "RetriedWrites".
+
+  When a volume is loaded, the needles after the last one in its index, appended before a
+  crash cut their index rows short, are indexed again, and a needle half written at the end
+  of the data file is truncated, rather than served; both are logged.
+
+  A replica failing -replicaFailures writes in a row is skipped until it answers again. The
+  writes are then acknowledged with 202 Accepted and "replicasPending", and sent to the
+  replica when it is back. /stats lists the skipped replicas.
+
+  -faults injects failures to test the replication and the repair end to end: dropped
+  heartbeats, delayed replicated writes, needles written with a wrong CRC and failed fsyncs,
+  each with a probability, e.g. -faults=heartbeat.drop=1,replicate.delay=3s.
+
+  -maxConcurrentWrites, -writeQueueSeconds, -readOnly, -latencyBudgets and -debug can change
+  while the server runs, with /admin/settings, or with a SIGHUP, which sets them again from
+  the WEED_VOLUME_* variables and weed.toml, except the ones given on the command line.
+
+  The admin operations changing volumes or settings, including the SIGHUP reloads, are
+  appended to audit.log in the first -dir, and listed with /admin/audit?since=&limit=100.
+
+  With -encryptionKeyFile or -encryptionKeyCommand, the file contents are encrypted with
+  AES-GCM, with a data key per volume, kept in its .key file wrapped with the master key.
+  The files written before stay readable, and the CRCs are over the encrypted contents.
+  After the master key is changed in the file or the KMS, /admin/rotate_key wraps the data
+  keys with it, and with reencrypt=true also rewrites each volume with a new data key in
+  the background, like a vacuum. /admin/reencryption shows the progress per volume.
+
+  With -notify, the uploads, appends, deletes and undeletes taken by the server are published
+  to a message queue as create, update, delete and create events, in json with the fid, size
+  and collection, so pipelines can react without polling. The replicas do not publish them
+  again. Events are published in the background, and dropped when the queue is unreachable
+  for long; /stats counts them.
+
   `,
 }
 
 var (
 	vport          = cmdVolume.Flag.Int("port", 8080, "http listen port")
-	volumeFolder   = cmdVolume.Flag.String("dir", "/tmp", "directory to store data files")
-	ip             = cmdVolume.Flag.String("ip", "localhost", "ip or server name")
+	vAdminPort     = cmdVolume.Flag.Int("adminPort", 0, "http listen port of the /admin/ api, to firewall it apart from the files. 0 serves it on -port")
+	vGrpcPort      = cmdVolume.Flag.Int("grpcPort", 0, "listen port of the Volume gRPC service, to read the files. 0 disables it")
+	volumeFolder   = cmdVolume.Flag.String("dir", "/tmp", "comma separated directories to store data files, usually one per disk")
+	ip             = cmdVolume.Flag.String("ip", "localhost", "ip or server name, e.g. 10.0.0.2 or 2001:db8::2")
 	publicUrl      = cmdVolume.Flag.String("publicUrl", "", "Publicly accessible <ip|server_name>:<port>")
 	masterNode     = cmdVolume.Flag.String("mserver", "localhost:9333", "master server location")
 	vpulse         = cmdVolume.Flag.Int("pulseSeconds", 5, "number of seconds between heartbeats, must be smaller than the master's setting")
-	maxVolumeCount = cmdVolume.Flag.Int("max", 5, "maximum number of volumes")
+	maxVolumeCount = cmdVolume.Flag.String("max", "5", "maximum number of volumes, or comma separated numbers for each -dir")
+	vDiskType      = cmdVolume.Flag.String("diskType", "hdd", "type of the disk holding -dir, e.g. hdd or ssd, for ?diskType= on assign")
+	vAlignment     = cmdVolume.Flag.Int("needleAlignment", storage.DefaultNeedleAlignment, "bytes the needles of the volumes created or compacted are aligned on, e.g. 4096 for the pages of an SSD")
+	vLabels        = cmdVolume.Flag.String("labels", "", "comma separated key=value labels, e.g. env=prod,disk=nvme, for ?constraint= on assign")
 	vReadTimeout   = cmdVolume.Flag.Int("readTimeout", 5, "connection read timeout in seconds")
+	vReqTimeout    = cmdVolume.Flag.Int("requestTimeout", 30, "seconds for the calls to the master and the other replicas made while handling one request. 0 means no limit")
+	vSecureKey     = cmdVolume.Flag.String("secureKey", "", "secret shared with the master to verify signed urls for writes and deletes. Empty disables the check")
+	vSignedReads   = cmdVolume.Flag.Bool("signedReads", false, "with -secureKey, also require signed urls for reads")
+	vCorsOrigins   = cmdVolume.Flag.String("corsOrigins", "", "comma separated origins allowed for browser based clients, \"*\" for any origin. Empty disables CORS")
 	vMaxCpu        = cmdVolume.Flag.Int("maxCpu", 0, "maximum number of CPUs. 0 means all available CPUs")
+	vMaxWrites     = cmdVolume.Flag.Int("maxConcurrentWrites", 0, "maximum number of uploads handled at the same time, others wait in a queue. 0 means no limit")
+	vLatencyBudget = cmdVolume.Flag.String("latencyBudgets", "read=500ms,write=1s,replicate=1s", "comma separated endpoint=duration budgets, requests over them are logged and counted in /stats")
+	vReadCacheMB   = cmdVolume.Flag.Int("readCacheMB", 0, "memory in MB to keep recently read files, for hot files. 0 disables the cache")
+	vRemote        = cmdVolume.Flag.String("remote", "", "S3 bucket the sealed volumes are offloaded to, e.g. s3://accessKey:secretKey@s3.amazonaws.com/bucket/prefix?region=us-east-1, or s3+http:// without TLS. Empty disables it")
+	vRemoteCacheMB = cmdVolume.Flag.Int("remoteCacheMB", 256, "memory in MB to keep the blocks recently read from the -remote tier")
+	vMaxOpenFiles  = cmdVolume.Flag.Int("maxOpenFiles", 0, "maximum number of volume files kept open, the idle ones are closed and opened again when used. 0 keeps them all open")
+	vWriteQueueSec = cmdVolume.Flag.Int("writeQueueSeconds", 5, "with -maxConcurrentWrites, seconds an upload can wait in the queue before it is rejected with 503")
+	vReplicaFails  = cmdVolume.Flag.Int("replicaFailures", 5, "failed writes in a row to a replica before it is skipped until it is back. 0 never skips replicas")
+	vReadOnly      = cmdVolume.Flag.Bool("readOnly", false, "refuse uploads and deletes, and report the volumes read only to the master")
+	vFaults        = cmdVolume.Flag.String("faults", "", "faults injected for testing, e.g. heartbeat.drop=0.5,replicate.delay=2s,needle.crc=0.01,fsync.fail=0.1. Never set it in production")
+	vTrashSeconds  = cmdVolume.Flag.Int("trashSeconds", 0, "seconds deleted files are kept in the trash, from where /admin/undelete brings them back. 0 erases them right away")
+	vPartialHours  = cmdVolume.Flag.Int("partialUploadHours", 24, "hours a file created with its size has to be written completely in ranges, before it is dropped")
+	vClusterSecret = cmdVolume.Flag.String("clusterSecret", "", "secret shared with the master to sign the heartbeats, when the master requires it")
+	vKeyFile       = cmdVolume.Flag.String("encryptionKeyFile", "", "file with the 32 byte master key, raw or in hex, to encrypt the file contents at rest. Empty disables encryption")
+	vKeyCommand    = cmdVolume.Flag.String("encryptionKeyCommand", "", "shell command printing the master key, e.g. fetching it from a KMS, instead of -encryptionKeyFile")
+	vNotify        = cmdVolume.Flag.String("notify", "", "message queue url to publish the file writes and deletes to, e.g. nsq://localhost:4151/files, redis://localhost:6379/files, kafka://localhost:9092/files, kafka-rest://localhost:8082/files or http://host/hook. Empty disables it")
+
+	// writeSlots holds one token per upload being handled. nil means no limit.
+	// It is replaced, with writeQueueSeconds, when the settings change.
+	writeSlots        chan bool
+	writeQueueSeconds int
+	writeSlotsLock    sync.Mutex
+
+	store          *storage.Store
+	volumeLatency  *util.LatencyStats
+	volumeAudit    *util.AuditLog
+	intentLog      *storage.IntentLog
+	volumeFilePool *storage.FilePool // nil when all the volume files stay open
+	// where the sealed volumes are offloaded, nil without -remote
+	volumeRemoteTier *storage.RemoteTier
 
-	store *storage.Store
+	volumeHttpOptions = newHttpServerOptions(&cmdVolume.Flag)
 )
 
+func volumeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	m := make(map[string]interface{})
+	m["Version"] = VERSION
+	m["Latency"] = volumeLatency.ToMap()
+	if cache := store.ReadCache(); cache != nil {
+		m["ReadCache"] = cache.ToMap()
+	}
+	m["Reads"] = store.ReadFlight()
+	m["RetriedWrites"] = store.RetriedWrites()
+	if volumeFilePool != nil {
+		m["OpenFiles"] = volumeFilePool.ToMap()
+	}
+	if volumeRemoteTier != nil {
+		m["RemoteTier"] = volumeRemoteTier.ToMap()
+	}
+	m["Replicas"] = replicaBreaker.ToMap()
+	m["DeferredReplications"] = deferredReplicationCount()
+	if volumeNotifier != nil {
+		m["Notifications"] = volumeNotifier.ToMap()
+	}
+	writeJson(w, r, m)
+}
 func statusHandler(w http.ResponseWriter, r *http.Request) {
 	m := make(map[string]interface{})
 	m["Version"] = VERSION
 	m["Volumes"] = store.Status()
+	m["Locations"] = store.Locations()
 	writeJson(w, r, m)
 }
+
+// reloadDirHandler brings back a failed -dir directory, e.g. after its disk is replaced.
+func reloadDirHandler(w http.ResponseWriter, r *http.Request) {
+	if err := store.ReloadDiskLocation(r.FormValue("dir")); err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, map[string]interface{}{"Locations": store.Locations()})
+}
 func assignVolumeHandler(w http.ResponseWriter, r *http.Request) {
-	err := store.AddVolume(r.FormValue("volume"), r.FormValue("replicationType"))
+	err := store.AddVolume(r.FormValue("volume"), r.FormValue("collection"), r.FormValue("replicationType"))
+	if err == nil {
+		writeJson(w, r, map[string]string{"error": ""})
+	} else {
+		writeJson(w, r, map[string]string{"error": err.Error()})
+	}
+	debug("volume =", r.FormValue("volume"), ", collection =", r.FormValue("collection"), ", replicationType =", r.FormValue("replicationType"), ", error =", err)
+}
+func deleteVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	err := store.DeleteVolume(r.FormValue("volume"))
+	if err == nil {
+		writeJson(w, r, map[string]string{"error": ""})
+	} else {
+		writeJson(w, r, map[string]string{"error": err.Error()})
+	}
+	debug("deleted volume =", r.FormValue("volume"), ", error =", err)
+}
+func vacuumVolumeCheckHandler(w http.ResponseWriter, r *http.Request) {
+	garbageRatio, err := store.CheckCompactVolume(r.FormValue("volume"))
+	if err == nil {
+		writeJson(w, r, map[string]interface{}{"error": "", "garbageRatio": garbageRatio})
+	} else {
+		writeJson(w, r, map[string]interface{}{"error": err.Error(), "garbageRatio": garbageRatio})
+	}
+	debug("checked compacting volume =", r.FormValue("volume"), "garbageRatio =", garbageRatio, ", error =", err)
+}
+func vacuumVolumeCompactHandler(w http.ResponseWriter, r *http.Request) {
+	err := store.CompactVolume(r.FormValue("volume"))
 	if err == nil {
 		writeJson(w, r, map[string]string{"error": ""})
 	} else {
 		writeJson(w, r, map[string]string{"error": err.Error()})
 	}
-	debug("volume =", r.FormValue("volume"), ", replicationType =", r.FormValue("replicationType"), ", error =", err)
+	debug("compacted volume =", r.FormValue("volume"), ", error =", err)
 }
+func upgradeVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	err := store.UpgradeVolume(r.FormValue("volume"))
+	if err == nil {
+		writeJson(w, r, map[string]string{"error": ""})
+	} else {
+		writeJson(w, r, map[string]string{"error": err.Error()})
+	}
+	debug("upgraded volume =", r.FormValue("volume"), ", error =", err)
+}
+func cloneVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	err := store.CloneVolume(r.FormValue("volume"), r.FormValue("newVolume"))
+	if err == nil {
+		writeJson(w, r, map[string]string{"error": ""})
+	} else {
+		writeJson(w, r, map[string]string{"error": err.Error()})
+	}
+	debug("cloned volume =", r.FormValue("volume"), "as", r.FormValue("newVolume"), ", error =", err)
+}
+func offloadVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	err := store.OffloadVolume(r.FormValue("volume"))
+	if err == nil {
+		writeJson(w, r, map[string]string{"error": ""})
+	} else {
+		writeJson(w, r, map[string]string{"error": err.Error()})
+	}
+	debug("offloaded volume =", r.FormValue("volume"), ", error =", err)
+}
+func recallVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	err := store.RecallVolume(r.FormValue("volume"))
+	if err == nil {
+		writeJson(w, r, map[string]string{"error": ""})
+	} else {
+		writeJson(w, r, map[string]string{"error": err.Error()})
+	}
+	debug("recalled volume =", r.FormValue("volume"), ", error =", err)
+}
+func digestHandler(w http.ResponseWriter, r *http.Request) {
+	if !isDumpAuthorized(w, r, r.FormValue("volume")) {
+		return
+	}
+	volumeId, err := storage.NewVolumeId(r.FormValue("volume"))
+	if err != nil || !store.HasVolume(volumeId) {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": "Volume " + r.FormValue("volume") + " is not found"})
+		return
+	}
+	digest, err := store.VolumeDigest(volumeId.String())
+	if err != nil {
+		// e.g. a corrupted file
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, r, digest)
+}
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	var vids []storage.VolumeId
+	for _, s := range strings.Split(r.FormValue("volumes"), ",") {
+		vid, err := storage.NewVolumeId(s)
+		if err != nil {
+			writeJson(w, r, map[string]string{"error": "Volume Id " + s + " is not a valid unsigned integer!"})
+			return
+		}
+		vids = append(vids, vid)
+	}
+	ttl, err := strconv.Atoi(r.FormValue("ttl"))
+	if err != nil || ttl <= 0 || r.FormValue("name") == "" {
+		writeJson(w, r, map[string]string{"error": "a snapshot needs a name and a ttl in seconds"})
+		return
+	}
+	cuts, err := store.Snapshot(r.FormValue("name"), vids, time.Now().Add(time.Duration(ttl)*time.Second))
+	if err != nil {
+		writeJson(w, r, map[string]string{"error": err.Error()})
+	} else {
+		writeJson(w, r, map[string]interface{}{"error": "", "volumes": cuts})
+	}
+	debug("snapshot", r.FormValue("name"), "of volumes", r.FormValue("volumes"), ", error =", err)
+}
+func releaseSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	store.ReleaseSnapshot(r.FormValue("name"))
+	writeJson(w, r, map[string]string{"error": ""})
+	debug("released snapshot", r.FormValue("name"))
+}
+func setVolumeStateHandler(w http.ResponseWriter, r *http.Request) {
+	err := store.SetVolumeState(r.FormValue("volume"), r.FormValue("state"))
+	if err == nil {
+		writeJson(w, r, map[string]string{"error": ""})
+	} else {
+		writeJson(w, r, map[string]string{"error": err.Error()})
+	}
+	debug("volume =", r.FormValue("volume"), "state =", r.FormValue("state"), ", error =", err)
+}
+
+// exportVolumeHandler streams the live files of a volume as a tar, in the order
+// they are on disk, for exports and backups at the sequential read speed of the disk.
+// The files are named by their fid, with the content as stored, i.e. gzipped for
+// compressible types, and the name value pairs in the WEEDFS.pairs PAX record.
+func exportVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	if !isDumpAuthorized(w, r, r.FormValue("volume")) {
+		return
+	}
+	volumeId, err := storage.NewVolumeId(r.FormValue("volume"))
+	if err != nil || !store.HasVolume(volumeId) {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": "Volume " + r.FormValue("volume") + " is not found"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+	err = store.Scan(volumeId.String(), func(n *storage.Needle) error {
+		header := &tar.Header{
+			Name:     directory.NewFileId(volumeId, n.Id, n.Cookie).String(),
+			Mode:     0644,
+			Size:     int64(len(n.Data)),
+			ModTime:  time.Unix(int64(n.LastModified), 0),
+			Typeflag: tar.TypeReg,
+		}
+		if n.HasPairs() {
+			header.PAXRecords = map[string]string{"WEEDFS.pairs": string(n.Pairs)}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(n.Data)
+		return err
+	})
+	if err != nil {
+		// the tar is left without its end, so the client sees it is cut short
+		log.Println("export of volume", volumeId, "stopped:", err)
+		return
+	}
+	tw.Close()
+}
+func modifiedSinceHandler(w http.ResponseWriter, r *http.Request) {
+	if !isDumpAuthorized(w, r, r.FormValue("volume")) {
+		return
+	}
+	since, err := strconv.ParseUint(r.FormValue("since"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "since should be a unix time in seconds"})
+		return
+	}
+	needles, err := store.ModifiedSince(r.FormValue("volume"), since)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	volumeId, _ := storage.NewVolumeId(r.FormValue("volume"))
+	files := make([]map[string]interface{}, 0, len(needles))
+	for _, n := range needles {
+		fid := directory.NewFileId(volumeId, n.Id, n.Cookie).String()
+		files = append(files, map[string]interface{}{"fid": fid, "size": n.DataSize, "lastModified": n.LastModified})
+	}
+	writeJson(w, r, map[string]interface{}{"volume": volumeId, "files": files})
+}
+
+// adminPortHandler answers the /admin/ calls on -port when the admin api is
+// served on -adminPort, instead of taking them for file ids.
+func adminPortHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotFound)
+	writeJson(w, r, map[string]string{"error": "The admin api is served at port " + strconv.Itoa(store.AdminPort)})
+}
+
 func storeHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAuthorized(w, r) {
+		return
+	}
+	// the calls to the master and the other replicas share the deadline of the request
+	ctx, cancel := util.WithRequestTimeout(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
 	switch r.Method {
-	case "GET":
+	case "GET", "HEAD":
 		GetHandler(w, r)
 	case "DELETE":
+		if store.ReadOnly() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeJson(w, r, map[string]string{"error": storage.ErrStoreReadOnly.Error()})
+			return
+		}
 		DeleteHandler(w, r)
 	case "POST":
+		slots, ok := acquireWriteSlot(w, r)
+		if !ok {
+			return
+		}
+		defer releaseWriteSlot(slots)
 		PostHandler(w, r)
+	case "PUT":
+		if store.ReadOnly() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeJson(w, r, map[string]string{"error": storage.ErrStoreReadOnly.Error()})
+			return
+		}
+		slots, ok := acquireWriteSlot(w, r)
+		if !ok {
+			return
+		}
+		defer releaseWriteSlot(slots)
+		PutHandler(w, r)
 	}
 }
+
+// acquireWriteSlot waits up to -writeQueueSeconds for a free upload slot, and
+// returns the slots to release it to, which stay the same if -maxConcurrentWrites
+// changes in the meantime. If no slot frees up, it replies 503 with Retry-After.
+func acquireWriteSlot(w http.ResponseWriter, r *http.Request) (chan bool, bool) {
+	writeSlotsLock.Lock()
+	slots, queueSeconds := writeSlots, writeQueueSeconds
+	writeSlotsLock.Unlock()
+	if slots == nil {
+		return nil, true
+	}
+	select {
+	case slots <- true:
+		return slots, true
+	default:
+	}
+	timer := time.NewTimer(time.Duration(queueSeconds) * time.Second)
+	defer timer.Stop()
+	select {
+	case slots <- true:
+		return slots, true
+	case <-timer.C:
+	}
+	retryAfter := queueSeconds
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	writeJson(w, r, map[string]string{"error": "Too many concurrent uploads, retry later"})
+	return nil, false
+}
+func releaseWriteSlot(slots chan bool) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// signedReads is true if the files of the volume are only read with signed
+// urls, for all the volumes with -signedReads, else per collection. Until the
+// master told which collections are, all of them are.
+func signedReads(vid string) bool {
+	if *vSecureKey != "" && *vSignedReads || !store.ReadPolicyKnown() {
+		return true
+	}
+	volumeId, err := storage.NewVolumeId(vid)
+	return err == nil && store.SignedReads(volumeId)
+}
+
+// isAuthorized checks the signed url parameters of the request, if -secureKey is
+// set, or if the collection of the volume is only read with signed urls.
+func isAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	vid, fid, _ := directory.ParsePath(r.URL.Path)
+	op := util.SignedWrite
+	switch r.Method {
+	case "GET", "HEAD":
+		if !signedReads(vid) {
+			return true
+		}
+		if r.URL.Query().Get("chunks") == "missing" && *vSecureKey != "" && isSignedFor(r, vid+","+fid, util.SignedWrite) {
+			// the uploader resuming a chunked file may not be allowed to read it
+			return true
+		}
+		return isReadAuthorized(w, r, vid+","+fid)
+	case "DELETE":
+		op = util.SignedDelete
+	default:
+		if q := r.URL.Query().Get("op"); q == util.SignedWriteAt || q == util.SignedReplicate {
+			op = q
+		}
+	}
+	if *vSecureKey == "" {
+		return true
+	}
+	if err := util.VerifyFileIdSignature(*vSecureKey, op, vid+","+fid, r.URL.Query()); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// isReadAuthorized checks the signed url parameters of a read of a collection
+// only read with signed urls, or of any collection before the master told which.
+func isReadAuthorized(w http.ResponseWriter, r *http.Request, fileId string) bool {
+	err := errors.New("The collection needs signed reads, and there is no -secureKey to check them")
+	if *vSecureKey != "" {
+		err = util.VerifyFileIdSignature(*vSecureKey, util.SignedRead, fileId, r.URL.Query())
+	}
+	if err == nil {
+		return true
+	}
+	if !store.ReadPolicyKnown() {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeJson(w, r, map[string]string{"error": "Only the signed reads are served until the master is reached"})
+		return false
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	writeJson(w, r, map[string]string{"error": err.Error()})
+	return false
+}
+
+// isDumpAuthorized checks that a request reading the whole volume, e.g.
+// /admin/export, is signed with -secureKey by a peer or a tool sharing it, if
+// the files of the volume are only read with signed urls.
+func isDumpAuthorized(w http.ResponseWriter, r *http.Request, vid string) bool {
+	if !signedReads(vid) {
+		return true
+	}
+	err := errors.New("The collection needs signed reads, and there is no -secureKey to check them")
+	if *vSecureKey != "" {
+		err = util.VerifyValuesSignature(*vSecureKey, r.URL.Query(), time.Minute)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// signedDumpQuery is the query string of a request reading a whole volume,
+// signed with the secure key of the volume server if there is one.
+func signedDumpQuery(secureKey string, values url.Values) string {
+	if secureKey != "" {
+		values.Set("time", strconv.FormatInt(time.Now().Unix(), 10))
+		util.SignValues(secureKey, values)
+	}
+	return values.Encode()
+}
+
+// writeTimestamp returns the last modified time a write keeps from its ts
+// parameter, if the write is signed for it with -secureKey, by a replica or a
+// tool holding the key, as the master only signs plain writes for the clients.
+// Without -secureKey no write is authenticated, and ts is always kept.
+func writeTimestamp(r *http.Request, fileId string) (uint64, bool) {
+	ts, err := strconv.ParseUint(r.URL.Query().Get("ts"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if *vSecureKey != "" && !isSignedFor(r, fileId, util.SignedWriteAt, util.SignedReplicate) {
+		return 0, false
+	}
+	return ts, true
+}
+
+// isReplicaWrite is true for a write sent by another replica, which checked the
+// upload policy of the collection already. Only -secureKey tells the replicas
+// from the clients, so without it every write is checked.
+func isReplicaWrite(r *http.Request, fileId string) bool {
+	return *vSecureKey != "" && r.FormValue("type") == "standard" && isSignedFor(r, fileId, util.SignedReplicate)
+}
+
+// isSignedFor is true if the request on the file id is signed for one of the ops.
+func isSignedFor(r *http.Request, fileId string, ops ...string) bool {
+	for _, op := range ops {
+		if util.VerifyFileIdSignature(*vSecureKey, op, fileId, r.URL.Query()) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// peerAuth signs the request forwarded to the other replicas, if -secureKey is set.
+func peerAuth(r *http.Request, op string) string {
+	vid, fid, _ := directory.ParsePath(r.URL.Path)
+	return peerAuthFileId(vid+","+fid, op)
+}
+
+func peerAuthFileId(fileId string, op string) string {
+	if *vSecureKey == "" {
+		return ""
+	}
+	return "&" + util.SignFileId(*vSecureKey, op, fileId, time.Now().Unix()+60)
+}
+
 func GetHandler(w http.ResponseWriter, r *http.Request) {
+	defer volumeLatency.Observe("read", r.URL.Path[1:], time.Now())
 	n := new(storage.Needle)
-	vid, fid, ext := parseURLPath(r.URL.Path)
+	vid, fid, ext := directory.ParsePath(r.URL.Path)
 	volumeId, err := storage.NewVolumeId(vid)
 	if err != nil {
 		debug("parsing error:", err, r.URL.Path)
@@ -79,10 +734,14 @@ func GetHandler(w http.ResponseWriter, r *http.Request) {
 
 	debug("volume", volumeId, "reading", n)
 	if !store.HasVolume(volumeId) {
-		lookupResult, err := operation.Lookup(*masterNode, volumeId)
+		lookupResult, err := operation.LookupContext(r.Context(), *masterNode, volumeId)
 		debug("volume", volumeId, "found on", lookupResult, "error", err)
 		if err == nil {
-			http.Redirect(w, r, "http://"+lookupResult.Locations[0].PublicUrl+r.URL.Path, http.StatusMovedPermanently)
+			redirectUrl := "http://" + lookupResult.Locations[0].PublicUrl + r.URL.Path
+			if r.URL.RawQuery != "" {
+				redirectUrl += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, redirectUrl, http.StatusMovedPermanently)
 		} else {
 			debug("lookup error:", err, r.URL.Path)
 			w.WriteHeader(http.StatusNotFound)
@@ -102,64 +761,263 @@ func GetHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	setResponseHeaders(w.Header(), store.ResponseHeaders(volumeId))
+	if n.IsChunkManifest() {
+		serveChunkManifest(w, r, n, ext)
+		return
+	}
+	if n.HasLastModifiedDate() {
+		lastModified := time.Unix(int64(n.LastModified), 0)
+		if ims, err := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(ims) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if r.Header.Get("Range") != "" {
+		// the ranges are of the content as uploaded, so it is never sent gzipped
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(needleContent(w.Header(), n, ext, false)))
+		return
+	}
+	data := needleContent(w.Header(), n, ext, strings.Contains(r.Header.Get("Accept-Encoding"), "gzip"))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// needleContent sets the headers the file is served with, and returns its content,
+// un-gzipped if the client does not accept gzip.
+func needleContent(header http.Header, n *storage.Needle, ext string, acceptGzip bool) []byte {
+	if n.HasLastModifiedDate() {
+		header.Set("Last-Modified", time.Unix(int64(n.LastModified), 0).UTC().Format(http.TimeFormat))
+	}
+	data := n.Data
 	if ext != "" {
 		mtype := mime.TypeByExtension(ext)
-		w.Header().Set("Content-Type", mtype)
+		header.Set("Content-Type", mtype)
 		if storage.IsCompressable(ext, mtype) {
-			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-				w.Header().Set("Content-Encoding", "gzip")
+			if acceptGzip {
+				header.Set("Content-Encoding", "gzip")
 			} else {
-				n.Data = storage.UnGzipData(n.Data)
+				data = storage.UnGzipData(data)
 			}
 		}
 	}
-	w.Write(n.Data)
+	for name, value := range n.GetPairs() {
+		header.Set(storage.PairNamePrefix+name, value)
+	}
+	return data
+}
+
+// multiGetHandler serves several files of one volume in a multipart/mixed response,
+// one part per fid in the order asked, e.g.
+//   GET /multi_get?volumeId=3&fid=01637037d6.jpg&fid=0263c1d2e8.jpg
+// Each part has the headers of a single GET, and X-Weed-Fid. Files not found
+// are parts with X-Weed-Status: 404 and no content.
+func multiGetHandler(w http.ResponseWriter, r *http.Request) {
+	defer volumeLatency.Observe("read", "multi_get", time.Now())
+	r.ParseForm()
+	if !store.ReadPolicyKnown() {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeJson(w, r, map[string]string{"error": "Only the signed reads are served until the master is reached"})
+		return
+	}
+	if signedReads(r.FormValue("volumeId")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJson(w, r, map[string]string{"error": "Signed reads are per file, multi_get is not available with signed reads"})
+		return
+	}
+	volumeId, err := storage.NewVolumeId(r.FormValue("volumeId"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "Unknown volumeId " + r.FormValue("volumeId")})
+		return
+	}
+	if !store.HasVolume(volumeId) {
+		lookupResult, err := operation.LookupContext(r.Context(), *masterNode, volumeId)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "http://"+lookupResult.Locations[0].PublicUrl+r.URL.Path+"?"+r.URL.RawQuery, http.StatusMovedPermanently)
+		return
+	}
+	acceptGzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for _, fid := range r.Form["fid"] {
+		ext := ""
+		if dotIndex := strings.LastIndex(fid, "."); dotIndex > 0 {
+			fid, ext = fid[:dotIndex], fid[dotIndex:]
+		}
+		fileId := volumeId.String() + "," + fid
+		header := make(http.Header)
+		header.Set("X-Weed-Fid", fileId)
+		var data []byte
+		if id, err := directory.ParseFileId(fileId); err != nil {
+			header.Set("X-Weed-Status", strconv.Itoa(http.StatusNotAcceptable))
+		} else if n := (&storage.Needle{Id: id.Key, Cookie: id.Hashcode}); !readNeedle(volumeId, n) || n.Cookie != id.Hashcode {
+			header.Set("X-Weed-Status", strconv.Itoa(http.StatusNotFound))
+		} else {
+			data = needleContent(header, n, ext, acceptGzip)
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader(header))
+		if err != nil {
+			return
+		}
+		if _, err := part.Write(data); err != nil {
+			return
+		}
+	}
+	mw.Close()
+}
+
+func readNeedle(volumeId storage.VolumeId, n *storage.Needle) bool {
+	count, err := store.Read(volumeId, n)
+	return err == nil && count > 0
 }
 func PostHandler(w http.ResponseWriter, r *http.Request) {
+	defer volumeLatency.Observe("write", r.URL.Path[1:], time.Now())
 	r.ParseForm()
-	vid, _, _ := parseURLPath(r.URL.Path)
+	vid, fid, _ := directory.ParsePath(r.URL.Path)
 	volumeId, e := storage.NewVolumeId(vid)
 	if e != nil {
-		writeJson(w, r, e)
+		w.WriteHeader(http.StatusBadRequest)
+		writeJson(w, r, map[string]string{"error": e.Error()})
 	} else {
-		needle, filename, ne := storage.NewNeedle(r)
-		if ne != nil {
-			writeJson(w, r, ne)
+		var policy *storage.UploadPolicy
+		if !isReplicaWrite(r, vid+","+fid) {
+			// replicas take what the first volume server took
+			policy = store.UploadPolicy(volumeId)
+		}
+		needle, filename, ne := storage.NewNeedle(r, policy)
+		if refused, ok := ne.(*storage.UploadRefusedError); ok {
+			w.WriteHeader(refused.Status)
+			writeJson(w, r, map[string]string{"error": ne.Error()})
+		} else if ne == storage.ErrChecksumMismatch {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeJson(w, r, map[string]string{"error": ne.Error()})
+		} else if ne != nil {
+			// e.g. a broken multipart body, or an invalid Content-MD5 or X-Content-Sha256
+			w.WriteHeader(http.StatusBadRequest)
+			writeJson(w, r, map[string]string{"error": ne.Error()})
+		} else if needle.IsChunkManifest() && !checkChunkManifest(w, r, vid+","+fid, needle) {
+			return
 		} else {
-			ret := store.Write(volumeId, needle)
-			errorStatus := ""
-			if ret > 0 || !store.HasVolume(volumeId) { //send to other replica locations
-				if r.FormValue("type") != "standard" {
-					if !distributedOperation(volumeId, func(location operation.Location) bool {
-						_, err := operation.Upload("http://"+location.Url+r.URL.Path+"?type=standard", filename, bytes.NewReader(needle.Data))
-						return err == nil
-					}) {
-						ret = 0
-						errorStatus = "Failed to write to replicas for volume " + volumeId.String()
-					}
-				}
-			} else {
-				errorStatus = "Failed to write to local disk"
+			if ts, ok := writeTimestamp(r, vid+","+fid); ok {
+				needle.LastModified = ts
 			}
-			m := make(map[string]interface{})
-			if errorStatus == "" {
-				w.WriteHeader(http.StatusCreated)
-			} else {
-				store.Delete(volumeId, needle)
-				distributedOperation(volumeId, func(location operation.Location) bool {
-					return nil == operation.Delete("http://"+location.Url+r.URL.Path+"?type=standard")
+			writeNeedle(w, r, volumeId, vid+","+fid, needle, filename)
+		}
+	}
+}
+
+// writeNeedle writes the needle uploaded as the file, and sends it to the other
+// replicas unless it came from one of them, rolling it back everywhere if that fails.
+// It returns whether the needle was written.
+func writeNeedle(w http.ResponseWriter, r *http.Request, volumeId storage.VolumeId, fileId string, needle *storage.Needle, filename string) bool {
+	var ret uint32
+	var e error
+	var previous *storage.Needle // the content before an append, restored if it fails
+	if r.FormValue("append") == "true" {
+		if ret, previous, e = store.Append(volumeId, needle); e != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			writeJson(w, r, map[string]string{"error": e.Error()})
+			return false
+		}
+	} else if r.FormValue("type") == "standard" {
+		// a replica can be sent the same write again, after it timed out
+		ret, e = store.WriteReplica(volumeId, needle)
+	} else {
+		ret, e = store.Write(volumeId, needle)
+	}
+	if e == storage.ErrCookieMismatch {
+		// nothing to roll back, the file of the other cookie stays as it is
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": e.Error()})
+		return false
+	}
+	errorStatus := ""
+	var intent *storage.Intent
+	var skipped []operation.Location
+	if ret > 0 || !store.HasVolume(volumeId) { //send to other replica locations
+		if r.FormValue("type") != "standard" {
+			locations, err := replicaLocations(r.Context(), volumeId)
+			if err == nil && len(locations) > 0 {
+				intent, err = intentLog.Begin(fileId, ret, filename, needle.Mime, locationUrls(locations))
+				locations, skipped = allowedReplicas(locations)
+			}
+			if err == nil {
+				err = replicatedWrite(r.Context(), locations, func(ctx context.Context, location operation.Location) error {
+					defer volumeLatency.Observe("replicate", location.Url+r.URL.Path, time.Now())
+					_, err := operation.UploadMimeContext(ctx, "http://"+location.Url+r.URL.Path+"?type=standard&ts="+strconv.FormatUint(needle.LastModified, 10)+manifestParam(needle)+peerAuth(r, util.SignedReplicate), filename, needle.Mime, bytes.NewReader(needle.Data), needle.GetPairs())
+					return err
 				})
-				w.WriteHeader(http.StatusInternalServerError)
-				m["error"] = errorStatus
 			}
-			m["size"] = ret
-			writeJson(w, r, m)
+			if err != nil {
+				ret = 0
+				errorStatus = "Failed to write to replicas for volume " + volumeId.String() + ": " + err.Error()
+			}
+		}
+	} else {
+		errorStatus = "Failed to write to local disk"
+		if e != nil {
+			errorStatus += ": " + e.Error()
 		}
 	}
+	if errorStatus != "" && previous != nil {
+		rollbackAppend(r, volumeId, filename, needle.Mime, previous)
+	} else if errorStatus != "" {
+		store.Delete(volumeId, needle)
+		// the rollback gets its own deadline, the request may be out of time already
+		distributedOperation(context.Background(), volumeId, func(ctx context.Context, location operation.Location) bool {
+			return nil == operation.DeleteContext(ctx, "http://"+location.Url+r.URL.Path+"?type=standard"+peerAuth(r, util.SignedDelete))
+		})
+	}
+	m := make(map[string]interface{})
+	if errorStatus == "" && len(skipped) > 0 {
+		// the intent stays pending until the skipped replicas have the file
+		deferReplication(intent, skipped)
+		m["replicasPending"] = locationUrls(skipped)
+	} else if intent != nil {
+		if err := intentLog.Done(intent); err != nil {
+			log.Println("Failed to log replication of", intent.Fid, "as done:", err)
+		}
+	}
+	if errorStatus == "" && len(skipped) > 0 {
+		w.WriteHeader(http.StatusAccepted)
+	} else if errorStatus == "" {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		m["error"] = errorStatus
+	}
+	if errorStatus == "" && r.FormValue("type") != "standard" {
+		eventType := notification.Create
+		if r.FormValue("append") == "true" {
+			eventType = notification.Update
+		}
+		notifyVolumeEvent(eventType, volumeId, fileId, int64(ret))
+	}
+	m["size"] = ret
+	writeJson(w, r, m)
+	return errorStatus == ""
+}
+
+// rollbackAppend writes the content of the file before a failed append again,
+// here and on the other replicas, instead of deleting the file with the content
+// it had before.
+func rollbackAppend(r *http.Request, volumeId storage.VolumeId, filename string, mime string, previous *storage.Needle) {
+	if _, err := store.WriteReplica(volumeId, previous); err != nil {
+		log.Println("Failed to roll back the append to", r.URL.Path, ":", err)
+	}
+	distributedOperation(context.Background(), volumeId, func(ctx context.Context, location operation.Location) bool {
+		_, err := operation.UploadMimeContext(ctx, "http://"+location.Url+r.URL.Path+"?type=standard&ts="+strconv.FormatUint(previous.LastModified, 10)+peerAuth(r, util.SignedReplicate), filename, mime, bytes.NewReader(previous.Data), previous.GetPairs())
+		return err == nil
+	})
 }
 func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	n := new(storage.Needle)
-	vid, fid, _ := parseURLPath(r.URL.Path)
+	vid, fid, _ := directory.ParsePath(r.URL.Path)
 	volumeId, _ := storage.NewVolumeId(vid)
 	n.ParsePath(fid)
 
@@ -185,8 +1043,8 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 
 	if ret > 0 || !store.HasVolume(volumeId) { //send to other replica locations
 		if r.FormValue("type") != "standard" {
-			if !distributedOperation(volumeId, func(location operation.Location) bool {
-				return nil == operation.Delete("http://"+location.Url+r.URL.Path+"?type=standard")
+			if !distributedOperation(r.Context(), volumeId, func(ctx context.Context, location operation.Location) bool {
+				return nil == operation.DeleteContext(ctx, "http://"+location.Url+r.URL.Path+"?type=standard"+peerAuth(r, util.SignedDelete))
 			}) {
 				ret = 0
 			}
@@ -194,6 +1052,12 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if ret != 0 {
+		if r.FormValue("type") != "standard" {
+			notifyVolumeEvent(notification.Delete, volumeId, vid+","+fid, int64(len(n.Data)))
+			if n.IsChunkManifest() {
+				deleteChunks(n)
+			}
+		}
 		w.WriteHeader(http.StatusAccepted)
 	} else {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -204,37 +1068,119 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	writeJson(w, r, m)
 }
 
-func parseURLPath(path string) (vid, fid, ext string) {
-
-	sepIndex := strings.LastIndex(path, "/")
-	commaIndex := strings.LastIndex(path[sepIndex:], ",")
-	if commaIndex <= 0 {
-		if "favicon.ico" != path[sepIndex+1:] {
-			log.Println("unknown file id", path[sepIndex+1:])
+// replicaLocations looks up the other replicas of the volume.
+func replicaLocations(ctx context.Context, volumeId storage.VolumeId) (locations []operation.Location, err error) {
+	lookupResult, err := operation.LookupContext(ctx, *masterNode, volumeId)
+	if err != nil {
+		log.Println("Failed to lookup for", volumeId, err.Error())
+		return nil, err
+	}
+	selfUrl := util.JoinHostPort(*ip, *vport)
+	for _, location := range lookupResult.Locations {
+		if location.Url != selfUrl {
+			locations = append(locations, location)
 		}
-		return
 	}
-	dotIndex := strings.LastIndex(path[sepIndex:], ".")
-	vid = path[sepIndex+1 : commaIndex]
-	fid = path[commaIndex+1:]
-	ext = ""
-	if dotIndex > 0 {
-		fid = path[commaIndex+1 : dotIndex]
-		ext = path[dotIndex:]
+	return locations, nil
+}
+
+func locationUrls(locations []operation.Location) (urls []string) {
+	for _, location := range locations {
+		urls = append(urls, location.Url)
 	}
 	return
 }
 
-func distributedOperation(volumeId storage.VolumeId, op func(location operation.Location) bool) bool {
-	if lookupResult, lookupErr := operation.Lookup(*masterNode, volumeId); lookupErr == nil {
+// replicatedWrite runs the write on all the locations at the same time, and
+// on the first failure cancels the writes still running. It returns after all
+// the writes have returned, so the caller can roll them back. The writes
+// are also canceled when ctx is done.
+func replicatedWrite(ctx context.Context, locations []operation.Location, op func(ctx context.Context, location operation.Location) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan error, len(locations))
+	for _, location := range locations {
+		go func(location operation.Location) {
+			err := util.FaultDelay(ctx)
+			if err == nil {
+				err = op(ctx, location)
+			}
+			recordReplicaResult(location, err)
+			if err != nil {
+				results <- errors.New(location.Url + ": " + err.Error())
+			} else {
+				results <- nil
+			}
+		}(location)
+	}
+	var firstErr error
+	for i := 0; i < len(locations); i++ {
+		if err := <-results; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	return firstErr
+}
+
+// completeIntents finishes the replicated writes cut short by a crash. A file
+// still kept locally is sent to the replicas again, and a file rolled back
+// locally is deleted from them. Failed ones are retried every pulse.
+func completeIntents(intents []*storage.Intent) {
+	for len(intents) > 0 {
+		var failed []*storage.Intent
+		for _, intent := range intents {
+			if err := completeIntent(intent); err != nil {
+				log.Println("Failed to complete the replication of", intent.Fid, ":", err)
+				failed = append(failed, intent)
+			} else if err = intentLog.Done(intent); err != nil {
+				log.Println("Failed to log replication of", intent.Fid, "as done:", err)
+			}
+		}
+		if intents = failed; len(intents) > 0 {
+			time.Sleep(time.Duration(*vpulse) * time.Second)
+		}
+	}
+}
+
+func completeIntent(intent *storage.Intent) error {
+	vid, fid, _ := directory.ParsePath("/" + intent.Fid)
+	volumeId, err := storage.NewVolumeId(vid)
+	if err != nil {
+		return err
+	}
+	var locations []operation.Location
+	for _, url := range intent.Targets {
+		locations = append(locations, operation.Location{Url: url})
+	}
+	ctx, cancel := util.WithRequestTimeout(context.Background())
+	defer cancel()
+	n := new(storage.Needle)
+	n.ParsePath(fid)
+	cookie := n.Cookie
+	if count, err := store.Read(volumeId, n); err == nil && count > 0 && n.Cookie == cookie {
+		log.Println("Completing the replication of", intent.Fid, "to", intent.Targets)
+		return replicatedWrite(ctx, locations, func(ctx context.Context, location operation.Location) error {
+			_, err := operation.UploadMimeContext(ctx, "http://"+location.Url+"/"+intent.Fid+"?type=standard&ts="+strconv.FormatUint(n.LastModified, 10)+manifestParam(n)+peerAuthFileId(intent.Fid, util.SignedReplicate), intent.Filename, intent.Mime, bytes.NewReader(n.Data), n.GetPairs())
+			return err
+		})
+	}
+	log.Println("Deleting the rolled back", intent.Fid, "from", intent.Targets)
+	return replicatedWrite(ctx, locations, func(ctx context.Context, location operation.Location) error {
+		return operation.DeleteContext(ctx, "http://"+location.Url+"/"+intent.Fid+"?type=standard"+peerAuthFileId(intent.Fid, util.SignedDelete))
+	})
+}
+
+func distributedOperation(ctx context.Context, volumeId storage.VolumeId, op func(ctx context.Context, location operation.Location) bool) bool {
+	if lookupResult, lookupErr := operation.LookupContext(ctx, *masterNode, volumeId); lookupErr == nil {
 		length := 0
-		selfUrl := (*ip + ":" + strconv.Itoa(*vport))
+		selfUrl := util.JoinHostPort(*ip, *vport)
 		results := make(chan bool)
 		for _, location := range lookupResult.Locations {
 			if location.Url != selfUrl {
 				length++
 				go func(location operation.Location, results chan bool) {
-					results <- op(location)
+					results <- op(ctx, location)
 				}(location, results)
 			}
 		}
@@ -254,41 +1200,169 @@ func runVolume(cmd *Command, args []string) bool {
     *vMaxCpu = runtime.NumCPU()
   }
 	runtime.GOMAXPROCS(*vMaxCpu)
-	fileInfo, err := os.Stat(*volumeFolder)
-	if err != nil {
-		log.Fatalf("No Existing Folder:%s", *volumeFolder)
+	folders := strings.Split(*volumeFolder, ",")
+	for _, folder := range folders {
+		fileInfo, err := os.Stat(folder)
+		if err != nil {
+			log.Fatalf("No Existing Folder:%s", folder)
+		}
+		if !fileInfo.IsDir() {
+			log.Fatalf("Volume Folder should not be a file:%s", folder)
+		}
+		perm := fileInfo.Mode().Perm()
+		log.Println("Volume Folder", folder, "permission:", perm)
 	}
-	if !fileInfo.IsDir() {
-		log.Fatalf("Volume Folder should not be a file:%s", *volumeFolder)
+	var maxCounts []int
+	for _, maxString := range strings.Split(*maxVolumeCount, ",") {
+		max, err := strconv.Atoi(maxString)
+		if err != nil {
+			log.Fatalf("-max %s is not a number", maxString)
+		}
+		maxCounts = append(maxCounts, max)
+	}
+	if len(maxCounts) == 1 {
+		for len(maxCounts) < len(folders) {
+			maxCounts = append(maxCounts, maxCounts[0])
+		}
+	} else if len(maxCounts) != len(folders) {
+		log.Fatalf("-max has %d numbers for %d -dir directories", len(maxCounts), len(folders))
 	}
-	perm := fileInfo.Mode().Perm()
-	log.Println("Volume Folder permission:", perm)
 
 	if *publicUrl == "" {
-		*publicUrl = *ip + ":" + strconv.Itoa(*vport)
+		*publicUrl = util.JoinHostPort(*ip, *vport)
 	}
 
-	store = storage.NewStore(*vport, *ip, *publicUrl, *volumeFolder, *maxVolumeCount)
+	budgets, err := util.ParseLatencyBudgets(*vLatencyBudget)
+	if err != nil {
+		log.Fatalf("-latencyBudgets: %s", err)
+	}
+	volumeLatency = util.NewLatencyStats(budgets)
+	util.RequestTimeout = time.Duration(*vReqTimeout) * time.Second
+	if err = util.SetFaults(*vFaults); err != nil {
+		log.Fatalf("-faults: %s", err)
+	}
+	if err = storage.SetNeedleAlignment(int64(*vAlignment)); err != nil {
+		log.Fatalf("-needleAlignment: %s", err)
+	}
+	if *vMaxOpenFiles > 0 {
+		volumeFilePool = storage.NewFilePool(*vMaxOpenFiles)
+		storage.SetFilePool(volumeFilePool)
+	}
+	if *vRemote != "" {
+		if volumeRemoteTier, err = storage.NewRemoteTier(*vRemote, int64(*vRemoteCacheMB)*1024*1024); err != nil {
+			log.Fatalf("-remote: %s", err)
+		}
+		storage.SetRemoteTier(volumeRemoteTier)
+	}
+	store = storage.NewStore(*vport, *ip, *publicUrl, folders, maxCounts)
+	store.DiskType, store.Labels, store.ClusterSecret = *vDiskType, *vLabels, *vClusterSecret
+	if *vAdminPort != *vport {
+		store.AdminPort = *vAdminPort
+	}
+	store.GrpcPort = *vGrpcPort
+	store.TrashRetention = time.Duration(*vTrashSeconds) * time.Second
+	if *vNotify != "" {
+		publisher, err := notification.NewPublisher(*vNotify)
+		if err != nil {
+			log.Fatalf("-notify: %s", err)
+		}
+		volumeNotifier = notification.NewNotifier(publisher, 10000)
+	}
+	if masterKey, err := volumeMasterKey(); err != nil {
+		log.Fatalf("Encryption key [ERROR] %s", err)
+	} else if masterKey != nil {
+		if err = store.SetMasterKey(masterKey); err != nil {
+			log.Fatalf("Encryption key [ERROR] %s", err)
+		}
+	}
+	if *vReadCacheMB > 0 {
+		store.SetReadCache(util.NewLRUCache(int64(*vReadCacheMB) * 1024 * 1024))
+	}
+	if err = applyVolumeSettings(); err != nil {
+		log.Fatalf("%s", err)
+	}
+	go reloadVolumeSettingsOnSighup()
 	defer store.Close()
-	http.HandleFunc("/", storeHandler)
-	http.HandleFunc("/status", statusHandler)
-	http.HandleFunc("/admin/assign_volume", assignVolumeHandler)
+	if intentLog, err = storage.NewIntentLog(path.Join(folders[0], "replication.intents")); err != nil {
+		log.Fatalf("Replication intent log [ERROR] %s", err)
+	}
+	defer intentLog.Close()
+	replicaBreaker = util.NewCircuitBreaker(*vReplicaFails, time.Duration(*vpulse)*time.Second, probeVolumeServer)
+	go completeDeferredReplications()
+	go purgeTrash()
+	if partialUploads, err = storage.NewPartialUploads(path.Join(folders[0], "partial")); err != nil {
+		log.Fatalf("Partial uploads [ERROR] %s", err)
+	}
+	go purgePartialUploads()
+	if intents := intentLog.Pending(); len(intents) > 0 {
+		log.Println("Found", len(intents), "replicated writes cut short")
+		go completeIntents(intents)
+	}
+	if volumeAudit, err = util.NewAuditLog(path.Join(folders[0], "audit.log")); err != nil {
+		log.Fatalf("Audit log [ERROR] %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", storeHandler)
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/stats", volumeStatsHandler)
+	mux.HandleFunc("/multi_get", multiGetHandler)
+	mux.HandleFunc("/checksum", checksumHandler)
+	mux.HandleFunc("/openapi.json", openapiHandler("volume"))
+	admin := mux
+	if store.AdminPort != 0 {
+		admin = http.NewServeMux()
+		mux.HandleFunc("/admin/", adminPortHandler)
+	}
+	admin.HandleFunc("/admin/assign_volume", audited(volumeAudit, assignVolumeHandler))
+	admin.HandleFunc("/admin/audit", auditHandler(volumeAudit))
+	admin.HandleFunc("/admin/delete_volume", audited(volumeAudit, deleteVolumeHandler))
+	admin.HandleFunc("/admin/reencryption", reencryptionHandler)
+	admin.HandleFunc("/admin/reload_dir", audited(volumeAudit, reloadDirHandler))
+	admin.HandleFunc("/admin/rotate_key", audited(volumeAudit, rotateKeyHandler))
+	admin.HandleFunc("/admin/set_volume_state", audited(volumeAudit, setVolumeStateHandler))
+	admin.HandleFunc("/admin/trash", trashHandler)
+	admin.HandleFunc("/admin/undelete", audited(volumeAudit, undeleteHandler))
+	admin.HandleFunc("/admin/vacuum_volume_check", vacuumVolumeCheckHandler)
+	admin.HandleFunc("/admin/vacuum_volume_compact", audited(volumeAudit, vacuumVolumeCompactHandler))
+	admin.HandleFunc("/admin/modified_since", modifiedSinceHandler)
+	admin.HandleFunc("/admin/export", exportVolumeHandler)
+	admin.HandleFunc("/admin/upgrade_volume", audited(volumeAudit, upgradeVolumeHandler))
+	admin.HandleFunc("/admin/clone_volume", audited(volumeAudit, cloneVolumeHandler))
+	admin.HandleFunc("/admin/offload_volume", audited(volumeAudit, offloadVolumeHandler))
+	admin.HandleFunc("/admin/recall_volume", audited(volumeAudit, recallVolumeHandler))
+	admin.HandleFunc("/admin/mirror_volume", audited(volumeAudit, mirrorVolumeHandler))
+	admin.HandleFunc("/admin/replicate_volume", audited(volumeAudit, replicateVolumeHandler))
+	admin.HandleFunc("/admin/volume_file", volumeFileHandler)
+	admin.HandleFunc("/admin/digest", digestHandler)
+	admin.HandleFunc("/admin/snapshot", audited(volumeAudit, snapshotHandler))
+	admin.HandleFunc("/admin/snapshot/release", audited(volumeAudit, releaseSnapshotHandler))
+	admin.HandleFunc("/admin/settings", audited(volumeAudit, volumeSettingsHandler))
+	mux.HandleFunc("/ui/", volumeUiHandler)
+	mux.HandleFunc("/ui/volume", volumeUiVolumeHandler)
 
 	go func() {
 		for {
-			store.Join(*masterNode)
+			if !util.Fault(util.FaultDropHeartbeat) {
+				store.Join(*masterNode)
+			}
 			time.Sleep(time.Duration(float32(*vpulse*1e3)*(1+rand.Float32())) * time.Millisecond)
 		}
 	}()
 	log.Println("store joined at", *masterNode)
 
-	log.Println("Start Weed volume server", VERSION, "at http://"+*ip+":"+strconv.Itoa(*vport))
-	srv := &http.Server{
-		Addr:        ":" + strconv.Itoa(*vport),
-		Handler:     http.DefaultServeMux,
-		ReadTimeout: (time.Duration(*vReadTimeout) * time.Second),
+	if admin != mux {
+		go func() {
+			log.Println("Serving the admin api at port", store.AdminPort)
+			if e := volumeHttpOptions.newServer(store.AdminPort, admin, *vReadTimeout).ListenAndServe(); e != nil {
+				log.Fatalf("Fail to start the admin api:%s", e.Error())
+			}
+		}()
+	}
+	if store.GrpcPort != 0 {
+		go serveGrpc(store.GrpcPort, volumeGrpcMethods)
 	}
-	e := srv.ListenAndServe()
+	log.Println("Start Weed volume server", VERSION, "at http://"+util.JoinHostPort(*ip, *vport))
+	e := volumeHttpOptions.listenAndServe(*vport, withCors(*vCorsOrigins, mux), *vReadTimeout)
 	if e != nil {
 		log.Fatalf("Fail to start:%s", e.Error())
 	}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"pkg/directory"
+	"pkg/operation"
+	"pkg/storage"
+)
+
+// checksumHandler returns the size and the checksums of a file, computed on
+// the volume server over the content a GET of the same fid would return
+// without gzip, so sync tools can compare it with a local copy without
+// downloading it:
+//
+//	GET /checksum?fid=3,01637037d6.txt
+//	{"Fid":"3,01637037d6","Size":4087,"Crc32c":"5a8e0f33","Md5":"9e107d9d372bb6826bd81d3542a419d6"}
+func checksumHandler(w http.ResponseWriter, r *http.Request) {
+	fileId := r.FormValue("fid")
+	vid, fid, ext := directory.ParsePath("/" + fileId)
+	volumeId, err := storage.NewVolumeId(vid)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "Unknown file id " + fileId})
+		return
+	}
+	if signedReads(vid) && !isReadAuthorized(w, r, vid+","+fid) {
+		return
+	}
+	if !store.HasVolume(volumeId) {
+		lookupResult, err := operation.LookupContext(r.Context(), *masterNode, volumeId)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			writeJson(w, r, map[string]string{"error": err.Error()})
+			return
+		}
+		http.Redirect(w, r, "http://"+lookupResult.Locations[0].PublicUrl+r.URL.Path+"?"+r.URL.RawQuery, http.StatusMovedPermanently)
+		return
+	}
+	n := new(storage.Needle)
+	n.ParsePath(fid)
+	cookie := n.Cookie
+	if count, err := store.Read(volumeId, n); err != nil || count <= 0 || n.Cookie != cookie {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": "File " + fileId + " is not found"})
+		return
+	}
+	data := needleContent(make(http.Header), n, ext, false)
+	sum := md5.Sum(data)
+	m := map[string]interface{}{
+		"Fid":    vid + "," + fid,
+		"Size":   len(data),
+		"Crc32c": fmt.Sprintf("%08x", uint32(storage.NewCRC(data))),
+		"Md5":    hex.EncodeToString(sum[:]),
+	}
+	if n.HasLastModifiedDate() {
+		m["LastModified"] = n.LastModified
+	}
+	writeJson(w, r, m)
+}
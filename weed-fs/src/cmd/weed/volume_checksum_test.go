@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"pkg/storage"
+	"pkg/util"
+	"testing"
+	"time"
+)
+
+// withTestStore serves the volume 3 from a store in a temporary directory,
+// with the needle 01637037d6 of the data in it, gzipped as uploads of text are.
+func withTestStore(t *testing.T, data []byte) func() {
+	dir, err := ioutil.TempDir("", "weedfs_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := store
+	store = storage.NewStore(0, "", "", []string{dir}, []int{1})
+	if err = store.AddVolume("3", "", "000"); err != nil {
+		t.Fatal(err)
+	}
+	n := new(storage.Needle)
+	n.ParsePath("01637037d6")
+	n.Data = storage.GzipData(data)
+	n.Checksum = storage.NewCRC(n.Data)
+	n.LastModified, n.Flags = 1380000000, storage.FlagHasLastModifiedDate
+	if _, err = store.Write(3, n); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		store.Close()
+		store = previous
+		os.RemoveAll(dir)
+	}
+}
+
+func TestChecksumHandler(t *testing.T) {
+	data := []byte("checksummed content")
+	defer withTestStore(t, data)()
+	defer func(key string) { *vSecureKey = key }(*vSecureKey)
+	*vSecureKey = "secret"
+	volumeLatency = util.NewLatencyStats(nil)
+
+	signed := "&" + util.SignFileId("secret", util.SignedRead, "3,01637037d6", time.Now().Unix()+60)
+	w := httptest.NewRecorder()
+	checksumHandler(w, httptest.NewRequest("GET", "/checksum?fid=3,01637037d6.txt"+signed, nil))
+	var reply map[string]interface{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &reply) != nil {
+		t.Fatal("got", w.Code, w.Body.String())
+	}
+	sum := md5.Sum(data)
+	if reply["Size"] != float64(len(data)) || reply["Md5"] != hex.EncodeToString(sum[:]) ||
+		reply["Crc32c"] != fmt.Sprintf("%08x", uint32(storage.NewCRC(data))) || reply["LastModified"] != float64(1380000000) {
+		t.Fatal("unexpected checksums", reply)
+	}
+
+	for query, expected := range map[string]int{
+		// not signed, or signed for another fid, before the master tells the read policy
+		"fid=3,01637037d6.txt":          http.StatusServiceUnavailable,
+		"fid=3,01637037d7.txt" + signed: http.StatusServiceUnavailable,
+		"fid=x,01637037d6" + signed:     http.StatusNotAcceptable,
+	} {
+		w := httptest.NewRecorder()
+		checksumHandler(w, httptest.NewRequest("GET", "/checksum?"+query, nil))
+		if w.Code != expected {
+			t.Error(query, "got", w.Code, w.Body.String(), "expected", expected)
+		}
+	}
+	wrongCookie := "&" + util.SignFileId("secret", util.SignedRead, "3,01637037d7", time.Now().Unix()+60)
+	w = httptest.NewRecorder()
+	checksumHandler(w, httptest.NewRequest("GET", "/checksum?fid=3,01637037d7"+wrongCookie, nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("a wrong cookie got", w.Code, w.Body.String())
+	}
+}
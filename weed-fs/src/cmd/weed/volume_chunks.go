@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"pkg/directory"
+	"pkg/operation"
+	"pkg/storage"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The large files are uploaded in chunks, each a file of its own, and a chunk
+// manifest listing them, uploaded with ?cm=true, which is served as the
+// content of its chunks:
+//
+//	GET /3,01637037d6               the content of the chunks, with ranges
+//	GET /3,01637037d6?cm=false      the manifest itself, in json
+//	GET /3,01637037d6?chunks=missing
+//	{"manifest":{...},"missing":[3,7]}
+//
+// The missing chunks are those not found, or not of the size and md5 listed,
+// which a client resumes the upload with before uploading the manifest again
+// complete. A manifest uploaded complete with missing chunks is refused with
+// 409 and the missing ones, and deleting the manifest deletes its chunks.
+
+// chunkCheckers is how many chunks are checked at a time for the missing ones.
+const chunkCheckers = 8
+
+// serveChunkManifest serves the chunked file of the manifest needle.
+func serveChunkManifest(w http.ResponseWriter, r *http.Request, n *storage.Needle, ext string) {
+	manifest, err := operation.ParseChunkManifest(n.Data)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	switch {
+	case r.FormValue("cm") == "false":
+		w.Header().Set("X-Weed-Chunk-Manifest", "true")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(n.Data)
+	case r.FormValue("chunks") == "missing":
+		missing, err := missingChunks(r.Context(), manifest)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			writeJson(w, r, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJson(w, r, operation.MissingChunksResult{Manifest: manifest, Missing: missing})
+	case manifest.Pending:
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": "The chunked file is not uploaded completely"})
+	default:
+		mtype := mime.TypeByExtension(ext)
+		if mtype == "" {
+			mtype = manifest.Mime
+		}
+		if mtype == "" {
+			mtype = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", mtype)
+		for name, value := range n.GetPairs() {
+			w.Header().Set(storage.PairNamePrefix+name, value)
+		}
+		var lastModified time.Time
+		if n.HasLastModifiedDate() {
+			lastModified = time.Unix(int64(n.LastModified), 0)
+		}
+		reader := &chunkedReader{ctx: r.Context(), manifest: manifest}
+		defer reader.Close()
+		http.ServeContent(w, r, "", lastModified, reader)
+	}
+}
+
+// checkChunkManifest checks the manifest uploaded with ?cm=true, and unless it
+// is pending or sent by another replica, that none of its chunks is missing.
+func checkChunkManifest(w http.ResponseWriter, r *http.Request, fileId string, n *storage.Needle) bool {
+	if r.FormValue("append") == "true" {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJson(w, r, map[string]string{"error": storage.ErrAppendToManifest.Error()})
+		return false
+	}
+	manifest, err := operation.ParseChunkManifest(n.Data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return false
+	}
+	if manifest.Pending || isReplicaWrite(r, fileId) {
+		return true
+	}
+	missing, err := missingChunks(r.Context(), manifest)
+	if err == nil && len(missing) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		writeJson(w, r, map[string]interface{}{"error": strconv.Itoa(len(missing)) + " chunks are missing", "missing": missing})
+		return false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// missingChunks returns the indexes of the chunks of the manifest that are not
+// found, or not of their size and md5, in order.
+func missingChunks(ctx context.Context, manifest *operation.ChunkManifest) ([]int, error) {
+	found := make([]bool, len(manifest.Chunks))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < chunkCheckers && i < len(manifest.Chunks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				found[index] = hasChunk(ctx, manifest.Chunks[index])
+			}
+		}()
+	}
+	for i := range manifest.Chunks {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	missing := []int{}
+	for i, ok := range found {
+		if !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing, nil
+}
+
+// hasChunk checks the chunk on this volume server if its volume is here, or
+// with the /checksum of a volume server of its volume.
+func hasChunk(ctx context.Context, chunk operation.ChunkInfo) bool {
+	fileId, err := directory.ParseFileId(chunk.Fid)
+	if err != nil {
+		return false
+	}
+	if store.HasVolume(fileId.VolumeId) {
+		n := &storage.Needle{Id: fileId.Key, Cookie: fileId.Hashcode}
+		if !readNeedle(fileId.VolumeId, n) || n.Cookie != fileId.Hashcode || int64(len(n.Data)) != chunk.Size {
+			return false
+		}
+		sum := md5.Sum(n.Data)
+		return chunk.Md5 == "" || chunk.Md5 == hex.EncodeToString(sum[:])
+	}
+	server, err := chunkServer(ctx, fileId.VolumeId)
+	if err != nil {
+		return false
+	}
+	checksumUrl := "http://" + server + "/checksum?fid=" + chunk.Fid + peerAuthFileId(chunk.Fid, util.SignedRead)
+	req, err := http.NewRequestWithContext(ctx, "GET", checksumUrl, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	var checksum struct {
+		Size int64
+		Md5  string
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&checksum) != nil {
+		return false
+	}
+	return checksum.Size == chunk.Size && (chunk.Md5 == "" || chunk.Md5 == checksum.Md5)
+}
+
+// deleteChunks deletes the chunks of the manifest, once the manifest is deleted.
+// The chunks failing to be deleted are left behind, and logged.
+func deleteChunks(manifestNeedle *storage.Needle) {
+	manifest, err := operation.ParseChunkManifest(manifestNeedle.Data)
+	if err != nil {
+		log.Println("Can not delete the chunks of an invalid manifest:", err)
+		return
+	}
+	for _, chunk := range manifest.Chunks {
+		err := func() error {
+			ctx, cancel := util.WithRequestTimeout(context.Background())
+			defer cancel()
+			volumeId, err := directory.ParseVolumeId(chunk.Fid)
+			if err != nil {
+				return err
+			}
+			server, err := chunkServer(ctx, volumeId)
+			if err != nil {
+				return err
+			}
+			return operation.DeleteContext(ctx, "http://"+server+"/"+chunk.Fid+"?"+strings.TrimPrefix(peerAuthFileId(chunk.Fid, util.SignedDelete), "&"))
+		}()
+		if err != nil {
+			log.Println("Failed to delete chunk", chunk.Fid, ":", err)
+		}
+	}
+}
+
+// manifestParam keeps the needle a chunk manifest on the other replicas.
+func manifestParam(n *storage.Needle) string {
+	if n.IsChunkManifest() {
+		return "&cm=true"
+	}
+	return ""
+}
+
+// chunkServer is a volume server of the volume of a chunk.
+func chunkServer(ctx context.Context, volumeId storage.VolumeId) (string, error) {
+	lookup, err := operation.LookupContext(ctx, *masterNode, volumeId)
+	if err != nil {
+		return "", err
+	}
+	if len(lookup.Locations) == 0 {
+		return "", errors.New("Volume " + volumeId.String() + " is not found")
+	}
+	return lookup.Locations[0].Url, nil
+}
+
+// chunkedReader reads the content of the chunks of a manifest, each from this
+// volume server if its volume is here, or else from a volume server of its
+// volume, from the position read on.
+type chunkedReader struct {
+	ctx      context.Context
+	manifest *operation.ChunkManifest
+	position int64
+	body     io.ReadCloser // the rest of the chunk at position, nil until read
+	bodyEnd  int64         // the end of the chunk of body
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.position >= c.manifest.Size {
+		return 0, io.EOF
+	}
+	if c.body == nil {
+		chunk := c.manifest.Chunks[c.manifest.ChunkIndex(c.position)]
+		body, err := openChunk(c.ctx, chunk, c.position-chunk.Offset)
+		if err != nil {
+			return 0, err
+		}
+		c.body, c.bodyEnd = body, chunk.Offset+chunk.Size
+	}
+	if int64(len(p)) > c.bodyEnd-c.position {
+		p = p[:c.bodyEnd-c.position]
+	}
+	n, err := c.body.Read(p)
+	c.position += int64(n)
+	if err == io.EOF && c.position < c.bodyEnd {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	if c.position == c.bodyEnd || err != nil {
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *chunkedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.position
+	case io.SeekEnd:
+		offset += c.manifest.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek before the start of the chunked file")
+	}
+	if offset != c.position {
+		c.Close()
+		c.position = offset
+	}
+	return offset, nil
+}
+
+func (c *chunkedReader) Close() error {
+	if c.body != nil {
+		c.body.Close()
+		c.body = nil
+	}
+	return nil
+}
+
+// openChunk reads the chunk from the offset on.
+func openChunk(ctx context.Context, chunk operation.ChunkInfo, offset int64) (io.ReadCloser, error) {
+	fileId, err := directory.ParseFileId(chunk.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if store.HasVolume(fileId.VolumeId) {
+		n := &storage.Needle{Id: fileId.Key, Cookie: fileId.Hashcode}
+		if !readNeedle(fileId.VolumeId, n) || n.Cookie != fileId.Hashcode {
+			return nil, errors.New("Chunk " + chunk.Fid + " is not found")
+		}
+		if int64(len(n.Data)) != chunk.Size {
+			return nil, errors.New("Chunk " + chunk.Fid + " is not of the size of its manifest")
+		}
+		return ioutil.NopCloser(bytes.NewReader(n.Data[offset:])), nil
+	}
+	server, err := chunkServer(ctx, fileId.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+server+"/"+chunk.Fid+"?"+strings.TrimPrefix(peerAuthFileId(chunk.Fid, util.SignedRead), "&"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(chunk.Size-1, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && offset == 0) ||
+		resp.ContentLength >= 0 && resp.ContentLength != chunk.Size-offset {
+		resp.Body.Close()
+		return nil, errors.New("Chunk " + chunk.Fid + " answered " + resp.Status + " of " + strconv.FormatInt(resp.ContentLength, 10) + " bytes")
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"pkg/directory"
+	"pkg/operation"
+	"pkg/storage"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startChunkServer serves the volume 3 of the test store, as the master and
+// the only volume server of the cluster, assigning the keys from the one of
+// first on.
+func startChunkServer(t *testing.T, first string) *httptest.Server {
+	mux := http.NewServeMux()
+	var addr string
+	var lock sync.Mutex
+	next, _ := directory.ParseFileId(first)
+	mux.HandleFunc("/dir/assign", func(w http.ResponseWriter, r *http.Request) {
+		count, _ := strconv.Atoi(r.FormValue("count"))
+		if count < 1 {
+			count = 1
+		}
+		lock.Lock()
+		fid := next.String()
+		next.Key += uint64(count)
+		lock.Unlock()
+		auth := util.SignFileIds(*vSecureKey, util.SignedWrite, fid, count, time.Now().Unix()+60)
+		writeJson(w, r, operation.AssignResult{Fid: fid, Url: addr, PublicUrl: addr, Count: count, Auth: auth})
+	})
+	mux.HandleFunc("/dir/lookup", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, r, map[string]interface{}{"locations": []map[string]string{{"url": addr, "publicUrl": addr}}})
+	})
+	mux.HandleFunc("/", storeHandler)
+	server := httptest.NewServer(mux)
+	addr = strings.TrimPrefix(server.URL, "http://")
+	host, port, _ := net.SplitHostPort(addr)
+	*masterNode, *ip = addr, host
+	*vport, _ = strconv.Atoi(port)
+	return server
+}
+
+func TestChunkedUpload(t *testing.T) {
+	defer withTestStore(t, []byte("unchunked"))()
+	defer func(key, master, host string, port int) {
+		*vSecureKey, *masterNode, *ip, *vport = key, master, host, port
+	}(*vSecureKey, *masterNode, *ip, *vport)
+	*vSecureKey = "secret"
+	volumeLatency = util.NewLatencyStats(nil)
+	const fid = "3,02637037e0"
+	server := startChunkServer(t, fid)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	data := make([]byte, 2500)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	manifestFid, err := operation.UploadChunked(addr, "big.bin", "application/x-big", bytes.NewReader(data), int64(len(data)), operation.ChunkedOptions{ChunkSize: 1000})
+	if err != nil || manifestFid != fid {
+		t.Fatal("uploaded", manifestFid, err)
+	}
+	get := func(query string, header http.Header) (*http.Response, []byte) {
+		readAuth := util.SignFileId("secret", util.SignedRead, fid, time.Now().Unix()+60)
+		req, _ := http.NewRequest("GET", server.URL+"/"+fid+"?"+readAuth+query, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+	if resp, body := get("", nil); resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) || resp.Header.Get("Content-Type") != "application/x-big" {
+		t.Fatal("read", resp.Status, len(body), resp.Header)
+	}
+	// a range across the chunks
+	if resp, body := get("", http.Header{"Range": {"bytes=900-2099"}}); resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[900:2100]) {
+		t.Fatal("read the range", resp.Status, len(body))
+	}
+	resp, body := get("&cm=false", nil)
+	manifest, err := operation.ParseChunkManifest(body)
+	if err != nil || resp.Header.Get("X-Weed-Chunk-Manifest") != "true" || len(manifest.Chunks) != 3 || manifest.Pending ||
+		manifest.Chunks[2].Size != 500 || manifest.Chunks[1].Fid != fid+"_2" {
+		t.Fatal("unexpected manifest", string(body), err)
+	}
+
+	// a chunk lost, the manifest is refused complete, and resumed from the missing chunks
+	chunkId, _ := directory.ParseFileId(manifest.Chunks[1].Fid)
+	store.Delete(3, &storage.Needle{Id: chunkId.Key, Cookie: chunkId.Hashcode})
+	writeAuth := util.SignFileIds("secret", util.SignedWrite, fid, 4, time.Now().Unix()+60)
+	_, err = operation.UploadMimeContext(context.Background(), server.URL+"/"+fid+"?cm=true&"+writeAuth, "", "application/json", bytes.NewReader(body), nil)
+	if err == nil || !strings.Contains(err.Error(), "1 chunks are missing") {
+		t.Fatal("a manifest with a missing chunk should be refused", err)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/"+fid+"?chunks=missing&"+writeAuth, nil)
+	missingResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missing operation.MissingChunksResult
+	json.NewDecoder(missingResp.Body).Decode(&missing)
+	missingResp.Body.Close()
+	if len(missing.Missing) != 1 || missing.Missing[0] != 1 || missing.Manifest == nil {
+		t.Fatal("unexpected missing chunks", missing)
+	}
+	if err = operation.ResumeChunked(addr, fid, writeAuth, bytes.NewReader(data), 2); err != nil {
+		t.Fatal(err)
+	}
+	if resp, body := get("", nil); resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatal("read after the resume", resp.Status, len(body))
+	}
+
+	_, err = operation.UploadContext(context.Background(), server.URL+"/"+fid+"?append=true&"+writeAuth, "", bytes.NewReader([]byte("more")), nil)
+	if err == nil || !strings.Contains(err.Error(), storage.ErrAppendToManifest.Error()) {
+		t.Fatal("appending to a chunked file should be refused", err)
+	}
+
+	// deleting the manifest deletes its chunks
+	deleteAuth := util.SignFileId("secret", util.SignedDelete, fid, time.Now().Unix()+60)
+	if err = operation.Delete(server.URL + "/" + fid + "?" + deleteAuth); err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range manifest.Chunks {
+		id, _ := directory.ParseFileId(chunk.Fid)
+		if readNeedle(3, &storage.Needle{Id: id.Key, Cookie: id.Hashcode}) {
+			t.Error("chunk", chunk.Fid, "should be deleted")
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os/exec"
+	"pkg/storage"
+	"sync"
+)
+
+// volumeMasterKey reads the master key wrapping the data keys of the volumes,
+// from -encryptionKeyFile, or from the output of -encryptionKeyCommand, which
+// usually asks a KMS for it. nil means the volumes are not encrypted.
+func volumeMasterKey() ([]byte, error) {
+	var data []byte
+	var err error
+	switch {
+	case *vKeyFile != "" && *vKeyCommand != "":
+		return nil, errors.New("-encryptionKeyFile and -encryptionKeyCommand can not be both set")
+	case *vKeyFile != "":
+		if data, err = ioutil.ReadFile(*vKeyFile); err != nil {
+			return nil, err
+		}
+	case *vKeyCommand != "":
+		if data, err = exec.Command("sh", "-c", *vKeyCommand).Output(); err != nil {
+			return nil, errors.New("-encryptionKeyCommand: " + err.Error())
+		}
+	default:
+		return nil, nil
+	}
+	return storage.ParseMasterKey(data)
+}
+
+// reencryption is the progress of the re-encryption of a volume with a new data key.
+type reencryption struct {
+	Volume string
+	State  string // waiting, reencrypting, done or failed
+	Done   int64  // bytes of the volume read so far
+	Total  int64
+	Error  string `json:",omitempty"`
+}
+
+var (
+	reencryptions     []*reencryption // of the last re-encryption job
+	reencryptionsLock sync.Mutex
+)
+
+// rotateKeyHandler wraps the data keys of the volumes with the master key read
+// again from -encryptionKeyFile or -encryptionKeyCommand, after the key is
+// changed there. With reencrypt=true, the volumes are then re-encrypted with
+// new data keys in the background, one after the other.
+func rotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	masterKey, err := volumeMasterKey()
+	if err == nil && masterKey == nil {
+		err = errors.New("Volumes are not encrypted")
+	}
+	if err == nil {
+		err = store.RotateMasterKey(masterKey)
+	}
+	if err == nil && r.FormValue("reencrypt") == "true" {
+		err = startReencryption()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Println("Rotated the master key")
+	reencryptionHandler(w, r)
+}
+
+func startReencryption() error {
+	reencryptionsLock.Lock()
+	defer reencryptionsLock.Unlock()
+	for _, p := range reencryptions {
+		if p.State == "waiting" || p.State == "reencrypting" {
+			return errors.New("Volume " + p.Volume + " is still being re-encrypted")
+		}
+	}
+	reencryptions = nil
+	for _, info := range store.Status() {
+		reencryptions = append(reencryptions, &reencryption{Volume: info.Id.String(), State: "waiting", Total: info.Size})
+	}
+	go func(job []*reencryption) {
+		for _, p := range job {
+			setReencryption(p, "reencrypting", 0, p.Total, nil)
+			err := store.ReencryptVolume(p.Volume, func(done, total int64) {
+				setReencryption(p, "reencrypting", done, total, nil)
+			})
+			if err != nil {
+				log.Println("Re-encrypting volume", p.Volume, "failed:", err)
+				setReencryption(p, "failed", p.Done, p.Total, err)
+			} else {
+				setReencryption(p, "done", p.Total, p.Total, nil)
+			}
+		}
+	}(reencryptions)
+	return nil
+}
+
+func setReencryption(p *reencryption, state string, done, total int64, err error) {
+	reencryptionsLock.Lock()
+	defer reencryptionsLock.Unlock()
+	p.State, p.Done, p.Total = state, done, total
+	if err != nil {
+		p.Error = err.Error()
+	}
+}
+
+// reencryptionHandler lists the progress of the last re-encryption, per volume.
+func reencryptionHandler(w http.ResponseWriter, r *http.Request) {
+	reencryptionsLock.Lock()
+	progress := make([]reencryption, 0, len(reencryptions))
+	for _, p := range reencryptions {
+		progress = append(progress, *p)
+	}
+	reencryptionsLock.Unlock()
+	writeJson(w, r, map[string]interface{}{"Volumes": progress})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"pkg/util"
+	"strconv"
+)
+
+// volumeGrpcMethods are the methods of the Volume service of
+// pkg/operation/volume.proto, served on -grpcPort.
+var volumeGrpcMethods = map[string]http.HandlerFunc{
+	"/weedfs.Volume/Read": grpcMethod(map[int]string{1: "fid", 2: "auth"}, volumeGrpcReadHandler),
+}
+
+// volumeGrpcReadHandler answers the Read method with the file, as a GET of it
+// without gzip answers it, and its status if it fails. The file is only read
+// from this volume server, a redirect to another one is an error.
+func volumeGrpcReadHandler(w http.ResponseWriter, r *http.Request) {
+	read, err := http.NewRequest("GET", "/"+r.FormValue("fid")+"?"+r.FormValue("auth"), nil)
+	b := new(util.ProtoBuffer)
+	if err != nil {
+		b.EncodeString(2, err.Error())
+		writeProtobuf(w, b)
+		return
+	}
+	read = read.WithContext(r.Context())
+	read.RemoteAddr = r.RemoteAddr
+	answer := &grpcAnswer{header: make(http.Header)}
+	storeHandler(answer, read)
+	switch answer.status {
+	case http.StatusOK:
+		b.EncodeString(1, answer.body.String())
+		b.EncodeString(3, answer.header.Get("Content-Type"))
+	case 0:
+		b.EncodeString(2, "Invalid file id "+r.FormValue("fid"))
+	default:
+		b.EncodeString(2, strconv.Itoa(answer.status)+" "+http.StatusText(answer.status))
+	}
+	writeProtobuf(w, b)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// volumeFileHandler sends a file of a sealed or pinned volume, to a server
+// mirroring or replicating it, from ?offset= if given:
+//
+//	GET /admin/volume_file?volume=3&ext=.idx&offset=4096
+func volumeFileHandler(w http.ResponseWriter, r *http.Request) {
+	if !isDumpAuthorized(w, r, r.FormValue("volume")) {
+		return
+	}
+	f, err := store.OpenVolumeFile(r.FormValue("volume"), r.FormValue("ext"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusNotAcceptable)
+		}
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	stat, err := f.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	if offset < 0 || offset > stat.Size() {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		writeJson(w, r, map[string]string{"error": "offset " + r.FormValue("offset") + " is out of the file"})
+		return
+	}
+	if _, err = f.Seek(offset, 0); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	// the files can grow meanwhile, up to the size at the start is sent
+	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size()-offset, 10))
+	io.CopyN(w, f, stat.Size()-offset)
+}
+
+// mirrorVolumeHandler copies a sealed volume from the volume server ?source=, as
+// an extra read only replica of a hot volume, on the master's request:
+//
+//	POST /admin/mirror_volume?volume=3&collection=pictures&source=10.0.0.2:8080
+func mirrorVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	source, volume := r.FormValue("source"), r.FormValue("volume")
+	err := store.MirrorVolume(volume, r.FormValue("collection"), func(ext string, dst io.Writer) error {
+		return fetchVolumeFile(r, source, volume, ext, 0, dst)
+	})
+	if err == nil {
+		writeJson(w, r, map[string]string{"error": ""})
+	} else {
+		writeJson(w, r, map[string]string{"error": err.Error()})
+	}
+	debug("mirrored volume =", volume, "from", source, ", error =", err)
+}
+
+// replicateVolumeHandler copies a volume pinned by a snapshot on the volume server
+// ?source=, in place of a replica lost with its server, on the master's request:
+//
+//	POST /admin/replicate_volume?volume=3&collection=pictures&source=10.0.0.2:8080
+func replicateVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	source, volume := r.FormValue("source"), r.FormValue("volume")
+	err := store.ReplicateVolume(volume, r.FormValue("collection"), func(ext string, offset int64, dst io.Writer) error {
+		return fetchVolumeFile(r, source, volume, ext, offset, dst)
+	})
+	if err == nil {
+		writeJson(w, r, map[string]string{"error": ""})
+	} else {
+		writeJson(w, r, map[string]string{"error": err.Error()})
+	}
+	debug("replicated volume =", volume, "from", source, ", error =", err)
+}
+
+// fetchVolumeFile copies a file of the volume, from the offset on, from the
+// /admin/volume_file of the server.
+func fetchVolumeFile(r *http.Request, server, volume, ext string, offset int64, dst io.Writer) error {
+	values := url.Values{"volume": {volume}, "ext": {ext}}
+	if offset > 0 {
+		values.Set("offset", strconv.FormatInt(offset, 10))
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "GET", "http://"+server+"/admin/volume_file?"+signedDumpQuery(*vSecureKey, values), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && ext == ".key" {
+		return os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Volume " + volume + ext + " from " + server + ": " + resp.Status)
+	}
+	_, err = io.Copy(dst, resp.Body)
+	return err
+}
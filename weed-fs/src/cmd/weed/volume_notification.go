@@ -0,0 +1,22 @@
+package main
+
+import (
+	"pkg/notification"
+	"pkg/storage"
+)
+
+// volumeNotifier publishes the writes and deletes taken by this server to the
+// -notify message queue, nil without one. Only the server the client sent the
+// request to publishes it, not the other replicas.
+var volumeNotifier *notification.Notifier
+
+func notifyVolumeEvent(eventType string, volumeId storage.VolumeId, fileId string, size int64) {
+	if volumeNotifier == nil {
+		return
+	}
+	e := &notification.Event{Type: eventType, Source: "volume", Fid: fileId, Size: size}
+	if v := store.GetVolume(volumeId); v != nil {
+		e.Collection = v.Collection
+	}
+	volumeNotifier.Notify(e)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"pkg/directory"
+	"pkg/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partialUploads are the files created with their size and written in ranges.
+var partialUploads *storage.PartialUploads
+
+// PutHandler creates a file with its size, to be written in ranges, or writes
+// one of its ranges. The file is stored, and sent to the other replicas, by the
+// write of its last missing range:
+//
+//	PUT /3,01637037d6?size=1048576&filename=movie.mp4
+//	PUT /3,01637037d6 with Content-Range: bytes 0-65535/1048576
+func PutHandler(w http.ResponseWriter, r *http.Request) {
+	defer volumeLatency.Observe("write", r.URL.Path[1:], time.Now())
+	vid, fid, _ := directory.ParsePath(r.URL.Path)
+	volumeId, err := storage.NewVolumeId(vid)
+	if err == nil {
+		_, err = directory.ParseFileId(vid + "," + fid)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if !store.HasVolume(volumeId) {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": "Volume " + vid + " is not on this server"})
+		return
+	}
+	fileId := vid + "," + fid
+	contentRange := r.Header.Get("Content-Range")
+	if contentRange == "" {
+		size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJson(w, r, map[string]string{"error": "Expecting ?size= to create the file, or a Content-Range to write one of its ranges"})
+			return
+		}
+		u, err := partialUploads.Create(fileId, size, r.FormValue("filename"), r.Header, store.UploadPolicy(volumeId))
+		if refused, ok := err.(*storage.UploadRefusedError); ok {
+			w.WriteHeader(refused.Status)
+			writeJson(w, r, map[string]string{"error": err.Error()})
+		} else if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			writeJson(w, r, map[string]string{"error": err.Error()})
+		} else {
+			w.WriteHeader(http.StatusCreated)
+			writeJson(w, r, map[string]interface{}{"size": u.Size, "missing": u.Missing()})
+		}
+		return
+	}
+	start, end, total, err := parseContentRange(contentRange)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if r.ContentLength >= 0 && r.ContentLength != end-start {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJson(w, r, map[string]string{"error": "The body is not the length of the Content-Range"})
+		return
+	}
+	u, err := partialUploads.Write(fileId, start, end-start, total, r.Body)
+	if err == storage.ErrPartialUploadNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if !u.Complete() {
+		writeJson(w, r, map[string]interface{}{"size": u.Size, "missing": u.Missing()})
+		return
+	}
+	needle, err := partialUploads.Store(fileId)
+	if err != nil {
+		// another range completed it at the same time
+		w.WriteHeader(http.StatusAccepted)
+		writeJson(w, r, map[string]interface{}{"size": u.Size, "missing": u.Missing()})
+		return
+	}
+	if writeNeedle(w, r, volumeId, fileId, needle, u.Filename) {
+		partialUploads.Stored(fileId)
+	} else {
+		partialUploads.Release(fileId)
+	}
+}
+
+// parseContentRange parses "bytes 0-65535/1048576" into the range [start, end),
+// and the total size, -1 for "bytes 0-65535/*".
+func parseContentRange(contentRange string) (start, end, total int64, err error) {
+	err = errors.New("Invalid Content-Range " + contentRange + ", expecting bytes first-last/size")
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return
+	}
+	spec := strings.TrimPrefix(contentRange, "bytes ")
+	slash, dash := strings.Index(spec, "/"), strings.Index(spec, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return
+	}
+	var last int64
+	var e error
+	if start, e = strconv.ParseInt(spec[:dash], 10, 64); e != nil {
+		return
+	}
+	if last, e = strconv.ParseInt(spec[dash+1:slash], 10, 64); e != nil || last < start {
+		return
+	}
+	total = -1
+	if spec[slash+1:] != "*" {
+		if total, e = strconv.ParseInt(spec[slash+1:], 10, 64); e != nil {
+			return
+		}
+	}
+	return start, last + 1, total, nil
+}
+
+// purgePartialUploads drops the files created with their size and not written
+// completely within -partialUploadHours.
+func purgePartialUploads() {
+	for {
+		if count := partialUploads.Purge(time.Now().Add(-time.Duration(*vPartialHours) * time.Hour).Unix()); count > 0 {
+			log.Println("Dropped", count, "files not written completely within", *vPartialHours, "hours")
+		}
+		time.Sleep(time.Minute)
+	}
+}
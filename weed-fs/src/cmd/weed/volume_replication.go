@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"pkg/operation"
+	"pkg/storage"
+	"pkg/util"
+	"sync"
+	"time"
+)
+
+// Replicas failing -replicaFailures writes in a row are skipped, instead of
+// failing or slowing down every write during their outage. The writes skipped
+// on a replica are acknowledged with 202 Accepted, listing it in replicasPending.
+// Their intents stay pending, and the writes are sent to the replica once it
+// answers its /status probes again, or, after a restart, with the other pending intents.
+
+var (
+	replicaBreaker *util.CircuitBreaker
+
+	// deferredReplications are the intents of the writes skipped on some replicas,
+	// with only those replicas as the targets.
+	deferredReplications []*storage.Intent
+	deferredLock         sync.Mutex
+)
+
+// allowedReplicas splits the locations into the ones to write to, and the ones skipped.
+func allowedReplicas(locations []operation.Location) (allowed, skipped []operation.Location) {
+	for _, location := range locations {
+		if replicaBreaker.Allow(location.Url) {
+			allowed = append(allowed, location)
+		} else {
+			skipped = append(skipped, location)
+		}
+	}
+	return
+}
+
+// recordReplicaResult counts the result of a write to a replica, except the
+// writes canceled because another replica failed, or the client went away.
+func recordReplicaResult(location operation.Location, err error) {
+	if !errors.Is(err, context.Canceled) {
+		replicaBreaker.Record(location.Url, err)
+	}
+}
+
+func deferReplication(intent *storage.Intent, skipped []operation.Location) {
+	deferred := *intent
+	deferred.Targets = locationUrls(skipped)
+	deferredLock.Lock()
+	deferredReplications = append(deferredReplications, &deferred)
+	deferredLock.Unlock()
+}
+
+// completeDeferredReplications sends the skipped writes to the replicas that are back, every pulse.
+func completeDeferredReplications() {
+	for {
+		time.Sleep(time.Duration(*vpulse) * time.Second)
+		deferredLock.Lock()
+		intents := deferredReplications
+		deferredReplications = nil
+		deferredLock.Unlock()
+		var failed []*storage.Intent
+		for _, intent := range intents {
+			if !allReplicasAllowed(intent.Targets) {
+				failed = append(failed, intent)
+			} else if err := completeIntent(intent); err != nil {
+				log.Println("Failed to complete the replication of", intent.Fid, ":", err)
+				failed = append(failed, intent)
+			} else if err = intentLog.Done(intent); err != nil {
+				log.Println("Failed to log replication of", intent.Fid, "as done:", err)
+			}
+		}
+		if len(failed) > 0 {
+			deferredLock.Lock()
+			deferredReplications = append(failed, deferredReplications...)
+			deferredLock.Unlock()
+		}
+	}
+}
+
+func allReplicasAllowed(urls []string) bool {
+	for _, url := range urls {
+		if !replicaBreaker.Allow(url) {
+			return false
+		}
+	}
+	return true
+}
+
+func deferredReplicationCount() int {
+	deferredLock.Lock()
+	defer deferredLock.Unlock()
+	return len(deferredReplications)
+}
+
+// probeVolumeServer checks a skipped replica is back.
+func probeVolumeServer(url string) error {
+	ctx, cancel := util.WithRequestTimeout(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+url+"/status", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("status " + resp.Status)
+	}
+	return nil
+}
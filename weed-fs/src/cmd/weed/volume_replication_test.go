@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"pkg/operation"
+	"pkg/util"
+	"testing"
+	"time"
+)
+
+func TestReplicatedWriteCancelsTheOthersOnFailure(t *testing.T) {
+	defer func(b *util.CircuitBreaker) { replicaBreaker = b }(replicaBreaker)
+	replicaBreaker = util.NewCircuitBreaker(3, time.Hour, func(peer string) error { return nil })
+	locations := []operation.Location{{Url: "failing:8080"}, {Url: "slow:8080"}, {Url: "stuck:8080"}}
+	canceled := make(chan string, len(locations))
+	start := time.Now()
+	err := replicatedWrite(context.Background(), locations, func(ctx context.Context, location operation.Location) error {
+		switch location.Url {
+		case "failing:8080":
+			return errors.New("disk full")
+		case "slow:8080":
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			canceled <- location.Url
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+			return nil
+		}
+	})
+	if err == nil || err.Error() != "failing:8080: disk full" {
+		t.Fatal("expected the error of the failing replica, got", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("waited for the stuck replica")
+	}
+	if url := <-canceled; url != "stuck:8080" {
+		t.Fatal("canceled", url)
+	}
+
+	if err = replicatedWrite(context.Background(), locations, func(ctx context.Context, location operation.Location) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"pkg/util"
+	"sync"
+	"syscall"
+)
+
+// reloadableVolumeFlags are the volume server flags that can change while it runs.
+var reloadableVolumeFlags = []string{"debug", "latencyBudgets", "maxConcurrentWrites", "readOnly", "writeQueueSeconds"}
+
+// volumeSettingsLock serializes the changes of the settings.
+var volumeSettingsLock sync.Mutex
+
+// applyVolumeSettings puts the values of the reloadable flags in use. The
+// uploads holding a slot release it to the slots they took it from.
+func applyVolumeSettings() error {
+	budgets, err := util.ParseLatencyBudgets(*vLatencyBudget)
+	if err != nil {
+		return errors.New("-latencyBudgets: " + err.Error())
+	}
+	if *vMaxWrites < 0 || *vWriteQueueSec < 0 {
+		return errors.New("-maxConcurrentWrites and -writeQueueSeconds can not be negative")
+	}
+	volumeLatency.SetBudgets(budgets)
+	store.SetReadOnly(*vReadOnly)
+	writeSlotsLock.Lock()
+	defer writeSlotsLock.Unlock()
+	if cap(writeSlots) != *vMaxWrites {
+		writeSlots = nil
+		if *vMaxWrites > 0 {
+			writeSlots = make(chan bool, *vMaxWrites)
+		}
+	}
+	writeQueueSeconds = *vWriteQueueSec
+	return nil
+}
+
+// setVolumeSettings sets the reloadable flags, and puts them in use. If any
+// value is invalid, none is changed. The flags are set without marking them
+// as given on the command line, so a SIGHUP can set them again.
+func setVolumeSettings(values map[string]string) error {
+	volumeSettingsLock.Lock()
+	defer volumeSettingsLock.Unlock()
+	previous := make(map[string]string)
+	for _, name := range reloadableVolumeFlags {
+		previous[name] = cmdVolume.Flag.Lookup(name).Value.String()
+	}
+	var err error
+	for name, value := range values {
+		if _, ok := previous[name]; !ok {
+			err = errors.New("Setting " + name + " can not change while the server runs")
+		} else if e := cmdVolume.Flag.Lookup(name).Value.Set(value); e != nil {
+			err = errors.New(name + ": " + e.Error())
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = applyVolumeSettings()
+	}
+	if err != nil {
+		for name, value := range previous {
+			cmdVolume.Flag.Lookup(name).Value.Set(value)
+		}
+		applyVolumeSettings()
+		return err
+	}
+	log.Println("Volume server settings changed to", values)
+	return nil
+}
+
+func volumeSettings() map[string]interface{} {
+	settings := make(map[string]interface{})
+	for _, name := range reloadableVolumeFlags {
+		settings[name] = cmdVolume.Flag.Lookup(name).Value.(flag.Getter).Get()
+	}
+	return settings
+}
+
+func volumeSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	values := make(map[string]string)
+	for name := range r.Form {
+		values[name] = r.FormValue(name)
+	}
+	if len(values) > 0 {
+		if err := setVolumeSettings(values); err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			writeJson(w, r, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	writeJson(w, r, volumeSettings())
+}
+
+// reloadVolumeSettingsOnSighup sets the reloadable flags again from the
+// environment and the configuration file on each SIGHUP, or back to their
+// defaults, except the flags given on the command line.
+func reloadVolumeSettingsOnSighup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Println("Reloading the volume server settings")
+		sections, fileName, err := loadConfigFile()
+		if err != nil {
+			log.Println("Can not reload the settings:", err)
+			continue
+		}
+		onCommandLine := make(map[string]bool)
+		cmdVolume.Flag.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+		cmdServer.Flag.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+		values := make(map[string]string)
+		for _, name := range reloadableVolumeFlags {
+			if onCommandLine[name] || onCommandLine["volume."+name] {
+				continue
+			}
+			if value, ok := os.LookupEnv(configEnvName("volume", name)); ok {
+				values[name] = value
+			} else if value, ok := sections["volume"][name]; ok {
+				values[name] = value
+			} else {
+				values[name] = cmdVolume.Flag.Lookup(name).DefValue
+			}
+		}
+		status := http.StatusOK
+		if err = setVolumeSettings(values); err != nil {
+			log.Println("Can not reload the settings from", fileName, ":", err)
+			status = http.StatusNotAcceptable
+		}
+		recordAudit(volumeAudit, &util.AuditEntry{Principal: "SIGHUP", Operation: "reload settings", Params: values, Status: status})
+	}
+}
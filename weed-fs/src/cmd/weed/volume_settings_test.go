@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"pkg/storage"
+	"pkg/util"
+	"testing"
+)
+
+func TestVolumeSettingsHandler(t *testing.T) {
+	defer func(s *storage.Store) { store = s }(store)
+	store = storage.NewStore(0, "", "", nil, nil)
+	defer func(latency *util.LatencyStats) { volumeLatency = latency }(volumeLatency)
+	volumeLatency = util.NewLatencyStats(nil)
+	previous := make(map[string]string)
+	for _, name := range reloadableVolumeFlags {
+		previous[name] = cmdVolume.Flag.Lookup(name).Value.String()
+	}
+	defer setVolumeSettings(previous)
+
+	settings := func(query string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		volumeSettingsHandler(w, httptest.NewRequest("GET", "/admin/settings"+query, nil))
+		var reply map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatal("settings got", w.Code, w.Body.String())
+		}
+		return w.Code, reply
+	}
+
+	if code, reply := settings("?maxConcurrentWrites=4&readOnly=true&writeQueueSeconds=2"); code != http.StatusOK || reply["maxConcurrentWrites"] != float64(4) || reply["readOnly"] != true {
+		t.Fatal("change the settings got", code, reply)
+	}
+	if !store.ReadOnly() || cap(writeSlots) != 4 || writeQueueSeconds != 2 {
+		t.Error("the settings are not in use", store.ReadOnly(), cap(writeSlots), writeQueueSeconds)
+	}
+
+	// an invalid value, or a setting that can not change, changes nothing
+	for _, query := range []string{"?readOnly=false&maxConcurrentWrites=-1", "?readOnly=false&port=8081", "?readOnly=false&latencyBudgets=nonsense"} {
+		if code, reply := settings(query); code != http.StatusNotAcceptable || reply["error"] == nil {
+			t.Error(query, "got", code, reply)
+		}
+		if !store.ReadOnly() || cap(writeSlots) != 4 {
+			t.Error(query, "changed the settings")
+		}
+	}
+
+	if code, reply := settings("?readOnly=false&maxConcurrentWrites=0"); code != http.StatusOK || reply["readOnly"] != false {
+		t.Error("change the settings back got", code, reply)
+	}
+	if store.ReadOnly() || writeSlots != nil {
+		t.Error("the settings are not in use", store.ReadOnly(), cap(writeSlots))
+	}
+	if code, reply := settings(""); code != http.StatusOK || len(reply) != len(reloadableVolumeFlags) {
+		t.Error("the settings are", code, reply)
+	}
+}
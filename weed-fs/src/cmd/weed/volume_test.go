@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pkg/storage"
+	"pkg/util"
+	"testing"
+	"time"
+)
+
+func TestPostHandlerRejectsInvalidChecksumHeaders(t *testing.T) {
+	defer func(s *storage.Store) { store = s }(store)
+	store = storage.NewStore(0, "", "", nil, nil)
+	volumeLatency = util.NewLatencyStats(nil)
+	for header, value := range map[string]string{"Content-MD5": "not base64!", "X-Content-Sha256": "not hex"} {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "a.txt")
+		part.Write([]byte("hello"))
+		form.Close()
+		r := httptest.NewRequest("POST", "/3,01637037d6", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		r.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		PostHandler(w, r)
+		var reply map[string]string
+		if w.Code != http.StatusBadRequest || json.Unmarshal(w.Body.Bytes(), &reply) != nil || reply["error"] == "" {
+			t.Error("an invalid", header, "got", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestWriteTimestampNeedsWriteAtSignature(t *testing.T) {
+	defer func(key string) { *vSecureKey = key }(*vSecureKey)
+	*vSecureKey = "secret"
+	fid := "3,01637037d6"
+	expires := time.Now().Unix() + 60
+	for query, kept := range map[string]bool{
+		"ts=1380000000": false,
+		"ts=1380000000&" + util.SignFileId("secret", util.SignedWrite, fid, expires):   false,
+		"ts=1380000000&" + util.SignFileId("other", util.SignedWriteAt, fid, expires):  false,
+		"ts=1380000000&" + util.SignFileId("secret", util.SignedWriteAt, fid, expires): true,
+	} {
+		r := httptest.NewRequest("POST", "/"+fid+"?"+query, nil)
+		if ts, ok := writeTimestamp(r, fid); ok != kept || kept && ts != 1380000000 {
+			t.Error("with", query, "got", ts, ok)
+		}
+	}
+	*vSecureKey = ""
+	if ts, ok := writeTimestamp(httptest.NewRequest("POST", "/"+fid+"?ts=1380000000", nil), fid); !ok || ts != 1380000000 {
+		t.Error("without -secureKey, got", ts, ok)
+	}
+}
+
+func TestIsReplicaWrite(t *testing.T) {
+	defer func(key string) { *vSecureKey = key }(*vSecureKey)
+	*vSecureKey = "secret"
+	fid := "3,01637037d6"
+	expires := time.Now().Unix() + 60
+	for query, replica := range map[string]bool{
+		"type=standard": false,
+		"type=standard&" + util.SignFileId("secret", util.SignedWrite, fid, expires):     false,
+		"type=standard&" + util.SignFileId("secret", util.SignedWriteAt, fid, expires):   false,
+		"type=standard&" + util.SignFileId("other", util.SignedReplicate, fid, expires):  false,
+		util.SignFileId("secret", util.SignedReplicate, fid, expires):                    false,
+		"type=standard&" + util.SignFileId("secret", util.SignedReplicate, fid, expires): true,
+	} {
+		if isReplicaWrite(httptest.NewRequest("POST", "/"+fid+"?"+query, nil), fid) != replica {
+			t.Error("with", query, "expected", replica)
+		}
+	}
+	*vSecureKey = ""
+	if isReplicaWrite(httptest.NewRequest("POST", "/"+fid+"?type=standard", nil), fid) {
+		t.Error("without -secureKey, the replicas check the upload policy too")
+	}
+}
+
+func TestIsAuthorized(t *testing.T) {
+	defer func(key string, reads bool, s *storage.Store) { *vSecureKey, *vSignedReads, store = key, reads, s }(*vSecureKey, *vSignedReads, store)
+	*vSecureKey, *vSignedReads = "secret", false
+	store = storage.NewStore(0, "", "", nil, nil)
+	fid := "3,01637037d6"
+	expires := time.Now().Unix() + 60
+	for _, c := range []struct {
+		method, query string
+		expected      int
+	}{
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", util.SignFileId("secret", util.SignedWrite, fid, expires), http.StatusOK},
+		{"POST", util.SignFileId("secret", util.SignedWriteAt, fid, expires), http.StatusOK},
+		{"POST", util.SignFileId("secret", util.SignedReplicate, fid, expires), http.StatusOK},
+		{"POST", util.SignFileId("secret", util.SignedDelete, fid, expires), http.StatusUnauthorized},
+		{"POST", util.SignFileId("secret", util.SignedWrite, fid, time.Now().Unix()-1), http.StatusUnauthorized},
+		{"DELETE", util.SignFileId("secret", util.SignedWrite, fid, expires), http.StatusUnauthorized},
+		{"DELETE", util.SignFileId("secret", util.SignedDelete, fid, expires), http.StatusOK},
+		// the reads are signed until the master tells which collections need it
+		{"GET", "", http.StatusServiceUnavailable},
+		{"GET", util.SignFileId("secret", util.SignedRead, fid, expires), http.StatusOK},
+		{"GET", util.SignFileId("secret", util.SignedWrite, fid, expires), http.StatusServiceUnavailable},
+	} {
+		w := httptest.NewRecorder()
+		if authorized := isAuthorized(w, httptest.NewRequest(c.method, "/"+fid+"?"+c.query, nil)); authorized != (c.expected == http.StatusOK) || w.Code != c.expected {
+			t.Error(c.method, c.query, "got", authorized, w.Code, "expected", c.expected)
+		}
+	}
+	*vSecureKey = ""
+	if w := httptest.NewRecorder(); !isAuthorized(w, httptest.NewRequest("DELETE", "/"+fid, nil)) {
+		t.Error("without -secureKey, a delete got", w.Code)
+	}
+}
+
+func TestAdminFileEndpointsAreSigned(t *testing.T) {
+	defer func(key string, s *storage.Store) { *vSecureKey, store = key, s }(*vSecureKey, store)
+	*vSecureKey = "secret"
+	// the reads are signed until the master tells which collections need it
+	store = storage.NewStore(0, "", "", nil, nil)
+	for _, c := range []struct {
+		path    string
+		handler http.HandlerFunc
+		values  url.Values
+	}{
+		{"/admin/digest", digestHandler, url.Values{"volume": {"3"}}},
+		{"/admin/trash", trashHandler, url.Values{"volume": {"3"}}},
+		{"/admin/undelete", undeleteHandler, url.Values{"fid": {"3,01637037d6"}}},
+	} {
+		w := httptest.NewRecorder()
+		c.handler(w, httptest.NewRequest("POST", c.path+"?"+c.values.Encode(), nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Error(c.path, "without a signature got", w.Code)
+		}
+		w = httptest.NewRecorder()
+		c.handler(w, httptest.NewRequest("POST", c.path+"?"+signedDumpQuery("other", c.values), nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Error(c.path, "signed with another key got", w.Code)
+		}
+		// the volume is not there
+		w = httptest.NewRecorder()
+		c.handler(w, httptest.NewRequest("POST", c.path+"?"+signedDumpQuery("secret", c.values), nil))
+		if w.Code != http.StatusNotFound {
+			t.Error(c.path, "signed got", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestGetHandlerServesRanges(t *testing.T) {
+	defer withTestStore(t, []byte("hello ranged world"))()
+	volumeLatency = util.NewLatencyStats(nil)
+	get := func(byteRange string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/3,01637037d6.txt", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		r.Header.Set("Range", byteRange)
+		w := httptest.NewRecorder()
+		GetHandler(w, r)
+		return w
+	}
+	// the range is of the content uploaded, not of the gzipped one stored
+	w := get("bytes=6-11")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "ranged" ||
+		w.Header().Get("Content-Range") != "bytes 6-11/18" || w.Header().Get("Content-Encoding") != "" {
+		t.Fatal("got", w.Code, w.Header(), w.Body.String())
+	}
+	if w = get("bytes=-5"); w.Code != http.StatusPartialContent || w.Body.String() != "world" {
+		t.Fatal("the last bytes got", w.Code, w.Body.String())
+	}
+	if w = get("bytes=18-"); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatal("a range after the end got", w.Code)
+	}
+}
+
+func TestWriteSlotsQueueAndReject(t *testing.T) {
+	defer func(slots chan bool, seconds int) { writeSlots, writeQueueSeconds = slots, seconds }(writeSlots, writeQueueSeconds)
+	writeSlots, writeQueueSeconds = make(chan bool, 1), 1
+	r := httptest.NewRequest("POST", "/3,01637037d6", nil)
+	first, ok := acquireWriteSlot(httptest.NewRecorder(), r)
+	if !ok {
+		t.Fatal("the first upload did not get the free slot")
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		releaseWriteSlot(first)
+	}()
+	second, ok := acquireWriteSlot(httptest.NewRecorder(), r)
+	if !ok {
+		t.Fatal("the queued upload did not get the slot freed up")
+	}
+
+	writeQueueSeconds = 0
+	w := httptest.NewRecorder()
+	if _, ok := acquireWriteSlot(w, r); ok || w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatal("an upload with no slot free got", w.Code, "with Retry-After", w.Header().Get("Retry-After"))
+	}
+	releaseWriteSlot(second)
+	if _, ok := acquireWriteSlot(httptest.NewRecorder(), r); !ok {
+		t.Fatal("the released slot is not free")
+	}
+}
+
+func TestAdminPortHandler(t *testing.T) {
+	defer func(previous *storage.Store) { store = previous }(store)
+	store = storage.NewStore(8080, "", "", nil, nil)
+	store.AdminPort = 8081
+	w := httptest.NewRecorder()
+	adminPortHandler(w, httptest.NewRequest("GET", "/admin/assign_volume?volume=3", nil))
+	if w.Code != http.StatusNotFound || !bytes.Contains(w.Body.Bytes(), []byte("port 8081")) {
+		t.Error("the admin api on -port got", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"pkg/directory"
+	"pkg/notification"
+	"pkg/operation"
+	"pkg/storage"
+	"pkg/util"
+	"time"
+)
+
+// undeleteHandler brings back a deleted file still in the trash, on all its replicas:
+//
+//	POST /admin/undelete?fid=3,01637037d6
+func undeleteHandler(w http.ResponseWriter, r *http.Request) {
+	fileId := r.FormValue("fid")
+	vid, fid, _ := directory.ParsePath("/" + fileId)
+	volumeId, err := storage.NewVolumeId(vid)
+	if err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		writeJson(w, r, map[string]string{"error": "Unknown file id " + fileId})
+		return
+	}
+	if !isUndeleteAuthorized(w, r, vid) {
+		return
+	}
+	n := new(storage.Needle)
+	n.ParsePath(fid)
+	size, err := store.Undelete(volumeId, n)
+	if err == nil && r.FormValue("type") != "standard" {
+		if !distributedOperation(r.Context(), volumeId, func(ctx context.Context, location operation.Location) bool {
+			server := location.Url
+			if location.AdminUrl != "" {
+				server = location.AdminUrl
+			}
+			return nil == undeleteReplica(ctx, server, fileId)
+		}) {
+			err = errors.New("Failed to undelete on the other replicas of volume " + volumeId.String())
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	if r.FormValue("type") != "standard" && readNeedle(volumeId, n) {
+		notifyVolumeEvent(notification.Create, volumeId, vid+","+fid, int64(len(n.Data)))
+	}
+	writeJson(w, r, map[string]uint32{"size": size})
+}
+
+func undeleteReplica(ctx context.Context, server string, fileId string) error {
+	query := signedDumpQuery(*vSecureKey, url.Values{"fid": {fileId}, "type": {"standard"}})
+	jsonBlob, err := util.PostContext(ctx, "http://"+server+"/admin/undelete?"+query, url.Values{})
+	if err != nil {
+		return err
+	}
+	var ret struct{ Error string }
+	if err = json.Unmarshal(jsonBlob, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	return nil
+}
+
+// isUndeleteAuthorized checks that an undelete is signed with -secureKey, as
+// the writes and the deletes are, whenever there is one.
+func isUndeleteAuthorized(w http.ResponseWriter, r *http.Request, vid string) bool {
+	if *vSecureKey == "" {
+		return isDumpAuthorized(w, r, vid)
+	}
+	if err := util.VerifyValuesSignature(*vSecureKey, r.URL.Query(), time.Minute); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// trashHandler lists the deleted files of a volume that can still be undeleted,
+// with the cookies to read them, so it is signed like the dumps of the volume.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	if !isDumpAuthorized(w, r, r.FormValue("volume")) {
+		return
+	}
+	trashed, err := store.Trashed(r.FormValue("volume"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, r, map[string]string{"error": err.Error()})
+		return
+	}
+	volumeId, _ := storage.NewVolumeId(r.FormValue("volume"))
+	files := make([]map[string]interface{}, 0, len(trashed))
+	for _, t := range trashed {
+		files = append(files, map[string]interface{}{
+			"Fid":       directory.NewFileId(volumeId, t.Id, t.Cookie).String(),
+			"Size":      t.Size,
+			"DeletedAt": t.DeletedAt,
+		})
+	}
+	writeJson(w, r, map[string]interface{}{"Files": files, "RetentionSeconds": *vTrashSeconds})
+}
+
+// purgeTrash erases the deleted files past the -trashSeconds retention, every minute.
+func purgeTrash() {
+	for {
+		if count := store.PurgeTrash(); count > 0 {
+			log.Println("Purged", count, "deleted files from the trash")
+		}
+		time.Sleep(time.Minute)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"pkg/directory"
+	"pkg/storage"
+	"sort"
+	"time"
+)
+
+const (
+	volumeUiMaxFiles = 100
+)
+
+var volumeUiTemplate = template.Must(template.New("volume").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Weed File System Volume Server</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 16px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Weed File System Volume Server {{.Version}}</h1>
+<p>Master: {{.Master}}</p>
+<table>
+<tr><th>Volume</th><th>Collection</th><th>Replication</th><th>Size</th><th>Files</th><th>Deleted</th><th>Deleted Bytes</th><th>Average File Size</th><th>Needle Version</th></tr>
+{{range .Volumes}}
+<tr><td><a href="/ui/volume?volume={{.Id}}">{{.Id}}</a></td><td>{{.Collection}}</td><td>{{.RepType}}</td><td>{{.Size}}</td><td>{{.FileCount}}</td><td>{{.DeleteCount}}</td><td>{{.DeletedByteCount}}</td><td>{{.AverageFileSize}}</td><td>{{.Version}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+var volumeUiVolumeTemplate = template.Must(template.New("volume").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Weed File System Volume {{.Volume.Id}}</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 16px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Volume {{.Volume.Id}}</h1>
+<p><a href="/ui/">all volumes</a></p>
+<table>
+<tr><th>Collection</th><td>{{.Volume.Collection}}</td></tr>
+<tr><th>Replication</th><td>{{.Volume.RepType}}</td></tr>
+<tr><th>Size</th><td>{{.Volume.Size}}</td></tr>
+<tr><th>Files</th><td>{{.Volume.FileCount}}</td></tr>
+<tr><th>Deleted Files</th><td>{{.Volume.DeleteCount}}</td></tr>
+<tr><th>Deleted Bytes</th><td>{{.Volume.DeletedByteCount}}</td></tr>
+<tr><th>Garbage Ratio</th><td>{{printf "%.3f" .GarbageRatio}}</td></tr>
+<tr><th>Average File Size</th><td>{{.Volume.AverageFileSize}}</td></tr>
+<tr><th>Needle Version</th><td>{{.Volume.Version}}</td></tr>
+</table>
+<h2>Latest Files</h2>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<table>
+<tr><th>File Id</th><th>Size</th><th>Last Modified</th></tr>
+{{range .Files}}<tr><td><a href="/{{.Fid}}">{{.Fid}}</a></td><td>{{.Size}}</td><td>{{.LastModified}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+func volumeUiHandler(w http.ResponseWriter, r *http.Request) {
+	m := make(map[string]interface{})
+	m["Version"] = VERSION
+	m["Master"] = *masterNode
+	volumes := store.Status()
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Id < volumes[j].Id })
+	m["Volumes"] = volumes
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := volumeUiTemplate.Execute(w, m); err != nil {
+		debug("volume ui error:", err)
+	}
+}
+
+func volumeUiVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	volumeId, err := storage.NewVolumeId(r.FormValue("volume"))
+	if err != nil || !store.HasVolume(volumeId) {
+		http.NotFound(w, r)
+		return
+	}
+	m := make(map[string]interface{})
+	for _, v := range store.Status() {
+		if v.Id == volumeId {
+			m["Volume"] = v
+		}
+	}
+	m["GarbageRatio"], _ = store.CheckCompactVolume(volumeId.String())
+	needles, err := store.ModifiedSince(volumeId.String(), 0)
+	if err != nil {
+		m["Error"] = err.Error()
+	}
+	if len(needles) > volumeUiMaxFiles {
+		needles = needles[len(needles)-volumeUiMaxFiles:]
+	}
+	var files []map[string]interface{}
+	for i := len(needles) - 1; i >= 0; i-- {
+		n := needles[i]
+		files = append(files, map[string]interface{}{
+			"Fid":          directory.NewFileId(volumeId, n.Id, n.Cookie).String(),
+			"Size":         n.DataSize,
+			"LastModified": time.Unix(int64(n.LastModified), 0).Format("2006-01-02 15:04:05"),
+		})
+	}
+	m["Files"] = files
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := volumeUiVolumeTemplate.Execute(w, m); err != nil {
+		debug("volume ui error:", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
 	"text/template"
@@ -20,10 +21,23 @@ var IsDebug *bool
 var server *string
 
 var commands = []*Command{
+	cmdBackup,
+	cmdCache,
+	cmdConfig,
+	cmdDownload,
+	cmdFiler,
 	cmdFix,
 	cmdMaster,
+	cmdMerge,
+	cmdMirror,
+	cmdNfs,
+	cmdRestore,
+	cmdServer,
+	cmdUpgrade,
 	cmdUpload,
 	cmdShell,
+	cmdSync,
+	cmdVerify,
 	cmdVersion,
 	cmdVolume,
 }
@@ -65,6 +79,12 @@ func main() {
 			cmd.Flag.Usage = func() { cmd.Usage() }
 			cmd.Flag.Parse(args[1:])
 			args = cmd.Flag.Args()
+			if _, err := applyConfig(cmd); err != nil {
+				fmt.Fprintf(os.Stderr, "weed: %s\n", err)
+				setExitStatus(2)
+				exit()
+				return
+			}
 			if !cmd.Run(cmd, args) {
 				fmt.Fprintf(os.Stderr, "\n")
 				cmd.Flag.Usage()
@@ -171,15 +191,28 @@ func exitIfErrors() {
 		exit()
 	}
 }
+
+// jsonpCallbackPattern only allows callbacks like "cb" or "jQuery123.handle",
+// so that the callback parameter can not inject scripts. Any other callback is
+// ignored, and the reply is plain json with the status the handler chose.
+var jsonpCallbackPattern = regexp.MustCompile(`^[a-zA-Z_$][0-9a-zA-Z_$.]*$`)
+
 func writeJson(w http.ResponseWriter, r *http.Request, obj interface{}) {
-	w.Header().Set("Content-Type", "application/javascript")
+	callback := r.FormValue("callback")
+	if !jsonpCallbackPattern.MatchString(callback) {
+		callback = ""
+	}
+	if callback == "" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/javascript")
+	}
 	var bytes []byte
 	if r.FormValue("pretty") != "" {
     bytes, _ = json.MarshalIndent(obj, "", "  ")
 	} else {
     bytes, _ = json.Marshal(obj)
 	}
-	callback := r.FormValue("callback")
 	if callback == "" {
 		w.Write(bytes)
 	} else {
@@ -190,8 +223,38 @@ func writeJson(w http.ResponseWriter, r *http.Request, obj interface{}) {
 	}
 }
 
+// withCors lets browser based clients from the comma separated origins call
+// the handler across origins. "*" allows any origin, and "" disables CORS.
+func withCors(origins string, h http.Handler) http.Handler {
+	if origins == "" {
+		return h
+	}
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(origins, ",") {
+		allowed[strings.TrimSpace(origin)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && (allowed["*"] || allowed[origin]) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Encoding, Last-Modified, Location")
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				w.Header().Set("Access-Control-Max-Age", "86400")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func debug(params ...interface{}) {
 	if *IsDebug {
-		fmt.Println(params)
+		fmt.Println(params...)
 	}
 }
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteJsonCallback(t *testing.T) {
+	for query, expected := range map[string]string{
+		"":                         `{"a":"b"}`,
+		"?callback=jQuery1.handle": `jQuery1.handle({"a":"b"})`,
+		"?callback=alert(1)//":     `{"a":"b"}`,
+	} {
+		w := httptest.NewRecorder()
+		w.WriteHeader(http.StatusNotFound)
+		writeJson(w, httptest.NewRequest("GET", "/"+query, nil), map[string]string{"a": "b"})
+		if w.Code != http.StatusNotFound || w.Body.String() != expected {
+			t.Error("with", query, "got", w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package directory
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// FidRedirects maps the file ids of renumbered volumes, e.g. by weed merge, to
+// their new file ids, so that the old file ids keep resolving. The volume id of
+// an old file id is usually in use by another volume, so the table is by file,
+// not by volume. The entries are appended to a file, and loaded back on start.
+type FidRedirects struct {
+	lock  sync.RWMutex
+	table map[FileId]FileId
+	file  *os.File
+
+	lookups, hits uint64
+}
+
+// NewFidRedirects loads the redirects saved in the file, creating it if needed.
+func NewFidRedirects(fileName string) (*FidRedirects, error) {
+	f := &FidRedirects{table: make(map[FileId]FileId)}
+	if file, err := os.Open(fileName); err == nil {
+		redirects, err := readRedirects(file)
+		file.Close()
+		if err != nil {
+			return nil, errors.New(fileName + ": " + err.Error())
+		}
+		for from, to := range redirects {
+			f.table[from] = to
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	var err error
+	if f.file, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readRedirects parses "old_fid new_fid" lines.
+func readRedirects(r io.Reader) (map[FileId]FileId, error) {
+	redirects := make(map[FileId]FileId)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("Invalid redirect \"" + line + "\", expecting \"old_fid new_fid\"")
+		}
+		from, err := ParseFileId(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := ParseFileId(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		redirects[*from] = *to
+	}
+	return redirects, scanner.Err()
+}
+
+// Add adds the "old_fid new_fid" lines, the format of the table of weed merge,
+// and saves them. It returns the number of redirects added.
+func (f *FidRedirects) Add(r io.Reader) (int, error) {
+	redirects, err := readRedirects(r)
+	if err != nil {
+		return 0, err
+	}
+	var lines []string
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for from, to := range redirects {
+		f.table[from] = to
+		lines = append(lines, from.String()+" "+to.String()+"\n")
+	}
+	if _, err = f.file.WriteString(strings.Join(lines, "")); err == nil {
+		err = f.file.Sync()
+	}
+	return len(redirects), err
+}
+
+// Resolve returns the new file id of a redirected file id, or false if it is not
+// redirected. A file id with the _N suffix of an assign resolves as the file of its key.
+func (f *FidRedirects) Resolve(fid *FileId) (*FileId, bool) {
+	atomic.AddUint64(&f.lookups, 1)
+	f.lock.RLock()
+	to, ok := f.table[*fid]
+	f.lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	atomic.AddUint64(&f.hits, 1)
+	return &to, true
+}
+
+func (f *FidRedirects) ToMap() map[string]interface{} {
+	f.lock.RLock()
+	entries := len(f.table)
+	f.lock.RUnlock()
+	lookups, hits := atomic.LoadUint64(&f.lookups), atomic.LoadUint64(&f.hits)
+	hitRate := 0.0
+	if lookups > 0 {
+		hitRate = float64(hits) / float64(lookups)
+	}
+	return map[string]interface{}{"Entries": entries, "Lookups": lookups, "Hits": hits, "HitRate": hitRate}
+}
@@ -0,0 +1,44 @@
+package directory
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFidRedirects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redirects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := dir + "/fid_redirects.txt"
+	f, err := NewFidRedirects(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Add(strings.NewReader("3,01637037d6 9,01637037d6\n3,x 9,01637037d6\n")); err == nil {
+		t.Fatal("an invalid line should fail the whole add")
+	}
+	if count, err := f.Add(strings.NewReader("3,01637037d6 9,01637037d6\n\n3,02637037d6 9,02637037d6\n")); err != nil || count != 2 {
+		t.Fatal("unexpected add", count, err)
+	}
+
+	// loaded back, as after a restart of the master
+	f, err = NewFidRedirects(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid, _ := ParseFileId("3,01637037d6_1")
+	if to, ok := f.Resolve(fid); !ok || to.String() != "9,02637037d6" {
+		t.Fatal("the second file of the assign should resolve, got", to)
+	}
+	fid, _ = ParseFileId("3,03637037d6")
+	if _, ok := f.Resolve(fid); ok {
+		t.Fatal("3,03637037d6 is not redirected")
+	}
+	if stats := f.ToMap(); stats["Entries"] != 2 || stats["Hits"] != uint64(1) || stats["HitRate"] != 0.5 {
+		t.Fatal("unexpected stats", stats)
+	}
+}
@@ -2,9 +2,12 @@ package directory
 
 import (
 	"encoding/hex"
+	"errors"
+	"log"
 	"pkg/storage"
-	"strings"
 	"pkg/util"
+	"strconv"
+	"strings"
 )
 
 type FileId struct {
@@ -16,17 +19,80 @@ type FileId struct {
 func NewFileId(VolumeId storage.VolumeId, Key uint64, Hashcode uint32) *FileId {
 	return &FileId{VolumeId: VolumeId, Key: Key, Hashcode: Hashcode}
 }
-func ParseFileId(fid string) *FileId{
+
+// ParseFileId parses a file id like 3,01637037d6, also with the _1, _2, ... suffixes
+// of the file ids assigned together with /dir/assign?count=N.
+func ParseFileId(fid string) (*FileId, error) {
 	a := strings.Split(fid, ",")
 	if len(a) != 2 {
-		println("Invalid fid", fid, ", split length", len(a))
-		return nil
+		return nil, errors.New("Invalid file id " + fid)
+	}
+	volumeId, err := storage.NewVolumeId(a[0])
+	if err != nil {
+		return nil, errors.New("Invalid volume id in file id " + fid)
+	}
+	keyHash, delta := a[1], uint64(0)
+	if deltaIndex := strings.LastIndex(keyHash, "_"); deltaIndex > 0 {
+		if delta, err = strconv.ParseUint(keyHash[deltaIndex+1:], 10, 64); err != nil {
+			return nil, errors.New("Invalid file id suffix in " + fid)
+		}
+		keyHash = keyHash[:deltaIndex]
 	}
-	vid_string, key_hash_string := a[0], a[1]
-  volumeId, _ := storage.NewVolumeId(vid_string)
-	key, hash := storage.ParseKeyHash(key_hash_string)
-	return &FileId{VolumeId: volumeId, Key: key, Hashcode: hash}
+	if b, err := hex.DecodeString(keyHash); err != nil || len(b) <= 4 || len(b) > 12 {
+		return nil, errors.New("Invalid key and cookie in file id " + fid)
+	}
+	key, hash := storage.ParseKeyHash(keyHash)
+	return &FileId{VolumeId: volumeId, Key: key + delta, Hashcode: hash}, nil
 }
+
+// ParseVolumeId reads the volume id of a file id, or just a volume id, without looking up anything.
+func ParseVolumeId(fid string) (storage.VolumeId, error) {
+	if commaSep := strings.Index(fid, ","); commaSep > 0 {
+		fid = fid[0:commaSep]
+	}
+	return storage.NewVolumeId(fid)
+}
+
+// FileIds lists the count file ids assigned by one /dir/assign?count=N,
+// which are fid, fid_1, fid_2, ... fid_N-1.
+func FileIds(fid string, count int) []string {
+	fids := []string{fid}
+	for i := 1; i < count; i++ {
+		fids = append(fids, fid+"_"+strconv.Itoa(i))
+	}
+	return fids
+}
+
+// ParsePath splits a url path like /3,01637037d6.jpg into the volume id,
+// the file key and cookie, and the extension with the dot.
+func ParsePath(path string) (vid, fid, ext string) {
+	sepIndex := strings.LastIndex(path, "/")
+	commaIndex := strings.LastIndex(path[sepIndex:], ",")
+	if commaIndex <= 0 {
+		if "favicon.ico" != path[sepIndex+1:] {
+			log.Println("unknown file id", path[sepIndex+1:])
+		}
+		return
+	}
+	commaIndex += sepIndex
+	dotIndex := strings.LastIndex(path[commaIndex:], ".")
+	vid = path[sepIndex+1 : commaIndex]
+	fid = path[commaIndex+1:]
+	ext = ""
+	if dotIndex > 0 {
+		dotIndex += commaIndex
+		fid = path[commaIndex+1 : dotIndex]
+		ext = path[dotIndex:]
+	}
+	return
+}
+
+// FileUrl is the url of the file on the volume server, e.g. at the publicUrl from a lookup.
+// The extension, like .jpg, sets the content type the file is served with.
+func FileUrl(server string, fid string, ext string) string {
+	return "http://" + server + "/" + fid + ext
+}
+
 func (n *FileId) String() string {
 	bytes := make([]byte, 12)
 	util.Uint64toBytes(bytes[0:8], n.Key)
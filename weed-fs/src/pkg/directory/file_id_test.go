@@ -0,0 +1,40 @@
+package directory
+
+import (
+	"testing"
+)
+
+func TestParseFileId(t *testing.T) {
+	f, err := ParseFileId("3,01637037d6")
+	if err != nil || f.VolumeId != 3 || f.Key != 1 || f.Hashcode != 0x637037d6 {
+		t.Fatal("unexpected", f, err)
+	}
+	if f.String() != "3,01637037d6" {
+		t.Fatal("file id should print as parsed, got", f.String())
+	}
+	fids := FileIds("3,01637037d6", 3)
+	if len(fids) != 3 || fids[2] != "3,01637037d6_2" {
+		t.Fatal("unexpected file ids", fids)
+	}
+	if f, err = ParseFileId(fids[2]); err != nil || f.Key != 3 || f.String() != "3,03637037d6" {
+		t.Fatal("the suffix should be added to the key, got", f, err)
+	}
+	for _, bad := range []string{"3", "x,01637037d6", "3,637037d6", "3,zz637037d6", "3,01637037d6_x"} {
+		if _, err := ParseFileId(bad); err == nil {
+			t.Fatal("file id", bad, "should not parse")
+		}
+	}
+	if vid, err := ParseVolumeId("7,01637037d6"); err != nil || vid != 7 {
+		t.Fatal("unexpected volume id", vid, err)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	vid, fid, ext := ParsePath("/3,01637037d6.jpg")
+	if vid != "3" || fid != "01637037d6" || ext != ".jpg" {
+		t.Fatal("unexpected", vid, fid, ext)
+	}
+	if url := FileUrl("localhost:8080", vid+","+fid, ext); url != "http://localhost:8080/3,01637037d6.jpg" {
+		t.Fatal("unexpected url", url)
+	}
+}
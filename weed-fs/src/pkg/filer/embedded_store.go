@@ -0,0 +1,595 @@
+package filer
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"pkg/util"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minCompactLines is how many lines the filer log has beyond twice the live
+// files and versions, before it is compacted.
+var minCompactLines = 100000
+
+// EmbeddedStore keeps all entries in memory, and persists every change
+// to an append-only log file, which is replayed on start up.
+// It is meant for a single filer without external dependencies.
+// A change returns once it is synced to the disk, the changes waiting at the
+// same time sharing one sync, and the log is rewritten with only the live
+// entries once it has many more lines.
+type EmbeddedStore struct {
+	files    map[string]map[string]string // dir => file name => fid
+	subdirs  map[string]map[string]bool   // dir => sub directory names
+	entries  map[string]*sortedNames      // dir => file names, and sub directory names with a trailing "/"
+	versions map[string][]VersionEntry    // full file name => previous versions, oldest first
+	version  int                          // the last version number, of any file
+	live     int                          // files and versions
+	logName  string
+	logFile  *os.File
+	logLines int
+	failedAt int // the log lines when the last compaction failed
+	sync     *util.GroupSync
+	lock     sync.RWMutex
+}
+
+func NewEmbeddedStore(dirname string) (s *EmbeddedStore, err error) {
+	s = &EmbeddedStore{
+		files:    make(map[string]map[string]string),
+		subdirs:  make(map[string]map[string]bool),
+		entries:  make(map[string]*sortedNames),
+		versions: make(map[string][]VersionEntry),
+		logName:  path.Join(dirname, "filer.log"),
+	}
+	if s.logFile, err = os.OpenFile(s.logName, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	}
+	var size int64
+	if size, err = s.replay(s.logFile); err == nil {
+		// drop the last line if it was cut short by a crash, before it was synced
+		if err = s.logFile.Truncate(size); err == nil {
+			_, err = s.logFile.Seek(size, io.SeekStart)
+		}
+	}
+	if err != nil {
+		s.logFile.Close()
+		return nil, err
+	}
+	s.sync = util.NewGroupSync(s.logFile)
+	s.compactIfNeeded()
+	log.Println("Loaded filer store", s.logName, "with", len(s.files), "directories")
+	return s, nil
+}
+
+// replay applies the complete lines of the log, and returns their size.
+func (s *EmbeddedStore) replay(r io.Reader) (size int64, err error) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		if err = s.apply(strings.TrimRight(line, "\n")); err != nil {
+			return size, err
+		}
+		size += int64(len(line))
+		s.logLines++
+	}
+}
+
+func (s *EmbeddedStore) apply(line string) error {
+	if len(line) < 2 {
+		return errors.New("Corrupted filer log line: " + line)
+	}
+	switch line[0] {
+	case '+', '-', 'V', 'v':
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) != 3 {
+			return errors.New("Corrupted filer log line: " + line)
+		}
+		fullFileName, err := strconv.Unquote(parts[2])
+		if err != nil {
+			return err
+		}
+		switch parts[0] {
+		case "+":
+			s.put(fullFileName, parts[1])
+		case "-":
+			s.remove(fullFileName)
+		case "V":
+			s.addVersion(fullFileName, parts[1])
+		case "v":
+			s.removeVersion(fullFileName, parts[1])
+		}
+	case '>', 'D':
+		from, to, err := unquotePair(line[2:])
+		if err != nil {
+			return errors.New("Corrupted filer log line: " + line)
+		}
+		if line[0] == '>' {
+			s.move(from, to)
+		} else {
+			s.moveDirectory(from, to)
+		}
+	case '#':
+		version, err := strconv.Atoi(line[2:])
+		if err != nil {
+			return errors.New("Corrupted filer log line: " + line)
+		}
+		s.version = version
+	default:
+		return errors.New("Corrupted filer log line: " + line)
+	}
+	return nil
+}
+
+func unquotePair(line string) (first, second string, err error) {
+	quoted, err := strconv.QuotedPrefix(line)
+	if err != nil || len(line) < len(quoted)+1 {
+		return "", "", errors.New("invalid quoted pair")
+	}
+	if first, err = strconv.Unquote(quoted); err != nil {
+		return
+	}
+	second, err = strconv.Unquote(line[len(quoted)+1:])
+	return
+}
+
+func (s *EmbeddedStore) appendLog(op, fid, fullFileName string) error {
+	_, err := s.logFile.WriteString(op + " " + fid + " " + strconv.Quote(fullFileName) + "\n")
+	s.logLines++
+	return err
+}
+
+// update makes the change under the lock, and returns once its log lines are
+// synced to the disk.
+func (s *EmbeddedStore) update(change func() error) error {
+	s.lock.Lock()
+	lines := s.logLines
+	err := change()
+	var ticket uint64
+	if s.logLines > lines {
+		ticket = s.sync.Written()
+		s.compactIfNeeded()
+	}
+	s.lock.Unlock()
+	if ticket == 0 {
+		return err
+	}
+	if syncErr := s.sync.Wait(ticket); err == nil {
+		err = syncErr
+	}
+	return err
+}
+
+func (s *EmbeddedStore) compactIfNeeded() {
+	if s.logLines <= 2*s.live+minCompactLines || s.logLines <= 2*s.failedAt {
+		return
+	}
+	if err := s.compact(); err != nil {
+		log.Println("Failed to compact the filer log", s.logName, ":", err)
+		s.failedAt = s.logLines
+	}
+}
+
+// compact writes the live files and versions into a new log, and renames it
+// over the log once synced.
+func (s *EmbeddedStore) compact() error {
+	f, err := os.Create(s.logName + ".tmp")
+	if err != nil {
+		return err
+	}
+	w, lines := bufio.NewWriter(f), 0
+	writeLine := func(line string) {
+		w.WriteString(line + "\n")
+		lines++
+	}
+	for dir, files := range s.files {
+		for name, fid := range files {
+			writeLine("+ " + fid + " " + strconv.Quote(path.Join(dir, name)))
+		}
+	}
+	// the versions in the order of their numbers, with the counter set before the gaps
+	type fileVersion struct {
+		fullFileName string
+		VersionEntry
+	}
+	var versions []fileVersion
+	for fullFileName, entries := range s.versions {
+		for _, v := range entries {
+			versions = append(versions, fileVersion{fullFileName, v})
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	counter := 0
+	for _, v := range versions {
+		if v.Version-1 != counter {
+			writeLine("# " + strconv.Itoa(v.Version-1))
+		}
+		writeLine("V " + v.Id + " " + strconv.Quote(v.fullFileName))
+		counter = v.Version
+	}
+	if counter != s.version {
+		writeLine("# " + strconv.Itoa(s.version))
+	}
+	if err = w.Flush(); err == nil {
+		if err = util.Fsync(f); err == nil {
+			err = os.Rename(f.Name(), s.logName)
+		}
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if dir, err := os.Open(path.Dir(s.logName)); err == nil {
+		util.Fsync(dir)
+		dir.Close()
+	}
+	s.logFile.Close()
+	s.logFile, s.logLines, s.failedAt = f, lines, 0
+	s.sync.Reset(f)
+	log.Println("Compacted the filer log", s.logName, "to", lines, "lines")
+	return nil
+}
+
+func (s *EmbeddedStore) put(fullFileName string, fid string) {
+	dir, name := path.Split(fullFileName)
+	dir = cleanPath(dir)
+	if s.files[dir] == nil {
+		s.files[dir] = make(map[string]string)
+	}
+	if _, ok := s.files[dir][name]; !ok {
+		s.live++
+	}
+	s.files[dir][name] = fid
+	s.addEntry(dir, name)
+	s.linkDirectory(dir)
+}
+
+func (s *EmbeddedStore) remove(fullFileName string) (fid string, ok bool) {
+	dir, name := path.Split(fullFileName)
+	dir = cleanPath(dir)
+	if fid, ok = s.files[dir][name]; !ok {
+		return "", false
+	}
+	delete(s.files[dir], name)
+	s.live--
+	s.removeEntry(dir, name)
+	s.pruneDirectory(dir)
+	return fid, true
+}
+
+func (s *EmbeddedStore) move(from, to string) bool {
+	fid, ok := s.remove(from)
+	if ok {
+		s.put(to, fid)
+		if versions, found := s.versions[from]; found {
+			s.versions[to] = versions
+			delete(s.versions, from)
+		}
+	}
+	return ok
+}
+
+func (s *EmbeddedStore) addVersion(fullFileName string, fid string) {
+	s.version++
+	s.live++
+	s.versions[fullFileName] = append(s.versions[fullFileName], VersionEntry{Version: s.version, Id: fid})
+}
+
+func (s *EmbeddedStore) removeVersion(fullFileName string, fid string) {
+	versions := s.versions[fullFileName]
+	for i, v := range versions {
+		if v.Id == fid {
+			versions = append(versions[:i], versions[i+1:]...)
+			s.live--
+			break
+		}
+	}
+	if len(versions) == 0 {
+		delete(s.versions, fullFileName)
+	} else {
+		s.versions[fullFileName] = versions
+	}
+}
+
+func (s *EmbeddedStore) moveDirectory(fromDir, toDir string) {
+	var dirs []string
+	for dir := range s.files {
+		if isInDirectory(dir, fromDir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		s.files[toDir+dir[len(fromDir):]] = s.files[dir]
+		delete(s.files, dir)
+	}
+	dirs = nil
+	for dir := range s.subdirs {
+		if isInDirectory(dir, fromDir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		s.subdirs[toDir+dir[len(fromDir):]] = s.subdirs[dir]
+		delete(s.subdirs, dir)
+	}
+	dirs = nil
+	for dir := range s.entries {
+		if isInDirectory(dir, fromDir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		s.entries[toDir+dir[len(fromDir):]] = s.entries[dir]
+		delete(s.entries, dir)
+	}
+	var versioned []string
+	for fullFileName := range s.versions {
+		if isInDirectory(fullFileName, fromDir) {
+			versioned = append(versioned, fullFileName)
+		}
+	}
+	for _, fullFileName := range versioned {
+		s.versions[toDir+fullFileName[len(fromDir):]] = s.versions[fullFileName]
+		delete(s.versions, fullFileName)
+	}
+	parent, child := path.Split(fromDir)
+	parent = cleanPath(parent)
+	delete(s.subdirs[parent], child)
+	s.removeEntry(parent, child+"/")
+	s.pruneDirectory(parent)
+	s.linkDirectory(toDir)
+}
+
+// linkDirectory adds dir into the sub directories of all its ancestors.
+func (s *EmbeddedStore) linkDirectory(dir string) {
+	for dir != "/" {
+		parent, child := path.Split(dir)
+		parent = cleanPath(parent)
+		if s.subdirs[parent] == nil {
+			s.subdirs[parent] = make(map[string]bool)
+		}
+		s.subdirs[parent][child] = true
+		s.addEntry(parent, child+"/")
+		dir = parent
+	}
+}
+
+// pruneDirectory removes dir, and then its ancestors, as long as they are empty.
+func (s *EmbeddedStore) pruneDirectory(dir string) {
+	for dir != "/" && len(s.files[dir]) == 0 && len(s.subdirs[dir]) == 0 {
+		delete(s.files, dir)
+		delete(s.subdirs, dir)
+		delete(s.entries, dir)
+		parent, child := path.Split(dir)
+		parent = cleanPath(parent)
+		delete(s.subdirs[parent], child)
+		s.removeEntry(parent, child+"/")
+		dir = parent
+	}
+}
+
+func (s *EmbeddedStore) addEntry(dir, name string) {
+	names := s.entries[dir]
+	if names == nil {
+		names = &sortedNames{}
+		s.entries[dir] = names
+	}
+	names.add(name)
+}
+
+func (s *EmbeddedStore) removeEntry(dir, name string) {
+	if names := s.entries[dir]; names != nil {
+		names.remove(name)
+		if names.size == 0 {
+			delete(s.entries, dir)
+		}
+	}
+}
+
+func (s *EmbeddedStore) hasDirectory(dir string) bool {
+	return len(s.files[dir]) > 0 || len(s.subdirs[dir]) > 0
+}
+
+func (s *EmbeddedStore) hasFile(fullFileName string) bool {
+	dir, name := path.Split(fullFileName)
+	_, ok := s.files[cleanPath(dir)][name]
+	return ok
+}
+
+func (s *EmbeddedStore) CreateFile(fullFileName string, fid string) error {
+	fullFileName = cleanPath(fullFileName)
+	return s.update(func() error {
+		if err := s.appendLog("+", fid, fullFileName); err != nil {
+			return err
+		}
+		s.put(fullFileName, fid)
+		return nil
+	})
+}
+
+func (s *EmbeddedStore) FindFile(fullFileName string) (string, error) {
+	dir, name := path.Split(cleanPath(fullFileName))
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if fid, ok := s.files[cleanPath(dir)][name]; ok {
+		return fid, nil
+	}
+	return "", ErrNotFound
+}
+
+func (s *EmbeddedStore) DeleteFile(fullFileName string) (fid string, err error) {
+	fullFileName = cleanPath(fullFileName)
+	err = s.update(func() error {
+		var ok bool
+		if fid, ok = s.remove(fullFileName); !ok {
+			return ErrNotFound
+		}
+		return s.appendLog("-", fid, fullFileName)
+	})
+	return fid, err
+}
+
+func (s *EmbeddedStore) MoveFile(fromFullFileName string, toFullFileName string) error {
+	return s.update(func() error {
+		return s.moveFileEntry(fromFullFileName, toFullFileName)
+	})
+}
+
+func (s *EmbeddedStore) moveFileEntry(fromFullFileName string, toFullFileName string) error {
+	from, to := cleanPath(fromFullFileName), cleanPath(toFullFileName)
+	if !s.hasFile(from) {
+		return ErrNotFound
+	}
+	if s.hasFile(to) || s.hasDirectory(to) {
+		return errors.New(to + " already exists")
+	}
+	if err := s.appendLog(">", strconv.Quote(from), to); err != nil {
+		return err
+	}
+	s.move(from, to)
+	return nil
+}
+
+func (s *EmbeddedStore) MoveDirectory(fromDir string, toDir string) error {
+	return s.update(func() error {
+		return s.moveDirectoryEntry(fromDir, toDir)
+	})
+}
+
+func (s *EmbeddedStore) moveDirectoryEntry(fromDir string, toDir string) error {
+	from, to := cleanPath(fromDir), cleanPath(toDir)
+	if from == "/" || isInDirectory(to, from) {
+		return errors.New("Can not move " + from + " into " + to)
+	}
+	if !s.hasDirectory(from) {
+		return ErrNotFound
+	}
+	if s.hasFile(to) || s.hasDirectory(to) {
+		return errors.New(to + " already exists")
+	}
+	if err := s.appendLog("D", strconv.Quote(from), to); err != nil {
+		return err
+	}
+	s.moveDirectory(from, to)
+	return nil
+}
+
+func (s *EmbeddedStore) MoveEntries(moves []Move) []error {
+	errs := make([]error, len(moves))
+	err := s.update(func() error {
+		for i, m := range moves {
+			if strings.HasSuffix(m.From, "/") {
+				errs[i] = s.moveDirectoryEntry(m.From, m.To)
+			} else {
+				errs[i] = s.moveFileEntry(m.From, m.To)
+			}
+		}
+		return nil
+	})
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+func (s *EmbeddedStore) ListEntries(dirPath string, lastFileName string, prefix string, limit int) (entries []FileEntry, err error) {
+	dirPath = cleanPath(dirPath)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	names := s.entries[dirPath]
+	if names == nil {
+		return nil, nil
+	}
+	start := lastFileName
+	if prefix > start {
+		start = prefix
+	}
+	names.from(start, func(name string) bool {
+		if name == lastFileName {
+			return true
+		}
+		if !strings.HasPrefix(name, prefix) || (limit >= 0 && len(entries) >= limit) {
+			return false
+		}
+		entries = append(entries, FileEntry{Name: name, Id: s.files[dirPath][name]})
+		return true
+	})
+	return entries, nil
+}
+
+func (s *EmbeddedStore) AddVersion(fullFileName string, fid string, maxVersions int) (expired []string, err error) {
+	fullFileName = cleanPath(fullFileName)
+	err = s.update(func() error {
+		if err := s.appendLog("V", fid, fullFileName); err != nil {
+			return err
+		}
+		s.addVersion(fullFileName, fid)
+		for len(s.versions[fullFileName]) > maxVersions {
+			oldest := s.versions[fullFileName][0].Id
+			if err := s.appendLog("v", oldest, fullFileName); err != nil {
+				return err
+			}
+			s.removeVersion(fullFileName, oldest)
+			expired = append(expired, oldest)
+		}
+		return nil
+	})
+	return expired, err
+}
+
+func (s *EmbeddedStore) ListVersions(fullFileName string) ([]VersionEntry, error) {
+	fullFileName = cleanPath(fullFileName)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	versions, ok := s.versions[fullFileName]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]VersionEntry(nil), versions...), nil
+}
+
+func (s *EmbeddedStore) PurgeVersions(fullFileName string) (fids []string, err error) {
+	fullFileName = cleanPath(fullFileName)
+	err = s.update(func() error {
+		for len(s.versions[fullFileName]) > 0 {
+			oldest := s.versions[fullFileName][0].Id
+			if err := s.appendLog("v", oldest, fullFileName); err != nil {
+				return err
+			}
+			s.removeVersion(fullFileName, oldest)
+			fids = append(fids, oldest)
+		}
+		return nil
+	})
+	return fids, err
+}
+
+func (s *EmbeddedStore) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.logFile.Close()
+}
+
+func isInDirectory(p string, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// cleanPath normalizes a path to always start with "/" and
+// never end with "/", except for the root directory itself.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
@@ -0,0 +1,346 @@
+package filer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func entryNames(entries []FileEntry) string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestEmbeddedStore(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_filer")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s, e := NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.CreateFile("/home/chris/a.txt", "3,01637037d6")
+	s.CreateFile("/home/chris/b.txt", "3,01637037d7")
+	s.CreateFile("/home/chris/photos/c.jpg", "4,0163703800")
+	s.CreateFile("/home/ted/d.txt", "5,0163703801")
+	if _, e := s.DeleteFile("/home/ted/d.txt"); e != nil {
+		t.Fatal("delete error:", e)
+	}
+	s.Close()
+
+	s, e = NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if fid, e := s.FindFile("/home/chris/a.txt"); e != nil || fid != "3,01637037d6" {
+		t.Fatal("unexpected fid", fid, e)
+	}
+	if _, e := s.FindFile("/home/ted/d.txt"); e != ErrNotFound {
+		t.Fatal("deleted file is still found")
+	}
+	if entries, _ := s.ListEntries("/home", "", "", -1); entryNames(entries) != "chris/" {
+		t.Fatal("unexpected entries", entries)
+	}
+	entries, _ := s.ListEntries("/home/chris/", "", "", -1)
+	if entryNames(entries) != "a.txt,b.txt,photos/" || entries[0].Id != "3,01637037d6" || entries[2].Id != "" {
+		t.Fatal("unexpected entries", entries)
+	}
+}
+
+func TestEmbeddedStoreMove(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_filer")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s, e := NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.CreateFile("/home/chris/a.txt", "3,01637037d6")
+	s.CreateFile("/home/chris/photos/c.jpg", "4,0163703800")
+	s.CreateFile("/home/ted/d.txt", "5,0163703801")
+	if e := s.MoveFile("/home/chris/a.txt", "/home/ted/d.txt"); e == nil {
+		t.Fatal("moving onto an existing file should fail")
+	}
+	if e := s.MoveFile("/home/chris/a.txt", "/home/ted/a.txt"); e != nil {
+		t.Fatal("move file error:", e)
+	}
+	if e := s.MoveDirectory("/home/chris", "/home/chris/photos/old"); e == nil {
+		t.Fatal("moving a directory into itself should fail")
+	}
+	if e := s.MoveDirectory("/home/chris", "/archive/chris"); e != nil {
+		t.Fatal("move directory error:", e)
+	}
+	s.Close()
+
+	s, e = NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if fid, e := s.FindFile("/home/ted/a.txt"); e != nil || fid != "3,01637037d6" {
+		t.Fatal("unexpected fid", fid, e)
+	}
+	if fid, e := s.FindFile("/archive/chris/photos/c.jpg"); e != nil || fid != "4,0163703800" {
+		t.Fatal("unexpected fid", fid, e)
+	}
+	if entries, _ := s.ListEntries("/home", "", "", -1); entryNames(entries) != "ted/" {
+		t.Fatal("unexpected entries", entries)
+	}
+	if entries, _ := s.ListEntries("/", "", "", -1); entryNames(entries) != "archive/,home/" {
+		t.Fatal("unexpected entries", entries)
+	}
+	if entries, _ := s.ListEntries("/archive/chris", "", "", -1); entryNames(entries) != "photos/" {
+		t.Fatal("unexpected entries", entries)
+	}
+}
+
+func TestEmbeddedStoreListEntries(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_filer")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s, e := NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	for _, name := range []string{"b1", "a1", "a3/x", "a2", "b2", "a4", "a3.txt"} {
+		s.CreateFile("/data/"+name, "3,01637037d6")
+	}
+	entries, _ := s.ListEntries("/data", "", "a", 3)
+	if entryNames(entries) != "a1,a2,a3.txt" {
+		t.Fatal("unexpected first page", entries)
+	}
+	entries, _ = s.ListEntries("/data", entries[2].Name, "a", 3)
+	if entryNames(entries) != "a3/,a4" {
+		t.Fatal("unexpected second page", entries)
+	}
+	entries, _ = s.ListEntries("/data", "a3/", "", 10)
+	if entryNames(entries) != "a4,b1,b2" {
+		t.Fatal("unexpected entries after a3/", entries)
+	}
+	s.DeleteFile("/data/a3/x")
+	if entries, _ = s.ListEntries("/data", "", "a", -1); entryNames(entries) != "a1,a2,a3.txt,a4" {
+		t.Fatal("unexpected entries after deleting a3/x", entries)
+	}
+}
+
+func TestEmbeddedStoreListManyEntries(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_filer")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s, e := NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	for i := 0; i < 5000; i++ {
+		s.CreateFile(fmt.Sprintf("/data/%05d", (i*7919)%5000), "3,01637037d6")
+	}
+	for i := 0; i < 5000; i += 2 {
+		s.DeleteFile(fmt.Sprintf("/data/%05d", i))
+	}
+	count, lastFileName := 0, ""
+	for {
+		entries, _ := s.ListEntries("/data", lastFileName, "", 100)
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			if entry.Name != fmt.Sprintf("%05d", 2*count+1) {
+				t.Fatal("unexpected entry", entry.Name, "after", lastFileName)
+			}
+			lastFileName = entry.Name
+			count++
+		}
+	}
+	if count != 2500 {
+		t.Fatal("listed", count, "entries instead of 2500")
+	}
+}
+
+func TestEmbeddedStoreVersions(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_filer")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s, e := NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, fid := range []string{"3,01", "3,02", "3,03"} {
+		if expired, e := s.AddVersion("/doc/a.txt", fid, 2); e != nil || (fid == "3,03") != (len(expired) == 1) {
+			t.Fatal("unexpected expired versions", expired, e)
+		}
+	}
+	s.Close()
+
+	s, e = NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	versions, _ := s.ListVersions("/doc/a.txt")
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Id != "3,03" {
+		t.Fatal("unexpected versions", versions)
+	}
+	fids, e := s.PurgeVersions("/doc/a.txt")
+	if e != nil || len(fids) != 2 {
+		t.Fatal("unexpected purged versions", fids, e)
+	}
+	if _, e := s.ListVersions("/doc/a.txt"); e != ErrNotFound {
+		t.Fatal("versions are not purged")
+	}
+	s.AddVersion("/doc/b.txt", "3,04", 2)
+	s.AddVersion("/doc/a.txt", "3,05", 2)
+	s.Close()
+
+	s, e = NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	versions, _ = s.ListVersions("/doc/a.txt")
+	if len(versions) != 1 || versions[0].Version != 5 {
+		t.Fatal("version numbers are reused after a purge", versions)
+	}
+}
+
+func TestEmbeddedStoreMoveEntries(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_filer")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s, e := NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.CreateFile("/in/a.txt", "3,01")
+	s.CreateFile("/in/b.txt", "3,02")
+	s.CreateFile("/in/sub/c.txt", "3,03")
+	errs := s.MoveEntries([]Move{
+		{From: "/in/a.txt", To: "/out/a.txt"},
+		{From: "/in/missing.txt", To: "/out/missing.txt"},
+		{From: "/in/b.txt", To: "/out/a.txt"},
+		{From: "/in/sub/", To: "/out/sub"},
+	})
+	if errs[0] != nil || errs[1] != ErrNotFound || errs[2] == nil || errs[3] != nil {
+		t.Fatal("unexpected move errors", errs)
+	}
+	s.Close()
+
+	s, e = NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if entries, _ := s.ListEntries("/out", "", "", -1); entryNames(entries) != "a.txt,sub/" {
+		t.Fatal("unexpected moved entries", entries)
+	}
+	if entries, _ := s.ListEntries("/in", "", "", -1); entryNames(entries) != "b.txt" {
+		t.Fatal("unexpected entries left", entries)
+	}
+}
+
+func TestEmbeddedStoreCompaction(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_filer")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	defer func(lines int) { minCompactLines = lines }(minCompactLines)
+	minCompactLines = 10
+
+	s, e := NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 100; i++ {
+		s.CreateFile(fmt.Sprintf("/tmp/%d", i), "3,01")
+		s.DeleteFile(fmt.Sprintf("/tmp/%d", i))
+	}
+	s.CreateFile("/home/a.txt", "3,02")
+	s.AddVersion("/home/a.txt", "3,03", 3)
+	s.AddVersion("/home/b.txt", "3,04", 3)
+	s.AddVersion("/home/a.txt", "3,05", 3)
+	s.PurgeVersions("/home/b.txt")
+	s.AddVersion("/home/c.txt", "3,06", 3)
+	s.PurgeVersions("/home/c.txt")
+	if s.logLines > 2*s.live+minCompactLines {
+		t.Fatal("the log is not compacted:", s.logLines, "lines")
+	}
+	s.Close()
+
+	s, e = NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if fid, e := s.FindFile("/home/a.txt"); e != nil || fid != "3,02" {
+		t.Fatal("unexpected fid", fid, e)
+	}
+	if entries, _ := s.ListEntries("/", "", "", -1); entryNames(entries) != "home/" {
+		t.Fatal("unexpected entries", entries)
+	}
+	versions, _ := s.ListVersions("/home/a.txt")
+	if len(versions) != 2 || versions[0].Version != 1 || versions[1].Version != 3 || versions[1].Id != "3,05" {
+		t.Fatal("unexpected versions", versions)
+	}
+	s.AddVersion("/home/a.txt", "3,07", 3)
+	if versions, _ = s.ListVersions("/home/a.txt"); versions[2].Version != 5 {
+		t.Fatal("the version counter is not kept by the compaction", versions)
+	}
+}
+
+func TestEmbeddedStoreTornLogLine(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_filer")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	s, e := NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.CreateFile("/home/a.txt", "3,01")
+	s.logFile.WriteString(`+ 3,02 "/home/b`)
+	s.Close()
+
+	s, e = NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	s.CreateFile("/home/c.txt", "3,03")
+	s.Close()
+
+	s, e = NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if entries, _ := s.ListEntries("/home", "", "", -1); entryNames(entries) != "a.txt,c.txt" {
+		t.Fatal("unexpected entries", entries)
+	}
+}
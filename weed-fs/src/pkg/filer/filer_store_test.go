@@ -0,0 +1,111 @@
+package filer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// testFilerStore checks the behaviour shared by all the filer stores.
+func testFilerStore(t *testing.T, s FilerStore) {
+	s.CreateFile("/home/chris/a.txt", "3,01")
+	s.CreateFile("/home/chris/b.txt", "3,02")
+	s.CreateFile("/home/chris/photos/c.jpg", "4,03")
+	s.CreateFile("/home/ted/d.txt", "5,04")
+	if fid, err := s.FindFile("/home/chris/a.txt"); err != nil || fid != "3,01" {
+		t.Fatal("unexpected fid", fid, err)
+	}
+	if _, err := s.FindFile("/home/chris/z.txt"); err != ErrNotFound {
+		t.Fatal("expecting not found, got", err)
+	}
+	entries, _ := s.ListEntries("/home/chris", "", "", -1)
+	if entryNames(entries) != "a.txt,b.txt,photos/" || entries[1].Id != "3,02" || entries[2].Id != "" {
+		t.Fatal("unexpected entries", entries)
+	}
+	if entries, _ = s.ListEntries("/home/chris/", "a.txt", "", 1); entryNames(entries) != "b.txt" {
+		t.Fatal("unexpected page after a.txt", entries)
+	}
+	if entries, _ = s.ListEntries("/home/chris", "", "p", 10); entryNames(entries) != "photos/" {
+		t.Fatal("unexpected entries with prefix p", entries)
+	}
+
+	if fid, err := s.DeleteFile("/home/ted/d.txt"); err != nil || fid != "5,04" {
+		t.Fatal("unexpected deleted fid", fid, err)
+	}
+	if _, err := s.DeleteFile("/home/ted/d.txt"); err != ErrNotFound {
+		t.Fatal("expecting not found, got", err)
+	}
+	if entries, _ = s.ListEntries("/home", "", "", -1); entryNames(entries) != "chris/" {
+		t.Fatal("the empty directory is still listed", entries)
+	}
+
+	if err := s.MoveFile("/home/chris/a.txt", "/home/chris/b.txt"); err == nil {
+		t.Fatal("moving onto an existing file should fail")
+	}
+	if err := s.MoveFile("/home/chris/a.txt", "/home/chris/photos"); err == nil {
+		t.Fatal("moving onto an existing directory should fail")
+	}
+	if err := s.MoveFile("/home/chris/a.txt", "/home/ted/a.txt"); err != nil {
+		t.Fatal("move file error:", err)
+	}
+	if err := s.MoveDirectory("/home/chris", "/home/chris/photos/old"); err == nil {
+		t.Fatal("moving a directory into itself should fail")
+	}
+	if err := s.MoveDirectory("/home/nobody", "/archive/nobody"); err != ErrNotFound {
+		t.Fatal("expecting not found, got", err)
+	}
+	if err := s.MoveDirectory("/home/chris", "/archive/chris"); err != nil {
+		t.Fatal("move directory error:", err)
+	}
+	if fid, err := s.FindFile("/archive/chris/photos/c.jpg"); err != nil || fid != "4,03" {
+		t.Fatal("unexpected fid", fid, err)
+	}
+	if entries, _ = s.ListEntries("/", "", "", -1); entryNames(entries) != "archive/,home/" {
+		t.Fatal("unexpected entries", entries)
+	}
+	if entries, _ = s.ListEntries("/home", "", "", -1); entryNames(entries) != "ted/" {
+		t.Fatal("unexpected entries", entries)
+	}
+	errs := s.MoveEntries([]Move{{From: "/home/ted/a.txt", To: "/a.txt"}, {From: "/home/ted/z.txt", To: "/z.txt"}, {From: "/archive/", To: "/old"}})
+	if errs[0] != nil || errs[1] != ErrNotFound || errs[2] != nil {
+		t.Fatal("unexpected move errors", errs)
+	}
+	if entries, _ = s.ListEntries("/", "", "", -1); entryNames(entries) != "a.txt,old/" {
+		t.Fatal("unexpected entries", entries)
+	}
+
+	s.AddVersion("/a.txt", "3,05", 2)
+	s.AddVersion("/a.txt", "3,06", 2)
+	if expired, err := s.AddVersion("/a.txt", "3,07", 2); err != nil || len(expired) != 1 || expired[0] != "3,05" {
+		t.Fatal("unexpected expired versions", expired, err)
+	}
+	s.MoveFile("/a.txt", "/b.txt")
+	versions, _ := s.ListVersions("/b.txt")
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Id != "3,07" {
+		t.Fatal("unexpected versions", versions)
+	}
+	if fids, err := s.PurgeVersions("/b.txt"); err != nil || len(fids) != 2 {
+		t.Fatal("unexpected purged versions", fids, err)
+	}
+	if _, err := s.ListVersions("/b.txt"); err != ErrNotFound {
+		t.Fatal("versions are not purged")
+	}
+	s.AddVersion("/b.txt", "3,08", 2)
+	if versions, _ = s.ListVersions("/b.txt"); len(versions) != 1 || versions[0].Version != 4 {
+		t.Fatal("version numbers are reused after a purge", versions)
+	}
+}
+
+func TestEmbeddedStoreBehaviour(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_filer")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	s, e := NewEmbeddedStore(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	testFilerStore(t, s)
+}
@@ -0,0 +1,395 @@
+package filer
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KvStore keeps the entries in an ordered key value store, a LevelDB on the
+// filer's disk, or a table of a MySQL or Postgres database for several filers
+// to share it, under these keys:
+//
+//	e/dir\x00name    the fid of a file, or "" for a sub directory whose name
+//	                 ends with "/", so that a directory's entries are listed
+//	                 in the order of their keys
+//	v/dir/name       the previous versions of the file in json
+//	#version         the counter of the version numbers
+//
+// Each change reads and writes its keys alone among the changes of the store,
+// and its writes are committed all at once.
+type KvStore struct {
+	kv kvBackend
+}
+
+type kvReader interface {
+	get(key string) (value string, found bool, err error)
+	// scan calls fn with the keys from start up to end, excluded, in order,
+	// until fn returns false.
+	scan(start string, end string, fn func(key string, value string) bool) error
+}
+
+type kvBackend interface {
+	view(fn func(r kvReader) error) error
+	// update runs fn alone among the updates of the store, and then writes the
+	// values it returns, nil to delete the key, all or none of them.
+	update(fn func(r kvReader) (writes map[string]*string, err error)) error
+	close()
+}
+
+// kvTxn reads the keys of a change, as changed by its writes so far.
+type kvTxn struct {
+	kvReader
+	writes map[string]*string
+}
+
+func (t *kvTxn) put(key string, value string) {
+	t.writes[key] = &value
+}
+
+func (t *kvTxn) del(key string) {
+	t.writes[key] = nil
+}
+
+func (t *kvTxn) get(key string) (string, bool, error) {
+	if value, ok := t.writes[key]; ok {
+		if value == nil {
+			return "", false, nil
+		}
+		return *value, true, nil
+	}
+	return t.kvReader.get(key)
+}
+
+// scan merges the written keys into the scanned ones.
+func (t *kvTxn) scan(start string, end string, fn func(key string, value string) bool) error {
+	var written []string
+	for key := range t.writes {
+		if key >= start && key < end {
+			written = append(written, key)
+		}
+	}
+	sort.Strings(written)
+	// emit calls fn with the written keys before the key, or all of them
+	emit := func(before string, all bool) bool {
+		for ; len(written) > 0 && (all || written[0] < before); written = written[1:] {
+			if value := t.writes[written[0]]; value != nil && !fn(written[0], *value) {
+				return false
+			}
+		}
+		return true
+	}
+	stopped := false
+	err := t.kvReader.scan(start, end, func(key string, value string) bool {
+		if !emit(key, false) {
+			stopped = true
+		} else if len(written) > 0 && written[0] == key {
+			written = written[1:]
+			if changed := t.writes[key]; changed != nil {
+				stopped = !fn(key, *changed)
+			}
+		} else {
+			stopped = !fn(key, value)
+		}
+		return !stopped
+	})
+	if err == nil && !stopped {
+		emit("", true)
+	}
+	return err
+}
+
+func newKvStore(kv kvBackend) *KvStore {
+	return &KvStore{kv: kv}
+}
+
+func (s *KvStore) update(change func(t *kvTxn) error) error {
+	return s.kv.update(func(r kvReader) (map[string]*string, error) {
+		t := &kvTxn{kvReader: r, writes: make(map[string]*string)}
+		err := change(t)
+		return t.writes, err
+	})
+}
+
+func entryKey(dir string, name string) string {
+	return "e" + dir + "\x00" + name
+}
+
+func versionsKey(fullFileName string) string {
+	return "v" + cleanPath(fullFileName)
+}
+
+// entriesRange is the range of the keys of the entries of dir.
+func entriesRange(dir string) (start string, end string) {
+	return entryKey(dir, ""), "e" + dir + "\x01"
+}
+
+// link adds dir into the listings of its ancestors, up to the first listed one.
+func (s *KvStore) link(t *kvTxn, dir string) error {
+	for dir != "/" {
+		parent, child := path.Split(dir)
+		parent = cleanPath(parent)
+		if _, found, err := t.get(entryKey(parent, child+"/")); err != nil || found {
+			return err
+		}
+		t.put(entryKey(parent, child+"/"), "")
+		dir = parent
+	}
+	return nil
+}
+
+// unlink removes the entry from the listing of dir, and then dir from its
+// parent's as long as it is left empty.
+func (s *KvStore) unlink(t *kvTxn, dir string, entry string) error {
+	for {
+		t.del(entryKey(dir, entry))
+		if dir == "/" {
+			return nil
+		}
+		empty := true
+		start, end := entriesRange(dir)
+		if err := t.scan(start, end, func(key string, value string) bool {
+			empty = false
+			return false
+		}); err != nil || !empty {
+			return err
+		}
+		parent, child := path.Split(dir)
+		dir, entry = cleanPath(parent), child+"/"
+	}
+}
+
+// exists tells whether the directory has a file or a sub directory of the name.
+func (s *KvStore) exists(t *kvTxn, dir string, name string) (bool, error) {
+	if _, found, err := t.get(entryKey(dir, name)); err != nil || found {
+		return found, err
+	}
+	_, found, err := t.get(entryKey(dir, name+"/"))
+	return found, err
+}
+
+func (s *KvStore) CreateFile(fullFileName string, fid string) error {
+	dir, name := splitPath(fullFileName)
+	return s.update(func(t *kvTxn) error {
+		t.put(entryKey(dir, name), fid)
+		return s.link(t, dir)
+	})
+}
+
+func (s *KvStore) FindFile(fullFileName string) (fid string, err error) {
+	dir, name := splitPath(fullFileName)
+	err = s.kv.view(func(r kvReader) error {
+		var found bool
+		if fid, found, err = r.get(entryKey(dir, name)); err == nil && !found {
+			err = ErrNotFound
+		}
+		return err
+	})
+	return fid, err
+}
+
+func (s *KvStore) DeleteFile(fullFileName string) (fid string, err error) {
+	dir, name := splitPath(fullFileName)
+	err = s.update(func(t *kvTxn) error {
+		var found bool
+		if fid, found, err = t.get(entryKey(dir, name)); err != nil || !found {
+			if err == nil {
+				err = ErrNotFound
+			}
+			return err
+		}
+		return s.unlink(t, dir, name)
+	})
+	return fid, err
+}
+
+func (s *KvStore) MoveFile(fromFullFileName string, toFullFileName string) error {
+	return s.update(func(t *kvTxn) error {
+		return s.moveFile(t, fromFullFileName, toFullFileName)
+	})
+}
+
+func (s *KvStore) moveFile(t *kvTxn, fromFullFileName string, toFullFileName string) error {
+	fromDir, fromName := splitPath(fromFullFileName)
+	toDir, toName := splitPath(toFullFileName)
+	fid, found, err := t.get(entryKey(fromDir, fromName))
+	if err != nil || !found {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return err
+	}
+	if exists, err := s.exists(t, toDir, toName); err != nil || exists {
+		if err == nil {
+			err = errors.New(cleanPath(toFullFileName) + " already exists")
+		}
+		return err
+	}
+	versions, hasVersions, err := t.get(versionsKey(fromFullFileName))
+	if err != nil {
+		return err
+	}
+	if err = s.unlink(t, fromDir, fromName); err != nil {
+		return err
+	}
+	t.put(entryKey(toDir, toName), fid)
+	if hasVersions {
+		t.del(versionsKey(fromFullFileName))
+		t.put(versionsKey(toFullFileName), versions)
+	}
+	return s.link(t, toDir)
+}
+
+func (s *KvStore) MoveDirectory(fromDir string, toDir string) error {
+	return s.update(func(t *kvTxn) error {
+		return s.moveDirectory(t, fromDir, toDir)
+	})
+}
+
+// moveDirectory moves the keys of the directory and of all the directories
+// under it, and moves it from the listing of its parent to the new one's.
+func (s *KvStore) moveDirectory(t *kvTxn, fromDir string, toDir string) error {
+	from, to := cleanPath(fromDir), cleanPath(toDir)
+	if from == "/" || isInDirectory(to, from) {
+		return errors.New("Can not move " + from + " into " + to)
+	}
+	toParent, toName := splitPath(to)
+	if exists, err := s.exists(t, toParent, toName); err != nil || exists {
+		if err == nil {
+			err = errors.New(to + " already exists")
+		}
+		return err
+	}
+	moved := make(map[string]string)
+	collect := func(key string, value string) bool {
+		moved[key] = value
+		return true
+	}
+	start, end := entriesRange(from)
+	if err := t.scan(start, end, collect); err != nil {
+		return err
+	}
+	if len(moved) == 0 {
+		return ErrNotFound
+	}
+	// "0" is right after "/"
+	for _, kind := range []string{"e", "v"} {
+		if err := t.scan(kind+from+"/", kind+from+"0", collect); err != nil {
+			return err
+		}
+	}
+	for key, value := range moved {
+		t.del(key)
+		t.put(key[:1]+to+key[1+len(from):], value)
+	}
+	fromParent, fromName := splitPath(from)
+	if err := s.unlink(t, fromParent, fromName+"/"); err != nil {
+		return err
+	}
+	return s.link(t, to)
+}
+
+func (s *KvStore) MoveEntries(moves []Move) []error {
+	errs := make([]error, len(moves))
+	for i, m := range moves {
+		if strings.HasSuffix(m.From, "/") {
+			errs[i] = s.MoveDirectory(m.From, m.To)
+		} else {
+			errs[i] = s.MoveFile(m.From, m.To)
+		}
+	}
+	return errs
+}
+
+func (s *KvStore) ListEntries(dirPath string, lastFileName string, prefix string, limit int) (entries []FileEntry, err error) {
+	dir := cleanPath(dirPath)
+	start, end := entriesRange(dir)
+	if lastFileName != "" {
+		start = entryKey(dir, lastFileName+"\x00")
+	}
+	if prefix > lastFileName {
+		start = entryKey(dir, prefix)
+	}
+	if prefix != "" {
+		// no byte of an utf-8 name is 0xff
+		end = entryKey(dir, prefix+"\xff")
+	}
+	err = s.kv.view(func(r kvReader) error {
+		return r.scan(start, end, func(key string, value string) bool {
+			if limit >= 0 && len(entries) >= limit {
+				return false
+			}
+			entries = append(entries, FileEntry{Name: key[len(entryKey(dir, "")):], Id: value})
+			return true
+		})
+	})
+	return entries, err
+}
+
+func (s *KvStore) versions(r kvReader, fullFileName string) (versions []VersionEntry, err error) {
+	data, found, err := r.get(versionsKey(fullFileName))
+	if err != nil || !found {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(data), &versions)
+	return versions, err
+}
+
+func (s *KvStore) AddVersion(fullFileName string, fid string, maxVersions int) (expired []string, err error) {
+	err = s.update(func(t *kvTxn) error {
+		versions, err := s.versions(t, fullFileName)
+		if err != nil {
+			return err
+		}
+		counter, _, err := t.get("#version")
+		if err != nil {
+			return err
+		}
+		version, _ := strconv.Atoi(counter)
+		version++
+		t.put("#version", strconv.Itoa(version))
+		versions = append(versions, VersionEntry{Version: version, Id: fid})
+		for len(versions) > maxVersions {
+			expired = append(expired, versions[0].Id)
+			versions = versions[1:]
+		}
+		if len(versions) == 0 {
+			t.del(versionsKey(fullFileName))
+			return nil
+		}
+		data, err := json.Marshal(versions)
+		t.put(versionsKey(fullFileName), string(data))
+		return err
+	})
+	return expired, err
+}
+
+func (s *KvStore) ListVersions(fullFileName string) (versions []VersionEntry, err error) {
+	err = s.kv.view(func(r kvReader) error {
+		versions, err = s.versions(r, fullFileName)
+		return err
+	})
+	if err == nil && versions == nil {
+		err = ErrNotFound
+	}
+	return versions, err
+}
+
+func (s *KvStore) PurgeVersions(fullFileName string) (fids []string, err error) {
+	err = s.update(func(t *kvTxn) error {
+		versions, err := s.versions(t, fullFileName)
+		for _, v := range versions {
+			fids = append(fids, v.Id)
+		}
+		t.del(versionsKey(fullFileName))
+		return err
+	})
+	return fids, err
+}
+
+func (s *KvStore) Close() {
+	s.kv.close()
+}
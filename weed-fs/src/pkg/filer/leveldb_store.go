@@ -0,0 +1,86 @@
+//go:build leveldb
+
+package filer
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+	"sync"
+)
+
+func init() {
+	newLevelDbStore = NewLevelDbStore
+}
+
+// levelDbKv keeps the keys of a KvStore in a LevelDB, whose changes are made
+// one at a time, and synced to the disk before they return.
+type levelDbKv struct {
+	db   *leveldb.DB
+	lock sync.Mutex
+}
+
+// levelDbReader reads the LevelDB, or a snapshot of it.
+type levelDbReader struct {
+	db interface {
+		Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+		NewIterator(slice *leveldbUtil.Range, ro *opt.ReadOptions) iterator.Iterator
+	}
+}
+
+// NewLevelDbStore opens the LevelDB in the directory, created if missing.
+func NewLevelDbStore(dir string) (*KvStore, error) {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newKvStore(&levelDbKv{db: db}), nil
+}
+
+func (r levelDbReader) get(key string) (string, bool, error) {
+	value, err := r.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return "", false, nil
+	}
+	return string(value), err == nil, err
+}
+
+func (r levelDbReader) scan(start string, end string, fn func(key string, value string) bool) error {
+	iter := r.db.NewIterator(&leveldbUtil.Range{Start: []byte(start), Limit: []byte(end)}, nil)
+	defer iter.Release()
+	for iter.Next() && fn(string(iter.Key()), string(iter.Value())) {
+	}
+	return iter.Error()
+}
+
+func (kv *levelDbKv) view(fn func(r kvReader) error) error {
+	snapshot, err := kv.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+	return fn(levelDbReader{snapshot})
+}
+
+func (kv *levelDbKv) update(fn func(r kvReader) (map[string]*string, error)) error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	writes, err := fn(levelDbReader{kv.db})
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for key, value := range writes {
+		if value == nil {
+			batch.Delete([]byte(key))
+		} else {
+			batch.Put([]byte(key), []byte(*value))
+		}
+	}
+	return kv.db.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+func (kv *levelDbKv) close() {
+	kv.db.Close()
+}
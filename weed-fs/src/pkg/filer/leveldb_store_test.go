@@ -0,0 +1,32 @@
+//go:build leveldb
+
+package filer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLevelDbStoreBehaviour(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_leveldb")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	s, e := NewFilerStore("leveldb://" + dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	testFilerStore(t, s)
+	s.Close()
+
+	// the entries are kept on reopening
+	if s, e = NewFilerStore("leveldb://" + dir); e != nil {
+		t.Fatal(e)
+	}
+	defer s.Close()
+	if fid, err := s.FindFile("/old/chris/photos/c.jpg"); err != nil || fid != "4,03" {
+		t.Fatal("unexpected fid", fid, err)
+	}
+}
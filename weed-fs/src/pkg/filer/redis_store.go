@@ -0,0 +1,427 @@
+package filer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"path"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisTimeout      = 10 * time.Second
+	maxRedisAttempts  = 100
+	defaultRedisStore = "weed-filer"
+)
+
+// RedisStore keeps the entries in redis, e.g. for several filers to share them,
+// under these keys of the prefix in the url path:
+//
+//	prefix:f:/dir    hash of the file names => fids
+//	prefix:d:/dir    sorted set of the file names, and the sub directory names
+//	                 with a trailing "/", listed in order with ZRANGEBYLEX
+//	prefix:v:/dir    hash of the file names => previous versions in json
+//	prefix:version   the counter of the version numbers
+//
+// Each change is a MULTI/EXEC transaction watching the keys it reads, tried
+// again when another filer changed them meanwhile. The transactions span the
+// keys of several directories, so it needs one redis, not a redis cluster.
+type RedisStore struct {
+	redis  *util.RedisConn
+	prefix string
+}
+
+type redisDo func(args ...string) (interface{}, error)
+
+// NewRedisStore connects to the store url, e.g. redis://:password@localhost:6379/weed-filer.
+func NewRedisStore(storeUrl string) (*RedisStore, error) {
+	u, err := url.Parse(storeUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, errors.New("Unsupported filer store " + storeUrl + ", expecting redis://host:port/prefix")
+	}
+	s := &RedisStore{redis: util.NewRedisConn(u), prefix: strings.Trim(u.Path, "/")}
+	if s.prefix == "" {
+		s.prefix = defaultRedisStore
+	}
+	if _, err = s.redis.Do(redisTimeout, "PING"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RedisStore) key(kind string, dir string) string {
+	return s.prefix + ":" + kind + ":" + dir
+}
+
+// transaction runs prepare, which watches the keys it reads and returns the
+// commands of the change, and then runs the commands in a transaction, all
+// over again if a watched key changed in the meantime.
+func (s *RedisStore) transaction(prepare func(do redisDo) ([][]string, error)) error {
+	for attempt := 0; attempt < maxRedisAttempts; attempt++ {
+		done := false
+		err := s.redis.Session(redisTimeout, func(do func(args ...string) (interface{}, error)) error {
+			commands, err := prepare(do)
+			if err != nil {
+				do("UNWATCH")
+				return err
+			}
+			if _, err = do("MULTI"); err != nil {
+				return err
+			}
+			for _, command := range commands {
+				if _, err = do(command...); err != nil {
+					do("DISCARD")
+					return err
+				}
+			}
+			reply, err := do("EXEC")
+			done = reply != nil
+			return err
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+	return errors.New("Too many concurrent changes of the filer store")
+}
+
+func (s *RedisStore) watch(do redisDo, keys ...string) error {
+	_, err := do(append([]string{"WATCH"}, keys...)...)
+	return err
+}
+
+// link returns the commands adding dir into the listings of its ancestors.
+func (s *RedisStore) link(dir string) (commands [][]string) {
+	for dir != "/" {
+		parent, child := path.Split(dir)
+		parent = cleanPath(parent)
+		commands = append(commands, []string{"ZADD", s.key("d", parent), "0", child + "/"})
+		dir = parent
+	}
+	return commands
+}
+
+// unlink returns the commands removing the entry from the listing of dir, and
+// then dir from its parent's as long as it is left empty.
+func (s *RedisStore) unlink(do redisDo, dir string, entry string) (commands [][]string, err error) {
+	for {
+		key := s.key("d", dir)
+		if err = s.watch(do, key); err != nil {
+			return nil, err
+		}
+		commands = append(commands, []string{"ZREM", key, entry})
+		count, err := do("ZCARD", key)
+		if err != nil {
+			return nil, err
+		}
+		if dir == "/" || count.(int64) > 1 {
+			return commands, nil
+		}
+		parent, child := path.Split(dir)
+		dir, entry = cleanPath(parent), child+"/"
+	}
+}
+
+// exists tells whether the directory has a file or a sub directory of the name.
+func (s *RedisStore) exists(do redisDo, dir string, name string) (bool, error) {
+	if err := s.watch(do, s.key("f", dir), s.key("d", dir)); err != nil {
+		return false, err
+	}
+	file, err := do("HEXISTS", s.key("f", dir), name)
+	if err != nil || file.(int64) == 1 {
+		return err == nil, err
+	}
+	subdir, err := do("ZSCORE", s.key("d", dir), name+"/")
+	return subdir != nil, err
+}
+
+func (s *RedisStore) CreateFile(fullFileName string, fid string) error {
+	dir, name := splitPath(fullFileName)
+	return s.transaction(func(do redisDo) ([][]string, error) {
+		return append([][]string{
+			{"HSET", s.key("f", dir), name, fid},
+			{"ZADD", s.key("d", dir), "0", name},
+		}, s.link(dir)...), nil
+	})
+}
+
+func (s *RedisStore) FindFile(fullFileName string) (string, error) {
+	dir, name := splitPath(fullFileName)
+	fid, err := s.redis.Do(redisTimeout, "HGET", s.key("f", dir), name)
+	if err != nil {
+		return "", err
+	}
+	if fid == nil {
+		return "", ErrNotFound
+	}
+	return fid.(string), nil
+}
+
+func (s *RedisStore) DeleteFile(fullFileName string) (fid string, err error) {
+	dir, name := splitPath(fullFileName)
+	err = s.transaction(func(do redisDo) ([][]string, error) {
+		if err := s.watch(do, s.key("f", dir)); err != nil {
+			return nil, err
+		}
+		reply, err := do("HGET", s.key("f", dir), name)
+		if err != nil {
+			return nil, err
+		}
+		if reply == nil {
+			return nil, ErrNotFound
+		}
+		fid = reply.(string)
+		unlink, err := s.unlink(do, dir, name)
+		return append([][]string{{"HDEL", s.key("f", dir), name}}, unlink...), err
+	})
+	return fid, err
+}
+
+func (s *RedisStore) MoveFile(fromFullFileName string, toFullFileName string) error {
+	return s.transaction(func(do redisDo) ([][]string, error) {
+		return s.moveFile(do, fromFullFileName, toFullFileName)
+	})
+}
+
+func (s *RedisStore) moveFile(do redisDo, fromFullFileName string, toFullFileName string) ([][]string, error) {
+	fromDir, fromName := splitPath(fromFullFileName)
+	toDir, toName := splitPath(toFullFileName)
+	if err := s.watch(do, s.key("f", fromDir), s.key("v", fromDir), s.key("v", toDir)); err != nil {
+		return nil, err
+	}
+	fid, err := do("HGET", s.key("f", fromDir), fromName)
+	if err != nil {
+		return nil, err
+	}
+	if fid == nil {
+		return nil, ErrNotFound
+	}
+	if exists, err := s.exists(do, toDir, toName); err != nil || exists {
+		if err == nil {
+			err = errors.New(cleanPath(toFullFileName) + " already exists")
+		}
+		return nil, err
+	}
+	versions, err := do("HGET", s.key("v", fromDir), fromName)
+	if err != nil {
+		return nil, err
+	}
+	commands, err := s.unlink(do, fromDir, fromName)
+	if err != nil {
+		return nil, err
+	}
+	commands = append([][]string{{"HDEL", s.key("f", fromDir), fromName}}, commands...)
+	commands = append(commands,
+		[]string{"HSET", s.key("f", toDir), toName, fid.(string)},
+		[]string{"ZADD", s.key("d", toDir), "0", toName})
+	commands = append(commands, s.link(toDir)...)
+	if versions != nil {
+		commands = append(commands,
+			[]string{"HDEL", s.key("v", fromDir), fromName},
+			[]string{"HSET", s.key("v", toDir), toName, versions.(string)})
+	}
+	return commands, nil
+}
+
+func (s *RedisStore) MoveDirectory(fromDir string, toDir string) error {
+	return s.transaction(func(do redisDo) ([][]string, error) {
+		return s.moveDirectory(do, fromDir, toDir)
+	})
+}
+
+// moveDirectory renames the keys of the directory and of all the directories
+// under it, and moves it from the listing of its parent to the new one's.
+func (s *RedisStore) moveDirectory(do redisDo, fromDir string, toDir string) ([][]string, error) {
+	from, to := cleanPath(fromDir), cleanPath(toDir)
+	if from == "/" || isInDirectory(to, from) {
+		return nil, errors.New("Can not move " + from + " into " + to)
+	}
+	toParent, toName := splitPath(to)
+	if exists, err := s.exists(do, toParent, toName); err != nil || exists {
+		if err == nil {
+			err = errors.New(to + " already exists")
+		}
+		return nil, err
+	}
+	var commands [][]string
+	dirs := []string{from}
+	for i := 0; i < len(dirs); i++ {
+		dir, newDir := dirs[i], to+dirs[i][len(from):]
+		if err := s.watch(do, s.key("d", dir), s.key("f", dir), s.key("v", dir)); err != nil {
+			return nil, err
+		}
+		reply, err := do("ZRANGE", s.key("d", dir), "0", "-1")
+		if err != nil {
+			return nil, err
+		}
+		names := reply.([]interface{})
+		if len(names) == 0 {
+			return nil, ErrNotFound
+		}
+		for _, name := range names {
+			if name := name.(string); strings.HasSuffix(name, "/") {
+				dirs = append(dirs, path.Join(dir, strings.TrimSuffix(name, "/")))
+			}
+		}
+		for _, kind := range []string{"d", "f", "v"} {
+			exists, err := do("EXISTS", s.key(kind, dir))
+			if err != nil {
+				return nil, err
+			}
+			if exists.(int64) == 1 {
+				commands = append(commands, []string{"RENAME", s.key(kind, dir), s.key(kind, newDir)})
+			}
+		}
+	}
+	fromParent, fromName := splitPath(from)
+	unlink, err := s.unlink(do, fromParent, fromName+"/")
+	if err != nil {
+		return nil, err
+	}
+	commands = append(commands, unlink...)
+	return append(commands, s.link(to)...), nil
+}
+
+func (s *RedisStore) MoveEntries(moves []Move) []error {
+	errs := make([]error, len(moves))
+	for i, m := range moves {
+		if strings.HasSuffix(m.From, "/") {
+			errs[i] = s.MoveDirectory(m.From, m.To)
+		} else {
+			errs[i] = s.MoveFile(m.From, m.To)
+		}
+	}
+	return errs
+}
+
+func (s *RedisStore) ListEntries(dirPath string, lastFileName string, prefix string, limit int) (entries []FileEntry, err error) {
+	dir := cleanPath(dirPath)
+	min, max := "-", "+"
+	if lastFileName != "" {
+		min = "(" + lastFileName
+	}
+	if prefix > lastFileName {
+		min = "[" + prefix
+	}
+	if prefix != "" {
+		// no byte of an utf-8 name is 0xff
+		max = "(" + prefix + "\xff"
+	}
+	args := []string{"ZRANGEBYLEX", s.key("d", dir), min, max}
+	if limit >= 0 {
+		args = append(args, "LIMIT", "0", strconv.Itoa(limit))
+	}
+	reply, err := s.redis.Do(redisTimeout, args...)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	hmget := []string{"HMGET", s.key("f", dir)}
+	for _, name := range reply.([]interface{}) {
+		entries = append(entries, FileEntry{Name: name.(string)})
+		if !strings.HasSuffix(name.(string), "/") {
+			hmget = append(hmget, name.(string))
+		}
+	}
+	if len(hmget) == 2 {
+		return entries, nil
+	}
+	if reply, err = s.redis.Do(redisTimeout, hmget...); err != nil {
+		return nil, err
+	}
+	fids := reply.([]interface{})
+	listed := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name, "/") {
+			fid := fids[0]
+			fids = fids[1:]
+			if fid == nil {
+				// deleted since it was listed
+				continue
+			}
+			entry.Id = fid.(string)
+		}
+		listed = append(listed, entry)
+	}
+	return listed, nil
+}
+
+func (s *RedisStore) versions(do redisDo, dir string, name string) (versions []VersionEntry, err error) {
+	reply, err := do("HGET", s.key("v", dir), name)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(reply.(string)), &versions)
+	return versions, err
+}
+
+func (s *RedisStore) AddVersion(fullFileName string, fid string, maxVersions int) (expired []string, err error) {
+	dir, name := splitPath(fullFileName)
+	err = s.transaction(func(do redisDo) ([][]string, error) {
+		expired = nil
+		if err := s.watch(do, s.key("v", dir)); err != nil {
+			return nil, err
+		}
+		versions, err := s.versions(do, dir, name)
+		if err != nil {
+			return nil, err
+		}
+		version, err := do("INCR", s.prefix+":version")
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, VersionEntry{Version: int(version.(int64)), Id: fid})
+		for len(versions) > maxVersions {
+			expired = append(expired, versions[0].Id)
+			versions = versions[1:]
+		}
+		if len(versions) == 0 {
+			return [][]string{{"HDEL", s.key("v", dir), name}}, nil
+		}
+		data, err := json.Marshal(versions)
+		return [][]string{{"HSET", s.key("v", dir), name, string(data)}}, err
+	})
+	return expired, err
+}
+
+func (s *RedisStore) ListVersions(fullFileName string) (versions []VersionEntry, err error) {
+	dir, name := splitPath(fullFileName)
+	versions, err = s.versions(func(args ...string) (interface{}, error) {
+		return s.redis.Do(redisTimeout, args...)
+	}, dir, name)
+	if err == nil && versions == nil {
+		err = ErrNotFound
+	}
+	return versions, err
+}
+
+func (s *RedisStore) PurgeVersions(fullFileName string) (fids []string, err error) {
+	dir, name := splitPath(fullFileName)
+	err = s.transaction(func(do redisDo) ([][]string, error) {
+		fids = nil
+		if err := s.watch(do, s.key("v", dir)); err != nil {
+			return nil, err
+		}
+		versions, err := s.versions(do, dir, name)
+		for _, v := range versions {
+			fids = append(fids, v.Id)
+		}
+		return [][]string{{"HDEL", s.key("v", dir), name}}, err
+	})
+	return fids, err
+}
+
+func (s *RedisStore) Close() {
+	s.redis.Close()
+}
+
+// splitPath returns the cleaned directory and the name of the file.
+func splitPath(fullFileName string) (dir string, name string) {
+	dir, name = path.Split(cleanPath(fullFileName))
+	return cleanPath(dir), name
+}
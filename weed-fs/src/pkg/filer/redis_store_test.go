@@ -0,0 +1,233 @@
+package filer
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis keeps strings, hashes and sorted sets in memory, for the commands
+// of the RedisStore. WATCH is not checked, as the tests have a single client.
+type fakeRedis struct {
+	lock    sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]bool
+}
+
+func startFakeRedis(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{strings: make(map[string]string), hashes: make(map[string]map[string]string), zsets: make(map[string]map[string]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return l
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	multi := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, count)
+		for i := range args {
+			header, _ := r.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			args[i] = string(data[:size])
+		}
+		var reply string
+		switch command := strings.ToUpper(args[0]); {
+		case command == "MULTI":
+			multi, queued, reply = true, nil, "+OK\r\n"
+		case command == "DISCARD":
+			multi, reply = false, "+OK\r\n"
+		case command == "EXEC":
+			f.lock.Lock()
+			reply = "*" + strconv.Itoa(len(queued)) + "\r\n"
+			for _, args := range queued {
+				reply += f.do(args)
+			}
+			f.lock.Unlock()
+			multi = false
+		case multi:
+			queued, reply = append(queued, args), "+QUEUED\r\n"
+		default:
+			f.lock.Lock()
+			reply = f.do(args)
+			f.lock.Unlock()
+		}
+		conn.Write([]byte(reply))
+	}
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func integer(i int) string {
+	return ":" + strconv.Itoa(i) + "\r\n"
+}
+
+func (f *fakeRedis) do(args []string) string {
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "WATCH", "UNWATCH":
+		return "+OK\r\n"
+	case "INCR":
+		i, _ := strconv.Atoi(f.strings[key])
+		f.strings[key] = strconv.Itoa(i + 1)
+		return integer(i + 1)
+	case "EXISTS":
+		_, s := f.strings[key]
+		_, h := f.hashes[key]
+		_, z := f.zsets[key]
+		if s || h || z {
+			return integer(1)
+		}
+		return integer(0)
+	case "RENAME":
+		if h, ok := f.hashes[key]; ok {
+			f.hashes[args[2]] = h
+			delete(f.hashes, key)
+		} else if z, ok := f.zsets[key]; ok {
+			f.zsets[args[2]] = z
+			delete(f.zsets, key)
+		} else {
+			return "-ERR no such key\r\n"
+		}
+		return "+OK\r\n"
+	case "HSET":
+		if f.hashes[key] == nil {
+			f.hashes[key] = make(map[string]string)
+		}
+		f.hashes[key][args[2]] = args[3]
+		return integer(1)
+	case "HGET":
+		if v, ok := f.hashes[key][args[2]]; ok {
+			return bulk(v)
+		}
+		return "$-1\r\n"
+	case "HEXISTS":
+		if _, ok := f.hashes[key][args[2]]; ok {
+			return integer(1)
+		}
+		return integer(0)
+	case "HMGET":
+		reply := "*" + strconv.Itoa(len(args)-2) + "\r\n"
+		for _, field := range args[2:] {
+			if v, ok := f.hashes[key][field]; ok {
+				reply += bulk(v)
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+	case "HDEL":
+		delete(f.hashes[key], args[2])
+		if len(f.hashes[key]) == 0 {
+			delete(f.hashes, key)
+		}
+		return integer(1)
+	case "ZADD":
+		if f.zsets[key] == nil {
+			f.zsets[key] = make(map[string]bool)
+		}
+		f.zsets[key][args[3]] = true
+		return integer(1)
+	case "ZREM":
+		delete(f.zsets[key], args[2])
+		if len(f.zsets[key]) == 0 {
+			delete(f.zsets, key)
+		}
+		return integer(1)
+	case "ZCARD":
+		return integer(len(f.zsets[key]))
+	case "ZSCORE":
+		if f.zsets[key][args[2]] {
+			return bulk("0")
+		}
+		return "$-1\r\n"
+	case "ZRANGE", "ZRANGEBYLEX":
+		var names []string
+		for name := range f.zsets[key] {
+			if args[0] == "ZRANGE" || (lexAbove(name, args[2]) && lexBelow(name, args[3])) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if len(args) == 7 {
+			if count, _ := strconv.Atoi(args[6]); count < len(names) {
+				names = names[:count]
+			}
+		}
+		reply := "*" + strconv.Itoa(len(names)) + "\r\n"
+		for _, name := range names {
+			reply += bulk(name)
+		}
+		return reply
+	}
+	return "-ERR unknown command " + args[0] + "\r\n"
+}
+
+func lexAbove(name, min string) bool {
+	switch min[0] {
+	case '-':
+		return true
+	case '(':
+		return name > min[1:]
+	}
+	return name >= min[1:]
+}
+
+func lexBelow(name, max string) bool {
+	switch max[0] {
+	case '+':
+		return true
+	case '(':
+		return name < max[1:]
+	}
+	return name <= max[1:]
+}
+
+func TestRedisStore(t *testing.T) {
+	l := startFakeRedis(t)
+	defer l.Close()
+	if _, err := NewRedisStore("leveldb://" + l.Addr().String()); err == nil {
+		t.Fatal("accepted a store url other than redis")
+	}
+	s, err := NewRedisStore("redis://" + l.Addr().String() + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testFilerStore(t, s)
+}
@@ -0,0 +1,194 @@
+package filer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"pkg/notification"
+	"strings"
+	"time"
+)
+
+// SearchIndex keeps the path, size, mime type and user meta data of the filer
+// files in an Elasticsearch index, one document per file id, so that moving a
+// file or a directory only updates the paths. It is fed with the file events
+// of the filer, as a notification.Publisher.
+type SearchIndex struct {
+	indexUrl string // e.g. http://localhost:9200/weed-files
+	client   *http.Client
+}
+
+// SearchDocument is the indexed meta data of a file.
+type SearchDocument struct {
+	Path       string            `json:"path"`
+	Directory  string            `json:"directory"`
+	Name       string            `json:"name"`
+	Fid        string            `json:"fid"`
+	Size       int64             `json:"size"`
+	Mime       string            `json:"mime,omitempty"`
+	Meta       map[string]string `json:"meta,omitempty"`
+	Collection string            `json:"collection,omitempty"`
+	Modified   int64             `json:"modified"`
+}
+
+// SearchResult is a page of the files matching a search, best matches first.
+type SearchResult struct {
+	Total int64
+	Files []*SearchDocument
+}
+
+// searchMapping keeps the paths whole, for the prefix queries on directories.
+const searchMapping = `{"mappings":{"properties":{
+  "path":{"type":"keyword"},"directory":{"type":"keyword"},
+  "name":{"type":"text","fields":{"raw":{"type":"keyword"}}},
+  "fid":{"type":"keyword"},"size":{"type":"long"},"mime":{"type":"keyword"},
+  "meta":{"type":"object","dynamic":true},"collection":{"type":"keyword"},
+  "modified":{"type":"date","format":"epoch_second"}}}}`
+
+func NewSearchIndex(indexUrl string) *SearchIndex {
+	return &SearchIndex{indexUrl: strings.TrimSuffix(indexUrl, "/"), client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// CreateIndex creates the index with its mapping, unless it exists already.
+func (s *SearchIndex) CreateIndex() error {
+	status, body, err := s.request("PUT", "", []byte(searchMapping))
+	if err != nil {
+		return err
+	}
+	if status/100 != 2 && !strings.Contains(string(body), "resource_already_exists_exception") {
+		return errors.New("Can not create " + s.indexUrl + ": " + string(body))
+	}
+	return nil
+}
+
+// Publish applies the filer event to the index.
+func (s *SearchIndex) Publish(e *notification.Event) error {
+	switch e.Type {
+	case notification.Create, notification.Update:
+		doc := &SearchDocument{Path: e.Path, Directory: path.Dir(e.Path), Name: path.Base(e.Path), Fid: e.Fid,
+			Size: e.Size, Mime: e.Mime, Meta: e.Meta, Collection: e.Collection, Modified: e.Time}
+		if err := s.call("PUT", "/_doc/"+url.PathEscape(e.Fid), doc); err != nil {
+			return err
+		}
+		if e.OldFid != "" {
+			return s.remove(e.OldFid)
+		}
+	case notification.Delete:
+		return s.remove(e.Fid)
+	case notification.Move:
+		if e.Fid != "" {
+			return s.call("POST", "/_update/"+url.PathEscape(e.Fid), map[string]interface{}{
+				"doc": map[string]string{"path": e.Path, "directory": path.Dir(e.Path), "name": path.Base(e.Path)}})
+		}
+		// a directory: the paths under it, and the directories from it on, change their prefix
+		from, to := strings.TrimSuffix(e.OldPath, "/"), strings.TrimSuffix(e.Path, "/")
+		return s.call("POST", "/_update_by_query?conflicts=proceed", map[string]interface{}{
+			"query": map[string]interface{}{"prefix": map[string]string{"path": from + "/"}},
+			"script": map[string]interface{}{
+				"lang": "painless",
+				"source": "ctx._source.path = params.to + ctx._source.path.substring(params.from.length());" +
+					"ctx._source.directory = params.to + ctx._source.directory.substring(params.from.length())",
+				"params": map[string]string{"from": from, "to": to},
+			},
+		})
+	}
+	return nil
+}
+
+func (s *SearchIndex) remove(fid string) error {
+	status, body, err := s.request("DELETE", "/_doc/"+url.PathEscape(fid), nil)
+	if err == nil && status/100 != 2 && status != http.StatusNotFound {
+		err = errors.New(string(body))
+	}
+	return err
+}
+
+// Search finds the files matching the query, in the Elasticsearch query string
+// syntax over the name, the path and the meta data, e.g. "sunset AND meta.camera:nikon".
+// The directory, if not empty, limits the search to the files under it, and the
+// mime type, e.g. image/*, to the files of that type.
+func (s *SearchIndex) Search(query, directory, mime string, from, size int) (*SearchResult, error) {
+	var must []interface{}
+	filter := []interface{}{}
+	if query != "" {
+		must = append(must, map[string]interface{}{"query_string": map[string]interface{}{
+			"query": query, "fields": []string{"name^3", "path", "meta.*"}, "lenient": true}})
+	} else {
+		must = append(must, map[string]interface{}{"match_all": map[string]interface{}{}})
+	}
+	if directory != "" {
+		filter = append(filter, map[string]interface{}{"prefix": map[string]string{"path": strings.TrimSuffix(directory, "/") + "/"}})
+	}
+	if mime != "" {
+		filter = append(filter, map[string]interface{}{"wildcard": map[string]string{"mime": mime}})
+	}
+	request := map[string]interface{}{
+		"from": from, "size": size, "track_total_hits": true,
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": must, "filter": filter}},
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	status, body, err := s.request("POST", "/_search", data)
+	if err != nil {
+		return nil, err
+	}
+	if status/100 != 2 {
+		return nil, errors.New("Search failed: " + string(body))
+	}
+	var response struct {
+		Hits struct {
+			Total struct{ Value int64 }
+			Hits  []struct {
+				Source *SearchDocument `json:"_source"`
+			}
+		}
+	}
+	if err = json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	result := &SearchResult{Total: response.Hits.Total.Value, Files: []*SearchDocument{}}
+	for _, hit := range response.Hits.Hits {
+		result.Files = append(result.Files, hit.Source)
+	}
+	return result, nil
+}
+
+func (s *SearchIndex) call(method, urlPath string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	status, body, err := s.request(method, urlPath, data)
+	if err == nil && status/100 != 2 {
+		err = errors.New(method + " " + s.indexUrl + urlPath + ": " + string(body))
+	}
+	return err
+}
+
+func (s *SearchIndex) request(method, urlPath string, data []byte) (int, []byte, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.indexUrl+urlPath, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
@@ -0,0 +1,97 @@
+package filer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"pkg/notification"
+	"strings"
+	"testing"
+)
+
+type esRequest struct {
+	method, path string
+	body         map[string]interface{}
+}
+
+func TestSearchIndexPublish(t *testing.T) {
+	var requests []esRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		req := esRequest{method: r.Method, path: r.URL.Path}
+		if r.URL.RawQuery != "" {
+			req.path += "?" + r.URL.RawQuery
+		}
+		json.Unmarshal(data, &req.body)
+		requests = append(requests, req)
+		if r.Method == "DELETE" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	s := NewSearchIndex(server.URL + "/weed-files/")
+	events := []*notification.Event{
+		{Type: notification.Create, Path: "/photos/a.jpg", Fid: "3,01", Mime: "image/jpeg", Meta: map[string]string{"camera": "nikon"}},
+		{Type: notification.Update, Path: "/photos/a.jpg", Fid: "3,02", OldFid: "3,01"},
+		{Type: notification.Move, Path: "/pictures/a.jpg", OldPath: "/photos/a.jpg", Fid: "3,02"},
+		{Type: notification.Move, Path: "/albums/", OldPath: "/pictures/"},
+		{Type: notification.Delete, Path: "/albums/a.jpg", Fid: "3,02"},
+	}
+	for _, e := range events {
+		if err := s.Publish(e); err != nil {
+			t.Fatal(e.Type, err)
+		}
+	}
+	expected := []string{
+		"PUT /weed-files/_doc/3,01",
+		"PUT /weed-files/_doc/3,02",
+		"DELETE /weed-files/_doc/3,01",
+		"POST /weed-files/_update/3,02",
+		"POST /weed-files/_update_by_query?conflicts=proceed",
+		"DELETE /weed-files/_doc/3,02",
+	}
+	if len(requests) != len(expected) {
+		t.Fatal("unexpected requests", requests)
+	}
+	for i, req := range requests {
+		if req.method+" "+req.path != expected[i] {
+			t.Fatal("expecting", expected[i], "got", req.method, req.path)
+		}
+	}
+	if doc := requests[0].body; doc["directory"] != "/photos" || doc["name"] != "a.jpg" || doc["meta"].(map[string]interface{})["camera"] != "nikon" {
+		t.Fatal("unexpected document", doc)
+	}
+	if doc := requests[3].body["doc"].(map[string]interface{}); doc["path"] != "/pictures/a.jpg" || doc["directory"] != "/pictures" {
+		t.Fatal("unexpected move", doc)
+	}
+	params := requests[4].body["script"].(map[string]interface{})["params"].(map[string]interface{})
+	if params["from"] != "/pictures" || params["to"] != "/albums" {
+		t.Fatal("unexpected directory move", params)
+	}
+}
+
+func TestSearchIndexSearch(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		query = string(data)
+		w.Write([]byte(`{"hits":{"total":{"value":1},"hits":[{"_source":{"path":"/photos/a.jpg","fid":"3,01","size":10}}]}}`))
+	}))
+	defer server.Close()
+
+	result, err := NewSearchIndex(server.URL+"/weed-files").Search("sunset", "/photos", "image/*", 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 1 || len(result.Files) != 1 || result.Files[0].Fid != "3,01" {
+		t.Fatal("unexpected result", result)
+	}
+	for _, part := range []string{`"query":"sunset"`, `"prefix":{"path":"/photos/"}`, `"wildcard":{"mime":"image/*"}`, `"size":20`} {
+		if !strings.Contains(query, part) {
+			t.Fatal("expecting", part, "in", query)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package filer
+
+import (
+	"sort"
+)
+
+const maxChunkNames = 1024
+
+// sortedNames is a sorted set of the entry names of a directory. The names are
+// kept in sorted chunks of at most maxChunkNames, so that adding or removing a
+// name, and listing a page after a name, stay cheap for millions of entries.
+type sortedNames struct {
+	chunks [][]string // no chunk is empty
+	size   int
+}
+
+// chunkIndex returns the chunk the name belongs in: the last one whose first
+// name is not after it, or the first one.
+func (s *sortedNames) chunkIndex(name string) int {
+	i := sort.Search(len(s.chunks), func(i int) bool { return s.chunks[i][0] > name })
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// add adds the name, and tells whether it was not there yet.
+func (s *sortedNames) add(name string) bool {
+	if len(s.chunks) == 0 {
+		s.chunks = [][]string{{name}}
+		s.size = 1
+		return true
+	}
+	ci := s.chunkIndex(name)
+	chunk := s.chunks[ci]
+	i := sort.SearchStrings(chunk, name)
+	if i < len(chunk) && chunk[i] == name {
+		return false
+	}
+	chunk = append(chunk, "")
+	copy(chunk[i+1:], chunk[i:])
+	chunk[i] = name
+	if len(chunk) > maxChunkNames {
+		half := len(chunk) / 2
+		right := append([]string(nil), chunk[half:]...)
+		chunk = chunk[:half:half]
+		s.chunks = append(s.chunks, nil)
+		copy(s.chunks[ci+2:], s.chunks[ci+1:])
+		s.chunks[ci+1] = right
+	}
+	s.chunks[ci] = chunk
+	s.size++
+	return true
+}
+
+// remove removes the name, and tells whether it was there.
+func (s *sortedNames) remove(name string) bool {
+	if len(s.chunks) == 0 {
+		return false
+	}
+	ci := s.chunkIndex(name)
+	chunk := s.chunks[ci]
+	i := sort.SearchStrings(chunk, name)
+	if i == len(chunk) || chunk[i] != name {
+		return false
+	}
+	chunk = append(chunk[:i], chunk[i+1:]...)
+	if len(chunk) == 0 {
+		s.chunks = append(s.chunks[:ci], s.chunks[ci+1:]...)
+	} else {
+		s.chunks[ci] = chunk
+	}
+	s.size--
+	return true
+}
+
+// from calls f on the names from the given one on, in order, until f returns false.
+func (s *sortedNames) from(name string, f func(name string) bool) {
+	if len(s.chunks) == 0 {
+		return
+	}
+	for ci := s.chunkIndex(name); ci < len(s.chunks); ci++ {
+		chunk := s.chunks[ci]
+		for i := sort.Search(len(chunk), func(i int) bool { return chunk[i] >= name }); i < len(chunk); i++ {
+			if !f(chunk[i]) {
+				return
+			}
+		}
+	}
+}
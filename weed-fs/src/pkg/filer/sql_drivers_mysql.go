@@ -0,0 +1,6 @@
+//go:build mysql
+
+package filer
+
+// the driver of the mysql:// filer stores
+import _ "github.com/go-sql-driver/mysql"
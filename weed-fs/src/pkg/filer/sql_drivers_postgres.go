@@ -0,0 +1,6 @@
+//go:build postgres
+
+package filer
+
+// the driver of the postgres:// filer stores
+import _ "github.com/lib/pq"
@@ -0,0 +1,118 @@
+package notification
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is a change of a file, published by the volume server which took
+// the write or the delete, and by the filer for the changes of its paths.
+type Event struct {
+	Type       string // create, update, delete, or move on the filer
+	Source     string // volume or filer
+	Fid        string
+	OldFid     string            `json:",omitempty"` // the file id overwritten by an update on the filer
+	Path       string            `json:",omitempty"` // the filer path
+	OldPath    string            `json:",omitempty"` // the path moved from
+	Size       int64             // of the content as stored, gzipped if uploaded gzipped
+	Collection string            `json:",omitempty"`
+	Mime       string            `json:",omitempty"` // the mime type of a filer upload
+	Meta       map[string]string `json:",omitempty"` // the X-Weed-Meta-* pairs of a filer upload
+	Time       int64             // unix seconds
+	Origin     string            `json:",omitempty"` // the notifier publishing it, one per process start
+	Seq        uint64            `json:",omitempty"` // the number of the event in its origin, the dropped ones counted too
+}
+
+const (
+	Create = "create"
+	Update = "update"
+	Delete = "delete"
+	Move   = "move"
+)
+
+// Publisher sends one event to a message queue.
+type Publisher interface {
+	Publish(e *Event) error
+}
+
+// Notifier publishes the events in the background, in order, so the writes do
+// not wait on the message queue. An event is retried a few times, and dropped
+// if it still fails, or if the queue of events waiting is full. The events are
+// numbered in their origin, dropped ones included, so the consumers that can
+// not miss any, e.g. weed mirror, see the gaps.
+type Notifier struct {
+	publisher Publisher
+	queue     chan *Event
+	origin    string
+	seqLock   sync.Mutex // numbers the events in the order they are queued
+	seq       uint64
+
+	published, failed, dropped uint64
+}
+
+const publishAttempts = 3
+
+// retryInterval is the wait before the second attempt, doubled before the third.
+var retryInterval = time.Second
+
+func NewNotifier(publisher Publisher, queueSize int) *Notifier {
+	hostname, _ := os.Hostname()
+	n := &Notifier{publisher: publisher, queue: make(chan *Event, queueSize)}
+	n.origin = hostname + "/" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	go n.loop()
+	return n
+}
+
+// Notify queues the event, with the current time if it has none. A nil notifier drops it.
+func (n *Notifier) Notify(e *Event) {
+	if n == nil {
+		return
+	}
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+	n.seqLock.Lock()
+	defer n.seqLock.Unlock()
+	n.seq++
+	e.Origin, e.Seq = n.origin, n.seq
+	select {
+	case n.queue <- e:
+	default:
+		if atomic.AddUint64(&n.dropped, 1)%1000 == 1 {
+			log.Println("Notification queue is full, dropping events")
+		}
+	}
+}
+
+func (n *Notifier) loop() {
+	for e := range n.queue {
+		var err error
+		for attempt := 1; attempt <= publishAttempts; attempt++ {
+			if err = n.publisher.Publish(e); err == nil {
+				break
+			}
+			if attempt < publishAttempts {
+				time.Sleep(retryInterval * time.Duration(attempt))
+			}
+		}
+		if err != nil {
+			atomic.AddUint64(&n.failed, 1)
+			log.Println("Failed to publish", e.Type, "of", e.Fid, e.Path, ":", err)
+		} else {
+			atomic.AddUint64(&n.published, 1)
+		}
+	}
+}
+
+func (n *Notifier) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"Published": atomic.LoadUint64(&n.published),
+		"Failed":    atomic.LoadUint64(&n.failed),
+		"Dropped":   atomic.LoadUint64(&n.dropped),
+		"Queued":    len(n.queue),
+	}
+}
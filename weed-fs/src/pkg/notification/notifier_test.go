@@ -0,0 +1,256 @@
+package notification
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakePublisher struct {
+	lock      sync.Mutex
+	failures  int // the next publishes to fail
+	published []string
+	seqs      []uint64
+	block     chan bool
+}
+
+func (p *fakePublisher) Publish(e *Event) error {
+	if p.block != nil {
+		<-p.block
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("queue unavailable")
+	}
+	p.published = append(p.published, e.Fid)
+	p.seqs = append(p.seqs, e.Seq)
+	return nil
+}
+
+func (p *fakePublisher) fids() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.published...)
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	for i := 0; i < 200 && !done(); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !done() {
+		t.Fatal("timed out waiting for", what)
+	}
+}
+
+func TestNotifierRetriesInOrder(t *testing.T) {
+	retryInterval = time.Millisecond
+	p := &fakePublisher{failures: 2}
+	n := NewNotifier(p, 10)
+	n.Notify(&Event{Type: Create, Fid: "3,01"})
+	n.Notify(&Event{Type: Delete, Fid: "3,02"})
+	waitFor(t, "the events", func() bool { return len(p.fids()) == 2 })
+	if fids := p.fids(); fids[0] != "3,01" || fids[1] != "3,02" {
+		t.Fatal("events published out of order", fids)
+	}
+
+	p.lock.Lock()
+	p.failures = publishAttempts
+	p.lock.Unlock()
+	n.Notify(&Event{Type: Create, Fid: "3,03"})
+	n.Notify(&Event{Type: Create, Fid: "3,04"})
+	waitFor(t, "the last event", func() bool { return len(p.fids()) == 3 })
+	if fids := p.fids(); fids[2] != "3,04" {
+		t.Fatal("the event failing every attempt should be skipped", fids)
+	}
+	if stats := n.ToMap(); stats["Failed"].(uint64) != 1 || stats["Published"].(uint64) != 3 {
+		t.Fatal("unexpected stats", stats)
+	}
+}
+
+func TestNotifierDropsWhenFull(t *testing.T) {
+	p := &fakePublisher{block: make(chan bool)}
+	n := NewNotifier(p, 2)
+	for i := 0; i < 5; i++ {
+		n.Notify(&Event{Type: Create, Fid: "3,0" + strconv.Itoa(i)})
+	}
+	close(p.block)
+	waitFor(t, "the queued events", func() bool { return len(n.queue) == 0 && n.ToMap()["Published"].(uint64) >= 2 })
+	// one event taken by the publisher, two queued, the others dropped
+	if dropped := n.ToMap()["Dropped"].(uint64); dropped < 2 || dropped > 3 {
+		t.Fatal("expecting 2 or 3 dropped events, got", dropped)
+	}
+	// the numbers of the events published next show the dropped ones
+	n.Notify(&Event{Type: Create, Fid: "3,05"})
+	waitFor(t, "the next event", func() bool { return len(p.fids()) > 0 && p.fids()[len(p.fids())-1] == "3,05" })
+	p.lock.Lock()
+	if last := p.seqs[len(p.seqs)-1]; last != 6 || len(p.seqs) == 6 {
+		t.Fatal("expecting the event 6 after a gap, got", p.seqs)
+	}
+	p.lock.Unlock()
+	var nilNotifier *Notifier
+	nilNotifier.Notify(&Event{Type: Create})
+}
+
+func TestHttpPublishers(t *testing.T) {
+	var paths, contentTypes, bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		paths = append(paths, r.URL.RequestURI())
+		contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	e := &Event{Type: Create, Source: "filer", Fid: "3,01637037d6", Path: "/a/b.txt", Size: 10, Time: 1}
+	for _, u := range []string{"nsq://" + host + "/files", "kafka-rest://" + host + "/files", server.URL + "/hook"} {
+		p, err := NewPublisher(u)
+		if err != nil {
+			t.Fatal(u, err)
+		}
+		if err = p.Publish(e); err != nil {
+			t.Fatal(u, err)
+		}
+	}
+	if paths[0] != "/pub?topic=files" || paths[1] != "/topics/files" || paths[2] != "/hook" {
+		t.Fatal("unexpected paths", paths)
+	}
+	if contentTypes[1] != "application/vnd.kafka.json.v2+json" {
+		t.Fatal("unexpected kafka content type", contentTypes[1])
+	}
+	var records struct{ Records []struct{ Key string } }
+	if err := json.Unmarshal([]byte(bodies[1]), &records); err != nil || len(records.Records) != 1 || records.Records[0].Key != e.Fid {
+		t.Fatal("unexpected kafka records", bodies[1])
+	}
+	if bodies[0] != bodies[2] || !strings.Contains(bodies[0], `"Path":"/a/b.txt"`) {
+		t.Fatal("unexpected event json", bodies[0])
+	}
+	if _, err := NewPublisher("amqp://localhost/files"); err == nil {
+		t.Fatal("unknown schemes should be refused")
+	}
+}
+
+func TestKafkaPublisherUrls(t *testing.T) {
+	p, err := NewPublisher("kafka://broker1:9092,broker2:9092/files?acks=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(*kafkaPublisher); !ok {
+		t.Fatal("unexpected publisher", p)
+	}
+	for _, u := range []string{"kafka://broker1:9092/", "kafka://broker1:9092/files?acks=2"} {
+		if _, err = NewPublisher(u); err == nil {
+			t.Error("should be refused", u)
+		}
+	}
+}
+
+// fakeRedis answers AUTH with OK and XADD with an id, and records the XADD arguments.
+// XREAD after 0 gets two entries of a stream, and after anything else none.
+func fakeRedis(t *testing.T, commands chan []string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+				args := make([]string, count)
+				for i := range args {
+					r.ReadString('\n')
+					arg, _ := r.ReadString('\n')
+					args[i] = strings.TrimRight(arg, "\r\n")
+				}
+				if args[0] == "AUTH" {
+					conn.Write([]byte("+OK\r\n"))
+					continue
+				}
+				if args[0] == "XREAD" {
+					if args[len(args)-1] != "0" {
+						conn.Write([]byte("*-1\r\n"))
+						continue
+					}
+					conn.Write([]byte("*1\r\n*2\r\n$6\r\nevents\r\n*2\r\n" +
+						"*2\r\n$15\r\n1526919030474-0\r\n*6\r\n$4\r\ntype\r\n$6\r\ncreate\r\n$3\r\nfid\r\n$4\r\n3,01\r\n$4\r\nsize\r\n$2\r\n10\r\n" +
+						"*2\r\n$15\r\n1526919030475-0\r\n*6\r\n$4\r\ntype\r\n$4\r\nmove\r\n$4\r\npath\r\n$2\r\n/b\r\n$7\r\noldPath\r\n$2\r\n/a\r\n"))
+					continue
+				}
+				commands <- args
+				conn.Write([]byte("$15\r\n1526919030474-0\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestRedisPublisher(t *testing.T) {
+	commands := make(chan []string, 10)
+	l := fakeRedis(t, commands)
+	defer l.Close()
+	p, err := NewPublisher("redis://:secret@" + l.Addr().String() + "/weed-events?maxlen=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = p.Publish(&Event{Type: Delete, Source: "volume", Fid: "3,01637037d6", Size: 10, Time: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := strings.Join(<-commands, " ")
+	if args != "XADD weed-events MAXLEN ~ 1000 * type delete source volume fid 3,01637037d6 size 10 time 1" {
+		t.Fatal("unexpected command", args)
+	}
+	<-commands
+}
+
+func TestStreamReader(t *testing.T) {
+	l := fakeRedis(t, make(chan []string, 10))
+	defer l.Close()
+	s, err := NewStreamReader("redis://" + l.Addr().String() + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.Read("0", 100, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Id != "1526919030474-0" {
+		t.Fatal("unexpected entries", entries)
+	}
+	if e := entries[0].Event; e.Type != Create || e.Fid != "3,01" || e.Size != 10 {
+		t.Fatal("unexpected event", e)
+	}
+	if e := entries[1].Event; e.Type != Move || e.Path != "/b" || e.OldPath != "/a" {
+		t.Fatal("unexpected event", e)
+	}
+	if EntryTime(entries[0].Id).UnixNano() != 1526919030474*int64(time.Millisecond) {
+		t.Fatal("unexpected entry time", EntryTime(entries[0].Id))
+	}
+	if entries, err = s.Read(entries[1].Id, 100, time.Second); err != nil || len(entries) != 0 {
+		t.Fatal("expecting no more entries", entries, err)
+	}
+	if _, err = NewStreamReader("nsq://localhost:4151/events"); err == nil {
+		t.Fatal("only redis streams can be read back")
+	}
+}
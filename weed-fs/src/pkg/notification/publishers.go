@@ -0,0 +1,134 @@
+package notification
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewPublisher returns the publisher for the url of the message queue:
+//
+//	nsq://localhost:4151/topic            the HTTP /pub api of nsqd
+//	redis://:password@localhost:6379/stream?maxlen=100000
+//	                                      XADD to a redis stream, trimmed to about maxlen entries
+//	kafka://broker1:9092,broker2:9092/topic?acks=all
+//	                                      the Kafka brokers, acks all (the default), 1 or 0
+//	kafka-rest://localhost:8082/topic     a Kafka REST proxy in front of the Kafka brokers
+//	http://hooks.example.com/files        a POST of each event in json
+func NewPublisher(rawUrl string) (Publisher, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "nsq":
+		if name == "" {
+			return nil, errors.New(rawUrl + ": the nsq topic is missing")
+		}
+		return &httpPublisher{url: "http://" + u.Host + "/pub?topic=" + url.QueryEscape(name)}, nil
+	case "redis":
+		if name == "" {
+			return nil, errors.New(rawUrl + ": the redis stream is missing")
+		}
+		return &redisPublisher{redis: util.NewRedisConn(u), stream: name, maxLen: u.Query().Get("maxlen")}, nil
+	case "kafka":
+		if name == "" {
+			return nil, errors.New(rawUrl + ": the kafka topic is missing")
+		}
+		acks, ok := map[string]int16{"": -1, "all": -1, "-1": -1, "1": 1, "0": 0}[u.Query().Get("acks")]
+		if !ok {
+			return nil, errors.New(rawUrl + ": acks should be all, 1 or 0")
+		}
+		return &kafkaPublisher{producer: util.NewKafkaProducer(strings.Split(u.Host, ","), name, acks)}, nil
+	case "kafka-rest":
+		if name == "" {
+			return nil, errors.New(rawUrl + ": the kafka topic is missing")
+		}
+		return &httpPublisher{url: "http://" + u.Host + "/topics/" + url.PathEscape(name), kafka: true}, nil
+	case "http", "https":
+		return &httpPublisher{url: rawUrl}, nil
+	}
+	return nil, errors.New(rawUrl + ": unknown message queue, expecting nsq://, redis://, kafka://, kafka-rest:// or http://")
+}
+
+var publishClient = &http.Client{Timeout: 10 * time.Second}
+
+// httpPublisher posts the events in json, or as Kafka REST proxy records keyed by fid.
+type httpPublisher struct {
+	url   string
+	kafka bool
+}
+
+func (p *httpPublisher) Publish(e *Event) error {
+	var body []byte
+	var err error
+	contentType := "application/json"
+	if p.kafka {
+		contentType = "application/vnd.kafka.json.v2+json"
+		body, err = json.Marshal(map[string]interface{}{"records": []interface{}{map[string]interface{}{"key": e.Fid, "value": e}}})
+	} else {
+		body, err = json.Marshal(e)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := publishClient.Post(p.url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New(p.url + " answered " + resp.Status + ": " + string(message))
+	}
+	return nil
+}
+
+// redisPublisher adds the events to a redis stream, one field per event field.
+type redisPublisher struct {
+	redis  *util.RedisConn
+	stream string
+	maxLen string
+}
+
+func (p *redisPublisher) Publish(e *Event) error {
+	args := []string{"XADD", p.stream}
+	if p.maxLen != "" {
+		args = append(args, "MAXLEN", "~", p.maxLen)
+	}
+	args = append(args, "*", "type", e.Type, "source", e.Source, "fid", e.Fid)
+	if e.Path != "" {
+		args = append(args, "path", e.Path)
+	}
+	if e.OldPath != "" {
+		args = append(args, "oldPath", e.OldPath)
+	}
+	if e.Collection != "" {
+		args = append(args, "collection", e.Collection)
+	}
+	args = append(args, "size", strconv.FormatInt(e.Size, 10), "time", strconv.FormatInt(e.Time, 10))
+	_, err := p.redis.Do(10*time.Second, args...)
+	return err
+}
+
+// kafkaPublisher produces the events in json to the Kafka topic, keyed by fid.
+type kafkaPublisher struct {
+	producer *util.KafkaProducer
+}
+
+func (p *kafkaPublisher) Publish(e *Event) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return p.producer.Produce([]byte(e.Fid), value, time.Unix(e.Time, 0))
+}
@@ -0,0 +1,102 @@
+package notification
+
+import (
+	"errors"
+	"net/url"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamReader reads the events back from the redis stream a redis:// publisher
+// adds them to, from a given entry on, so that a consumer can stop and resume
+// where it left off.
+type StreamReader struct {
+	redis  *util.RedisConn
+	stream string
+}
+
+// StreamEntry is an event read from the stream, with the id of its entry.
+type StreamEntry struct {
+	Id    string // e.g. 1526919030474-0, the milliseconds it was added at, and a sequence
+	Event *Event
+}
+
+func NewStreamReader(rawUrl string) (*StreamReader, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.Trim(u.Path, "/")
+	if u.Scheme != "redis" || name == "" {
+		return nil, errors.New(rawUrl + ": expecting a redis stream, as redis://localhost:6379/stream")
+	}
+	return &StreamReader{redis: util.NewRedisConn(u), stream: name}, nil
+}
+
+// Read returns up to count entries after the entry id, "0" to read from the
+// start of the stream. It waits up to block for an entry if there is none yet,
+// and returns no entry if none came.
+func (s *StreamReader) Read(after string, count int, block time.Duration) ([]*StreamEntry, error) {
+	reply, err := s.redis.Do(block+10*time.Second, "XREAD", "COUNT", strconv.Itoa(count),
+		"BLOCK", strconv.FormatInt(int64(block/time.Millisecond), 10), "STREAMS", s.stream, after)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	// [[stream, [[id, [field, value, ...]], ...]]]
+	streams, ok := reply.([]interface{})
+	if !ok || len(streams) != 1 {
+		return nil, errors.New("redis: unexpected XREAD reply")
+	}
+	stream, ok := streams[0].([]interface{})
+	if !ok || len(stream) != 2 {
+		return nil, errors.New("redis: unexpected XREAD reply")
+	}
+	items, _ := stream[1].([]interface{})
+	entries := make([]*StreamEntry, 0, len(items))
+	for _, item := range items {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, errors.New("redis: unexpected stream entry")
+		}
+		id, _ := pair[0].(string)
+		fields, _ := pair[1].([]interface{})
+		entries = append(entries, &StreamEntry{Id: id, Event: streamEvent(fields)})
+	}
+	return entries, nil
+}
+
+// streamEvent is the event of the fields added by redisPublisher.
+func streamEvent(fields []interface{}) *Event {
+	e := &Event{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		value, _ := fields[i+1].(string)
+		switch name {
+		case "type":
+			e.Type = value
+		case "source":
+			e.Source = value
+		case "fid":
+			e.Fid = value
+		case "path":
+			e.Path = value
+		case "oldPath":
+			e.OldPath = value
+		case "collection":
+			e.Collection = value
+		case "size":
+			e.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "time":
+			e.Time, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return e
+}
+
+// EntryTime is the time the entry was added to the stream, from its id.
+func EntryTime(id string) time.Time {
+	ms, _ := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
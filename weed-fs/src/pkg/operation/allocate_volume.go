@@ -13,11 +13,12 @@ type AllocateVolumeResult struct {
   Error string
 }
 
-func AllocateVolume(dn *topology.DataNode, vid storage.VolumeId, repType storage.ReplicationType) error {
+func AllocateVolume(dn *topology.DataNode, vid storage.VolumeId, collection string, repType storage.ReplicationType) error {
   values := make(url.Values)
   values.Add("volume", vid.String())
+  values.Add("collection", collection)
   values.Add("replicationType", repType.String())
-  jsonBlob, err := util.Post("http://"+dn.Url()+"/admin/assign_volume", values)
+  jsonBlob, err := util.Post("http://"+dn.AdminUrl()+"/admin/assign_volume", values)
   if err != nil {
     return err
   }
@@ -0,0 +1,58 @@
+package operation
+
+import (
+	"encoding/json"
+	"net/url"
+	"pkg/util"
+	"strconv"
+	"time"
+)
+
+type AssignResult struct {
+	Fid        string `json:"fid"`
+	Url        string `json:"url"`
+	PublicUrl  string `json:"publicUrl"`
+	Count      int    `json:"count"`
+	Auth       string `json:"auth,omitempty"` // signed url query string, if the master has a secure key
+	Error      string `json:"error"`
+	Code       string `json:"code,omitempty"` // why the assign failed, one of the topology.Assign* codes
+	Hint       string `json:"hint,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"` // seconds to wait before retrying, 0 if retrying will not help
+}
+
+// AssignError is a failed assign, with its code, e.g. "no_capacity" to add
+// volume servers, or "capacity_low" to retry later.
+type AssignError struct {
+	Code       string
+	Message    string
+	Hint       string
+	RetryAfter time.Duration // 0 if retrying will not help until the cluster changes
+}
+
+func (e *AssignError) Error() string {
+	return e.Message
+}
+
+func Assign(server string, count int, collection string, replication string) (*AssignResult, error) {
+	values := make(url.Values)
+	values.Add("count", strconv.Itoa(count))
+	if collection != "" {
+		values.Add("collection", collection)
+	}
+	if replication != "" {
+		values.Add("replication", replication)
+	}
+	jsonBlob, err := util.Post("http://"+server+"/dir/assign", values)
+	if err != nil {
+		return nil, err
+	}
+	var ret AssignResult
+	err = json.Unmarshal(jsonBlob, &ret)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Count <= 0 {
+		return nil, &AssignError{Code: ret.Code, Message: ret.Error, Hint: ret.Hint, RetryAfter: time.Duration(ret.RetryAfter) * time.Second}
+	}
+	return &ret, nil
+}
@@ -0,0 +1,468 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"pkg/directory"
+	"pkg/util"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// chunkAttempts is how many times a chunk is sent or read before the transfer
+// fails, waiting chunkRetryBackoff, doubled each time, between the attempts.
+const chunkAttempts = 3
+
+var chunkRetryBackoff = time.Second
+
+// ChunkInfo is one chunk of a chunked file, stored as a file of its own.
+type ChunkInfo struct {
+	Fid    string `json:"fid"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Md5    string `json:"md5,omitempty"` // hex, checked with the size when looking for the missing chunks
+}
+
+// ChunkManifest lists the chunks of a large file in order. It is uploaded with
+// ?cm=true as a file of its own, which the volume servers serve as the content
+// of its chunks, and delete with them. A pending manifest is uploaded before
+// the chunks, so that an interrupted upload can be resumed from it, and is not
+// served until it is uploaded again complete.
+type ChunkManifest struct {
+	Name    string      `json:"name,omitempty"`
+	Mime    string      `json:"mime,omitempty"`
+	Size    int64       `json:"size"`
+	Chunks  []ChunkInfo `json:"chunks"`
+	Pending bool        `json:"pending,omitempty"`
+	// sent as the X-Weed-Meta-* pairs of the manifest, and kept here for a resume
+	Pairs map[string]string `json:"pairs,omitempty"`
+}
+
+// ParseChunkManifest reads the manifest, checking that its chunks follow each
+// other up to its size.
+func ParseChunkManifest(data []byte) (*ChunkManifest, error) {
+	m := new(ChunkManifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, errors.New("Invalid chunk manifest: " + err.Error())
+	}
+	offset := int64(0)
+	for i, chunk := range m.Chunks {
+		if chunk.Offset != offset || chunk.Size <= 0 {
+			return nil, errors.New("Invalid chunk manifest: chunk " + strconv.Itoa(i) + " does not follow the previous one")
+		}
+		if _, err := directory.ParseFileId(chunk.Fid); err != nil {
+			return nil, errors.New("Invalid chunk manifest: " + err.Error())
+		}
+		offset += chunk.Size
+	}
+	if offset != m.Size {
+		return nil, errors.New("Invalid chunk manifest: the chunks are not of its size")
+	}
+	return m, nil
+}
+
+// ChunkIndex is the index of the chunk holding the byte at offset, or
+// len(m.Chunks) past the end.
+func (m *ChunkManifest) ChunkIndex(offset int64) int {
+	low, high := 0, len(m.Chunks)
+	for low < high {
+		middle := (low + high) / 2
+		if m.Chunks[middle].Offset+m.Chunks[middle].Size <= offset {
+			low = middle + 1
+		} else {
+			high = middle
+		}
+	}
+	return low
+}
+
+// MissingChunksResult is the answer of GET /<manifest fid>?chunks=missing.
+type MissingChunksResult struct {
+	Manifest *ChunkManifest `json:"manifest"`
+	Missing  []int          `json:"missing"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// ChunkedOptions are the options of a chunked upload.
+type ChunkedOptions struct {
+	ChunkSize   int64
+	Collection  string
+	Replication string
+	Parallelism int // the chunks sent at a time, 1 if not positive
+	Pairs       map[string]string
+}
+
+// UploadChunked uploads the size bytes of the file in chunks of options.ChunkSize,
+// assigned together with the manifest, and returns the fid of the manifest. The
+// manifest is uploaded pending first, then the chunks, and then the manifest
+// again complete, so that ResumeChunked can finish an interrupted upload from
+// the manifest fid.
+func UploadChunked(master string, filename string, mimeType string, file io.ReaderAt, size int64, options ChunkedOptions) (string, error) {
+	if options.ChunkSize <= 0 {
+		return "", errors.New("The chunk size should be positive")
+	}
+	count := int((size + options.ChunkSize - 1) / options.ChunkSize)
+	ret, err := Assign(master, count+1, options.Collection, options.Replication)
+	if err != nil {
+		return "", err
+	}
+	fids := directory.FileIds(ret.Fid, count+1)
+	manifest := &ChunkManifest{Name: filename, Mime: mimeType, Size: size, Pending: true, Pairs: options.Pairs}
+	for i := 0; i < count; i++ {
+		chunk := ChunkInfo{Fid: fids[i+1], Offset: int64(i) * options.ChunkSize, Size: options.ChunkSize}
+		if chunk.Offset+chunk.Size > size {
+			chunk.Size = size - chunk.Offset
+		}
+		if chunk.Md5, err = chunkMd5(file, chunk); err != nil {
+			return "", err
+		}
+		manifest.Chunks = append(manifest.Chunks, chunk)
+	}
+	if err = uploadManifest(ret.Url, ret.Fid, ret.Auth, manifest); err != nil {
+		return "", err
+	}
+	return ret.Fid, uploadChunks(master, ret.Url, ret.Fid, ret.Auth, file, manifest, nil, options.Parallelism)
+}
+
+// ResumeChunked finishes the upload of the file of a pending manifest, with
+// only the chunks its volume server does not have, parallelism at a time. The
+// auth signs the writes to the manifest fid and its chunks, if the cluster has
+// a secure key.
+func ResumeChunked(master string, manifestFid string, auth string, file io.ReaderAt, parallelism int) error {
+	server, err := fileIdServer(master, manifestFid)
+	if err != nil {
+		return err
+	}
+	missingUrl := directory.FileUrl(server, manifestFid, "") + "?chunks=missing"
+	if auth != "" {
+		missingUrl += "&" + auth
+	}
+	ctx, cancel := util.WithRequestTimeout(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", missingUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var ret MissingChunksResult
+	if err = json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return errors.New(missingUrl + " answered " + resp.Status)
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	if ret.Manifest == nil {
+		return errors.New(manifestFid + " is not a chunked file")
+	}
+	return uploadChunks(master, server, manifestFid, auth, file, ret.Manifest, ret.Missing, parallelism)
+}
+
+// uploadChunks uploads the chunks of the indexes, or all of them if nil,
+// parallelism at a time, and then the manifest, complete, as the fid on its
+// volume server. The first chunk failing all its attempts cancels the others,
+// and leaves the manifest pending.
+func uploadChunks(master string, server string, fid string, auth string, file io.ReaderAt, manifest *ChunkManifest, indexes []int, parallelism int) error {
+	if indexes == nil {
+		for i := range manifest.Chunks {
+			indexes = append(indexes, i)
+		}
+	}
+	for _, i := range indexes {
+		if i < 0 || i >= len(manifest.Chunks) {
+			return errors.New("Unknown chunk " + strconv.Itoa(i))
+		}
+	}
+	err := forEachChunk(context.Background(), indexes, parallelism, func(ctx context.Context, i int) error {
+		chunk := manifest.Chunks[i]
+		return withChunkRetries(ctx, master, chunk.Fid, func(ctx context.Context, server string) error {
+			chunkUrl := directory.FileUrl(server, chunk.Fid, "")
+			if auth != "" {
+				chunkUrl += "?" + auth
+			}
+			// without a file name, so that the chunk is not gzipped
+			_, err := UploadContext(ctx, chunkUrl, "", io.NewSectionReader(file, chunk.Offset, chunk.Size), nil)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	manifest.Pending = false
+	return uploadManifest(server, fid, auth, manifest)
+}
+
+// DownloadChunked writes the file fid to w, reading the chunks of a chunked
+// file parallelism at a time, each retried alone, and in order, with at most
+// parallelism chunks kept in memory, or each at its offset right away if w is
+// an io.WriterAt. A file not chunked is copied as it is. The auth signs the
+// reads of the fid and its chunks, if the cluster only serves signed reads.
+func DownloadChunked(ctx context.Context, master string, fid string, auth string, w io.Writer, parallelism int) error {
+	server, err := fileIdServer(master, fid)
+	if err != nil {
+		return err
+	}
+	manifestUrl := directory.FileUrl(server, fid, "") + "?cm=false"
+	if auth != "" {
+		manifestUrl += "&" + auth
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", manifestUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fid + " answered " + resp.Status)
+	}
+	if resp.Header.Get("X-Weed-Chunk-Manifest") != "true" {
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	manifest, err := ParseChunkManifest(data)
+	if err != nil {
+		return err
+	}
+	if manifest.Pending {
+		return errors.New(fid + " is not uploaded completely")
+	}
+	indexes := make([]int, len(manifest.Chunks))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	read := func(ctx context.Context, i int) (data []byte, err error) {
+		chunk := manifest.Chunks[i]
+		err = withChunkRetries(ctx, master, chunk.Fid, func(ctx context.Context, server string) error {
+			data, err = downloadChunk(ctx, server, auth, chunk)
+			return err
+		})
+		return data, err
+	}
+	if writerAt, ok := w.(io.WriterAt); ok {
+		return forEachChunk(ctx, indexes, parallelism, func(ctx context.Context, i int) error {
+			data, err := read(ctx, i)
+			if err == nil {
+				_, err = writerAt.WriteAt(data, manifest.Chunks[i].Offset)
+			}
+			return err
+		})
+	}
+
+	// the chunks read ahead wait for their turn, parallelism of them at most
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	slots := make(chan bool, parallelism)
+	results := make([]chan []byte, len(manifest.Chunks))
+	for i := range results {
+		results[i] = make(chan []byte, 1)
+	}
+	var failure chunkFailure
+	go func() {
+		for _, i := range indexes {
+			select {
+			case slots <- true:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int) {
+				data, err := read(ctx, i)
+				if err != nil {
+					failure.set(err, cancel)
+					return
+				}
+				results[i] <- data
+			}(i)
+		}
+	}()
+	for _, result := range results {
+		select {
+		case data := <-result:
+			if _, err = w.Write(data); err != nil {
+				return err
+			}
+			<-slots
+		case <-ctx.Done():
+			return failure.get(ctx)
+		}
+	}
+	return nil
+}
+
+func downloadChunk(ctx context.Context, server string, auth string, chunk ChunkInfo) ([]byte, error) {
+	chunkUrl := directory.FileUrl(server, chunk.Fid, "")
+	if auth != "" {
+		chunkUrl += "?" + auth
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", chunkUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(chunk.Fid + " answered " + resp.Status)
+	}
+	data := make([]byte, chunk.Size)
+	if _, err = io.ReadFull(resp.Body, data); err != nil {
+		return nil, errors.New("Chunk " + chunk.Fid + " is shorter than its manifest: " + err.Error())
+	}
+	return data, nil
+}
+
+// forEachChunk runs do for the chunk indexes, parallelism at a time, and on the
+// first failure cancels the others, returning that failure once all returned.
+func forEachChunk(ctx context.Context, indexes []int, parallelism int, do func(ctx context.Context, i int) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	work := make(chan int)
+	var failure chunkFailure
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism && w < len(indexes); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if err := do(ctx, i); err != nil {
+					failure.set(err, cancel)
+				}
+			}
+		}()
+	}
+feed:
+	for _, i := range indexes {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	return failure.get(ctx)
+}
+
+// withChunkRetries runs the transfer of the chunk fid up to chunkAttempts
+// times, on the locations of its volume in turn, backing off in between.
+func withChunkRetries(ctx context.Context, master string, fid string, transfer func(ctx context.Context, server string) error) error {
+	volumeId, err := directory.ParseVolumeId(fid)
+	if err != nil {
+		return err
+	}
+	var locations []Location
+	backoff := chunkRetryBackoff
+	for attempt := 0; attempt < chunkAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if len(locations) == 0 {
+			var lookup *LookupResult
+			if lookup, err = LookupContext(ctx, master, volumeId); err != nil {
+				continue
+			}
+			if locations = lookup.Locations; len(locations) == 0 {
+				err = errors.New("Volume of " + fid + " is not found")
+				continue
+			}
+		}
+		if err = transfer(ctx, locations[attempt%len(locations)].Url); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return errors.New("Chunk " + fid + " failed " + strconv.Itoa(chunkAttempts) + " times: " + err.Error())
+}
+
+// chunkFailure keeps the first failure of the chunks transferred together.
+type chunkFailure struct {
+	lock sync.Mutex
+	err  error
+}
+
+// set keeps the failure if it is the first, and cancels the other chunks.
+func (f *chunkFailure) set(err error, cancel context.CancelFunc) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err == nil {
+		f.err = err
+		cancel()
+	}
+}
+
+// get is the first failure, or the error of ctx if it was canceled from above.
+func (f *chunkFailure) get(ctx context.Context) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	return ctx.Err()
+}
+
+// uploadManifest uploads the manifest as the file fid on the volume server.
+func uploadManifest(server string, fid string, auth string, manifest *ChunkManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifestUrl := directory.FileUrl(server, fid, "") + "?cm=true"
+	if auth != "" {
+		manifestUrl += "&" + auth
+	}
+	_, err = UploadMimeContext(context.Background(), manifestUrl, "", "application/json", bytes.NewReader(data), manifest.Pairs)
+	return err
+}
+
+// fileIdServer is the host:port of a volume server of the volume of the fid.
+func fileIdServer(master string, fid string) (string, error) {
+	volumeId, err := directory.ParseVolumeId(fid)
+	if err != nil {
+		return "", err
+	}
+	lookup, err := Lookup(master, volumeId)
+	if err != nil {
+		return "", err
+	}
+	if len(lookup.Locations) == 0 {
+		return "", errors.New("Volume of " + fid + " is not found")
+	}
+	return lookup.Locations[0].Url, nil
+}
+
+func chunkMd5(file io.ReaderAt, chunk ChunkInfo) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(file, chunk.Offset, chunk.Size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
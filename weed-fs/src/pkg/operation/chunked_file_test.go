@@ -0,0 +1,156 @@
+package operation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVolumeServer is the master and the only volume server of a cluster,
+// keeping the uploaded files in memory, and failing the first attempt at
+// each chunk, or every attempt at the broken ones.
+type fakeVolumeServer struct {
+	*httptest.Server
+	lock      sync.Mutex
+	files     map[string][]byte
+	manifests map[string]bool
+	attempts  map[string]int // of each request
+	broken    map[string]bool
+}
+
+func startFakeVolumeServer(t *testing.T) *fakeVolumeServer {
+	f := &fakeVolumeServer{files: make(map[string][]byte), manifests: make(map[string]bool), attempts: make(map[string]int), broken: make(map[string]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir/assign", func(w http.ResponseWriter, r *http.Request) {
+		count, _ := strconv.Atoi(r.FormValue("count"))
+		json.NewEncoder(w).Encode(AssignResult{Fid: "3,01637037d6", Url: f.addr(), PublicUrl: f.addr(), Count: count})
+	})
+	mux.HandleFunc("/dir/lookup", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(LookupResult{Locations: []Location{{Url: f.addr(), PublicUrl: f.addr()}}})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fid := strings.TrimPrefix(r.URL.Path, "/")
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		key := r.Method + " " + fid
+		f.attempts[key]++
+		isManifest := r.URL.Query().Get("cm") != ""
+		if !isManifest && (f.attempts[key] == 1 || f.broken[fid]) {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failing " + key})
+			return
+		}
+		switch r.Method {
+		case "POST":
+			// the chunks are sent without a file name, so not as a form file
+			reader, err := r.MultipartReader()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			f.files[fid], _ = ioutil.ReadAll(part)
+			f.manifests[fid] = r.URL.Query().Get("cm") == "true"
+			json.NewEncoder(w).Encode(UploadResult{Size: len(f.files[fid])})
+		case "GET":
+			data, ok := f.files[fid]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if f.manifests[fid] {
+				w.Header().Set("X-Weed-Chunk-Manifest", "true")
+			}
+			w.Write(data)
+		}
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeVolumeServer) addr() string {
+	return strings.TrimPrefix(f.URL, "http://")
+}
+
+func TestChunkedTransfers(t *testing.T) {
+	defer func(backoff time.Duration) { chunkRetryBackoff = backoff }(chunkRetryBackoff)
+	chunkRetryBackoff = time.Millisecond
+	f := startFakeVolumeServer(t)
+	defer f.Close()
+
+	data := make([]byte, 1050)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	fid, err := UploadChunked(f.addr(), "big.bin", "", bytes.NewReader(data), int64(len(data)), ChunkedOptions{ChunkSize: 100, Parallelism: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ParseChunkManifest(f.files[fid])
+	if err != nil || manifest.Pending || len(manifest.Chunks) != 11 || manifest.Chunks[10].Size != 50 {
+		t.Fatal("unexpected manifest", string(f.files[fid]), err)
+	}
+	for _, chunk := range manifest.Chunks {
+		if f.attempts["POST "+chunk.Fid] != 2 || !bytes.Equal(f.files[chunk.Fid], data[chunk.Offset:chunk.Offset+chunk.Size]) {
+			t.Fatal("chunk", chunk.Fid, "sent", f.attempts["POST "+chunk.Fid], "times")
+		}
+	}
+
+	// read back in order, and at the offsets of a file
+	var buffer bytes.Buffer
+	if err = DownloadChunked(context.Background(), f.addr(), fid, "", &buffer, 3); err != nil || !bytes.Equal(buffer.Bytes(), data) {
+		t.Fatal("downloaded", buffer.Len(), "bytes", err)
+	}
+	file, err := ioutil.TempFile("", "weedfs_chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err = DownloadChunked(context.Background(), f.addr(), fid, "", file, 4); err != nil {
+		t.Fatal(err)
+	}
+	if written, _ := ioutil.ReadFile(file.Name()); !bytes.Equal(written, data) {
+		t.Fatal("downloaded", len(written), "bytes to the file")
+	}
+
+	// a file not chunked is copied as it is
+	f.files["4,01637037d6"] = []byte("plain")
+	f.attempts["GET 4,01637037d6"] = 1
+	buffer.Reset()
+	if err = DownloadChunked(context.Background(), f.addr(), "4,01637037d6", "", &buffer, 3); err != nil || buffer.String() != "plain" {
+		t.Fatal("downloaded", buffer.String(), err)
+	}
+
+	// a chunk failing all its attempts fails the download, and the upload
+	// leaves the manifest pending
+	f.broken[manifest.Chunks[5].Fid] = true
+	buffer.Reset()
+	if err = DownloadChunked(context.Background(), f.addr(), fid, "", &buffer, 3); err == nil || !strings.Contains(err.Error(), "failed 3 times") {
+		t.Fatal("the download should fail", err)
+	}
+	if buffer.Len() > 5*100 {
+		t.Error("the chunks after the broken one should not be written", buffer.Len())
+	}
+	f.files = make(map[string][]byte)
+	f.attempts = make(map[string]int)
+	if _, err = UploadChunked(f.addr(), "big.bin", "", bytes.NewReader(data), int64(len(data)), ChunkedOptions{ChunkSize: 100, Parallelism: 3}); err == nil {
+		t.Fatal("the upload should fail")
+	}
+	if manifest, err = ParseChunkManifest(f.files[fid]); err != nil || !manifest.Pending {
+		t.Fatal("the manifest should stay pending", err)
+	}
+}
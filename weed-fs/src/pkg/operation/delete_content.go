@@ -1,16 +1,33 @@
 package operation
 
 import (
-	"net/http"
+	"context"
 	"log"
+	"net/http"
+	"pkg/util"
 )
 
 func Delete(url string) error {
-	req, err := http.NewRequest("DELETE", url, nil)
+	return DeleteContext(context.Background(), url)
+}
+
+// DeleteContext is Delete that gives up when the context is done.
+// Without a deadline in the context, it gives up after util.RequestTimeout.
+func DeleteContext(ctx context.Context, url string) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = util.WithRequestTimeout(ctx)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
 	if err != nil {
 		log.Println("failing to delete", url)
 		return err
 	}
-	_, err = http.DefaultClient.Do(req)
-	return err
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
 }
@@ -1,6 +1,7 @@
 package operation
 
 import (
+  "context"
   "encoding/json"
   "net/url"
   "pkg/storage"
@@ -12,6 +13,8 @@ import (
 type Location struct {
   Url       string "url"
   PublicUrl       string "publicUrl"
+  AdminUrl  string `json:"adminUrl,omitempty"` // of the /admin/ api, if served on another port than Url
+  GrpcUrl   string `json:"grpcUrl,omitempty"`  // of the Volume gRPC service, if served
 }
 type LookupResult struct {
   Locations []Location "locations"
@@ -20,9 +23,14 @@ type LookupResult struct {
 
 //TODO: Add a caching for vid here
 func Lookup(server string, vid storage.VolumeId) (*LookupResult, error) {
+  return LookupContext(context.Background(), server, vid)
+}
+
+// LookupContext is Lookup that gives up when the context is done.
+func LookupContext(ctx context.Context, server string, vid storage.VolumeId) (*LookupResult, error) {
   values := make(url.Values)
   values.Add("volumeId", vid.String())
-  jsonBlob, err := util.Post("http://"+server+"/dir/lookup", values)
+  jsonBlob, err := util.PostContext(ctx, "http://"+server+"/dir/lookup", values)
   if err != nil {
     return nil, err
   }
@@ -2,14 +2,20 @@ package operation
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
-	_ "fmt"
+	"fmt"
 	"io"
 	"io/ioutil"
   "log"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"pkg/storage"
 	"errors"
+	"strings"
 )
 
 type UploadResult struct {
@@ -17,14 +23,51 @@ type UploadResult struct {
   Error string
 }
 
-func Upload(uploadUrl string, filename string, reader io.Reader) (*UploadResult, error) {
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// Upload posts the content as a multipart file, with the pairs sent as X-Weed-Meta-* headers.
+func Upload(uploadUrl string, filename string, reader io.Reader, pairs map[string]string) (*UploadResult, error) {
+	return UploadContext(context.Background(), uploadUrl, filename, reader, pairs)
+}
+
+// UploadContext is Upload that is aborted when the context is canceled.
+func UploadContext(ctx context.Context, uploadUrl string, filename string, reader io.Reader, pairs map[string]string) (*UploadResult, error) {
+	return UploadMimeContext(ctx, uploadUrl, filename, "", reader, pairs)
+}
+
+// UploadMimeContext is UploadContext sending the content type of the file, or
+// application/octet-stream if it is empty.
+func UploadMimeContext(ctx context.Context, uploadUrl string, filename string, mimeType string, reader io.Reader, pairs map[string]string) (*UploadResult, error) {
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	md5sum := md5.Sum(data)
 	body_buf := bytes.NewBufferString("")
 	body_writer := multipart.NewWriter(body_buf)
-	file_writer, err := body_writer.CreateFormFile("file", filename)
-	io.Copy(file_writer, reader)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, quoteEscaper.Replace(filename)))
+	h.Set("Content-Type", mimeType)
+	h.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]))
+	file_writer, err := body_writer.CreatePart(h)
+	if err != nil {
+		return nil, err
+	}
+	file_writer.Write(data)
 	content_type := body_writer.FormDataContentType()
 	body_writer.Close()
-	resp, err := http.Post(uploadUrl, content_type, body_buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", uploadUrl, body_buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", content_type)
+	for k, v := range pairs {
+		req.Header.Set(storage.PairNamePrefix+k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
     log.Println("failing to upload to", uploadUrl)
 		return nil, err
@@ -0,0 +1,120 @@
+package replication
+
+import (
+	"errors"
+	"math/rand"
+	"pkg/storage"
+	"pkg/topology"
+)
+
+// PlacementPolicy picks the data nodes to hold the copies of a new volume.
+// The default is RandomPlacement. A custom policy, e.g. scoring SSD nodes
+// first, can be plugged in with VolumeGrowth.SetPlacementPolicy.
+type PlacementPolicy interface {
+	// Place returns one data node for each copy required by the replication type,
+	// choosing only among the data nodes that pass the filter.
+	Place(topo *topology.Topology, repType storage.ReplicationType, vid storage.VolumeId, filter topology.NodeFilter) ([]*topology.DataNode, error)
+}
+
+var ErrNoPlacement = errors.New("No data nodes left to place the volume replicas!")
+
+// RandomPlacement picks data nodes randomly, weighted by their free space,
+// while spreading the copies over racks, data centers and regions as
+// required by the replication type.
+var RandomPlacement PlacementPolicy = randomPlacement{}
+
+type randomPlacement struct{}
+
+func (randomPlacement) Place(topo *topology.Topology, repType storage.ReplicationType, vid storage.VolumeId, filter topology.NodeFilter) ([]*topology.DataNode, error) {
+	var servers []*topology.DataNode
+	random := topo.Random()
+	switch repType {
+	case storage.Copy000:
+		servers = reserveOneInEach(random, []topology.Node{topo}, vid, filter)
+	case storage.Copy001:
+		//randomly pick one server, and then choose from the same rack
+		if picked := reserveOneInEach(random, []topology.Node{topo}, vid, filter); len(picked) > 0 {
+			server1 := picked[0]
+			rack := server1.Parent()
+			exclusion := make(map[string]topology.Node)
+			exclusion[server1.String()] = server1
+			newNodeList := topology.NewFilteredNodeList(rack.Children(), exclusion, filter)
+			if newNodeList.FreeSpace() > 0 {
+				if ok2, server2 := newNodeList.ReserveOneVolume(random.Intn(newNodeList.FreeSpace()), vid); ok2 {
+					servers = append(servers, server1, server2)
+				}
+			}
+		}
+	case storage.Copy010:
+		//randomly pick one server, and then choose from another rack in the same data center
+		if picked := reserveOneInEach(random, []topology.Node{topo}, vid, filter); len(picked) > 0 {
+			server1 := picked[0]
+			rack := server1.Parent()
+			dc := rack.Parent()
+			exclusion := make(map[string]topology.Node)
+			exclusion[rack.String()] = rack
+			newNodeList := topology.NewFilteredNodeList(dc.Children(), exclusion, filter)
+			if newNodeList.FreeSpace() > 0 {
+				if ok2, server2 := newNodeList.ReserveOneVolume(random.Intn(newNodeList.FreeSpace()), vid); ok2 {
+					servers = append(servers, server1, server2)
+				}
+			}
+		}
+	case storage.Copy100:
+		nl := topology.NewFilteredNodeList(topo.DataCenters(), nil, filter)
+		if picked, ret := nl.RandomlyPickN(random, 2, 1); ret {
+			servers = reserveOneInEach(random, picked, vid, filter)
+		}
+	case storage.Copy110:
+		nl := topology.NewFilteredNodeList(topo.DataCenters(), nil, filter)
+		if picked, ret := nl.RandomlyPickN(random, 2, 2); ret {
+			dc1, dc2 := picked[0], picked[1]
+			if topology.FreeSpaceMatching(dc2, filter) > topology.FreeSpaceMatching(dc1, filter) {
+				dc1, dc2 = dc2, dc1
+			}
+			if picked1 := reserveOneInEach(random, []topology.Node{dc1}, vid, filter); len(picked1) > 0 {
+				server1 := picked1[0]
+				servers = append(servers, server1)
+				rack := server1.Parent()
+				exclusion := make(map[string]topology.Node)
+				exclusion[rack.String()] = rack
+				newNodeList := topology.NewFilteredNodeList(dc1.Children(), exclusion, filter)
+				if newNodeList.FreeSpace() > 0 {
+					if ok2, server2 := newNodeList.ReserveOneVolume(random.Intn(newNodeList.FreeSpace()), vid); ok2 {
+						servers = append(servers, server2)
+					}
+				}
+			}
+			servers = append(servers, reserveOneInEach(random, []topology.Node{dc2}, vid, filter)...)
+		}
+	case storage.Copy200:
+		nl := topology.NewFilteredNodeList(topo.DataCenters(), nil, filter)
+		if picked, ret := nl.RandomlyPickN(random, 3, 1); ret {
+			servers = reserveOneInEach(random, picked, vid, filter)
+		}
+	case storage.Copy1000:
+		nl := topology.NewFilteredNodeList(topo.Regions(), nil, filter)
+		if picked, ret := nl.RandomlyPickN(random, 2, 1); ret {
+			servers = reserveOneInEach(random, picked, vid, filter)
+		}
+	default:
+		return nil, errors.New("Unknown Replication Type!")
+	}
+	if len(servers) != repType.GetCopyCount() {
+		return nil, ErrNoPlacement
+	}
+	return servers, nil
+}
+
+// reserveOneInEach randomly picks one data node that passes the filter under each of the nodes.
+func reserveOneInEach(random *rand.Rand, nodes []topology.Node, vid storage.VolumeId, filter topology.NodeFilter) []*topology.DataNode {
+	var servers []*topology.DataNode
+	for _, n := range nodes {
+		if freeSpace := topology.FreeSpaceMatching(n, filter); freeSpace > 0 {
+			if ok, server := topology.ReserveOneVolumeMatching(n, random.Intn(freeSpace), vid, filter); ok {
+				servers = append(servers, server)
+			}
+		}
+	}
+	return servers
+}
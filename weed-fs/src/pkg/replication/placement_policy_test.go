@@ -0,0 +1,53 @@
+package replication
+
+import (
+	"math/rand"
+	"pkg/storage"
+	"testing"
+)
+
+func TestRandomPlacementAcrossDataCenters(t *testing.T) {
+	topo := setup(topologyLayout)
+	vid, _ := topo.NextVolumeId()
+	servers, err := RandomPlacement.Place(topo, storage.Copy100, vid, nil)
+	if err != nil {
+		t.Fatalf("place 100: %s", err.Error())
+	}
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 servers, got %d", len(servers))
+	}
+	if servers[0].GetDataCenter() == servers[1].GetDataCenter() {
+		t.Fatalf("both copies are in data center %s", servers[0].GetDataCenter().Id())
+	}
+}
+
+func TestRandomPlacementWithoutRegions(t *testing.T) {
+	topo := setup(topologyLayout)
+	vid, _ := topo.NextVolumeId()
+	if _, err := RandomPlacement.Place(topo, storage.Copy1000, vid, nil); err != ErrNoPlacement {
+		t.Fatalf("expected ErrNoPlacement without regions, got %v", err)
+	}
+}
+
+func TestSeededPlacementIsReproducible(t *testing.T) {
+	place := func() []string {
+		topo := setup(topologyLayout)
+		topo.SetRandSource(rand.NewSource(42))
+		var placed []string
+		for vid := storage.VolumeId(100); vid < 110; vid++ {
+			// some data centers have a single rack, failing the placement
+			servers, _ := RandomPlacement.Place(topo, storage.Copy010, vid, nil)
+			placed = append(placed, vid.String())
+			for _, dn := range servers {
+				placed = append(placed, dn.String())
+			}
+		}
+		return placed
+	}
+	first, second := place(), place()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatal("the same seed placed differently:", first, second)
+		}
+	}
+}
@@ -3,10 +3,10 @@ package replication
 import (
 	"errors"
 	"fmt"
-	"math/rand"
 	"pkg/operation"
 	"pkg/storage"
 	"pkg/topology"
+	"sync"
 )
 
 /*
@@ -22,168 +22,111 @@ type VolumeGrowth struct {
 	copy2factor int
 	copy3factor int
 	copyAll     int
+
+	policy PlacementPolicy
 }
 
 func NewDefaultVolumeGrowth() *VolumeGrowth {
 	return &VolumeGrowth{copy1factor: 7, copy2factor: 6, copy3factor: 3}
 }
 
-func (vg *VolumeGrowth) GrowByType(repType storage.ReplicationType, topo *topology.Topology) (int, error) {
+// SetPlacementPolicy replaces the default RandomPlacement.
+func (vg *VolumeGrowth) SetPlacementPolicy(policy PlacementPolicy) {
+	vg.policy = policy
+}
+
+func (vg *VolumeGrowth) GrowByType(collection string, repType storage.ReplicationType, topo *topology.Topology, filter topology.NodeFilter) (int, error) {
 	switch repType {
 	case storage.Copy000:
-		return vg.GrowByCountAndType(vg.copy1factor, repType, topo)
+		return vg.GrowByCountAndType(vg.copy1factor, collection, repType, topo, filter)
 	case storage.Copy001:
-		return vg.GrowByCountAndType(vg.copy2factor, repType, topo)
+		return vg.GrowByCountAndType(vg.copy2factor, collection, repType, topo, filter)
 	case storage.Copy010:
-		return vg.GrowByCountAndType(vg.copy2factor, repType, topo)
+		return vg.GrowByCountAndType(vg.copy2factor, collection, repType, topo, filter)
 	case storage.Copy100:
-		return vg.GrowByCountAndType(vg.copy2factor, repType, topo)
+		return vg.GrowByCountAndType(vg.copy2factor, collection, repType, topo, filter)
 	case storage.Copy110:
-		return vg.GrowByCountAndType(vg.copy3factor, repType, topo)
+		return vg.GrowByCountAndType(vg.copy3factor, collection, repType, topo, filter)
 	case storage.Copy200:
-		return vg.GrowByCountAndType(vg.copy3factor, repType, topo)
+		return vg.GrowByCountAndType(vg.copy3factor, collection, repType, topo, filter)
+	case storage.Copy1000:
+		return vg.GrowByCountAndType(vg.copy2factor, collection, repType, topo, filter)
 	}
 	return 0, errors.New("Unknown Replication Type!")
 }
-func (vg *VolumeGrowth) GrowByCountAndType(count int, repType storage.ReplicationType, topo *topology.Topology) (counter int, err error) {
-	counter = 0
-	switch repType {
-	case storage.Copy000:
-		for i := 0; i < count; i++ {
-			if ok, server, vid := topo.RandomlyReserveOneVolume(); ok {
-				if err = vg.grow(topo, *vid, repType, server); err == nil {
-					counter++
-				}
-			}
-		}
-	case storage.Copy001:
-		for i := 0; i < count; i++ {
-			//randomly pick one server, and then choose from the same rack
-			if ok, server1, vid := topo.RandomlyReserveOneVolume(); ok {
-				rack := server1.Parent()
-				exclusion := make(map[string]topology.Node)
-				exclusion[server1.String()] = server1
-				newNodeList := topology.NewNodeList(rack.Children(), exclusion)
-				if newNodeList.FreeSpace() > 0 {
-					if ok2, server2 := newNodeList.ReserveOneVolume(rand.Intn(newNodeList.FreeSpace()), *vid); ok2 {
-						if err = vg.grow(topo, *vid, repType, server1, server2); err == nil {
-							counter++
-						}
-					}
-				}
-			}
-		}
-	case storage.Copy010:
-		for i := 0; i < count; i++ {
-			//randomly pick one server, and then choose from the same rack
-			if ok, server1, vid := topo.RandomlyReserveOneVolume(); ok {
-				rack := server1.Parent()
-				dc := rack.Parent()
-				exclusion := make(map[string]topology.Node)
-				exclusion[rack.String()] = rack
-				newNodeList := topology.NewNodeList(dc.Children(), exclusion)
-				if newNodeList.FreeSpace() > 0 {
-					if ok2, server2 := newNodeList.ReserveOneVolume(rand.Intn(newNodeList.FreeSpace()), *vid); ok2 {
-						if err = vg.grow(topo, *vid, repType, server1, server2); err == nil {
-							counter++
-						}
-					}
-				}
-			}
-		}
-	case storage.Copy100:
-		for i := 0; i < count; i++ {
-			nl := topology.NewNodeList(topo.Children(), nil)
-			picked, ret := nl.RandomlyPickN(2, 1)
-			vid := topo.NextVolumeId()
-			if ret {
-				var servers []*topology.DataNode
-				for _, n := range picked {
-					if n.FreeSpace() > 0 {
-						if ok, server := n.ReserveOneVolume(rand.Intn(n.FreeSpace()), vid); ok {
-							servers = append(servers, server)
-						}
-					}
-				}
-				if len(servers) == 2 {
-					if err = vg.grow(topo, vid, repType, servers...); err == nil {
-						counter++
-					}
-				}
-			}
+
+// GrowByCountAndType creates count volumes on the data nodes that pass the filter.
+func (vg *VolumeGrowth) GrowByCountAndType(count int, collection string, repType storage.ReplicationType, topo *topology.Topology, filter topology.NodeFilter) (counter int, err error) {
+	policy := vg.policy
+	if policy == nil {
+		policy = RandomPlacement
+	}
+	var placementErr error
+	for i := 0; i < count; i++ {
+		vid, e := topo.NextVolumeId()
+		if e != nil {
+			placementErr = e
+			break
 		}
-	case storage.Copy110:
-		for i := 0; i < count; i++ {
-			nl := topology.NewNodeList(topo.Children(), nil)
-			picked, ret := nl.RandomlyPickN(2, 2)
-			vid := topo.NextVolumeId()
-			if ret {
-				var servers []*topology.DataNode
-				dc1, dc2 := picked[0], picked[1]
-				if dc2.FreeSpace() > dc1.FreeSpace() {
-					dc1, dc2 = dc2, dc1
-				}
-				if dc1.FreeSpace() > 0 {
-					if ok, server1 := dc1.ReserveOneVolume(rand.Intn(dc1.FreeSpace()), vid); ok {
-						servers = append(servers, server1)
-						rack := server1.Parent()
-						exclusion := make(map[string]topology.Node)
-						exclusion[rack.String()] = rack
-						newNodeList := topology.NewNodeList(dc1.Children(), exclusion)
-						if newNodeList.FreeSpace() > 0 {
-							if ok2, server2 := newNodeList.ReserveOneVolume(rand.Intn(newNodeList.FreeSpace()), vid); ok2 {
-								servers = append(servers, server2)
-							}
-						}
-					}
-				}
-				if dc2.FreeSpace() > 0 {
-					if ok, server := dc2.ReserveOneVolume(rand.Intn(dc2.FreeSpace()), vid); ok {
-						servers = append(servers, server)
-					}
-				}
-				if len(servers) == 3 {
-					if err = vg.grow(topo, vid, repType, servers...); err == nil {
-						counter++
-					}
-				}
-			}
+		servers, e := policy.Place(topo, repType, vid, filter)
+		if e != nil {
+			placementErr = e
+			continue
 		}
-	case storage.Copy200:
-		for i := 0; i < count; i++ {
-			nl := topology.NewNodeList(topo.Children(), nil)
-			picked, ret := nl.RandomlyPickN(3, 1)
-			vid := topo.NextVolumeId()
-			if ret {
-				var servers []*topology.DataNode
-				for _, n := range picked {
-					if n.FreeSpace() > 0 {
-						if ok, server := n.ReserveOneVolume(rand.Intn(n.FreeSpace()), vid); ok {
-							servers = append(servers, server)
-						}
-					}
-				}
-				if len(servers) == 3 {
-					if err = vg.grow(topo, vid, repType, servers...); err == nil {
-						counter++
-					}
-				}
-			}
+		if err = vg.grow(topo, vid, collection, repType, servers...); err == nil {
+			counter++
 		}
 	}
+	if counter == 0 && err == nil {
+		err = placementErr
+	}
 	return
 }
-func (vg *VolumeGrowth) grow(topo *topology.Topology, vid storage.VolumeId, repType storage.ReplicationType, servers ...*topology.DataNode) error {
-	for _, server := range servers {
-		if err := operation.AllocateVolume(server, vid, repType); err == nil {
-			vi := storage.VolumeInfo{Id: vid, Size: 0, RepType: repType}
+
+// GrowVolume creates one volume with the given id, instead of the next one,
+// e.g. for a volume taken over from another cluster.
+func (vg *VolumeGrowth) GrowVolume(vid storage.VolumeId, collection string, repType storage.ReplicationType, topo *topology.Topology, filter topology.NodeFilter) error {
+	if topo.Lookup(vid) != nil {
+		return errors.New("Volume " + vid.String() + " already exists")
+	}
+	if topo.IsDeletedVolume(vid) {
+		return errors.New("Volume " + vid.String() + " was deleted, and may still have orphan replicas")
+	}
+	policy := vg.policy
+	if policy == nil {
+		policy = RandomPlacement
+	}
+	servers, err := policy.Place(topo, repType, vid, filter)
+	if err != nil {
+		return err
+	}
+	return vg.grow(topo, vid, collection, repType, servers...)
+}
+
+// grow allocates the volume on all the servers in parallel,
+// and registers the replicas that are created.
+func (vg *VolumeGrowth) grow(topo *topology.Topology, vid storage.VolumeId, collection string, repType storage.ReplicationType, servers ...*topology.DataNode) error {
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server *topology.DataNode) {
+			defer wg.Done()
+			errs[i] = operation.AllocateVolume(server, vid, collection, repType)
+		}(i, server)
+	}
+	wg.Wait()
+	var err error
+	for i, server := range servers {
+		if errs[i] == nil {
+			vi := storage.VolumeInfo{Id: vid, Size: 0, RepType: repType, Collection: collection}
 			server.AddOrUpdateVolume(vi)
 			topo.RegisterVolumeLayout(&vi, server)
 			fmt.Println("Created Volume", vid, "on", server)
 		} else {
-			fmt.Println("Failed to assign", vid, "to", servers)
-			return errors.New("Failed to assign " + vid.String())
+			fmt.Println("Failed to assign", vid, "to", server, errs[i])
+			err = errors.New("Failed to assign " + vid.String())
 		}
 	}
-	return nil
+	return err
 }
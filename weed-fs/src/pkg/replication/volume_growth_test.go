@@ -123,8 +123,39 @@ func TestReserveOneVolume(t *testing.T) {
 	topo := setup(topologyLayout)
   rand.Seed(time.Now().UnixNano())
   vg:=&VolumeGrowth{copy1factor:3,copy2factor:2,copy3factor:1,copyAll:4}
-  if c, e := vg.GrowByCountAndType(1,storage.Copy000,topo);e==nil{
+  if c, e := vg.GrowByCountAndType(1,"",storage.Copy000,topo,nil);e==nil{
     t.Log("reserved", c)
   }
 }
 
+
+func TestNextVolumeIdInPartition(t *testing.T) {
+	topo := setup(topologyLayout)
+	for _, c := range []struct {
+		partition string
+		expected  storage.VolumeId
+	}{{"", 7}, {"1/2", 7}, {"0/2", 8}, {"1/3", 7}, {"5-9", 7}, {"100-199", 100}} {
+		p, err := topology.ParseVolumeIdPartition(c.partition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topo.SetVolumeIdPartition(p)
+		if vid, err := topo.NextVolumeId(); err != nil || vid != c.expected {
+			t.Fatal("partition", c.partition, "expecting", c.expected, "got", vid, err)
+		}
+	}
+	p, _ := topology.ParseVolumeIdPartition("2-6")
+	topo.SetVolumeIdPartition(p)
+	if _, err := topo.NextVolumeId(); err != topology.ErrVolumeIdsExhausted {
+		t.Fatal("expecting the partition to be used up, got", err)
+	}
+}
+
+func TestGrowVolumeRefusesExistingId(t *testing.T) {
+	topo := setup(topologyLayout)
+	vi := storage.VolumeInfo{Id: 4, RepType: storage.Copy000}
+	topo.RegisterVolumeLayout(&vi, topology.NewDataNode("server9"))
+	if err := NewDefaultVolumeGrowth().GrowVolume(4, "", storage.Copy000, topo, nil); err == nil || err.Error() != "Volume 4 already exists" {
+		t.Fatal("expecting volume 4 to exist, got", err)
+	}
+}
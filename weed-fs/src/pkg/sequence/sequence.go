@@ -1,47 +1,74 @@
 package sequence
 
 import (
-  "encoding/gob"
-  "os"
-  "path"
-	"sync"
+	"encoding/gob"
+	"errors"
 	"log"
+	"os"
+	"path"
+	"pkg/util"
+	"strconv"
+	"sync"
 )
 
 const (
-	FileIdSaveInterval = 10000
+	DefaultBatchSize = 10000
 )
 
 type Sequencer interface {
+	// NextFileId reserves count consecutive file ids, and returns the first one.
 	NextFileId(count int) (uint64, int)
+	SetBatchSize(size int)
+	// Bump moves the next file id forward to next. It can not move backwards.
+	Bump(next uint64) error
+	// Peek is the next file id to hand out, without reserving it.
+	Peek() uint64
+	ToMap() interface{}
 }
+
+// SequencerImpl hands out file ids from batches. Only the high-water mark,
+// the largest id of the current batch, is saved to the disk, once per batch,
+// before any id of the batch is handed out. After a crash, the ids start
+// above the saved high-water mark, so no id is ever reused.
 type SequencerImpl struct {
 	dir      string
 	fileName string
 
-	volumeLock   sync.Mutex
 	sequenceLock sync.Mutex
 
-	FileIdSequence uint64
-	fileIdCounter  uint64
+	batchSize     uint64
+	next          uint64 // the next file id to hand out
+	highWaterMark uint64 // the largest file id saved as used
 }
 
 func NewSequencer(dirname string, filename string) (m *SequencerImpl) {
-  m = &SequencerImpl{dir: dirname, fileName: filename}
+	m = &SequencerImpl{dir: dirname, fileName: filename, batchSize: DefaultBatchSize}
 
-  seqFile, se := os.OpenFile(path.Join(m.dir, m.fileName+".seq"), os.O_RDONLY, 0644)
-  if se != nil {
-    m.FileIdSequence = FileIdSaveInterval
-    log.Println("Setting file id sequence", m.FileIdSequence)
-  } else {
-    decoder := gob.NewDecoder(seqFile)
-    defer seqFile.Close()
-    decoder.Decode(&m.FileIdSequence)
-    log.Println("Loading file id sequence", m.FileIdSequence, "=>", m.FileIdSequence+FileIdSaveInterval)
-    //in case the server stops between intervals
-    m.FileIdSequence += FileIdSaveInterval
-  }
-  return
+	seqFile, se := os.OpenFile(m.filePath(), os.O_RDONLY, 0644)
+	if se != nil {
+		if !os.IsNotExist(se) {
+			log.Fatalf("Sequence File Load [ERROR] %s\n", se)
+		}
+		log.Println("Starting file id sequence from", m.highWaterMark+1)
+	} else {
+		defer seqFile.Close()
+		if e := gob.NewDecoder(seqFile).Decode(&m.highWaterMark); e != nil {
+			// starting over could hand out used ids again
+			log.Fatalf("Sequence File %s is corrupted [ERROR] %s\n", m.filePath(), e)
+		}
+		log.Println("Loading file id sequence high-water mark", m.highWaterMark)
+	}
+	m.next = m.highWaterMark + 1
+	return
+}
+
+func (m *SequencerImpl) SetBatchSize(size int) {
+	m.sequenceLock.Lock()
+	defer m.sequenceLock.Unlock()
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	m.batchSize = uint64(size)
 }
 
 //count should be 1 or more
@@ -51,21 +78,71 @@ func (m *SequencerImpl) NextFileId(count int) (uint64, int) {
 	}
 	m.sequenceLock.Lock()
 	defer m.sequenceLock.Unlock()
-	if m.fileIdCounter < uint64(count) {
-		m.fileIdCounter = FileIdSaveInterval
-		m.FileIdSequence += FileIdSaveInterval
-		m.saveSequence()
+	last := m.next + uint64(count) - 1
+	if last > m.highWaterMark {
+		if err := m.saveSequence(last + m.batchSize - 1); err != nil {
+			log.Fatalf("Sequence File Save [ERROR] %s\n", err)
+		}
+	}
+	fileId := m.next
+	m.next = last + 1
+	return fileId, count
+}
+
+func (m *SequencerImpl) Bump(next uint64) error {
+	m.sequenceLock.Lock()
+	defer m.sequenceLock.Unlock()
+	if next < m.next {
+		return errors.New("Can not move the file id sequence back from " + strconv.FormatUint(m.next, 10) + " to " + strconv.FormatUint(next, 10))
+	}
+	if next > m.highWaterMark {
+		if err := m.saveSequence(next + m.batchSize - 1); err != nil {
+			return err
+		}
 	}
-	m.fileIdCounter = m.fileIdCounter - uint64(count)
-	return m.FileIdSequence - m.fileIdCounter, count
+	m.next = next
+	return nil
 }
-func (m *SequencerImpl) saveSequence() {
-  log.Println("Saving file id sequence", m.FileIdSequence, "to", path.Join(m.dir, m.fileName+".seq"))
-  seqFile, e := os.OpenFile(path.Join(m.dir, m.fileName+".seq"), os.O_CREATE|os.O_WRONLY, 0644)
-  if e != nil {
-    log.Fatalf("Sequence File Save [ERROR] %s\n", e)
-  }
-  defer seqFile.Close()
-  encoder := gob.NewEncoder(seqFile)
-  encoder.Encode(m.FileIdSequence)
+
+func (m *SequencerImpl) Peek() uint64 {
+	m.sequenceLock.Lock()
+	defer m.sequenceLock.Unlock()
+	return m.next
+}
+
+func (m *SequencerImpl) ToMap() interface{} {
+	m.sequenceLock.Lock()
+	defer m.sequenceLock.Unlock()
+	ret := make(map[string]interface{})
+	ret["Next"] = m.next
+	ret["HighWaterMark"] = m.highWaterMark
+	ret["BatchSize"] = m.batchSize
+	return ret
+}
+
+func (m *SequencerImpl) filePath() string {
+	return path.Join(m.dir, m.fileName+".seq")
+}
+
+// saveSequence writes the high-water mark to a temporary file, syncs it,
+// and renames it over the sequence file, so a crash never leaves a partial file.
+func (m *SequencerImpl) saveSequence(highWaterMark uint64) error {
+	log.Println("Saving file id sequence high-water mark", highWaterMark, "to", m.filePath())
+	tmpPath := m.filePath() + ".tmp"
+	seqFile, e := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if e != nil {
+		return e
+	}
+	if e = gob.NewEncoder(seqFile).Encode(highWaterMark); e == nil {
+		e = util.Fsync(seqFile)
+	}
+	seqFile.Close()
+	if e != nil {
+		return e
+	}
+	if e = os.Rename(tmpPath, m.filePath()); e != nil {
+		return e
+	}
+	m.highWaterMark = highWaterMark
+	return nil
 }
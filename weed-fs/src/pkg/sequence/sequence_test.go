@@ -0,0 +1,46 @@
+package sequence
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSequenceNeverReusesIdsAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewSequencer(dir, "test")
+	m.SetBatchSize(10)
+	if id, _ := m.NextFileId(1); id != 1 {
+		t.Fatalf("first id is %d", id)
+	}
+	if id, _ := m.NextFileId(3); id != 2 {
+		t.Fatalf("first id of the second assignment is %d", id)
+	}
+	if id, _ := m.NextFileId(20); id != 5 {
+		t.Fatalf("first id of an assignment larger than a batch is %d", id)
+	}
+
+	// restarting without a clean shutdown skips the rest of the batch
+	m = NewSequencer(dir, "test")
+	if id, _ := m.NextFileId(1); id <= 24 {
+		t.Fatalf("id %d was already handed out before the restart", id)
+	}
+
+	if err := m.Bump(1000); err != nil {
+		t.Fatal(err)
+	}
+	if m.Peek() != 1000 {
+		t.Fatalf("next id after bumping to 1000 is %d", m.Peek())
+	}
+	if id, _ := m.NextFileId(1); id != 1000 {
+		t.Fatalf("id after bumping to 1000 is %d", id)
+	}
+	if err := m.Bump(10); err == nil {
+		t.Fatalf("bumping backwards should fail")
+	}
+}
@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+)
+
+// CheckCollectionName refuses the collection names that are not safe in the
+// file names of the volumes, collection_id.dat, i.e. the ones with other
+// characters than letters, digits, '.', '_' and '-', or with "..".
+func CheckCollectionName(collection string) error {
+	for _, c := range collection {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return errors.New("Collection " + collection + " should only have letters, digits, '.', '_' and '-'")
+		}
+	}
+	if strings.Contains(collection, "..") {
+		return errors.New("Collection " + collection + " should not have \"..\"")
+	}
+	return nil
+}
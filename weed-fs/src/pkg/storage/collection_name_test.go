@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckCollectionName(t *testing.T) {
+	for _, name := range []string{"", "pictures", "logs-2024.01", "a_b"} {
+		if err := CheckCollectionName(name); err != nil {
+			t.Error(name, err)
+		}
+	}
+	for _, name := range []string{"../../etc/x", "..", "a..b", "a/b", `a\b`, "a b", "é"} {
+		if err := CheckCollectionName(name); err == nil {
+			t.Error("expecting", name, "to be refused")
+		}
+	}
+}
+
+func TestAddVolumeRefusesUnsafeCollection(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_collection")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	s := NewStore(8080, "localhost", "localhost:8080", []string{dir + "/volumes"}, []int{2})
+	defer s.Close()
+	os.Mkdir(dir+"/volumes", 0755)
+	if e := s.AddVolume("1", "../escaped", "000"); e == nil {
+		t.Fatal("expecting the collection ../escaped to be refused")
+	}
+	if _, e := os.Stat(dir + "/escaped_1.dat"); !os.IsNotExist(e) {
+		t.Fatal("a volume file was written outside the directory:", e)
+	}
+	if e := s.AddVolume("1", "pictures", "000"); e != nil {
+		t.Fatal(e)
+	}
+}
@@ -96,7 +96,11 @@ func NewCompactMap() CompactMap {
 
 func (cm *CompactMap) Set(key Key, offset uint32, size uint32) {
 	x := cm.binarySearchCompactSection(key)
-	if x < 0 {
+	if x == -3 {
+		// below the first section, keep the sections sorted by their start
+		cm.list = append([]CompactSection{NewCompactSection(key)}, cm.list...)
+		x = 0
+	} else if x < 0 {
 		//println(x, "creating", len(cm.list), "section1, starting", key)
 		cm.list = append(cm.list, NewCompactSection(key))
 		x = len(cm.list) - 1
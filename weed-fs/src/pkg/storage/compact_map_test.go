@@ -61,3 +61,15 @@ func TestXYZ(t *testing.T) {
 	}
 
 }
+
+func TestCompactMapKeyBelowTheFirstSection(t *testing.T) {
+	m := NewCompactMap()
+	for _, key := range []Key{2, 3, 1} {
+		m.Set(key, uint32(key), uint32(key))
+	}
+	for _, key := range []Key{1, 2, 3} {
+		if v, ok := m.Get(key); !ok || v.Offset != uint32(key) {
+			t.Fatal("key", key, "got", v, ok)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"pkg/util"
+	"strings"
+)
+
+// DiskLocation is one data directory of a store, usually on a disk of its own.
+// When the directory fails, only its volumes are lost, and the store keeps
+// serving the volumes in the other directories.
+type DiskLocation struct {
+	Directory      string
+	MaxVolumeCount int
+	Failed         bool
+	InMemory       bool // the volumes are kept in memory, with no directory behind them
+	volumes        map[VolumeId]*Volume
+	lostVolumes    []VolumeId // the volumes unloaded when the directory failed
+}
+
+func NewDiskLocation(dir string, maxVolumeCount int) *DiskLocation {
+	return &DiskLocation{Directory: dir, MaxVolumeCount: maxVolumeCount, volumes: make(map[VolumeId]*Volume)}
+}
+
+// NewMemoryLocation holds up to maxVolumeCount volumes in memory.
+func NewMemoryLocation(maxVolumeCount int) *DiskLocation {
+	return &DiskLocation{Directory: "memory", MaxVolumeCount: maxVolumeCount, InMemory: true, volumes: make(map[VolumeId]*Volume)}
+}
+
+func (l *DiskLocation) loadExistingVolumes(loaded func(vid VolumeId) bool) {
+	if dirs, err := ioutil.ReadDir(l.Directory); err == nil {
+		for _, dir := range dirs {
+			name := dir.Name()
+			if strings.HasSuffix(name, ".remote") {
+				// an offloaded volume, unless its .dat is still there too
+				if _, err := os.Stat(path.Join(l.Directory, strings.TrimSuffix(name, ".remote")+".dat")); os.IsNotExist(err) {
+					name = strings.TrimSuffix(name, ".remote") + ".dat"
+				}
+			}
+			if !dir.IsDir() && strings.HasSuffix(name, ".dat") {
+				collection, base := "", name[:len(name)-len(".dat")]
+				if i := strings.LastIndex(base, "_"); i > 0 {
+					collection, base = base[:i], base[i+1:]
+				}
+				if vid, err := NewVolumeId(base); err == nil {
+					if l.volumes[vid] == nil && !loaded(vid) {
+						v := NewVolume(l.Directory, collection, vid, CopyNil)
+						if v.version > CurrentVersion {
+							// written by a newer weed-fs, which the needles of this one would corrupt
+							log.Println("In dir", l.Directory, "skips volume", vid, "of needle version", v.version, "newer than", CurrentVersion)
+							v.Close()
+							continue
+						}
+						l.volumes[vid] = v
+						log.Println("In dir", l.Directory, "reads volume = ", vid, ", collection =", collection, ", replicationType =", v.replicaType)
+					}
+				}
+			}
+		}
+	}
+}
+
+// probe checks that the directory is still writable, by writing, syncing and removing a small file.
+func (l *DiskLocation) probe() error {
+	if l.InMemory {
+		return nil
+	}
+	probePath := path.Join(l.Directory, ".weed_probe")
+	f, err := os.OpenFile(probePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write([]byte("probe")); err == nil {
+		err = util.Fsync(f)
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(probePath)
+}
+
+// fail unloads all the volumes of the failed directory, and remembers them as lost.
+func (l *DiskLocation) fail(err error) {
+	log.Println("Dir", l.Directory, "failed with", len(l.volumes), "volumes:", err)
+	l.Failed = true
+	for vid, v := range l.volumes {
+		v.Close()
+		l.lostVolumes = append(l.lostVolumes, vid)
+	}
+	l.volumes = make(map[VolumeId]*Volume)
+}
+
+func (l *DiskLocation) FreeCount() int {
+	if l.Failed {
+		return 0
+	}
+	return l.MaxVolumeCount - len(l.volumes)
+}
+
+func (l *DiskLocation) ToMap() interface{} {
+	ret := make(map[string]interface{})
+	ret["Directory"] = l.Directory
+	ret["Max"] = l.MaxVolumeCount
+	ret["Volumes"] = len(l.volumes)
+	ret["Failed"] = l.Failed
+	ret["LostVolumes"] = l.lostVolumes
+	return ret
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStoreIsolatesFailedDirectory(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_store")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	dir1, dir2 := path.Join(dir, "1"), path.Join(dir, "2")
+	os.Mkdir(dir1, 0755)
+	os.Mkdir(dir2, 0755)
+
+	s := NewStore(8080, "localhost", "localhost:8080", []string{dir1, dir2}, []int{2, 2})
+	defer s.Close()
+	if e := s.AddVolume("1-4", "", "000"); e != nil {
+		t.Fatal(e)
+	}
+	if e := s.AddVolume("5", "", "000"); e == nil {
+		t.Fatal("a fifth volume should not fit in 2 directories of 2 volumes")
+	}
+
+	os.RemoveAll(dir2)
+	s.CheckDiskLocations()
+	if len(s.LostVolumes()) != 2 || len(s.Status()) != 2 {
+		t.Fatal("lost", s.LostVolumes(), "kept", len(s.Status()), "volumes")
+	}
+	if s.MaxVolumeCount() != 2 {
+		t.Fatal("max volume count", s.MaxVolumeCount(), "should only count the healthy directory")
+	}
+
+	os.Mkdir(dir2, 0755)
+	if e := s.ReloadDiskLocation(dir2); e != nil {
+		t.Fatal(e)
+	}
+	if len(s.LostVolumes()) != 0 || s.MaxVolumeCount() != 4 {
+		t.Fatal("after reloading, lost", s.LostVolumes(), "max volume count", s.MaxVolumeCount())
+	}
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sync"
+)
+
+// FilePool bounds the files the volumes keep open, for servers with more volumes
+// than file descriptors. The least recently used files are closed when more than
+// the budget are open, and opened again, at the same position, on their next use.
+// A file in use is never closed, so the budget can be overrun while they all are.
+type FilePool struct {
+	budget int
+	files  *list.List // of the open *pooledFile, most recently used at the front
+	lock   sync.Mutex
+
+	opens, reopens, closes int64
+}
+
+func NewFilePool(budget int) *FilePool {
+	return &FilePool{budget: budget, files: list.New()}
+}
+
+// filePool keeps the volume files, nil to keep them all open.
+var filePool *FilePool
+
+// SetFilePool makes the volumes loaded or created from now on keep their data,
+// index and trash files in the pool. Nil keeps them all open.
+func SetFilePool(pool *FilePool) {
+	filePool = pool
+}
+
+// openVolumeFile opens a file of a volume, in the file pool if there is one.
+func openVolumeFile(name string, flag int) (volumeFile, error) {
+	if filePool == nil {
+		return os.OpenFile(name, flag, 0644)
+	}
+	return filePool.open(name, flag)
+}
+
+// pooledFile is a volumeFile the pool may close while it is idle. Its lock is
+// held through each operation.
+type pooledFile struct {
+	pool     *FilePool
+	name     string
+	flag     int // to open it again, without O_CREATE, O_EXCL nor O_TRUNC
+	lock     sync.Mutex
+	file     *os.File      // nil while closed by the pool
+	position int64         // where the file was when the pool closed it
+	element  *list.Element // in the pool while open
+	closed   bool          // by the volume
+}
+
+func (p *FilePool) open(name string, flag int) (*pooledFile, error) {
+	file, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f := &pooledFile{pool: p, name: name, flag: flag &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC), file: file}
+	p.lock.Lock()
+	f.element = p.files.PushFront(f)
+	p.opens++
+	p.lock.Unlock()
+	p.closeIdle(f)
+	return f, nil
+}
+
+// closeIdle closes the least recently used files over the budget, other than
+// the one being used, skipping the ones in use.
+func (p *FilePool) closeIdle(using *pooledFile) {
+	p.lock.Lock()
+	var candidates []*pooledFile
+	for e := p.files.Back(); e != nil && p.files.Len()-len(candidates) > p.budget; e = e.Prev() {
+		if f := e.Value.(*pooledFile); f != using {
+			candidates = append(candidates, f)
+		}
+	}
+	p.lock.Unlock()
+	for _, f := range candidates {
+		if !f.lock.TryLock() {
+			continue
+		}
+		if f.file != nil {
+			if position, err := f.file.Seek(0, io.SeekCurrent); err == nil {
+				f.position = position
+				f.file.Close()
+				f.file = nil
+				p.remove(f)
+				p.lock.Lock()
+				p.closes++
+				p.lock.Unlock()
+			}
+		}
+		f.lock.Unlock()
+	}
+}
+
+func (p *FilePool) remove(f *pooledFile) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if f.element != nil {
+		p.files.Remove(f.element)
+		f.element = nil
+	}
+}
+
+func (p *FilePool) ToMap() map[string]interface{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return map[string]interface{}{
+		"Budget":  p.budget,
+		"Open":    p.files.Len(),
+		"Opens":   p.opens,
+		"Reopens": p.reopens,
+		"Closes":  p.closes,
+	}
+}
+
+// use runs op on the open file, opening it again if the pool closed it.
+func (f *pooledFile) use(op func(file *os.File) error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	p := f.pool
+	if f.file == nil {
+		file, err := os.OpenFile(f.name, f.flag, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err = file.Seek(f.position, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+		f.file = file
+		p.lock.Lock()
+		f.element = p.files.PushFront(f)
+		p.reopens++
+		p.lock.Unlock()
+		p.closeIdle(f)
+	} else {
+		p.lock.Lock()
+		p.files.MoveToFront(f.element)
+		p.lock.Unlock()
+	}
+	return op(f.file)
+}
+
+func (f *pooledFile) Read(b []byte) (n int, err error) {
+	err = f.use(func(file *os.File) (e error) { n, e = file.Read(b); return })
+	return
+}
+
+func (f *pooledFile) Write(b []byte) (n int, err error) {
+	err = f.use(func(file *os.File) (e error) { n, e = file.Write(b); return })
+	return
+}
+
+func (f *pooledFile) ReadAt(b []byte, offset int64) (n int, err error) {
+	err = f.use(func(file *os.File) (e error) { n, e = file.ReadAt(b, offset); return })
+	return
+}
+
+func (f *pooledFile) WriteAt(b []byte, offset int64) (n int, err error) {
+	err = f.use(func(file *os.File) (e error) { n, e = file.WriteAt(b, offset); return })
+	return
+}
+
+func (f *pooledFile) Seek(offset int64, whence int) (position int64, err error) {
+	err = f.use(func(file *os.File) (e error) { position, e = file.Seek(offset, whence); return })
+	return
+}
+
+func (f *pooledFile) Stat() (stat os.FileInfo, err error) {
+	err = f.use(func(file *os.File) (e error) { stat, e = file.Stat(); return })
+	return
+}
+
+func (f *pooledFile) Truncate(size int64) error {
+	return f.use(func(file *os.File) error { return file.Truncate(size) })
+}
+
+func (f *pooledFile) Sync() error {
+	return f.use(func(file *os.File) error { return file.Sync() })
+}
+
+func (f *pooledFile) Name() string {
+	return f.name
+}
+
+func (f *pooledFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	f.pool.remove(f)
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
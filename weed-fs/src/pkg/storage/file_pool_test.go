@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFilePoolReopensIdleFiles(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_file_pool")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	pool := NewFilePool(2)
+	SetFilePool(pool)
+	defer SetFilePool(nil)
+
+	// 3 volumes with a data and an index file each, for 2 open files
+	var volumes []*Volume
+	for vid := VolumeId(1); vid <= 3; vid++ {
+		volumes = append(volumes, NewVolume(dir, "", vid, Copy000))
+	}
+	for i := uint64(1); i <= 6; i++ {
+		for _, v := range volumes {
+			if _, e = v.write(newTestNeedle(i)); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+	volumes[1].delete(newTestNeedle(2), false)
+	if e = volumes[2].compact(); e != nil {
+		t.Fatal(e)
+	}
+	for _, v := range volumes {
+		for i := uint64(1); i <= 6; i++ {
+			n := &Needle{Id: i}
+			if _, e = v.read(n); (e != nil) != (v.Id == 2 && i == 2) {
+				t.Fatal("volume", v.Id, "needle", i, "read error:", e)
+			}
+			if e == nil && string(n.Data) != string(newTestNeedle(i).Data) {
+				t.Fatal("volume", v.Id, "needle", i, "has unexpected data", string(n.Data))
+			}
+		}
+	}
+	m := pool.ToMap()
+	if m["Open"].(int) > 2 || m["Reopens"].(int64) == 0 || m["Closes"].(int64) == 0 {
+		t.Fatal("the idle files should be closed and reopened", m)
+	}
+
+	// the index written through the reopened files loads back
+	for _, v := range volumes {
+		v.Close()
+	}
+	if m = pool.ToMap(); m["Open"].(int) != 0 {
+		t.Fatal("the closed volumes should leave no file open", m)
+	}
+	v := NewVolume(dir, "", VolumeId(2), CopyNil)
+	defer v.Close()
+	if _, e = v.read(&Needle{Id: 2}); e == nil {
+		t.Fatal("needle 2 of volume 2 was deleted")
+	}
+	if _, e = v.read(&Needle{Id: 6}); e != nil {
+		t.Fatal("needle 6 of volume 2 should load back", e)
+	}
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"pkg/util"
+	"sync"
+)
+
+// Intent is a replicated write in progress: the file was written locally, and
+// is being sent to the other replicas.
+type Intent struct {
+	Id       uint64
+	Fid      string   // vid,key_cookie of the file
+	Size     uint32   // size of the local write
+	Filename string   // the file name sent to the replicas
+	Mime     string   `json:",omitempty"` // the content type sent to the replicas
+	Targets  []string // urls of the other replicas
+	Done     bool     `json:",omitempty"`
+}
+
+// IntentLog records a replicated write before it is sent to the other replicas,
+// and marks it done once the replicas have it, before the client is acknowledged,
+// except for the writes acknowledged while some replicas were skipped. Both are
+// synced to the disk, so after a crash the intents not done are the writes that
+// may have reached only some replicas. They are completed or tombstoned on all
+// the replicas when the server restarts. The concurrent writes share the syncs,
+// as a group commit.
+type IntentLog struct {
+	path    string
+	file    *os.File
+	sync    *util.GroupSync
+	lock    sync.Mutex
+	lastId  uint64
+	pending map[uint64]*Intent
+}
+
+func NewIntentLog(path string) (*IntentLog, error) {
+	l := &IntentLog{path: path, pending: make(map[uint64]*Intent)}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			intent := new(Intent)
+			if err := json.Unmarshal(scanner.Bytes(), intent); err != nil {
+				// the last record can be cut short by the crash, before it was synced
+				log.Println("Skipping broken replication intent in", path, ":", err)
+				continue
+			}
+			if intent.Id > l.lastId {
+				l.lastId = intent.Id
+			}
+			if intent.Done {
+				delete(l.pending, intent.Id)
+			} else {
+				l.pending[intent.Id] = intent
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	var err error
+	if l.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	l.sync = util.NewGroupSync(l.file)
+	if len(l.pending) == 0 {
+		err = l.file.Truncate(0)
+	}
+	return l, err
+}
+
+// Begin durably records the intent before the write is sent to the targets.
+func (l *IntentLog) Begin(fid string, size uint32, filename string, mime string, targets []string) (*Intent, error) {
+	l.lock.Lock()
+	l.lastId++
+	intent := &Intent{Id: l.lastId, Fid: fid, Size: size, Filename: filename, Mime: mime, Targets: targets}
+	ticket, err := l.append(intent)
+	if err == nil {
+		l.pending[intent.Id] = intent
+	}
+	l.lock.Unlock()
+	if err == nil {
+		if err = l.sync.Wait(ticket); err != nil {
+			l.lock.Lock()
+			delete(l.pending, intent.Id)
+			l.lock.Unlock()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return intent, nil
+}
+
+// Done durably marks the intent as completed, or rolled back.
+// The log is emptied whenever no intent is pending.
+func (l *IntentLog) Done(intent *Intent) error {
+	l.lock.Lock()
+	if _, ok := l.pending[intent.Id]; !ok {
+		l.lock.Unlock()
+		return nil
+	}
+	delete(l.pending, intent.Id)
+	var ticket uint64
+	var err error
+	if len(l.pending) == 0 {
+		if err = l.file.Truncate(0); err == nil {
+			ticket = l.sync.Written()
+		}
+	} else {
+		ticket, err = l.append(&Intent{Id: intent.Id, Done: true})
+	}
+	l.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return l.sync.Wait(ticket)
+}
+
+// append writes the intent to the log, and returns the ticket to wait for it
+// to be synced.
+func (l *IntentLog) append(intent *Intent) (uint64, error) {
+	data, err := json.Marshal(intent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = l.file.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return l.sync.Written(), nil
+}
+
+// Pending returns the intents not done, e.g. left over from a crash.
+func (l *IntentLog) Pending() (intents []*Intent) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, intent := range l.pending {
+		intents = append(intents, intent)
+	}
+	return
+}
+
+func (l *IntentLog) Close() {
+	l.file.Close()
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"pkg/util"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestIntentLogKeepsPendingIntentsAcrossRestart(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_intents")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "replication.intents")
+
+	l, e := NewIntentLog(logPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+	done, _ := l.Begin("3,01637037d6", 10, "a.txt", "", []string{"localhost:8081"})
+	l.Begin("3,02637037d6", 20, "b.txt", "", []string{"localhost:8081", "localhost:8082"})
+	l.Done(done)
+	l.Close()
+
+	// a crash while writing leaves a broken last record
+	f, _ := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(`{"Id":3,"Fid":"3,03`))
+	f.Close()
+
+	l, e = NewIntentLog(logPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	pending := l.Pending()
+	if len(pending) != 1 || pending[0].Fid != "3,02637037d6" || len(pending[0].Targets) != 2 {
+		t.Fatal("unexpected pending intents", pending)
+	}
+	if next, _ := l.Begin("3,04637037d6", 1, "", "", nil); next.Id != 3 {
+		t.Fatal("intent ids should continue after the loaded ones, got", next.Id)
+	}
+	for _, intent := range l.Pending() {
+		l.Done(intent)
+	}
+	if info, _ := os.Stat(logPath); info.Size() != 0 {
+		t.Fatal("the log should be emptied when no intent is pending, size", info.Size())
+	}
+}
+
+func TestIntentLogConcurrentWrites(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_intents")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "replication.intents")
+
+	l, e := NewIntentLog(logPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			intent, e := l.Begin("3,0"+strconv.Itoa(i)+"637037d6", 10, "", "", nil)
+			if e != nil {
+				t.Error(e)
+				return
+			}
+			if i%2 == 0 {
+				if e = l.Done(intent); e != nil {
+					t.Error(e)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	l.Close()
+
+	l, e = NewIntentLog(logPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	if pending := l.Pending(); len(pending) != 25 {
+		t.Fatal("expected the 25 intents not done, got", len(pending))
+	}
+
+	defer util.SetFaults("")
+	util.SetFaults(util.FaultFailFsync + "=1")
+	if _, e := l.Begin("3,99637037d6", 10, "", "", nil); e != util.ErrInjectedFault {
+		t.Fatal("expected the failed sync, got", e)
+	}
+	if pending := l.Pending(); len(pending) != 25 {
+		t.Fatal("an intent not synced is pending, got", len(pending))
+	}
+}
@@ -1,29 +1,62 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
-	"os"
 	"pkg/util"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Version is the needle format version of a volume, kept in the first byte of its super block.
+type Version uint8
+
+const (
+	Version1       = Version(1)
+	Version2       = Version(2)
+	CurrentVersion = Version2
+
+	FlagHasPairs            = 0x01
+	FlagHasLastModifiedDate = 0x02
+	FlagIsChunkManifest     = 0x08 // the data is the json manifest of a chunked file, 0x04 is FlagEncrypted
+
+	PairNamePrefix = "X-Weed-Meta-"
+	MaxPairsSize   = 64 * 1024
+)
+
+// Version1: Cookie, Id, Size, Data, Checksum, Padding
+// Version2: Cookie, Id, Size, DataSize, Data, Flags, [PairsSize, Pairs], [LastModified], Checksum, Padding
+// The Checksum of version2 covers the Data, and then the Flags, the Pairs and the LastModified.
 type Needle struct {
-	Cookie   uint32 "random number to mitigate brute force lookups"
-	Id       uint64 "needle id"
-	Size     uint32 "Data size"
-	Data     []byte "The actual file data"
-	Checksum CRC  "CRC32 to check integrity"
-	Padding  []byte "Aligned to 8 bytes"
+	Cookie       uint32 "random number to mitigate brute force lookups"
+	Id           uint64 "needle id"
+	Size         uint32 "sum of DataSize,Data,Flags,PairsSize,Pairs,LastModified"
+	DataSize     uint32 // version2 only, Data size
+	Data         []byte "The actual file data"
+	Flags        byte   // version2 only, boolean flags
+	PairsSize    uint16 // version2 only, Pairs size
+	Pairs        []byte // version2 only, user defined name value pairs in json, less than 64KB
+	LastModified uint64 // version2 only, unix time in seconds of the write
+	Checksum     CRC    "CRC32 to check integrity"
+	Padding      []byte "Aligned to 8 bytes"
+	Mime         string // content type of the upload, not stored, sent along to the replicas
 }
 
-func NewNeedle(r *http.Request) (n *Needle, fname string, e error) {
+// NewNeedle reads the uploaded file of the request, checked against the policy
+// of the collection if not nil. With ?cm=true the file is the manifest of a
+// chunked file, flagged as such, and never gzipped.
+func NewNeedle(r *http.Request, policy *UploadPolicy) (n *Needle, fname string, e error) {
 
 	n = new(Needle)
 	form, fe := r.MultipartReader()
@@ -32,12 +65,38 @@ func NewNeedle(r *http.Request) (n *Needle, fname string, e error) {
 		e = fe
 		return
 	}
-	part, _ := form.NextPart()
-	fname = part.FileName()
-	data, _ := ioutil.ReadAll(part)
+	part, pe := form.NextPart()
+	if pe != nil {
+		e = pe
+		return
+	}
+	fname, n.Mime = part.FileName(), part.Header.Get("Content-Type")
+	if e = policy.checkContentType(n.Mime, fname); e != nil {
+		return
+	}
+	var content io.Reader = part
+	if policy != nil && policy.MaxSize > 0 {
+		// no need to read more than one byte past the limit
+		content = io.LimitReader(part, policy.MaxSize+1)
+	}
+	data, de := ioutil.ReadAll(content)
+	if de != nil {
+		e = de
+		return
+	}
+	if e = policy.checkSize(int64(len(data))); e != nil {
+		return
+	}
 	//log.Println("uploading file " + part.FileName())
-	dotIndex := strings.LastIndex(fname, ".")
-	if dotIndex > 0 {
+	if e = verifyContentChecksum(data, part.Header.Get("Content-MD5"), part.Header.Get("X-Content-Sha256")); e != nil {
+		return
+	}
+	if e = verifyContentChecksum(data, r.Header.Get("Content-MD5"), r.Header.Get("X-Content-Sha256")); e != nil {
+		return
+	}
+	if r.URL.Query().Get("cm") == "true" {
+		n.Flags |= FlagIsChunkManifest
+	} else if dotIndex := strings.LastIndex(fname, "."); dotIndex > 0 {
 		ext := fname[dotIndex:]
 		mtype := mime.TypeByExtension(ext)
 		if IsCompressable(ext, mtype) {
@@ -46,6 +105,11 @@ func NewNeedle(r *http.Request) (n *Needle, fname string, e error) {
 	}
 	n.Data = data
 	n.Checksum = NewCRC(data)
+	if e = n.parsePairs(r.Header); e != nil {
+		return
+	}
+	n.LastModified = uint64(time.Now().Unix())
+	n.Flags |= FlagHasLastModifiedDate
 
 	commaSep := strings.LastIndex(r.URL.Path, ",")
 	dotSep := strings.LastIndex(r.URL.Path, ".")
@@ -58,6 +122,72 @@ func NewNeedle(r *http.Request) (n *Needle, fname string, e error) {
 
 	return
 }
+
+var ErrChecksumMismatch = errors.New("Checksum mismatch! Data corrupted during transmission.")
+
+// verifyContentChecksum checks the uploaded file content against the
+// optional base64 encoded Content-MD5 and hex encoded X-Content-Sha256 headers.
+func verifyContentChecksum(data []byte, contentMd5 string, contentSha256 string) error {
+	if contentMd5 != "" {
+		expected, err := base64.StdEncoding.DecodeString(contentMd5)
+		if err != nil {
+			return errors.New("Invalid Content-MD5 " + contentMd5)
+		}
+		actual := md5.Sum(data)
+		if !bytes.Equal(expected, actual[:]) {
+			return ErrChecksumMismatch
+		}
+	}
+	if contentSha256 != "" {
+		expected, err := hex.DecodeString(contentSha256)
+		if err != nil {
+			return errors.New("Invalid X-Content-Sha256 " + contentSha256)
+		}
+		actual := sha256.Sum256(data)
+		if !bytes.Equal(expected, actual[:]) {
+			return ErrChecksumMismatch
+		}
+	}
+	return nil
+}
+
+// parsePairs keeps the X-Weed-Meta-* request headers as the needle's name value pairs.
+func (n *Needle) parsePairs(header http.Header) error {
+	pairs := make(map[string]string)
+	for name, values := range header {
+		if strings.HasPrefix(name, PairNamePrefix) && len(name) > len(PairNamePrefix) {
+			pairs[name[len(PairNamePrefix):]] = values[0]
+		}
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	pairsBytes, err := json.Marshal(pairs)
+	if err != nil {
+		return err
+	}
+	if len(pairsBytes) >= MaxPairsSize {
+		return errors.New("Too many or too large " + PairNamePrefix + "* headers")
+	}
+	n.Pairs = pairsBytes
+	n.Flags |= FlagHasPairs
+	return nil
+}
+func (n *Needle) HasPairs() bool {
+	return n.Flags&FlagHasPairs > 0
+}
+func (n *Needle) HasLastModifiedDate() bool {
+	return n.Flags&FlagHasLastModifiedDate > 0
+}
+func (n *Needle) IsChunkManifest() bool {
+	return n.Flags&FlagIsChunkManifest > 0
+}
+func (n *Needle) GetPairs() (pairs map[string]string) {
+	if n.HasPairs() {
+		json.Unmarshal(n.Pairs, &pairs)
+	}
+	return
+}
 func (n *Needle) ParsePath(fid string) {
 	length := len(fid)
 	if length <= 8 {
@@ -79,33 +209,137 @@ func (n *Needle) ParsePath(fid string) {
 		}
 	}
 }
-func (n *Needle) Append(w io.Writer) uint32 {
+
+// Append writes the needle, and returns the size of its data and the first write error.
+func (n *Needle) Append(w io.Writer, version Version) (uint32, error) {
+	return n.AppendAligned(w, version, DefaultNeedleAlignment)
+}
+
+// AppendAligned writes the needle padded to the alignment of its volume.
+func (n *Needle) AppendAligned(w io.Writer, version Version, alignment int64) (uint32, error) {
+	var err error
+	write := func(b []byte) {
+		if err == nil {
+			_, err = w.Write(b)
+		}
+	}
 	header := make([]byte, 16)
 	util.Uint32toBytes(header[0:4], n.Cookie)
 	util.Uint64toBytes(header[4:12], n.Id)
-	n.Size = uint32(len(n.Data))
-	util.Uint32toBytes(header[12:16], n.Size)
-	w.Write(header)
-	w.Write(n.Data)
-	rest := 8 - ((n.Size + 16 + 4) % 8)
-	util.Uint32toBytes(header[0:4], n.Checksum.Value())
-	w.Write(header[0 : rest+4])
-	return n.Size
-}
-func (n *Needle) Read(r io.Reader, size uint32) (int, error) {
+	checksum := n.Checksum
+	if version == Version1 {
+		n.Size = uint32(len(n.Data))
+		util.Uint32toBytes(header[12:16], n.Size)
+		write(header)
+		write(n.Data)
+	} else {
+		n.DataSize, n.PairsSize = uint32(len(n.Data)), uint16(len(n.Pairs))
+		if n.PairsSize > 0 {
+			n.Flags |= FlagHasPairs
+		}
+		n.Size = 4 + n.DataSize + 1
+		if n.HasPairs() {
+			n.Size += 2 + uint32(n.PairsSize)
+		}
+		if n.HasLastModifiedDate() {
+			n.Size += 8
+		}
+		util.Uint32toBytes(header[12:16], n.Size)
+		write(header)
+		util.Uint32toBytes(header[0:4], n.DataSize)
+		write(header[0:4])
+		write(n.Data)
+		meta := n.meta()
+		write(meta)
+		checksum = checksum.Update(meta)
+	}
+	padded := make([]byte, alignedSize(n.Size, alignment)-16-int64(n.Size))
+	value := checksum.Value()
+	if util.Fault(util.FaultCorruptCrc) {
+		value = ^value
+	}
+	util.Uint32toBytes(padded[0:4], value)
+	write(padded)
+	return uint32(len(n.Data)), err
+}
+
+// meta returns the Flags, and the optional Pairs and LastModified, as written
+// after the Data in version2.
+func (n *Needle) meta() []byte {
+	meta := []byte{n.Flags}
+	if n.HasPairs() {
+		meta = append(meta, 0, 0)
+		util.Uint16toBytes(meta[1:3], n.PairsSize)
+		meta = append(meta, n.Pairs...)
+	}
+	if n.HasLastModifiedDate() {
+		lastModified := make([]byte, 8)
+		util.Uint64toBytes(lastModified, n.LastModified)
+		meta = append(meta, lastModified...)
+	}
+	return meta
+}
+
+func (n *Needle) Read(r io.Reader, size uint32, version Version) (int, error) {
 	bytes := make([]byte, size+16+4)
 	ret, e := r.Read(bytes)
 	n.Cookie = util.BytesToUint32(bytes[0:4])
 	n.Id = util.BytesToUint64(bytes[4:12])
 	n.Size = util.BytesToUint32(bytes[12:16])
-	n.Data = bytes[16 : 16+size]
-  checksum := util.BytesToUint32(bytes[16+size : 16+size+4])	
-	if checksum != NewCRC(n.Data).Value() {
-	  return 0, errors.New("CRC error! Data On Disk Corrupted!")
+	var meta []byte
+	if version == Version1 {
+		n.Data = bytes[16 : 16+size]
+	} else if err := n.readDataVersion2(bytes[16 : 16+size]); err != nil {
+		return 0, err
+	} else {
+		meta = bytes[16+4+n.DataSize : 16+size]
+	}
+	checksum := util.BytesToUint32(bytes[16+size : 16+size+4])
+	n.Checksum = NewCRC(n.Data)
+	if checksum != n.Checksum.Update(meta).Value() {
+		return 0, errors.New("CRC error! Data On Disk Corrupted!")
 	}
 	return ret, e
 }
-func ReadNeedle(r *os.File) (*Needle, uint32) {
+func (n *Needle) readDataVersion2(body []byte) error {
+	if len(body) < 5 {
+		return errors.New("Needle body too short! Data On Disk Corrupted!")
+	}
+	n.DataSize = util.BytesToUint32(body[0:4])
+	index := 4 + int(n.DataSize)
+	if index+1 > len(body) {
+		return errors.New("Needle data size error! Data On Disk Corrupted!")
+	}
+	n.Data = body[4:index]
+	n.Flags = body[index]
+	index++
+	if n.HasPairs() {
+		if index+2 > len(body) {
+			return errors.New("Needle pairs size error! Data On Disk Corrupted!")
+		}
+		n.PairsSize = util.BytesToUint16(body[index : index+2])
+		index += 2
+		if index+int(n.PairsSize) > len(body) {
+			return errors.New("Needle pairs size error! Data On Disk Corrupted!")
+		}
+		n.Pairs = body[index : index+int(n.PairsSize)]
+		index += int(n.PairsSize)
+	}
+	if n.HasLastModifiedDate() {
+		if index+8 > len(body) {
+			return errors.New("Needle last modified date error! Data On Disk Corrupted!")
+		}
+		n.LastModified = util.BytesToUint64(body[index : index+8])
+	}
+	return nil
+}
+func ReadNeedle(r io.ReadSeeker) (*Needle, uint32) {
+	return ReadAlignedNeedle(r, DefaultNeedleAlignment)
+}
+
+// ReadAlignedNeedle reads the header of the next needle of a volume of the
+// alignment, skips its data, and returns it with its size in the data file.
+func ReadAlignedNeedle(r io.ReadSeeker, alignment int64) (*Needle, uint32) {
 	n := new(Needle)
 	bytes := make([]byte, 16)
 	count, e := r.Read(bytes)
@@ -115,9 +349,9 @@ func ReadNeedle(r *os.File) (*Needle, uint32) {
 	n.Cookie = util.BytesToUint32(bytes[0:4])
 	n.Id = util.BytesToUint64(bytes[4:12])
 	n.Size = util.BytesToUint32(bytes[12:16])
-	rest := 8 - ((n.Size + 16 + 4) % 8)
-	r.Seek(int64(n.Size+4+rest), 1)
-	return n, 16 + n.Size + 4 + rest
+	length := alignedSize(n.Size, alignment)
+	r.Seek(length-16, 1)
+	return n, uint32(length)
 }
 func ParseKeyHash(key_hash_string string) (uint64, uint32) {
 	key_hash_bytes, khe := hex.DecodeString(key_hash_string)
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+	"strconv"
+)
+
+// DefaultNeedleAlignment is where the needles of a volume start: at multiples of
+// 8 bytes, the unit of the offsets in the index.
+const DefaultNeedleAlignment = 8
+
+// MaxNeedleAlignment is the largest alignment kept in the super block.
+const MaxNeedleAlignment = 1 << 16
+
+// needleAlignment is the alignment of the volumes created from now on, and of
+// the volumes compacted, which moves the existing volumes to it.
+var needleAlignment int64 = DefaultNeedleAlignment
+
+// SetNeedleAlignment aligns the needles of the volumes created or compacted from
+// now on, e.g. on 4096 bytes so that each needle starts on a page of an SSD.
+// Larger alignments waste more space padding the small files.
+func SetNeedleAlignment(alignment int64) error {
+	if alignment < DefaultNeedleAlignment || alignment > MaxNeedleAlignment || alignment&(alignment-1) != 0 {
+		return errors.New("The needle alignment is a power of 2 from " + strconv.Itoa(DefaultNeedleAlignment) + " to " + strconv.Itoa(MaxNeedleAlignment) + " bytes")
+	}
+	needleAlignment = alignment
+	return nil
+}
+
+// SuperBlockAlignment is the alignment kept in the super block, as a power of 2
+// in its 4th byte, 0 for the default of the volumes written before it was.
+func SuperBlockAlignment(header []byte) int64 {
+	if header[3] < 3 || header[3] > 16 {
+		return DefaultNeedleAlignment
+	}
+	return 1 << header[3]
+}
+
+func setSuperBlockAlignment(header []byte, alignment int64) {
+	header[3] = 0
+	if alignment > DefaultNeedleAlignment {
+		header[3] = byte(bits.TrailingZeros64(uint64(alignment)))
+	}
+}
+
+// DataStart is the offset of the first needle: the super block is padded to the
+// alignment.
+func DataStart(alignment int64) int64 {
+	if alignment > SuperBlockSize {
+		return alignment
+	}
+	return SuperBlockSize
+}
+
+// writeSuperBlock writes the super block, padded to the alignment it records.
+func writeSuperBlock(w io.Writer, header []byte, alignment int64) error {
+	setSuperBlockAlignment(header, alignment)
+	padded := make([]byte, DataStart(alignment))
+	copy(padded, header)
+	_, e := w.Write(padded)
+	return e
+}
+
+// alignedSize is the size a needle takes in the data file, with its header, its
+// checksum and the padding to the alignment, of at least 1 byte.
+func alignedSize(size uint32, alignment int64) int64 {
+	unpadded := 16 + int64(size) + 4
+	return unpadded + alignment - unpadded%alignment
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNeedleAlignment(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_alignment")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	defer SetNeedleAlignment(DefaultNeedleAlignment)
+
+	if e = SetNeedleAlignment(1000); e == nil {
+		t.Fatal("the alignment should be a power of 2")
+	}
+	if e = SetNeedleAlignment(4096); e != nil {
+		t.Fatal(e)
+	}
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	for i := uint64(1); i <= 4; i++ {
+		v.write(newTestNeedle(i))
+	}
+	v.delete(newTestNeedle(2), false)
+	for _, i := range []uint64{1, 3, 4} {
+		if nv, _ := v.nm.Get(i); int64(nv.Offset)*8%4096 != 0 {
+			t.Fatal("needle", i, "is not aligned at", int64(nv.Offset)*8)
+		}
+	}
+	if size := v.Size(); size != 5*4096 {
+		t.Fatal("expecting the padded super block and 4 pages, got", size)
+	}
+	v.Close()
+
+	// the alignment is kept in the super block, and changes with a compaction
+	SetNeedleAlignment(DefaultNeedleAlignment)
+	v = NewVolume(dir, "", VolumeId(1), CopyNil)
+	defer v.Close()
+	if v.alignment != 4096 || v.Size() != 5*4096 {
+		t.Fatal("the volume should stay aligned until compacted", v.alignment, v.Size())
+	}
+	if e = v.compact(); e != nil {
+		t.Fatal(e)
+	}
+	if v.alignment != DefaultNeedleAlignment || v.Size() >= 4096 {
+		t.Fatal("the compaction should move the volume to the default alignment", v.alignment, v.Size())
+	}
+	var scanned int
+	if e = v.scan(func(n *Needle) error { scanned++; return nil }); e != nil || scanned != 3 {
+		t.Fatal("expecting the 3 live needles, scanned", scanned, e)
+	}
+	for _, i := range []uint64{1, 3, 4} {
+		n := &Needle{Id: i}
+		if _, e = v.read(n); e != nil || string(n.Data) != string(newTestNeedle(i).Data) {
+			t.Fatal("needle", i, "read error:", e)
+		}
+	}
+}
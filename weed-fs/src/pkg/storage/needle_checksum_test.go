@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerifyContentChecksum(t *testing.T) {
+	data := []byte("hello, weed-fs")
+	md5sum, sha256sum := md5.Sum(data), sha256.Sum256(data)
+	contentMd5, contentSha256 := base64.StdEncoding.EncodeToString(md5sum[:]), hex.EncodeToString(sha256sum[:])
+	if e := verifyContentChecksum(data, "", ""); e != nil {
+		t.Error("without the headers", e)
+	}
+	if e := verifyContentChecksum(data, contentMd5, contentSha256); e != nil {
+		t.Error("with the right checksums", e)
+	}
+	corrupted := []byte("hello, weed-fS")
+	if e := verifyContentChecksum(corrupted, contentMd5, ""); e != ErrChecksumMismatch {
+		t.Error("a wrong Content-MD5 got", e)
+	}
+	if e := verifyContentChecksum(corrupted, "", contentSha256); e != ErrChecksumMismatch {
+		t.Error("a wrong X-Content-Sha256 got", e)
+	}
+	if e := verifyContentChecksum(data, contentMd5, hex.EncodeToString(md5sum[:])); e != ErrChecksumMismatch {
+		t.Error("a right Content-MD5 with a wrong X-Content-Sha256 got", e)
+	}
+	if e := verifyContentChecksum(data, "not base64!", ""); e == nil || e == ErrChecksumMismatch {
+		t.Error("an invalid Content-MD5 got", e)
+	}
+	if e := verifyContentChecksum(data, "", "not hex"); e == nil || e == ErrChecksumMismatch {
+		t.Error("an invalid X-Content-Sha256 got", e)
+	}
+}
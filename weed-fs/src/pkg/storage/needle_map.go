@@ -2,21 +2,24 @@ package storage
 
 import (
 	"log"
-	"os"
 	"pkg/util"
 )
 
 type NeedleMap struct {
-	indexFile *os.File
+	indexFile volumeFile
 	m         CompactMap
 
 	//transient
-	bytes           []byte
-	deletionCounter int
-	fileCounter     int
+	bytes               []byte
+	deletionCounter     int
+	fileCounter         int
+	fileByteCounter     uint64
+	deletionByteCounter uint64
+	lastOffset          uint32 // of the needle furthest in the data file of the index, and its size
+	lastSize            uint32
 }
 
-func NewNeedleMap(file *os.File) *NeedleMap {
+func NewNeedleMap(file volumeFile) *NeedleMap {
 	nm := &NeedleMap{
 		m:         NewCompactMap(),
 		bytes:     make([]byte, 16),
@@ -29,7 +32,7 @@ const (
 	RowsToRead = 1024
 )
 
-func LoadNeedleMap(file *os.File) *NeedleMap {
+func LoadNeedleMap(file volumeFile) *NeedleMap {
 	nm := NewNeedleMap(file)
 	bytes := make([]byte, 16*RowsToRead)
 	count, e := nm.indexFile.Read(bytes)
@@ -38,13 +41,19 @@ func LoadNeedleMap(file *os.File) *NeedleMap {
 		log.Println("Loading index file", fstat.Name(), "size", fstat.Size())
 	}
 	for count > 0 && e == nil {
-		for i := 0; i < count; i += 16 {
+		// a row cut short by a crash is dropped, see Volume.checkDataTail
+		for i := 0; i+16 <= count; i += 16 {
 			key := util.BytesToUint64(bytes[i : i+8])
 			offset := util.BytesToUint32(bytes[i+8 : i+12])
 			size := util.BytesToUint32(bytes[i+12 : i+16])
+			if oldValue, ok := nm.m.Get(Key(key)); ok && oldValue.Size > 0 {
+				nm.deletionByteCounter += uint64(oldValue.Size)
+			}
 			if offset > 0 {
+				nm.indexed(offset, size)
 				nm.m.Set(Key(key), offset, size)
 				nm.fileCounter++
+				nm.fileByteCounter += uint64(size)
 			} else {
 				nm.m.Delete(Key(key))
 				nm.deletionCounter++
@@ -57,18 +66,33 @@ func LoadNeedleMap(file *os.File) *NeedleMap {
 }
 
 func (nm *NeedleMap) Put(key uint64, offset uint32, size uint32) (int, error) {
+	if oldValue, ok := nm.m.Get(Key(key)); ok && oldValue.Size > 0 {
+		nm.deletionByteCounter += uint64(oldValue.Size)
+	}
+	nm.indexed(offset, size)
 	nm.m.Set(Key(key), offset, size)
 	util.Uint64toBytes(nm.bytes[0:8], key)
 	util.Uint32toBytes(nm.bytes[8:12], offset)
 	util.Uint32toBytes(nm.bytes[12:16], size)
 	nm.fileCounter++
+	nm.fileByteCounter += uint64(size)
 	return nm.indexFile.Write(nm.bytes)
 }
+
+// indexed keeps the needle at offset if it is the furthest of the index.
+func (nm *NeedleMap) indexed(offset uint32, size uint32) {
+	if offset >= nm.lastOffset {
+		nm.lastOffset, nm.lastSize = offset, size
+	}
+}
 func (nm *NeedleMap) Get(key uint64) (element *NeedleValue, ok bool) {
 	element, ok = nm.m.Get(Key(key))
 	return
 }
 func (nm *NeedleMap) Delete(key uint64) {
+	if oldValue, ok := nm.m.Get(Key(key)); ok && oldValue.Size > 0 {
+		nm.deletionByteCounter += uint64(oldValue.Size)
+	}
 	nm.m.Delete(Key(key))
 	util.Uint64toBytes(nm.bytes[0:8], key)
 	util.Uint32toBytes(nm.bytes[8:12], 0)
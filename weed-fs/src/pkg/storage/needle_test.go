@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestNeedleAppendRead(t *testing.T) {
+	for _, version := range []Version{Version1, Version2} {
+		n := newTestNeedle(3)
+		buf := new(bytes.Buffer)
+		if size, e := n.Append(buf, version); e != nil || size != uint32(len(n.Data)) {
+			t.Fatal("version", version, "appended data size", size, "error", e)
+		}
+		if buf.Len()%8 != 0 {
+			t.Fatal("version", version, "needle is not aligned to 8 bytes:", buf.Len())
+		}
+		m := new(Needle)
+		if _, e := m.Read(buf, n.Size, version); e != nil {
+			t.Fatal("version", version, "read error:", e)
+		}
+		if m.Id != n.Id || m.Cookie != n.Cookie || string(m.Data) != string(n.Data) {
+			t.Fatal("version", version, "read back a different needle", m)
+		}
+	}
+}
+
+func TestNeedlePairs(t *testing.T) {
+	n := newTestNeedle(5)
+	header := make(http.Header)
+	header.Set("X-Weed-Meta-Owner", "chris")
+	header.Set("X-Weed-Meta-Source", "camera")
+	header.Set("Content-Type", "image/jpeg")
+	if e := n.parsePairs(header); e != nil {
+		t.Fatal(e)
+	}
+	n.LastModified = 1380000000
+	n.Flags |= FlagHasLastModifiedDate
+	buf := new(bytes.Buffer)
+	n.Append(buf, Version2)
+	m := new(Needle)
+	if _, e := m.Read(buf, n.Size, Version2); e != nil {
+		t.Fatal("read error:", e)
+	}
+	pairs := m.GetPairs()
+	if len(pairs) != 2 || pairs["Owner"] != "chris" || pairs["Source"] != "camera" {
+		t.Fatal("unexpected pairs", pairs)
+	}
+	if string(m.Data) != string(n.Data) {
+		t.Fatal("unexpected data", string(m.Data))
+	}
+	if !m.HasLastModifiedDate() || m.LastModified != n.LastModified {
+		t.Fatal("unexpected last modified", m.LastModified)
+	}
+}
+
+func TestNeedleChecksumCoversPairs(t *testing.T) {
+	n := newTestNeedle(7)
+	header := make(http.Header)
+	header.Set("X-Weed-Meta-Owner", "chris")
+	if e := n.parsePairs(header); e != nil {
+		t.Fatal(e)
+	}
+	n.LastModified = 1380000000
+	n.Flags |= FlagHasLastModifiedDate
+	buf := new(bytes.Buffer)
+	n.Append(buf, Version2)
+	owner := bytes.Index(buf.Bytes(), []byte("chris"))
+	lastModified := 16 + int(n.Size) - 1
+	for _, i := range []int{owner, lastModified} {
+		stored := append([]byte(nil), buf.Bytes()...)
+		stored[i] ^= 1
+		if _, e := new(Needle).Read(bytes.NewReader(stored), n.Size, Version2); e == nil {
+			t.Fatal("read a needle with a changed byte at", i)
+		}
+	}
+}
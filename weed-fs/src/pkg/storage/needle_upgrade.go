@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"errors"
+	"log"
+	"strconv"
+)
+
+// needleUpgrades convert a needle read in a version into the next version.
+// A new needle version adds its conversion here, so that the volumes of the
+// older versions keep being read and written in their own version, and are
+// upgraded one at a time with /admin/upgrade_volume, instead of all at once.
+var needleUpgrades = map[Version]func(n *Needle) error{
+	// version 2 adds the data size, the flags, and the optional pairs and last
+	// modified date, all computed by Append from the data
+	Version1: func(n *Needle) error {
+		n.Flags, n.Pairs = 0, nil
+		return nil
+	},
+}
+
+// upgradeNeedle converts the needle, as read in the version from, into the version to.
+func upgradeNeedle(n *Needle, from, to Version) error {
+	for version := from; version < to; version++ {
+		upgrade, ok := needleUpgrades[version]
+		if !ok {
+			return errors.New("No upgrade of needle version " + strconv.Itoa(int(version)))
+		}
+		if err := upgrade(n); err != nil {
+			return err
+		}
+	}
+	n.Checksum = NewCRC(n.Data)
+	return nil
+}
+
+// upgrade rewrites the volume in the current needle version, like a compaction.
+func (v *Volume) upgrade() error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	from := v.version
+	if from >= CurrentVersion {
+		return nil
+	}
+	err := v.rewrite(CurrentVersion, func(n *Needle, offset int64) (*Needle, error) {
+		return n, upgradeNeedle(n, from, CurrentVersion)
+	})
+	if err == nil {
+		log.Println("Upgraded volume", v.Id, "from needle version", from, "to", CurrentVersion)
+	}
+	return err
+}
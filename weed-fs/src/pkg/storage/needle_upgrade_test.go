@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestUpgradeVolume(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_upgrade")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	// a volume of version 1, as written by an older weed-fs
+	repType := Copy000
+	header := make([]byte, SuperBlockSize)
+	header[0], header[1] = byte(Version1), repType.Byte()
+	if e = ioutil.WriteFile(path.Join(dir, "1.dat"), header, 0644); e != nil {
+		t.Fatal(e)
+	}
+	v := NewVolume(dir, "", VolumeId(1), CopyNil)
+	defer v.Close()
+	if v.version != Version1 {
+		t.Fatal("expecting version 1, got", v.version)
+	}
+	for i := uint64(1); i <= 4; i++ {
+		v.write(newTestNeedle(i))
+	}
+	v.delete(newTestNeedle(2), false)
+
+	if e = v.upgrade(); e != nil {
+		t.Fatal("upgrade error:", e)
+	}
+	if v.version != CurrentVersion || v.volumeInfo().Version != CurrentVersion {
+		t.Fatal("expecting the current version, got", v.version)
+	}
+	for i := uint64(1); i <= 4; i++ {
+		n := &Needle{Id: i}
+		_, e := v.read(n)
+		if i == 2 {
+			if e == nil {
+				t.Fatal("needle 2 should stay deleted")
+			}
+			continue
+		}
+		if e != nil || string(n.Data) != string(newTestNeedle(i).Data) {
+			t.Fatal("needle", i, "read after the upgrade:", string(n.Data), e)
+		}
+	}
+	// the new needles are written in the current version, with their last modified date
+	n := newTestNeedle(5)
+	n.LastModified, n.Flags = 1500000000, FlagHasLastModifiedDate
+	v.write(n)
+	n = &Needle{Id: 5}
+	if _, e = v.read(n); e != nil || n.LastModified != 1500000000 {
+		t.Fatal("needle 5 after the upgrade:", n.LastModified, e)
+	}
+	v.Close()
+	v = NewVolume(dir, "", VolumeId(1), CopyNil)
+	if v.version != CurrentVersion {
+		t.Fatal("the super block should keep the current version, got", v.version)
+	}
+}
+
+func TestSkipNewerVolumeVersion(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_upgrade")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	repType := Copy000
+	header := make([]byte, SuperBlockSize)
+	header[0], header[1] = byte(CurrentVersion+1), repType.Byte()
+	ioutil.WriteFile(path.Join(dir, "7.dat"), header, 0644)
+	ioutil.WriteFile(path.Join(dir, "7.idx"), nil, 0644)
+	l := NewDiskLocation(dir, 10)
+	l.loadExistingVolumes(func(VolumeId) bool { return false })
+	if len(l.volumes) != 0 {
+		t.Fatal("a volume of a newer needle version should not be loaded")
+	}
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"pkg/util"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxPartialUploadSize is the largest file written in ranges, which is held in
+// memory, with its compressed copy, when it is stored as a needle.
+const MaxPartialUploadSize = 256 << 20
+
+var ErrPartialUploadNotFound = errors.New("No file created with its size for this file id")
+
+// PartialUpload is a file created with its size, and written in ranges, in any
+// order and over several connections, e.g. by parallel uploaders or torrent
+// style fetchers. It is stored as one needle once all its ranges are written.
+type PartialUpload struct {
+	Fid      string            // vid,key_cookie of the file
+	Size     int64             // of the file, in bytes
+	Filename string            // compresses the file by its extension, like an upload's file name
+	Mime     string            `json:",omitempty"` // the Content-Type of the creation
+	Pairs    map[string]string `json:",omitempty"` // the X-Weed-Meta-* headers of the creation
+	Created  int64             // unix time
+	Received [][2]int64        // the ranges written, [start, end), sorted and merged
+
+	storing bool // the needle is being written, until Stored or Release
+}
+
+// Missing lists the ranges not written yet, [start, end).
+func (u *PartialUpload) Missing() [][2]int64 {
+	missing := [][2]int64{}
+	start := int64(0)
+	for _, r := range u.Received {
+		if r[0] > start {
+			missing = append(missing, [2]int64{start, r[0]})
+		}
+		start = r[1]
+	}
+	if start < u.Size {
+		missing = append(missing, [2]int64{start, u.Size})
+	}
+	return missing
+}
+
+func (u *PartialUpload) Complete() bool {
+	return len(u.Received) == 1 && u.Received[0] == [2]int64{0, u.Size}
+}
+
+// snapshot copies the upload, to be read without holding the lock.
+func (u *PartialUpload) snapshot() *PartialUpload {
+	s := *u
+	s.Received = append([][2]int64(nil), u.Received...)
+	return &s
+}
+
+// receive adds the range to the received ones, keeping them sorted and merged.
+func (u *PartialUpload) receive(start, end int64) {
+	ranges := append(u.Received, [2]int64{start, end})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		if last := &merged[len(merged)-1]; r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	u.Received = merged
+}
+
+// PartialUploads keeps the partial uploads of a volume server in a folder, with
+// a spool file of the size of the file and a json record for each, so they
+// survive restarts.
+type PartialUploads struct {
+	dir     string
+	lock    sync.Mutex
+	uploads map[string]*PartialUpload
+}
+
+func NewPartialUploads(dir string) (*PartialUploads, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	p := &PartialUploads{dir: dir, uploads: make(map[string]*PartialUpload)}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		u := new(PartialUpload)
+		data, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+		if err == nil {
+			err = json.Unmarshal(data, u)
+		}
+		if err != nil {
+			log.Println("Skipping broken partial upload", f.Name(), ":", err)
+			continue
+		}
+		p.uploads[u.Fid] = u
+	}
+	return p, nil
+}
+
+func (p *PartialUploads) fileName(fid string) string {
+	return path.Join(p.dir, strings.Replace(fid, ",", "_", 1))
+}
+
+// save writes the record of the upload. The caller holds the lock.
+func (p *PartialUploads) save(u *PartialUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	fileName := p.fileName(u.Fid) + ".json"
+	if err = ioutil.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// Create starts the upload of a file of the size. The file name and the content
+// type are checked against the upload policy of the collection, like an upload's.
+func (p *PartialUploads) Create(fid string, size int64, filename string, header http.Header, policy *UploadPolicy) (*PartialUpload, error) {
+	if size <= 0 || size > MaxPartialUploadSize {
+		return nil, errors.New("The size of a file written in ranges is from 1 to " + strconv.Itoa(MaxPartialUploadSize) + " bytes")
+	}
+	if err := policy.checkSize(size); err != nil {
+		return nil, err
+	}
+	if err := policy.checkContentType(header.Get("Content-Type"), filename); err != nil {
+		return nil, err
+	}
+	u := &PartialUpload{Fid: fid, Size: size, Filename: filename, Mime: header.Get("Content-Type"), Created: time.Now().Unix()}
+	for name, values := range header {
+		if strings.HasPrefix(name, PairNamePrefix) && len(name) > len(PairNamePrefix) {
+			if u.Pairs == nil {
+				u.Pairs = make(map[string]string)
+			}
+			u.Pairs[name] = values[0]
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.uploads[fid]; ok {
+		return nil, errors.New("The file " + fid + " is being written in ranges already")
+	}
+	f, err := os.OpenFile(p.fileName(fid)+".part", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(size)
+	if ce := f.Close(); err == nil {
+		err = ce
+	}
+	if err == nil {
+		err = p.save(u)
+	}
+	if err != nil {
+		os.Remove(p.fileName(fid) + ".part")
+		return nil, err
+	}
+	p.uploads[fid] = u
+	return u.snapshot(), nil
+}
+
+// Write writes the range of the file at start, of length bytes read from r, and
+// returns the upload as it is after it. total is the size of the file the client
+// expects, -1 if it did not tell.
+func (p *PartialUploads) Write(fid string, start int64, length int64, total int64, r io.Reader) (*PartialUpload, error) {
+	p.lock.Lock()
+	u, ok := p.uploads[fid]
+	var size int64
+	if ok {
+		size = u.Size
+	}
+	p.lock.Unlock()
+	if !ok {
+		return nil, ErrPartialUploadNotFound
+	}
+	if total >= 0 && total != size {
+		return nil, errors.New("The file was created with " + strconv.FormatInt(size, 10) + " bytes, not " + strconv.FormatInt(total, 10))
+	}
+	if start < 0 || length <= 0 || start+length > size {
+		return nil, errors.New("The range is not within the " + strconv.FormatInt(size, 10) + " bytes of the file")
+	}
+	// the range is copied as it is read, a short body leaves it not received
+	f, err := os.OpenFile(p.fileName(fid)+".part", os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.CopyN(io.NewOffsetWriter(f, start), r, length); err == nil {
+		err = util.Fsync(f)
+	}
+	if ce := f.Close(); err == nil {
+		err = ce
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if u, ok = p.uploads[fid]; !ok {
+		return nil, ErrPartialUploadNotFound
+	}
+	u.receive(start, start+length)
+	if err = p.save(u); err != nil {
+		return nil, err
+	}
+	return u.snapshot(), nil
+}
+
+// Store returns the needle of the complete upload, to be written to its volume,
+// after which Stored drops the upload, or Release lets it be stored again. Only
+// one caller gets the needle at a time.
+func (p *PartialUploads) Store(fid string) (*Needle, error) {
+	p.lock.Lock()
+	u, ok := p.uploads[fid]
+	if ok && (u.storing || !u.Complete()) {
+		ok = false
+	}
+	if ok {
+		u.storing = true
+	}
+	p.lock.Unlock()
+	if !ok {
+		return nil, errors.New("The file " + fid + " is not complete, or is being stored already")
+	}
+	data, err := ioutil.ReadFile(p.fileName(fid) + ".part")
+	if err != nil {
+		p.Release(fid)
+		return nil, err
+	}
+	if dotIndex := strings.LastIndex(u.Filename, "."); dotIndex > 0 {
+		ext := u.Filename[dotIndex:]
+		if IsCompressable(ext, mime.TypeByExtension(ext)) {
+			data = GzipData(data)
+		}
+	}
+	n := &Needle{Data: data, Checksum: NewCRC(data), Mime: u.Mime}
+	header := make(http.Header)
+	for name, value := range u.Pairs {
+		header.Set(name, value)
+	}
+	if err = n.parsePairs(header); err != nil {
+		p.Release(fid)
+		return nil, err
+	}
+	n.LastModified = uint64(time.Now().Unix())
+	n.Flags |= FlagHasLastModifiedDate
+	n.ParsePath(fid[strings.Index(fid, ",")+1:])
+	return n, nil
+}
+
+// Release lets the upload be stored again, after writing its needle failed.
+func (p *PartialUploads) Release(fid string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if u, ok := p.uploads[fid]; ok {
+		u.storing = false
+	}
+}
+
+// Stored drops the upload, once its needle is written.
+func (p *PartialUploads) Stored(fid string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.remove(fid)
+}
+
+func (p *PartialUploads) remove(fid string) {
+	delete(p.uploads, fid)
+	os.Remove(p.fileName(fid) + ".part")
+	os.Remove(p.fileName(fid) + ".json")
+}
+
+// Purge drops the uploads created before the unix time and not stored, and
+// returns how many.
+func (p *PartialUploads) Purge(before int64) (count int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for fid, u := range p.uploads {
+		if u.Created < before && !u.storing {
+			p.remove(fid)
+			count++
+		}
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestPartialUploads(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_partial")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	p, e := NewPartialUploads(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	fid := "3,01637037d6"
+	header := http.Header{"X-Weed-Meta-Owner": {"alice"}}
+	if _, e = p.Create(fid, 10, "data.jpg", header, NewUploadPolicy(5, "")); e == nil {
+		t.Fatal("the upload policy should apply to the size")
+	}
+	if _, e = p.Create(fid, MaxPartialUploadSize+1, "data.jpg", header, nil); e == nil {
+		t.Fatal("a file larger than", MaxPartialUploadSize, "should be refused")
+	}
+	if _, e = p.Create(fid, 10, "data.jpg", header, nil); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = p.Create(fid, 10, "data.jpg", header, nil); e == nil {
+		t.Fatal("a file should only be created once")
+	}
+	if _, e = p.Write(fid, 8, 4, -1, bytes.NewReader([]byte("89ab"))); e == nil {
+		t.Fatal("a range past the size should be refused")
+	}
+	if _, e = p.Write(fid, 0, 2, 12, bytes.NewReader([]byte("01"))); e == nil {
+		t.Fatal("a range of another size should be refused")
+	}
+	if u, e := p.Write(fid, 0, 6, 10, bytes.NewReader([]byte("01"))); e == nil {
+		t.Fatal("a range with a short body should be refused, got", u)
+	}
+	u, e := p.Write(fid, 6, 4, 10, bytes.NewReader([]byte("6789")))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if missing := u.Missing(); len(missing) != 1 || missing[0] != [2]int64{0, 6} {
+		t.Fatal("unexpected missing ranges", missing)
+	}
+	if _, e = p.Store(fid); e == nil {
+		t.Fatal("an incomplete file should not be stored")
+	}
+
+	// the uploads survive restarts
+	if p, e = NewPartialUploads(dir); e != nil {
+		t.Fatal(e)
+	}
+	p.Write(fid, 0, 3, 10, bytes.NewReader([]byte("012")))
+	if u, e = p.Write(fid, 2, 4, 10, bytes.NewReader([]byte("2345"))); e != nil || !u.Complete() {
+		t.Fatal("the file should be complete", u, e)
+	}
+	n, e := p.Store(fid)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = p.Store(fid); e == nil {
+		t.Fatal("the file should only be stored once at a time")
+	}
+	if string(n.Data) != "0123456789" || n.Id != 1 || n.Cookie != 0x637037d6 || n.GetPairs()["Owner"] != "alice" {
+		t.Fatal("unexpected needle", string(n.Data), n.Id, n.Cookie, n.GetPairs())
+	}
+	p.Release(fid)
+	if _, e = p.Store(fid); e != nil {
+		t.Fatal("a released file should be stored again", e)
+	}
+	p.Stored(fid)
+	if _, e = p.Write(fid, 0, 1, 10, bytes.NewReader([]byte("0"))); e != ErrPartialUploadNotFound {
+		t.Fatal("a stored file should be dropped", e)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatal("the spool files should be removed", len(files))
+	}
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the data files are read from the remote tier by blocks of this size
+	RemoteBlockSize    = 1024 * 1024
+	remoteAttempts     = 3
+	remoteBlockTimeout = 30 * time.Second
+)
+
+// the data files are uploaded by parts of this size
+var remotePartSize int64 = 64 * 1024 * 1024
+
+// RemoteTier keeps the data files of the volumes offloaded to it in an S3
+// bucket, or any storage speaking the S3 api. The sealed volumes are offloaded
+// whole, and read by ranges from then on, through a cache of the blocks read
+// last, while their index stays on the volume server.
+type RemoteTier struct {
+	endpoint  string // scheme://host:port
+	bucket    string
+	prefix    string // of the object keys
+	region    string
+	accessKey string
+	secretKey string
+
+	client         *http.Client // for the blocks
+	transferClient *http.Client // for the whole data files, with no overall timeout
+	blocks         *util.LRUCache
+	flight         util.SingleFlight // the blocks being read, shared by the reads of the same block
+
+	gets, getBytes int64 // the blocks read from the bucket, updated atomically
+}
+
+// remoteTier is where the volumes are offloaded, nil if the server has none.
+var remoteTier *RemoteTier
+
+// NewRemoteTier takes the url of the bucket, e.g.
+// s3://accessKey:secretKey@s3.amazonaws.com/bucket/prefix?region=us-east-1, or
+// s3+http://... for an endpoint without TLS, and keeps up to cacheSize bytes of
+// the blocks read in memory.
+func NewRemoteTier(tierUrl string, cacheSize int64) (*RemoteTier, error) {
+	u, err := url.Parse(tierUrl)
+	if err != nil {
+		return nil, err
+	}
+	scheme := map[string]string{"s3": "https", "s3+http": "http"}[u.Scheme]
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if scheme == "" || u.Host == "" || parts[0] == "" || u.User == nil {
+		return nil, errors.New("Unsupported remote tier " + tierUrl + ", expecting s3://accessKey:secretKey@host/bucket/prefix?region=us-east-1")
+	}
+	t := &RemoteTier{endpoint: scheme + "://" + u.Host, bucket: parts[0], region: u.Query().Get("region"), accessKey: u.User.Username()}
+	t.secretKey, _ = u.User.Password()
+	if len(parts) > 1 && parts[1] != "" {
+		t.prefix = strings.TrimSuffix(parts[1], "/") + "/"
+	}
+	if t.region == "" {
+		t.region = "us-east-1"
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		ResponseHeaderTimeout: remoteBlockTimeout,
+		MaxIdleConnsPerHost:   16,
+	}
+	t.client = &http.Client{Transport: transport, Timeout: remoteBlockTimeout}
+	t.transferClient = &http.Client{Transport: transport}
+	t.blocks = util.NewLRUCache(cacheSize)
+	return t, nil
+}
+
+// SetRemoteTier makes the volumes offload their data files to the tier. It is
+// set before the volumes are loaded, which fail to load without it once offloaded.
+func SetRemoteTier(tier *RemoteTier) {
+	remoteTier = tier
+}
+
+func (t *RemoteTier) ToMap() map[string]interface{} {
+	m := t.blocks.ToMap()
+	m["Bucket"] = t.bucket
+	m["RemoteReads"] = atomic.LoadInt64(&t.gets)
+	m["RemoteReadBytes"] = atomic.LoadInt64(&t.getBytes)
+	m["Flight"] = t.flight.ToMap()
+	return m
+}
+
+// do sends the signed request for the object key, with the query, and returns
+// the response if it has one of the expected statuses.
+func (t *RemoteTier) do(client *http.Client, method string, key string, query string, header http.Header, body io.Reader, size int64, expected ...int) (*http.Response, error) {
+	objectUrl := t.endpoint + "/" + t.bucket + "/" + (&url.URL{Path: t.prefix + key}).EscapedPath()
+	if query != "" {
+		objectUrl += "?" + query
+	}
+	r, err := http.NewRequest(method, objectUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	if body != nil {
+		r.ContentLength = size
+	}
+	util.SignAwsV4(r, t.accessKey, t.secretKey, t.region, "s3", time.Now())
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	return nil, errors.New(method + " " + t.bucket + "/" + t.prefix + key + ": " + resp.Status + " " + string(message))
+}
+
+// upload puts the first size bytes of the file as the object key, in parts if
+// it is larger than one.
+func (t *RemoteTier) upload(key string, file io.ReaderAt, size int64) error {
+	if size <= remotePartSize {
+		resp, err := t.do(t.transferClient, "PUT", key, "", nil, io.NewSectionReader(file, 0, size), size, http.StatusOK)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	resp, err := t.do(t.client, "POST", key, "uploads=", nil, nil, 0, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	uploadQuery := "uploadId=" + url.QueryEscape(initiated.UploadId)
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var completed struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for offset := int64(0); offset < size && err == nil; offset += remotePartSize {
+		number, partSize := len(completed.Parts)+1, size-offset
+		if partSize > remotePartSize {
+			partSize = remotePartSize
+		}
+		query := "partNumber=" + strconv.Itoa(number) + "&" + uploadQuery
+		if resp, err = t.do(t.transferClient, "PUT", key, query, nil, io.NewSectionReader(file, offset, partSize), partSize, http.StatusOK); err == nil {
+			resp.Body.Close()
+			completed.Parts = append(completed.Parts, part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		}
+	}
+	var body []byte
+	if err == nil {
+		body, err = xml.Marshal(completed)
+	}
+	if err == nil {
+		if resp, err = t.do(t.client, "POST", key, uploadQuery, nil, bytes.NewReader(body), int64(len(body)), http.StatusOK); err == nil {
+			// the completion can still fail after its 200
+			answer, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if bytes.Contains(answer, []byte("<Error>")) {
+				err = errors.New("Completing the upload of " + key + " failed: " + string(answer))
+			}
+		}
+	}
+	if err != nil {
+		if resp, abortErr := t.do(t.client, "DELETE", key, uploadQuery, nil, nil, 0, http.StatusNoContent, http.StatusOK); abortErr == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+// download copies the object key to w.
+func (t *RemoteTier) download(key string, w io.Writer) error {
+	resp, err := t.do(t.transferClient, "GET", key, "", nil, nil, 0, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (t *RemoteTier) remove(key string) error {
+	resp, err := t.do(t.client, "DELETE", key, "", nil, nil, 0, http.StatusNoContent, http.StatusOK)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// block returns the block at index of the object key of the size, from the
+// cache, or else read from the bucket, and cached.
+func (t *RemoteTier) block(key string, size int64, index int64) ([]byte, error) {
+	cacheKey := key + "/" + strconv.FormatInt(index, 10)
+	if cached, ok := t.blocks.Get(cacheKey); ok {
+		return cached.([]byte), nil
+	}
+	value, _, err := t.flight.Do(cacheKey, func() (interface{}, error) {
+		start, end := index*RemoteBlockSize, (index+1)*RemoteBlockSize
+		if end > size {
+			end = size
+		}
+		header := http.Header{"Range": {"bytes=" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end-1, 10)}}
+		var err error
+		for attempt := 0; attempt < remoteAttempts; attempt++ {
+			var resp *http.Response
+			if resp, err = t.do(t.client, "GET", key, "", header, nil, 0, http.StatusPartialContent); err != nil {
+				continue
+			}
+			data := make([]byte, end-start)
+			_, err = io.ReadFull(resp.Body, data)
+			resp.Body.Close()
+			if err == nil {
+				atomic.AddInt64(&t.gets, 1)
+				atomic.AddInt64(&t.getBytes, end-start)
+				t.blocks.Set(cacheKey, data, end-start)
+				return data, nil
+			}
+		}
+		return nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]byte), nil
+}
+
+// drop forgets the cached blocks of the object key of the size.
+func (t *RemoteTier) drop(key string, size int64) {
+	for index := int64(0); index*RemoteBlockSize < size; index++ {
+		t.blocks.Delete(key + "/" + strconv.FormatInt(index, 10))
+	}
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 keeps the objects of one bucket in memory, checking the signature of
+// each request, for the requests of the RemoteTier.
+type fakeS3 struct {
+	t       *testing.T
+	lock    sync.Mutex
+	objects map[string][]byte
+	parts   map[string]map[int][]byte // upload id => part number => content
+	gets    int
+}
+
+func startFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{t: t, objects: make(map[string][]byte), parts: make(map[string]map[int][]byte)}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	amzDate := r.Header.Get("X-Amz-Date")
+	signature := util.AwsV4Signature(r, []string{"host", "x-amz-content-sha256", "x-amz-date"}, r.Header.Get("X-Amz-Content-Sha256"), "secret", amzDate, "eu-west-1", "s3")
+	if !strings.HasSuffix(r.Header.Get("Authorization"), "Signature="+signature) {
+		f.t.Error("unexpected signature of", r.Method, r.URL, r.Header)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key, query := r.URL.Path, r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == "POST" && query.Has("uploads"):
+		id := strconv.Itoa(len(f.parts) + 1)
+		f.parts[id] = make(map[int][]byte)
+		w.Write([]byte("<InitiateMultipartUploadResult><UploadId>" + id + "</UploadId></InitiateMultipartUploadResult>"))
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.parts[query.Get("uploadId")][number] = body
+		w.Header().Set("ETag", `"`+strconv.Itoa(number)+`"`)
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		var completed struct {
+			Part []struct {
+				PartNumber int
+				ETag       string
+			}
+		}
+		xml.Unmarshal(body, &completed)
+		var content []byte
+		for i, part := range completed.Part {
+			if part.PartNumber != i+1 || part.ETag != `"`+strconv.Itoa(i+1)+`"` {
+				f.t.Error("unexpected part", part)
+			}
+			content = append(content, f.parts[query.Get("uploadId")][part.PartNumber]...)
+		}
+		f.objects[key] = content
+		delete(f.parts, query.Get("uploadId"))
+	case r.Method == "PUT":
+		f.objects[key] = body
+	case r.Method == "GET":
+		content, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.gets++
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestOffloadVolume(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_offload")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	s3, server := startFakeS3(t)
+	defer server.Close()
+	tier, e := NewRemoteTier("s3+http://AKID:secret@"+server.Listener.Addr().String()+"/bucket/volumes?region=eu-west-1", 1024*1024)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer SetRemoteTier(remoteTier)
+	SetRemoteTier(tier)
+	defer func(size int64) { remotePartSize = size }(remotePartSize)
+	remotePartSize = 100
+
+	v := NewVolume(dir, "pics", VolumeId(1), Copy000)
+	for id := uint64(1); id <= 5; id++ {
+		v.write(newTestNeedle(id))
+	}
+	if e = v.offload(); e == nil {
+		t.Fatal("a growing volume should not be offloaded")
+	}
+	v.SetState(VolumeSealed)
+	size := v.Size()
+	if e = v.offload(); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = os.Stat(path.Join(dir, "pics_1.dat")); !os.IsNotExist(e) || !v.Offloaded() || v.Size() != size ||
+		int64(len(s3.objects["/bucket/volumes/pics_1.dat"])) != size {
+		t.Fatal("the data file should be offloaded", e, v.Offloaded(), v.Size(), len(s3.objects["/bucket/volumes/pics_1.dat"]))
+	}
+
+	for _, id := range []uint64{1, 5, 1} {
+		n := newTestNeedle(id)
+		if _, e = v.read(n); e != nil || string(n.Data) != string(newTestNeedle(id).Data) {
+			t.Fatal("unexpected needle", id, string(n.Data), e)
+		}
+	}
+	if stats := tier.ToMap(); s3.gets != 1 || stats["Hits"].(int64) != 2 || stats["RemoteReads"].(int64) != 1 {
+		t.Error("the block should be read once, and then from the cache", s3.gets, stats)
+	}
+	if _, e = v.write(newTestNeedle(6)); e == nil {
+		t.Error("an offloaded volume should not be written")
+	}
+	if e = v.SetState(VolumeGrowing); e == nil {
+		t.Error("an offloaded volume should stay sealed")
+	}
+	if e = v.compact(); e == nil {
+		t.Error("an offloaded volume should not be compacted")
+	}
+	if v.delete(newTestNeedle(2), false) == 0 {
+		t.Error("the needles of an offloaded volume should be deleted from its index")
+	}
+	v.Close()
+
+	// loaded again from its .remote file
+	v = NewVolume(dir, "pics", VolumeId(1), CopyNil)
+	if !v.Offloaded() || v.State() != VolumeSealed {
+		t.Fatal("the volume should be loaded offloaded and sealed", v.Offloaded(), v.State())
+	}
+	if e = v.recall(); e != nil {
+		t.Fatal(e)
+	}
+	defer v.Close()
+	if _, e = os.Stat(path.Join(dir, "pics_1.remote")); !os.IsNotExist(e) || v.Offloaded() || len(s3.objects) != 0 {
+		t.Fatal("the volume should be recalled", e, v.Offloaded(), len(s3.objects))
+	}
+	if _, e = v.read(newTestNeedle(2)); e == nil {
+		t.Error("needle 2 was deleted")
+	}
+	if e = v.SetState(VolumeGrowing); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = v.write(newTestNeedle(6)); e != nil {
+		t.Error("a recalled volume should be written again", e)
+	}
+}
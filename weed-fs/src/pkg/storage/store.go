@@ -3,32 +3,71 @@ package storage
 import (
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"log"
 	"net/url"
+	"path"
 	"pkg/util"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Store struct {
-	volumes        map[VolumeId]*Volume
-	dir            string
-	Port           int
-	Ip             string
-	PublicUrl      string
-	MaxVolumeCount int
+	locations []*DiskLocation
+	// guards the volumes of the locations, which change when volumes are added or deleted, or when a directory fails
+	lock      sync.RWMutex
+	Port      int
+	AdminPort int // of the /admin/ api, when it is served apart from Port, else 0
+	GrpcPort  int // of the Volume gRPC service, 0 if not served
+	Ip        string
+	PublicUrl string
+	DiskType  string // e.g. hdd or ssd
+	Labels    string // comma separated key=value pairs
+	// signs the joins with the secret shared with the master, if not empty
+	ClusterSecret string
+	// deleted files are kept this long in the trash of their volume, 0 erases them right away
+	TrashRetention time.Duration
+
+	readCache  *util.LRUCache    // recently read needles, nil if disabled
+	readFlight util.SingleFlight // the reads in flight, shared by the concurrent reads of the same needle
+	readOnly   int32             // 1 when writes are refused, set with SetReadOnly
+	retries    int64             // replicated writes found already written, updated atomically
+	masterKey  []byte            // wraps the data keys of the volumes, nil if not encrypted
+	keyLock    sync.Mutex        // serializes the master key rotations and the re-encryptions
+	tierLock   sync.Mutex        // serializes the offloads and the recalls of the volumes
+
+	uploadPolicies map[string]*UploadPolicy     // per collection, from the master with each join
+	signedReads    map[string]bool              // collections only read with signed urls, from the master too, nil until then
+	headers        map[string]map[string]string // response headers per collection, from the master too
 }
 
-func NewStore(port int, ip, publicUrl, dirname string, maxVolumeCount int) (s *Store) {
-	s = &Store{Port: port, Ip: ip, PublicUrl: publicUrl, dir: dirname, MaxVolumeCount: maxVolumeCount}
-	s.volumes = make(map[VolumeId]*Volume)
-	s.loadExistingVolumes()
+var ErrStoreReadOnly = errors.New("Volume server is read only")
 
-	log.Println("Store started on dir:", dirname, "with", len(s.volumes), "volumes")
+// NewStore loads the volumes in each of the directories, which can hold up to
+// the maximum volume count at the same index.
+func NewStore(port int, ip, publicUrl string, dirnames []string, maxVolumeCounts []int) (s *Store) {
+	s = &Store{Port: port, Ip: ip, PublicUrl: publicUrl}
+	for i, dirname := range dirnames {
+		location := NewDiskLocation(dirname, maxVolumeCounts[i])
+		location.loadExistingVolumes(func(vid VolumeId) bool { return s.findVolume(vid) != nil })
+		s.locations = append(s.locations, location)
+		log.Println("Store started on dir:", dirname, "with", len(location.volumes), "volumes")
+	}
 	return
 }
-func (s *Store) AddVolume(volumeListString string, replicationType string) error {
+
+// NewMemoryStore keeps up to maxVolumeCount volumes in memory, with no files,
+// so the volume server can be tested, or embedded, without touching the disk.
+// The volumes are lost when the store goes away.
+func NewMemoryStore(port int, ip, publicUrl string, maxVolumeCount int) *Store {
+	s := &Store{Port: port, Ip: ip, PublicUrl: publicUrl}
+	s.locations = append(s.locations, NewMemoryLocation(maxVolumeCount))
+	log.Println("Store started in memory for", maxVolumeCount, "volumes")
+	return s
+}
+func (s *Store) AddVolume(volumeListString string, collection string, replicationType string) error {
 	rt, e := NewReplicationTypeFromString(replicationType)
 	if e != nil {
 		return e
@@ -40,7 +79,7 @@ func (s *Store) AddVolume(volumeListString string, replicationType string) error
 			if err != nil {
 				return errors.New("Volume Id " + id_string + " is not a valid unsigned integer!")
 			}
-			e = s.addVolume(VolumeId(id), rt)
+			e = s.addVolume(VolumeId(id), collection, rt)
 		} else {
 			pair := strings.Split(range_string, "-")
 			start, start_err := strconv.ParseUint(pair[0], 10, 64)
@@ -52,7 +91,7 @@ func (s *Store) AddVolume(volumeListString string, replicationType string) error
 				return errors.New("Volume End Id" + pair[1] + " is not a valid unsigned integer!")
 			}
 			for id := start; id <= end; id++ {
-				if err := s.addVolume(VolumeId(id), rt); err != nil {
+				if err := s.addVolume(VolumeId(id), collection, rt); err != nil {
 					e = err
 				}
 			}
@@ -60,85 +99,688 @@ func (s *Store) AddVolume(volumeListString string, replicationType string) error
 	}
 	return e
 }
-func (s *Store) addVolume(vid VolumeId, replicationType ReplicationType) error {
-	if s.volumes[vid] != nil {
+
+// addVolume creates the volume in the healthy directory with the most free volume slots.
+func (s *Store) addVolume(vid VolumeId, collection string, replicationType ReplicationType) error {
+	if err := CheckCollectionName(collection); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.findVolumeLocked(vid) != nil {
 		return errors.New("Volume Id " + vid.String() + " already exists!")
 	}
-	log.Println("In dir", s.dir, "adds volume =", vid, ", replicationType =", replicationType)
-	s.volumes[vid] = NewVolume(s.dir, vid, replicationType)
+	var location *DiskLocation
+	for _, l := range s.locations {
+		if l.FreeCount() > 0 && (location == nil || l.FreeCount() > location.FreeCount()) {
+			location = l
+		}
+	}
+	if location == nil {
+		return errors.New("No free volume slot left for volume " + vid.String() + "!")
+	}
+	log.Println("In dir", location.Directory, "adds volume =", vid, ", collection =", collection, ", replicationType =", replicationType)
+	var v *Volume
+	if location.InMemory {
+		v = NewMemoryVolume(collection, vid, replicationType)
+	} else {
+		v = NewVolume(location.Directory, collection, vid, replicationType)
+	}
+	location.volumes[vid] = v
+	if s.masterKey != nil {
+		return v.setMasterKey(s.masterKey)
+	}
 	return nil
 }
-func (s *Store) loadExistingVolumes() {
-	if dirs, err := ioutil.ReadDir(s.dir); err == nil {
-		for _, dir := range dirs {
-			name := dir.Name()
-			if !dir.IsDir() && strings.HasSuffix(name, ".dat") {
-				base := name[:len(name)-len(".dat")]
-				if vid, err := NewVolumeId(base); err == nil {
-					if s.volumes[vid] == nil {
-						v := NewVolume(s.dir, vid, CopyNil)
-						s.volumes[vid] = v
-						log.Println("In dir", s.dir, "reads volume = ", vid, ", replicationType =", v.replicaType)
-					}
+
+// DeleteVolume unloads the volume and removes its files from the disk.
+func (s *Store) DeleteVolume(volumeIdString string) error {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, l := range s.locations {
+		if v := l.volumes[vid]; v != nil {
+			delete(l.volumes, vid)
+			log.Println("In dir", l.Directory, "deletes volume =", vid, ", collection =", v.Collection)
+			return v.destroy()
+		}
+	}
+	return errors.New("Volume Id " + vid.String() + " is not found!")
+}
+
+// CheckDiskLocations probes the healthy directories, and unloads the volumes
+// of the ones that fail, so the master stops using them on this server.
+func (s *Store) CheckDiskLocations() {
+	for _, l := range s.locations {
+		s.lock.RLock()
+		failed := l.Failed
+		s.lock.RUnlock()
+		if failed {
+			continue
+		}
+		if err := l.probe(); err != nil {
+			s.lock.Lock()
+			l.fail(err)
+			s.lock.Unlock()
+		}
+	}
+}
+
+// ReloadDiskLocation brings back a failed directory, e.g. after its disk is
+// replaced, and loads the volumes found in it.
+func (s *Store) ReloadDiskLocation(dir string) error {
+	for _, l := range s.locations {
+		if path.Clean(l.Directory) != path.Clean(dir) {
+			continue
+		}
+		if !l.Failed {
+			return errors.New("Dir " + dir + " has not failed")
+		}
+		if err := l.probe(); err != nil {
+			return err
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		l.Failed, l.lostVolumes = false, nil
+		l.loadExistingVolumes(func(vid VolumeId) bool { return s.findVolumeLocked(vid) != nil })
+		log.Println("Dir", dir, "is back with", len(l.volumes), "volumes")
+		if s.masterKey != nil {
+			for _, v := range l.volumes {
+				if err := v.setMasterKey(s.masterKey); err != nil {
+					return err
 				}
 			}
 		}
+		return nil
+	}
+	return errors.New("Dir " + dir + " is not one of the -dir directories")
+}
+
+func (s *Store) MaxVolumeCount() (count int) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, l := range s.locations {
+		if !l.Failed {
+			count += l.MaxVolumeCount
+		}
+	}
+	return
+}
+
+// LostVolumes lists the volumes unloaded because their directories failed.
+func (s *Store) LostVolumes() (vids []VolumeId) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, l := range s.locations {
+		vids = append(vids, l.lostVolumes...)
+	}
+	return
+}
+
+func (s *Store) Locations() (locations []interface{}) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, l := range s.locations {
+		locations = append(locations, l.ToMap())
+	}
+	return
+}
+
+func (s *Store) findVolume(vid VolumeId) *Volume {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.findVolumeLocked(vid)
+}
+func (s *Store) findVolumeLocked(vid VolumeId) *Volume {
+	for _, l := range s.locations {
+		if v := l.volumes[vid]; v != nil {
+			return v
+		}
+	}
+	return nil
+}
+func (s *Store) allVolumes() (volumes []*Volume) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, l := range s.locations {
+		for _, v := range l.volumes {
+			volumes = append(volumes, v)
+		}
 	}
+	return
 }
 func (s *Store) Status() []*VolumeInfo {
 	var stats []*VolumeInfo
-	for k, v := range s.volumes {
-		s := new(VolumeInfo)
-		s.Id, s.Size, s.RepType, s.FileCount, s.DeleteCount = VolumeId(k), v.Size(), v.replicaType, v.nm.fileCounter, v.nm.deletionCounter
-		stats = append(stats, s)
+	for _, v := range s.allVolumes() {
+		stats = append(stats, s.volumeInfo(v))
 	}
 	return stats
 }
 func (s *Store) Join(mserver string) error {
+	s.CheckDiskLocations()
 	stats := new([]*VolumeInfo)
-	for k, v := range s.volumes {
-		s := new(VolumeInfo)
-		s.Id, s.Size, s.RepType, s.FileCount, s.DeleteCount = VolumeId(k), v.Size(), v.replicaType, v.nm.fileCounter, v.nm.deletionCounter
-		*stats = append(*stats, s)
+	for _, v := range s.allVolumes() {
+		*stats = append(*stats, s.volumeInfo(v))
 	}
 	bytes, _ := json.Marshal(stats)
+	lost, _ := json.Marshal(s.LostVolumes())
 	values := make(url.Values)
 	values.Add("port", strconv.Itoa(s.Port))
 	values.Add("ip", s.Ip)
 	values.Add("publicUrl", s.PublicUrl)
+	if s.AdminPort != 0 {
+		values.Add("adminPort", strconv.Itoa(s.AdminPort))
+	}
+	if s.GrpcPort != 0 {
+		values.Add("grpcPort", strconv.Itoa(s.GrpcPort))
+	}
 	values.Add("volumes", string(bytes))
-	values.Add("maxVolumeCount", strconv.Itoa(s.MaxVolumeCount))
-	_, err := util.Post("http://"+mserver+"/dir/join", values)
-	return err
+	values.Add("maxVolumeCount", strconv.Itoa(s.MaxVolumeCount()))
+	values.Add("lostVolumes", string(lost))
+	reads, _ := json.Marshal(s.ReadCounts())
+	values.Add("reads", string(reads))
+	values.Add("diskType", s.DiskType)
+	values.Add("labels", s.Labels)
+	values.Add("time", strconv.FormatInt(time.Now().Unix(), 10))
+	if s.ClusterSecret != "" {
+		util.SignValues(s.ClusterSecret, values)
+	}
+	jsonBlob, err := util.PostGzipped("http://"+mserver+"/dir/join", values)
+	if err != nil {
+		return err
+	}
+	var ret struct {
+		Error           string
+		UploadPolicies  map[string]*UploadPolicy
+		SignedReads     []string
+		ResponseHeaders map[string]map[string]string
+	}
+	if err = json.Unmarshal(jsonBlob, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		log.Println("Master", mserver, "refused to join:", ret.Error)
+		return errors.New(ret.Error)
+	}
+	signedReads := make(map[string]bool)
+	for _, collection := range ret.SignedReads {
+		signedReads[collection] = true
+	}
+	s.lock.Lock()
+	s.uploadPolicies, s.signedReads, s.headers = ret.UploadPolicies, signedReads, ret.ResponseHeaders
+	s.lock.Unlock()
+	return nil
+}
+
+// ReadPolicyKnown is false until the master told, with a join, which collections
+// are only read with signed urls.
+func (s *Store) ReadPolicyKnown() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.signedReads != nil
+}
+
+// SignedReads is true if the collection of the volume is only read with signed urls.
+func (s *Store) SignedReads(i VolumeId) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if v := s.findVolumeLocked(i); v != nil {
+		return s.signedReads[v.Collection]
+	}
+	return false
+}
+
+// ResponseHeaders are the headers added to the reads of the collection of the volume.
+func (s *Store) ResponseHeaders(i VolumeId) map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if v := s.findVolumeLocked(i); v != nil {
+		return s.headers[v.Collection]
+	}
+	return nil
+}
+
+// UploadPolicy is the policy of the collection of the volume, nil if none.
+func (s *Store) UploadPolicy(i VolumeId) *UploadPolicy {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if v := s.findVolumeLocked(i); v != nil {
+		return s.uploadPolicies[v.Collection]
+	}
+	return nil
+}
+func (s *Store) volumeInfo(v *Volume) *VolumeInfo {
+	vi := v.volumeInfo()
+	vi.DiskType = s.DiskType
+	if s.ReadOnly() && vi.State.IsWritable() {
+		vi.State = VolumeReadOnly
+	}
+	return vi
+}
+
+// SetReadOnly refuses, or takes again, the writes to all the volumes. The
+// volumes are reported read only to the master, which stops assigning them.
+func (s *Store) SetReadOnly(readOnly bool) {
+	if readOnly {
+		atomic.StoreInt32(&s.readOnly, 1)
+	} else {
+		atomic.StoreInt32(&s.readOnly, 0)
+	}
+}
+func (s *Store) ReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) == 1
+}
+
+// SetMasterKey encrypts the needles written from now on with the data keys of
+// their volumes, which are wrapped with the 32 byte master key.
+func (s *Store) SetMasterKey(masterKey []byte) error {
+	if len(masterKey) != 32 {
+		return errors.New("The master key should be 32 bytes")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.masterKey = masterKey
+	for _, l := range s.locations {
+		for _, v := range l.volumes {
+			if err := v.setMasterKey(masterKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RotateMasterKey wraps the data keys of all the volumes with the new master
+// key. They are all written next to the current ones before any replaces them,
+// and a volume loaded with the new master key before its .key is replaced
+// finishes the rotation itself.
+func (s *Store) RotateMasterKey(masterKey []byte) error {
+	if len(masterKey) != 32 {
+		return errors.New("The master key should be 32 bytes")
+	}
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.masterKey == nil {
+		return errors.New("Volumes are not encrypted")
+	}
+	var volumes []*Volume
+	for _, l := range s.locations {
+		for _, v := range l.volumes {
+			volumes = append(volumes, v)
+		}
+	}
+	for _, v := range volumes {
+		if err := v.prepareMasterKey(masterKey); err != nil {
+			return err
+		}
+	}
+	s.masterKey = masterKey
+	for _, v := range volumes {
+		if err := v.commitMasterKey(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReencryptVolume rewrites the needles of the volume with a new data key.
+// The volume is locked meanwhile, as during a compaction.
+func (s *Store) ReencryptVolume(volumeIdString string, progress func(done, total int64)) error {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+	s.lock.RLock()
+	masterKey := s.masterKey
+	s.lock.RUnlock()
+	if masterKey == nil {
+		return errors.New("Volumes are not encrypted")
+	}
+	return v.reencrypt(masterKey, progress)
 }
 func (s *Store) Close() {
-	for _, v := range s.volumes {
+	for _, v := range s.allVolumes() {
 		v.Close()
 	}
 }
-func (s *Store) Write(i VolumeId, n *Needle) uint32 {
-	if v := s.volumes[i]; v != nil {
+
+// SetReadCache keeps recently read needles in the cache, to serve hot files without reading the volume.
+func (s *Store) SetReadCache(cache *util.LRUCache) {
+	s.readCache = cache
+}
+func (s *Store) ReadCache() *util.LRUCache {
+	return s.readCache
+}
+
+type cachedNeedle struct {
+	needle Needle
+	count  int
+}
+
+func readCacheKey(i VolumeId, n *Needle) string {
+	return i.String() + "," + strconv.FormatUint(n.Id, 16)
+}
+func (s *Store) invalidateReadCache(i VolumeId, n *Needle) {
+	if s.readCache != nil {
+		s.readCache.Delete(readCacheKey(i, n))
+	}
+}
+
+func (s *Store) Write(i VolumeId, n *Needle) (uint32, error) {
+	if s.ReadOnly() {
+		return 0, ErrStoreReadOnly
+	}
+	if v := s.findVolume(i); v != nil {
+		s.invalidateReadCache(i, n)
 		return v.write(n)
 	}
-	return 0
+	return 0, errors.New("Volume " + i.String() + " is not found!")
+}
+
+// WriteReplica writes the needle sent by another replica, unless it is a retry
+// of a write that reached this server already, timing out on the sender: the
+// needle last written to the volume then has the same id, cookie and content,
+// and is not written twice.
+func (s *Store) WriteReplica(i VolumeId, n *Needle) (uint32, error) {
+	if s.ReadOnly() {
+		return 0, ErrStoreReadOnly
+	}
+	if v := s.findVolume(i); v != nil {
+		s.invalidateReadCache(i, n)
+		size, retry, e := v.writeOnce(n)
+		if retry {
+			atomic.AddInt64(&s.retries, 1)
+		}
+		return size, e
+	}
+	return 0, errors.New("Volume " + i.String() + " is not found!")
+}
+
+// RetriedWrites counts the replicated writes not written twice by WriteReplica.
+func (s *Store) RetriedWrites() int64 {
+	return atomic.LoadInt64(&s.retries)
+}
+
+// Append writes n with its data appended to the existing content of the file,
+// and returns the previous content, nil for a new file, to roll the append back.
+func (s *Store) Append(i VolumeId, n *Needle) (uint32, *Needle, error) {
+	if s.ReadOnly() {
+		return 0, nil, ErrStoreReadOnly
+	}
+	if v := s.findVolume(i); v != nil {
+		s.invalidateReadCache(i, n)
+		return v.appendTo(n)
+	}
+	return 0, nil, errors.New("Volume " + i.String() + " is not found!")
 }
 func (s *Store) Delete(i VolumeId, n *Needle) uint32 {
-	if v := s.volumes[i]; v != nil {
-		return v.delete(n)
+	if v := s.findVolume(i); v != nil {
+		s.invalidateReadCache(i, n)
+		return v.delete(n, s.TrashRetention > 0)
 	}
 	return 0
 }
+
+// Undelete brings back a deleted file still in the trash of its volume.
+func (s *Store) Undelete(i VolumeId, n *Needle) (uint32, error) {
+	if v := s.findVolume(i); v != nil {
+		return v.undelete(n)
+	}
+	return 0, errors.New("Volume Id " + i.String() + " is not found!")
+}
+
+// PurgeTrash erases the deleted files kept for longer than the trash retention,
+// and returns how many.
+func (s *Store) PurgeTrash() (count int) {
+	before := time.Now().Add(-s.TrashRetention).Unix()
+	for _, v := range s.allVolumes() {
+		count += v.purgeTrash(before)
+	}
+	return
+}
+
+// Trashed lists the deleted files of the volume that can be undeleted.
+func (s *Store) Trashed(volumeIdString string) ([]*TrashedNeedle, error) {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return nil, errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return nil, errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	return v.trashed(), nil
+}
 func (s *Store) Read(i VolumeId, n *Needle) (int, error) {
-	if v := s.volumes[i]; v != nil {
-		return v.read(n)
+	if v := s.findVolume(i); v != nil {
+		atomic.AddUint64(&v.reads, 1)
+		key := readCacheKey(i, n)
+		if s.readCache != nil {
+			if cached, ok := s.readCache.Get(key); ok {
+				*n = cached.(*cachedNeedle).needle
+				return cached.(*cachedNeedle).count, nil
+			}
+		}
+		// the concurrent reads of a needle share one read of the volume,
+		// the cookie is checked by each reader after
+		read, shared, err := s.readFlight.Do(key, func() (interface{}, error) {
+			count, err := v.read(n)
+			if err == nil && s.readCache != nil {
+				s.readCache.Set(key, &cachedNeedle{needle: *n, count: count}, int64(len(n.Data)+len(n.Pairs)))
+			}
+			return &cachedNeedle{needle: *n, count: count}, err
+		})
+		if shared && err == nil {
+			*n = read.(*cachedNeedle).needle
+		}
+		return read.(*cachedNeedle).count, err
 	}
 	return 0, errors.New("Not Found")
 }
+
+// ReadFlight counts the reads of the volumes, and the ones sharing a read in flight.
+func (s *Store) ReadFlight() map[string]interface{} {
+	return s.readFlight.ToMap()
+}
 func (s *Store) GetVolume(i VolumeId) *Volume {
-	return s.volumes[i]
+	return s.findVolume(i)
 }
 
 func (s *Store) HasVolume(i VolumeId) bool {
-	_, ok := s.volumes[i]
-	return ok
+	return s.findVolume(i) != nil
+}
+func (s *Store) CheckCompactVolume(volumeIdString string) (float64, error) {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return 0, errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return 0, errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	return v.garbageLevel(), nil
+}
+func (s *Store) CompactVolume(volumeIdString string) error {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	return v.compact()
+}
+
+// UpgradeVolume rewrites the volume in the current needle version, if it is older.
+func (s *Store) UpgradeVolume(volumeIdString string) error {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	return v.upgrade()
+}
+
+// CloneVolume makes a copy of the sealed volume under the new id, in the same
+// directory, linked with it until one of them changes, see Volume.clone.
+func (s *Store) CloneVolume(volumeIdString string, newVolumeIdString string) error {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	newVid, err := NewVolumeId(newVolumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + newVolumeIdString + " is not a valid unsigned integer!")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.findVolumeLocked(newVid) != nil {
+		return errors.New("Volume Id " + newVid.String() + " already exists!")
+	}
+	for _, l := range s.locations {
+		if v := l.volumes[vid]; v != nil {
+			if l.FreeCount() <= 0 {
+				return errors.New("No free volume slot left in " + l.Directory + " for volume " + newVid.String() + "!")
+			}
+			c, err := v.clone(newVid)
+			if err != nil {
+				return err
+			}
+			l.volumes[newVid] = c
+			return nil
+		}
+	}
+	return errors.New("Volume Id " + vid.String() + " is not found!")
+}
+
+// OffloadVolume moves the data file of the sealed volume to the remote tier,
+// see Volume.offload.
+func (s *Store) OffloadVolume(volumeIdString string) error {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	s.tierLock.Lock()
+	defer s.tierLock.Unlock()
+	return v.offload()
+}
+
+// RecallVolume brings the data file of the offloaded volume back from the
+// remote tier, see Volume.recall.
+func (s *Store) RecallVolume(volumeIdString string) error {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	s.tierLock.Lock()
+	defer s.tierLock.Unlock()
+	return v.recall()
+}
+
+// Snapshot takes the cut points of the volumes, pinning them for the snapshot
+// until it expires or is released, see Volume.cut. If a volume fails, the
+// others are released.
+func (s *Store) Snapshot(name string, vids []VolumeId, expires time.Time) ([]*VolumeCut, error) {
+	var cuts []*VolumeCut
+	for _, vid := range vids {
+		v := s.findVolume(vid)
+		if v == nil {
+			s.ReleaseSnapshot(name)
+			return nil, errors.New("Volume Id " + vid.String() + " is not found!")
+		}
+		cut, err := v.cut(name, expires)
+		if err != nil {
+			s.ReleaseSnapshot(name)
+			return nil, err
+		}
+		cuts = append(cuts, cut)
+	}
+	return cuts, nil
+}
+
+// ReleaseSnapshot unpins the volumes of the snapshot.
+func (s *Store) ReleaseSnapshot(name string) {
+	for _, v := range s.allVolumes() {
+		v.unpin(name)
+	}
+}
+
+// SetVolumeState seals or unseals the volume.
+func (s *Store) SetVolumeState(volumeIdString string, stateString string) error {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	state, err := NewVolumeState(stateString)
+	if err != nil {
+		return err
+	}
+	if state != VolumeSealed && state != VolumeGrowing {
+		return errors.New("Volume state can only be set to " + string(VolumeSealed) + " or " + string(VolumeGrowing))
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	return v.SetState(state)
+}
+
+// VolumeDigest sums up the live needles of the volume, see Volume.digest.
+func (s *Store) VolumeDigest(volumeIdString string) (*VolumeDigest, error) {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return nil, errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return nil, errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	return v.digest()
+}
+
+// Scan visits the live needles of the volume in the order they are on disk, see Volume.scan.
+func (s *Store) Scan(volumeIdString string, visit func(n *Needle) error) error {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	return v.scan(visit)
+}
+func (s *Store) ModifiedSince(volumeIdString string, since uint64) ([]*Needle, error) {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return nil, errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return nil, errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	return v.modifiedSince(since)
 }
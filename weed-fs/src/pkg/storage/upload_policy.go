@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// UploadPolicy limits the files uploaded to the volumes of a collection,
+// e.g. to only take images of up to 10MB in a public image collection.
+type UploadPolicy struct {
+	MaxSize      int64    `json:",omitempty"` // in bytes, 0 means no limit
+	ContentTypes []string `json:",omitempty"` // e.g. image/jpeg or image/*, empty allows all
+}
+
+// UploadRefusedError is an upload not allowed by the policy, with the http
+// status to answer with: 413 when too large, 415 for content types not allowed.
+type UploadRefusedError struct {
+	Status  int
+	Message string
+}
+
+func (e *UploadRefusedError) Error() string {
+	return e.Message
+}
+
+// NewUploadPolicy returns nil, i.e. no limit, when there is nothing to check.
+func NewUploadPolicy(maxSize int64, contentTypes string) *UploadPolicy {
+	p := &UploadPolicy{MaxSize: maxSize}
+	for _, t := range strings.Split(contentTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			p.ContentTypes = append(p.ContentTypes, strings.ToLower(t))
+		}
+	}
+	if p.MaxSize <= 0 && len(p.ContentTypes) == 0 {
+		return nil
+	}
+	return p
+}
+
+func (p *UploadPolicy) checkSize(size int64) error {
+	if p != nil && p.MaxSize > 0 && size > p.MaxSize {
+		return &UploadRefusedError{http.StatusRequestEntityTooLarge, "File too large for the collection, the limit is " + strconv.FormatInt(p.MaxSize, 10) + " bytes"}
+	}
+	return nil
+}
+
+// checkContentType checks the content type of the uploaded file, or the one
+// of its file name extension if the client did not send one.
+func (p *UploadPolicy) checkContentType(contentType, fileName string) error {
+	if p == nil || len(p.ContentTypes) == 0 {
+		return nil
+	}
+	if contentType == "" || contentType == "application/octet-stream" {
+		if dotIndex := strings.LastIndex(fileName, "."); dotIndex > 0 {
+			contentType = mime.TypeByExtension(fileName[dotIndex:])
+		}
+	}
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, allowed := range p.ContentTypes {
+		if allowed == contentType || strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, allowed[:len(allowed)-1]) {
+			return nil
+		}
+	}
+	if contentType == "" {
+		contentType = "unknown"
+	}
+	return &UploadRefusedError{http.StatusUnsupportedMediaType, "Content type " + contentType + " is not allowed in the collection"}
+}
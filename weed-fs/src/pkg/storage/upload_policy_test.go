@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUploadPolicy(t *testing.T) {
+	if NewUploadPolicy(0, " , ") != nil {
+		t.Fatal("expecting no policy without limits")
+	}
+	p := NewUploadPolicy(100, "image/jpeg,IMAGE/png,video/*")
+	for _, c := range []struct {
+		contentType, fileName string
+		status                int
+	}{
+		{"image/jpeg", "a", 0},
+		{"image/png; charset=binary", "a", 0},
+		{"video/mp4", "a.bin", 0},
+		{"", "a.jpg", 0},
+		{"application/octet-stream", "a.png", 0},
+		{"text/html", "a.jpg", http.StatusUnsupportedMediaType},
+		{"", "a.exe", http.StatusUnsupportedMediaType},
+		{"", "a", http.StatusUnsupportedMediaType},
+	} {
+		err := p.checkContentType(c.contentType, c.fileName)
+		if refused, ok := err.(*UploadRefusedError); (c.status == 0 && err != nil) || (c.status != 0 && (!ok || refused.Status != c.status)) {
+			t.Fatal(c.contentType, c.fileName, "unexpected", err)
+		}
+	}
+	if p.checkSize(100) != nil {
+		t.Fatal("expecting 100 bytes to be allowed")
+	}
+	if refused, ok := p.checkSize(101).(*UploadRefusedError); !ok || refused.Status != http.StatusRequestEntityTooLarge {
+		t.Fatal("expecting 101 bytes to be refused")
+	}
+}
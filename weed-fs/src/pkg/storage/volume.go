@@ -1,50 +1,108 @@
 package storage
 
 import (
+	"bytes"
 	"log"
 	"os"
 	"path"
+	"pkg/util"
 	"sync"
 	"errors"
+	"time"
 )
 
 const (
 	SuperBlockSize = 8
+	// a volume turns read only after this many write errors in a row
+	MaxConsecutiveWriteErrors = 3
 )
 
 type Volume struct {
-	Id       VolumeId
-	dir      string
-	dataFile *os.File
-	nm       *NeedleMap
+	Id         VolumeId
+	dir        string
+	Collection string
+	dataFile   volumeFile
+	nm         *NeedleMap
 
 	replicaType ReplicationType
+	version     Version
+	alignment   int64 // of the needles in the data file, from the super block
 
 	accessLock sync.Mutex
-	
+
+	state       VolumeState
+	writeErrors int // consecutive write errors
+
+	dataKeys []*dataKey           // the last one encrypts the new needles, nil when not encrypted
+	trash    *trashLog            // deleted needles that can be undeleted, nil until the first one
+	shared   bool                 // the data file is hard linked with a clone, and copied before it is changed
+	pins     map[string]time.Time // the snapshots keeping the volume as it is, until they expire
+	reads    uint64               // since the server started, updated atomically
 }
 
-func NewVolume(dirname string, id VolumeId, replicationType ReplicationType) (v *Volume) {
+func NewVolume(dirname string, collection string, id VolumeId, replicationType ReplicationType) (v *Volume) {
 	var e error
-	v = &Volume{dir: dirname, Id: id, replicaType: replicationType}
-	fileName := id.String()
-	v.dataFile, e = os.OpenFile(path.Join(v.dir, fileName+".dat"), os.O_RDWR|os.O_CREATE, 0644)
+	v = &Volume{dir: dirname, Collection: collection, Id: id, replicaType: replicationType, state: VolumeGrowing}
+	fileName := v.FileName()
+	if e = finishCompaction(fileName); e != nil {
+		log.Fatalf("Volume %s can not finish its compaction [ERROR] %s\n", id.String(), e)
+	}
+	v.dataFile, e = openDataFile(fileName)
 	if e != nil {
 		log.Fatalf("New Volume [ERROR] %s\n", e)
 	}
+	v.shared = linkCount(v.dataFile) > 1
 	if replicationType == CopyNil {
 		v.readSuperBlock()
 	} else {
 		v.maybeWriteSuperBlock()
 	}
-	indexFile, ie := os.OpenFile(path.Join(v.dir, fileName+".idx"), os.O_RDWR|os.O_CREATE, 0644)
+	indexFile, ie := openVolumeFile(fileName+".idx", os.O_RDWR|os.O_CREATE)
 	if ie != nil {
 		log.Fatalf("Write Volume Index [ERROR] %s\n", ie)
 	}
 	v.nm = LoadNeedleMap(indexFile)
+	if e = v.checkDataTail(); e != nil {
+		log.Println("Volume", id, "can not check its data file against its index:", e)
+	}
+	if e = v.openTrash(false); e != nil {
+		log.Println("Volume", id, "can not load its trash:", e)
+	} else if v.trash != nil {
+		for _, t := range v.trash.entries {
+			if v.nm.deletionByteCounter >= uint64(t.Size) {
+				v.nm.deletionByteCounter -= uint64(t.Size)
+			}
+		}
+	}
 
 	return
 }
+
+// NewMemoryVolume creates an empty volume kept in memory, with no files, e.g.
+// for tests or when weed-fs is embedded in another program.
+func NewMemoryVolume(collection string, id VolumeId, replicationType ReplicationType) *Volume {
+	v := &Volume{Collection: collection, Id: id, replicaType: replicationType, state: VolumeGrowing}
+	fileName := v.FileName()
+	v.dataFile = newMemoryFile(fileName + ".dat")
+	v.maybeWriteSuperBlock()
+	v.nm = NewNeedleMap(newMemoryFile(fileName + ".idx"))
+	return v
+}
+
+// InMemory tells if the volume is kept in memory instead of in files.
+func (v *Volume) InMemory() bool {
+	_, ok := v.dataFile.(*memoryFile)
+	return ok
+}
+
+// FileName is the path of the volume files without the extension.
+// Volumes of a collection are named collection_id, others just id.
+func (v *Volume) FileName() string {
+	if v.Collection == "" {
+		return path.Join(v.dir, v.Id.String())
+	}
+	return path.Join(v.dir, v.Collection+"_"+v.Id.String())
+}
 func (v *Volume) Size() int64 {
 	stat, e := v.dataFile.Stat()
 	if e == nil {
@@ -52,48 +110,238 @@ func (v *Volume) Size() int64 {
 	}
 	return -1
 }
+func (v *Volume) volumeInfo() *VolumeInfo {
+	s := new(VolumeInfo)
+	s.Id, s.Size, s.RepType, s.FileCount, s.DeleteCount = v.Id, v.Size(), v.replicaType, v.nm.fileCounter, v.nm.deletionCounter
+	s.DeletedByteCount, s.Version, s.Collection = v.nm.deletionByteCounter, v.version, v.Collection
+	s.State = v.state
+	s.Offloaded = v.Offloaded()
+	if v.nm.fileCounter > 0 {
+		s.AverageFileSize = v.nm.fileByteCounter / uint64(v.nm.fileCounter)
+	}
+	return s
+}
 func (v *Volume) Close() {
 	v.nm.Close()
 	v.dataFile.Close()
+	if v.trash != nil {
+		v.trash.file.Close()
+	}
+}
+
+// destroy closes the volume and removes its data and index files.
+func (v *Volume) destroy() error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.state == VolumeCompacting {
+		return errors.New("Volume " + v.Id.String() + " is being compacted")
+	}
+	v.Close()
+	if v.InMemory() {
+		return nil
+	}
+	fileName := v.FileName()
+	if f, ok := v.dataFile.(*remoteFile); ok {
+		remoteTier.drop(f.remote.Key, f.remote.Size)
+		if e := remoteTier.remove(f.remote.Key); e != nil {
+			return e
+		}
+		if e := os.Remove(fileName + ".remote"); e != nil {
+			return e
+		}
+	} else if e := os.Remove(fileName + ".dat"); e != nil {
+		return e
+	}
+	if e := os.Remove(fileName + ".key"); e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	os.Remove(fileName + ".key.new")
+	os.Remove(fileName + ".trash")
+	return os.Remove(fileName + ".idx")
 }
 func (v *Volume) maybeWriteSuperBlock() {
 	stat, _ := v.dataFile.Stat()
 	if stat.Size() == 0 {
 		header := make([]byte, SuperBlockSize)
-		header[0] = 1
+		header[0] = byte(CurrentVersion)
 		header[1] = v.replicaType.Byte()
-		v.dataFile.Write(header)
+		writeSuperBlock(v.dataFile, header, needleAlignment)
+		v.version, v.alignment = CurrentVersion, needleAlignment
+	} else {
+		v.readSuperBlock()
 	}
 }
 func (v *Volume) readSuperBlock() {
 	v.dataFile.Seek(0, 0)
 	header := make([]byte, SuperBlockSize)
+	v.alignment = DefaultNeedleAlignment
 	if _, error := v.dataFile.Read(header); error == nil {
+		v.version, v.alignment = Version(header[0]), SuperBlockAlignment(header)
 		v.replicaType, _ = NewReplicationTypeFromByte(header[1])
+		if header[2]&superBlockFlagSealed != 0 {
+			v.state = VolumeSealed
+		}
 	}
 }
 
-func (v *Volume) write(n *Needle) uint32 {
+func (v *Volume) write(n *Needle) (uint32, error) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	return v.writeNeedle(n)
+}
+
+// writeOnce writes the needle, unless it is the last one written to the volume
+// already, with the same cookie, content and modification time.
+func (v *Volume) writeOnce(n *Needle) (size uint32, retry bool, e error) {
 	v.accessLock.Lock()
 	defer v.accessLock.Unlock()
-	offset, _ := v.dataFile.Seek(0, 2)
-	ret := n.Append(v.dataFile)
+	if v.isLastNeedle(n) {
+		return uint32(len(n.Data)), true, nil
+	}
+	size, e = v.writeNeedle(n)
+	return
+}
+func (v *Volume) isLastNeedle(n *Needle) bool {
+	nv, ok := v.nm.Get(n.Id)
+	if !ok || nv.Offset == 0 || !v.state.IsWritable() {
+		return false
+	}
+	end, e := v.dataFile.Seek(0, 2)
+	if e != nil || int64(nv.Offset)*8+alignedSize(nv.Size, v.alignment) != end {
+		return false
+	}
+	last := new(Needle)
+	v.dataFile.Seek(int64(nv.Offset)*8, 0)
+	if _, e = last.Read(v.dataFile, nv.Size, v.version); e != nil {
+		return false
+	}
+	if e = v.decrypt(last); e != nil {
+		return false
+	}
+	return last.Cookie == n.Cookie && last.LastModified == n.LastModified &&
+		bytes.Equal(last.Data, n.Data) && bytes.Equal(last.Pairs, n.Pairs)
+}
+
+// ErrCookieMismatch refuses a write over a file with another cookie, e.g. one
+// to a file id guessed from the key of another.
+var ErrCookieMismatch = errors.New("Cookie does not match the existing file")
+
+func (v *Volume) writeNeedle(n *Needle) (uint32, error) {
+	if !v.state.IsWritable() {
+		return 0, errors.New("Volume " + v.Id.String() + " is " + string(v.state))
+	}
+	if n.IsChunkManifest() && v.version == Version1 {
+		// the flags are only kept from version2 on
+		return 0, errors.New("Volume " + v.Id.String() + " is of version 1, and can not keep chunk manifests")
+	}
+	if nv, ok := v.nm.Get(n.Id); ok && nv.Offset > 0 && nv.Size > 0 {
+		cookie := make([]byte, 4)
+		if _, e := v.dataFile.ReadAt(cookie, int64(nv.Offset)*8); e != nil {
+			return 0, e
+		}
+		if util.BytesToUint32(cookie) != n.Cookie {
+			return 0, ErrCookieMismatch
+		}
+	}
+	stored, e := v.encrypted(n)
+	if e != nil {
+		return 0, e
+	}
+	if e = v.unshare(); e != nil {
+		return 0, v.writeFailed(e)
+	}
+	offset, e := v.dataFile.Seek(0, 2)
+	if e != nil {
+		return 0, v.writeFailed(e)
+	}
+	if _, e = stored.AppendAligned(v.dataFile, v.version, v.alignment); e != nil {
+		// drop the partial needle, so the next one starts at an aligned offset
+		v.dataFile.Truncate(offset)
+		return 0, v.writeFailed(e)
+	}
 	nv, ok := v.nm.Get(n.Id)
 	if !ok || int64(nv.Offset)*8 < offset {
-		v.nm.Put(n.Id, uint32(offset/8), n.Size)
+		if _, e = v.nm.Put(n.Id, uint32(offset/8), stored.Size); e != nil {
+			return 0, v.writeFailed(e)
+		}
+	}
+	v.writeErrors = 0
+	return uint32(len(n.Data)), nil
+}
+
+// writeFailed counts the write error, and turns the volume read only
+// after MaxConsecutiveWriteErrors of them.
+func (v *Volume) writeFailed(e error) error {
+	v.writeErrors++
+	log.Println("Volume", v.Id, "write error", v.writeErrors, "in a row:", e)
+	if v.writeErrors >= MaxConsecutiveWriteErrors && v.state == VolumeGrowing {
+		log.Println("Volume", v.Id, "is read only after", v.writeErrors, "write errors in a row")
+		v.setState(VolumeReadOnly)
+	}
+	return e
+}
+
+// ErrAppendToManifest refuses an append to a chunked file, whose chunks are
+// uploaded as files of their own.
+var ErrAppendToManifest = errors.New("Can not append to a chunked file")
+
+// appendTo writes n with its data appended to the existing content of the same
+// needle, and returns the existing one, or nil if there is none.
+// Compressed contents are appended as concatenated gzip members.
+func (v *Volume) appendTo(n *Needle) (uint32, *Needle, error) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	var old *Needle
+	if nv, ok := v.nm.Get(n.Id); ok && nv.Size > 0 {
+		old = new(Needle)
+		v.dataFile.Seek(int64(nv.Offset)*8, 0)
+		if _, e := old.Read(v.dataFile, nv.Size, v.version); e != nil {
+			return 0, nil, e
+		}
+		if e := v.decrypt(old); e != nil {
+			return 0, nil, e
+		}
+		if old.Cookie != n.Cookie {
+			return 0, nil, ErrCookieMismatch
+		}
+		if old.IsChunkManifest() {
+			return 0, nil, ErrAppendToManifest
+		}
+		n.Data = append(append([]byte(nil), old.Data...), n.Data...)
+		n.Checksum = NewCRC(n.Data)
+		if !n.HasPairs() && old.HasPairs() {
+			n.Pairs = old.Pairs
+			n.Flags |= FlagHasPairs
+		}
 	}
-	return ret
+	size, e := v.writeNeedle(n)
+	return size, old, e
 }
-func (v *Volume) delete(n *Needle) uint32 {
+
+// delete drops the needle from the index, and erases its content, or keeps it
+// in the trash until it is purged.
+func (v *Volume) delete(n *Needle, trash bool) uint32 {
 	v.accessLock.Lock()
 	defer v.accessLock.Unlock()
+	// files can still be deleted from sealed volumes
+	if v.state == VolumeReadOnly {
+		return 0
+	}
 	nv, ok := v.nm.Get(n.Id)
 	//log.Println("key", n.Id, "volume offset", nv.Offset, "data_size", n.Size, "cached size", nv.Size)
-	if ok {
+	if ok && nv.Size > 0 {
+		// the index entry is zeroed by the delete
+		offset, size := nv.Offset, nv.Size
 		v.nm.Delete(n.Id)
-		v.dataFile.Seek(int64(nv.Offset*8), 0)
-		n.Append(v.dataFile)
-		return nv.Size
+		if trash {
+			if e := v.trashNeedle(n.Id, offset, size); e == nil {
+				return size
+			} else {
+				log.Println("Volume", v.Id, "can not keep", n.Id, "in the trash:", e)
+			}
+		}
+		v.eraseNeedle(offset, size)
+		return size
 	}
 	return 0
 }
@@ -103,7 +351,29 @@ func (v *Volume) read(n *Needle) (int, error) {
 	nv, ok := v.nm.Get(n.Id)
 	if ok && nv.Offset > 0 {
 		v.dataFile.Seek(int64(nv.Offset)*8, 0)
-		return n.Read(v.dataFile, nv.Size)
+		count, e := n.Read(v.dataFile, nv.Size, v.version)
+		if e == nil {
+			e = v.decrypt(n)
+		}
+		return count, e
 	}
 	return -1, errors.New("Not Found")
 }
+
+// modifiedSince lists, in the order of writing, the live needles written at
+// or after the unix time since, without their data. The volume is scanned
+// without holding its lock, except to check the needles against the index.
+func (v *Volume) modifiedSince(since uint64) ([]*Needle, error) {
+	if v.version == Version1 {
+		return nil, errors.New("Volume " + v.Id.String() + " does not track modification time")
+	}
+	var needles []*Needle
+	e := v.scan(func(n *Needle) error {
+		if n.LastModified >= since {
+			n.Data, n.Pairs = nil, nil
+			needles = append(needles, n)
+		}
+		return nil
+	})
+	return needles, e
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func appendNeedle(cookie uint32, id uint64, data []byte) *Needle {
+	return &Needle{Cookie: cookie, Id: id, Data: data, Checksum: NewCRC(data)}
+}
+
+func TestVolumeAppend(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_append")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	defer v.Close()
+	first := appendNeedle(0x12345678, 3, []byte("line 1\n"))
+	first.Pairs, first.Flags = []byte(`{"Owner":"chris"}`), FlagHasPairs
+	// appending to a missing file writes it
+	if _, previous, e := v.appendTo(first); e != nil || previous != nil {
+		t.Fatal("append to a new file", previous, e)
+	}
+	if _, _, e = v.appendTo(appendNeedle(0x12345678, 3, []byte("line 2\n"))); e != nil {
+		t.Fatal(e)
+	}
+	n := &Needle{Id: 3}
+	if _, e = v.read(n); e != nil || string(n.Data) != "line 1\nline 2\n" {
+		t.Fatal("unexpected appended needle", string(n.Data), e)
+	}
+	if pairs := n.GetPairs(); pairs["Owner"] != "chris" {
+		t.Error("the name value pairs are not kept", pairs)
+	}
+	if _, _, e = v.appendTo(appendNeedle(1, 3, []byte("line 3\n"))); e == nil {
+		t.Error("appended with another cookie")
+	}
+
+	// compressed contents are appended as gzip members, read back as one
+	if _, _, e = v.appendTo(appendNeedle(0x12345678, 4, GzipData([]byte("gzipped 1\n")))); e != nil {
+		t.Fatal(e)
+	}
+	if _, _, e = v.appendTo(appendNeedle(0x12345678, 4, GzipData([]byte("gzipped 2\n")))); e != nil {
+		t.Fatal(e)
+	}
+	n = &Needle{Id: 4}
+	if _, e = v.read(n); e != nil || string(UnGzipData(n.Data)) != "gzipped 1\ngzipped 2\n" {
+		t.Error("unexpected appended gzipped needle", string(UnGzipData(n.Data)), e)
+	}
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"pkg/util"
+)
+
+// clone makes a copy of the sealed volume under a new id, in the same directory.
+// The data file is reflinked, or hard linked where the file system can not
+// reflink, so the clone takes no space until one of the two volumes changes it.
+// The index and the data keys are copied. The trash is not, so the clone only
+// has the live files.
+func (v *Volume) clone(id VolumeId) (*Volume, error) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.InMemory() {
+		return nil, errors.New("Volume " + v.Id.String() + " is in memory and can not be cloned")
+	}
+	if v.Offloaded() {
+		return nil, errors.New("Volume " + v.Id.String() + " is offloaded and can not be cloned")
+	}
+	if v.state != VolumeSealed {
+		return nil, errors.New("Volume " + v.Id.String() + " is " + string(v.state) + ", only sealed volumes can be cloned")
+	}
+	c := &Volume{dir: v.dir, Collection: v.Collection, Id: id}
+	from, to := v.FileName(), c.FileName()
+	if _, e := os.Stat(to + ".dat"); e == nil {
+		return nil, errors.New("Volume " + id.String() + " already has a data file " + to + ".dat")
+	}
+	if e := util.Fsync(v.dataFile); e != nil {
+		return nil, e
+	}
+	linked, e := linkFile(from+".dat", to+".dat")
+	if e != nil {
+		return nil, e
+	}
+	if e = copyFile(from+".idx", to+".idx"); e == nil && v.dataKeys != nil {
+		e = copyFile(from+".key", to+".key")
+	}
+	if e != nil {
+		os.Remove(to + ".dat")
+		os.Remove(to + ".idx")
+		return nil, e
+	}
+	v.shared = v.shared || linked
+	log.Println("Volume", v.Id, "is cloned as volume", id, "linked:", linked)
+	return NewVolume(v.dir, v.Collection, id, CopyNil), nil
+}
+
+// linkFile makes to share the content of from, with a reflink, which copies
+// the blocks on write, or else a hard link, which shares the file itself.
+// It tells if the file is hard linked.
+func linkFile(from, to string) (bool, error) {
+	if e := reflinkFile(from, to); e == nil {
+		return false, nil
+	}
+	if e := os.Link(from, to); e != nil {
+		return false, e
+	}
+	return true, nil
+}
+
+func copyFile(from, to string) error {
+	src, e := os.Open(from)
+	if e != nil {
+		return e
+	}
+	defer src.Close()
+	dst, e := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if e != nil {
+		return e
+	}
+	if _, e = io.Copy(dst, src); e == nil {
+		e = util.Fsync(dst)
+	}
+	if ce := dst.Close(); e == nil {
+		e = ce
+	}
+	if e != nil {
+		os.Remove(to)
+	}
+	return e
+}
+
+// unshare gives the volume a data file of its own, before it is changed in
+// place, if the data file is hard linked with a clone.
+// The caller holds the access lock.
+func (v *Volume) unshare() error {
+	if !v.shared {
+		return nil
+	}
+	if linkCount(v.dataFile) <= 1 {
+		// the clones have their own data files already, or were deleted
+		v.shared = false
+		return nil
+	}
+	fileName := v.FileName()
+	os.Remove(fileName + ".dat.unshare")
+	if e := copyFile(fileName+".dat", fileName+".dat.unshare"); e != nil {
+		return e
+	}
+	if e := os.Rename(fileName+".dat.unshare", fileName+".dat"); e != nil {
+		os.Remove(fileName + ".dat.unshare")
+		return e
+	}
+	dataFile, e := openVolumeFile(fileName+".dat", os.O_RDWR)
+	if e != nil {
+		return e
+	}
+	v.dataFile.Close()
+	v.dataFile, v.shared = dataFile, false
+	log.Println("Volume", v.Id, "has its own data file now")
+	return nil
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, which reflinks a whole file on btrfs, xfs and others.
+const ficlone = 0x40049409
+
+func reflinkFile(from, to string) error {
+	src, e := os.Open(from)
+	if e != nil {
+		return e
+	}
+	defer src.Close()
+	dst, e := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if e != nil {
+		return e
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	dst.Close()
+	if errno != 0 {
+		os.Remove(to)
+		return errno
+	}
+	return nil
+}
+
+// linkCount is the number of hard links to the file.
+func linkCount(f volumeFile) int {
+	if stat, e := f.Stat(); e == nil {
+		if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+			return int(sys.Nlink)
+		}
+	}
+	return 1
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCloneVolume(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_clone")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "pics", VolumeId(1), Copy000)
+	defer v.Close()
+	v.write(newTestNeedle(1))
+	v.write(newTestNeedle(2))
+	if _, e = v.clone(VolumeId(2)); e == nil {
+		t.Fatal("a growing volume should not be cloned")
+	}
+	if e = v.SetState(VolumeSealed); e != nil {
+		t.Fatal(e)
+	}
+	c, e := v.clone(VolumeId(2))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+	if c.Collection != "pics" || c.State() != VolumeSealed || c.Size() != v.Size() {
+		t.Fatal("the clone should be a sealed copy in the same collection", c.Collection, c.State(), c.Size())
+	}
+	if _, e = v.clone(VolumeId(2)); e == nil {
+		t.Fatal("a volume should not be cloned over an existing one")
+	}
+
+	size := v.Size()
+	if e = c.SetState(VolumeGrowing); e != nil {
+		t.Fatal(e)
+	}
+	c.write(newTestNeedle(3))
+	c.delete(newTestNeedle(1), false)
+	if v.Size() != size || v.State() != VolumeSealed {
+		t.Fatal("changing the clone should not change the volume", v.Size(), v.State())
+	}
+	for _, id := range []uint64{1, 2} {
+		if _, e = v.read(newTestNeedle(id)); e != nil {
+			t.Fatal("the volume should still have needle", id, e)
+		}
+	}
+	if _, e = c.read(newTestNeedle(1)); e == nil {
+		t.Fatal("needle 1 was deleted from the clone")
+	}
+	if _, e = c.read(newTestNeedle(3)); e != nil {
+		t.Fatal("the clone should have needle 3", e)
+	}
+
+	v.delete(newTestNeedle(2), false)
+	if _, e = c.read(newTestNeedle(2)); e != nil {
+		t.Fatal("deleting from the volume should not erase the needle of the clone", e)
+	}
+}
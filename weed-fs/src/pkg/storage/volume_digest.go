@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+)
+
+// VolumeDigest sums up the live needles of a volume, to compare two copies of
+// it, e.g. a backup and its restore, whatever the order of their needles.
+type VolumeDigest struct {
+	Id        VolumeId
+	FileCount int    // live needles
+	Bytes     int64  // of their content, as stored, and decrypted
+	Digest    string // the sum of a hash of the key, the cookie and the content CRC of each needle
+}
+
+// digest scans the live needles, checking the content of each of them.
+func (v *Volume) digest() (*VolumeDigest, error) {
+	d := &VolumeDigest{Id: v.Id}
+	var sum uint64
+	buf := make([]byte, 16)
+	e := v.scan(func(n *Needle) error {
+		binary.BigEndian.PutUint64(buf[0:8], n.Id)
+		binary.BigEndian.PutUint32(buf[8:12], n.Cookie)
+		binary.BigEndian.PutUint32(buf[12:16], NewCRC(n.Data).Value())
+		hash := sha256.Sum256(buf)
+		sum += binary.BigEndian.Uint64(hash[:8])
+		d.FileCount++
+		d.Bytes += int64(len(n.Data))
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	d.Digest = strconv.FormatUint(sum, 16)
+	return d, nil
+}
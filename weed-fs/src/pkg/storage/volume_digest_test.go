@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestVolumeDigest(t *testing.T) {
+	a := NewMemoryVolume("", VolumeId(1), Copy000)
+	b := NewMemoryVolume("", VolumeId(1), Copy000)
+	for _, id := range []uint64{1, 2, 3} {
+		a.write(newTestNeedle(id))
+	}
+	// the same files, with needle 1 written again after the others, and a deleted one
+	for _, id := range []uint64{1, 2, 3, 4, 1} {
+		b.write(newTestNeedle(id))
+	}
+	b.delete(newTestNeedle(4), false)
+	da, e := a.digest()
+	if e != nil {
+		t.Fatal(e)
+	}
+	db, e := b.digest()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if da.FileCount != 3 || *da != *db {
+		t.Fatal("the digests of the same files should match", da, db)
+	}
+
+	changed := newTestNeedle(2)
+	changed.Data = []byte("other content")
+	changed.Checksum = NewCRC(changed.Data)
+	b.write(changed)
+	if db, e = b.digest(); e != nil || db.Digest == da.Digest {
+		t.Fatal("a changed file should change the digest")
+	}
+}
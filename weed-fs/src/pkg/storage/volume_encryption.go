@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"pkg/util"
+	"strings"
+)
+
+// With a master key, a volume encrypts the data of its needles with AES-GCM,
+// with a data key of its own, kept in its .key file wrapped with the master
+// key, so the .dat file is useless without the master key. The CRC is over
+// the encrypted data, so the needles can be checked without any key. The
+// needles written before the volume got a key stay readable.
+
+const FlagEncrypted = 0x04
+
+var ErrNoDataKey = errors.New("Volume is encrypted, and there is no master key to decrypt it")
+
+// ParseMasterKey reads a 32 byte AES-256 master key, raw or in hex.
+func ParseMasterKey(data []byte) ([]byte, error) {
+	if trimmed := strings.TrimSpace(string(data)); len(trimmed) == 64 {
+		if key, err := hex.DecodeString(trimmed); err == nil {
+			return key, nil
+		}
+	}
+	if len(data) != 32 {
+		return nil, errors.New("The master key should be 32 bytes, or 64 hex digits")
+	}
+	return data, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the data with a random nonce, which is put before the encrypted data.
+func seal(aead cipher.AEAD, data, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Encrypted data too short! Data On Disk Corrupted!")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+// dataKey is a data key of a volume. A volume has two of them only while its
+// needles are re-encrypted from the old one to the new one.
+type dataKey struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+func newDataKey(key []byte) (*dataKey, error) {
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{key: key, aead: aead}, nil
+}
+
+// wrappedKeySize is the size of a data key wrapped with the master key: the
+// nonce, the key, and the GCM tag. The .key file has one per data key.
+const wrappedKeySize = 12 + 32 + 16
+
+// setMasterKey loads the data keys of the volume from its .key file, or
+// creates one. Volumes in memory get a data key in memory.
+func (v *Volume) setMasterKey(masterKey []byte) error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.version == Version1 {
+		log.Println("Volume", v.Id, "is version 1, and can not be encrypted")
+		return nil
+	}
+	if v.InMemory() {
+		if v.dataKeys == nil {
+			key, err := newDataKey(nil)
+			if err != nil {
+				return err
+			}
+			v.dataKeys = []*dataKey{key}
+		}
+		return nil
+	}
+	keyFileName := v.FileName() + ".key"
+	keys, err := v.readKeyFile(keyFileName, masterKey)
+	if err != nil && !os.IsNotExist(err) {
+		// a master key rotation cut short leaves the keys wrapped with the new master key in .key.new
+		if newKeys, e := v.readKeyFile(keyFileName+".new", masterKey); e == nil {
+			keys, err = newKeys, os.Rename(keyFileName+".new", keyFileName)
+		}
+	}
+	if os.IsNotExist(err) {
+		var key *dataKey
+		if key, err = newDataKey(nil); err == nil {
+			keys = []*dataKey{key}
+			err = v.writeKeyFile(keyFileName, masterKey, keys)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	v.dataKeys = keys
+	return nil
+}
+
+func (v *Volume) readKeyFile(fileName string, masterKey []byte) ([]*dataKey, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	wrapping, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%wrappedKeySize != 0 {
+		return nil, errors.New(fileName + " is not a key file")
+	}
+	var keys []*dataKey
+	for ; len(data) > 0; data = data[wrappedKeySize:] {
+		raw, err := open(wrapping, data[:wrappedKeySize], []byte(v.Id.String()))
+		if err != nil {
+			return nil, errors.New("Can not decrypt the data key of volume " + v.Id.String() + " with the master key: " + err.Error())
+		}
+		key, err := newDataKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// writeKeyFile replaces the file with the keys wrapped with the master key,
+// synced before it is renamed in place, so it is never seen half written.
+func (v *Volume) writeKeyFile(fileName string, masterKey []byte, keys []*dataKey) error {
+	wrapping, err := newGCM(masterKey)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, key := range keys {
+		wrapped, err := seal(wrapping, key.key, []byte(v.Id.String()))
+		if err != nil {
+			return err
+		}
+		data = append(data, wrapped...)
+	}
+	f, err := os.OpenFile(fileName+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = util.Fsync(f)
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(fileName+".tmp", fileName)
+	}
+	if err != nil {
+		os.Remove(fileName + ".tmp")
+	}
+	return err
+}
+
+// prepareMasterKey writes the data keys wrapped with the new master key to
+// .key.new, and commitMasterKey moves it in place of .key. A rotation of the
+// master key prepares all the volumes before it commits any.
+func (v *Volume) prepareMasterKey(masterKey []byte) error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.dataKeys == nil || v.InMemory() {
+		return nil
+	}
+	return v.writeKeyFile(v.FileName()+".key.new", masterKey, v.dataKeys)
+}
+func (v *Volume) commitMasterKey() error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.dataKeys == nil || v.InMemory() {
+		return nil
+	}
+	return os.Rename(v.FileName()+".key.new", v.FileName()+".key")
+}
+
+// reencrypt rewrites the live needles with a new data key, like a compaction,
+// and drops the old data key. The needles written before the volume was
+// encrypted are encrypted too. progress is called with the bytes read so far
+// and the size of the volume.
+func (v *Volume) reencrypt(masterKey []byte, progress func(done, total int64)) error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.dataKeys == nil {
+		return errors.New("Volume " + v.Id.String() + " is not encrypted")
+	}
+	key, err := newDataKey(nil)
+	if err != nil {
+		return err
+	}
+	keys := append(v.dataKeys[:len(v.dataKeys):len(v.dataKeys)], key)
+	keyFileName := v.FileName() + ".key"
+	// both keys are kept until the needles are all rewritten, in case it is cut short
+	if !v.InMemory() {
+		if err = v.writeKeyFile(keyFileName, masterKey, keys); err != nil {
+			return err
+		}
+	}
+	v.dataKeys = keys
+	total := v.Size()
+	// the needles are rewritten without the volume lock, with the keys as they are now
+	err = v.rewrite(v.version, func(n *Needle, offset int64) (*Needle, error) {
+		if progress != nil {
+			progress(offset, total)
+		}
+		if e := decryptWith(keys, n); e != nil {
+			return nil, e
+		}
+		return encryptedWith(keys, n)
+	})
+	if err != nil {
+		return err
+	}
+	v.dataKeys = []*dataKey{key}
+	if progress != nil {
+		progress(total, total)
+	}
+	if v.InMemory() {
+		return nil
+	}
+	return v.writeKeyFile(keyFileName, masterKey, v.dataKeys)
+}
+
+// needleAdditionalData binds the encrypted data to the needle, so it can
+// not be moved to another needle.
+func needleAdditionalData(n *Needle) []byte {
+	b := make([]byte, 12)
+	util.Uint64toBytes(b[0:8], n.Id)
+	util.Uint32toBytes(b[8:12], n.Cookie)
+	return b
+}
+
+// encrypted returns the needle to store for n, with its data encrypted if the
+// volume has a data key. n itself is not changed.
+func (v *Volume) encrypted(n *Needle) (*Needle, error) {
+	return encryptedWith(v.dataKeys, n)
+}
+func encryptedWith(keys []*dataKey, n *Needle) (*Needle, error) {
+	if keys == nil {
+		return n, nil
+	}
+	data, err := seal(keys[len(keys)-1].aead, n.Data, needleAdditionalData(n))
+	if err != nil {
+		return nil, err
+	}
+	stored := *n
+	stored.Data, stored.Flags, stored.Checksum = data, n.Flags|FlagEncrypted, NewCRC(data)
+	return &stored, nil
+}
+
+// decrypt decrypts the data of the needle read from the volume, if encrypted.
+func (v *Volume) decrypt(n *Needle) error {
+	return decryptWith(v.dataKeys, n)
+}
+func decryptWith(keys []*dataKey, n *Needle) error {
+	if n.Flags&FlagEncrypted == 0 {
+		return nil
+	}
+	if keys == nil {
+		return ErrNoDataKey
+	}
+	var data []byte
+	var err error
+	for i := len(keys) - 1; i >= 0; i-- {
+		if data, err = open(keys[i].aead, n.Data, needleAdditionalData(n)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	n.Data, n.DataSize, n.Flags = data, uint32(len(data)), n.Flags&^FlagEncrypted
+	return nil
+}
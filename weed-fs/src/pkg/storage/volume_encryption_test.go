@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestEncryptedVolume(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_encryption")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	masterKey := bytes.Repeat([]byte{7}, 32)
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	if _, e = v.write(newTestNeedle(1)); e != nil {
+		t.Fatal(e)
+	}
+	if e = v.setMasterKey(masterKey); e != nil {
+		t.Fatal(e)
+	}
+	for i := uint64(2); i <= 3; i++ {
+		if _, e = v.write(newTestNeedle(i)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	v.Close()
+
+	data, _ := ioutil.ReadFile(v.FileName() + ".dat")
+	if !bytes.Contains(data, newTestNeedle(1).Data) || bytes.Contains(data, newTestNeedle(2).Data) {
+		t.Fatal("only the needle written before the master key should be in clear")
+	}
+
+	v = NewVolume(dir, "", VolumeId(1), CopyNil)
+	if e = v.setMasterKey(bytes.Repeat([]byte{8}, 32)); e == nil {
+		t.Fatal("expecting a wrong master key to be refused")
+	}
+	v.Close()
+	v = NewVolume(dir, "", VolumeId(1), CopyNil)
+	defer v.Close()
+	n := &Needle{Id: 2}
+	if _, e = v.read(n); e != ErrNoDataKey {
+		t.Fatal("expecting", ErrNoDataKey, "without the master key, got", e)
+	}
+	if e = v.setMasterKey(masterKey); e != nil {
+		t.Fatal(e)
+	}
+	if e = v.compact(); e != nil {
+		t.Fatal(e)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		n := &Needle{Id: i}
+		if _, e := v.read(n); e != nil {
+			t.Fatal("needle", i, "read error:", e)
+		}
+		if string(n.Data) != string(newTestNeedle(i).Data) {
+			t.Fatal("needle", i, "has unexpected data", string(n.Data))
+		}
+	}
+	_, previous, e := v.appendTo(&Needle{Cookie: 0x12345678, Id: 3, Data: []byte(" appended")})
+	if e != nil {
+		t.Fatal(e)
+	}
+	n = &Needle{Id: 3}
+	if _, e = v.read(n); e != nil || string(n.Data) != "needle content 3 appended" {
+		t.Fatal("unexpected appended needle", string(n.Data), e)
+	}
+	// a failed append is rolled back by writing the previous content again
+	if previous == nil || string(previous.Data) != "needle content 3" {
+		t.Fatal("unexpected content before the append", previous)
+	}
+	if _, e = v.writeNeedle(previous); e != nil {
+		t.Fatal(e)
+	}
+	n = &Needle{Id: 3}
+	if _, e = v.read(n); e != nil || string(n.Data) != "needle content 3" {
+		t.Fatal("unexpected rolled back needle", string(n.Data), e)
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_rotation")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey, newKey := bytes.Repeat([]byte{7}, 32), bytes.Repeat([]byte{8}, 32)
+	s := NewStore(8080, "localhost", "localhost:8080", []string{dir}, []int{2})
+	if e = s.AddVolume("1", "", "000"); e != nil {
+		t.Fatal(e)
+	}
+	if _, e = s.Write(VolumeId(1), newTestNeedle(1)); e != nil {
+		t.Fatal(e)
+	}
+	if e = s.SetMasterKey(oldKey); e != nil {
+		t.Fatal(e)
+	}
+	for i := uint64(2); i <= 4; i++ {
+		if _, e = s.Write(VolumeId(1), newTestNeedle(i)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	s.Delete(VolumeId(1), newTestNeedle(3))
+	if e = s.RotateMasterKey(newKey); e != nil {
+		t.Fatal(e)
+	}
+	var progress []int64
+	if e = s.ReencryptVolume("1", func(done, total int64) { progress = append(progress, done, total) }); e != nil {
+		t.Fatal(e)
+	}
+	// the 3 live needles, then the end
+	if len(progress) != 8 || progress[6] != progress[7] {
+		t.Fatal("unexpected progress", progress)
+	}
+	s.Close()
+
+	data, _ := ioutil.ReadFile(path.Join(dir, "1.dat"))
+	if bytes.Contains(data, newTestNeedle(1).Data) {
+		t.Fatal("the needle written before the master key should be encrypted too")
+	}
+	s = NewStore(8080, "localhost", "localhost:8080", []string{dir}, []int{2})
+	defer s.Close()
+	if e = s.SetMasterKey(oldKey); e == nil {
+		t.Fatal("expecting the old master key to be refused")
+	}
+	if e = s.SetMasterKey(newKey); e != nil {
+		t.Fatal(e)
+	}
+	for _, i := range []uint64{1, 2, 4} {
+		n := &Needle{Id: i}
+		if _, e := s.Read(VolumeId(1), n); e != nil || string(n.Data) != string(newTestNeedle(i).Data) {
+			t.Fatal("needle", i, "read", string(n.Data), e)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// volumeFile is where a volume keeps its data or its index: an *os.File, or a
+// memoryFile for the volumes of a memory store.
+type volumeFile interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// memoryFile is a volumeFile kept in memory, with no file behind it. Closing
+// it keeps the content, which goes away with the last reference to it.
+type memoryFile struct {
+	name     string
+	lock     sync.Mutex
+	data     []byte
+	position int64
+	modified time.Time
+}
+
+var errNegativeOffset = errors.New("Negative offset")
+
+func newMemoryFile(name string) *memoryFile {
+	return &memoryFile{name: name, modified: time.Now()}
+}
+
+func (f *memoryFile) Read(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.readAt(b, f.position)
+	f.position += int64(n)
+	if n > 0 {
+		return n, nil
+	}
+	return n, err
+}
+
+func (f *memoryFile) ReadAt(b []byte, offset int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.readAt(b, offset)
+}
+
+func (f *memoryFile) readAt(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	if offset >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memoryFile) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.writeAt(b, f.position)
+	f.position += int64(n)
+	return n, err
+}
+
+func (f *memoryFile) WriteAt(b []byte, offset int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.writeAt(b, offset)
+}
+
+func (f *memoryFile) writeAt(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	if end := offset + int64(len(b)); end > int64(len(f.data)) {
+		f.resize(end)
+	}
+	f.modified = time.Now()
+	return copy(f.data[offset:], b), nil
+}
+
+// resize grows or shrinks the content, zero filling the bytes added.
+func (f *memoryFile) resize(size int64) {
+	if size <= int64(cap(f.data)) {
+		old := len(f.data)
+		f.data = f.data[:size]
+		for i := old; i < len(f.data); i++ {
+			f.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, f.data)
+	f.data = data
+}
+
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch whence {
+	case 1:
+		offset += f.position
+	case 2:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	f.position = offset
+	return offset, nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if size < 0 {
+		return errNegativeOffset
+	}
+	f.resize(size)
+	f.modified = time.Now()
+	return nil
+}
+
+func (f *memoryFile) Name() string {
+	return f.name
+}
+
+func (f *memoryFile) Stat() (os.FileInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return &memoryFileInfo{name: f.name, size: int64(len(f.data)), modified: f.modified}, nil
+}
+
+func (f *memoryFile) Sync() error {
+	return nil
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
+
+type memoryFileInfo struct {
+	name     string
+	size     int64
+	modified time.Time
+}
+
+func (i *memoryFileInfo) Name() string       { return i.name }
+func (i *memoryFileInfo) Size() int64        { return i.size }
+func (i *memoryFileInfo) Mode() os.FileMode  { return 0644 }
+func (i *memoryFileInfo) ModTime() time.Time { return i.modified }
+func (i *memoryFileInfo) IsDir() bool        { return false }
+func (i *memoryFileInfo) Sys() interface{}   { return nil }
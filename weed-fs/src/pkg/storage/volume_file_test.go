@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(8080, "localhost", "localhost:8080", 2)
+	if e := s.AddVolume("1-2", "", "000"); e != nil {
+		t.Fatal(e)
+	}
+	if e := s.AddVolume("3", "", "000"); e == nil {
+		t.Fatal("expecting no free volume slot")
+	}
+	for i := uint64(1); i <= 10; i++ {
+		if _, e := s.Write(VolumeId(1), newTestNeedle(i)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	for i := uint64(1); i <= 10; i += 2 {
+		s.Delete(VolumeId(1), newTestNeedle(i))
+	}
+	sizeBefore := s.GetVolume(VolumeId(1)).Size()
+	if e := s.CompactVolume("1"); e != nil {
+		t.Fatal(e)
+	}
+	if size := s.GetVolume(VolumeId(1)).Size(); size >= sizeBefore {
+		t.Fatal("volume size", size, "not reduced from", sizeBefore)
+	}
+	var scanned []uint64
+	if e := s.Scan("1", func(n *Needle) error { scanned = append(scanned, n.Id); return nil }); e != nil {
+		t.Fatal(e)
+	}
+	if len(scanned) != 5 {
+		t.Fatal("expecting the 5 live needles, scanned", scanned)
+	}
+	for i := uint64(2); i <= 10; i += 2 {
+		n := &Needle{Id: i}
+		if _, e := s.Read(VolumeId(1), n); e != nil {
+			t.Fatal("needle", i, "read error:", e)
+		}
+		if string(n.Data) != string(newTestNeedle(i).Data) {
+			t.Fatal("needle", i, "has unexpected data", string(n.Data))
+		}
+	}
+	if e := s.DeleteVolume("1"); e != nil {
+		t.Fatal(e)
+	}
+	if s.HasVolume(VolumeId(1)) {
+		t.Fatal("volume 1 should be deleted")
+	}
+	s.CheckDiskLocations()
+	if s.MaxVolumeCount() != 2 {
+		t.Fatal("the memory location should not fail")
+	}
+}
+
+func TestMemoryFile(t *testing.T) {
+	f := newMemoryFile("test")
+	f.Write([]byte("hello"))
+	f.WriteAt([]byte("!"), 7)
+	if stat, _ := f.Stat(); stat.Size() != 8 {
+		t.Fatal("expecting 8 bytes, got", stat.Size())
+	}
+	b := make([]byte, 8)
+	if n, _ := f.ReadAt(b, 0); n != 8 || string(b) != "hello\x00\x00!" {
+		t.Fatalf("unexpected content %q", b[:n])
+	}
+	f.Truncate(4)
+	f.Seek(0, 0)
+	if n, e := f.Read(b); n != 4 || string(b[:n]) != "hell" || e != nil {
+		t.Fatalf("unexpected content %q after truncate, error %v", b[:n], e)
+	}
+	f.Truncate(6)
+	if n, _ := f.ReadAt(b, 0); string(b[:n]) != "hell\x00\x00" {
+		t.Fatalf("truncate should zero fill, got %q", b[:n])
+	}
+}
+
+func TestWriteReplica(t *testing.T) {
+	s := NewMemoryStore(8080, "localhost", "localhost:8080", 1)
+	if e := s.AddVolume("1", "", "000"); e != nil {
+		t.Fatal(e)
+	}
+	v := s.GetVolume(VolumeId(1))
+	s.WriteReplica(VolumeId(1), newTestNeedle(1))
+	size := v.Size()
+	if _, e := s.WriteReplica(VolumeId(1), newTestNeedle(1)); e != nil {
+		t.Fatal(e)
+	}
+	if v.Size() != size || s.RetriedWrites() != 1 {
+		t.Fatal("the retried write should not be appended again", v.Size(), size)
+	}
+	changed := newTestNeedle(1)
+	changed.Data = []byte("another content")
+	changed.Checksum = NewCRC(changed.Data)
+	s.WriteReplica(VolumeId(1), changed)
+	if v.Size() == size || s.RetriedWrites() != 1 {
+		t.Fatal("a new content should be written", v.Size(), size)
+	}
+	// needle 1 is not the last one written any more
+	s.WriteReplica(VolumeId(1), newTestNeedle(2))
+	size = v.Size()
+	s.WriteReplica(VolumeId(1), changed)
+	if v.Size() == size {
+		t.Fatal("only the last needle written is taken as a retry")
+	}
+}
+
+func TestWriteRefusesAnotherCookie(t *testing.T) {
+	s := NewMemoryStore(8080, "localhost", "localhost:8080", 1)
+	if e := s.AddVolume("1", "", "000"); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := s.Write(VolumeId(1), newTestNeedle(1)); e != nil {
+		t.Fatal(e)
+	}
+	guessed := newTestNeedle(1)
+	guessed.Cookie++
+	guessed.Data = []byte("overwritten")
+	guessed.Checksum = NewCRC(guessed.Data)
+	if _, e := s.Write(VolumeId(1), guessed); e != ErrCookieMismatch {
+		t.Fatal("expecting", ErrCookieMismatch, "got", e)
+	}
+	if _, e := s.WriteReplica(VolumeId(1), guessed); e != ErrCookieMismatch {
+		t.Fatal("expecting", ErrCookieMismatch, "from a replica, got", e)
+	}
+	n := &Needle{Id: 1}
+	if _, e := s.Read(VolumeId(1), n); e != nil || string(n.Data) != string(newTestNeedle(1).Data) {
+		t.Fatal("the file should be kept, got", string(n.Data), e)
+	}
+	s.Delete(VolumeId(1), newTestNeedle(1))
+	if _, e := s.Write(VolumeId(1), guessed); e != nil {
+		t.Fatal("a deleted file can be written again,", e)
+	}
+}
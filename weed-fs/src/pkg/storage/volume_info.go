@@ -5,11 +5,18 @@ import (
 )
 
 type VolumeInfo struct {
-	Id      VolumeId
-	Size    int64
-	RepType ReplicationType
-	FileCount int
-	DeleteCount int
+	Id               VolumeId
+	Size             int64
+	RepType          ReplicationType
+	FileCount        int
+	DeleteCount      int
+	DeletedByteCount uint64
+	AverageFileSize  uint64
+	Version          Version
+	Collection       string
+	DiskType         string
+	State            VolumeState
+	Offloaded        bool // the data file is in the remote tier
 }
 type ReplicationType string
 
@@ -20,7 +27,8 @@ const (
 	Copy100               = ReplicationType("100") // 2 copies, each on different data center
 	Copy110               = ReplicationType("110") // 3 copies, 2 on different racks and local data center, 1 on different data center
 	Copy200               = ReplicationType("200") // 3 copies, each on dffereint data center
-	LengthRelicationType = 6
+	Copy1000              = ReplicationType("1000") // 2 copies, each on different region
+	LengthRelicationType = 7
 	CopyNil              = ReplicationType(255) // nil value
 )
 
@@ -38,6 +46,8 @@ func NewReplicationTypeFromString(t string) (ReplicationType, error) {
 		return Copy110, nil
 	case "200":
 		return Copy200, nil
+	case "1000":
+		return Copy1000, nil
 	}
 	return Copy000, errors.New("Unknown Replication Type:"+t)
 }
@@ -55,6 +65,8 @@ func NewReplicationTypeFromByte(b byte) (ReplicationType, error) {
     return Copy110, nil
   case byte(200):
     return Copy200, nil
+  case byte(232): // 1000 truncated to a byte
+    return Copy1000, nil
   }
   return Copy000, errors.New("Unknown Replication Type:"+string(b))
 }
@@ -73,6 +85,8 @@ func (r *ReplicationType) String() string {
 		return "110"
 	case Copy200:
 		return "200"
+	case Copy1000:
+		return "1000"
 	}
 	return "000"
 }
@@ -90,6 +104,8 @@ func (r *ReplicationType) Byte() byte {
     return byte(110)
   case Copy200:
     return byte(200)
+  case Copy1000:
+    return byte(232)
   }
   return byte(000)
 }
@@ -108,6 +124,8 @@ func (repType ReplicationType)GetReplicationLevelIndex() int {
 		return 4
 	case Copy200:
 		return 5
+	case Copy1000:
+		return 6
 	}
 	return -1
 }
@@ -125,6 +143,8 @@ func (repType ReplicationType)GetCopyCount() int {
 		return 3
 	case Copy200:
 		return 3
+	case Copy1000:
+		return 2
 	}
 	return 0
 }
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"pkg/util"
+	"sync/atomic"
+)
+
+// mirrorFileExtensions are the files of a volume copied to a mirror of it. The
+// data file goes first, so that the index copied after it has the deletes made
+// meanwhile. The key file is only there when the volume is encrypted.
+var mirrorFileExtensions = []string{".dat", ".idx", ".key"}
+
+// ReadCounts is the number of reads of each volume since the server started,
+// sent with the heartbeats, so the master finds the hot volumes.
+func (s *Store) ReadCounts() map[VolumeId]uint64 {
+	counts := make(map[VolumeId]uint64)
+	for _, v := range s.allVolumes() {
+		if reads := atomic.LoadUint64(&v.reads); reads > 0 {
+			counts[v.Id] = reads
+		}
+	}
+	return counts
+}
+
+// OpenVolumeFile opens the .dat, .idx or .key file of the volume, to be copied
+// by another volume server mirroring it, or replicating it. The volume is sealed,
+// or pinned by a snapshot, so that its files do not change, or only grow.
+func (s *Store) OpenVolumeFile(volumeIdString string, ext string) (*os.File, error) {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return nil, errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	v := s.findVolume(vid)
+	if v == nil {
+		return nil, errors.New("Volume Id " + vid.String() + " is not found!")
+	}
+	if ext != ".dat" && ext != ".idx" && ext != ".key" {
+		return nil, errors.New("Volume files are .dat, .idx or .key, not " + ext)
+	}
+	v.accessLock.Lock()
+	state, inMemory, offloaded, pinned := v.state, v.InMemory(), v.Offloaded(), v.pinned()
+	v.accessLock.Unlock()
+	if inMemory {
+		return nil, errors.New("Volume " + vid.String() + " is in memory and can not be mirrored")
+	}
+	if offloaded {
+		return nil, errors.New("Volume " + vid.String() + " is offloaded and can not be mirrored")
+	}
+	if state != VolumeSealed && !pinned {
+		return nil, errors.New("Volume " + vid.String() + " is " + string(state) + ", only sealed or pinned volumes can be copied")
+	}
+	return os.Open(v.FileName() + ext)
+}
+
+// MirrorVolume copies the sealed volume from another volume server, fetch
+// writing each of its files, and loads the copy. fetch returns an error passing
+// os.IsNotExist for the .key file of a volume that is not encrypted.
+// The mirror is read only, as it is sealed, and is deleted like any replica.
+func (s *Store) MirrorVolume(volumeIdString string, collection string, fetch func(ext string, w io.Writer) error) error {
+	return s.copyVolume(volumeIdString, collection, func(fileName string) ([]string, error) {
+		var fetched []string
+		for _, ext := range mirrorFileExtensions {
+			err := fetchVolumeFile(fileName+ext+".mirror", ext, fetch)
+			if ext == ".key" && os.IsNotExist(err) {
+				os.Remove(fileName + ext + ".mirror")
+				break
+			}
+			fetched = append(fetched, ext)
+			if err != nil {
+				return fetched, err
+			}
+		}
+		return fetched, nil
+	}, func(v *Volume) error {
+		if v.state != VolumeSealed {
+			return errors.New("Volume " + v.Id.String() + " was not sealed on the source, and is not mirrored")
+		}
+		return nil
+	})
+}
+
+// copyVolume copies a volume from another volume server into the directory
+// with the most free slots, and loads it. fetchFiles writes the files of the
+// volume under fileName, each with its extension and a .mirror suffix, and
+// returns the extensions it wrote, even partly. check refuses the loaded copy.
+func (s *Store) copyVolume(volumeIdString string, collection string, fetchFiles func(fileName string) ([]string, error), check func(v *Volume) error) error {
+	vid, err := NewVolumeId(volumeIdString)
+	if err != nil {
+		return errors.New("Volume Id " + volumeIdString + " is not a valid unsigned integer!")
+	}
+	if err := CheckCollectionName(collection); err != nil {
+		return err
+	}
+	s.lock.RLock()
+	var location *DiskLocation
+	for _, l := range s.locations {
+		if !l.InMemory && l.FreeCount() > 0 && (location == nil || l.FreeCount() > location.FreeCount()) {
+			location = l
+		}
+	}
+	exists := s.findVolumeLocked(vid) != nil
+	s.lock.RUnlock()
+	if exists {
+		return errors.New("Volume Id " + vid.String() + " already exists!")
+	}
+	if location == nil {
+		return errors.New("No free volume slot left for volume " + vid.String() + "!")
+	}
+	fileName := path.Join(location.Directory, vid.String())
+	if collection != "" {
+		fileName = path.Join(location.Directory, collection+"_"+vid.String())
+	}
+	if _, e := os.Stat(fileName + ".dat"); e == nil {
+		return errors.New("Volume " + vid.String() + " already has a data file " + fileName + ".dat")
+	}
+	// the files are fetched without holding the store lock, under temporary names
+	fetched, err := fetchFiles(fileName)
+	removeFetched := func() {
+		for _, ext := range fetched {
+			os.Remove(fileName + ext + ".mirror")
+			os.Remove(fileName + ext)
+		}
+	}
+	if err != nil {
+		removeFetched()
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.findVolumeLocked(vid) != nil {
+		removeFetched()
+		return errors.New("Volume Id " + vid.String() + " already exists!")
+	}
+	for _, ext := range fetched {
+		if e := os.Rename(fileName+ext+".mirror", fileName+ext); e != nil {
+			removeFetched()
+			return e
+		}
+	}
+	v := NewVolume(location.Directory, collection, vid, CopyNil)
+	if e := check(v); e != nil {
+		v.destroy()
+		return e
+	}
+	if s.masterKey != nil {
+		if e := v.setMasterKey(s.masterKey); e != nil {
+			v.destroy()
+			return e
+		}
+	}
+	location.volumes[vid] = v
+	log.Println("In dir", location.Directory, "copies volume =", vid, ", collection =", collection)
+	return nil
+}
+
+func fetchVolumeFile(fileName string, ext string, fetch func(ext string, w io.Writer) error) error {
+	f, e := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if e != nil {
+		return e
+	}
+	if e = fetch(ext, f); e == nil {
+		e = util.Fsync(f)
+	}
+	if ce := f.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
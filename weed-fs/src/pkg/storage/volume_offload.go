@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"pkg/util"
+	"sync"
+	"time"
+)
+
+// remoteVolume is the .remote file of an offloaded volume, in place of its .dat.
+type remoteVolume struct {
+	Key      string    // of the data file in the remote tier
+	Size     int64     // of the data file
+	Modified time.Time // when it was offloaded
+}
+
+// ErrOffloaded refuses the changes to the data file of an offloaded volume.
+var ErrOffloaded = errors.New("Volume data file is offloaded to the remote tier, and read only")
+
+// remoteFile is the volumeFile of an offloaded volume, read from the remote
+// tier through the cache of its blocks.
+type remoteFile struct {
+	name     string // of the .dat file it replaces
+	remote   remoteVolume
+	lock     sync.Mutex
+	position int64
+}
+
+// openDataFile opens the .dat file of the volume, or its remote copy once it
+// is offloaded. A .dat file left beside the .remote one, by an offload or a
+// recall cut short, is complete, and taken first.
+func openDataFile(fileName string) (volumeFile, error) {
+	if _, e := os.Stat(fileName + ".dat"); os.IsNotExist(e) {
+		if data, e := ioutil.ReadFile(fileName + ".remote"); e == nil {
+			f := &remoteFile{name: fileName + ".dat"}
+			if e = json.Unmarshal(data, &f.remote); e != nil {
+				return nil, e
+			}
+			if remoteTier == nil {
+				return nil, errors.New(fileName + " is offloaded, and the server has no remote tier")
+			}
+			return f, nil
+		}
+	}
+	return openVolumeFile(fileName+".dat", os.O_RDWR|os.O_CREATE)
+}
+
+func (f *remoteFile) Read(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n, err := f.ReadAt(b, f.position)
+	f.position += int64(n)
+	if n > 0 {
+		return n, nil
+	}
+	return n, err
+}
+
+// ReadAt reads the blocks of the range, each from the cache or the remote tier.
+func (f *remoteFile) ReadAt(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	n := 0
+	for n < len(b) && offset < f.remote.Size {
+		block, err := remoteTier.block(f.remote.Key, f.remote.Size, offset/RemoteBlockSize)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(b[n:], block[offset%RemoteBlockSize:])
+		n, offset = n+copied, offset+int64(copied)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch whence {
+	case 1:
+		offset += f.position
+	case 2:
+		offset += f.remote.Size
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	f.position = offset
+	return offset, nil
+}
+
+func (f *remoteFile) Write(b []byte) (int, error)                 { return 0, ErrOffloaded }
+func (f *remoteFile) WriteAt(b []byte, offset int64) (int, error) { return 0, ErrOffloaded }
+func (f *remoteFile) Truncate(size int64) error                   { return ErrOffloaded }
+func (f *remoteFile) Sync() error                                 { return nil }
+func (f *remoteFile) Close() error                                { return nil }
+func (f *remoteFile) Name() string                                { return f.name }
+
+func (f *remoteFile) Stat() (os.FileInfo, error) {
+	return &memoryFileInfo{name: path.Base(f.name), size: f.remote.Size, modified: f.remote.Modified}, nil
+}
+
+// Offloaded tells if the data file of the volume is in the remote tier.
+func (v *Volume) Offloaded() bool {
+	_, ok := v.dataFile.(*remoteFile)
+	return ok
+}
+
+// offload uploads the data file of the sealed volume to the remote tier, and
+// then reads it from there, dropping the local one. The upload runs without
+// the volume lock, and the volume is only switched if it is still sealed and
+// of the same size. The deletes meanwhile, or later, drop the needles from the
+// index only, and their content is left in the remote copy.
+func (v *Volume) offload() error {
+	if remoteTier == nil {
+		return errors.New("The volume server has no remote tier")
+	}
+	v.accessLock.Lock()
+	if e := v.canOffload(); e != nil {
+		v.accessLock.Unlock()
+		return e
+	}
+	if e := util.Fsync(v.dataFile); e != nil {
+		v.accessLock.Unlock()
+		return e
+	}
+	size := v.Size()
+	v.accessLock.Unlock()
+
+	fileName := v.FileName()
+	key := path.Base(fileName) + ".dat"
+	data, e := os.Open(fileName + ".dat")
+	if e != nil {
+		return e
+	}
+	e = remoteTier.upload(key, data, size)
+	data.Close()
+	if e != nil {
+		return e
+	}
+
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if e = v.canOffload(); e == nil && v.Size() != size {
+		e = errors.New("Volume " + v.Id.String() + " changed during its offload")
+	}
+	remote := remoteVolume{Key: key, Size: size, Modified: time.Now()}
+	if e == nil {
+		e = writeRemoteVolume(fileName+".remote", remote)
+	}
+	if e != nil {
+		remoteTier.remove(key)
+		return e
+	}
+	v.dataFile.Close()
+	v.dataFile = &remoteFile{name: fileName + ".dat", remote: remote}
+	if e = os.Remove(fileName + ".dat"); e != nil {
+		log.Println("Volume", v.Id, "can not remove its offloaded data file:", e)
+	}
+	log.Println("Volume", v.Id, "is offloaded to the remote tier as", key, "of", size, "bytes")
+	return nil
+}
+
+// canOffload checks the volume can be offloaded. The caller holds the access lock.
+func (v *Volume) canOffload() error {
+	if v.InMemory() {
+		return errors.New("Volume " + v.Id.String() + " is in memory and can not be offloaded")
+	}
+	if v.Offloaded() {
+		return errors.New("Volume " + v.Id.String() + " is offloaded already")
+	}
+	if v.state != VolumeSealed {
+		return errors.New("Volume " + v.Id.String() + " is " + string(v.state) + ", only sealed volumes can be offloaded")
+	}
+	if v.pinned() {
+		return ErrVolumePinned
+	}
+	return nil
+}
+
+// recall downloads the data file of the offloaded volume back, and removes its
+// remote copy. The volume is locked meanwhile.
+func (v *Volume) recall() error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	f, ok := v.dataFile.(*remoteFile)
+	if !ok {
+		return errors.New("Volume " + v.Id.String() + " is not offloaded")
+	}
+	fileName := v.FileName()
+	dst, e := os.OpenFile(fileName+".dat.recall", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if e != nil {
+		return e
+	}
+	if e = remoteTier.download(f.remote.Key, dst); e == nil {
+		e = util.Fsync(dst)
+	}
+	if ce := dst.Close(); e == nil {
+		e = ce
+	}
+	if e == nil {
+		e = os.Rename(fileName+".dat.recall", fileName+".dat")
+	}
+	if e != nil {
+		os.Remove(fileName + ".dat.recall")
+		return e
+	}
+	if v.dataFile, e = openVolumeFile(fileName+".dat", os.O_RDWR); e != nil {
+		v.dataFile = f
+		return e
+	}
+	os.Remove(fileName + ".remote")
+	remoteTier.drop(f.remote.Key, f.remote.Size)
+	if e = remoteTier.remove(f.remote.Key); e != nil {
+		log.Println("Volume", v.Id, "can not remove its remote copy", f.remote.Key, ":", e)
+	}
+	log.Println("Volume", v.Id, "is recalled from the remote tier")
+	return nil
+}
+
+func writeRemoteVolume(name string, remote remoteVolume) error {
+	data, e := json.Marshal(remote)
+	if e != nil {
+		return e
+	}
+	f, e := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if e != nil {
+		return e
+	}
+	if _, e = f.Write(data); e == nil {
+		e = util.Fsync(f)
+	}
+	if ce := f.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"pkg/util"
+)
+
+// checkDataTail compares the data file with the end of the needles in the index,
+// when the volume is loaded. The complete needles after the indexed ones, whose
+// index rows a crash cut short, are indexed again, and a needle half written is
+// truncated, so it is not served, and the next needle starts at an aligned offset.
+// The caller holds the access lock, or is loading the volume.
+func (v *Volume) checkDataTail() error {
+	indexStat, e := v.nm.indexFile.Stat()
+	if e != nil {
+		return e
+	}
+	if cut := indexStat.Size() % 16; cut != 0 {
+		log.Println("Volume", v.Id, "drops the last", cut, "bytes of its index, a row cut short")
+		if e = v.nm.indexFile.Truncate(indexStat.Size() - cut); e != nil {
+			return e
+		}
+		if _, e = v.nm.indexFile.Seek(0, 2); e != nil {
+			return e
+		}
+	}
+	end := DataStart(v.alignment)
+	if v.nm.lastOffset > 0 {
+		end = int64(v.nm.lastOffset)*8 + alignedSize(v.nm.lastSize, v.alignment)
+	}
+	size, e := v.dataFile.Seek(0, 2)
+	if e != nil {
+		return e
+	}
+	if size <= end {
+		return nil
+	}
+	recovered, recoveredBytes := 0, int64(0)
+	var cause error
+	for end < size {
+		header := make([]byte, 16)
+		if end+16 > size {
+			cause = errors.New("the needle is cut short")
+			break
+		}
+		if _, e = v.dataFile.ReadAt(header, end); e != nil {
+			cause = e
+			break
+		}
+		// the size is checked before the needle is read, it may be garbage
+		needleSize := util.BytesToUint32(header[12:16])
+		length := alignedSize(needleSize, v.alignment)
+		if end+length > size {
+			cause = errors.New("the needle is cut short")
+			break
+		}
+		record := make([]byte, length)
+		if _, e = v.dataFile.ReadAt(record, end); e != nil {
+			cause = e
+			break
+		}
+		n := new(Needle)
+		if _, e = n.Read(bytes.NewReader(record), needleSize, v.version); e != nil {
+			cause = e
+			break
+		}
+		if _, e = v.nm.Put(n.Id, uint32(end/8), n.Size); e != nil {
+			return e
+		}
+		recovered++
+		recoveredBytes += int64(len(record))
+		end += int64(len(record))
+	}
+	if recovered > 0 {
+		log.Println("Volume", v.Id, "indexed", recovered, "needles,", recoveredBytes, "bytes, written after its index")
+	}
+	if end < size {
+		log.Println("Volume", v.Id, "truncates the last", size-end, "bytes of its data file:", cause)
+		if e = v.unshare(); e != nil {
+			return e
+		}
+		return v.dataFile.Truncate(end)
+	}
+	return nil
+}
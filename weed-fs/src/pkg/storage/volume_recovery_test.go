@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckDataTail(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_recovery")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	v.write(newTestNeedle(1))
+	v.write(newTestNeedle(2))
+	fileName := v.FileName()
+	v.Close()
+
+	// a crash after needle 3 was appended but not indexed, while needle 4 was
+	// half written, and an index row half written
+	var tail bytes.Buffer
+	newTestNeedle(3).Append(&tail, CurrentVersion)
+	end := tail.Len()
+	newTestNeedle(4).Append(&tail, CurrentVersion)
+	appendFile(t, fileName+".dat", tail.Bytes()[:end+20])
+	appendFile(t, fileName+".idx", make([]byte, 7))
+	stat, _ := os.Stat(fileName + ".dat")
+	goodSize := stat.Size() - 20
+
+	v = NewVolume(dir, "", VolumeId(1), CopyNil)
+	if stat, _ = os.Stat(fileName + ".dat"); stat.Size() != goodSize {
+		t.Fatal("the half written needle should be truncated", stat.Size(), goodSize)
+	}
+	if stat, _ = os.Stat(fileName + ".idx"); stat.Size()%16 != 0 {
+		t.Fatal("the half written index row should be truncated", stat.Size())
+	}
+	if _, e = v.read(&Needle{Id: 3}); e != nil {
+		t.Fatal("the unindexed needle should be recovered:", e)
+	}
+	if _, e = v.write(newTestNeedle(5)); e != nil {
+		t.Fatal(e)
+	}
+	v.Close()
+
+	// only a half written needle
+	tail.Reset()
+	newTestNeedle(6).Append(&tail, CurrentVersion)
+	appendFile(t, fileName+".dat", tail.Bytes()[:10])
+	v = NewVolume(dir, "", VolumeId(1), CopyNil)
+	for _, i := range []uint64{1, 2, 3, 5} {
+		if _, e = v.read(&Needle{Id: i}); e != nil {
+			t.Fatal("needle", i, "read error:", e)
+		}
+	}
+	if _, e = v.read(&Needle{Id: 6}); e == nil {
+		t.Fatal("the half written needle should not be read")
+	}
+	if stat, _ = os.Stat(fileName + ".dat"); stat.Size()%8 != 0 {
+		t.Fatal("the data file should end at a needle boundary", stat.Size())
+	}
+	v.Close()
+
+	// a garbage header, with a size far larger than the data file
+	goodSize = stat.Size()
+	appendFile(t, fileName+".dat", []byte{1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 7, 0xff, 0xff, 0xff, 0xf0})
+	v = NewVolume(dir, "", VolumeId(1), CopyNil)
+	defer v.Close()
+	if stat, _ = os.Stat(fileName + ".dat"); stat.Size() != goodSize {
+		t.Fatal("the garbage header should be truncated", stat.Size(), goodSize)
+	}
+}
+
+func appendFile(t *testing.T, name string, data []byte) {
+	f, e := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer f.Close()
+	if _, e = f.Write(data); e != nil {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"pkg/util"
+)
+
+// MaxReplicateRounds bounds the rounds of ReplicateVolume copying what the
+// volume grew by during the previous round.
+const MaxReplicateRounds = 8
+
+// ReplicateVolume copies a replica of the volume from another volume server,
+// in place of a replica lost with its server, and loads it. The volume can take
+// writes meanwhile, so it is pinned by a snapshot on the source, and its files
+// only grow: fetch writes the file from the offset on, and returns an error
+// passing os.IsNotExist for the .key file of a volume that is not encrypted.
+// The index is copied before the data file, so the data holds every needle of
+// the index, and then the growth of both again, until a round copies nothing.
+func (s *Store) ReplicateVolume(volumeIdString string, collection string, fetch func(ext string, offset int64, w io.Writer) error) error {
+	return s.copyVolume(volumeIdString, collection, func(fileName string) ([]string, error) {
+		var fetched []string
+		err := fetchVolumeFile(fileName+".key.mirror", ".key", func(ext string, w io.Writer) error {
+			return fetch(ext, 0, w)
+		})
+		if os.IsNotExist(err) {
+			os.Remove(fileName + ".key.mirror")
+		} else {
+			fetched = append(fetched, ".key")
+			if err != nil {
+				return fetched, err
+			}
+		}
+		fetched = append(fetched, ".idx", ".dat")
+		for round := 0; round < MaxReplicateRounds; round++ {
+			grewIndex, err := fetchVolumeGrowth(fileName+".idx.mirror", ".idx", fetch)
+			if err != nil {
+				return fetched, err
+			}
+			grewData, err := fetchVolumeGrowth(fileName+".dat.mirror", ".dat", fetch)
+			if err != nil {
+				return fetched, err
+			}
+			if round > 0 && !grewIndex && !grewData {
+				return fetched, nil
+			}
+		}
+		return fetched, errors.New("Volume " + volumeIdString + " kept changing over the rounds of its copy")
+	}, func(v *Volume) error {
+		return nil
+	})
+}
+
+// fetchVolumeGrowth appends what the file grew by since it was last fetched,
+// and tells if it grew. An index entry fetched in part is fetched again whole.
+func fetchVolumeGrowth(fileName string, ext string, fetch func(ext string, offset int64, w io.Writer) error) (bool, error) {
+	f, e := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0644)
+	if e != nil {
+		return false, e
+	}
+	defer f.Close()
+	size, e := f.Seek(0, 2)
+	if e != nil {
+		return false, e
+	}
+	if cut := size % 16; ext == ".idx" && cut != 0 {
+		if size, e = f.Seek(size-cut, 0); e == nil {
+			e = f.Truncate(size)
+		}
+		if e != nil {
+			return false, e
+		}
+	}
+	if e = fetch(ext, size, f); e != nil {
+		return false, e
+	}
+	grown, e := f.Seek(0, 1)
+	if e != nil {
+		return false, e
+	}
+	return grown > size, util.Fsync(f)
+}
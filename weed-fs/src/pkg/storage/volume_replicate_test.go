@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestReplicateVolume(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_replicate")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(path.Join(dir, "source"), 0755)
+	os.Mkdir(path.Join(dir, "target"), 0755)
+	source := NewStore(8080, "", "", []string{path.Join(dir, "source")}, []int{2})
+	defer source.Close()
+	target := NewStore(8081, "", "", []string{path.Join(dir, "target")}, []int{2})
+	defer target.Close()
+	if e = source.AddVolume("3", "pictures", "001"); e != nil {
+		t.Fatal(e)
+	}
+	for id := uint64(1); id <= 3; id++ {
+		source.Write(3, newTestNeedle(id))
+	}
+
+	// the volume changes during the first round of the copy
+	rounds := 0
+	fetch := func(ext string, offset int64, w io.Writer) error {
+		f, e := source.OpenVolumeFile("3", ext)
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+		if _, e = f.Seek(offset, 0); e != nil {
+			return e
+		}
+		_, e = io.Copy(w, f)
+		if ext == ".dat" {
+			if rounds++; rounds == 1 {
+				source.Write(3, newTestNeedle(4))
+				source.Delete(3, newTestNeedle(1))
+			}
+		}
+		return e
+	}
+	if e = target.ReplicateVolume("3", "pictures", fetch); e == nil {
+		t.Fatal("replicated a volume that is neither sealed nor pinned")
+	}
+	if target.HasVolume(3) {
+		t.Fatal("a failed copy was loaded")
+	}
+	source.Snapshot("replicate-3", []VolumeId{3}, time.Now().Add(time.Hour))
+	if e = target.ReplicateVolume("3", "pictures", fetch); e != nil {
+		t.Fatal(e)
+	}
+	if rounds != 3 {
+		t.Error("copied in", rounds, "rounds, instead of the copy, its growth and an empty round")
+	}
+	for id, expected := range map[uint64]bool{1: false, 2: true, 3: true, 4: true} {
+		if _, e := target.Read(3, newTestNeedle(id)); (e == nil) != expected {
+			t.Error("needle", id, "read from the replica:", e)
+		}
+	}
+	if v := target.GetVolume(3); v == nil || v.replicaType != Copy001 || v.Collection != "pictures" {
+		t.Fatal("unexpected replica", v)
+	}
+	if e = target.ReplicateVolume("3", "pictures", fetch); e == nil {
+		t.Error("replicated a volume twice")
+	}
+	if files, _ := ioutil.ReadDir(path.Join(dir, "target")); len(files) != 2 {
+		t.Error("left the files of a refused copy", files)
+	}
+}
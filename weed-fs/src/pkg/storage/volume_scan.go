@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"pkg/util"
+)
+
+const (
+	// the data file is read ahead this much, and needles are buffered up
+	// to this size before they are checked against the index
+	scanReadAheadBytes = 4 * 1024 * 1024
+	// needles checked against the index in one lock of the volume
+	scanBatchSize = 1024
+)
+
+var ErrScanCompacted = errors.New("Volume was compacted during the scan")
+
+type scannedNeedle struct {
+	offset int64
+	record []byte
+}
+
+// scan calls visit with the live needles of the volume, in the order they are
+// on disk. The data file is read sequentially with a large read ahead, instead
+// of seeking to each needle, and the needles are checked against the index in
+// batches, holding the volume lock only for the check. Needles written after
+// the scan starts are not visited. If the volume is compacted during the scan,
+// it stops with ErrScanCompacted.
+func (v *Volume) scan(visit func(n *Needle) error) error {
+	v.accessLock.Lock()
+	nm, version, alignment := v.nm, v.version, v.alignment
+	var dataFile io.ReaderAt = v.dataFile
+	var e error
+	if !v.InMemory() && !v.Offloaded() {
+		var f *os.File
+		if f, e = os.Open(v.dataFile.Name()); e == nil {
+			defer f.Close()
+			dataFile = f
+		}
+	}
+	var end int64
+	if e == nil {
+		end, e = v.dataFile.Seek(0, 2)
+	}
+	v.accessLock.Unlock()
+	if e != nil {
+		return e
+	}
+
+	return readNeedles(dataFile, DataStart(alignment), end, alignment, func(batch []scannedNeedle) error {
+		return v.visitLive(nm, version, batch, visit)
+	})
+}
+
+// readNeedles reads the needles of the data file from start to end, in order,
+// with a large read ahead, and passes them to visit in batches. The batch is
+// reused after visit returns.
+func readNeedles(dataFile io.ReaderAt, start, end, alignment int64, visit func(batch []scannedNeedle) error) error {
+	r := bufio.NewReaderSize(io.NewSectionReader(dataFile, start, end-start), scanReadAheadBytes)
+	var batch []scannedNeedle
+	batchBytes := 0
+	for offset := start; offset < end; {
+		header := make([]byte, 16)
+		if _, e := io.ReadFull(r, header); e != nil {
+			return e
+		}
+		size := util.BytesToUint32(header[12:16])
+		record := make([]byte, alignedSize(size, alignment))
+		copy(record, header)
+		if _, e := io.ReadFull(r, record[16:]); e != nil {
+			return e
+		}
+		batch = append(batch, scannedNeedle{offset: offset, record: record})
+		batchBytes += len(record)
+		offset += int64(len(record))
+		if len(batch) >= scanBatchSize || batchBytes >= scanReadAheadBytes || offset >= end {
+			if e := visit(batch); e != nil {
+				return e
+			}
+			batch, batchBytes = batch[:0], 0
+		}
+	}
+	return nil
+}
+
+// visitLive visits the needles of the batch still in the index at the same offset.
+func (v *Volume) visitLive(nm *NeedleMap, version Version, batch []scannedNeedle, visit func(n *Needle) error) error {
+	live := make([]bool, len(batch))
+	v.accessLock.Lock()
+	if v.nm != nm {
+		v.accessLock.Unlock()
+		return ErrScanCompacted
+	}
+	for i, s := range batch {
+		nv, ok := nm.Get(util.BytesToUint64(s.record[4:12]))
+		live[i] = ok && nv.Size > 0 && int64(nv.Offset)*8 == s.offset
+	}
+	v.accessLock.Unlock()
+	for i, s := range batch {
+		if !live[i] {
+			continue
+		}
+		n := new(Needle)
+		if _, e := n.Read(bytes.NewReader(s.record), util.BytesToUint32(s.record[12:16]), version); e != nil {
+			return e
+		}
+		if e := v.decrypt(n); e != nil {
+			return e
+		}
+		if e := visit(n); e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestScanVisitsLiveNeedlesInDiskOrder(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_scan")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	defer v.Close()
+	for _, id := range []uint64{1, 3, 5, 8} {
+		v.write(newTestNeedle(id))
+	}
+	v.delete(newTestNeedle(3), false)
+	v.write(newTestNeedle(1)) // overwritten, only the later copy is live
+
+	var ids []uint64
+	e = v.scan(func(n *Needle) error {
+		if !bytes.Equal(n.Data, newTestNeedle(n.Id).Data) {
+			t.Fatal("wrong content for needle", n.Id, string(n.Data))
+		}
+		ids = append(ids, n.Id)
+		return nil
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	expected := []uint64{5, 8, 1}
+	if len(ids) != len(expected) {
+		t.Fatal("expected needles", expected, "but visited", ids)
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Fatal("expected needles", expected, "but visited", ids)
+		}
+	}
+}
+
+func TestModifiedSince(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_scan")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	defer v.Close()
+	for id, lastModified := range map[uint64]uint64{1: 100, 2: 200, 3: 300} {
+		n := newTestNeedle(id)
+		n.LastModified = lastModified
+		n.Flags |= FlagHasLastModifiedDate
+		v.write(n)
+	}
+	needles, e := v.modifiedSince(200)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(needles) != 2 || needles[0].LastModified < 200 || needles[1].LastModified < 200 {
+		t.Fatal("expected the needles 2 and 3, got", needles)
+	}
+	for _, n := range needles {
+		if n.Data != nil {
+			t.Fatal("listed needle", n.Id, "with its data")
+		}
+	}
+}
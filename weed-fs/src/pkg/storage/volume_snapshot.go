@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+// VolumeCut is where a snapshot cuts the files of a volume. The first DataSize
+// bytes of the data file and IndexSize bytes of the index file hold the volume
+// as it was at the snapshot, as long as the snapshot pins the volume.
+type VolumeCut struct {
+	Id         VolumeId
+	Collection string
+	Version    Version
+	DataSize   int64
+	IndexSize  int64
+	FileCount  int
+}
+
+var ErrVolumePinned = errors.New("Volume is pinned by a snapshot")
+
+// cut takes the cut point of the volume, and pins it for the snapshot until it
+// expires, so the data before the cut does not change: the volume is not
+// vacuumed, and the deleted needles are not erased until the pin is released.
+// Holding the access lock, it waits for the write in progress, if any.
+func (v *Volume) cut(snapshot string, expires time.Time) (*VolumeCut, error) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.InMemory() {
+		return nil, errors.New("Volume " + v.Id.String() + " is in memory and can not be snapshotted")
+	}
+	if v.Offloaded() {
+		return nil, errors.New("Volume " + v.Id.String() + " is offloaded and can not be snapshotted")
+	}
+	dataSize, e := v.dataFile.Seek(0, 2)
+	if e != nil {
+		return nil, e
+	}
+	indexStat, e := v.nm.indexFile.Stat()
+	if e != nil {
+		return nil, e
+	}
+	if v.pins == nil {
+		v.pins = make(map[string]time.Time)
+	}
+	v.pins[snapshot] = expires
+	return &VolumeCut{Id: v.Id, Collection: v.Collection, Version: v.version,
+		DataSize: dataSize, IndexSize: indexStat.Size(), FileCount: v.nm.fileCounter}, nil
+}
+
+// unpin releases the pin of the snapshot.
+func (v *Volume) unpin(snapshot string) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	delete(v.pins, snapshot)
+}
+
+// pinned tells if an unexpired snapshot pins the volume, dropping the expired pins.
+// The caller holds the access lock.
+func (v *Volume) pinned() bool {
+	now := time.Now()
+	for snapshot, expires := range v.pins {
+		if now.After(expires) {
+			delete(v.pins, snapshot)
+		}
+	}
+	return len(v.pins) > 0
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestVolumeCut(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_snapshot")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	defer v.Close()
+	v.write(newTestNeedle(1))
+	v.write(newTestNeedle(2))
+	cut, e := v.cut("nightly", time.Now().Add(time.Hour))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if cut.FileCount != 2 || cut.IndexSize != 32 {
+		t.Fatal("unexpected cut", cut)
+	}
+	v.write(newTestNeedle(3))
+	v.delete(newTestNeedle(1), false)
+	if e = v.compact(); e != ErrVolumePinned {
+		t.Fatal("a pinned volume should not be vacuumed, got", e)
+	}
+
+	// the files up to the cut are the volume at the snapshot
+	backup := path.Join(dir, "backup")
+	os.Mkdir(backup, 0755)
+	for ext, size := range map[string]int64{".dat": cut.DataSize, ".idx": cut.IndexSize} {
+		data, _ := ioutil.ReadFile(path.Join(dir, "1"+ext))
+		ioutil.WriteFile(path.Join(backup, "1"+ext), data[:size], 0644)
+	}
+	b := NewVolume(backup, "", VolumeId(1), CopyNil)
+	defer b.Close()
+	for _, id := range []uint64{1, 2} {
+		if _, e = b.read(newTestNeedle(id)); e != nil {
+			t.Fatal("the snapshot should have needle", id, e)
+		}
+	}
+	if _, e = b.read(newTestNeedle(3)); e == nil {
+		t.Fatal("the snapshot should not have the needle written after the cut")
+	}
+
+	v.unpin("nightly")
+	if e = v.compact(); e != nil {
+		t.Fatal(e)
+	}
+	v.cut("expired", time.Now().Add(-time.Second))
+	if e = v.compact(); e != nil {
+		t.Fatal("an expired pin should not stop the vacuum", e)
+	}
+}
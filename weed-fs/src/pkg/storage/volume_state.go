@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"errors"
+	"log"
+	"pkg/util"
+)
+
+// VolumeState is the life cycle state of a volume. Only growing volumes take new files.
+type VolumeState string
+
+const (
+	VolumeGrowing    = VolumeState("growing")    // takes new files
+	VolumeSealed     = VolumeState("sealed")     // full, or sealed by an admin, saved in the super block
+	VolumeReadOnly   = VolumeState("readonly")   // after repeated write errors, until the server restarts
+	VolumeCompacting = VolumeState("compacting") // being vacuumed, back to its previous state after, only by the compaction
+)
+
+const (
+	// super block byte 2
+	superBlockFlagSealed = 0x01
+)
+
+// volumeStateTransitions lists the states each state can move to.
+var volumeStateTransitions = map[VolumeState][]VolumeState{
+	VolumeGrowing:    {VolumeSealed, VolumeReadOnly},
+	VolumeSealed:     {VolumeGrowing},
+	VolumeReadOnly:   {VolumeSealed},
+	VolumeCompacting: {},
+}
+
+func NewVolumeState(s string) (VolumeState, error) {
+	state := VolumeState(s)
+	if _, ok := volumeStateTransitions[state]; !ok {
+		return "", errors.New("Unknown volume state " + s)
+	}
+	return state, nil
+}
+
+// IsWritable is true for growing volumes, and for the volumes from servers not reporting states yet.
+func (s VolumeState) IsWritable() bool {
+	return s == VolumeGrowing || s == ""
+}
+
+func (s VolumeState) canMoveTo(to VolumeState) bool {
+	for _, state := range volumeStateTransitions[s] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setState moves the volume to the state. Moving to growing or sealed also saves
+// whether it is sealed in the super block.
+// The caller holds the access lock.
+func (v *Volume) setState(to VolumeState) error {
+	if v.state == to {
+		return nil
+	}
+	if !v.state.canMoveTo(to) {
+		return errors.New("Volume " + v.Id.String() + " can not move from " + string(v.state) + " to " + string(to))
+	}
+	if to == VolumeGrowing || to == VolumeSealed {
+		flags := []byte{0}
+		if to == VolumeSealed {
+			flags[0] = superBlockFlagSealed
+		}
+		if e := v.unshare(); e != nil {
+			return e
+		}
+		if _, e := v.dataFile.WriteAt(flags, 2); e != nil {
+			return e
+		}
+		if e := util.Fsync(v.dataFile); e != nil {
+			return e
+		}
+	}
+	log.Println("Volume", v.Id, "moves from", v.state, "to", to)
+	v.state = to
+	return nil
+}
+
+// SetState moves the volume to the state, e.g. sealed by the master when it is full.
+func (v *Volume) SetState(to VolumeState) error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	return v.setState(to)
+}
+
+func (v *Volume) State() VolumeState {
+	return v.state
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSealedVolumeStaysSealed(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_state")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	v.write(newTestNeedle(1))
+	v.write(newTestNeedle(2))
+	if e := v.SetState(VolumeSealed); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := v.write(newTestNeedle(3)); e == nil {
+		t.Fatal("a sealed volume should not take new files")
+	}
+	v.delete(newTestNeedle(1), false)
+	if _, e := v.read(newTestNeedle(1)); e == nil {
+		t.Fatal("files should still be deleted from a sealed volume")
+	}
+	if e := v.compact(); e != nil {
+		t.Fatal(e)
+	}
+	v.Close()
+
+	v = NewVolume(dir, "", VolumeId(1), CopyNil)
+	defer v.Close()
+	if v.State() != VolumeSealed {
+		t.Fatal("the volume should still be sealed after compacting and reloading, but is", v.State())
+	}
+	if e := v.SetState(VolumeReadOnly); e == nil {
+		t.Fatal("a sealed volume should not turn read only")
+	}
+	if e := v.SetState(VolumeGrowing); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := v.write(newTestNeedle(3)); e != nil {
+		t.Fatal("an unsealed volume should take new files:", e)
+	}
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"pkg/util"
+	"time"
+)
+
+// With a trash retention, deleting a needle only drops it from the index, and
+// keeps it in the .trash file of the volume, from where it can be undeleted.
+// Its content is only erased when it is purged, after the retention. The
+// compactions keep the needles in the trash.
+
+// trashRecordSize is the size of a .trash record: the needle id, offset and
+// size, and the unix time it was deleted at. Offset 0 removes the needle.
+const trashRecordSize = 24
+
+type trashEntry struct {
+	Offset    uint32
+	Size      uint32
+	DeletedAt int64
+}
+
+type trashLog struct {
+	file    volumeFile
+	entries map[uint64]*trashEntry
+}
+
+func loadTrashLog(file volumeFile) (*trashLog, error) {
+	t := &trashLog{file: file, entries: make(map[uint64]*trashEntry)}
+	file.Seek(0, 0)
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	// drop a record cut short, so the next ones are aligned
+	if rest := len(data) % trashRecordSize; rest != 0 {
+		data = data[:len(data)-rest]
+		if err = file.Truncate(int64(len(data))); err != nil {
+			return nil, err
+		}
+	}
+	for ; len(data) > 0; data = data[trashRecordSize:] {
+		id := util.BytesToUint64(data[0:8])
+		if offset := util.BytesToUint32(data[8:12]); offset > 0 {
+			t.entries[id] = &trashEntry{Offset: offset, Size: util.BytesToUint32(data[12:16]), DeletedAt: int64(util.BytesToUint64(data[16:24]))}
+		} else {
+			delete(t.entries, id)
+		}
+	}
+	return t, nil
+}
+
+func (t *trashLog) append(id uint64, e *trashEntry) error {
+	b := make([]byte, trashRecordSize)
+	util.Uint64toBytes(b[0:8], id)
+	util.Uint32toBytes(b[8:12], e.Offset)
+	util.Uint32toBytes(b[12:16], e.Size)
+	util.Uint64toBytes(b[16:24], uint64(e.DeletedAt))
+	if _, err := t.file.Seek(0, 2); err != nil {
+		return err
+	}
+	_, err := t.file.Write(b)
+	return err
+}
+func (t *trashLog) add(id uint64, e *trashEntry) error {
+	if err := t.append(id, e); err != nil {
+		return err
+	}
+	t.entries[id] = e
+	return nil
+}
+func (t *trashLog) remove(id uint64) error {
+	delete(t.entries, id)
+	return t.append(id, &trashEntry{})
+}
+
+// reset replaces the records with the entries, e.g. after a compaction.
+func (t *trashLog) reset(entries map[uint64]*trashEntry) error {
+	t.entries = entries
+	if err := t.file.Truncate(0); err != nil {
+		return err
+	}
+	for id, e := range entries {
+		if err := t.append(id, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openTrash loads the .trash file of the volume, and creates it if asked to.
+func (v *Volume) openTrash(create bool) error {
+	if v.trash != nil {
+		return nil
+	}
+	var file volumeFile
+	if v.InMemory() {
+		if !create {
+			return nil
+		}
+		file = newMemoryFile(v.FileName() + ".trash")
+	} else {
+		flags := os.O_RDWR
+		if create {
+			flags |= os.O_CREATE
+		}
+		f, err := openVolumeFile(v.FileName()+".trash", flags)
+		if os.IsNotExist(err) && !create {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		file = f
+	}
+	t, err := loadTrashLog(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	v.trash = t
+	return nil
+}
+
+// trashNeedle keeps the deleted needle in the trash. A previous needle with the
+// same id still in the trash is erased, only the last one can be undeleted.
+// The caller holds the access lock.
+func (v *Volume) trashNeedle(id uint64, offset, size uint32) error {
+	if err := v.openTrash(true); err != nil {
+		return err
+	}
+	previous := v.trash.entries[id]
+	if err := v.trash.add(id, &trashEntry{Offset: offset, Size: size, DeletedAt: time.Now().Unix()}); err != nil {
+		return err
+	}
+	// the needle is garbage only once purged
+	v.nm.deletionByteCounter -= uint64(size)
+	if previous != nil {
+		v.eraseTrashed(id, previous)
+	}
+	return nil
+}
+
+// inTrash tells if the needle in the trash is still at its offset. It may not
+// be, after a compaction cut short before the .trash file was rewritten.
+func (v *Volume) inTrash(id uint64, e *trashEntry) (*Needle, bool) {
+	header := make([]byte, 16)
+	if _, err := v.dataFile.ReadAt(header, int64(e.Offset)*8); err != nil {
+		return nil, false
+	}
+	n := &Needle{Cookie: util.BytesToUint32(header[0:4]), Id: util.BytesToUint64(header[4:12]), Size: util.BytesToUint32(header[12:16])}
+	return n, n.Id == id && n.Size == e.Size
+}
+
+// eraseTrashed erases the content of the needle, for good.
+func (v *Volume) eraseTrashed(id uint64, e *trashEntry) {
+	if _, ok := v.inTrash(id, e); ok {
+		v.eraseNeedle(e.Offset, e.Size)
+		v.nm.deletionByteCounter += uint64(e.Size)
+	}
+}
+
+// eraseNeedle erases the content, but keeps the needle header and length, so
+// the needles after it are still found when reading the data file in order.
+// The needles of a volume pinned by a snapshot are left for the next vacuum,
+// and the ones of an offloaded volume in its remote copy.
+func (v *Volume) eraseNeedle(offset, size uint32) {
+	if v.pinned() || v.Offloaded() {
+		return
+	}
+	if e := v.unshare(); e != nil {
+		v.writeFailed(e)
+		return
+	}
+	if _, e := v.dataFile.WriteAt(make([]byte, alignedSize(size, v.alignment)-16), int64(offset)*8+16); e != nil {
+		v.writeFailed(e)
+	}
+}
+
+// undelete puts the needle back in the index, if it is still in the trash
+// with the same cookie, and no needle with the same id was written since.
+func (v *Volume) undelete(n *Needle) (uint32, error) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	var e *trashEntry
+	if v.trash != nil {
+		e = v.trash.entries[n.Id]
+	}
+	if e == nil {
+		return 0, errors.New("Not in the trash")
+	}
+	if nv, ok := v.nm.Get(n.Id); ok && nv.Size > 0 {
+		return 0, errors.New("A file with the same id was written since")
+	}
+	trashed, ok := v.inTrash(n.Id, e)
+	if !ok {
+		return 0, errors.New("Not in the trash")
+	}
+	if trashed.Cookie != n.Cookie {
+		return 0, errors.New("Cookie does not match the deleted file")
+	}
+	if _, err := v.nm.Put(n.Id, e.Offset, e.Size); err != nil {
+		return 0, v.writeFailed(err)
+	}
+	return e.Size, v.trash.remove(n.Id)
+}
+
+// purgeTrash erases the needles deleted before the unix time, and returns how many.
+func (v *Volume) purgeTrash(before int64) (count int) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.trash == nil || v.state == VolumeReadOnly {
+		return 0
+	}
+	for id, e := range v.trash.entries {
+		if e.DeletedAt < before {
+			v.eraseTrashed(id, e)
+			if err := v.trash.remove(id); err != nil {
+				log.Println("Volume", v.Id, "can not purge its trash:", err)
+				return
+			}
+			count++
+		}
+	}
+	return
+}
+
+// TrashedNeedle is a deleted needle that can still be undeleted.
+type TrashedNeedle struct {
+	Id        uint64
+	Cookie    uint32
+	Size      uint32
+	DeletedAt int64
+}
+
+func (v *Volume) trashed() (needles []*TrashedNeedle) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.trash == nil {
+		return
+	}
+	for id, e := range v.trash.entries {
+		if n, ok := v.inTrash(id, e); ok {
+			needles = append(needles, &TrashedNeedle{Id: id, Cookie: n.Cookie, Size: e.Size, DeletedAt: e.DeletedAt})
+		}
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVolumeTrash(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_trash")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	for i := uint64(1); i <= 4; i++ {
+		if _, e = v.write(newTestNeedle(i)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	for i := uint64(1); i <= 3; i++ {
+		if v.delete(newTestNeedle(i), i != 3) == 0 {
+			t.Fatal("needle", i, "not deleted")
+		}
+	}
+	if _, e = v.read(&Needle{Id: 1}); e == nil {
+		t.Fatal("a needle in the trash should not be read")
+	}
+	if _, e = v.undelete(&Needle{Id: 3, Cookie: 0x12345678}); e == nil {
+		t.Fatal("a needle deleted without the trash should not be undeleted")
+	}
+	if _, e = v.undelete(&Needle{Id: 1, Cookie: 1}); e == nil {
+		t.Fatal("expecting the cookie to be checked")
+	}
+	if e = v.compact(); e != nil {
+		t.Fatal(e)
+	}
+	v.Close()
+
+	// the trash is kept through compactions and restarts
+	v = NewVolume(dir, "", VolumeId(1), CopyNil)
+	defer v.Close()
+	if trashed := v.trashed(); len(trashed) != 2 {
+		t.Fatal("expecting needles 1 and 2 in the trash, got", trashed)
+	}
+	if _, e = v.undelete(&Needle{Id: 1, Cookie: 0x12345678}); e != nil {
+		t.Fatal(e)
+	}
+	n := &Needle{Id: 1}
+	if _, e = v.read(n); e != nil || string(n.Data) != string(newTestNeedle(1).Data) {
+		t.Fatal("undeleted needle read", string(n.Data), e)
+	}
+	if count := v.purgeTrash(time.Now().Unix() + 1); count != 1 {
+		t.Fatal("expecting needle 2 to be purged, purged", count)
+	}
+	if _, e = v.undelete(&Needle{Id: 2, Cookie: 0x12345678}); e == nil {
+		t.Fatal("a purged needle should not be undeleted")
+	}
+	if v.garbageLevel() == 0 {
+		t.Fatal("the purged needle should be garbage")
+	}
+}
@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"pkg/util"
+)
+
+func (v *Volume) garbageLevel() float64 {
+	size := v.Size()
+	if size <= SuperBlockSize {
+		return 0
+	}
+	return float64(v.nm.deletionByteCounter) / float64(size-SuperBlockSize)
+}
+
+// compact copies all live needles into a new data file and index file,
+// and swaps them in place of the current ones.
+func (v *Volume) compact() error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	return v.rewrite(v.version, nil)
+}
+
+// compaction is a copy of the needles of a volume in progress, into the .cpd
+// data file and the .cpx index file, or into memory files.
+type compaction struct {
+	dst, idx  volumeFile
+	nm        *NeedleMap
+	version   Version
+	alignment int64
+	rewrite   func(n *Needle, offset int64) (*Needle, error)
+
+	// of the volume copied
+	srcVersion   Version
+	srcAlignment int64
+	// the needles of the trash copied, by id, with their offsets in the volume
+	trashCopied map[uint64]*copiedTrash
+	// the trash of the compacted volume, once the changes are copied
+	trashed map[uint64]*trashEntry
+}
+
+type copiedTrash struct {
+	from  uint32
+	entry *trashEntry
+}
+
+// rewrite copies the live needles, passed through rewrite if not nil, into a
+// new data file and index file in the needle version, and swaps them in place
+// of the current ones. Changing the version needs a rewrite function.
+// The caller holds the access lock. rewrite releases it while it copies the
+// needles, so the volume keeps serving reads and deletes, and takes it back to
+// copy the changes made meanwhile and to swap the files. The rewrite function
+// is called without the lock.
+func (v *Volume) rewrite(version Version, rewrite func(n *Needle, offset int64) (*Needle, error)) error {
+	if version != v.version && rewrite == nil {
+		return errors.New("Volume " + v.Id.String() + " can only change its version with a rewrite")
+	}
+	if v.pinned() {
+		return ErrVolumePinned
+	}
+	if v.state == VolumeCompacting {
+		return errors.New("Volume " + v.Id.String() + " is already being compacted")
+	}
+	if v.Offloaded() {
+		return errors.New("Volume " + v.Id.String() + " is offloaded, and is recalled before it is rewritten")
+	}
+	previous := v.state
+	log.Println("Volume", v.Id, "moves from", previous, "to", VolumeCompacting)
+	v.state = VolumeCompacting
+	// the super block is copied as is, so the previous state is still saved in it
+	defer func() { v.state = previous }()
+	// the needles move to the current alignment
+	c := &compaction{version: version, alignment: needleAlignment, rewrite: rewrite, trashCopied: make(map[uint64]*copiedTrash)}
+
+	filePath := v.FileName()
+	if v.InMemory() {
+		c.dst, c.idx = newMemoryFile(filePath+".dat"), newMemoryFile(filePath+".idx")
+		if e := v.copyCompacted(c); e != nil {
+			return e
+		}
+		c.idx.Seek(0, 0)
+		v.dataFile, v.nm, v.version, v.alignment = c.dst, LoadNeedleMap(c.idx), version, c.alignment
+		log.Println("Compacted volume", v.Id, "in memory to size", v.Size())
+		return v.resetTrash(c.trashed)
+	}
+	e := c.create(filePath)
+	if e == nil {
+		e = v.copyCompacted(c)
+	}
+	if e == nil {
+		e = c.commit(filePath)
+	}
+	if e != nil {
+		c.discard(filePath)
+		return e
+	}
+	// from here on, the compaction is finished when the volume is loaded again, if not now
+	v.nm.Close()
+	v.dataFile.Close()
+	if e = finishCompaction(filePath); e == nil {
+		e = v.reopen(filePath)
+	}
+	if e != nil {
+		previous = VolumeReadOnly
+		log.Println("Volume", v.Id, "is read only until it is loaded again, which finishes its compaction:", e)
+		return e
+	}
+	// the new data file is not linked with the clones of the volume any more
+	v.version, v.alignment, v.shared = version, c.alignment, false
+	log.Println("Compacted volume", v.Id, "to size", v.Size())
+	return v.resetTrash(c.trashed)
+}
+
+// create creates the .cpd and .cpx files of the compaction.
+func (c *compaction) create(filePath string) (e error) {
+	if c.dst, e = os.OpenFile(filePath+".cpd", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); e != nil {
+		return e
+	}
+	c.idx, e = os.OpenFile(filePath+".cpx", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	return e
+}
+
+// commit syncs the .cpd and .cpx files, and marks the compaction as committed
+// with the .cpc file, so a crash while they are moved in place of the .dat and
+// .idx files is finished when the volume is loaded again.
+func (c *compaction) commit(filePath string) error {
+	if e := util.Fsync(c.dst); e != nil {
+		return e
+	}
+	if e := util.Fsync(c.idx); e != nil {
+		return e
+	}
+	c.close()
+	marker, e := os.OpenFile(filePath+".cpc", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if e != nil {
+		return e
+	}
+	if e = util.Fsync(marker); e != nil {
+		marker.Close()
+		return e
+	}
+	marker.Close()
+	return syncDir(path.Dir(filePath))
+}
+
+func (c *compaction) close() {
+	if c.dst != nil {
+		c.dst.Close()
+	}
+	if c.idx != nil {
+		c.idx.Close()
+	}
+	c.dst, c.idx = nil, nil
+}
+
+// discard removes the files of a compaction that was not committed. The volume
+// keeps its files.
+func (c *compaction) discard(filePath string) {
+	c.close()
+	os.Remove(filePath + ".cpc")
+	os.Remove(filePath + ".cpd")
+	os.Remove(filePath + ".cpx")
+}
+
+// finishCompaction moves the .cpd and .cpx files in place of the .dat and .idx
+// files, if their compaction was committed, and removes them otherwise. It is
+// called when a volume is loaded, to finish or drop a compaction cut short by
+// a crash. Each file is moved in one rename, so the volume either has both
+// files compacted, or the commit marker is still there to finish the move.
+func finishCompaction(filePath string) error {
+	if _, e := os.Stat(filePath + ".cpc"); os.IsNotExist(e) {
+		os.Remove(filePath + ".cpd")
+		os.Remove(filePath + ".cpx")
+		return nil
+	} else if e != nil {
+		return e
+	}
+	for _, rename := range [][2]string{{".cpd", ".dat"}, {".cpx", ".idx"}} {
+		// moved already, before a crash
+		if e := os.Rename(filePath+rename[0], filePath+rename[1]); e != nil && !os.IsNotExist(e) {
+			return e
+		}
+	}
+	if e := syncDir(path.Dir(filePath)); e != nil {
+		return e
+	}
+	if e := os.Remove(filePath + ".cpc"); e != nil {
+		return e
+	}
+	return syncDir(path.Dir(filePath))
+}
+
+// syncDir syncs the directory, so the files created, renamed and removed in it
+// survive a crash.
+func syncDir(dir string) error {
+	d, e := os.Open(dir)
+	if e != nil {
+		return e
+	}
+	defer d.Close()
+	return util.Fsync(d)
+}
+
+// reopen opens the data file and the index file of the volume again, after
+// they were closed for a compaction.
+func (v *Volume) reopen(filePath string) (e error) {
+	if v.dataFile, e = openVolumeFile(filePath+".dat", os.O_RDWR); e != nil {
+		return e
+	}
+	indexFile, e := openVolumeFile(filePath+".idx", os.O_RDWR)
+	if e != nil {
+		return e
+	}
+	v.nm = LoadNeedleMap(indexFile)
+	return nil
+}
+
+// resetTrash rewrites the trash with the offsets of the needles in the new data file.
+func (v *Volume) resetTrash(trashed map[uint64]*trashEntry) error {
+	if v.trash == nil {
+		return nil
+	}
+	return v.trash.reset(trashed)
+}
+
+// copyCompacted writes the super block and the needles of the volume to the
+// compaction: the needles live or in the trash when the copy starts, copied
+// without the access lock, and then those changed since, with it.
+// The caller holds the access lock.
+func (v *Volume) copyCompacted(c *compaction) error {
+	c.nm = NewNeedleMap(c.idx)
+	c.srcVersion, c.srcAlignment = v.version, v.alignment
+	header := make([]byte, SuperBlockSize)
+	if _, e := v.dataFile.ReadAt(header, 0); e != nil {
+		return e
+	}
+	header[0] = byte(c.version)
+	if e := writeSuperBlock(c.dst, header, c.alignment); e != nil {
+		return e
+	}
+	end, e := v.dataFile.Seek(0, 2)
+	if e != nil {
+		return e
+	}
+	stat, e := v.nm.indexFile.Stat()
+	if e != nil {
+		return e
+	}
+	indexed := stat.Size()
+	var dataFile io.ReaderAt = v.dataFile
+	if !v.InMemory() {
+		f, e := os.Open(v.dataFile.Name())
+		if e != nil {
+			return e
+		}
+		defer f.Close()
+		dataFile = f
+	}
+
+	v.accessLock.Unlock()
+	e = readNeedles(dataFile, DataStart(c.srcAlignment), end, c.srcAlignment, func(batch []scannedNeedle) error {
+		return v.copyBatch(c, batch)
+	})
+	v.accessLock.Lock()
+	if e != nil {
+		return e
+	}
+	// a snapshot cut during the copy keeps the files as they are
+	if v.pinned() {
+		return ErrVolumePinned
+	}
+	return v.copyChanges(c, indexed)
+}
+
+// copyBatch copies the needles of the batch live or in the trash, checked
+// against the index and the trash under the access lock.
+func (v *Volume) copyBatch(c *compaction, batch []scannedNeedle) error {
+	live := make([]bool, len(batch))
+	trashed := make([]*trashEntry, len(batch))
+	v.accessLock.Lock()
+	for i, s := range batch {
+		id := util.BytesToUint64(s.record[4:12])
+		if nv, ok := v.nm.Get(id); ok && nv.Size > 0 && int64(nv.Offset)*8 == s.offset {
+			live[i] = true
+		} else if v.trash != nil {
+			if t := v.trash.entries[id]; t != nil && int64(t.Offset)*8 == s.offset {
+				trashed[i] = &trashEntry{DeletedAt: t.DeletedAt}
+			}
+		}
+	}
+	v.accessLock.Unlock()
+	for i, s := range batch {
+		if !live[i] && trashed[i] == nil {
+			continue
+		}
+		id := util.BytesToUint64(s.record[4:12])
+		offset, size, e := c.copy(s.record, s.offset)
+		if e != nil {
+			return e
+		}
+		if live[i] {
+			if _, e = c.nm.Put(id, offset, size); e != nil {
+				return e
+			}
+		} else {
+			trashed[i].Offset, trashed[i].Size = offset, size
+			c.trashCopied[id] = &copiedTrash{from: uint32(s.offset / 8), entry: trashed[i]}
+		}
+	}
+	return nil
+}
+
+// copyChanges replays on the compaction the index rows written since the copy
+// started, e.g. by deletes and undeletes, and copies the trash as it is now.
+// The caller holds the access lock.
+func (v *Volume) copyChanges(c *compaction, indexed int64) error {
+	stat, e := v.nm.indexFile.Stat()
+	if e != nil {
+		return e
+	}
+	rows := make([]byte, stat.Size()-indexed)
+	if _, e = v.nm.indexFile.ReadAt(rows, indexed); e != nil && e != io.EOF {
+		return e
+	}
+	for i := 0; i+16 <= len(rows); i += 16 {
+		id := util.BytesToUint64(rows[i : i+8])
+		offset, size := util.BytesToUint32(rows[i+8:i+12]), util.BytesToUint32(rows[i+12:i+16])
+		if offset == 0 {
+			c.nm.Delete(id)
+			continue
+		}
+		// an undeleted needle was copied with the trash
+		if t := c.trashCopied[id]; t != nil && t.from == offset {
+			offset, size = t.entry.Offset, t.entry.Size
+		} else if offset, size, e = v.copyAt(c, offset, size); e != nil {
+			return e
+		}
+		if _, e = c.nm.Put(id, offset, size); e != nil {
+			return e
+		}
+	}
+	c.trashed = make(map[uint64]*trashEntry)
+	if v.trash == nil {
+		return nil
+	}
+	for id, t := range v.trash.entries {
+		if copied := c.trashCopied[id]; copied != nil && copied.from == t.Offset {
+			c.trashed[id] = copied.entry
+			continue
+		}
+		// deleted during the copy
+		offset, size, e := v.copyAt(c, t.Offset, t.Size)
+		if e != nil {
+			return e
+		}
+		c.trashed[id] = &trashEntry{Offset: offset, Size: size, DeletedAt: t.DeletedAt}
+	}
+	return nil
+}
+
+// copyAt copies the needle at the offset of the volume to the compaction.
+// The caller holds the access lock.
+func (v *Volume) copyAt(c *compaction, offset, size uint32) (uint32, uint32, error) {
+	record := make([]byte, alignedSize(size, c.srcAlignment))
+	if _, e := v.dataFile.ReadAt(record, int64(offset)*8); e != nil {
+		return 0, 0, e
+	}
+	return c.copy(record, int64(offset)*8)
+}
+
+// copy appends the needle read from the data file at offset, as is or as
+// returned by the rewrite function, padded to the alignment, and returns its
+// offset and size in the compacted data file.
+func (c *compaction) copy(record []byte, offset int64) (uint32, uint32, error) {
+	newOffset, e := c.dst.Seek(0, 1)
+	if e != nil {
+		return 0, 0, e
+	}
+	size := util.BytesToUint32(record[12:16])
+	if c.rewrite != nil {
+		n := new(Needle)
+		if _, e = n.Read(bytes.NewReader(record), size, c.srcVersion); e != nil {
+			return 0, 0, e
+		}
+		rewritten, e := c.rewrite(n, offset)
+		if e != nil {
+			return 0, 0, e
+		}
+		if _, e = rewritten.AppendAligned(c.dst, c.version, c.alignment); e != nil {
+			return 0, 0, e
+		}
+		return uint32(newOffset / 8), rewritten.Size, nil
+	}
+	if c.alignment != c.srcAlignment {
+		padded := make([]byte, alignedSize(size, c.alignment))
+		copy(padded, record[:16+size+4])
+		record = padded
+	}
+	if _, e = c.dst.Write(record); e != nil {
+		return 0, 0, e
+	}
+	return uint32(newOffset / 8), size, nil
+}
@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestNeedle(id uint64) *Needle {
+	data := []byte("needle content " + strconv.FormatUint(id, 10))
+	return &Needle{Cookie: 0x12345678, Id: id, Data: data, Checksum: NewCRC(data)}
+}
+
+func TestCompactVolume(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_vacuum")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	defer v.Close()
+	for i := uint64(1); i <= 10; i++ {
+		v.write(newTestNeedle(i))
+	}
+	for i := uint64(1); i <= 10; i += 2 {
+		v.delete(newTestNeedle(i), false)
+	}
+	sizeBefore := v.Size()
+	if v.garbageLevel() <= 0 {
+		t.Fatal("expected garbage after deletes, got", v.garbageLevel())
+	}
+
+	if e := v.compact(); e != nil {
+		t.Fatal("compact error:", e)
+	}
+	if v.Size() >= sizeBefore {
+		t.Fatal("volume size", v.Size(), "not reduced from", sizeBefore)
+	}
+	if v.garbageLevel() != 0 {
+		t.Fatal("expected no garbage after compact, got", v.garbageLevel())
+	}
+	for i := uint64(1); i <= 10; i++ {
+		n := &Needle{Id: i}
+		_, e := v.read(n)
+		if i%2 == 1 {
+			if e == nil {
+				t.Fatal("needle", i, "should have been deleted")
+			}
+			continue
+		}
+		if e != nil {
+			t.Fatal("needle", i, "read error:", e)
+		}
+		if string(n.Data) != string(newTestNeedle(i).Data) {
+			t.Fatal("needle", i, "has unexpected data", string(n.Data))
+		}
+	}
+}
+
+func TestVolumeTurnsReadOnlyAfterWriteErrors(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_readonly")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	defer v.Close()
+	if _, e := v.write(newTestNeedle(1)); e != nil {
+		t.Fatal("write error:", e)
+	}
+	// simulate a failing disk
+	v.dataFile.Close()
+	for i := uint64(2); i < 2+MaxConsecutiveWriteErrors; i++ {
+		if _, e := v.write(newTestNeedle(i)); e == nil {
+			t.Fatal("write to a closed data file should fail")
+		}
+	}
+	if v.volumeInfo().State != VolumeReadOnly {
+		t.Fatal("volume should be read only after", MaxConsecutiveWriteErrors, "write errors")
+	}
+}
+
+func TestCompactVolumeFailedCommitKeepsServing(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_vacuum")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	defer v.Close()
+	for i := uint64(1); i <= 4; i++ {
+		v.write(newTestNeedle(i))
+	}
+	v.delete(newTestNeedle(1), false)
+	// the commit marker can not be written
+	if e := os.MkdirAll(v.FileName()+".cpc/blocked", 0755); e != nil {
+		t.Fatal(e)
+	}
+	if e := v.compact(); e == nil {
+		t.Fatal("compacted with the commit marker blocked")
+	}
+	for i := uint64(2); i <= 4; i++ {
+		n := &Needle{Id: i}
+		if _, e := v.read(n); e != nil || string(n.Data) != string(newTestNeedle(i).Data) {
+			t.Fatal("needle", i, "is not served after the failed compaction:", e)
+		}
+	}
+	if _, e := v.write(newTestNeedle(5)); e != nil {
+		t.Fatal("write after the failed compaction:", e)
+	}
+	for _, ext := range []string{".cpd", ".cpx"} {
+		if _, e := os.Stat(v.FileName() + ext); !os.IsNotExist(e) {
+			t.Fatal(ext, "is left behind")
+		}
+	}
+}
+
+// compactUntilCommitted runs a compaction of the volume up to its commit, as if
+// the server crashed right after.
+func compactUntilCommitted(t *testing.T, v *Volume, commit bool) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	c := &compaction{version: v.version, alignment: needleAlignment, trashCopied: make(map[uint64]*copiedTrash)}
+	if e := c.create(v.FileName()); e != nil {
+		t.Fatal(e)
+	}
+	if e := v.copyCompacted(c); e != nil {
+		t.Fatal(e)
+	}
+	if commit {
+		if e := c.commit(v.FileName()); e != nil {
+			t.Fatal(e)
+		}
+	}
+	c.close()
+}
+
+func TestCompactVolumeIsFinishedAfterACrash(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_vacuum")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	for i := uint64(1); i <= 4; i++ {
+		v.write(newTestNeedle(i))
+	}
+	v.delete(newTestNeedle(1), false)
+	sizeBefore := v.Size()
+	compactUntilCommitted(t, v, true)
+	v.Close()
+	// the crash is between the moves of the data file and of the index file
+	if e = os.Rename(v.FileName()+".cpd", v.FileName()+".dat"); e != nil {
+		t.Fatal(e)
+	}
+
+	v = NewVolume(dir, "", VolumeId(1), Copy000)
+	defer v.Close()
+	if v.Size() >= sizeBefore {
+		t.Fatal("volume size", v.Size(), "not reduced from", sizeBefore)
+	}
+	if _, e = v.read(&Needle{Id: 1}); e == nil {
+		t.Fatal("needle 1 should have been deleted")
+	}
+	for i := uint64(2); i <= 4; i++ {
+		n := &Needle{Id: i}
+		if _, e := v.read(n); e != nil || string(n.Data) != string(newTestNeedle(i).Data) {
+			t.Fatal("needle", i, "is not served after the compaction is finished:", e)
+		}
+	}
+	for _, ext := range []string{".cpc", ".cpd", ".cpx"} {
+		if _, e := os.Stat(v.FileName() + ext); !os.IsNotExist(e) {
+			t.Fatal(ext, "is left behind")
+		}
+	}
+}
+
+func TestCompactVolumeIsDroppedIfNotCommitted(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_vacuum")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	for i := uint64(1); i <= 4; i++ {
+		v.write(newTestNeedle(i))
+	}
+	v.delete(newTestNeedle(1), false)
+	sizeBefore := v.Size()
+	compactUntilCommitted(t, v, false)
+	v.Close()
+
+	v = NewVolume(dir, "", VolumeId(1), Copy000)
+	defer v.Close()
+	if v.Size() != sizeBefore {
+		t.Fatal("volume size", v.Size(), "is not", sizeBefore, "as before the compaction")
+	}
+	for i := uint64(2); i <= 4; i++ {
+		n := &Needle{Id: i}
+		if _, e := v.read(n); e != nil || string(n.Data) != string(newTestNeedle(i).Data) {
+			t.Fatal("needle", i, "is not served:", e)
+		}
+	}
+	for _, ext := range []string{".cpd", ".cpx"} {
+		if _, e := os.Stat(v.FileName() + ext); !os.IsNotExist(e) {
+			t.Fatal(ext, "is left behind")
+		}
+	}
+}
+
+func TestCompactVolumeCopiesTheChangesMadeDuringTheCopy(t *testing.T) {
+	dir, e := ioutil.TempDir("", "weedfs_vacuum")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewVolume(dir, "", VolumeId(1), Copy000)
+	defer v.Close()
+	for i := uint64(1); i <= 6; i++ {
+		v.write(newTestNeedle(i))
+	}
+	v.delete(newTestNeedle(5), true)
+
+	changed := false
+	v.accessLock.Lock()
+	e = v.rewrite(v.version, func(n *Needle, offset int64) (*Needle, error) {
+		if changed {
+			return n, nil
+		}
+		changed = true
+		// the volume is not locked during the copy
+		done := make(chan error, 1)
+		go func() {
+			if _, e := v.read(&Needle{Id: 6}); e != nil {
+				done <- e
+				return
+			}
+			v.delete(newTestNeedle(2), false)
+			v.delete(newTestNeedle(3), true)
+			_, e := v.undelete(&Needle{Id: 5, Cookie: 0x12345678})
+			done <- e
+		}()
+		select {
+		case e := <-done:
+			return n, e
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("the volume is locked during the copy")
+		}
+	})
+	v.accessLock.Unlock()
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, i := range []uint64{1, 4, 5, 6} {
+		n := &Needle{Id: i}
+		if _, e := v.read(n); e != nil || string(n.Data) != string(newTestNeedle(i).Data) {
+			t.Fatal("needle", i, "is not served after the compaction:", e)
+		}
+	}
+	for _, i := range []uint64{2, 3} {
+		if _, e := v.read(&Needle{Id: i}); e == nil {
+			t.Fatal("needle", i, "deleted during the copy is still served")
+		}
+	}
+	if _, e := v.undelete(&Needle{Id: 3, Cookie: 0x12345678}); e != nil {
+		t.Fatal("needle 3 trashed during the copy can not be undeleted:", e)
+	}
+	n := &Needle{Id: 3}
+	if _, e := v.read(n); e != nil || string(n.Data) != string(newTestNeedle(3).Data) {
+		t.Fatal("needle 3 is not served after its undelete:", e)
+	}
+	if _, e := v.write(newTestNeedle(7)); e != nil {
+		t.Fatal("write after the compaction:", e)
+	}
+}
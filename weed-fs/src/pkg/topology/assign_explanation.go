@@ -0,0 +1,130 @@
+package topology
+
+import (
+	"pkg/storage"
+	"sort"
+	"strconv"
+)
+
+// AssignExplanation tells why an assign picks its volume: the volumes of the
+// layout, and why the ones not picked from are excluded, and the free slots of
+// the data nodes, which weigh where the volumes grown for the layout are placed.
+type AssignExplanation struct {
+	Collection  string
+	Replication string
+	DataCenter  string `json:",omitempty"` // preferred with -writeAffinity
+	Grown       int    `json:",omitempty"` // volumes created for the assign, as none was writable
+	Rule        string // how the volume is picked among the candidates
+	Candidates  []*AssignCandidate
+	Nodes       []*AssignNode
+}
+
+type AssignCandidate struct {
+	Volume   storage.VolumeId
+	Replicas []string
+	Size     uint64
+	Excluded string `json:",omitempty"` // why the assign can not pick it, empty for the candidates picked from
+}
+
+type AssignNode struct {
+	Url        string
+	DataCenter string
+	Rack       string
+	FreeSlots  int    // the weight of the data node when placing a new volume replica
+	Excluded   string `json:",omitempty"` // why no new volume is placed on it
+}
+
+// ExplainAssign explains the pick of an assign of the layout, with the filter and the
+// preferred data center of the assign, as PickForWrite would make it.
+func (t *Topology) ExplainAssign(collection string, repType storage.ReplicationType, dataCenter string, filter NodeFilter) *AssignExplanation {
+	vl := t.GetVolumeLayout(collection, repType)
+	e := &AssignExplanation{Collection: collection, Replication: string(repType), DataCenter: dataCenter}
+	vids := make([]storage.VolumeId, 0, len(vl.vid2location))
+	for vid := range vl.vid2location {
+		vids = append(vids, vid)
+	}
+	sort.Slice(vids, func(i, j int) bool { return vids[i] < vids[j] })
+	picked, local := 0, 0
+	for _, vid := range vids {
+		c := &AssignCandidate{Volume: vid, Excluded: vl.exclusion(vid, filter)}
+		for _, dn := range vl.vid2location[vid].list {
+			c.Replicas = append(c.Replicas, dn.Url())
+			if v := dn.volumes[vid]; uint64(v.Size) > c.Size {
+				c.Size = uint64(v.Size)
+			}
+		}
+		if c.Excluded == "" {
+			picked++
+			if dataCenter != "" && vl.vid2location[vid].Length() > 0 {
+				if dc := vl.vid2location[vid].Head().GetDataCenter(); dc != nil && string(dc.Id()) == dataCenter {
+					local++
+				}
+			}
+		}
+		e.Candidates = append(e.Candidates, c)
+	}
+	if local > 0 {
+		// as PickForWrite, only the volumes whose first replica is in the data center are picked from
+		for _, c := range e.Candidates {
+			if c.Excluded != "" {
+				continue
+			}
+			if dc := vl.vid2location[c.Volume].Head().GetDataCenter(); dc == nil || string(dc.Id()) != dataCenter {
+				c.Excluded = "first replica not in data center " + dataCenter
+			}
+		}
+		picked = local
+	}
+	switch {
+	case picked == 0:
+		e.Rule = "no writable volume to pick"
+	case local > 0:
+		e.Rule = "random among the " + strconv.Itoa(picked) + " writable volumes with their first replica in data center " + dataCenter
+	default:
+		e.Rule = "random among the " + strconv.Itoa(picked) + " writable volumes"
+	}
+
+	t.eachDataNode(func(dc *DataCenter, dn *DataNode) {
+		n := &AssignNode{Url: dn.Url(), DataCenter: string(dc.Id()), Rack: string(dn.Parent().Id()), FreeSlots: dn.FreeSpace()}
+		switch {
+		case dn.Dead:
+			n.Excluded = "dead"
+		case dn.Draining:
+			n.Excluded = "draining"
+		case filter != nil && !filter(dn):
+			n.Excluded = "does not match the disk type or constraint"
+		case n.FreeSlots <= 0:
+			n.Excluded = "no free slot"
+		}
+		e.Nodes = append(e.Nodes, n)
+	})
+	sort.Slice(e.Nodes, func(i, j int) bool { return e.Nodes[i].Url < e.Nodes[j].Url })
+	return e
+}
+
+// exclusion tells why an assign with the filter can not pick the volume, or "" if it can.
+func (vl *VolumeLayout) exclusion(vid storage.VolumeId, filter NodeFilter) string {
+	list := vl.vid2location[vid].list
+	if len(list) < vl.repType.GetCopyCount() {
+		return "only " + strconv.Itoa(len(list)) + " of " + strconv.Itoa(vl.repType.GetCopyCount()) + " replicas"
+	}
+	for _, dn := range list {
+		v := dn.volumes[vid]
+		switch {
+		case !v.State.IsWritable():
+			return string(v.State) + " on " + dn.Url()
+		case uint64(v.Size) >= vl.volumeSizeLimit:
+			return "full on " + dn.Url()
+		case vl.volumeFileCountLimit > 0 && v.FileCount >= vl.volumeFileCountLimit:
+			return "at the file count limit on " + dn.Url()
+		case dn.Draining:
+			return "replica on draining " + dn.Url()
+		case filter != nil && !filter(dn):
+			return "replica on " + dn.Url() + " does not match the disk type or constraint"
+		}
+	}
+	if !vl.isVolumeWritable(vid) {
+		return "not writable"
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package topology
+
+import (
+	"pkg/storage"
+	"testing"
+)
+
+func TestExplainAssign(t *testing.T) {
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	volumes := []storage.VolumeInfo{
+		{Id: 1, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion},
+		{Id: 2, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion, State: storage.VolumeSealed},
+		{Id: 3, Size: 1000, RepType: storage.Copy000, Version: storage.CurrentVersion},
+	}
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	topo.RegisterVolumes([]storage.VolumeInfo{{Id: 4, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion}},
+		"127.0.0.2", 8080, "", 5, "ssd", nil)
+
+	e := topo.ExplainAssign("", storage.Copy000, "", DiskTypeFilter("hdd"))
+	if len(e.Candidates) != 4 || e.Rule != "random among the 1 writable volumes" {
+		t.Fatal("unexpected explanation", e.Rule, len(e.Candidates))
+	}
+	expected := []string{"", "sealed on 127.0.0.1:8080", "full on 127.0.0.1:8080", "replica on 127.0.0.2:8080 does not match the disk type or constraint"}
+	for i, c := range e.Candidates {
+		if c.Excluded != expected[i] {
+			t.Fatalf("volume %d excluded for %q, expecting %q", c.Volume, c.Excluded, expected[i])
+		}
+	}
+	if len(e.Nodes) != 2 || e.Nodes[0].FreeSlots != 2 || e.Nodes[0].Excluded != "" || e.Nodes[1].Excluded == "" {
+		t.Fatal("unexpected nodes", *e.Nodes[0], *e.Nodes[1])
+	}
+}
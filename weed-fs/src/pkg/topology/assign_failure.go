@@ -0,0 +1,68 @@
+package topology
+
+import (
+	"pkg/storage"
+)
+
+// Codes of the failed assigns, for the clients and the autoscalers to tell why
+// no volume was assigned, e.g. to add volume servers for AssignNoCapacity.
+const (
+	AssignInvalidRequest         = "invalid_request"         // bad replication, disk type, constraint or preallocate
+	AssignCapacityLow            = "capacity_low"            // refused under the -capacityMargin, retry later
+	AssignGrowing                = "growing"                 // another assign is growing volumes of the layout, retry shortly
+	AssignNoCapacity             = "no_capacity"             // no volume, and no free volume slot to create one
+	AssignVolumesFull            = "volumes_full"            // the volumes are full or sealed, and no free volume slot to grow more
+	AssignReplicationUnavailable = "replication_unavailable" // the free slots or the live replicas are too few for the replication
+)
+
+// AssignCounts are the volumes of the layout and the free slots an assign could
+// use, i.e. on the volume servers passing its filter.
+type AssignCounts struct {
+	Volumes     int `json:"volumes"`
+	Writable    int `json:"writable"`
+	Full        int `json:"full"`        // full, at the file count limit, or not writable, e.g. sealed
+	Unavailable int `json:"unavailable"` // missing replicas, or on draining volume servers
+	FreeSlots   int `json:"freeSlots"`
+	Servers     int `json:"servers"` // live volume servers with free slots
+}
+
+// AssignFailure tells why an assign of the layout with the filter found no
+// writable volume, after trying to grow one, with the counts behind it.
+func (t *Topology) AssignFailure(collection string, repType storage.ReplicationType, filter NodeFilter) (string, *AssignCounts) {
+	vl := t.GetVolumeLayout(collection, repType)
+	counts := &AssignCounts{FreeSlots: FreeSpaceMatching(t, filter)}
+	for vid, locations := range vl.vid2location {
+		matching := true
+		for _, dn := range locations.list {
+			matching = matching && (filter == nil || filter(dn))
+		}
+		if !matching {
+			continue
+		}
+		counts.Volumes++
+		switch {
+		case len(locations.list) < repType.GetCopyCount():
+			counts.Unavailable++
+		case vl.isVolumeFull(vid):
+			counts.Full++
+		case !vl.isVolumeWritable(vid):
+			counts.Unavailable++
+		default:
+			counts.Writable++
+		}
+	}
+	t.eachDataNode(func(dc *DataCenter, dn *DataNode) {
+		if !dn.Dead && dn.FreeSpace() > 0 && (filter == nil || filter(dn)) {
+			counts.Servers++
+		}
+	})
+	switch {
+	case counts.FreeSlots > 0:
+		return AssignReplicationUnavailable, counts
+	case counts.Volumes == 0:
+		return AssignNoCapacity, counts
+	case counts.Full > 0:
+		return AssignVolumesFull, counts
+	}
+	return AssignReplicationUnavailable, counts
+}
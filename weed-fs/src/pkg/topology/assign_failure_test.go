@@ -0,0 +1,32 @@
+package topology
+
+import (
+	"pkg/storage"
+	"testing"
+)
+
+func TestAssignFailure(t *testing.T) {
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	if code, counts := topo.AssignFailure("", storage.Copy000, nil); code != AssignNoCapacity || counts.Servers != 0 {
+		t.Fatal("unexpected failure of an empty topology", code, *counts)
+	}
+
+	volumes := []storage.VolumeInfo{
+		{Id: 1, Size: 1000, RepType: storage.Copy000, Version: storage.CurrentVersion},
+		{Id: 2, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion, State: storage.VolumeSealed},
+	}
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 2, "hdd", nil)
+	code, counts := topo.AssignFailure("", storage.Copy000, nil)
+	if code != AssignVolumesFull || *counts != (AssignCounts{Volumes: 2, Full: 2}) {
+		t.Fatal("unexpected failure of full volumes", code, *counts)
+	}
+
+	topo.RegisterVolumes(nil, "127.0.0.2", 8080, "", 3, "hdd", nil)
+	code, counts = topo.AssignFailure("", storage.Copy010, nil)
+	if code != AssignReplicationUnavailable || *counts != (AssignCounts{FreeSlots: 3, Servers: 1}) {
+		t.Fatal("unexpected failure of a replication on one rack", code, *counts)
+	}
+	if code, counts = topo.AssignFailure("", storage.Copy000, DiskTypeFilter("ssd")); code != AssignNoCapacity || counts.FreeSlots != 0 {
+		t.Fatal("unexpected failure of a missing disk type", code, *counts)
+	}
+}
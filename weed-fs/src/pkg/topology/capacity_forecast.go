@@ -0,0 +1,180 @@
+package topology
+
+import (
+	"pkg/storage"
+	"sort"
+	"sync"
+	"time"
+)
+
+// capacityForecast keeps samples of the bytes used by each layout and each data
+// center over a window, to project when they fill up at their recent write rate.
+type capacityForecast struct {
+	lock    sync.Mutex
+	window  time.Duration
+	samples []*capacitySample // oldest first
+}
+
+type capacitySample struct {
+	time        time.Time
+	layouts     map[capacityLayout]uint64 // bytes of each volume, once, whatever its copy count
+	dataCenters map[string]uint64         // bytes of all the replicas in the data center
+}
+
+type capacityLayout struct {
+	collection string
+	repType    storage.ReplicationType
+}
+
+// CapacityProjection is when a layout, a data center or the cluster is full, at
+// the rate its used bytes grew over the samples. The room of a layout counts all
+// the free volume slots, as if the other layouts did not grow.
+type CapacityProjection struct {
+	Collection    string `json:",omitempty"`
+	Replication   string `json:",omitempty"`
+	DataCenter    string `json:",omitempty"`
+	UsedBytes     uint64
+	FreeBytes     uint64  // left in the growing volumes, and in new volumes on the free slots
+	BytesPerDay   int64   // negative when the vacuums free more than is written
+	DaysUntilFull float64 // -1 when not filling up, or not sampled long enough
+}
+
+type CapacityReport struct {
+	Since       int64 // unix time of the oldest sample the rates are computed from
+	Cluster     *CapacityProjection
+	Layouts     []*CapacityProjection
+	DataCenters []*CapacityProjection
+}
+
+// StartCapacitySampling samples the used bytes every interval, keeping the samples over the window.
+func (t *Topology) StartCapacitySampling(interval, window time.Duration) {
+	t.capacityForecast = &capacityForecast{window: window}
+	go func() {
+		for {
+			t.sampleCapacity(time.Now())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (t *Topology) sampleCapacity(now time.Time) {
+	s := &capacitySample{time: now, layouts: make(map[capacityLayout]uint64), dataCenters: make(map[string]uint64)}
+	volumeBytes := make(map[capacityLayout]map[storage.VolumeId]uint64)
+	t.eachDataNode(func(dc *DataCenter, dn *DataNode) {
+		var used uint64
+		for _, v := range dn.volumes {
+			size := uint64(v.Size)
+			used += size
+			l := capacityLayout{v.Collection, v.RepType}
+			if volumeBytes[l] == nil {
+				volumeBytes[l] = make(map[storage.VolumeId]uint64)
+			}
+			if size > volumeBytes[l][v.Id] {
+				volumeBytes[l][v.Id] = size
+			}
+		}
+		s.dataCenters[string(dc.Id())] += used
+	})
+	for l, volumes := range volumeBytes {
+		for _, size := range volumes {
+			s.layouts[l] += size
+		}
+	}
+	f := t.capacityForecast
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.samples = append(f.samples, s)
+	for len(f.samples) > 2 && now.Sub(f.samples[1].time) >= f.window {
+		f.samples = f.samples[1:]
+	}
+}
+
+func (t *Topology) eachDataNode(visit func(dc *DataCenter, dn *DataNode)) {
+	for _, c := range t.DataCenters() {
+		for _, r := range c.Children() {
+			for _, d := range r.Children() {
+				visit(c.(*DataCenter), d.(*DataNode))
+			}
+		}
+	}
+}
+
+// CapacityForecast projects when each layout, each data center and the cluster
+// are full, or returns nil if the used bytes are not sampled.
+func (t *Topology) CapacityForecast() *CapacityReport {
+	f := t.capacityForecast
+	if f == nil {
+		return nil
+	}
+	f.lock.Lock()
+	if len(f.samples) == 0 {
+		f.lock.Unlock()
+		return nil
+	}
+	first, last := f.samples[0], f.samples[len(f.samples)-1]
+	f.lock.Unlock()
+	days := last.time.Sub(first.time).Hours() / 24
+
+	limit := t.volumeSizeLimit
+	room := func(v storage.VolumeInfo) uint64 {
+		if !v.State.IsWritable() || uint64(v.Size) >= limit {
+			return 0
+		}
+		return limit - uint64(v.Size)
+	}
+	freeSlots := uint64(t.FreeSpace())
+	layoutRoom := make(map[capacityLayout]map[storage.VolumeId]uint64)
+	dcRoom := make(map[string]uint64)
+	t.eachDataNode(func(dc *DataCenter, dn *DataNode) {
+		dcRoom[string(dc.Id())] += uint64(dn.FreeSpace()) * limit
+		for _, v := range dn.volumes {
+			dcRoom[string(dc.Id())] += room(v)
+			l := capacityLayout{v.Collection, v.RepType}
+			if layoutRoom[l] == nil {
+				layoutRoom[l] = make(map[storage.VolumeId]uint64)
+			}
+			if r, ok := layoutRoom[l][v.Id]; !ok || room(v) < r {
+				layoutRoom[l][v.Id] = room(v)
+			}
+		}
+	})
+
+	report := &CapacityReport{Since: first.time.Unix(), Cluster: &CapacityProjection{}}
+	for l, used := range last.layouts {
+		p := &CapacityProjection{Collection: l.collection, Replication: string(l.repType), UsedBytes: used}
+		p.FreeBytes = freeSlots / uint64(l.repType.GetCopyCount()) * limit
+		for _, r := range layoutRoom[l] {
+			p.FreeBytes += r
+		}
+		p.project(first.layouts[l], days)
+		report.Layouts = append(report.Layouts, p)
+	}
+	var clusterBefore uint64
+	for dc, used := range last.dataCenters {
+		p := &CapacityProjection{DataCenter: dc, UsedBytes: used, FreeBytes: dcRoom[dc]}
+		p.project(first.dataCenters[dc], days)
+		report.DataCenters = append(report.DataCenters, p)
+		report.Cluster.UsedBytes += used
+		report.Cluster.FreeBytes += dcRoom[dc]
+		clusterBefore += first.dataCenters[dc]
+	}
+	report.Cluster.project(clusterBefore, days)
+	sort.Slice(report.Layouts, func(i, j int) bool {
+		a, b := report.Layouts[i], report.Layouts[j]
+		return a.Collection < b.Collection || a.Collection == b.Collection && a.Replication < b.Replication
+	})
+	sort.Slice(report.DataCenters, func(i, j int) bool { return report.DataCenters[i].DataCenter < report.DataCenters[j].DataCenter })
+	return report
+}
+
+// project sets the rate from the bytes used days ago, and the days until the free bytes are used up.
+func (p *CapacityProjection) project(usedBefore uint64, days float64) {
+	p.DaysUntilFull = -1
+	if days <= 0 {
+		return
+	}
+	p.BytesPerDay = int64(float64(int64(p.UsedBytes)-int64(usedBefore)) / days)
+	if p.BytesPerDay > 0 {
+		p.DaysUntilFull = float64(p.FreeBytes) / float64(p.BytesPerDay)
+	}
+}
@@ -0,0 +1,48 @@
+package topology
+
+import (
+	"pkg/storage"
+	"testing"
+	"time"
+)
+
+func TestCapacityForecast(t *testing.T) {
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	if topo.CapacityForecast() != nil {
+		t.Fatal("no forecast without sampling")
+	}
+	topo.capacityForecast = &capacityForecast{window: 48 * time.Hour}
+	volumes := []storage.VolumeInfo{{Id: 1, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion}}
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	start := time.Now()
+	topo.sampleCapacity(start)
+	if report := topo.CapacityForecast(); report.Cluster.DaysUntilFull != -1 {
+		t.Fatal("one sample should not project", report.Cluster)
+	}
+
+	volumes[0].Size = 300
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	topo.sampleCapacity(start.Add(24 * time.Hour))
+	report := topo.CapacityForecast()
+	if len(report.Layouts) != 1 || len(report.DataCenters) != 1 {
+		t.Fatal("unexpected projections", report.Layouts, report.DataCenters)
+	}
+	// 700 bytes left in volume 1, and 4 free slots of 1000 bytes, at 200 bytes a day
+	for _, p := range []*CapacityProjection{report.Layouts[0], report.DataCenters[0], report.Cluster} {
+		if p.UsedBytes != 300 || p.FreeBytes != 4700 || p.BytesPerDay != 200 || p.DaysUntilFull != 23.5 {
+			t.Fatal("unexpected projection", *p)
+		}
+	}
+
+	// the samples older than the window are dropped, and a shrinking layout does not fill up
+	volumes[0].Size = 200
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	topo.sampleCapacity(start.Add(72 * time.Hour))
+	report = topo.CapacityForecast()
+	if report.Since != start.Add(24*time.Hour).Unix() {
+		t.Fatal("the first sample should be out of the window")
+	}
+	if p := report.Layouts[0]; p.BytesPerDay != -50 || p.DaysUntilFull != -1 {
+		t.Fatal("unexpected projection", *p)
+	}
+}
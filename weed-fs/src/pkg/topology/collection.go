@@ -0,0 +1,151 @@
+package topology
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"pkg/storage"
+	"pkg/util"
+	"sync"
+)
+
+// Collection groups volumes that are assigned and deleted together.
+// Each collection keeps its own volume layouts, one per replication type.
+// The default collection has an empty name.
+type Collection struct {
+	Name                     string
+	replicaType2VolumeLayout []*VolumeLayout
+}
+
+func NewCollection(name string) *Collection {
+	return &Collection{
+		Name:                     name,
+		replicaType2VolumeLayout: make([]*VolumeLayout, storage.LengthRelicationType),
+	}
+}
+
+func (c *Collection) Lookup(vid storage.VolumeId) *[]*DataNode {
+	for _, vl := range c.replicaType2VolumeLayout {
+		if vl != nil {
+			if list := vl.Lookup(vid); list != nil {
+				return list
+			}
+		}
+	}
+	return nil
+}
+
+// VolumeLayouts returns the volume layouts that have been created so far.
+func (c *Collection) VolumeLayouts() []*VolumeLayout {
+	var layouts []*VolumeLayout
+	for _, vl := range c.replicaType2VolumeLayout {
+		if vl != nil {
+			layouts = append(layouts, vl)
+		}
+	}
+	return layouts
+}
+
+// VolumeDeleteResult reports how deleting one volume went on its replicas.
+type VolumeDeleteResult struct {
+	VolumeId storage.VolumeId
+	Deleted  []string          // servers that removed the volume
+	Errors   map[string]string // server -> error, for servers that failed to
+}
+
+// DeleteCollection asks every volume server hosting a volume of the collection
+// to unload the volume and remove its files, and unregisters the removed replicas.
+// Replicas that failed to be removed stay registered, but are no longer writable.
+// The collection is dropped once it has no volumes left.
+func (t *Topology) DeleteCollection(collectionName string) ([]*VolumeDeleteResult, error) {
+	c, ok := t.collectionMap[collectionName]
+	if !ok {
+		return nil, errors.New("Collection " + collectionName + " is not found!")
+	}
+	var results []*VolumeDeleteResult
+	remaining := 0
+	for _, vl := range c.VolumeLayouts() {
+		for vid, locationList := range vl.vid2location {
+			result := t.deleteVolume(vl, vid, locationList)
+			results = append(results, result)
+			if len(result.Errors) > 0 {
+				remaining++
+				t.recordEvent("Failed to delete volume", vid, "of collection", collectionName, "on", result.Errors)
+			}
+		}
+	}
+	if remaining == 0 {
+		delete(t.collectionMap, collectionName)
+		t.recordEvent("Deleted collection", collectionName)
+	}
+	return results, nil
+}
+
+func (t *Topology) deleteVolume(vl *VolumeLayout, vid storage.VolumeId, locationList *VolumeLocationList) *VolumeDeleteResult {
+	vl.removeFromWritable(vid)
+	dataNodes := make([]*DataNode, locationList.Length())
+	copy(dataNodes, locationList.list)
+	errs := make([]error, len(dataNodes))
+	var wg sync.WaitGroup
+	for i, dn := range dataNodes {
+		wg.Add(1)
+		go func(i int, dn *DataNode) {
+			defer wg.Done()
+			errs[i] = deleteVolumeOnDataNode(dn.AdminUrl(), vid)
+		}(i, dn)
+	}
+	wg.Wait()
+	result := &VolumeDeleteResult{VolumeId: vid}
+	for i, dn := range dataNodes {
+		if errs[i] != nil {
+			if result.Errors == nil {
+				result.Errors = make(map[string]string)
+			}
+			result.Errors[dn.Url()] = errs[i].Error()
+			continue
+		}
+		vl.lock.Lock()
+		locationList.Remove(dn)
+		vl.lock.Unlock()
+		if v, ok := dn.volumes[vid]; ok {
+			delete(dn.volumes, vid)
+			// full volumes were already taken off the active volume count
+			if vl.isWritable(&v) {
+				dn.UpAdjustActiveVolumeCountDelta(-1)
+			}
+		}
+		result.Deleted = append(result.Deleted, dn.Url())
+	}
+	vl.lock.Lock()
+	deleted := locationList.Length() == 0
+	if deleted {
+		delete(vl.vid2location, vid)
+	}
+	vl.lock.Unlock()
+	if deleted {
+		t.markVolumeDeleted(vid, vl.collection)
+	}
+	t.locationsChanged()
+	return result
+}
+
+type deleteVolumeResult struct {
+	Error string
+}
+
+func deleteVolumeOnDataNode(server string, vid storage.VolumeId) error {
+	values := make(url.Values)
+	values.Add("volume", vid.String())
+	jsonBlob, err := util.Post("http://"+server+"/admin/delete_volume", values)
+	if err != nil {
+		return err
+	}
+	var ret deleteVolumeResult
+	if err := json.Unmarshal(jsonBlob, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	return nil
+}
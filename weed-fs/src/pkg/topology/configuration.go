@@ -2,6 +2,10 @@ package topology
 
 import (
 	"encoding/xml"
+	"net/http"
+	"pkg/storage"
+	"pkg/util"
+	"strings"
 )
 
 type loc struct {
@@ -16,27 +20,58 @@ type dataCenter struct {
 	Name  string `xml:"name,attr"`
 	Racks []rack `xml:"Rack"`
 }
+type region struct {
+	Name        string       `xml:"name,attr"`
+	DataCenters []dataCenter `xml:"DataCenter"`
+}
+type header struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+type collection struct {
+	Name         string   `xml:"name,attr"`
+	Constraint   string   `xml:"constraint,attr"`
+	DiskType     string   `xml:"diskType,attr"`
+	MaxSizeMB    int64    `xml:"maxSizeMB,attr"`
+	ContentTypes string   `xml:"contentTypes,attr"`
+	SignedReads  bool     `xml:"signedReads,attr"`
+	Headers      []header `xml:"Header"`
+}
 type topology struct {
+	Regions     []region     `xml:"Region"`
 	DataCenters []dataCenter `xml:"DataCenter"`
 }
 type Configuration struct {
-	XMLName     xml.Name `xml:"Configuration"`
-	Topo        topology `xml:"Topology"`
+	XMLName     xml.Name     `xml:"Configuration"`
+	Topo        topology     `xml:"Topology"`
+	Collections []collection `xml:"Collections>Collection"`
 	ip2location map[string]loc
+	dc2region   map[string]string
 }
 
 func NewConfiguration(b []byte) (*Configuration, error) {
 	c := &Configuration{}
 	err := xml.Unmarshal(b, c)
 	c.ip2location = make(map[string]loc)
-	for _, dc := range c.Topo.DataCenters {
+	c.dc2region = make(map[string]string)
+	c.addDataCenters(c.Topo.DataCenters)
+	for _, r := range c.Topo.Regions {
+		for _, dc := range r.DataCenters {
+			c.dc2region[dc.Name] = r.Name
+		}
+		c.addDataCenters(r.DataCenters)
+	}
+	return c, err
+}
+
+func (c *Configuration) addDataCenters(dataCenters []dataCenter) {
+	for _, dc := range dataCenters {
 		for _, rack := range dc.Racks {
 			for _, ip := range rack.Ips {
-				c.ip2location[ip] = loc{dcName: dc.Name, rackName: rack.Name}
+				c.ip2location[util.CanonicalHost(ip)] = loc{dcName: dc.Name, rackName: rack.Name}
 			}
 		}
 	}
-	return c, err
 }
 
 func (c *Configuration) String() string {
@@ -48,9 +83,84 @@ func (c *Configuration) String() string {
 
 func (c *Configuration) Locate(ip string) (dc string, rack string) {
 	if c != nil && c.ip2location != nil {
-		if loc, ok := c.ip2location[ip]; ok {
+		if loc, ok := c.ip2location[util.CanonicalHost(ip)]; ok {
 			return loc.dcName, loc.rackName
 		}
 	}
 	return "DefaultDataCenter", "DefaultRack"
 }
+
+// Constraint returns the placement constraint configured for the collection, or "" if there is none.
+func (c *Configuration) Constraint(collectionName string) string {
+	if c != nil {
+		for _, col := range c.Collections {
+			if col.Name == collectionName {
+				return col.Constraint
+			}
+		}
+	}
+	return ""
+}
+
+// DiskType returns the disk type, i.e. the storage class, configured for the
+// collection, or "" if its volumes can be on any disk.
+func (c *Configuration) DiskType(collectionName string) string {
+	if c != nil {
+		for _, col := range c.Collections {
+			if col.Name == collectionName {
+				return col.DiskType
+			}
+		}
+	}
+	return ""
+}
+
+// UploadPolicies returns the upload limits configured per collection.
+func (c *Configuration) UploadPolicies() map[string]*storage.UploadPolicy {
+	policies := make(map[string]*storage.UploadPolicy)
+	if c != nil {
+		for _, col := range c.Collections {
+			if policy := storage.NewUploadPolicy(col.MaxSizeMB*1024*1024, col.ContentTypes); policy != nil {
+				policies[col.Name] = policy
+			}
+		}
+	}
+	return policies
+}
+
+// SignedReadCollections lists the collections only readable with signed urls.
+func (c *Configuration) SignedReadCollections() (names []string) {
+	if c != nil {
+		for _, col := range c.Collections {
+			if col.SignedReads {
+				names = append(names, col.Name)
+			}
+		}
+	}
+	return
+}
+
+// ResponseHeaders returns the headers the volume servers add to the reads of
+// the files of each collection, e.g. <Header name="Cache-Control">max-age=3600</Header>.
+func (c *Configuration) ResponseHeaders() map[string]map[string]string {
+	headers := make(map[string]map[string]string)
+	if c != nil {
+		for _, col := range c.Collections {
+			for _, h := range col.Headers {
+				if headers[col.Name] == nil {
+					headers[col.Name] = make(map[string]string)
+				}
+				headers[col.Name][http.CanonicalHeaderKey(h.Name)] = strings.TrimSpace(h.Value)
+			}
+		}
+	}
+	return headers
+}
+
+// Region returns the region of the data center, or "" if it is not in any region.
+func (c *Configuration) Region(dcName string) string {
+	if c != nil && c.dc2region != nil {
+		return c.dc2region[dcName]
+	}
+	return ""
+}
@@ -40,3 +40,156 @@ func TestLoadConfiguration(t *testing.T) {
     t.Fatalf("unmarshal error:%s",c)
 	}
 }
+
+func TestLoadConfigurationWithRegions(t *testing.T) {
+	confContent := `
+<?xml version="1.0" encoding="UTF-8" ?>
+<Configuration>
+  <Topology>
+    <Region name="us-east">
+      <DataCenter name="dc1">
+        <Rack name="rack1">
+          <Ip>192.168.1.1</Ip>
+        </Rack>
+      </DataCenter>
+    </Region>
+    <DataCenter name="dc2">
+      <Rack name="rack1">
+        <Ip>192.168.1.2</Ip>
+      </Rack>
+    </DataCenter>
+  </Topology>
+</Configuration>
+`
+	c, err := NewConfiguration([]byte(confContent))
+	if err != nil {
+		t.Fatalf("unmarshal error:%s", err.Error())
+	}
+	if dc, rack := c.Locate("192.168.1.1"); dc != "dc1" || rack != "rack1" {
+		t.Fatalf("192.168.1.1 is located in %s %s", dc, rack)
+	}
+	if region := c.Region("dc1"); region != "us-east" {
+		t.Fatalf("dc1 is in region %s", region)
+	}
+	if region := c.Region("dc2"); region != "" {
+		t.Fatalf("dc2 should not be in any region, but is in %s", region)
+	}
+}
+
+func TestLoadConfigurationWithCollectionConstraints(t *testing.T) {
+	confContent := `
+<?xml version="1.0" encoding="UTF-8" ?>
+<Configuration>
+  <Topology>
+  </Topology>
+  <Collections>
+    <Collection name="photos" constraint="env=prod &amp;&amp; disk=nvme"/>
+  </Collections>
+</Configuration>
+`
+	c, err := NewConfiguration([]byte(confContent))
+	if err != nil {
+		t.Fatalf("unmarshal error:%s", err.Error())
+	}
+	if constraint := c.Constraint("photos"); constraint != "env=prod && disk=nvme" {
+		t.Fatalf("photos has constraint %s", constraint)
+	}
+	if constraint := c.Constraint("logs"); constraint != "" {
+		t.Fatalf("logs should have no constraint, but has %s", constraint)
+	}
+}
+
+func TestCollectionPolicies(t *testing.T) {
+	c, err := NewConfiguration([]byte(`
+<Configuration>
+  <Collections>
+    <Collection name="photos" maxSizeMB="10" contentTypes="image/jpeg, image/*"/>
+    <Collection name="logs" constraint="disk=hdd" signedReads="true">
+      <Header name="cache-control">
+        private, max-age=60
+      </Header>
+      <Header name="Access-Control-Allow-Origin">*</Header>
+    </Collection>
+  </Collections>
+</Configuration>
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := c.UploadPolicies()
+	if len(policies) != 1 {
+		t.Fatal("expecting only the photos policy, got", policies)
+	}
+	if p := policies["photos"]; p.MaxSize != 10*1024*1024 || len(p.ContentTypes) != 2 || p.ContentTypes[1] != "image/*" {
+		t.Fatal("unexpected photos policy", p)
+	}
+	if names := c.SignedReadCollections(); len(names) != 1 || names[0] != "logs" {
+		t.Fatal("expecting only logs to need signed reads, got", names)
+	}
+	headers := c.ResponseHeaders()
+	if len(headers) != 1 || len(headers["logs"]) != 2 {
+		t.Fatal("expecting 2 headers for logs only, got", headers)
+	}
+	if value := headers["logs"]["Cache-Control"]; value != "private, max-age=60" {
+		t.Fatal("unexpected Cache-Control for logs", value)
+	}
+}
+
+func TestCollectionStorageClass(t *testing.T) {
+	c, err := NewConfiguration([]byte(`
+<Configuration>
+  <Collections>
+    <Collection name="logs" diskType="archive"/>
+  </Collections>
+</Configuration>
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	topo.configuration = c
+	ssd, _ := topo.RegisterVolumes(nil, "127.0.0.1", 8080, "", 5, "ssd", nil)
+	archive, _ := topo.RegisterVolumes(nil, "127.0.0.2", 8080, "", 5, "archive", nil)
+	if class, err := topo.StorageClass("logs", ""); class != "archive" || err != nil {
+		t.Fatal("logs should be stored on archive disks", class, err)
+	}
+	if _, err = topo.NodeFilter("logs", "ssd", ""); err == nil {
+		t.Fatal("logs should not be stored on ssd disks")
+	}
+	filter, err := topo.NodeFilter("logs", "", "")
+	if err != nil || filter(ssd) || !filter(archive) {
+		t.Fatal("only the archive volume server should take logs", err)
+	}
+	if filter, err = topo.NodeFilter("photos", "ssd", ""); err != nil || !filter(ssd) || filter(archive) {
+		t.Fatal("photos can be stored on any disk type asked for", err)
+	}
+}
+
+func TestLocateIPv6(t *testing.T) {
+	c, err := NewConfiguration([]byte(`
+<Configuration>
+  <Topology>
+    <DataCenter name="dc1">
+      <Rack name="rack1">
+        <Ip>2001:DB8:0::1</Ip>
+      </Rack>
+    </DataCenter>
+  </Topology>
+</Configuration>
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dc, rack := c.Locate("[2001:db8::1]"); dc != "dc1" || rack != "rack1" {
+		t.Fatal("2001:db8::1 should be located in dc1 rack1", dc, rack)
+	}
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	topo.configuration = c
+	dn, _ := topo.RegisterVolumes(nil, "2001:db8:0:0::1", 8080, "", 5, "hdd", nil)
+	if dn.Url() != "[2001:db8::1]:8080" || string(dn.GetDataCenter().Id()) != "dc1" {
+		t.Fatal("unexpected url or data center", dn.Url(), dn.GetDataCenter().Id())
+	}
+	if again, _ := topo.RegisterVolumes(nil, "2001:db8::1", 8080, "", 5, "hdd", nil); again != dn {
+		t.Fatal("the volume server should be found again whichever way its ip is written")
+	}
+}
@@ -30,6 +30,12 @@ func (dc *DataCenter) GetOrCreateRack(rackName string) *Rack {
 
 func (dc *DataCenter) ToMap() interface{}{
   m := make(map[string]interface{})
+  m["Id"] = dc.Id()
+  if p := dc.Parent(); p != nil {
+    if r, ok := p.GetValue().(*Region); ok {
+      m["Region"] = r.Id()
+    }
+  }
   m["Max"] = dc.GetMaxVolumeCount()
   m["Free"] = dc.FreeSpace()
   var racks []interface{}
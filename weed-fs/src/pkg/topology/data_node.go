@@ -3,17 +3,29 @@ package topology
 import (
 	_ "fmt"
 	"pkg/storage"
-	"strconv"
+	"pkg/util"
+	"time"
 )
 
 type DataNode struct {
 	NodeImpl
 	volumes   map[storage.VolumeId]storage.VolumeInfo
+	orphans   map[storage.VolumeId]storage.VolumeInfo // replicas of deleted volumes, held until adopted or purged
 	Ip        string
 	Port      int
+	AdminPort int // of the /admin/ api, 0 when it is served on Port
+	GrpcPort  int // of the Volume gRPC service, 0 when it is not served
 	PublicUrl string
-	LastSeen  int64 // unix time in seconds
-	Dead    bool
+	LastSeen  int64 // unix time in seconds, by the master's clock when the last heartbeat arrived
+	ClockSkew int64 // seconds the volume server's clock is ahead of the master's
+	Dead      bool
+	Draining  bool   // takes no new volumes and no writes
+	DiskType  string // e.g. hdd or ssd
+	Labels    map[string]string
+
+	reads map[storage.VolumeId]uint64 // of each volume since the volume server started, from its last heartbeat
+
+	drainedMaxVolumeCount int
 }
 
 func NewDataNode(id string) *DataNode {
@@ -21,6 +33,7 @@ func NewDataNode(id string) *DataNode {
 	s.id = NodeId(id)
 	s.nodeType = "DataNode"
 	s.volumes = make(map[storage.VolumeId]storage.VolumeInfo)
+	s.orphans = make(map[storage.VolumeId]storage.VolumeInfo)
   s.NodeImpl.value = s
 	return s
 }
@@ -33,19 +46,50 @@ func (dn *DataNode) AddOrUpdateVolume(v storage.VolumeInfo) {
 		dn.volumes[v.Id] = v
 	}
 }
+
+// GetTopology returns the topology of the data node, or nil if it is not linked into one.
 func (dn *DataNode) GetTopology() *Topology {
-	p := dn.parent
-	for p.Parent() != nil {
-		p = p.Parent()
+	if dn.parent == nil {
+		return nil
 	}
-	t := p.(*Topology)
-	return t
+	return dn.NodeImpl.GetTopology()
+}
+func (dn *DataNode) GetDataCenter() *DataCenter {
+	if rack := dn.Parent(); rack != nil && rack.Parent() != nil {
+		if dc, ok := rack.Parent().GetValue().(*DataCenter); ok {
+			return dc
+		}
+	}
+	return nil
+}
+
+// HeartbeatAge is the number of seconds since the last heartbeat arrived.
+func (dn *DataNode) HeartbeatAge() int64 {
+	return time.Now().Unix() - dn.LastSeen
 }
 func (dn *DataNode) MatchLocation(ip string, port int) bool {
 	return dn.Ip == ip && dn.Port == port
 }
 func (dn *DataNode) Url() string {
-  return dn.Ip + ":" + strconv.Itoa(dn.Port)
+	return util.JoinHostPort(dn.Ip, dn.Port)
+}
+
+// AdminUrl is where the master and the tools call the /admin/ api of the volume
+// server, which can be firewalled apart from the files served at Url.
+func (dn *DataNode) AdminUrl() string {
+	if dn.AdminPort == 0 {
+		return dn.Url()
+	}
+	return util.JoinHostPort(dn.Ip, dn.AdminPort)
+}
+
+// GrpcUrl is where the Volume gRPC service of the volume server is called, or
+// empty if it is not served.
+func (dn *DataNode) GrpcUrl() string {
+	if dn.GrpcPort == 0 {
+		return ""
+	}
+	return util.JoinHostPort(dn.Ip, dn.GrpcPort)
 }
 
 func (dn *DataNode) ToMap() interface{} {
@@ -55,5 +99,15 @@ func (dn *DataNode) ToMap() interface{} {
 	ret["Max"] = dn.GetMaxVolumeCount()
 	ret["Free"] = dn.FreeSpace()
 	ret["PublicUrl"] = dn.PublicUrl
+	ret["AdminUrl"] = dn.AdminUrl()
+	ret["GrpcUrl"] = dn.GrpcUrl()
+	ret["Draining"] = dn.Draining
+	ret["DiskType"] = dn.DiskType
+	ret["Labels"] = dn.Labels
+	ret["LastHeartbeatAge"] = dn.HeartbeatAge()
+	ret["ClockSkew"] = dn.ClockSkew
+	if t := dn.GetTopology(); t != nil {
+		ret["Slow"] = !dn.Dead && dn.HeartbeatAge() > 2*t.pulse
+	}
 	return ret
 }
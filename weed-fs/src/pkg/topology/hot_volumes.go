@@ -0,0 +1,346 @@
+package topology
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"pkg/storage"
+	"pkg/util"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hotVolumes copies the sealed volumes read the most onto more volume servers,
+// beyond their replication, so the reads spread over more servers. The copies,
+// or mirrors, are registered as replicas, looked up and deleted like the others,
+// and retired once the reads cool down, or before the volume is unsealed.
+type hotVolumes struct {
+	lock       sync.Mutex
+	threshold  float64                                // reads per second of a volume, over all its replicas, to mirror it
+	maxMirrors int                                    // per volume
+	cooldown   time.Duration                          // under half the threshold this long before a mirror is retired
+	lastCounts map[string]map[storage.VolumeId]uint64 // the read counts of each data node at the last check
+	lastTime   time.Time
+	rates      map[storage.VolumeId]float64
+	mirrored   map[storage.VolumeId]*MirroredVolume
+	file       string // where the mirrors are saved, empty to only keep them in memory
+}
+
+// MirroredVolume lists the mirrors of a hot volume.
+type MirroredVolume struct {
+	Id         storage.VolumeId
+	Collection string
+	Mirrors    []string // urls of the volume servers with a mirror, oldest first
+	CoolSince  int64    `json:",omitempty"` // unix time the reads went under half the threshold, 0 while hot
+}
+
+// HotVolume is a volume read at the last check, with its mirrors.
+type HotVolume struct {
+	Id             storage.VolumeId
+	ReadsPerSecond float64
+	Mirrors        []string
+}
+
+// StartHotVolumeMirroring checks the read rates of the volumes every interval,
+// adding a mirror to the sealed volumes read at least threshold times per second,
+// up to maxMirrors each, and retiring one once the reads stayed under half the
+// threshold for the cooldown. The mirrors are saved in the file, if not empty.
+func (t *Topology) StartHotVolumeMirroring(threshold float64, maxMirrors int, cooldown, interval time.Duration, file string) error {
+	h := &hotVolumes{threshold: threshold, maxMirrors: maxMirrors, cooldown: cooldown, file: file,
+		rates: make(map[storage.VolumeId]float64), mirrored: make(map[storage.VolumeId]*MirroredVolume)}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			var mirrored []*MirroredVolume
+			if err = json.Unmarshal(data, &mirrored); err != nil {
+				return errors.New(file + ": " + err.Error())
+			}
+			for _, m := range mirrored {
+				h.mirrored[m.Id] = m
+			}
+		}
+	}
+	t.hotVolumes = h
+	go func() {
+		for {
+			time.Sleep(interval)
+			t.checkHotVolumes(time.Now())
+		}
+	}()
+	return nil
+}
+
+// RecordReads keeps the read counts of the volumes of the data node, from its heartbeat.
+func (t *Topology) RecordReads(dn *DataNode, counts map[storage.VolumeId]uint64) {
+	dn.reads = counts
+}
+
+// save writes the mirrored volumes to the file, under the lock.
+func (h *hotVolumes) save() error {
+	if h.file == "" {
+		return nil
+	}
+	mirrored := make([]*MirroredVolume, 0, len(h.mirrored))
+	for _, m := range h.mirrored {
+		mirrored = append(mirrored, m)
+	}
+	sort.Slice(mirrored, func(i, j int) bool { return mirrored[i].Id < mirrored[j].Id })
+	data, err := json.MarshalIndent(mirrored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(h.file+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(h.file+".tmp", h.file)
+}
+
+// checkHotVolumes computes the read rates since the last check, from the read
+// counts of the heartbeats, and adds or retires one mirror of each volume.
+func (t *Topology) checkHotVolumes(now time.Time) {
+	h := t.hotVolumes
+	counts := make(map[string]map[storage.VolumeId]uint64)
+	rates := make(map[storage.VolumeId]float64)
+	elapsed := now.Sub(h.lastTime).Seconds()
+	t.eachDataNode(func(dc *DataCenter, dn *DataNode) {
+		counts[dn.Url()] = dn.reads
+		last, known := h.lastCounts[dn.Url()]
+		if !known || elapsed <= 0 {
+			return
+		}
+		for vid, count := range dn.reads {
+			reads := count
+			if previous, ok := last[vid]; ok && previous <= count {
+				reads = count - previous
+			} // else new on the data node, or counted again from 0 after a restart
+			rates[vid] += float64(reads) / elapsed
+		}
+	})
+	var toMirror, toRetire []storage.VolumeId
+	h.lock.Lock()
+	h.lastCounts, h.lastTime, h.rates = counts, now, rates
+	for vid, rate := range rates {
+		if m := h.mirrored[vid]; rate >= h.threshold && (m == nil || len(m.Mirrors) < h.maxMirrors) {
+			toMirror = append(toMirror, vid)
+		}
+	}
+	for vid, m := range h.mirrored {
+		if t.IsDeletedVolume(vid) {
+			// the mirrors were deleted with the volume
+			delete(h.mirrored, vid)
+			if err := h.save(); err != nil {
+				t.recordEvent("Failed to save the mirrored volumes:", err)
+			}
+		} else if rates[vid] >= h.threshold/2 {
+			m.CoolSince = 0
+		} else if m.CoolSince == 0 {
+			m.CoolSince = now.Unix()
+		} else if now.Sub(time.Unix(m.CoolSince, 0)) >= h.cooldown {
+			toRetire = append(toRetire, vid)
+		}
+	}
+	h.lock.Unlock()
+	sort.Slice(toMirror, func(i, j int) bool { return rates[toMirror[i]] > rates[toMirror[j]] })
+	for _, vid := range toMirror {
+		if err := t.mirrorVolume(vid); err != nil && err != errNotSealed {
+			t.recordEvent("Failed to mirror the hot volume", vid, ":", err)
+		}
+	}
+	for _, vid := range toRetire {
+		if err := t.retireMirror(vid, now); err != nil {
+			t.recordEvent("Failed to retire a mirror of volume", vid, ":", err)
+		}
+	}
+}
+
+var errNotSealed = errors.New("only sealed volumes are mirrored")
+
+// mirroring copies the whole volume over the network, like compacting copies it on disk
+const mirrorVolumeTimeout = vacuumCompactTimeout
+
+// mirrorVolume copies the sealed volume onto the live data node not holding it
+// with the most free slots, from one of its replicas.
+func (t *Topology) mirrorVolume(vid storage.VolumeId) error {
+	vl, locationList := t.findVolumeLayout(vid)
+	if vl == nil {
+		return errors.New("Volume " + vid.String() + " is not found!")
+	}
+	var source *DataNode
+	for _, dn := range locationList.list {
+		v, ok := dn.volumes[vid]
+		if !ok || v.State != storage.VolumeSealed {
+			return errNotSealed
+		}
+		if source == nil && !dn.Dead {
+			source = dn
+		}
+	}
+	if source == nil {
+		return errors.New("Volume " + vid.String() + " has no live replica to copy")
+	}
+	var target *DataNode
+	t.eachDataNode(func(dc *DataCenter, dn *DataNode) {
+		if _, holds := dn.volumes[vid]; holds || dn.Dead || dn.Draining || dn.FreeSpace() <= 0 {
+			return
+		}
+		if _, holds := dn.orphans[vid]; holds {
+			return
+		}
+		if target == nil || dn.FreeSpace() > target.FreeSpace() || dn.FreeSpace() == target.FreeSpace() && dn.Url() < target.Url() {
+			target = dn
+		}
+	})
+	if target == nil {
+		return errors.New("No free volume slot left for a mirror of volume " + vid.String())
+	}
+	v := source.volumes[vid]
+	if err := mirrorVolumeOnDataNode(target.AdminUrl(), vid, v.Collection, source.AdminUrl()); err != nil {
+		return errors.New(target.Url() + ": " + err.Error())
+	}
+	target.AddOrUpdateVolume(v)
+	t.RegisterVolumeLayout(&v, target)
+	t.locationsChanged()
+
+	h := t.hotVolumes
+	h.lock.Lock()
+	m := h.mirrored[vid]
+	if m == nil {
+		m = &MirroredVolume{Id: vid, Collection: v.Collection}
+		h.mirrored[vid] = m
+	}
+	m.Mirrors, m.CoolSince = append(m.Mirrors, target.Url()), 0
+	err := h.save()
+	h.lock.Unlock()
+	if err != nil {
+		t.recordEvent("Failed to save the mirrored volumes:", err)
+	}
+	t.recordEvent("Volume", vid, "is hot, mirrored on", target.Url(), "from", source.Url())
+	return nil
+}
+
+// retireMirror deletes the newest mirror of the volume, and restarts its cooldown
+// if it has more.
+func (t *Topology) retireMirror(vid storage.VolumeId, now time.Time) error {
+	h := t.hotVolumes
+	h.lock.Lock()
+	m := h.mirrored[vid]
+	if m == nil || len(m.Mirrors) == 0 {
+		h.lock.Unlock()
+		return nil
+	}
+	mirror := m.Mirrors[len(m.Mirrors)-1]
+	h.lock.Unlock()
+
+	var mirrorNode *DataNode
+	t.eachDataNode(func(dc *DataCenter, dn *DataNode) {
+		if dn.Url() == mirror {
+			mirrorNode = dn
+		}
+	})
+	// a mirror on a data node gone from the topology is forgotten
+	if mirrorNode != nil {
+		if err := deleteVolumeOnDataNode(mirror, vid); err != nil {
+			return errors.New(mirror + ": " + err.Error())
+		}
+		if vl, locationList := t.findVolumeLayout(vid); vl != nil {
+			locationList.Remove(mirrorNode)
+		}
+		if _, ok := mirrorNode.volumes[vid]; ok {
+			delete(mirrorNode.volumes, vid)
+			// the mirror took a slot when added
+			mirrorNode.UpAdjustActiveVolumeCountDelta(-1)
+		}
+		t.locationsChanged()
+	}
+
+	h.lock.Lock()
+	m.Mirrors = m.Mirrors[:len(m.Mirrors)-1]
+	if len(m.Mirrors) == 0 {
+		delete(h.mirrored, vid)
+	} else {
+		m.CoolSince = now.Unix()
+	}
+	err := h.save()
+	h.lock.Unlock()
+	if err != nil {
+		t.recordEvent("Failed to save the mirrored volumes:", err)
+	}
+	t.recordEvent("Retired the mirror of volume", vid, "on", mirror)
+	return nil
+}
+
+// retireMirrors deletes all the mirrors of the volume, e.g. before it is unsealed,
+// as the mirrors are not counted in its replication.
+func (t *Topology) retireMirrors(vid storage.VolumeId) error {
+	h := t.hotVolumes
+	if h == nil {
+		return nil
+	}
+	for {
+		h.lock.Lock()
+		m := h.mirrored[vid]
+		h.lock.Unlock()
+		if m == nil {
+			return nil
+		}
+		if err := t.retireMirror(vid, time.Now()); err != nil {
+			return err
+		}
+	}
+}
+
+// HotVolumes lists the volumes read since the last check, and the volumes with
+// mirrors, the most read first. It is nil if the mirroring is not started.
+func (t *Topology) HotVolumes() []*HotVolume {
+	h := t.hotVolumes
+	if h == nil {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hot := []*HotVolume{}
+	for vid, rate := range h.rates {
+		if h.mirrored[vid] == nil {
+			hot = append(hot, &HotVolume{Id: vid, ReadsPerSecond: rate, Mirrors: []string{}})
+		}
+	}
+	for vid, m := range h.mirrored {
+		hot = append(hot, &HotVolume{Id: vid, ReadsPerSecond: h.rates[vid], Mirrors: append([]string{}, m.Mirrors...)})
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		return hot[i].ReadsPerSecond > hot[j].ReadsPerSecond || hot[i].ReadsPerSecond == hot[j].ReadsPerSecond && hot[i].Id < hot[j].Id
+	})
+	return hot
+}
+
+type mirrorVolumeResult struct {
+	Error string
+}
+
+func mirrorVolumeOnDataNode(server string, vid storage.VolumeId, collection string, source string) error {
+	values := make(url.Values)
+	values.Add("volume", vid.String())
+	values.Add("collection", collection)
+	values.Add("source", source)
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorVolumeTimeout)
+	defer cancel()
+	jsonBlob, err := util.PostContext(ctx, "http://"+server+"/admin/mirror_volume", values)
+	if err != nil {
+		return err
+	}
+	var ret mirrorVolumeResult
+	if err := json.Unmarshal(jsonBlob, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package topology
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"pkg/storage"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHotVolumeMirrors(t *testing.T) {
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path+"?volume="+r.FormValue("volume"))
+		w.Write([]byte(`{"error":""}`))
+	}))
+	defer server.Close()
+	port, _ := strconv.Atoi(server.URL[strings.LastIndex(server.URL, ":")+1:])
+
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	if err := topo.StartHotVolumeMirroring(50, 1, time.Minute, time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	volumes := []storage.VolumeInfo{
+		{Id: 1, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion, State: storage.VolumeSealed},
+		{Id: 2, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion, State: storage.VolumeGrowing},
+	}
+	source, _ := topo.RegisterVolumes(volumes, "127.0.0.1", port, "", 5, "hdd", nil)
+	mirror, _ := topo.RegisterVolumes(nil, "localhost", port, "", 5, "hdd", nil)
+
+	start := time.Now()
+	topo.RecordReads(source, map[storage.VolumeId]uint64{1: 100, 2: 100})
+	topo.checkHotVolumes(start)
+	topo.RecordReads(source, map[storage.VolumeId]uint64{1: 1100, 2: 1100})
+	topo.checkHotVolumes(start.Add(10 * time.Second))
+	if len(calls) != 1 || calls[0] != "/admin/mirror_volume?volume=1" {
+		t.Fatal("only the sealed volume should be mirrored", calls)
+	}
+	if locations := topo.Lookup(1); len(*locations) != 2 || mirror.FreeSpace() != 4 {
+		t.Fatal("the mirror should be looked up like a replica", *locations)
+	}
+	hot := topo.HotVolumes()
+	if len(hot) != 2 || hot[0].ReadsPerSecond != 100 || len(hot[0].Mirrors) != 1 || hot[0].Mirrors[0] != mirror.Url() {
+		t.Fatal("unexpected hot volumes", hot[0], hot[1])
+	}
+
+	// still hot, but at the most mirrors
+	topo.RecordReads(source, map[storage.VolumeId]uint64{1: 2100})
+	topo.checkHotVolumes(start.Add(20 * time.Second))
+	if len(calls) != 1 {
+		t.Fatal("volume 1 has its one mirror already", calls)
+	}
+
+	// cooled down for a minute
+	topo.checkHotVolumes(start.Add(30 * time.Second))
+	topo.checkHotVolumes(start.Add(60 * time.Second))
+	if len(calls) != 1 {
+		t.Fatal("the mirror should stay through the cooldown", calls)
+	}
+	topo.checkHotVolumes(start.Add(90 * time.Second))
+	if len(calls) != 2 || calls[1] != "/admin/delete_volume?volume=1" {
+		t.Fatal("the mirror should be retired", calls)
+	}
+	if locations := topo.Lookup(1); len(*locations) != 1 || mirror.FreeSpace() != 5 || len(topo.HotVolumes()[0].Mirrors) != 0 {
+		t.Fatal("the mirror should be gone", *locations)
+	}
+
+	// unsealing retires the mirrors first
+	topo.RecordReads(source, map[storage.VolumeId]uint64{1: 5100})
+	topo.checkHotVolumes(start.Add(100 * time.Second))
+	if err := topo.SetVolumeState(1, storage.VolumeGrowing); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 5 || calls[3] != "/admin/delete_volume?volume=1" || calls[4] != "/admin/set_volume_state?volume=1" {
+		t.Fatal("the mirror should be retired before unsealing", calls)
+	}
+	if locations := topo.Lookup(1); len(*locations) != 1 {
+		t.Fatal("only the replica should be unsealed", *locations)
+	}
+}
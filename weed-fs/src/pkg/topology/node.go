@@ -21,7 +21,7 @@ type Node interface {
 	SetParent(Node)
 	LinkChildNode(node Node)
 	UnlinkChildNode(nodeId NodeId)
-	CollectDeadNodeAndFullVolumes(freshThreshHold int64, volumeSizeLimit uint64)
+	CollectDeadNodeAndFullVolumes(freshThreshHold int64)
 
 	IsDataNode() bool
 	Children() map[NodeId]Node
@@ -78,7 +78,7 @@ func (n *NodeImpl) GetValue() interface{} {
 func (n *NodeImpl) ReserveOneVolume(r int, vid storage.VolumeId) (bool, *DataNode) {
 	ret := false
 	var assignedNode *DataNode
-	for _, node := range n.children {
+	for _, node := range sortedNodes(n.children) {
 		freeSpace := node.FreeSpace()
 		//fmt.Println("r =", r, ", node =", node, ", freeSpace =", freeSpace)
 		if freeSpace <= 0 {
@@ -152,7 +152,7 @@ func (n *NodeImpl) UnlinkChildNode(nodeId NodeId) {
 	}
 }
 
-func (n *NodeImpl) CollectDeadNodeAndFullVolumes(freshThreshHold int64, volumeSizeLimit uint64) {
+func (n *NodeImpl) CollectDeadNodeAndFullVolumes(freshThreshHold int64) {
 	if n.IsRack() {
 		for _, c := range n.Children() {
 			dn := c.(*DataNode) //can not cast n to DataNode
@@ -163,14 +163,14 @@ func (n *NodeImpl) CollectDeadNodeAndFullVolumes(freshThreshHold int64, volumeSi
 				}
 			}
 			for _, v := range dn.volumes {
-				if uint64(v.Size) >= volumeSizeLimit {
+				if !n.GetTopology().isVolumeWritable(&v) {
 					n.GetTopology().chanFullVolumes <- &v
 				}
 			}
 		}
 	} else {
 		for _, c := range n.Children() {
-			c.CollectDeadNodeAndFullVolumes(freshThreshHold, volumeSizeLimit)
+			c.CollectDeadNodeAndFullVolumes(freshThreshHold)
 		}
 	}
 }
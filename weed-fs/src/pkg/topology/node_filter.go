@@ -0,0 +1,141 @@
+package topology
+
+import (
+	"errors"
+	"pkg/storage"
+	"strings"
+)
+
+// NodeFilter selects the data nodes allowed to hold a volume, e.g. only
+// the ones with ssd disks. A nil filter allows all data nodes.
+type NodeFilter func(dn *DataNode) bool
+
+// DiskTypeFilter allows only the data nodes with the disk type. An empty disk type allows all.
+func DiskTypeFilter(diskType string) NodeFilter {
+	if diskType == "" {
+		return nil
+	}
+	return func(dn *DataNode) bool {
+		return dn.DiskType == diskType
+	}
+}
+
+// ParseLabels parses comma separated key=value labels, e.g. "env=prod,disk=nvme".
+func ParseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if i := strings.Index(pair, "="); i > 0 {
+			labels[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+		}
+	}
+	return labels
+}
+
+// ParseConstraint parses a constraint on the data node labels, made of
+// key=value or key!=value terms joined by "&&", e.g. "env=prod && disk=nvme".
+// An empty constraint allows all data nodes.
+func ParseConstraint(expr string) (NodeFilter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	var filters []NodeFilter
+	for _, term := range strings.Split(expr, "&&") {
+		i := strings.Index(term, "=")
+		if i <= 0 {
+			return nil, errors.New("Invalid constraint term \"" + strings.TrimSpace(term) + "\", expecting key=value or key!=value")
+		}
+		key, value, negate := term[:i], term[i+1:], term[i-1] == '!'
+		if negate {
+			key = term[:i-1]
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "" {
+			return nil, errors.New("Invalid constraint term \"" + strings.TrimSpace(term) + "\", missing the key")
+		}
+		if strings.Contains(key, "!") || strings.ContainsAny(value, "!=") {
+			return nil, errors.New("Invalid constraint term \"" + strings.TrimSpace(term) + "\", expecting a single = or != operator")
+		}
+		filters = append(filters, func(dn *DataNode) bool {
+			return (dn.Labels[key] == value) != negate
+		})
+	}
+	return And(filters...), nil
+}
+
+// And allows only the data nodes passing all the filters. Nil filters are skipped.
+func And(filters ...NodeFilter) NodeFilter {
+	var nonNil []NodeFilter
+	for _, f := range filters {
+		if f != nil {
+			nonNil = append(nonNil, f)
+		}
+	}
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	}
+	return func(dn *DataNode) bool {
+		for _, f := range nonNil {
+			if !f(dn) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// FreeSpaceMatching counts the free volume slots of the data nodes under n that pass the filter.
+func FreeSpaceMatching(n Node, filter NodeFilter) int {
+	if filter == nil {
+		return n.FreeSpace()
+	}
+	if n.IsDataNode() {
+		if dn := n.GetValue().(*DataNode); filter(dn) && dn.FreeSpace() > 0 {
+			return dn.FreeSpace()
+		}
+		return 0
+	}
+	freeSpace := 0
+	for _, c := range n.Children() {
+		freeSpace += FreeSpaceMatching(c, filter)
+	}
+	return freeSpace
+}
+
+// ReserveOneVolumeMatching works like Node.ReserveOneVolume, but only
+// counts the free volume slots of the data nodes that pass the filter.
+func ReserveOneVolumeMatching(n Node, r int, vid storage.VolumeId, filter NodeFilter) (bool, *DataNode) {
+	if filter == nil {
+		return n.ReserveOneVolume(r, vid)
+	}
+	for _, c := range sortedNodes(n.Children()) {
+		freeSpace := FreeSpaceMatching(c, filter)
+		if freeSpace <= 0 {
+			continue
+		}
+		if r >= freeSpace {
+			r -= freeSpace
+		} else {
+			if c.IsDataNode() {
+				return true, c.GetValue().(*DataNode)
+			}
+			return ReserveOneVolumeMatching(c, r, vid, filter)
+		}
+	}
+	return false, nil
+}
+
+// matches tells whether all the data nodes pass the filter.
+func (filter NodeFilter) matches(dataNodes []*DataNode) bool {
+	if filter == nil {
+		return true
+	}
+	for _, dn := range dataNodes {
+		if !filter(dn) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,34 @@
+package topology
+
+import (
+	"testing"
+)
+
+func TestParseConstraint(t *testing.T) {
+	dn := NewDataNode("dn1")
+	dn.Labels = ParseLabels("env=prod, disk=nvme")
+	cases := map[string]bool{
+		"":                       true,
+		"env=prod":               true,
+		"env=prod && disk=nvme":  true,
+		"env=prod&&disk=ssd":     false,
+		"env!=test":              true,
+		"env!=prod":              false,
+		"zone=":                  true,
+		"env=prod && zone!=east": true,
+	}
+	for expr, expected := range cases {
+		filter, err := ParseConstraint(expr)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", expr, err.Error())
+		}
+		if matched := filter.matches([]*DataNode{dn}); matched != expected {
+			t.Errorf("%q matched %v, expected %v", expr, matched, expected)
+		}
+	}
+	for _, expr := range []string{"env", "=prod", "env=prod && ", "env==prod", "env!!=x", "env=!prod", "!=prod", "env=a=b"} {
+		if _, err := ParseConstraint(expr); err == nil {
+			t.Errorf("%q should be invalid", expr)
+		}
+	}
+}
@@ -9,31 +9,37 @@ import (
 type NodeList struct {
 	nodes  map[NodeId]Node
 	except map[string]Node
+	filter NodeFilter
 }
 
 func NewNodeList(nodes map[NodeId]Node, except map[string]Node) *NodeList {
+	return NewFilteredNodeList(nodes, except, nil)
+}
+
+// NewFilteredNodeList only counts the free space of data nodes that pass the filter.
+func NewFilteredNodeList(nodes map[NodeId]Node, except map[string]Node, filter NodeFilter) *NodeList {
 	m := make(map[NodeId]Node, len(nodes)-len(except))
 	for _, n := range nodes {
 		if except[n.String()] == nil {
 			m[n.Id()] = n
 		}
 	}
-	nl := &NodeList{nodes: m}
+	nl := &NodeList{nodes: m, except: except, filter: filter}
 	return nl
 }
 
 func (nl *NodeList) FreeSpace() int {
 	freeSpace := 0
 	for _, n := range nl.nodes {
-		freeSpace += n.FreeSpace()
+		freeSpace += FreeSpaceMatching(n, nl.filter)
 	}
 	return freeSpace
 }
 
-func (nl *NodeList) RandomlyPickN(n int, min int) ([]Node, bool) {
+func (nl *NodeList) RandomlyPickN(random *rand.Rand, n int, min int) ([]Node, bool) {
 	var list []Node
-	for _, n := range nl.nodes {
-		if n.FreeSpace() >= min {
+	for _, n := range sortedNodes(nl.nodes) {
+		if FreeSpaceMatching(n, nl.filter) >= min {
 			list = append(list, n)
 		}
 	}
@@ -41,7 +47,7 @@ func (nl *NodeList) RandomlyPickN(n int, min int) ([]Node, bool) {
 	  return nil,false
 	}
 	for i := n; i > 0; i-- {
-	  r := rand.Intn(i)
+	  r := random.Intn(i)
 	  t := list[r]
 	  list[r] = list[i-1]
 	  list[i-1] = t
@@ -50,17 +56,17 @@ func (nl *NodeList) RandomlyPickN(n int, min int) ([]Node, bool) {
 }
 
 func (nl *NodeList) ReserveOneVolume(randomVolumeIndex int, vid storage.VolumeId) (bool, *DataNode) {
-	for _, node := range nl.nodes {
-		freeSpace := node.FreeSpace()
+	for _, node := range sortedNodes(nl.nodes) {
+		freeSpace := FreeSpaceMatching(node, nl.filter)
 		if randomVolumeIndex >= freeSpace {
 			randomVolumeIndex -= freeSpace
 		} else {
-			if node.IsDataNode() && node.FreeSpace() > 0 {
+			if node.IsDataNode() && freeSpace > 0 {
 				fmt.Println("vid =", vid, " assigned to node =", node, ", freeSpace =", node.FreeSpace())
 				return true, node.(*DataNode)
 			}
 			children := node.Children()
-			newNodeList := NewNodeList(children, nl.except)
+			newNodeList := NewFilteredNodeList(children, nl.except, nl.filter)
 			return newNodeList.ReserveOneVolume(randomVolumeIndex, vid)
 		}
 	}
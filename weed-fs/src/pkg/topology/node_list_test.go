@@ -16,24 +16,24 @@ func TestXYZ(t *testing.T) {
 	}
 	nl := NewNodeList(topo.Children(),nil)
 
-  picked, ret := nl.RandomlyPickN(1)
+  picked, ret := nl.RandomlyPickN(topo.Random(), 1, 1)
   if !ret || len(picked)!=1 {
     t.Errorf("need to randomly pick 1 node")
   }
 
-	picked, ret = nl.RandomlyPickN(4)
+	picked, ret = nl.RandomlyPickN(topo.Random(), 4, 1)
 	if !ret || len(picked)!=4 {
 	  t.Errorf("need to randomly pick 4 nodes")
 	}
 
-  picked, ret = nl.RandomlyPickN(5)
+  picked, ret = nl.RandomlyPickN(topo.Random(), 5, 1)
   if !ret || len(picked)!=5 {
     t.Errorf("need to randomly pick 5 nodes")
   }
 
-  picked, ret = nl.RandomlyPickN(6)
+  picked, ret = nl.RandomlyPickN(topo.Random(), 6, 1)
   if ret || len(picked)!=0 {
-    t.Errorf("can not randomly pick 6 nodes:", ret, picked)
+    t.Error("can not randomly pick 6 nodes:", ret, picked)
   }
 
 }
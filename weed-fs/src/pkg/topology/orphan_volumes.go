@@ -0,0 +1,239 @@
+package topology
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"pkg/storage"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The master remembers the volumes it deleted, so that a replica reported after
+// the delete, e.g. by a volume server that was down during a collection delete,
+// or that failed to remove the files, is held as an orphan instead of bringing
+// the volume back. An orphan is not looked up nor assigned to, but takes its
+// slot, until it is adopted back into its layout, or purged from its servers.
+type orphanVolumes struct {
+	lock    sync.Mutex
+	deleted map[storage.VolumeId]*DeletedVolume
+	file    string // where the deleted volumes are saved, empty to only keep them in memory
+}
+
+type DeletedVolume struct {
+	Id         storage.VolumeId
+	Collection string
+	Time       int64 // unix time of the delete
+}
+
+// OrphanVolume is a replica of a deleted volume, still on a volume server.
+type OrphanVolume struct {
+	storage.VolumeInfo
+	Url       string
+	DeletedAt int64
+}
+
+// SetDeletedVolumesFile loads the deleted volumes saved in the file, if it exists,
+// and saves them there from now on.
+func (t *Topology) SetDeletedVolumesFile(file string) error {
+	o := t.orphans
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.file = file
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var deleted []*DeletedVolume
+	if err = json.Unmarshal(data, &deleted); err != nil {
+		return errors.New(file + ": " + err.Error())
+	}
+	for _, d := range deleted {
+		o.deleted[d.Id] = d
+	}
+	return nil
+}
+
+// save writes the deleted volumes to the file, under the lock.
+func (o *orphanVolumes) save() error {
+	if o.file == "" {
+		return nil
+	}
+	deleted := make([]*DeletedVolume, 0, len(o.deleted))
+	for _, d := range o.deleted {
+		deleted = append(deleted, d)
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].Id < deleted[j].Id })
+	data, err := json.MarshalIndent(deleted, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(o.file+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(o.file+".tmp", o.file)
+}
+
+func (t *Topology) markVolumeDeleted(vid storage.VolumeId, collection string) {
+	o := t.orphans
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.deleted[vid] = &DeletedVolume{Id: vid, Collection: collection, Time: time.Now().Unix()}
+	if err := o.save(); err != nil {
+		t.recordEvent("Failed to save the deleted volumes:", err)
+	}
+}
+
+// IsDeletedVolume tells whether the volume was deleted, and its id is not reusable
+// until its orphans are adopted or purged.
+func (t *Topology) IsDeletedVolume(vid storage.VolumeId) bool {
+	o := t.orphans
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.deleted[vid] != nil
+}
+
+// holdOrphan keeps the volume of a heartbeat aside if it was deleted, and tells if it did.
+func (t *Topology) holdOrphan(dn *DataNode, v storage.VolumeInfo) bool {
+	o := t.orphans
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.deleted[v.Id] == nil {
+		return false
+	}
+	if _, held := dn.orphans[v.Id]; !held {
+		dn.UpAdjustActiveVolumeCountDelta(1)
+		dn.UpAdjustMaxVolumeId(v.Id)
+		t.recordEvent("Volume", v.Id, "of collection", "\""+v.Collection+"\"", "on", dn.Url(), "was deleted, holding it as an orphan")
+	}
+	dn.orphans[v.Id] = v
+	return true
+}
+
+// OrphanVolumes lists the replicas of the deleted volumes on the live volume servers.
+func (t *Topology) OrphanVolumes() []*OrphanVolume {
+	o := t.orphans
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	orphans := []*OrphanVolume{}
+	t.eachDataNode(func(dc *DataCenter, dn *DataNode) {
+		for vid, v := range dn.orphans {
+			orphan := &OrphanVolume{VolumeInfo: v, Url: dn.Url()}
+			if d := o.deleted[vid]; d != nil {
+				orphan.DeletedAt = d.Time
+			}
+			orphans = append(orphans, orphan)
+		}
+	})
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Id < orphans[j].Id || orphans[i].Id == orphans[j].Id && orphans[i].Url < orphans[j].Url
+	})
+	return orphans
+}
+
+// takeOrphans removes the replicas of the orphan volume from the data nodes holding them.
+func (t *Topology) takeOrphans(vid storage.VolumeId) (map[*DataNode]storage.VolumeInfo, error) {
+	taken := make(map[*DataNode]storage.VolumeInfo)
+	t.eachDataNode(func(dc *DataCenter, dn *DataNode) {
+		if v, ok := dn.orphans[vid]; ok {
+			taken[dn] = v
+			delete(dn.orphans, vid)
+			dn.UpAdjustActiveVolumeCountDelta(-1)
+		}
+	})
+	if len(taken) == 0 {
+		return nil, errors.New("Volume " + vid.String() + " has no orphan replica on the live volume servers")
+	}
+	return taken, nil
+}
+
+// AdoptOrphanVolume registers the orphan replicas of the volume back into its layout,
+// and forgets it was deleted. It returns the number of replicas adopted.
+func (t *Topology) AdoptOrphanVolume(vid storage.VolumeId) (int, error) {
+	o := t.orphans
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	taken, err := t.takeOrphans(vid)
+	if err != nil {
+		return 0, err
+	}
+	delete(o.deleted, vid)
+	if err = o.save(); err != nil {
+		t.recordEvent("Failed to save the deleted volumes:", err)
+	}
+	for dn, v := range taken {
+		dn.AddOrUpdateVolume(v)
+		t.RegisterVolumeLayout(&v, dn)
+	}
+	t.locationsChanged()
+	t.recordEvent("Adopted volume", vid, "back with", len(taken), "replicas")
+	return len(taken), nil
+}
+
+// PurgeOrphanVolume removes the orphan replicas of the volume from their volume servers.
+// The replicas failing to be removed stay orphans. The volume stays deleted, for the
+// replicas on the volume servers down at the time.
+func (t *Topology) PurgeOrphanVolume(vid storage.VolumeId) (*VolumeDeleteResult, error) {
+	o := t.orphans
+	o.lock.Lock()
+	taken, err := t.takeOrphans(vid)
+	o.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	dataNodes := make([]*DataNode, 0, len(taken))
+	for dn := range taken {
+		dataNodes = append(dataNodes, dn)
+	}
+	errs := make([]error, len(dataNodes))
+	var wg sync.WaitGroup
+	for i, dn := range dataNodes {
+		wg.Add(1)
+		go func(i int, dn *DataNode) {
+			defer wg.Done()
+			errs[i] = deleteVolumeOnDataNode(dn.AdminUrl(), vid)
+		}(i, dn)
+	}
+	wg.Wait()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	result := &VolumeDeleteResult{VolumeId: vid}
+	for i, dn := range dataNodes {
+		if errs[i] != nil {
+			if result.Errors == nil {
+				result.Errors = make(map[string]string)
+			}
+			result.Errors[dn.Url()] = errs[i].Error()
+			dn.orphans[vid] = taken[dn]
+			dn.UpAdjustActiveVolumeCountDelta(1)
+			continue
+		}
+		// held again by a heartbeat sent before the removal
+		if _, held := dn.orphans[vid]; held {
+			delete(dn.orphans, vid)
+			dn.UpAdjustActiveVolumeCountDelta(-1)
+		}
+		result.Deleted = append(result.Deleted, dn.Url())
+	}
+	t.recordEvent("Purged orphan volume", vid, "from", result.Deleted)
+	return result, nil
+}
+
+// highestDeletedVolumeId is the highest id of the deleted volumes, not to be reused.
+func (t *Topology) highestDeletedVolumeId(partition *VolumeIdPartition) (highest storage.VolumeId) {
+	o := t.orphans
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for vid := range o.deleted {
+		if vid > highest && (partition == nil || partition.Contains(vid)) {
+			highest = vid
+		}
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package topology
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"pkg/storage"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOrphanVolumes(t *testing.T) {
+	deleted := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted++
+		w.Write([]byte(`{"error":""}`))
+	}))
+	defer server.Close()
+	port, _ := strconv.Atoi(server.URL[strings.LastIndex(server.URL, ":")+1:])
+	file := os.TempDir() + "/orphan_volumes_test.json"
+	os.Remove(file)
+	defer os.Remove(file)
+
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	topo.SetDeletedVolumesFile(file)
+	volumes := []storage.VolumeInfo{{Id: 1, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion, Collection: "logs"}}
+	topo.RegisterVolumes(volumes, "127.0.0.1", port, "", 5, "hdd", nil)
+	if _, err := topo.DeleteCollection("logs"); err != nil || deleted != 1 {
+		t.Fatal("the collection should be deleted", err, deleted)
+	}
+
+	// a master restarted over the same -mdir still knows volume 1 was deleted
+	topo = NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	if err := topo.SetDeletedVolumesFile(file); err != nil {
+		t.Fatal(err)
+	}
+	dn, _ := topo.RegisterVolumes(volumes, "127.0.0.1", port, "", 5, "hdd", nil)
+	if topo.Lookup(1) != nil || dn.FreeSpace() != 4 {
+		t.Fatal("the deleted volume should be held as an orphan, taking its slot")
+	}
+	if vid, _ := topo.NextVolumeId(); vid != 2 {
+		t.Fatal("the id of a deleted volume should not be reused, got", vid)
+	}
+	if orphans := topo.OrphanVolumes(); len(orphans) != 1 || orphans[0].Id != 1 || orphans[0].DeletedAt == 0 {
+		t.Fatal("unexpected orphans", orphans)
+	}
+
+	if count, err := topo.AdoptOrphanVolume(1); err != nil || count != 1 {
+		t.Fatal("adopting volume 1:", count, err)
+	}
+	if topo.Lookup(1) == nil || len(topo.OrphanVolumes()) != 0 || dn.FreeSpace() != 4 {
+		t.Fatal("volume 1 should be registered back")
+	}
+	if _, err := topo.AdoptOrphanVolume(1); err == nil {
+		t.Fatal("volume 1 is no longer an orphan")
+	}
+
+	topo.DeleteCollection("logs")
+	topo.RegisterVolumes(volumes, "127.0.0.1", port, "", 5, "hdd", nil)
+	result, err := topo.PurgeOrphanVolume(1)
+	if err != nil || len(result.Deleted) != 1 || deleted != 3 || dn.FreeSpace() != 5 {
+		t.Fatal("the orphan should be purged", result, err, deleted)
+	}
+	if !topo.IsDeletedVolume(1) {
+		t.Fatal("a purged volume stays deleted")
+	}
+}
@@ -1,7 +1,7 @@
 package topology
 
 import (
-	"strconv"
+	"pkg/util"
 	"time"
 )
 
@@ -26,23 +26,29 @@ func (r *Rack) GetOrCreateDataNode(ip string, port int, publicUrl string, maxVol
 			if dn.Dead {
 				dn.Dead = false
 				r.GetTopology().chanRecoveredDataNodes <- dn
-				dn.UpAdjustMaxVolumeCountDelta(maxVolumeCount - dn.maxVolumeCount)
+				if dn.Draining {
+					dn.drainedMaxVolumeCount = maxVolumeCount
+				} else {
+					dn.UpAdjustMaxVolumeCountDelta(maxVolumeCount - dn.maxVolumeCount)
+				}
 			}
 			return dn
 		}
 	}
-	dn := NewDataNode(ip + ":" + strconv.Itoa(port))
+	dn := NewDataNode(util.JoinHostPort(ip, port))
 	dn.Ip = ip
 	dn.Port = port
 	dn.PublicUrl = publicUrl
 	dn.maxVolumeCount = maxVolumeCount
 	dn.LastSeen = time.Now().Unix()
 	r.LinkChildNode(dn)
+	r.GetTopology().recordEvent("DataNode", dn, "joined")
 	return dn
 }
 
 func (rack *Rack) ToMap() interface{} {
 	m := make(map[string]interface{})
+	m["Id"] = rack.Id()
 	m["Max"] = rack.GetMaxVolumeCount()
 	m["Free"] = rack.FreeSpace()
 	var dns []interface{}
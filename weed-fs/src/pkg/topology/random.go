@@ -0,0 +1,56 @@
+package topology
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// lockedSource makes a rand.Source safe for the concurrent assigns.
+type lockedSource struct {
+	lock sync.Mutex
+	src  rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.src.Seed(seed)
+}
+
+func newRandom(src rand.Source) *rand.Rand {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	return rand.New(&lockedSource{src: src})
+}
+
+// SetRandSource replaces the randomness of the placement of new volumes and of the picks
+// of the assigns, e.g. with rand.NewSource(1) so the tests of the placement are reproducible.
+// The nodes are always visited in the order of their ids, so the same source over the same
+// topology places the volumes the same way. Set it before the topology is used.
+func (t *Topology) SetRandSource(src rand.Source) {
+	t.random = newRandom(src)
+}
+
+// Random is the randomness of the placement, for the placement policies.
+func (t *Topology) Random() *rand.Rand {
+	return t.random
+}
+
+// sortedNodes lists the nodes in the order of their ids.
+func sortedNodes(nodes map[NodeId]Node) []Node {
+	list := make([]Node, 0, len(nodes))
+	for _, n := range nodes {
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id() < list[j].Id() })
+	return list
+}
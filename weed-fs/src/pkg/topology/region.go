@@ -0,0 +1,26 @@
+package topology
+
+import ()
+
+// Region is an optional level above data centers, e.g. a cloud region.
+// It exists only when the configuration groups data centers into regions.
+type Region struct {
+	NodeImpl
+}
+
+func NewRegion(id string) *Region {
+	r := &Region{}
+	r.id = NodeId(id)
+	r.nodeType = "Region"
+	r.children = make(map[NodeId]Node)
+	r.NodeImpl.value = r
+	return r
+}
+
+func (r *Region) ToMap() interface{} {
+	m := make(map[string]interface{})
+	m["Id"] = r.Id()
+	m["Max"] = r.GetMaxVolumeCount()
+	m["Free"] = r.FreeSpace()
+	return m
+}
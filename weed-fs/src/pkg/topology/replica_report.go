@@ -0,0 +1,74 @@
+package topology
+
+import (
+	"pkg/storage"
+	"sort"
+)
+
+// ReplicaHistogram groups the volumes of a replication type, over all the
+// collections, by their number of live replicas.
+type ReplicaHistogram struct {
+	Replication     string
+	Copies          int             // the replicas each volume should have
+	Counts          []*ReplicaCount // by number of live replicas, from 0 up
+	UnderReplicated []*UnderReplicatedVolume
+}
+
+type ReplicaCount struct {
+	Replicas int
+	Volumes  int
+}
+
+// UnderReplicatedVolume is a volume with fewer live replicas than its replication type requires.
+type UnderReplicatedVolume struct {
+	Id         storage.VolumeId
+	Collection string
+	Replicas   []string // the volume servers of the live replicas, none for a lost volume
+	Missing    int
+}
+
+// ReplicaReport lists the histogram of each replication type in use, after a
+// failure showing at once how many volumes are down to one replica, or lost.
+func (t *Topology) ReplicaReport() []*ReplicaHistogram {
+	byType := make(map[storage.ReplicationType]*ReplicaHistogram)
+	counts := make(map[storage.ReplicationType]map[int]int)
+	for _, vl := range t.volumeLayouts() {
+		h := byType[vl.repType]
+		if h == nil {
+			h = &ReplicaHistogram{Replication: string(vl.repType), Copies: vl.repType.GetCopyCount(), UnderReplicated: []*UnderReplicatedVolume{}}
+			byType[vl.repType] = h
+			counts[vl.repType] = make(map[int]int)
+		}
+		for vid, locations := range vl.vid2location {
+			live := locations.Length()
+			counts[vl.repType][live]++
+			if live < h.Copies {
+				u := &UnderReplicatedVolume{Id: vid, Collection: vl.collection, Replicas: []string{}, Missing: h.Copies - live}
+				for _, dn := range locations.list {
+					u.Replicas = append(u.Replicas, dn.Url())
+				}
+				h.UnderReplicated = append(h.UnderReplicated, u)
+			}
+		}
+	}
+	report := make([]*ReplicaHistogram, 0, len(byType))
+	for rt, h := range byType {
+		most := h.Copies
+		for replicas := range counts[rt] {
+			if replicas > most {
+				most = replicas
+			}
+		}
+		for replicas := 0; replicas <= most; replicas++ {
+			h.Counts = append(h.Counts, &ReplicaCount{Replicas: replicas, Volumes: counts[rt][replicas]})
+		}
+		// the most exposed first
+		sort.Slice(h.UnderReplicated, func(i, j int) bool {
+			a, b := h.UnderReplicated[i], h.UnderReplicated[j]
+			return len(a.Replicas) < len(b.Replicas) || len(a.Replicas) == len(b.Replicas) && a.Id < b.Id
+		})
+		report = append(report, h)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Replication < report[j].Replication })
+	return report
+}
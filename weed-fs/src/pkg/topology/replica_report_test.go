@@ -0,0 +1,35 @@
+package topology
+
+import (
+	"pkg/storage"
+	"testing"
+)
+
+func TestReplicaReport(t *testing.T) {
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	volumes := []storage.VolumeInfo{
+		{Id: 1, Size: 100, RepType: storage.Copy001, Version: storage.CurrentVersion},
+		{Id: 2, Size: 100, RepType: storage.Copy001, Version: storage.CurrentVersion},
+		{Id: 3, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion, Collection: "photos"},
+	}
+	dn1, _ := topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	dn2, _ := topo.RegisterVolumes(volumes[:2], "127.0.0.2", 8080, "", 5, "hdd", nil)
+	report := topo.ReplicaReport()
+	if len(report) != 2 || report[1].Replication != "001" || len(report[1].UnderReplicated) != 0 || report[1].Counts[2].Volumes != 2 {
+		t.Fatal("unexpected report", report)
+	}
+
+	// the first volume server dies, and the second loses volume 2
+	topo.UnRegisterDataNode(dn1)
+	topo.UnRegisterLostVolumes(dn2, []storage.VolumeId{2})
+	report = topo.ReplicaReport()
+	if c := report[0].Counts; report[0].Replication != "000" || c[0].Volumes != 1 || c[1].Volumes != 0 {
+		t.Fatal("volume 3 should be lost", c[0], c[1])
+	}
+	if c := report[1].Counts; c[0].Volumes != 1 || c[1].Volumes != 1 || c[2].Volumes != 0 {
+		t.Fatal("unexpected 001 counts", c[0], c[1], c[2])
+	}
+	if u := report[1].UnderReplicated; len(u) != 2 || u[0].Id != 2 || u[0].Missing != 2 || u[1].Replicas[0] != "127.0.0.2:8080" {
+		t.Fatal("unexpected under replicated volumes", u)
+	}
+}
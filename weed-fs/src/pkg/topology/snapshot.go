@@ -0,0 +1,140 @@
+package topology
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"pkg/storage"
+	"pkg/util"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is the manifest of a cluster-wide snapshot: the cut point of each
+// volume on one of its replicas, to back up from that replica. The volumes are
+// cut one after the other, without stopping the writes, so the snapshot is
+// fuzzy: a file assigned before the snapshot, but uploaded after the cut of its
+// volume, is not in it. The files with keys from NextFileId on were all
+// assigned after the snapshot started.
+type Snapshot struct {
+	Name       string
+	Time       int64 // unix seconds
+	Expires    int64 // when the volume servers unpin the volumes, if not released before
+	NextFileId uint64
+	Volumes    []*SnapshotVolume
+}
+
+type SnapshotVolume struct {
+	Url string // the volume server to back up the volume from
+	storage.VolumeCut
+}
+
+// Snapshot cuts all the volumes, on their first replica, and pins them there
+// for ttl, so their data before the cut does not change until the snapshot
+// is released. If a volume server fails, the volumes cut so far are released.
+func (t *Topology) Snapshot(name string, ttl time.Duration) (*Snapshot, error) {
+	now := time.Now()
+	s := &Snapshot{Name: name, Time: now.Unix(), Expires: now.Add(ttl).Unix(), NextFileId: t.sequence.Peek()}
+	vids := make(map[*DataNode][]string)
+	for _, vl := range t.volumeLayouts() {
+		for vid, locationList := range vl.vid2location {
+			if locationList.Length() > 0 {
+				dn := locationList.list[0]
+				vids[dn] = append(vids[dn], vid.String())
+			}
+		}
+	}
+	var lock sync.Mutex
+	var failures []string
+	var wg sync.WaitGroup
+	for dn, list := range vids {
+		wg.Add(1)
+		go func(dn *DataNode, list []string) {
+			defer wg.Done()
+			cuts, err := snapshotOnDataNode(dn.AdminUrl(), name, list, ttl)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				failures = append(failures, dn.Url()+": "+err.Error())
+				return
+			}
+			for _, cut := range cuts {
+				s.Volumes = append(s.Volumes, &SnapshotVolume{Url: dn.Url(), VolumeCut: *cut})
+			}
+		}(dn, list)
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		t.ReleaseSnapshot(s)
+		return nil, errors.New(fmt.Sprint(failures))
+	}
+	t.recordEvent("Snapshot", name, "of", len(s.Volumes), "volumes")
+	return s, nil
+}
+
+// ReleaseSnapshot unpins the volumes of the snapshot on their volume servers.
+func (t *Topology) ReleaseSnapshot(s *Snapshot) error {
+	servers := make(map[string]bool)
+	for _, v := range s.Volumes {
+		if dn := t.FindDataNode(v.Url); dn != nil {
+			servers[dn.AdminUrl()] = true
+		} else {
+			servers[v.Url] = true
+		}
+	}
+	var failures []string
+	for server := range servers {
+		if err := releaseSnapshotOnDataNode(server, s.Name); err != nil {
+			failures = append(failures, server+": "+err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(fmt.Sprint(failures))
+	}
+	t.recordEvent("Released snapshot", s.Name)
+	return nil
+}
+
+type snapshotResult struct {
+	Error   string
+	Volumes []*storage.VolumeCut
+}
+
+func snapshotOnDataNode(server string, name string, vids []string, ttl time.Duration) ([]*storage.VolumeCut, error) {
+	values := make(url.Values)
+	values.Add("name", name)
+	values.Add("volumes", strings.Join(vids, ","))
+	values.Add("ttl", strconv.FormatInt(int64(ttl/time.Second), 10))
+	jsonBlob, err := util.Post("http://"+server+"/admin/snapshot", values)
+	if err != nil {
+		return nil, err
+	}
+	var ret snapshotResult
+	if err := json.Unmarshal(jsonBlob, &ret); err != nil {
+		return nil, err
+	}
+	if ret.Error != "" {
+		return nil, errors.New(ret.Error)
+	}
+	return ret.Volumes, nil
+}
+
+func releaseSnapshotOnDataNode(server string, name string) error {
+	values := make(url.Values)
+	values.Add("name", name)
+	jsonBlob, err := util.Post("http://"+server+"/admin/snapshot/release", values)
+	if err != nil {
+		return err
+	}
+	var ret snapshotResult
+	if err := json.Unmarshal(jsonBlob, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	return nil
+}
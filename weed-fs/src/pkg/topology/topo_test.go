@@ -125,3 +125,83 @@ func TestReserveOneVolume(t *testing.T) {
   fmt.Println("assigned :", ret, ", node :", node,", volume id:", vid)
 
 }
+
+func TestRegisterVolumesOnlyProcessesChanges(t *testing.T) {
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 234, 5)
+	volumes := []storage.VolumeInfo{
+		{Id: 1, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion},
+		{Id: 2, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion},
+	}
+	if _, changed := topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil); changed != 2 {
+		t.Fatalf("first heartbeat changed %d volumes", changed)
+	}
+	if _, changed := topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil); changed != 0 {
+		t.Fatalf("unchanged heartbeat changed %d volumes", changed)
+	}
+	volumes[1].Size = 200
+	if _, changed := topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil); changed != 1 {
+		t.Fatalf("heartbeat with one grown volume changed %d volumes", changed)
+	}
+}
+
+func TestReadOnlyVolumeIsNotWritable(t *testing.T) {
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 234, 5)
+	volumes := []storage.VolumeInfo{{Id: 1, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion}}
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	vl := topo.GetVolumeLayout("", storage.Copy000)
+	if vl.GetActiveVolumeCount() != 1 {
+		t.Fatal("volume 1 should be writable")
+	}
+	volumes[0].State = storage.VolumeReadOnly
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	if topo.isVolumeWritable(&volumes[0]) {
+		t.Fatal("read only volume 1 should not be writable")
+	}
+	// what the refresh loop does with the volumes that are not writable
+	topo.SetVolumeCapacityFull(&volumes[0])
+	if vl.GetActiveVolumeCount() != 0 {
+		t.Fatal("read only volume 1 should be removed from the writable volumes")
+	}
+}
+
+func TestVolumeIsWritableAgainAfterCompacting(t *testing.T) {
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 234, 5)
+	volumes := []storage.VolumeInfo{{Id: 1, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion, State: storage.VolumeGrowing}}
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	vl := topo.GetVolumeLayout("", storage.Copy000)
+
+	volumes[0].State = storage.VolumeCompacting
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	// what the refresh loop does with the volumes that are not writable
+	topo.SetVolumeCapacityFull(&volumes[0])
+	if vl.GetActiveVolumeCount() != 0 {
+		t.Fatal("compacting volume 1 should not be writable")
+	}
+	volumes[0].State = storage.VolumeGrowing
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	if vl.GetActiveVolumeCount() != 1 {
+		t.Fatal("volume 1 should be writable again after compacting")
+	}
+	volumes[0].Size = 300
+	if topo.isVolumeWritable(&volumes[0]) {
+		t.Fatal("a growing volume over the size limit is due to be sealed, and should not be writable")
+	}
+}
+
+func TestVolumeLocationsChangeOnlyWithHeartbeatChanges(t *testing.T) {
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 234, 5)
+	volumes := []storage.VolumeInfo{{Id: 1, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion}}
+	dn, _ := topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	changes := topo.LocationChanges()
+	topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	if topo.LocationChanges() != changes {
+		t.Fatal("an unchanged heartbeat should not change the volume locations")
+	}
+	if locations := topo.VolumeLocations(); len(locations[1]) != 1 || locations[1][0] != dn {
+		t.Fatal("unexpected volume locations", locations)
+	}
+	topo.UnRegisterLostVolumes(dn, []storage.VolumeId{1})
+	if topo.LocationChanges() == changes || len(topo.VolumeLocations()) != 0 {
+		t.Fatal("the lost volume should be gone from the volume locations")
+	}
+}
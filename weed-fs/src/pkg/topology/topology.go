@@ -7,25 +7,42 @@ import (
 	"pkg/directory"
 	"pkg/sequence"
 	"pkg/storage"
+	"pkg/util"
+	"sync"
 )
 
 type Topology struct {
 	NodeImpl
 
-	//transient vid~servers mapping for each replication type
-	replicaType2VolumeLayout []*VolumeLayout
+	//transient vid~servers mapping for each collection and replication type
+	collectionMap map[string]*Collection
 
-	pulse int64
+	pulse           int64
+	deadNodeSeconds int64
 
-	volumeSizeLimit uint64
+	volumeSizeLimit      uint64
+	volumeFileCountLimit int
 
-	sequence sequence.Sequencer
+	sequence          sequence.Sequencer
+	volumeIdPartition *VolumeIdPartition
 
 	chanDeadDataNodes      chan *DataNode
 	chanRecoveredDataNodes chan *DataNode
 	chanFullVolumes        chan *storage.VolumeInfo
 
 	configuration *Configuration
+
+	vacuumScheduler  *VacuumScheduler
+	capacityForecast *capacityForecast // nil until StartCapacitySampling
+	random           *rand.Rand
+	orphans          *orphanVolumes
+	hotVolumes       *hotVolumes // nil until StartHotVolumeMirroring
+	replicator       *replicator // nil until StartReplication
+
+	locationChanges uint64
+
+	events     []Event
+	eventsLock sync.Mutex
 }
 
 func NewTopology(id string, confFile string, dirname string, sequenceFilename string, volumeSizeLimit uint64, pulse int) *Topology {
@@ -34,8 +51,9 @@ func NewTopology(id string, confFile string, dirname string, sequenceFilename st
 	t.nodeType = "Topology"
 	t.NodeImpl.value = t
 	t.children = make(map[NodeId]Node)
-	t.replicaType2VolumeLayout = make([]*VolumeLayout, storage.LengthRelicationType)
+	t.collectionMap = make(map[string]*Collection)
 	t.pulse = int64(pulse)
+	t.SetDeadNodeSeconds(0)
 	t.volumeSizeLimit = volumeSizeLimit
 
 	t.sequence = sequence.NewSequencer(dirname, sequenceFilename)
@@ -44,6 +62,10 @@ func NewTopology(id string, confFile string, dirname string, sequenceFilename st
 	t.chanRecoveredDataNodes = make(chan *DataNode)
 	t.chanFullVolumes = make(chan *storage.VolumeInfo)
 
+	t.vacuumScheduler = NewVacuumScheduler(1, 2)
+	t.random = newRandom(nil)
+	t.orphans = &orphanVolumes{deleted: make(map[storage.VolumeId]*DeletedVolume)}
+
 	t.loadConfiguration(confFile)
 
 	return t
@@ -58,22 +80,78 @@ func (t *Topology) loadConfiguration(configurationFile string) error {
 }
 
 func (t *Topology) Lookup(vid storage.VolumeId) *[]*DataNode {
-	for _, vl := range t.replicaType2VolumeLayout {
-		if vl != nil {
-			if list := vl.Lookup(vid); list != nil {
-				return list
-			}
+	for _, c := range t.collectionMap {
+		if list := c.Lookup(vid); list != nil {
+			return list
 		}
 	}
 	return nil
 }
 
+// LocateDataCenter finds the data center of the ip in the configuration,
+// the same way as for the volume servers.
+func (t *Topology) LocateDataCenter(ip string) string {
+	dcName, _ := t.configuration.Locate(ip)
+	return dcName
+}
+
+// UploadPolicies are the upload limits of the collections, sent to the
+// volume servers in reply to their heartbeats.
+func (t *Topology) UploadPolicies() map[string]*storage.UploadPolicy {
+	return t.configuration.UploadPolicies()
+}
+
+// SignedReadCollections are the collections the volume servers only serve
+// with signed urls, also sent in reply to their heartbeats.
+func (t *Topology) SignedReadCollections() []string {
+	return t.configuration.SignedReadCollections()
+}
+
+// ResponseHeaders are the headers the volume servers add to the reads of each collection.
+func (t *Topology) ResponseHeaders() map[string]map[string]string {
+	return t.configuration.ResponseHeaders()
+}
+
+// StorageClass is the disk type the volumes of the collection are placed on:
+// the one configured for the collection, or else the one asked for, if any.
+func (t *Topology) StorageClass(collectionName string, diskType string) (string, error) {
+	class := t.configuration.DiskType(collectionName)
+	if class == "" {
+		return diskType, nil
+	}
+	if diskType != "" && diskType != class {
+		return "", errors.New("Collection " + collectionName + " is stored on " + class + " disks, not on " + diskType + " disks")
+	}
+	return class, nil
+}
+
+// NodeFilter combines the disk type, the constraint, and the disk type and the
+// constraint configured for the collection into one filter for placing its volumes.
+func (t *Topology) NodeFilter(collectionName string, diskType string, constraint string) (NodeFilter, error) {
+	diskType, err := t.StorageClass(collectionName, diskType)
+	if err != nil {
+		return nil, err
+	}
+	constraintFilter, err := ParseConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+	collectionFilter, err := ParseConstraint(t.configuration.Constraint(collectionName))
+	if err != nil {
+		return nil, err
+	}
+	return And(DiskTypeFilter(diskType), constraintFilter, collectionFilter), nil
+}
+
 func (t *Topology) RandomlyReserveOneVolume() (bool, *DataNode, *storage.VolumeId) {
 	if t.FreeSpace() <= 0 {
 		return false, nil, nil
 	}
-	vid := t.NextVolumeId()
-	ret, node := t.ReserveOneVolume(rand.Intn(t.FreeSpace()), vid) //node.go 77 line
+	vid, err := t.NextVolumeId()
+	if err != nil {
+		return false, nil, nil
+	}
+	ret, node := t.ReserveOneVolume(t.random.Intn(t.FreeSpace()), vid) //node.go 77 line
 	return ret, node, &vid
 }
 
@@ -85,79 +163,245 @@ func (t *Topology) RandomlyReserveOneVolumeExcept(except []Node) (bool, *DataNod
 	if freeSpace <= 0 {
 		return false, nil, nil
 	}
-	vid := t.NextVolumeId()
-	ret, node := t.ReserveOneVolume(rand.Intn(freeSpace), vid)	//node.go 77 line
+	vid, err := t.NextVolumeId()
+	if err != nil {
+		return false, nil, nil
+	}
+	ret, node := t.ReserveOneVolume(t.random.Intn(freeSpace), vid)	//node.go 77 line
 	return ret, node, &vid
 }
 
-func (t *Topology) NextVolumeId() storage.VolumeId {
-	vid := t.GetMaxVolumeId()
-	return vid.Next()
+// NextVolumeId is the id for a new volume, the next one of the volume id
+// partition after the highest id of the partition in use.
+func (t *Topology) NextVolumeId() (storage.VolumeId, error) {
+	if t.volumeIdPartition == nil {
+		vid := t.GetMaxVolumeId()
+		if deleted := t.highestDeletedVolumeId(nil); deleted > vid {
+			vid = deleted
+		}
+		return vid.Next(), nil
+	}
+	highest := t.highestDeletedVolumeId(t.volumeIdPartition)
+	for _, c := range t.DataCenters() {
+		for _, r := range c.Children() {
+			for _, d := range r.Children() {
+				for vid := range d.(*DataNode).volumes {
+					if vid > highest && t.volumeIdPartition.Contains(vid) {
+						highest = vid
+					}
+				}
+			}
+		}
+	}
+	return t.volumeIdPartition.Next(highest)
+}
+
+// SetVolumeIdPartition limits the ids of the new volumes to the partition, nil for all the ids.
+func (t *Topology) SetVolumeIdPartition(p *VolumeIdPartition) {
+	t.volumeIdPartition = p
 }
 
-func (t *Topology) PickForWrite(repType storage.ReplicationType, count int) (string, int, *DataNode, error) {
-	replicationTypeIndex := repType.GetReplicationLevelIndex()
-	if t.replicaType2VolumeLayout[replicationTypeIndex] == nil {
-		t.replicaType2VolumeLayout[replicationTypeIndex] = NewVolumeLayout(repType, t.volumeSizeLimit, t.pulse)
-	}
-	vid, count, datanodes, err := t.replicaType2VolumeLayout[replicationTypeIndex].PickForWrite(count)
+func (t *Topology) VolumeIdPartition() *VolumeIdPartition {
+	return t.volumeIdPartition
+}
+
+// Sequence returns the file id sequencer, to inspect or bump it.
+func (t *Topology) Sequence() sequence.Sequencer {
+	return t.sequence
+}
+
+func (t *Topology) PickForWrite(collectionName string, repType storage.ReplicationType, count int, dataCenter string, filter NodeFilter) (string, int, *DataNode, error) {
+	vid, count, datanodes, err := t.GetVolumeLayout(collectionName, repType).PickForWrite(t.random, count, dataCenter, filter)
 	if err != nil {
 		return "", 0, nil, errors.New("No writable volumes avalable!")
 	}
 	fileId, count := t.sequence.NextFileId(count)
-	return directory.NewFileId(*vid, fileId, rand.Uint32()).String(), count, datanodes.Head(), nil
+	return directory.NewFileId(*vid, fileId, t.random.Uint32()).String(), count, datanodes.Head(), nil
 }
 
-func (t *Topology) GetVolumeLayout(repType storage.ReplicationType) *VolumeLayout {
+func (t *Topology) GetVolumeLayout(collectionName string, repType storage.ReplicationType) *VolumeLayout {
+	c, ok := t.collectionMap[collectionName]
+	if !ok {
+		c = NewCollection(collectionName)
+		t.collectionMap[collectionName] = c
+	}
 	replicationTypeIndex := repType.GetReplicationLevelIndex()
-	if t.replicaType2VolumeLayout[replicationTypeIndex] == nil {
-		t.replicaType2VolumeLayout[replicationTypeIndex] = NewVolumeLayout(repType, t.volumeSizeLimit, t.pulse)
+	if c.replicaType2VolumeLayout[replicationTypeIndex] == nil {
+		c.replicaType2VolumeLayout[replicationTypeIndex] = NewVolumeLayout(collectionName, repType, t.volumeSizeLimit, t.volumeFileCountLimit, t.pulse)
+	}
+	return c.replicaType2VolumeLayout[replicationTypeIndex]
+}
+
+func (t *Topology) GetCollection(collectionName string) (*Collection, bool) {
+	c, ok := t.collectionMap[collectionName]
+	return c, ok
+}
+
+// volumeLayouts returns the volume layouts of all collections.
+func (t *Topology) volumeLayouts() []*VolumeLayout {
+	var layouts []*VolumeLayout
+	for _, c := range t.collectionMap {
+		layouts = append(layouts, c.VolumeLayouts()...)
+	}
+	return layouts
+}
+
+// SetVolumeFileCountLimit limits the number of files in one volume,
+// to keep the index memory bounded for small files. 0 means no limit.
+// SetDeadNodeSeconds sets how long a data node can go without heartbeats before it is
+// considered dead. 0 means 4 pulses: volume servers sleep between 1 and 2 pulses
+// between heartbeats, so this tolerates one missed heartbeat with the worst jitter.
+func (t *Topology) SetDeadNodeSeconds(seconds int) {
+	if seconds <= 0 {
+		seconds = 4 * int(t.pulse)
+	}
+	t.deadNodeSeconds = int64(seconds)
+}
+
+func (t *Topology) SetVolumeFileCountLimit(limit int) {
+	t.volumeFileCountLimit = limit
+	for _, vl := range t.volumeLayouts() {
+		vl.volumeFileCountLimit = limit
 	}
-	return t.replicaType2VolumeLayout[replicationTypeIndex]
+}
+
+func (t *Topology) isVolumeWritable(v *storage.VolumeInfo) bool {
+	return t.GetVolumeLayout(v.Collection, v.RepType).isWritable(v)
 }
 
 func (t *Topology) RegisterVolumeLayout(v *storage.VolumeInfo, dn *DataNode) {
-	t.GetVolumeLayout(v.RepType).RegisterVolume(v, dn)
+	t.GetVolumeLayout(v.Collection, v.RepType).RegisterVolume(v, dn)
 }
 
-func (t *Topology) RegisterVolumes(volumeInfos []storage.VolumeInfo, ip string, port int, publicUrl string, maxVolumeCount int) {
+// RegisterVolumes updates the data node with its heartbeat. Only the volumes
+// that changed since the last heartbeat are processed, and their count is returned.
+func (t *Topology) RegisterVolumes(volumeInfos []storage.VolumeInfo, ip string, port int, publicUrl string, maxVolumeCount int, diskType string, labels map[string]string) (dn *DataNode, changed int) {
+	ip = util.CanonicalHost(ip)
 	dcName, rackName := t.configuration.Locate(ip)
 	dc := t.GetOrCreateDataCenter(dcName)
 	rack := dc.GetOrCreateRack(rackName)
-	dn := rack.GetOrCreateDataNode(ip, port, publicUrl, maxVolumeCount)
+	dn = rack.GetOrCreateDataNode(ip, port, publicUrl, maxVolumeCount)
+	dn.DiskType, dn.Labels = diskType, labels
+	if dn.Draining {
+		dn.drainedMaxVolumeCount = maxVolumeCount
+	} else if maxVolumeCount != dn.GetMaxVolumeCount() {
+		dn.UpAdjustMaxVolumeCountDelta(maxVolumeCount - dn.GetMaxVolumeCount())
+	}
 	for _, v := range volumeInfos {
+		old, existed := dn.volumes[v.Id]
+		if existed && old == v {
+			continue
+		}
+		if !existed && t.holdOrphan(dn, v) {
+			continue
+		}
+		if class := t.configuration.DiskType(v.Collection); !existed && class != "" && class != dn.DiskType {
+			t.recordEvent("Volume", v.Id, "of collection", v.Collection, "is on", dn.Url(), "with -diskType="+dn.DiskType+", not "+class+", and takes no new files")
+		}
 		dn.AddOrUpdateVolume(v)
 		t.RegisterVolumeLayout(&v, dn)
+		if existed && !old.State.IsWritable() && v.State.IsWritable() {
+			t.setVolumeWritableIfReady(t.GetVolumeLayout(v.Collection, v.RepType), v.Id)
+		}
+		changed++
 	}
+	if changed > 0 {
+		t.locationsChanged()
+	}
+	return
 }
 
+// UnRegisterLostVolumes removes the volumes lost with a failed disk of the data node,
+// while its other volumes stay available.
+func (t *Topology) UnRegisterLostVolumes(dn *DataNode, vids []storage.VolumeId) {
+	for _, vid := range vids {
+		v, ok := dn.volumes[vid]
+		if !ok {
+			continue
+		}
+		t.GetVolumeLayout(v.Collection, v.RepType).SetVolumeUnavailable(dn, vid)
+		delete(dn.volumes, vid)
+		dn.UpAdjustActiveVolumeCountDelta(-1)
+		t.recordEvent("Volume", vid, "is lost with a failed disk on "+dn.Url())
+		t.locationsChanged()
+	}
+}
+
+// GetOrCreateDataCenter finds the data center, under its region if the
+// configuration puts it in one, or directly under the topology otherwise.
 func (t *Topology) GetOrCreateDataCenter(dcName string) *DataCenter {
-	for _, c := range t.Children() {
+	var parent Node = t
+	if regionName := t.configuration.Region(dcName); regionName != "" {
+		parent = t.GetOrCreateRegion(regionName)
+	}
+	for _, c := range parent.Children() {
 		dc := c.(*DataCenter)
 		if string(dc.Id()) == dcName {
 			return dc
 		}
 	}
 	dc := NewDataCenter(dcName)
-	t.LinkChildNode(dc)
+	parent.LinkChildNode(dc)
 	return dc
 }
 
+func (t *Topology) GetOrCreateRegion(regionName string) *Region {
+	for _, c := range t.Regions() {
+		if string(c.Id()) == regionName {
+			return c.GetValue().(*Region)
+		}
+	}
+	r := NewRegion(regionName)
+	t.LinkChildNode(r)
+	return r
+}
+
+// Regions returns the region nodes, if any.
+func (t *Topology) Regions() map[NodeId]Node {
+	regions := make(map[NodeId]Node)
+	for id, c := range t.Children() {
+		if _, ok := c.GetValue().(*Region); ok {
+			regions[id] = c
+		}
+	}
+	return regions
+}
+
+// DataCenters returns all data center nodes, whether they are in a region or not.
+func (t *Topology) DataCenters() map[NodeId]Node {
+	dcs := make(map[NodeId]Node)
+	for id, c := range t.Children() {
+		if _, ok := c.GetValue().(*Region); ok {
+			for dcId, dc := range c.Children() {
+				dcs[dcId] = dc
+			}
+		} else {
+			dcs[id] = c
+		}
+	}
+	return dcs
+}
+
 func (t *Topology) ToMap() interface{} {
 	m := make(map[string]interface{})
 	m["Max"] = t.GetMaxVolumeCount()
 	m["Free"] = t.FreeSpace()
 	var dcs []interface{}
-	for _, c := range t.Children() {
+	for _, c := range t.DataCenters() {
 		dc := c.(*DataCenter)
 		dcs = append(dcs, dc.ToMap())
 	}
 	m["DataCenters"] = dcs
+	var regions []interface{}
+	for _, c := range t.Regions() {
+		regions = append(regions, c.GetValue().(*Region).ToMap())
+	}
+	if regions != nil {
+		m["Regions"] = regions
+	}
 	var layouts []interface{}
-	for _, layout := range t.replicaType2VolumeLayout {
-		if layout != nil {
-			layouts = append(layouts, layout.ToMap())
-		}
+	for _, layout := range t.volumeLayouts() {
+		layouts = append(layouts, layout.ToMap())
 	}
 	m["layouts"] = layouts
 	return m
@@ -168,7 +412,8 @@ func (t *Topology) ToVolumeMap() interface{} {
 	m["Max"] = t.GetMaxVolumeCount()
 	m["Free"] = t.FreeSpace()
 	dcs := make(map[NodeId]interface{})
-	for _, c := range t.Children() {
+	adminUrls := make(map[string]string)
+	for _, c := range t.DataCenters() {
 		dc := c.(*DataCenter)
 		racks := make(map[NodeId]interface{})
 		for _, r := range dc.Children() {
@@ -176,6 +421,9 @@ func (t *Topology) ToVolumeMap() interface{} {
 			dataNodes := make(map[NodeId]interface{})
 			for _, d := range rack.Children() {
 				dn := d.(*DataNode)
+				if dn.AdminPort != 0 {
+					adminUrls[dn.Url()] = dn.AdminUrl()
+				}
 				var volumes []interface{}
 				for _, v := range dn.volumes {
 					volumes = append(volumes, v)
@@ -187,5 +435,7 @@ func (t *Topology) ToVolumeMap() interface{} {
 		dcs[dc.Id()] = racks
 	}
 	m["DataCenters"] = dcs
+	// the volume servers serving their /admin/ api on another port
+	m["AdminUrls"] = adminUrls
 	return m
 }
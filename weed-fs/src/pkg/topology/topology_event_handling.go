@@ -4,14 +4,16 @@ import (
 	"fmt"
 	"math/rand"
 	"pkg/storage"
+	"strings"
 	"time"
 )
 
 func (t *Topology) StartRefreshWritableVolumes() {
 	go func() {
 		for {
-			freshThreshHold := time.Now().Unix() - 3*t.pulse //5 times of sleep interval
-			t.CollectDeadNodeAndFullVolumes(freshThreshHold, t.volumeSizeLimit)	// -> node.go 155 line
+			// LastSeen is the master's own receive time in whole seconds, so allow one more second
+			freshThreshHold := time.Now().Unix() - t.deadNodeSeconds - 1
+			t.CollectDeadNodeAndFullVolumes(freshThreshHold)	// -> node.go 155 line
 			time.Sleep(time.Duration(float32(t.pulse*1e3)*(1+rand.Float32())) * time.Millisecond)
 		}
 	}()
@@ -19,40 +21,132 @@ func (t *Topology) StartRefreshWritableVolumes() {
 		for {
 			select {
 			case v := <-t.chanFullVolumes:
-				t.SetVolumeCapacityFull(v)
-				fmt.Println("Volume", v, "is full!")
+				if v.State.IsWritable() {
+					t.sealFullVolume(v)
+				} else if t.SetVolumeCapacityFull(v) {
+					if v.State == storage.VolumeReadOnly {
+						t.recordEvent("Volume", v.Id, "is read only after write errors!")
+					} else {
+						t.recordEvent("Volume", v.Id, "is", string(v.State))
+					}
+				}
 			case dn := <-t.chanRecoveredDataNodes:
 				t.RegisterRecoveredDataNode(dn)
-				fmt.Println("DataNode", dn, "is back alive!")
+				t.recordEvent("DataNode", dn, "is back alive!")
 			case dn := <-t.chanDeadDataNodes:
 				t.UnRegisterDataNode(dn)
-				fmt.Println("DataNode", dn, "is dead!")
+				t.recordEvent("DataNode", dn, "is dead!")
 			}
 		}
 	}()
 }
-func (t *Topology) SetVolumeCapacityFull(volumeInfo *storage.VolumeInfo) {
-	vl := t.GetVolumeLayout(volumeInfo.RepType)
-	vl.SetVolumeCapacityFull(volumeInfo.Id)
+func (t *Topology) SetVolumeCapacityFull(volumeInfo *storage.VolumeInfo) bool {
+	vl := t.GetVolumeLayout(volumeInfo.Collection, volumeInfo.RepType)
+	if !vl.SetVolumeCapacityFull(volumeInfo.Id) {
+		return false
+	}
 	for _, dn := range vl.vid2location[volumeInfo.Id].list {
 		dn.UpAdjustActiveVolumeCountDelta(-1)
 	}
+	return true
 }
 func (t *Topology) UnRegisterDataNode(dn *DataNode) {
 	for _, v := range dn.volumes {
 		fmt.Println("Removing Volume", v.Id, "from the dead volume server", dn)
-		vl := t.GetVolumeLayout(v.RepType)
+		vl := t.GetVolumeLayout(v.Collection, v.RepType)
 		vl.SetVolumeUnavailable(dn, v.Id)
 	}
 	dn.UpAdjustActiveVolumeCountDelta(-dn.GetActiveVolumeCount())
 	dn.UpAdjustMaxVolumeCountDelta(-dn.GetMaxVolumeCount())
 	dn.Parent().UnlinkChildNode(dn.Id())
+	t.locationsChanged()
 }
 func (t *Topology) RegisterRecoveredDataNode(dn *DataNode) {
 	for _, v := range dn.volumes {
-		if uint64(v.Size) < t.volumeSizeLimit {
-			vl := t.GetVolumeLayout(v.RepType)
+		if t.isVolumeWritable(&v) {
+			vl := t.GetVolumeLayout(v.Collection, v.RepType)
 			vl.SetVolumeAvailable(dn, v.Id)
 		}
 	}
+	t.locationsChanged()
+}
+
+const (
+	MaxRecentEvents = 100
+)
+
+type Event struct {
+	Time    time.Time
+	Message string
+}
+
+// recordEvent prints the event and keeps it among the recent events.
+func (t *Topology) recordEvent(a ...interface{}) {
+	message := strings.TrimSpace(fmt.Sprintln(a...))
+	fmt.Println(message)
+	t.eventsLock.Lock()
+	defer t.eventsLock.Unlock()
+	t.events = append(t.events, Event{Time: time.Now(), Message: message})
+	if len(t.events) > MaxRecentEvents {
+		t.events = t.events[len(t.events)-MaxRecentEvents:]
+	}
+}
+
+// RecordEvent keeps an event of the master, e.g. a layout running low on capacity, among the recent events.
+func (t *Topology) RecordEvent(a ...interface{}) {
+	t.recordEvent(a...)
+}
+
+// RecentEvents returns the recent events, newest first.
+func (t *Topology) RecentEvents() []Event {
+	t.eventsLock.Lock()
+	defer t.eventsLock.Unlock()
+	events := make([]Event, len(t.events))
+	for i, e := range t.events {
+		events[len(events)-1-i] = e
+	}
+	return events
+}
+
+func (t *Topology) FindDataNode(url string) *DataNode {
+	for _, c := range t.DataCenters() {
+		for _, r := range c.Children() {
+			for _, d := range r.Children() {
+				if dn := d.(*DataNode); dn.Url() == url {
+					return dn
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Drain stops placing new volumes and writes on the data node,
+// while its volumes are still readable.
+func (t *Topology) Drain(dn *DataNode) {
+	if dn.Draining {
+		return
+	}
+	dn.Draining = true
+	dn.drainedMaxVolumeCount = dn.GetMaxVolumeCount()
+	dn.UpAdjustMaxVolumeCountDelta(-dn.FreeSpace())
+	for _, v := range dn.volumes {
+		t.GetVolumeLayout(v.Collection, v.RepType).removeFromWritable(v.Id)
+	}
+	t.recordEvent("DataNode", dn, "is draining")
+}
+
+func (t *Topology) Undrain(dn *DataNode) {
+	if !dn.Draining {
+		return
+	}
+	dn.Draining = false
+	dn.UpAdjustMaxVolumeCountDelta(dn.drainedMaxVolumeCount - dn.GetMaxVolumeCount())
+	for _, v := range dn.volumes {
+		vl := t.GetVolumeLayout(v.Collection, v.RepType)
+		if vl.vid2location[v.Id].Length() >= vl.repType.GetCopyCount() && !vl.isVolumeFull(v.Id) {
+			vl.setVolumeWritable(v.Id)
+		}
+	}
+	t.recordEvent("DataNode", dn, "is no longer draining")
 }
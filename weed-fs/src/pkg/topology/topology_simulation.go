@@ -0,0 +1,382 @@
+package topology
+
+import (
+	"errors"
+	"pkg/storage"
+	"sort"
+)
+
+// A Simulation works on a copy of the volume placement, to try out a
+// decommission, a rebalance or a replication change, and report the volume
+// copies it would take, without changing anything in the topology.
+type Simulation struct {
+	nodes   []*simNode   // sorted by url, so the results are repeatable
+	volumes []*simVolume // sorted by volume id
+}
+
+type simNode struct {
+	url      string
+	rack     string // data center and rack, as rack names repeat across data centers
+	dc       string
+	region   string
+	max      int
+	draining bool
+	volumes  map[storage.VolumeId]bool
+}
+
+type simVolume struct {
+	id         storage.VolumeId
+	collection string
+	repType    storage.ReplicationType
+	size       int64
+	nodes      []*simNode
+}
+
+// VolumeMove is one copy or removal of a volume replica. To is empty when the
+// replica on From is removed. Otherwise the volume is copied from From to To.
+type VolumeMove struct {
+	VolumeId   storage.VolumeId
+	Collection string `json:",omitempty"`
+	Size       int64
+	From       string
+	To         string `json:",omitempty"`
+}
+
+type SimulationResult struct {
+	Action        string
+	Moves         []VolumeMove
+	VolumesMoved  int
+	TransferBytes int64
+	Unplaceable   []storage.VolumeId `json:",omitempty"` // volumes the change can not place
+
+	moved map[storage.VolumeId]bool
+}
+
+func (n *simNode) free() int {
+	if n.draining {
+		return 0
+	}
+	return n.max - len(n.volumes)
+}
+
+// NewSimulation copies the current volume placement of the topology.
+func NewSimulation(t *Topology) *Simulation {
+	s := &Simulation{}
+	volumes := make(map[storage.VolumeId]*simVolume)
+	for _, dcNode := range t.DataCenters() {
+		region := ""
+		if r, ok := dcNode.Parent().GetValue().(*Region); ok {
+			region = string(r.Id())
+		}
+		for _, rackNode := range dcNode.Children() {
+			for _, c := range rackNode.Children() {
+				dn := c.(*DataNode)
+				node := &simNode{
+					url:      dn.Url(),
+					rack:     string(dcNode.Id()) + ":" + string(rackNode.Id()),
+					dc:       string(dcNode.Id()),
+					region:   region,
+					max:      dn.GetMaxVolumeCount(),
+					draining: dn.Draining,
+					volumes:  make(map[storage.VolumeId]bool),
+				}
+				if dn.Draining {
+					node.max = dn.drainedMaxVolumeCount
+				}
+				for vid, vi := range dn.volumes {
+					v, ok := volumes[vid]
+					if !ok {
+						v = &simVolume{id: vid, collection: vi.Collection, repType: vi.RepType}
+						volumes[vid] = v
+					}
+					if vi.Size > v.size {
+						v.size = vi.Size
+					}
+					v.nodes = append(v.nodes, node)
+					node.volumes[vid] = true
+				}
+				s.nodes = append(s.nodes, node)
+			}
+		}
+	}
+	sort.Slice(s.nodes, func(i, j int) bool { return s.nodes[i].url < s.nodes[j].url })
+	for _, v := range volumes {
+		sort.Slice(v.nodes, func(i, j int) bool { return v.nodes[i].url < v.nodes[j].url })
+		s.volumes = append(s.volumes, v)
+	}
+	sort.Slice(s.volumes, func(i, j int) bool { return s.volumes[i].id < s.volumes[j].id })
+	return s
+}
+
+func (s *Simulation) findNode(url string) *simNode {
+	for _, n := range s.nodes {
+		if n.url == url {
+			return n
+		}
+	}
+	return nil
+}
+
+// Decommission moves all the volumes off the data node, keeping the
+// placement of each volume valid for its replication type.
+func (s *Simulation) Decommission(url string) (*SimulationResult, error) {
+	node := s.findNode(url)
+	if node == nil {
+		return nil, errors.New("Data node " + url + " is not found")
+	}
+	result := &SimulationResult{Action: "decommission " + url}
+	node.draining = true
+	for _, v := range s.volumes {
+		if !node.volumes[v.id] {
+			continue
+		}
+		kept := without(v.nodes, node)
+		added, ok := s.complete(v.repType, kept, v.repType.GetCopyCount()-len(kept))
+		if !ok {
+			result.Unplaceable = append(result.Unplaceable, v.id)
+			continue
+		}
+		if len(added) == 0 {
+			s.removeReplica(result, v, node)
+		}
+		for i, to := range added {
+			if i == 0 {
+				s.moveReplica(result, v, node, to)
+			} else {
+				s.addReplica(result, v, node, to)
+			}
+		}
+	}
+	return result, nil
+}
+
+// ChangeReplication changes the replication type of the volumes of the collection,
+// keeping as many of the existing replicas as the new type allows.
+func (s *Simulation) ChangeReplication(collection string, repType storage.ReplicationType) (*SimulationResult, error) {
+	if repType.GetCopyCount() == 0 {
+		return nil, errors.New("Unknown replication type " + string(repType))
+	}
+	result := &SimulationResult{Action: "replication " + collection + " " + repType.String()}
+	for _, v := range s.volumes {
+		if v.collection != collection || v.repType == repType {
+			continue
+		}
+		kept, added, ok := s.replace(v, repType)
+		if !ok {
+			result.Unplaceable = append(result.Unplaceable, v.id)
+			continue
+		}
+		source := v.nodes[0]
+		if len(kept) > 0 {
+			source = kept[0]
+		}
+		for _, n := range v.nodes {
+			if !contains(kept, n) {
+				s.removeReplica(result, v, n)
+			}
+		}
+		for _, to := range added {
+			s.addReplica(result, v, source, to)
+		}
+		v.repType = repType
+	}
+	return result, nil
+}
+
+// replace finds the largest subset of the current replicas that can be part of a
+// placement of the replication type, and the data nodes completing it.
+func (s *Simulation) replace(v *simVolume, repType storage.ReplicationType) (kept, added []*simNode, ok bool) {
+	for size := len(v.nodes); size >= 0; size-- {
+		for _, subset := range subsets(v.nodes, size) {
+			if !placementPossible(repType, subset) {
+				continue
+			}
+			if added, ok = s.complete(repType, subset, repType.GetCopyCount()-len(subset)); ok {
+				return subset, added, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// Rebalance moves volumes from the fullest data nodes, by their share of used
+// slots, to the emptiest ones, until a move would not even them out any more.
+func (s *Simulation) Rebalance() *SimulationResult {
+	result := &SimulationResult{Action: "rebalance"}
+	for moves := 0; moves < len(s.nodes)*len(s.volumes); moves++ {
+		if !s.rebalanceOne(result) {
+			break
+		}
+	}
+	return result
+}
+
+func (s *Simulation) rebalanceOne(result *SimulationResult) bool {
+	var nodes []*simNode
+	for _, n := range s.nodes {
+		if n.max > 0 && !n.draining {
+			nodes = append(nodes, n)
+		}
+	}
+	load := func(n *simNode, extra int) float64 {
+		return float64(len(n.volumes)+extra) / float64(n.max)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return load(nodes[i], 0) > load(nodes[j], 0) })
+	for _, from := range nodes {
+		for i := len(nodes) - 1; i >= 0; i-- {
+			to := nodes[i]
+			if load(to, 1) > load(from, -1) {
+				break
+			}
+			if to.free() <= 0 {
+				continue
+			}
+			for _, v := range s.volumes {
+				if !from.volumes[v.id] || to.volumes[v.id] {
+					continue
+				}
+				if placementPossible(v.repType, append(without(v.nodes, from), to)) {
+					s.moveReplica(result, v, from, to)
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// complete picks count more data nodes for the replicas already on the nodes,
+// preferring the data nodes with the most free slots.
+func (s *Simulation) complete(repType storage.ReplicationType, nodes []*simNode, count int) ([]*simNode, bool) {
+	if count <= 0 {
+		return nil, placementPossible(repType, nodes)
+	}
+	var candidates []*simNode
+	for _, n := range s.nodes {
+		if n.free() > 0 && !contains(nodes, n) {
+			candidates = append(candidates, n)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].free() > candidates[j].free() })
+	for _, c := range candidates {
+		picked := append(append([]*simNode{}, nodes...), c)
+		if !placementPossible(repType, picked) {
+			continue
+		}
+		if rest, ok := s.complete(repType, picked, count-1); ok {
+			return append([]*simNode{c}, rest...), true
+		}
+	}
+	return nil, false
+}
+
+// moveReplica copies the volume from one data node to another, and removes it from the first.
+func (s *Simulation) moveReplica(result *SimulationResult, v *simVolume, from, to *simNode) {
+	v.nodes = append(without(v.nodes, from), to)
+	delete(from.volumes, v.id)
+	to.volumes[v.id] = true
+	result.record(VolumeMove{VolumeId: v.id, Collection: v.collection, Size: v.size, From: from.url, To: to.url})
+}
+
+func (s *Simulation) addReplica(result *SimulationResult, v *simVolume, from, to *simNode) {
+	v.nodes = append(v.nodes, to)
+	to.volumes[v.id] = true
+	result.record(VolumeMove{VolumeId: v.id, Collection: v.collection, Size: v.size, From: from.url, To: to.url})
+}
+
+func (s *Simulation) removeReplica(result *SimulationResult, v *simVolume, from *simNode) {
+	v.nodes = without(v.nodes, from)
+	delete(from.volumes, v.id)
+	result.record(VolumeMove{VolumeId: v.id, Collection: v.collection, Size: v.size, From: from.url})
+}
+
+func (result *SimulationResult) record(m VolumeMove) {
+	if result.moved == nil {
+		result.moved = make(map[storage.VolumeId]bool)
+	}
+	if !result.moved[m.VolumeId] {
+		result.moved[m.VolumeId] = true
+		result.VolumesMoved++
+	}
+	if m.To != "" {
+		result.TransferBytes += m.Size
+	}
+	result.Moves = append(result.Moves, m)
+}
+
+// placementPossible tells if the replicas on the nodes are, or can be completed
+// into, a placement of the replication type.
+func placementPossible(repType storage.ReplicationType, nodes []*simNode) bool {
+	if len(nodes) > repType.GetCopyCount() {
+		return false
+	}
+	racks, dcs, regions := make(map[string]int), make(map[string]int), make(map[string]int)
+	for i, n := range nodes {
+		if contains(nodes[:i], n) {
+			return false
+		}
+		racks[n.rack]++
+		dcs[n.dc]++
+		regions[n.region]++
+	}
+	switch repType {
+	case storage.Copy000:
+		return true
+	case storage.Copy001:
+		return len(racks) <= 1
+	case storage.Copy010:
+		return len(dcs) <= 1 && len(racks) == len(nodes)
+	case storage.Copy100, storage.Copy200:
+		return len(dcs) == len(nodes)
+	case storage.Copy110:
+		if len(dcs) > 2 || len(racks) != len(nodes) {
+			return false
+		}
+		pairs := 0
+		for _, count := range dcs {
+			if count > 2 {
+				return false
+			}
+			if count == 2 {
+				pairs++
+			}
+		}
+		return pairs <= 1
+	case storage.Copy1000:
+		return len(regions) == len(nodes) && regions[""] == 0
+	}
+	return false
+}
+
+func contains(nodes []*simNode, node *simNode) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func without(nodes []*simNode, node *simNode) []*simNode {
+	var rest []*simNode
+	for _, n := range nodes {
+		if n != node {
+			rest = append(rest, n)
+		}
+	}
+	return rest
+}
+
+// subsets lists the subsets of the nodes with the given size.
+func subsets(nodes []*simNode, size int) [][]*simNode {
+	if size == 0 {
+		return [][]*simNode{nil}
+	}
+	var result [][]*simNode
+	for i := 0; i+size <= len(nodes); i++ {
+		for _, rest := range subsets(nodes[i+1:], size-1) {
+			result = append(result, append([]*simNode{nodes[i]}, rest...))
+		}
+	}
+	return result
+}
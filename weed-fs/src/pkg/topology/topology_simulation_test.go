@@ -0,0 +1,88 @@
+package topology
+
+import (
+	"pkg/storage"
+	"testing"
+)
+
+// simulationTopology has a:8080 and b:8081 in dc1 rack1, c:8082 in dc1 rack2,
+// and d:8083 in dc2, with volume 1 as 001 on a and b, volume 2 as 010 on a and c,
+// and volume 3 as 000 on a.
+func simulationTopology() *Topology {
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 234, 5)
+	nodes := make(map[string]*DataNode)
+	for _, n := range []struct{ dc, rack, ip string }{{"dc1", "rack1", "a"}, {"dc1", "rack1", "b"}, {"dc1", "rack2", "c"}, {"dc2", "rack1", "d"}} {
+		dc, ok := topo.Children()[NodeId(n.dc)]
+		if !ok {
+			dc = NewDataCenter(n.dc)
+			topo.LinkChildNode(dc)
+		}
+		nodes[n.ip] = dc.GetValue().(*DataCenter).GetOrCreateRack(n.rack).GetOrCreateDataNode(n.ip, 8080+len(nodes), "", 4)
+	}
+	for _, v := range []struct {
+		id      storage.VolumeId
+		repType storage.ReplicationType
+		on      []string
+	}{{1, storage.Copy001, []string{"a", "b"}}, {2, storage.Copy010, []string{"a", "c"}}, {3, storage.Copy000, []string{"a"}}} {
+		for _, ip := range v.on {
+			nodes[ip].AddOrUpdateVolume(storage.VolumeInfo{Id: v.id, Size: 100 * int64(v.id), RepType: v.repType, Collection: "photos"})
+		}
+	}
+	return topo
+}
+
+func TestSimulateDecommission(t *testing.T) {
+	topo := simulationTopology()
+	result, err := NewSimulation(topo).Decommission("a:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []VolumeMove{
+		{VolumeId: 2, Collection: "photos", Size: 200, From: "a:8080", To: "b:8081"},
+		{VolumeId: 3, Collection: "photos", Size: 300, From: "a:8080", To: "d:8083"},
+	}
+	checkMoves(t, result, expected)
+	if len(result.Unplaceable) != 1 || result.Unplaceable[0] != 1 {
+		t.Fatal("volume 1 has no other data node in its rack, but unplaceable are", result.Unplaceable)
+	}
+	if result.TransferBytes != 500 || result.VolumesMoved != 2 {
+		t.Fatal("expected 500 bytes for 2 volumes, but got", result.TransferBytes, "for", result.VolumesMoved)
+	}
+	if len(topo.FindDataNode("a:8080").volumes) != 3 {
+		t.Fatal("the simulation should not change the topology")
+	}
+}
+
+func TestSimulateReplicationChange(t *testing.T) {
+	result, err := NewSimulation(simulationTopology()).ChangeReplication("photos", storage.Copy100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []VolumeMove{
+		{VolumeId: 1, Collection: "photos", Size: 100, From: "b:8081"},
+		{VolumeId: 1, Collection: "photos", Size: 100, From: "a:8080", To: "d:8083"},
+		{VolumeId: 2, Collection: "photos", Size: 200, From: "c:8082"},
+		{VolumeId: 2, Collection: "photos", Size: 200, From: "a:8080", To: "d:8083"},
+		{VolumeId: 3, Collection: "photos", Size: 300, From: "a:8080", To: "d:8083"},
+	}
+	checkMoves(t, result, expected)
+}
+
+func TestSimulateRebalance(t *testing.T) {
+	result := NewSimulation(simulationTopology()).Rebalance()
+	expected := []VolumeMove{
+		{VolumeId: 3, Collection: "photos", Size: 300, From: "a:8080", To: "d:8083"},
+	}
+	checkMoves(t, result, expected)
+}
+
+func checkMoves(t *testing.T, result *SimulationResult, expected []VolumeMove) {
+	if len(result.Moves) != len(expected) {
+		t.Fatalf("expected moves %+v, but got %+v", expected, result.Moves)
+	}
+	for i := range expected {
+		if result.Moves[i] != expected[i] {
+			t.Fatalf("expected moves %+v, but got %+v", expected, result.Moves)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package topology
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"pkg/storage"
+	"pkg/util"
+	"sync"
+	"time"
+)
+
+const (
+	MaxFinishedVacuumTasks = 32
+	// compacting copies the whole volume, so it gets much longer than util.RequestTimeout
+	vacuumCompactTimeout = time.Hour
+)
+
+type VacuumTask struct {
+	VolumeId   storage.VolumeId
+	Collection string
+	RepType    storage.ReplicationType
+	Servers    []string
+	StartedAt  int64
+	EndedAt    int64
+	Error      string
+}
+
+// VacuumScheduler limits how many volumes are compacted at the same time
+// on each data node and in each rack, so that a batch of volumes crossing
+// the garbage threshold together does not saturate the disks.
+type VacuumScheduler struct {
+	maxPerDataNode int // 0 means no limit
+	maxPerRack     int // 0 means no limit
+
+	pending  []*VacuumTask
+	running  map[storage.VolumeId]*VacuumTask
+	finished []*VacuumTask
+
+	dataNodeCounter map[*DataNode]int
+	rackCounter     map[Node]int
+
+	lock sync.Mutex
+}
+
+func NewVacuumScheduler(maxPerDataNode, maxPerRack int) *VacuumScheduler {
+	return &VacuumScheduler{
+		maxPerDataNode:  maxPerDataNode,
+		maxPerRack:      maxPerRack,
+		running:         make(map[storage.VolumeId]*VacuumTask),
+		dataNodeCounter: make(map[*DataNode]int),
+		rackCounter:     make(map[Node]int),
+	}
+}
+
+func (vs *VacuumScheduler) isQueued(vid storage.VolumeId) bool {
+	if _, ok := vs.running[vid]; ok {
+		return true
+	}
+	for _, task := range vs.pending {
+		if task.VolumeId == vid {
+			return true
+		}
+	}
+	return false
+}
+
+func (vs *VacuumScheduler) canStart(dataNodes []*DataNode) bool {
+	rackDelta := make(map[Node]int)
+	for _, dn := range dataNodes {
+		if vs.maxPerDataNode > 0 && vs.dataNodeCounter[dn] >= vs.maxPerDataNode {
+			return false
+		}
+		rackDelta[dn.Parent()]++
+	}
+	if vs.maxPerRack > 0 {
+		for rack, delta := range rackDelta {
+			if vs.rackCounter[rack]+delta > vs.maxPerRack {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (vs *VacuumScheduler) adjustCounters(dataNodes []*DataNode, delta int) {
+	for _, dn := range dataNodes {
+		vs.dataNodeCounter[dn] += delta
+		vs.rackCounter[dn.Parent()] += delta
+	}
+}
+
+func (vs *VacuumScheduler) finish(task *VacuumTask) {
+	task.EndedAt = time.Now().Unix()
+	delete(vs.running, task.VolumeId)
+	vs.finished = append([]*VacuumTask{task}, vs.finished...)
+	if len(vs.finished) > MaxFinishedVacuumTasks {
+		vs.finished = vs.finished[:MaxFinishedVacuumTasks]
+	}
+}
+
+func (t *Topology) SetVacuumLimits(maxPerDataNode, maxPerRack int) {
+	t.vacuumScheduler.lock.Lock()
+	defer t.vacuumScheduler.lock.Unlock()
+	t.vacuumScheduler.maxPerDataNode = maxPerDataNode
+	t.vacuumScheduler.maxPerRack = maxPerRack
+}
+
+// Vacuum queues every volume whose garbage ratio exceeds garbageThreshold
+// on any replica, and starts as many compactions as the limits allow.
+// It returns the number of newly queued volumes.
+func (t *Topology) Vacuum(garbageThreshold float64) int {
+	vs := t.vacuumScheduler
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	queued := 0
+	for _, vl := range t.volumeLayouts() {
+		for vid, locationList := range vl.vid2location {
+			if vs.isQueued(vid) {
+				continue
+			}
+			for _, dn := range locationList.list {
+				if garbageLevel(dn.volumes[vid]) > garbageThreshold {
+					vs.pending = append(vs.pending, &VacuumTask{VolumeId: vid, Collection: vl.collection, RepType: vl.repType})
+					queued++
+					break
+				}
+			}
+		}
+	}
+	t.scheduleVacuum()
+	return queued
+}
+
+func garbageLevel(v storage.VolumeInfo) float64 {
+	if v.Size <= storage.SuperBlockSize {
+		return 0
+	}
+	return float64(v.DeletedByteCount) / float64(v.Size-storage.SuperBlockSize)
+}
+
+// scheduleVacuum must be called with the scheduler lock held.
+func (t *Topology) scheduleVacuum() {
+	vs := t.vacuumScheduler
+	var stillPending []*VacuumTask
+	for _, task := range vs.pending {
+		vl := t.GetVolumeLayout(task.Collection, task.RepType)
+		locationList := vl.vid2location[task.VolumeId]
+		if locationList == nil || locationList.Length() == 0 {
+			continue
+		}
+		dataNodes := make([]*DataNode, locationList.Length())
+		copy(dataNodes, locationList.list)
+		if !vs.canStart(dataNodes) {
+			stillPending = append(stillPending, task)
+			continue
+		}
+		task.StartedAt = time.Now().Unix()
+		task.Servers = nil
+		for _, dn := range dataNodes {
+			task.Servers = append(task.Servers, dn.Url())
+		}
+		vs.running[task.VolumeId] = task
+		vs.adjustCounters(dataNodes, 1)
+		vl.removeFromWritable(task.VolumeId)
+		go t.vacuumOneVolume(task, vl, dataNodes)
+	}
+	vs.pending = stillPending
+}
+
+func (t *Topology) vacuumOneVolume(task *VacuumTask, vl *VolumeLayout, dataNodes []*DataNode) {
+	errs := make(chan error, len(dataNodes))
+	for _, dn := range dataNodes {
+		go func(dn *DataNode) {
+			errs <- vacuumVolumeCompact(dn.AdminUrl(), task.VolumeId)
+		}(dn)
+	}
+	var failures []string
+	for i := 0; i < len(dataNodes); i++ {
+		if e := <-errs; e != nil {
+			failures = append(failures, e.Error())
+		}
+	}
+
+	vs := t.vacuumScheduler
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	if len(failures) > 0 {
+		task.Error = fmt.Sprint(failures)
+		t.recordEvent("Failed to vacuum volume", task.VolumeId, task.Error)
+	} else {
+		for _, dn := range dataNodes {
+			if v, ok := dn.volumes[task.VolumeId]; ok {
+				v.DeletedByteCount = 0
+				dn.volumes[task.VolumeId] = v
+			}
+		}
+		t.recordEvent("Vacuumed volume", task.VolumeId, "on", task.Servers)
+	}
+	vs.adjustCounters(dataNodes, -1)
+	vs.finish(task)
+	if locationList := vl.vid2location[task.VolumeId]; locationList != nil {
+		if locationList.Length() >= vl.repType.GetCopyCount() && !vl.isVolumeFull(task.VolumeId) {
+			vl.setVolumeWritable(task.VolumeId)
+		}
+	}
+	t.scheduleVacuum()
+}
+
+type vacuumVolumeResult struct {
+	Error string
+}
+
+func vacuumVolumeCompact(server string, vid storage.VolumeId) error {
+	values := make(url.Values)
+	values.Add("volume", vid.String())
+	ctx, cancel := context.WithTimeout(context.Background(), vacuumCompactTimeout)
+	defer cancel()
+	jsonBlob, err := util.PostContext(ctx, "http://"+server+"/admin/vacuum_volume_compact", values)
+	if err != nil {
+		return err
+	}
+	var ret vacuumVolumeResult
+	if err := json.Unmarshal(jsonBlob, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	return nil
+}
+
+func (t *Topology) ToVacuumMap() interface{} {
+	vs := t.vacuumScheduler
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	m := make(map[string]interface{})
+	m["MaxPerDataNode"] = vs.maxPerDataNode
+	m["MaxPerRack"] = vs.maxPerRack
+	var running []*VacuumTask
+	for _, task := range vs.running {
+		running = append(running, task)
+	}
+	m["Running"] = running
+	m["Pending"] = vs.pending
+	m["Finished"] = vs.finished
+	return m
+}
@@ -0,0 +1,81 @@
+package topology
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"pkg/storage"
+	"pkg/util"
+	"sync"
+)
+
+// CloneVolume copies the sealed volume under the next volume id, on the same
+// volume servers, where the copies share the data file of the volume until
+// one of them changes. The clone is registered sealed, at once.
+func (t *Topology) CloneVolume(vid storage.VolumeId) (storage.VolumeId, error) {
+	vl, locationList := t.findVolumeLayout(vid)
+	if vl == nil {
+		return 0, errors.New("Volume " + vid.String() + " is not found!")
+	}
+	dataNodes := make([]*DataNode, locationList.Length())
+	copy(dataNodes, locationList.list)
+	for _, dn := range dataNodes {
+		if v, ok := dn.volumes[vid]; ok && v.State != storage.VolumeSealed {
+			return 0, errors.New("Volume " + vid.String() + " is not sealed on " + dn.Url() + ", seal it first")
+		}
+	}
+	newVid, err := t.NextVolumeId()
+	if err != nil {
+		return 0, err
+	}
+	errs := make([]error, len(dataNodes))
+	var wg sync.WaitGroup
+	for i, dn := range dataNodes {
+		wg.Add(1)
+		go func(i int, dn *DataNode) {
+			defer wg.Done()
+			errs[i] = cloneVolumeOnDataNode(dn.AdminUrl(), vid, newVid)
+		}(i, dn)
+	}
+	wg.Wait()
+	for i, dn := range dataNodes {
+		if errs[i] != nil {
+			err = errors.New(dn.Url() + ": " + errs[i].Error())
+			t.recordEvent("Failed to clone volume", vid, "as volume", newVid, "on", dn, errs[i].Error())
+			continue
+		}
+		if v, ok := dn.volumes[vid]; ok {
+			v.Id = newVid
+			dn.AddOrUpdateVolume(v)
+			t.RegisterVolumeLayout(&v, dn)
+		}
+	}
+	if err != nil {
+		return newVid, err
+	}
+	t.locationsChanged()
+	t.recordEvent("Volume", vid, "is cloned as volume", newVid)
+	return newVid, nil
+}
+
+type cloneVolumeResult struct {
+	Error string
+}
+
+func cloneVolumeOnDataNode(server string, vid, newVid storage.VolumeId) error {
+	values := make(url.Values)
+	values.Add("volume", vid.String())
+	values.Add("newVolume", newVid.String())
+	jsonBlob, err := util.Post("http://"+server+"/admin/clone_volume", values)
+	if err != nil {
+		return err
+	}
+	var ret cloneVolumeResult
+	if err := json.Unmarshal(jsonBlob, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package topology
+
+import (
+	"errors"
+	"pkg/storage"
+	"strconv"
+	"strings"
+)
+
+// VolumeIdPartition is the part of the volume ids a master creates volumes
+// with, so that the masters of two active clusters never reuse each other's
+// ids, and their volumes can be mirrored or merged later:
+//
+//	1/2        the ids with a remainder of 1 divided by 2, the odd ids
+//	1000-1999  the ids from 1000 to 1999
+//
+// A nil partition has all the ids.
+type VolumeIdPartition struct {
+	remainder, modulus uint32 // modulus 0 for a range
+	first, last        uint32
+}
+
+var ErrVolumeIdsExhausted = errors.New("No volume id left in the volume id partition")
+
+func ParseVolumeIdPartition(s string) (*VolumeIdPartition, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if parts := strings.SplitN(s, "/", 2); len(parts) == 2 {
+		remainder, err1 := strconv.ParseUint(parts[0], 10, 32)
+		modulus, err2 := strconv.ParseUint(parts[1], 10, 32)
+		if err1 != nil || err2 != nil || modulus == 0 || remainder >= modulus {
+			return nil, errors.New("Invalid volume id partition " + s + ", expecting remainder/modulus, e.g. 1/2")
+		}
+		return &VolumeIdPartition{remainder: uint32(remainder), modulus: uint32(modulus)}, nil
+	}
+	if parts := strings.SplitN(s, "-", 2); len(parts) == 2 {
+		first, err1 := strconv.ParseUint(parts[0], 10, 32)
+		last, err2 := strconv.ParseUint(parts[1], 10, 32)
+		if err1 != nil || err2 != nil || first == 0 || first > last {
+			return nil, errors.New("Invalid volume id partition " + s + ", expecting first-last, e.g. 1000-1999")
+		}
+		return &VolumeIdPartition{first: uint32(first), last: uint32(last)}, nil
+	}
+	return nil, errors.New("Invalid volume id partition " + s + ", expecting 1/2 or 1000-1999")
+}
+
+func (p *VolumeIdPartition) Contains(vid storage.VolumeId) bool {
+	if p == nil {
+		return true
+	}
+	if p.modulus > 0 {
+		return uint32(vid)%p.modulus == p.remainder
+	}
+	return p.first <= uint32(vid) && uint32(vid) <= p.last
+}
+
+// Next is the first id of the partition after the highest one in use, 0 if
+// none is. Volume id 0 is never used.
+func (p *VolumeIdPartition) Next(highest storage.VolumeId) (storage.VolumeId, error) {
+	next := uint64(highest) + 1
+	switch {
+	case p == nil:
+	case p.modulus > 0:
+		m, r := uint64(p.modulus), uint64(p.remainder)
+		next = next + (r+m-next%m)%m
+		if next == 0 {
+			next = m
+		}
+	default:
+		if next < uint64(p.first) {
+			next = uint64(p.first)
+		}
+		if next > uint64(p.last) {
+			return 0, ErrVolumeIdsExhausted
+		}
+	}
+	if next > uint64(^uint32(0)) {
+		return 0, ErrVolumeIdsExhausted
+	}
+	return storage.VolumeId(next), nil
+}
+
+func (p *VolumeIdPartition) String() string {
+	switch {
+	case p == nil:
+		return ""
+	case p.modulus > 0:
+		return strconv.FormatUint(uint64(p.remainder), 10) + "/" + strconv.FormatUint(uint64(p.modulus), 10)
+	}
+	return strconv.FormatUint(uint64(p.first), 10) + "-" + strconv.FormatUint(uint64(p.last), 10)
+}
@@ -0,0 +1,44 @@
+package topology
+
+import (
+	"pkg/storage"
+	"testing"
+)
+
+func TestVolumeIdPartition(t *testing.T) {
+	odd, err := ParseVolumeIdPartition("1/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	even, _ := ParseVolumeIdPartition("0/2")
+	ranged, _ := ParseVolumeIdPartition("1000-1002")
+	var all *VolumeIdPartition
+	for _, c := range []struct {
+		p        *VolumeIdPartition
+		highest  storage.VolumeId
+		expected storage.VolumeId
+	}{
+		{all, 0, 1}, {all, 7, 8},
+		{odd, 0, 1}, {odd, 1, 3}, {odd, 4, 5},
+		{even, 0, 2}, {even, 2, 4}, {even, 3, 4},
+		{ranged, 0, 1000}, {ranged, 1001, 1002},
+	} {
+		if next, err := c.p.Next(c.highest); err != nil || next != c.expected || !c.p.Contains(next) {
+			t.Fatal(c.p, "after", c.highest, "expecting", c.expected, "got", next, err)
+		}
+	}
+	if _, err := ranged.Next(1002); err != ErrVolumeIdsExhausted {
+		t.Fatal("expecting the range to be exhausted, got", err)
+	}
+	if odd.Contains(4) || ranged.Contains(999) || !all.Contains(4) {
+		t.Fatal("unexpected Contains")
+	}
+	for _, s := range []string{"2/2", "1/0", "0-5", "9-3", "odd", "1/x"} {
+		if _, err := ParseVolumeIdPartition(s); err == nil {
+			t.Fatal("expecting", s, "to be refused")
+		}
+	}
+	if p, _ := ParseVolumeIdPartition(""); p != nil {
+		t.Fatal("expecting no partition")
+	}
+}
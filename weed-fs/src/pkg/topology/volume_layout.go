@@ -5,50 +5,77 @@ import (
 	"fmt"
 	"math/rand"
 	"pkg/storage"
+	"sync"
 )
 
 type VolumeLayout struct {
-	repType         storage.ReplicationType
-	vid2location    map[storage.VolumeId]*VolumeLocationList
-	writables       []storage.VolumeId // transient array of writable volume id
-	pulse           int64
-	volumeSizeLimit uint64
+	collection           string
+	repType              storage.ReplicationType
+	vid2location         map[storage.VolumeId]*VolumeLocationList
+	lock                 sync.RWMutex // held to change the volume locations, and to copy them, see locations
+	writables            []storage.VolumeId // transient array of writable volume id
+	pulse                int64
+	volumeSizeLimit      uint64
+	volumeFileCountLimit int // 0 means no limit
 }
 
-func NewVolumeLayout(repType storage.ReplicationType, volumeSizeLimit uint64, pulse int64) *VolumeLayout {
+func NewVolumeLayout(collection string, repType storage.ReplicationType, volumeSizeLimit uint64, volumeFileCountLimit int, pulse int64) *VolumeLayout {
 	return &VolumeLayout{
-		repType:         repType,
-		vid2location:    make(map[storage.VolumeId]*VolumeLocationList),
-		writables:       *new([]storage.VolumeId),
-		pulse:           pulse,
-		volumeSizeLimit: volumeSizeLimit,
+		collection:           collection,
+		repType:              repType,
+		vid2location:         make(map[storage.VolumeId]*VolumeLocationList),
+		writables:            *new([]storage.VolumeId),
+		pulse:                pulse,
+		volumeSizeLimit:      volumeSizeLimit,
+		volumeFileCountLimit: volumeFileCountLimit,
 	}
 }
 
 func (vl *VolumeLayout) RegisterVolume(v *storage.VolumeInfo, dn *DataNode) {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
 	if _, ok := vl.vid2location[v.Id]; !ok {
 		vl.vid2location[v.Id] = NewVolumeLocationList()
 	}
 	if vl.vid2location[v.Id].Add(dn) {
 		if len(vl.vid2location[v.Id].list) == v.RepType.GetCopyCount() {
-			if uint64(v.Size) < vl.volumeSizeLimit {
-				vl.writables = append(vl.writables, v.Id)
+			if vl.isWritable(v) {
+				vl.setVolumeWritable(v.Id)
 			}
 		}
 	}
 }
 
 func (vl *VolumeLayout) Lookup(vid storage.VolumeId) (*[]*DataNode) {
-  return &vl.vid2location[vid].list
+  if locationList := vl.vid2location[vid]; locationList != nil {
+    return &locationList.list
+  }
+  return nil
 }
 
-func (vl *VolumeLayout) PickForWrite(count int) (*storage.VolumeId, int, *VolumeLocationList, error) {
-	len_writers := len(vl.writables)
+// PickForWrite randomly picks a writable volume whose replicas all pass the filter.
+// If dataCenter is not empty, volumes whose head replica is in the data center are preferred.
+func (vl *VolumeLayout) PickForWrite(random *rand.Rand, count int, dataCenter string, filter NodeFilter) (*storage.VolumeId, int, *VolumeLocationList, error) {
+	writables := vl.writablesMatching(filter)
+	len_writers := len(writables)
 	if len_writers <= 0 {
 		fmt.Println("No more writable volumes!")
 		return nil, 0, nil, errors.New("No more writable volumes!")
 	}
-	vid := vl.writables[rand.Intn(len_writers)]
+	vid := writables[random.Intn(len_writers)]
+	if dataCenter != "" {
+		var local []storage.VolumeId
+		for _, v := range writables {
+			if locationList := vl.vid2location[v]; locationList != nil && locationList.Length() > 0 {
+				if dc := locationList.Head().GetDataCenter(); dc != nil && string(dc.Id()) == dataCenter {
+					local = append(local, v)
+				}
+			}
+		}
+		if len(local) > 0 {
+			vid = local[random.Intn(len(local))]
+		}
+	}
 	locationList := vl.vid2location[vid]
 	if locationList != nil {
 		return &vid, count, locationList, nil
@@ -60,6 +87,24 @@ func (vl *VolumeLayout) GetActiveVolumeCount() int {
 	return len(vl.writables)
 }
 
+// GetActiveVolumeCountMatching counts the writable volumes whose replicas all pass the filter.
+func (vl *VolumeLayout) GetActiveVolumeCountMatching(filter NodeFilter) int {
+	return len(vl.writablesMatching(filter))
+}
+
+func (vl *VolumeLayout) writablesMatching(filter NodeFilter) []storage.VolumeId {
+	if filter == nil {
+		return vl.writables
+	}
+	var writables []storage.VolumeId
+	for _, vid := range vl.writables {
+		if locationList := vl.vid2location[vid]; locationList != nil && filter.matches(locationList.list) {
+			writables = append(writables, vid)
+		}
+	}
+	return writables
+}
+
 func (vl *VolumeLayout) removeFromWritable(vid storage.VolumeId) bool {
 	for i, v := range vl.writables {
 		if v == vid {
@@ -69,7 +114,22 @@ func (vl *VolumeLayout) removeFromWritable(vid storage.VolumeId) bool {
 	}
 	return false
 }
+func (vl *VolumeLayout) isVolumeWritable(vid storage.VolumeId) bool {
+	for _, v := range vl.writables {
+		if v == vid {
+			return true
+		}
+	}
+	return false
+}
 func (vl *VolumeLayout) setVolumeWritable(vid storage.VolumeId) bool {
+	if list := vl.vid2location[vid]; list != nil {
+		for _, dn := range list.list {
+			if dn.Draining {
+				return false
+			}
+		}
+	}
 	for _, v := range vl.writables {
 		if v == vid {
 			return false
@@ -79,7 +139,32 @@ func (vl *VolumeLayout) setVolumeWritable(vid storage.VolumeId) bool {
 	return true
 }
 
+// isWritable checks that the volume is growing, and not due to be sealed
+func (vl *VolumeLayout) isWritable(v *storage.VolumeInfo) bool {
+	return v.State.IsWritable() && !vl.isOverLimit(v)
+}
+
+// isOverLimit checks the volume against both the size limit and the file count limit
+func (vl *VolumeLayout) isOverLimit(v *storage.VolumeInfo) bool {
+	if uint64(v.Size) >= vl.volumeSizeLimit {
+		return true
+	}
+	return vl.volumeFileCountLimit > 0 && v.FileCount >= vl.volumeFileCountLimit
+}
+
+func (vl *VolumeLayout) isVolumeFull(vid storage.VolumeId) bool {
+	for _, dn := range vl.vid2location[vid].list {
+		v := dn.volumes[vid]
+		if !vl.isWritable(&v) {
+			return true
+		}
+	}
+	return false
+}
+
 func (vl *VolumeLayout) SetVolumeUnavailable(dn *DataNode, vid storage.VolumeId) bool {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
 	if vl.vid2location[vid].Remove(dn) {
 		if vl.vid2location[vid].Length() < vl.repType.GetCopyCount() {
 			fmt.Println("Volume", vid, "has", vl.vid2location[vid].Length(), "replica, less than required", vl.repType.GetCopyCount())
@@ -89,6 +174,8 @@ func (vl *VolumeLayout) SetVolumeUnavailable(dn *DataNode, vid storage.VolumeId)
 	return false
 }
 func (vl *VolumeLayout) SetVolumeAvailable(dn *DataNode, vid storage.VolumeId) bool {
+	vl.lock.Lock()
+	defer vl.lock.Unlock()
 	if vl.vid2location[vid].Add(dn) {
 		if vl.vid2location[vid].Length() >= vl.repType.GetCopyCount() {
 			fmt.Println("Volume", vid, "becomes writable")
@@ -98,14 +185,34 @@ func (vl *VolumeLayout) SetVolumeAvailable(dn *DataNode, vid storage.VolumeId) b
 	return false
 }
 
+// locations copies the locations of the volumes, for the loops running beside
+// the heartbeats, which change them.
+func (vl *VolumeLayout) locations() map[storage.VolumeId][]*DataNode {
+	vl.lock.RLock()
+	defer vl.lock.RUnlock()
+	locations := make(map[storage.VolumeId][]*DataNode, len(vl.vid2location))
+	for vid, locationList := range vl.vid2location {
+		locations[vid] = append([]*DataNode(nil), locationList.list...)
+	}
+	return locations
+}
+
 func (vl *VolumeLayout) SetVolumeCapacityFull(vid storage.VolumeId) bool {
 	return vl.removeFromWritable(vid)
 }
 
 func (vl *VolumeLayout) ToMap() interface{} {
 	m := make(map[string]interface{})
+	m["collection"] = vl.collection
 	m["replication"] = vl.repType.String()
 	m["writables"] = vl.writables
+	var readonly []storage.VolumeId
+	for vid := range vl.vid2location {
+		if !vl.isVolumeWritable(vid) {
+			readonly = append(readonly, vid)
+		}
+	}
+	m["readonly"] = readonly
 	//m["locations"] = vl.vid2location
 	return m
 }
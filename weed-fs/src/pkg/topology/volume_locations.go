@@ -0,0 +1,30 @@
+package topology
+
+import (
+	"pkg/storage"
+	"sync/atomic"
+)
+
+// locationsChanged counts a change of the volume locations, so copies of them
+// can be refreshed only when needed.
+func (t *Topology) locationsChanged() {
+	atomic.AddUint64(&t.locationChanges, 1)
+}
+
+// LocationChanges is the number of times the volume locations changed.
+func (t *Topology) LocationChanges() uint64 {
+	return atomic.LoadUint64(&t.locationChanges)
+}
+
+// VolumeLocations copies the locations of all the volumes.
+func (t *Topology) VolumeLocations() map[storage.VolumeId][]*DataNode {
+	locations := make(map[storage.VolumeId][]*DataNode)
+	for _, vl := range t.volumeLayouts() {
+		for vid, locationList := range vl.vid2location {
+			if locationList.Length() > 0 {
+				locations[vid] = append([]*DataNode(nil), locationList.list...)
+			}
+		}
+	}
+	return locations
+}
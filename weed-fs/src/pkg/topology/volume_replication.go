@@ -0,0 +1,363 @@
+package topology
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"pkg/storage"
+	"pkg/util"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxFinishedReplicationTasks = 32
+	// replicating copies the whole volume over the network, like mirroring
+	replicateVolumeTimeout = mirrorVolumeTimeout
+	// the longest wait before a volume whose copies keep failing is tried again
+	maxReplicationBackoff = time.Hour
+)
+
+// replicator copies the volumes left with fewer live replicas than their
+// replication type, e.g. after a volume server died, onto other volume servers,
+// one replica at a time. A volume is only copied once its replica has been
+// missing for the delay, so a server back from a restart or a short rack power
+// cut is not copied again, and the copies only start within the daily window,
+// at most maxPerDataNode at the same time on a volume server, counting both the
+// source and the target, and maxPerRack in a rack, like the vacuums. A volume
+// whose copy failed waits a pulse, doubling on each failure up to an hour.
+// Volumes without any live replica are only reported, in /vol/replicas.
+type replicator struct {
+	delay          time.Duration
+	window         *DailyWindow // nil for any time
+	maxPerDataNode int          // 0 means no limit
+	maxPerRack     int          // 0 means no limit
+
+	missingSince map[storage.VolumeId]time.Time
+	failures     map[storage.VolumeId]*replicationFailure
+	running      map[storage.VolumeId]*ReplicationTask
+	finished     []*ReplicationTask
+
+	dataNodeCounter map[*DataNode]int
+	rackCounter     map[Node]int
+
+	lock sync.Mutex
+}
+
+type replicationFailure struct {
+	count int
+	next  time.Time
+}
+
+// ReplicationTask is the copy of one missing replica of a volume.
+type ReplicationTask struct {
+	VolumeId   storage.VolumeId
+	Collection string
+	From       string
+	To         string
+	StartedAt  int64
+	EndedAt    int64
+	Error      string
+}
+
+// DailyWindow is a range of the day, in minutes after midnight, that may wrap
+// around midnight, e.g. 22:00-04:00.
+type DailyWindow struct {
+	Start, End int
+}
+
+// ParseDailyWindow parses hh:mm-hh:mm, and returns nil for an empty window.
+func ParseDailyWindow(s string) (*DailyWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	bounds := strings.Split(s, "-")
+	if len(bounds) != 2 {
+		return nil, errors.New("the window " + s + " should be hh:mm-hh:mm")
+	}
+	var minutes [2]int
+	for i, bound := range bounds {
+		hm := strings.Split(strings.TrimSpace(bound), ":")
+		if len(hm) != 2 {
+			return nil, errors.New("the window " + s + " should be hh:mm-hh:mm")
+		}
+		h, e1 := strconv.Atoi(hm[0])
+		m, e2 := strconv.Atoi(hm[1])
+		if e1 != nil || e2 != nil || h < 0 || h > 24 || m < 0 || m > 59 || h == 24 && m != 0 {
+			return nil, errors.New("the window " + s + " has an invalid time " + bound)
+		}
+		minutes[i] = h*60 + m
+	}
+	if minutes[0] == minutes[1] {
+		return nil, errors.New("the window " + s + " is empty")
+	}
+	return &DailyWindow{Start: minutes[0], End: minutes[1]}, nil
+}
+
+// Contains tells if the time of the day, in its location, is within the window.
+func (w *DailyWindow) Contains(now time.Time) bool {
+	if w == nil {
+		return true
+	}
+	m := now.Hour()*60 + now.Minute()
+	if w.Start < w.End {
+		return w.Start <= m && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
+
+func (w *DailyWindow) String() string {
+	if w == nil {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// StartReplication checks the replicas of the volumes every interval, and
+// copies the missing ones, see replicator.
+func (t *Topology) StartReplication(delay time.Duration, window *DailyWindow, maxPerDataNode, maxPerRack int, interval time.Duration) {
+	t.replicator = &replicator{delay: delay, window: window, maxPerDataNode: maxPerDataNode, maxPerRack: maxPerRack,
+		missingSince: make(map[storage.VolumeId]time.Time), failures: make(map[storage.VolumeId]*replicationFailure),
+		running: make(map[storage.VolumeId]*ReplicationTask), dataNodeCounter: make(map[*DataNode]int), rackCounter: make(map[Node]int)}
+	go func() {
+		for {
+			time.Sleep(interval)
+			t.checkReplication(time.Now())
+		}
+	}()
+}
+
+// checkReplication notes the volumes missing replicas, and starts the copies
+// of those missing one long enough, as far as the window and the limits allow.
+// It returns the started tasks.
+func (t *Topology) checkReplication(now time.Time) []*ReplicationTask {
+	rp := t.replicator
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	type missing struct {
+		vl        *VolumeLayout
+		vid       storage.VolumeId
+		locations []*DataNode
+	}
+	var due []missing
+	stillMissing := make(map[storage.VolumeId]bool)
+	for _, vl := range t.volumeLayouts() {
+		// the heartbeats change the locations meanwhile
+		for vid, locations := range vl.locations() {
+			if live := len(locations); live == 0 || live >= vl.repType.GetCopyCount() {
+				continue
+			}
+			stillMissing[vid] = true
+			since, ok := rp.missingSince[vid]
+			if !ok {
+				since = now
+				rp.missingSince[vid] = now
+			}
+			_, running := rp.running[vid]
+			failure := rp.failures[vid]
+			if !running && now.Sub(since) >= rp.delay && (failure == nil || !now.Before(failure.next)) {
+				due = append(due, missing{vl, vid, locations})
+			}
+		}
+	}
+	for vid := range rp.missingSince {
+		if !stillMissing[vid] {
+			delete(rp.missingSince, vid)
+			delete(rp.failures, vid)
+		}
+	}
+	if len(due) == 0 || !rp.window.Contains(now) {
+		return nil
+	}
+	// the longest missing first
+	sort.Slice(due, func(i, j int) bool {
+		a, b := rp.missingSince[due[i].vid], rp.missingSince[due[j].vid]
+		return a.Before(b) || a.Equal(b) && due[i].vid < due[j].vid
+	})
+	dataNodes := make(map[string]*DataNode)
+	t.eachDataNode(func(dc *DataCenter, dn *DataNode) {
+		dataNodes[dn.Url()] = dn
+	})
+	s := NewSimulation(t)
+	var started []*ReplicationTask
+	for _, m := range due {
+		var source *DataNode
+		for _, dn := range m.locations {
+			if !dn.Dead {
+				source = dn
+				break
+			}
+		}
+		var v *simVolume
+		for _, sv := range s.volumes {
+			if sv.id == m.vid {
+				v = sv
+			}
+		}
+		if source == nil || v == nil {
+			continue
+		}
+		added, ok := s.complete(m.vl.repType, v.nodes, m.vl.repType.GetCopyCount()-len(v.nodes))
+		if !ok || len(added) == 0 {
+			continue
+		}
+		target := dataNodes[added[0].url]
+		if target == nil || target.Dead || !rp.canStart(source, target) {
+			continue
+		}
+		task := &ReplicationTask{VolumeId: m.vid, Collection: m.vl.collection, From: source.Url(), To: target.Url(), StartedAt: now.Unix()}
+		rp.running[m.vid] = task
+		rp.adjustCounters(source, target, 1)
+		s.addReplica(&SimulationResult{}, v, s.findNode(source.Url()), added[0])
+		started = append(started, task)
+		go t.replicateOneVolume(task, source, target)
+	}
+	return started
+}
+
+func (rp *replicator) canStart(dataNodes ...*DataNode) bool {
+	rackDelta := make(map[Node]int)
+	for _, dn := range dataNodes {
+		if rp.maxPerDataNode > 0 && rp.dataNodeCounter[dn] >= rp.maxPerDataNode {
+			return false
+		}
+		rackDelta[dn.Parent()]++
+	}
+	if rp.maxPerRack > 0 {
+		for rack, delta := range rackDelta {
+			if rp.rackCounter[rack]+delta > rp.maxPerRack {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (rp *replicator) adjustCounters(source, target *DataNode, delta int) {
+	for _, dn := range []*DataNode{source, target} {
+		rp.dataNodeCounter[dn] += delta
+		rp.rackCounter[dn.Parent()] += delta
+	}
+}
+
+// replicateOneVolume pins the volume on the source with a snapshot, so its files
+// only grow, has the target copy it, and registers the new replica.
+func (t *Topology) replicateOneVolume(task *ReplicationTask, source, target *DataNode) {
+	snapshot := "replicate-" + task.VolumeId.String()
+	_, err := snapshotOnDataNode(source.AdminUrl(), snapshot, []string{task.VolumeId.String()}, replicateVolumeTimeout)
+	if err == nil {
+		err = replicateVolumeOnDataNode(target.AdminUrl(), task.VolumeId, task.Collection, source.AdminUrl())
+		if e := releaseSnapshotOnDataNode(source.AdminUrl(), snapshot); e != nil {
+			t.recordEvent("Failed to release the pin of volume", task.VolumeId, "on", source.Url(), ":", e)
+		}
+	}
+	if err == nil {
+		if v, ok := source.volumes[task.VolumeId]; ok {
+			target.AddOrUpdateVolume(v)
+			t.RegisterVolumeLayout(&v, target)
+			t.locationsChanged()
+		}
+	}
+
+	rp := t.replicator
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	rp.adjustCounters(source, target, -1)
+	task.EndedAt = time.Now().Unix()
+	if err != nil {
+		task.Error = err.Error()
+		failure := rp.failures[task.VolumeId]
+		if failure == nil {
+			failure = &replicationFailure{}
+			rp.failures[task.VolumeId] = failure
+		}
+		failure.count++
+		backoff := time.Duration(t.pulse) * time.Second << uint(failure.count-1)
+		if backoff > maxReplicationBackoff || backoff <= 0 {
+			backoff = maxReplicationBackoff
+		}
+		failure.next = time.Now().Add(backoff)
+		t.recordEvent("Failed to replicate volume", task.VolumeId, "from", task.From, "to", task.To, ":", err, ", retrying in", backoff)
+	} else {
+		delete(rp.failures, task.VolumeId)
+		t.recordEvent("Replicated volume", task.VolumeId, "from", task.From, "to", task.To)
+	}
+	delete(rp.running, task.VolumeId)
+	rp.finished = append([]*ReplicationTask{task}, rp.finished...)
+	if len(rp.finished) > MaxFinishedReplicationTasks {
+		rp.finished = rp.finished[:MaxFinishedReplicationTasks]
+	}
+}
+
+type replicateVolumeResult struct {
+	Error string
+}
+
+func replicateVolumeOnDataNode(server string, vid storage.VolumeId, collection string, source string) error {
+	values := make(url.Values)
+	values.Add("volume", vid.String())
+	values.Add("collection", collection)
+	values.Add("source", source)
+	ctx, cancel := context.WithTimeout(context.Background(), replicateVolumeTimeout)
+	defer cancel()
+	jsonBlob, err := util.PostContext(ctx, "http://"+server+"/admin/replicate_volume", values)
+	if err != nil {
+		return err
+	}
+	var ret replicateVolumeResult
+	if err := json.Unmarshal(jsonBlob, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	return nil
+}
+
+// MissingReplica is a volume missing replicas, and when it is copied next.
+type MissingReplica struct {
+	VolumeId     storage.VolumeId
+	MissingSince int64
+	Failures     int   `json:",omitempty"`
+	NextTry      int64 `json:",omitempty"` // unix time, after a failure
+}
+
+// ToReplicationMap lists the settings, the volumes missing replicas, and the
+// running and finished copies. It is nil if the re-replication is not started.
+func (t *Topology) ToReplicationMap() map[string]interface{} {
+	rp := t.replicator
+	if rp == nil {
+		return nil
+	}
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	missing := []*MissingReplica{}
+	for vid, since := range rp.missingSince {
+		m := &MissingReplica{VolumeId: vid, MissingSince: since.Unix()}
+		if failure := rp.failures[vid]; failure != nil {
+			m.Failures, m.NextTry = failure.count, failure.next.Unix()
+		}
+		missing = append(missing, m)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].VolumeId < missing[j].VolumeId })
+	running := []*ReplicationTask{}
+	for _, task := range rp.running {
+		running = append(running, task)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].VolumeId < running[j].VolumeId })
+	return map[string]interface{}{
+		"DelaySeconds":   int64(rp.delay / time.Second),
+		"Window":         rp.window.String(),
+		"InWindow":       rp.window.Contains(time.Now()),
+		"MaxPerDataNode": rp.maxPerDataNode,
+		"MaxPerRack":     rp.maxPerRack,
+		"Missing":        missing,
+		"Running":        running,
+		"Finished":       rp.finished,
+	}
+}
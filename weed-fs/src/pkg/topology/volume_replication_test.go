@@ -0,0 +1,130 @@
+package topology
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"pkg/storage"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseDailyWindow(t *testing.T) {
+	w, err := ParseDailyWindow("22:30-04:00")
+	if err != nil || w.String() != "22:30-04:00" {
+		t.Fatal(w, err)
+	}
+	for hm, expected := range map[string]bool{"22:29": false, "22:30": true, "00:00": true, "03:59": true, "04:00": false, "12:00": false} {
+		now, _ := time.Parse("15:04", hm)
+		if w.Contains(now) != expected {
+			t.Error(hm, "in", w, "is not", expected)
+		}
+	}
+	if w, err = ParseDailyWindow(""); w != nil || err != nil || !w.Contains(time.Now()) {
+		t.Error("an empty window is any time", w, err)
+	}
+	for _, invalid := range []string{"01:00", "1-5", "01:00-25:00", "01:60-02:00", "03:00-03:00"} {
+		if _, err := ParseDailyWindow(invalid); err == nil {
+			t.Error("accepted", invalid)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	var lock sync.Mutex
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls = append(calls, r.URL.Path+"?volume="+r.FormValue("volume")+r.FormValue("volumes"))
+		lock.Unlock()
+		if r.URL.Path == "/admin/replicate_volume" && r.FormValue("volume") == "4" {
+			w.Write([]byte(`{"error":"disk full"}`))
+			return
+		}
+		w.Write([]byte(`{"error":""}`))
+	}))
+	defer server.Close()
+	port, _ := strconv.Atoi(server.URL[strings.LastIndex(server.URL, ":")+1:])
+	waitForCopies := func(topo *Topology) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if len(topo.ToReplicationMap()["Running"].([]*ReplicationTask)) == 0 {
+				return
+			}
+		}
+		t.Fatal("the copies did not finish")
+	}
+
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	window, _ := ParseDailyWindow("01:00-05:00")
+	topo.StartReplication(10*time.Minute, window, 1, 0, time.Hour)
+	volumes := []storage.VolumeInfo{
+		{Id: 3, Size: 100, RepType: storage.Copy001, Version: storage.CurrentVersion},
+		{Id: 4, Size: 100, RepType: storage.Copy001, Version: storage.CurrentVersion},
+		{Id: 5, Size: 100, RepType: storage.Copy000, Version: storage.CurrentVersion},
+	}
+	topo.RegisterVolumes(volumes, "127.0.0.1", port, "", 5, "hdd", nil)
+	target, _ := topo.RegisterVolumes(nil, "localhost", port, "", 5, "hdd", nil)
+
+	night := time.Date(2026, 10, 16, 2, 0, 0, 0, time.Local)
+	if started := topo.checkReplication(night); len(started) != 0 {
+		t.Fatal("copied a replica missing for less than the delay", started)
+	}
+	if started := topo.checkReplication(night.Add(4 * time.Hour)); len(started) != 0 {
+		t.Fatal("copied a replica out of the window", started)
+	}
+	// one copy at a time on the volume servers
+	started := topo.checkReplication(night.Add(24 * time.Hour))
+	if len(started) != 1 || started[0].VolumeId != 3 || started[0].To != target.Url() {
+		t.Fatal("unexpected copies", started)
+	}
+	waitForCopies(topo)
+	if locations := topo.Lookup(3); len(*locations) != 2 || target.FreeSpace() != 4 {
+		t.Fatal("the copy should be registered as a replica", *locations)
+	}
+	expected := []string{"/admin/snapshot?volume=3", "/admin/replicate_volume?volume=3", "/admin/snapshot/release?volume="}
+	if strings.Join(calls, " ") != strings.Join(expected, " ") {
+		t.Fatal("unexpected calls", calls)
+	}
+
+	// volume 4 fails, and waits a pulse before it is tried again
+	if started = topo.checkReplication(night.Add(24 * time.Hour)); len(started) != 1 || started[0].VolumeId != 4 {
+		t.Fatal("unexpected copies", started)
+	}
+	waitForCopies(topo)
+	status := topo.ToReplicationMap()
+	missing := status["Missing"].([]*MissingReplica)
+	if len(missing) != 1 || missing[0].VolumeId != 4 || missing[0].Failures != 1 {
+		t.Fatal("unexpected missing replicas", missing)
+	}
+	if finished := status["Finished"].([]*ReplicationTask); len(finished) != 2 || finished[0].Error != "disk full" {
+		t.Fatal("unexpected finished copies", finished)
+	}
+	if started = topo.checkReplication(time.Now()); len(started) != 0 {
+		t.Fatal("retried a failed copy before its backoff", started)
+	}
+}
+
+func TestReplicationCheckBesideHeartbeats(t *testing.T) {
+	topo := NewTopology("mynetwork", "/etc/weed.conf", "/tmp", "test", 1000, 5)
+	window, _ := ParseDailyWindow("")
+	topo.StartReplication(time.Hour, window, 1, 0, time.Hour)
+	volumes := []storage.VolumeInfo{{Id: 3, Size: 100, RepType: storage.Copy001, Version: storage.CurrentVersion}}
+	dn, _ := topo.RegisterVolumes(volumes, "127.0.0.1", 8080, "", 5, "hdd", nil)
+	vl := topo.GetVolumeLayout("", storage.Copy001)
+
+	// run with -race
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			vl.SetVolumeUnavailable(dn, 3)
+			vl.SetVolumeAvailable(dn, 3)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		topo.checkReplication(time.Now())
+	}
+	<-done
+}
@@ -0,0 +1,148 @@
+package topology
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"pkg/storage"
+	"pkg/util"
+)
+
+// findVolumeLayout finds the layout holding the volume, and its locations.
+func (t *Topology) findVolumeLayout(vid storage.VolumeId) (*VolumeLayout, *VolumeLocationList) {
+	for _, vl := range t.volumeLayouts() {
+		if locationList := vl.vid2location[vid]; locationList != nil && locationList.Length() > 0 {
+			return vl, locationList
+		}
+	}
+	return nil, nil
+}
+
+// SetVolumeState seals or unseals the volume on all its replicas. The master's
+// view of the volume is updated at once, without waiting for the heartbeats.
+func (t *Topology) SetVolumeState(vid storage.VolumeId, state storage.VolumeState) error {
+	vl, locationList := t.findVolumeLayout(vid)
+	if vl == nil {
+		return errors.New("Volume " + vid.String() + " is not found!")
+	}
+	dataNodes := make([]*DataNode, locationList.Length())
+	copy(dataNodes, locationList.list)
+	if state == storage.VolumeGrowing {
+		for _, dn := range dataNodes {
+			if v, ok := dn.volumes[vid]; ok && vl.isOverLimit(&v) {
+				return errors.New("Volume " + vid.String() + " is over the size or file count limit")
+			}
+		}
+		// the mirrors of a hot volume are beyond its replication, and go before it takes writes again
+		if err := t.retireMirrors(vid); err != nil {
+			return err
+		}
+		dataNodes = append(dataNodes[:0], locationList.list...)
+	}
+	err := setVolumeStateOnDataNodes(dataNodes, vid, state)
+	if err != nil {
+		return err
+	}
+	for _, dn := range dataNodes {
+		if v, ok := dn.volumes[vid]; ok {
+			v.State = state
+			dn.volumes[vid] = v
+		}
+	}
+	if state.IsWritable() {
+		t.setVolumeWritableIfReady(vl, vid)
+	} else if v, ok := dataNodes[0].volumes[vid]; ok {
+		t.SetVolumeCapacityFull(&v)
+	}
+	t.recordEvent("Volume", vid, "is", string(state))
+	return nil
+}
+
+// setVolumeWritableIfReady puts the volume back among the writable volumes, when
+// all its replicas are growing again, e.g. after being unsealed or compacted.
+func (t *Topology) setVolumeWritableIfReady(vl *VolumeLayout, vid storage.VolumeId) bool {
+	vs := t.vacuumScheduler
+	vs.lock.Lock()
+	queued := vs.isQueued(vid)
+	vs.lock.Unlock()
+	if queued {
+		return false
+	}
+	locationList := vl.vid2location[vid]
+	if locationList == nil || locationList.Length() < vl.repType.GetCopyCount() || vl.isVolumeFull(vid) {
+		return false
+	}
+	return vl.setVolumeWritable(vid)
+}
+
+// sealFullVolume seals the volume that reached the size or file count limit.
+// It is marked sealed in the master's view right away, and the next heartbeats
+// bring it back to growing if the volume servers failed to seal it, so it is
+// tried again.
+func (t *Topology) sealFullVolume(v *storage.VolumeInfo) {
+	vl, locationList := t.findVolumeLayout(v.Id)
+	if vl == nil {
+		return
+	}
+	dataNodes := make([]*DataNode, locationList.Length())
+	copy(dataNodes, locationList.list)
+	for _, dn := range dataNodes {
+		if dv, ok := dn.volumes[v.Id]; ok {
+			dv.State = storage.VolumeSealed
+			dn.volumes[v.Id] = dv
+		}
+	}
+	t.SetVolumeCapacityFull(v)
+	t.recordEvent("Volume", v.Id, "is full, sealing it")
+	go func() {
+		if err := setVolumeStateOnDataNodes(dataNodes, v.Id, storage.VolumeSealed); err != nil {
+			t.recordEvent("Failed to seal volume", v.Id, err.Error())
+		}
+	}()
+}
+
+func setVolumeStateOnDataNodes(dataNodes []*DataNode, vid storage.VolumeId, state storage.VolumeState) error {
+	errs := make(chan error, len(dataNodes))
+	for _, dn := range dataNodes {
+		go func(dn *DataNode) {
+			if err := setVolumeStateOnDataNode(dn.AdminUrl(), vid, state); err != nil {
+				errs <- errors.New(dn.Url() + ": " + err.Error())
+			} else {
+				errs <- nil
+			}
+		}(dn)
+	}
+	var failures []string
+	for i := 0; i < len(dataNodes); i++ {
+		if err := <-errs; err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(fmt.Sprint(failures))
+	}
+	return nil
+}
+
+type setVolumeStateResult struct {
+	Error string
+}
+
+func setVolumeStateOnDataNode(server string, vid storage.VolumeId, state storage.VolumeState) error {
+	values := make(url.Values)
+	values.Add("volume", vid.String())
+	values.Add("state", string(state))
+	jsonBlob, err := util.Post("http://"+server+"/admin/set_volume_state", values)
+	if err != nil {
+		return err
+	}
+	var ret setVolumeStateResult
+	if err := json.Unmarshal(jsonBlob, &ret); err != nil {
+		return err
+	}
+	if ret.Error != "" {
+		return errors.New(ret.Error)
+	}
+	return nil
+}
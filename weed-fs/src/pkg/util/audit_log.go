@@ -0,0 +1,76 @@
+package util
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one admin operation: who asked for it, with which
+// parameters, and the http status it was answered with.
+type AuditEntry struct {
+	Time       time.Time
+	Principal  string            // the basic auth user, else the remote address
+	RemoteAddr string            `json:",omitempty"`
+	Operation  string            // the admin path, e.g. /col/delete
+	Params     map[string]string `json:",omitempty"`
+	Status     int
+}
+
+// AuditLog appends the admin operations to a file, one json entry per line,
+// synced to the disk before the next one. The file is only ever appended to.
+type AuditLog struct {
+	path string
+	file *os.File
+	lock sync.Mutex
+}
+
+func NewAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, file: file}, nil
+}
+
+func (l *AuditLog) Record(entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err = l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return Fsync(l.file)
+}
+
+// Entries reads the last limit entries recorded since the time, oldest first.
+func (l *AuditLog) Entries(since time.Time, limit int) ([]*AuditEntry, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := new(AuditEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil || entry.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, entry)
+		if limit > 0 && len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (l *AuditLog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weedfs_audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := NewAuditLog(path.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for _, operation := range []string{"/vol/grow", "/col/delete", "/vol/vacuum"} {
+		l.Record(&AuditEntry{Time: start, Principal: "admin", Operation: operation, Params: map[string]string{"collection": "photos"}, Status: 200})
+	}
+	l.Record(&AuditEntry{Time: start.Add(-time.Hour), Principal: "admin", Operation: "/seq/bump"})
+	l.Close()
+
+	// reopened, the file is appended to
+	if l, err = NewAuditLog(path.Join(dir, "audit.log")); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Record(&AuditEntry{Time: start, Principal: "10.0.0.3", Operation: "/admin/delete_volume"})
+
+	entries, err := l.Entries(start.Add(-time.Minute), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Operation != "/col/delete" || entries[2].Operation != "/admin/delete_volume" {
+		t.Fatal("expecting the last 3 entries since the start, got", entries)
+	}
+	if entries[0].Params["collection"] != "photos" || entries[0].Status != 200 {
+		t.Fatal("unexpected entry", entries[0])
+	}
+	if entries, _ = l.Entries(time.Time{}, 0); len(entries) != 5 {
+		t.Fatal("expecting all 5 entries, got", len(entries))
+	}
+}
@@ -0,0 +1,151 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The requests to S3 are signed with the AWS Signature Version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	AwsV4Algorithm   = "AWS4-HMAC-SHA256"
+	AwsV4TimeFormat  = "20060102T150405Z"
+	UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// SignAwsV4 signs the request for the service, e.g. s3, in the region, with its
+// host and its X-Amz-* headers, and with the payload hash of its
+// X-Amz-Content-Sha256 header, set to UNSIGNED-PAYLOAD if missing.
+func SignAwsV4(r *http.Request, accessKey string, secretKey string, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format(AwsV4TimeFormat)
+	r.Header.Set("X-Amz-Date", amzDate)
+	if r.Header.Get("X-Amz-Content-Sha256") == "" {
+		r.Header.Set("X-Amz-Content-Sha256", UnsignedPayload)
+	}
+	signedHeaders := []string{"host"}
+	for name := range r.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			signedHeaders = append(signedHeaders, name)
+		}
+	}
+	sort.Strings(signedHeaders)
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	signature := AwsV4Signature(r, signedHeaders, r.Header.Get("X-Amz-Content-Sha256"), secretKey, amzDate, region, service)
+	r.Header.Set("Authorization", AwsV4Algorithm+" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+", Signature="+signature)
+}
+
+// AwsV4Signature is the signature of the request, with the signed headers,
+// lower case and sorted, and the payload hash, at the X-Amz-Date amzDate.
+func AwsV4Signature(r *http.Request, signedHeaders []string, payloadHash string, secretKey string, amzDate string, region string, service string) string {
+	var canonical strings.Builder
+	canonical.WriteString(r.Method + "\n")
+	canonical.WriteString(awsUriEncode(r.URL.Path, false) + "\n")
+	canonical.WriteString(awsCanonicalQuery(r) + "\n")
+	for _, name := range signedHeaders {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			if value = r.Host; value == "" {
+				value = r.URL.Host
+			}
+		}
+		canonical.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	canonical.WriteString("\n" + strings.Join(signedHeaders, ";") + "\n" + payloadHash)
+
+	if len(amzDate) < 8 {
+		return ""
+	}
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := AwsV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonical.String())
+	return hex.EncodeToString(hmacSha256(AwsV4SigningKey(secretKey, amzDate[:8], region, service), stringToSign))
+}
+
+// AwsV4SigningKey is the key derived from the secret key for the day, e.g.
+// 20130524, the region and the service.
+func AwsV4SigningKey(secretKey string, day string, region string, service string) []byte {
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	return key
+}
+
+// AwsV4ChunkSignature is the signature of a chunk of a STREAMING-AWS4-HMAC-SHA256-PAYLOAD
+// body, chained to the signature of the previous chunk, or of the request for the
+// first one, the last chunk being empty.
+func AwsV4ChunkSignature(signingKey []byte, amzDate string, scope string, previous string, chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	stringToSign := AwsV4Algorithm + "-PAYLOAD\n" + amzDate + "\n" + scope + "\n" + previous + "\n" +
+		EmptyPayloadHash + "\n" + hex.EncodeToString(sum[:])
+	return hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+}
+
+// PresignAwsV4 signs the url of the request in its query, for its host only
+// and an unsigned payload, valid for expires from now.
+func PresignAwsV4(r *http.Request, accessKey string, secretKey string, region string, service string, now time.Time, expires time.Duration) {
+	amzDate := now.UTC().Format(AwsV4TimeFormat)
+	query := r.URL.Query()
+	query.Set("X-Amz-Algorithm", AwsV4Algorithm)
+	query.Set("X-Amz-Credential", accessKey+"/"+amzDate[:8]+"/"+region+"/"+service+"/aws4_request")
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	r.URL.RawQuery = query.Encode()
+	signature := AwsV4Signature(r, []string{"host"}, UnsignedPayload, secretKey, amzDate, region, service)
+	r.URL.RawQuery += "&X-Amz-Signature=" + signature
+}
+
+// awsCanonicalQuery is the query, but for a presigned url's X-Amz-Signature,
+// sorted by names and values, each encoded.
+func awsCanonicalQuery(r *http.Request) string {
+	var pairs []string
+	for name, values := range r.URL.Query() {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, awsUriEncode(name, true)+"="+awsUriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsUriEncode escapes every byte but the unreserved characters, and "/"
+// unless encodeSlash.
+func awsUriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var encoded strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			encoded.WriteByte(c)
+		} else {
+			encoded.WriteByte('%')
+			encoded.WriteByte(hexDigits[c>>4])
+			encoded.WriteByte(hexDigits[c&15])
+		}
+	}
+	return encoded.String()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
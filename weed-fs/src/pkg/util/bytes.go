@@ -28,4 +28,10 @@ func Uint32toBytes(b []byte, v uint32){
     b[3-i] = byte(v>>(i*8))
   }
 }
-
+func BytesToUint16(b []byte)(v uint16){
+  return uint16(b[0])<<8 | uint16(b[1])
+}
+func Uint16toBytes(b []byte, v uint16){
+  b[0] = byte(v>>8)
+  b[1] = byte(v)
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type peerCircuit struct {
+	failures int // in a row
+	open     bool
+	openedAt time.Time
+	lastErr  string
+}
+
+// CircuitBreaker counts the failed calls to each peer. After the given number
+// of failures in a row, the circuit of the peer opens: Allow returns false, so
+// callers skip the peer instead of waiting on it, and the peer is probed in the
+// background every probe interval until the probe succeeds, which closes it.
+type CircuitBreaker struct {
+	failures      int
+	probeInterval time.Duration
+	probe         func(peer string) error
+	peers         map[string]*peerCircuit
+	lock          sync.Mutex
+}
+
+// NewCircuitBreaker returns a breaker opening after the failures in a row. 0 failures disables it.
+func NewCircuitBreaker(failures int, probeInterval time.Duration, probe func(peer string) error) *CircuitBreaker {
+	return &CircuitBreaker{failures: failures, probeInterval: probeInterval, probe: probe, peers: make(map[string]*peerCircuit)}
+}
+
+// Allow tells if calls to the peer should be made, i.e. its circuit is not open.
+func (cb *CircuitBreaker) Allow(peer string) bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	c, ok := cb.peers[peer]
+	return !ok || !c.open
+}
+
+// Record counts the result of a call to the peer.
+func (cb *CircuitBreaker) Record(peer string, err error) {
+	if cb.failures <= 0 {
+		return
+	}
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	c, ok := cb.peers[peer]
+	if !ok {
+		c = &peerCircuit{}
+		cb.peers[peer] = c
+	}
+	if err == nil {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	c.lastErr = err.Error()
+	if c.failures >= cb.failures && !c.open {
+		log.Println("Circuit to", peer, "opens after", c.failures, "failures in a row:", err)
+		c.open, c.openedAt = true, time.Now()
+		go cb.probeUntilHealthy(peer)
+	}
+}
+
+func (cb *CircuitBreaker) probeUntilHealthy(peer string) {
+	for {
+		time.Sleep(cb.probeInterval)
+		if err := cb.probe(peer); err == nil {
+			break
+		}
+	}
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	c := cb.peers[peer]
+	log.Println("Circuit to", peer, "closes after", time.Since(c.openedAt))
+	c.open, c.failures = false, 0
+}
+
+// ToMap lists the peers with open circuits, since when, and their last error.
+func (cb *CircuitBreaker) ToMap() map[string]interface{} {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	open := make(map[string]interface{})
+	for peer, c := range cb.peers {
+		if c.open {
+			open[peer] = map[string]interface{}{"OpenedAt": c.openedAt, "LastError": c.lastErr}
+		}
+	}
+	return map[string]interface{}{"FailuresToOpen": cb.failures, "Open": open}
+}
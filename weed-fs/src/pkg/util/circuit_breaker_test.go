@@ -0,0 +1,57 @@
+package util
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAndCloses(t *testing.T) {
+	var healthy int32
+	cb := NewCircuitBreaker(3, 10*time.Millisecond, func(peer string) error {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return errors.New("still down")
+		}
+		return nil
+	})
+	failure := errors.New("connection refused")
+
+	cb.Record("a:8080", failure)
+	cb.Record("a:8080", failure)
+	cb.Record("a:8080", nil)
+	cb.Record("a:8080", failure)
+	cb.Record("a:8080", failure)
+	if !cb.Allow("a:8080") {
+		t.Fatal("a success in between should keep the circuit closed")
+	}
+	cb.Record("a:8080", failure)
+	if cb.Allow("a:8080") {
+		t.Fatal("the circuit should open after 3 failures in a row")
+	}
+	if !cb.Allow("b:8080") {
+		t.Fatal("other peers should not be affected")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if cb.Allow("a:8080") {
+		t.Fatal("the circuit should stay open while the probes fail")
+	}
+	atomic.StoreInt32(&healthy, 1)
+	for i := 0; i < 100 && !cb.Allow("a:8080"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !cb.Allow("a:8080") {
+		t.Fatal("the circuit should close after a successful probe")
+	}
+}
+
+func TestDisabledCircuitBreaker(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Second, nil)
+	for i := 0; i < 10; i++ {
+		cb.Record("a:8080", errors.New("connection refused"))
+	}
+	if !cb.Allow("a:8080") {
+		t.Fatal("a disabled breaker should always allow")
+	}
+}
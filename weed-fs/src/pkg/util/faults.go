@@ -0,0 +1,107 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults injected on purpose, to test the replication and the repair of a
+// cluster end to end. They are set with the -faults flag of the servers, as
+// comma separated name=value pairs, e.g.
+//
+//	-faults=heartbeat.drop=0.5,replicate.delay=2s,needle.crc=0.01,fsync.fail=1
+//
+// The values are the probability of each fault, from 0 to 1, except for
+// replicate.delay, which is how long each replicated write waits.
+const (
+	FaultDropHeartbeat    = "heartbeat.drop"  // the volume server skips a heartbeat to the master
+	FaultDelayReplication = "replicate.delay" // a write waits before it is sent to a replica
+	FaultCorruptCrc       = "needle.crc"      // a needle is written with a wrong CRC
+	FaultFailFsync        = "fsync.fail"      // an fsync of the intent log, the filer log, a volume or a sequence fails
+)
+
+var ErrInjectedFault = errors.New("Injected fault")
+
+var (
+	faults     = make(map[string]float64)
+	faultDelay time.Duration
+	faultsLock sync.RWMutex
+)
+
+// SetFaults replaces the injected faults with the ones of the spec.
+func SetFaults(spec string) error {
+	parsed, delay := make(map[string]float64), time.Duration(0)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return errors.New("Invalid fault \"" + pair + "\", expecting name=value")
+		}
+		name, value := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		switch name {
+		case FaultDelayReplication:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return errors.New("Invalid fault \"" + pair + "\": " + err.Error())
+			}
+			delay = d
+		case FaultDropHeartbeat, FaultCorruptCrc, FaultFailFsync:
+			p, err := strconv.ParseFloat(value, 64)
+			if err != nil || p < 0 || p > 1 {
+				return errors.New("Invalid fault \"" + pair + "\", expecting a probability from 0 to 1")
+			}
+			parsed[name] = p
+		default:
+			return errors.New("Unknown fault " + name)
+		}
+	}
+	faultsLock.Lock()
+	faults, faultDelay = parsed, delay
+	faultsLock.Unlock()
+	if len(parsed) > 0 || delay > 0 {
+		log.Println("WARNING: injecting faults", spec)
+	}
+	return nil
+}
+
+// Fault tells if the fault happens this time.
+func Fault(name string) bool {
+	faultsLock.RLock()
+	p := faults[name]
+	faultsLock.RUnlock()
+	return p > 0 && rand.Float64() < p
+}
+
+// FaultDelay waits for the replication delay, if any, or until ctx is done.
+func FaultDelay(ctx context.Context) error {
+	faultsLock.RLock()
+	delay := faultDelay
+	faultsLock.RUnlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Fsync syncs the file, unless an fsync failure is injected.
+func Fsync(f interface{ Sync() error }) error {
+	if Fault(FaultFailFsync) {
+		return ErrInjectedFault
+	}
+	return f.Sync()
+}
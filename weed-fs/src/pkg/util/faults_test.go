@@ -0,0 +1,53 @@
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSetFaults(t *testing.T) {
+	defer SetFaults("")
+	if err := SetFaults("heartbeat.drop=1, replicate.delay=10ms,fsync.fail=0"); err != nil {
+		t.Fatal(err)
+	}
+	if !Fault(FaultDropHeartbeat) {
+		t.Fatal("heartbeat.drop=1 should always drop")
+	}
+	if Fault(FaultFailFsync) || Fault(FaultCorruptCrc) {
+		t.Fatal("faults with no probability should never happen")
+	}
+	start := time.Now()
+	if err := FaultDelay(context.Background()); err != nil || time.Since(start) < 10*time.Millisecond {
+		t.Fatal("replicate.delay=10ms should wait", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := FaultDelay(ctx); err != context.Canceled {
+		t.Fatal("the delay should stop with the context", err)
+	}
+	for _, spec := range []string{"heartbeat.drop", "heartbeat.drop=2", "replicate.delay=soon", "disk.melt=1"} {
+		if SetFaults(spec) == nil {
+			t.Fatal("expecting an error for", spec)
+		}
+	}
+}
+
+func TestFsyncFault(t *testing.T) {
+	defer SetFaults("")
+	f, err := ioutil.TempFile("", "fsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err = Fsync(f); err != nil {
+		t.Fatal(err)
+	}
+	SetFaults("fsync.fail=1")
+	if err = Fsync(f); err != ErrInjectedFault {
+		t.Fatal("expecting the injected fsync failure, got", err)
+	}
+}
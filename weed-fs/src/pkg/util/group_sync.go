@@ -0,0 +1,67 @@
+package util
+
+import (
+	"os"
+	"sync"
+)
+
+// GroupSync syncs a log file for its writers as a group commit: a writer takes
+// a ticket once its write is in the file, and waits for a sync started after
+// it, so one sync covers all the writes before it, however many writers wait.
+type GroupSync struct {
+	file    *os.File
+	lock    sync.Mutex
+	synced  *sync.Cond
+	written uint64 // the last ticket
+	durable uint64 // the last ticket synced to the disk
+	syncing bool
+}
+
+func NewGroupSync(file *os.File) *GroupSync {
+	g := &GroupSync{file: file}
+	g.synced = sync.NewCond(&g.lock)
+	return g
+}
+
+// Written returns the ticket of the writes to the file so far, to Wait for.
+func (g *GroupSync) Written() uint64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.written++
+	return g.written
+}
+
+// Wait returns once the writes of the ticket are synced to the disk.
+func (g *GroupSync) Wait(ticket uint64) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for g.durable < ticket {
+		if g.syncing {
+			g.synced.Wait()
+			continue
+		}
+		g.syncing = true
+		file, last := g.file, g.written
+		g.lock.Unlock()
+		err := Fsync(file)
+		g.lock.Lock()
+		g.syncing = false
+		if err == nil && last > g.durable {
+			g.durable = last
+		}
+		g.synced.Broadcast()
+		if err != nil && g.durable < ticket {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset continues on the file, with all the writes so far already synced to
+// it, e.g. once the log is rewritten as a new file.
+func (g *GroupSync) Reset(file *os.File) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.file, g.durable = file, g.written
+	g.synced.Broadcast()
+}
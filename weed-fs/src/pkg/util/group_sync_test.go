@@ -0,0 +1,52 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestGroupSync(t *testing.T) {
+	f, err := ioutil.TempFile("", "group_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	g := NewGroupSync(f)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock.Lock()
+			f.WriteString("record\n")
+			ticket := g.Written()
+			lock.Unlock()
+			if err := g.Wait(ticket); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if g.durable != 50 {
+		t.Fatal("synced up to", g.durable, "instead of 50")
+	}
+
+	defer SetFaults("")
+	SetFaults(FaultFailFsync + "=1")
+	ticket := g.Written()
+	if err := g.Wait(ticket); err != ErrInjectedFault {
+		t.Fatal("expecting the fsync failure, got", err)
+	}
+	SetFaults("")
+	if err := g.Wait(ticket); err != nil {
+		t.Fatal(err)
+	}
+	g.Reset(f)
+	if err := g.Wait(g.Written() - 1); err != nil {
+		t.Fatal(err)
+	}
+}
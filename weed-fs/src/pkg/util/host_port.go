@@ -0,0 +1,33 @@
+package util
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// CanonicalHost returns the ip of the host in its canonical form, e.g. 2001:db8::1
+// for [2001:DB8:0::1] and 10.0.0.1 for ::ffff:10.0.0.1, so each ip is written
+// one way in the urls and the lookups, or the host name as it is.
+func CanonicalHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// JoinHostPort joins the host and the port, bracketing an IPv6 host, e.g.
+// [2001:db8::1]:8080.
+func JoinHostPort(host string, port int) string {
+	return net.JoinHostPort(CanonicalHost(host), strconv.Itoa(port))
+}
+
+// RemoteIp returns the canonical ip of the remote address of a request, e.g.
+// 2001:db8::1 for [2001:db8::1]:52314.
+func RemoteIp(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return CanonicalHost(host)
+	}
+	return CanonicalHost(remoteAddr)
+}
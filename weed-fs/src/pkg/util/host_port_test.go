@@ -0,0 +1,35 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestHostPort(t *testing.T) {
+	hosts := map[string]string{
+		"10.0.0.1":         "10.0.0.1",
+		"::ffff:10.0.0.1":  "10.0.0.1",
+		"[2001:DB8:0::1]":  "2001:db8::1",
+		"2001:db8:0:0::1":  "2001:db8::1",
+		"volume1.internal": "volume1.internal",
+	}
+	for host, expected := range hosts {
+		if canonical := CanonicalHost(host); canonical != expected {
+			t.Errorf("CanonicalHost(%q) = %q, expecting %q", host, canonical, expected)
+		}
+	}
+	if url := JoinHostPort("2001:db8::1", 8080); url != "[2001:db8::1]:8080" {
+		t.Error("unexpected url", url)
+	}
+	if url := JoinHostPort("[2001:db8::1]", 8080); url != "[2001:db8::1]:8080" {
+		t.Error("unexpected url of a bracketed ip", url)
+	}
+	if url := JoinHostPort("localhost", 8080); url != "localhost:8080" {
+		t.Error("unexpected url of a host name", url)
+	}
+	if ip := RemoteIp("[2001:db8:0::1]:52314"); ip != "2001:db8::1" {
+		t.Error("unexpected ip", ip)
+	}
+	if ip := RemoteIp("10.0.0.3:52314"); ip != "10.0.0.3" {
+		t.Error("unexpected ip", ip)
+	}
+}
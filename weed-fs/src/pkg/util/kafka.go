@@ -0,0 +1,356 @@
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// KafkaProducer sends records to the partitions of one Kafka topic, speaking
+// the Kafka protocol to the leaders of the partitions, each found in the
+// metadata of the brokers. A record goes to the partition of the hash of its
+// key, so the records of one key stay in order.
+type KafkaProducer struct {
+	brokers []string // host:port of the brokers asked for the metadata
+	topic   string
+	acks    int16 // -1 for all the in sync replicas, 1 for the leader only, 0 for none
+	timeout time.Duration
+
+	lock        sync.Mutex
+	partitions  []int32          // of the topic with a leader, nil until the metadata is read
+	leaders     map[int32]string // partition => host:port of its leader
+	conns       map[string]*kafkaConn
+	correlation int32
+}
+
+type kafkaConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+const (
+	kafkaProduceKey  = 0
+	kafkaMetadataKey = 3
+	kafkaClientId    = "weed"
+)
+
+// KafkaError is an error code answered by a broker.
+type KafkaError int16
+
+var kafkaErrorNames = map[KafkaError]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+}
+
+func (e KafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e]; ok {
+		return "kafka: " + name
+	}
+	return "kafka: error code " + strconv.Itoa(int(e))
+}
+
+// NewKafkaProducer takes the host:port of some brokers of the cluster, and the
+// acks a record waits for.
+func NewKafkaProducer(brokers []string, topic string, acks int16) *KafkaProducer {
+	return &KafkaProducer{brokers: brokers, topic: topic, acks: acks, timeout: 10 * time.Second, conns: make(map[string]*kafkaConn)}
+}
+
+// Produce sends the record, and waits for its acks. The metadata is read again
+// after a failure, e.g. once the leader of the partition moved, for the next
+// record or the retry of this one.
+func (p *KafkaProducer) Produce(key []byte, value []byte, timestamp time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.partitions == nil {
+		if err := p.readMetadata(); err != nil {
+			return err
+		}
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	partition := p.partitions[h.Sum32()%uint32(len(p.partitions))]
+	leader := p.leaders[partition]
+
+	var b kafkaBuffer
+	b.putInt16(-1) // no transactional id
+	b.putInt16(p.acks)
+	b.putInt32(int32(p.timeout / time.Millisecond))
+	b.putInt32(1)
+	b.putString(p.topic)
+	b.putInt32(1)
+	b.putInt32(partition)
+	batch := kafkaRecordBatch(key, value, timestamp)
+	b.putInt32(int32(len(batch)))
+	b.buf = append(b.buf, batch...)
+	resp, err := p.roundTrip(leader, kafkaProduceKey, 3, b.buf, p.acks != 0)
+	if err != nil || p.acks == 0 {
+		return err
+	}
+	r := &kafkaReader{buf: resp}
+	for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+		r.string()
+		for partitions := r.int32(); partitions > 0 && r.err == nil; partitions-- {
+			r.int32()
+			if code := r.int16(); code != 0 && r.err == nil {
+				p.partitions = nil
+				return KafkaError(code)
+			}
+			r.int64() // the offset
+			r.int64() // the log append time
+		}
+	}
+	return r.err
+}
+
+// Close closes the connections to the brokers, which are opened again by the next record.
+func (p *KafkaProducer) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for address, c := range p.conns {
+		c.conn.Close()
+		delete(p.conns, address)
+	}
+}
+
+// readMetadata finds the leaders of the partitions of the topic, asking the
+// brokers in turn, and creates the topic if the brokers create topics on use.
+func (p *KafkaProducer) readMetadata() error {
+	var b kafkaBuffer
+	b.putInt32(1)
+	b.putString(p.topic)
+	b.buf = append(b.buf, 1) // allow auto topic creation
+	var err error
+	for _, broker := range p.brokers {
+		var resp []byte
+		if resp, err = p.roundTrip(broker, kafkaMetadataKey, 4, b.buf, true); err != nil {
+			continue
+		}
+		r := &kafkaReader{buf: resp}
+		r.int32() // the throttle time
+		addresses := make(map[int32]string)
+		for brokers := r.int32(); brokers > 0 && r.err == nil; brokers-- {
+			id, host, port := r.int32(), r.string(), r.int32()
+			r.nullableString() // the rack
+			addresses[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		r.nullableString() // the cluster id
+		r.int32()          // the controller id
+		var partitions []int32
+		leaders := make(map[int32]string)
+		for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+			code, name := r.int16(), r.string()
+			r.int8() // is internal
+			if name == p.topic && code != 0 && r.err == nil {
+				return errors.New("kafka topic " + p.topic + ": " + KafkaError(code).Error())
+			}
+			for count := r.int32(); count > 0 && r.err == nil; count-- {
+				r.int16()
+				partition, leader := r.int32(), r.int32()
+				r.int32Array() // the replicas
+				r.int32Array() // the in sync replicas
+				if address, ok := addresses[leader]; ok && name == p.topic {
+					partitions = append(partitions, partition)
+					leaders[partition] = address
+				}
+			}
+		}
+		if err = r.err; err == nil && len(partitions) == 0 {
+			err = errors.New("kafka topic " + p.topic + " has no partition with a leader")
+		}
+		if err == nil {
+			p.partitions, p.leaders = partitions, leaders
+			return nil
+		}
+	}
+	return err
+}
+
+// roundTrip sends the request to the broker, on its connection, and returns the
+// body of the response, if it expects one. The connection is closed after a failure.
+func (p *KafkaProducer) roundTrip(address string, apiKey int16, version int16, body []byte, expectResponse bool) ([]byte, error) {
+	c := p.conns[address]
+	if c == nil {
+		conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		c = &kafkaConn{conn: conn, reader: bufio.NewReader(conn)}
+		p.conns[address] = c
+	}
+	p.correlation++
+	var b kafkaBuffer
+	b.putInt32(0) // the size, set below
+	b.putInt16(apiKey)
+	b.putInt16(version)
+	b.putInt32(p.correlation)
+	b.putString(kafkaClientId)
+	b.buf = append(b.buf, body...)
+	binary.BigEndian.PutUint32(b.buf, uint32(len(b.buf)-4))
+
+	resp, err := func() ([]byte, error) {
+		c.conn.SetDeadline(time.Now().Add(p.timeout + 5*time.Second))
+		if _, err := c.conn.Write(b.buf); err != nil || !expectResponse {
+			return nil, err
+		}
+		var header [8]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		if size < 4 || size > 64*1024*1024 {
+			return nil, errors.New("kafka: unexpected response size " + strconv.FormatUint(uint64(size), 10))
+		}
+		if int32(binary.BigEndian.Uint32(header[4:])) != p.correlation {
+			return nil, errors.New("kafka: unexpected correlation id in the response")
+		}
+		resp := make([]byte, size-4)
+		_, err := io.ReadFull(c.reader, resp)
+		return resp, err
+	}()
+	if err != nil {
+		c.conn.Close()
+		delete(p.conns, address)
+		p.partitions = nil
+	}
+	return resp, err
+}
+
+// kafkaRecordBatch is the batch of the one record, in the v2 format of the
+// records, with no compression.
+func kafkaRecordBatch(key []byte, value []byte, timestamp time.Time) []byte {
+	var record kafkaBuffer
+	record.buf = append(record.buf, 0) // attributes
+	record.putVarint(0)                // timestamp delta
+	record.putVarint(0)                // offset delta
+	record.putVarint(int64(len(key)))
+	record.buf = append(record.buf, key...)
+	record.putVarint(int64(len(value)))
+	record.buf = append(record.buf, value...)
+	record.putVarint(0) // headers
+
+	millis := timestamp.UnixNano() / int64(time.Millisecond)
+	var b kafkaBuffer
+	b.putInt64(0)  // base offset
+	b.putInt32(0)  // batch length, set below
+	b.putInt32(-1) // partition leader epoch
+	b.buf = append(b.buf, 2)
+	b.putInt32(0) // crc, set below
+	crcStart := len(b.buf)
+	b.putInt16(0) // attributes
+	b.putInt32(0) // last offset delta
+	b.putInt64(millis)
+	b.putInt64(millis)
+	b.putInt64(-1) // producer id
+	b.putInt16(-1) // producer epoch
+	b.putInt32(-1) // base sequence
+	b.putInt32(1)
+	b.putVarint(int64(len(record.buf)))
+	b.buf = append(b.buf, record.buf...)
+	binary.BigEndian.PutUint32(b.buf[8:], uint32(len(b.buf)-12))
+	binary.BigEndian.PutUint32(b.buf[crcStart-4:], crc32.Checksum(b.buf[crcStart:], crc32.MakeTable(crc32.Castagnoli)))
+	return b.buf
+}
+
+// kafkaBuffer encodes the fields of the Kafka protocol, big endian.
+type kafkaBuffer struct {
+	buf []byte
+}
+
+func (b *kafkaBuffer) putInt16(v int16) {
+	b.buf = append(b.buf, byte(v>>8), byte(v))
+}
+
+func (b *kafkaBuffer) putInt32(v int32) {
+	b.buf = binary.BigEndian.AppendUint32(b.buf, uint32(v))
+}
+
+func (b *kafkaBuffer) putInt64(v int64) {
+	b.buf = binary.BigEndian.AppendUint64(b.buf, uint64(v))
+}
+
+func (b *kafkaBuffer) putString(s string) {
+	b.putInt16(int16(len(s)))
+	b.buf = append(b.buf, s...)
+}
+
+// putVarint writes the zigzag varint of the records.
+func (b *kafkaBuffer) putVarint(v int64) {
+	b.buf = binary.AppendVarint(b.buf, v)
+}
+
+// kafkaReader decodes the fields of a response, keeping the first error.
+type kafkaReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || n < 0 || r.pos+n > len(r.buf) {
+		if r.err == nil {
+			r.err = errors.New("kafka: truncated response")
+		}
+		return nil
+	}
+	r.pos += n
+	return r.buf[r.pos-n : r.pos]
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) string() string {
+	return string(r.next(int(r.int16())))
+}
+
+func (r *kafkaReader) nullableString() string {
+	if size := r.int16(); size >= 0 {
+		return string(r.next(int(size)))
+	}
+	return ""
+}
+
+func (r *kafkaReader) int32Array() {
+	if count := r.int32(); count > 0 {
+		r.next(4 * int(count))
+	}
+}
@@ -0,0 +1,204 @@
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKafka is a broker leading the two partitions of its topics, keeping the
+// records produced to them.
+type fakeKafka struct {
+	listener net.Listener
+	lock     sync.Mutex
+	records  map[int32][][2]string // partition => key, value
+	metadata int                   // the metadata requests
+	failNext KafkaError            // answered to the next produce
+}
+
+func startFakeKafka(t *testing.T) *fakeKafka {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeKafka{listener: listener, records: make(map[int32][][2]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(t, conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeKafka) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(reader, size[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return
+		}
+		r := &kafkaReader{buf: request}
+		apiKey, version, correlation, client := r.int16(), r.int16(), r.int32(), r.string()
+		if client != kafkaClientId {
+			t.Error("unexpected client id", client)
+		}
+		var b kafkaBuffer
+		b.putInt32(0)
+		b.putInt32(correlation)
+		f.lock.Lock()
+		switch {
+		case apiKey == kafkaMetadataKey && version == 4:
+			f.metadata++
+			host, port, _ := net.SplitHostPort(f.listener.Addr().String())
+			portNumber, _ := strconv.Atoi(port)
+			r.int32()
+			topic := r.string()
+			b.putInt32(0)
+			b.putInt32(1)
+			b.putInt32(7)
+			b.putString(host)
+			b.putInt32(int32(portNumber))
+			b.putInt16(-1)
+			b.putString("cluster")
+			b.putInt32(7)
+			b.putInt32(1)
+			b.putInt16(0)
+			b.putString(topic)
+			b.buf = append(b.buf, 0)
+			b.putInt32(2)
+			for partition := int32(0); partition < 2; partition++ {
+				b.putInt16(0)
+				b.putInt32(partition)
+				b.putInt32(7)
+				b.putInt32(1)
+				b.putInt32(7)
+				b.putInt32(1)
+				b.putInt32(7)
+			}
+		case apiKey == kafkaProduceKey && version == 3:
+			r.int16()
+			acks, _ := r.int16(), r.int32()
+			r.int32()
+			topic := r.string()
+			r.int32()
+			partition := r.int32()
+			batch := r.next(int(r.int32()))
+			if r.err != nil || acks != -1 {
+				t.Error("unexpected produce request", r.err, acks)
+			}
+			code := f.failNext
+			if code == 0 {
+				key, value := decodeRecordBatch(t, batch)
+				f.records[partition] = append(f.records[partition], [2]string{key, value})
+			}
+			f.failNext = 0
+			b.putInt32(1)
+			b.putString(topic)
+			b.putInt32(1)
+			b.putInt32(partition)
+			b.putInt16(int16(code))
+			b.putInt64(int64(len(f.records[partition])))
+			b.putInt64(-1)
+			b.putInt32(0)
+		default:
+			t.Error("unexpected request", apiKey, version)
+		}
+		f.lock.Unlock()
+		binary.BigEndian.PutUint32(b.buf, uint32(len(b.buf)-4))
+		conn.Write(b.buf)
+	}
+}
+
+func decodeRecordBatch(t *testing.T, batch []byte) (string, string) {
+	r := &kafkaReader{buf: batch}
+	r.int64()
+	if length := r.int32(); int(length) != len(batch)-12 {
+		t.Error("unexpected batch length", length)
+	}
+	r.int32()
+	if magic := r.int8(); magic != 2 {
+		t.Error("unexpected magic", magic)
+	}
+	if crc := uint32(r.int32()); crc != crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli)) {
+		t.Error("unexpected crc")
+	}
+	r.next(2 + 4 + 8 + 8 + 8 + 2 + 4)
+	if count := r.int32(); count != 1 {
+		t.Error("unexpected record count", count)
+	}
+	rest := batch[r.pos:]
+	length, n := binary.Varint(rest)
+	record := rest[n : n+int(length)]
+	record = record[1:]
+	for i := 0; i < 2; i++ { // the timestamp and offset deltas
+		_, n = binary.Varint(record)
+		record = record[n:]
+	}
+	keyLength, n := binary.Varint(record)
+	key := string(record[n : n+int(keyLength)])
+	record = record[n+int(keyLength):]
+	valueLength, n := binary.Varint(record)
+	return key, string(record[n : n+int(valueLength)])
+}
+
+func TestKafkaProducer(t *testing.T) {
+	f := startFakeKafka(t)
+	defer f.listener.Close()
+	p := NewKafkaProducer([]string{"127.0.0.1:1", f.listener.Addr().String()}, "files", -1)
+	defer p.Close()
+	for i := 0; i < 10; i++ {
+		key := "3," + strconv.Itoa(i)
+		if err := p.Produce([]byte(key), []byte("event of "+key), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Produce([]byte("3,0"), []byte("again"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	f.lock.Lock()
+	if len(f.records[0])+len(f.records[1]) != 11 || len(f.records[0]) == 0 || len(f.records[1]) == 0 || f.metadata != 1 {
+		t.Fatal("unexpected records", f.records, f.metadata)
+	}
+	// the records of a key go to its partition, in order
+	var ofKey []string
+	for _, records := range f.records {
+		for _, record := range records {
+			if record[0] == "3,0" {
+				ofKey = append(ofKey, record[1])
+			}
+		}
+	}
+	if len(ofKey) != 2 || ofKey[0] != "event of 3,0" || ofKey[1] != "again" {
+		t.Fatal("unexpected records of 3,0", ofKey)
+	}
+	f.failNext = 6
+	f.lock.Unlock()
+
+	// the leader moved, the metadata is read again for the retry
+	if err := p.Produce([]byte("3,1"), []byte("moved"), time.Now()); err != KafkaError(6) || err.Error() != "kafka: NOT_LEADER_OR_FOLLOWER" {
+		t.Fatal("unexpected error", err)
+	}
+	if err := p.Produce([]byte("3,1"), []byte("moved"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.metadata != 2 {
+		t.Error("the metadata should be read again", f.metadata)
+	}
+}
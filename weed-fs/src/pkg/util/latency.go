@@ -0,0 +1,105 @@
+package util
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MaxRecentSlowRequests = 100
+
+// ParseLatencyBudgets parses comma separated endpoint=duration pairs, e.g. "assign=100ms,lookup=50ms".
+func ParseLatencyBudgets(s string) (map[string]time.Duration, error) {
+	budgets := make(map[string]time.Duration)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, errors.New("Invalid latency budget \"" + pair + "\", expecting endpoint=duration")
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, errors.New("Invalid latency budget \"" + pair + "\": " + err.Error())
+		}
+		budgets[strings.TrimSpace(pair[:i])] = d
+	}
+	return budgets, nil
+}
+
+type SlowRequest struct {
+	Time     time.Time
+	Endpoint string
+	Target   string // the fid or volume id involved
+	Millis   int64
+}
+
+type endpointLatency struct {
+	count     int64
+	slowCount int64
+	maxMillis int64
+}
+
+// LatencyStats counts the requests of each endpoint, and logs and remembers
+// the recent ones that exceeded the latency budget of their endpoint.
+type LatencyStats struct {
+	budgets   map[string]time.Duration
+	endpoints map[string]*endpointLatency
+	recent    []SlowRequest
+	lock      sync.Mutex
+}
+
+func NewLatencyStats(budgets map[string]time.Duration) *LatencyStats {
+	return &LatencyStats{budgets: budgets, endpoints: make(map[string]*endpointLatency)}
+}
+
+// SetBudgets replaces the latency budgets, for the requests observed from now on.
+func (s *LatencyStats) SetBudgets(budgets map[string]time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.budgets = budgets
+}
+
+// Observe records a request on the endpoint that started at start.
+func (s *LatencyStats) Observe(endpoint string, target string, start time.Time) {
+	elapsed := time.Since(start)
+	millis := int64(elapsed / time.Millisecond)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e := s.endpoints[endpoint]
+	if e == nil {
+		e = &endpointLatency{}
+		s.endpoints[endpoint] = e
+	}
+	e.count++
+	if millis > e.maxMillis {
+		e.maxMillis = millis
+	}
+	if budget, ok := s.budgets[endpoint]; ok && elapsed > budget {
+		e.slowCount++
+		log.Println("Slow", endpoint, "on", target, "took", elapsed, "over the budget of", budget)
+		s.recent = append(s.recent, SlowRequest{Time: time.Now(), Endpoint: endpoint, Target: target, Millis: millis})
+		if len(s.recent) > MaxRecentSlowRequests {
+			s.recent = s.recent[len(s.recent)-MaxRecentSlowRequests:]
+		}
+	}
+}
+
+func (s *LatencyStats) ToMap() map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	endpoints := make(map[string]interface{})
+	for name, e := range s.endpoints {
+		m := map[string]interface{}{"Count": e.count, "Slow": e.slowCount, "MaxMillis": e.maxMillis}
+		if budget, ok := s.budgets[name]; ok {
+			m["BudgetMillis"] = int64(budget / time.Millisecond)
+		}
+		endpoints[name] = m
+	}
+	recent := make([]SlowRequest, len(s.recent))
+	copy(recent, s.recent)
+	return map[string]interface{}{"Endpoints": endpoints, "RecentSlowRequests": recent}
+}
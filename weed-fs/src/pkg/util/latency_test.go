@@ -0,0 +1,33 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	budgets, err := ParseLatencyBudgets("assign=10ms, lookup=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budgets["assign"] != 10*time.Millisecond || budgets["lookup"] != time.Second {
+		t.Fatalf("parsed budgets %v", budgets)
+	}
+	if _, err := ParseLatencyBudgets("assign"); err == nil {
+		t.Fatal("a budget without a duration should be invalid")
+	}
+
+	s := NewLatencyStats(budgets)
+	s.Observe("assign", "3,01637037d6", time.Now())
+	s.Observe("assign", "3,01637037d7", time.Now().Add(-time.Second))
+	s.Observe("read", "3,01637037d6", time.Now().Add(-time.Hour))
+	m := s.ToMap()
+	recent := m["RecentSlowRequests"].([]SlowRequest)
+	if len(recent) != 1 || recent[0].Target != "3,01637037d7" {
+		t.Fatalf("recent slow requests %v", recent)
+	}
+	assign := m["Endpoints"].(map[string]interface{})["assign"].(map[string]interface{})
+	if assign["Count"].(int64) != 2 || assign["Slow"].(int64) != 1 {
+		t.Fatalf("assign stats %v", assign)
+	}
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"container/list"
+	"sync"
+)
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+// LRUCache keeps values up to a total size, evicting the least recently used ones.
+type LRUCache struct {
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List // most recently used at the front
+	lock    sync.Mutex
+
+	hits, misses, evictions int64
+}
+
+func NewLRUCache(maxSize int64) *LRUCache {
+	return &LRUCache{maxSize: maxSize, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *LRUCache) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.hits++
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry).value, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// Set caches the value of the given size. Values larger than the whole cache are not cached.
+func (c *LRUCache) Set(key string, value interface{}, size int64) {
+	if size > c.maxSize {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remove(key)
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, size: size})
+	c.size += size
+	for c.size > c.maxSize {
+		c.remove(c.order.Back().Value.(*lruEntry).key)
+		c.evictions++
+	}
+}
+
+func (c *LRUCache) Delete(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remove(key)
+}
+
+func (c *LRUCache) remove(key string) {
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		c.size -= e.Value.(*lruEntry).size
+	}
+}
+
+func (c *LRUCache) ToMap() map[string]interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return map[string]interface{}{
+		"Entries":   len(c.entries),
+		"Size":      c.size,
+		"MaxSize":   c.maxSize,
+		"Hits":      c.hits,
+		"Misses":    c.misses,
+		"Evictions": c.evictions,
+	}
+}
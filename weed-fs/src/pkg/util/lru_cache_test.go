@@ -0,0 +1,28 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRUCache(10)
+	c.Set("a", "a", 4)
+	c.Set("b", "b", 4)
+	c.Get("a")
+	c.Set("c", "c", 4)
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b is the least recently used, and should have been evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v.(string) != "a" {
+		t.Fatal("a should still be cached")
+	}
+	c.Set("huge", "huge", 11)
+	if _, ok := c.Get("huge"); ok {
+		t.Fatal("a value larger than the cache should not be cached")
+	}
+	c.Delete("a")
+	m := c.ToMap()
+	if m["Entries"].(int) != 1 || m["Size"].(int64) != 4 || m["Evictions"].(int64) != 1 {
+		t.Fatal("unexpected cache stats", m)
+	}
+}
@@ -1,14 +1,48 @@
 package util
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
+// RequestTimeout bounds the calls between the servers made without a deadline
+// of their own, and the requests the servers handle. 0 means no limit.
+var RequestTimeout = 30 * time.Second
+
+// WithRequestTimeout returns a context done after RequestTimeout,
+// or earlier if ctx is done earlier.
+func WithRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, RequestTimeout)
+}
+
 func Post(url string, values url.Values) ([]byte, error) {
-	r, err := http.PostForm(url, values)
+	return PostContext(context.Background(), url, values)
+}
+
+// PostContext is Post that gives up when the context is done.
+// Without a deadline in the context, it gives up after RequestTimeout.
+func PostContext(ctx context.Context, url string, values url.Values) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = WithRequestTimeout(ctx)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Println("post to", url, err)
 		return nil, err
@@ -21,3 +55,32 @@ func Post(url string, values url.Values) ([]byte, error) {
 	}
 	return b, nil
 }
+
+// PostGzipped posts the form values like Post, with the body gzipped
+// and sent with "Content-Encoding: gzip".
+func PostGzipped(url string, values url.Values) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(values.Encode()))
+	gz.Close()
+	ctx, cancel := WithRequestTimeout(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Content-Encoding", "gzip")
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Println("post to", url, err)
+		return nil, err
+	}
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("read post result from", url, err)
+		return nil, err
+	}
+	return b, nil
+}
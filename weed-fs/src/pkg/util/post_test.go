@@ -0,0 +1,53 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPostDeadlines(t *testing.T) {
+	stuck := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stuck") == "true" {
+			<-stuck
+		}
+		w.Write([]byte(`{"error":""}`))
+	}))
+	defer server.Close()
+	defer close(stuck)
+	defer func(timeout time.Duration) { RequestTimeout = timeout }(RequestTimeout)
+	RequestTimeout = 100 * time.Millisecond
+	stuckUrl, values := server.URL+"?stuck=true", url.Values{"key": {"value"}}
+
+	if body, err := Post(server.URL, values); err != nil || string(body) != `{"error":""}` {
+		t.Fatal("post got", string(body), err)
+	}
+	start := time.Now()
+	if _, err := Post(stuckUrl, values); err == nil || time.Since(start) > 5*time.Second {
+		t.Error("a stuck post is not given up after RequestTimeout", err, time.Since(start))
+	}
+	start = time.Now()
+	if _, err := PostGzipped(stuckUrl, values); err == nil || time.Since(start) > 5*time.Second {
+		t.Error("a stuck gzipped post is not given up after RequestTimeout", err, time.Since(start))
+	}
+
+	// the deadline of the request is kept, even if longer than RequestTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := PostContext(ctx, stuckUrl, values); err == nil || time.Since(start) < 300*time.Millisecond {
+		t.Error("the deadline of the context is not kept", err, time.Since(start))
+	}
+
+	// without a limit, only the context gives the call up
+	RequestTimeout = 0
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := PostContext(ctx, stuckUrl, values); err == nil {
+		t.Error("a canceled post succeeded")
+	}
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"errors"
+)
+
+// ProtoBuffer encodes protocol buffer messages field by field, for the few
+// messages in pkg/operation/master.proto, without generated code.
+type ProtoBuffer struct {
+	buf []byte
+}
+
+const (
+	protoWireVarint          = 0
+	protoWireLengthDelimited = 2
+)
+
+var ErrProtoMalformed = errors.New("Malformed protocol buffer message")
+
+func (b *ProtoBuffer) appendVarint(v uint64) {
+	for v >= 0x80 {
+		b.buf = append(b.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	b.buf = append(b.buf, byte(v))
+}
+
+func (b *ProtoBuffer) appendKey(field int, wireType int) {
+	b.appendVarint(uint64(field)<<3 | uint64(wireType))
+}
+
+// EncodeUint64 writes a varint field, skipping the default zero value.
+func (b *ProtoBuffer) EncodeUint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.appendKey(field, protoWireVarint)
+	b.appendVarint(v)
+}
+
+// EncodeString writes a length delimited field, skipping the default empty value.
+func (b *ProtoBuffer) EncodeString(field int, s string) {
+	if s == "" {
+		return
+	}
+	b.appendKey(field, protoWireLengthDelimited)
+	b.appendVarint(uint64(len(s)))
+	b.buf = append(b.buf, s...)
+}
+
+// EncodeMessage writes an embedded message field, also for each element of repeated fields.
+func (b *ProtoBuffer) EncodeMessage(field int, m *ProtoBuffer) {
+	b.appendKey(field, protoWireLengthDelimited)
+	b.appendVarint(uint64(len(m.buf)))
+	b.buf = append(b.buf, m.buf...)
+}
+
+func (b *ProtoBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// DecodeProto calls fn with each field of the message. Varint fields come with
+// their value, length delimited fields, i.e. strings and messages, with their bytes.
+func DecodeProto(data []byte, fn func(field int, varint uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		key, n := decodeVarint(data)
+		if n == 0 {
+			return ErrProtoMalformed
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case protoWireVarint:
+			v, n := decodeVarint(data)
+			if n == 0 {
+				return ErrProtoMalformed
+			}
+			data = data[n:]
+			if err := fn(field, v, nil); err != nil {
+				return err
+			}
+		case protoWireLengthDelimited:
+			length, n := decodeVarint(data)
+			if n == 0 || uint64(len(data)-n) < length {
+				return ErrProtoMalformed
+			}
+			data = data[n:]
+			if err := fn(field, 0, data[:length]); err != nil {
+				return err
+			}
+			data = data[length:]
+		default:
+			return ErrProtoMalformed
+		}
+	}
+	return nil
+}
+
+// decodeVarint returns the value and the number of bytes read, 0 if malformed.
+func decodeVarint(data []byte) (v uint64, n int) {
+	for shift := uint(0); n < len(data) && shift < 64; shift += 7 {
+		b := data[n]
+		n++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, n
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestProtoBufferRoundTrip(t *testing.T) {
+	location := new(ProtoBuffer)
+	location.EncodeString(1, "localhost:8080")
+	b := new(ProtoBuffer)
+	b.EncodeString(1, "3,01637037d6")
+	b.EncodeUint64(4, 300)
+	b.EncodeMessage(7, location)
+	b.EncodeString(5, "")
+
+	var fid, url string
+	var count uint64
+	err := DecodeProto(b.Bytes(), func(field int, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			fid = string(bytes)
+		case 4:
+			count = varint
+		case 7:
+			return DecodeProto(bytes, func(field int, varint uint64, bytes []byte) error {
+				url = string(bytes)
+				return nil
+			})
+		case 5:
+			t.Fatal("empty string should not be encoded")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fid != "3,01637037d6" || count != 300 || url != "localhost:8080" {
+		t.Fatal("unexpected decoded values", fid, count, url)
+	}
+	if DecodeProto(b.Bytes()[:len(b.Bytes())-1], func(int, uint64, []byte) error { return nil }) == nil {
+		t.Fatal("truncated message should fail to decode")
+	}
+}
@@ -0,0 +1,175 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisConn is one connection to redis, opened on the first command, and
+// opened again after a failure.
+type RedisConn struct {
+	address  string
+	password string
+	conn     net.Conn
+	reader   *bufio.Reader
+	lock     sync.Mutex
+}
+
+func NewRedisConn(u *url.URL) *RedisConn {
+	c := &RedisConn{address: u.Host}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	return c
+}
+
+// Do sends the command, and returns its reply: a string, an int64, nil, or
+// a []interface{} of replies. The reply is waited for up to timeout.
+func (c *RedisConn) Do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.command(timeout, args...)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// Session runs f with the connection to itself, for the commands that no other
+// command may come in the middle of, e.g. the WATCH, MULTI and EXEC of a
+// transaction. The connection is opened again after a failure, other than an
+// error reply of redis.
+func (c *RedisConn) Session(timeout time.Duration, f func(do func(args ...string) (interface{}, error)) error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+	failed := false
+	err := f(func(args ...string) (interface{}, error) {
+		if failed {
+			return nil, errors.New("redis: the connection failed")
+		}
+		reply, err := c.command(timeout, args...)
+		if _, isReply := err.(RedisError); err != nil && !isReply {
+			failed = true
+		}
+		return reply, err
+	})
+	if failed {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// Close closes the connection, which is opened again by the next command.
+func (c *RedisConn) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// RedisError is an error reply of redis.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *RedisConn) connect() error {
+	conn, err := net.DialTimeout("tcp", c.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err = c.command(10*time.Second, "AUTH", c.password); err != nil {
+			conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// command sends the command in the redis protocol, and reads the reply.
+func (c *RedisConn) command(timeout time.Duration, args ...string) (interface{}, error) {
+	var b bytes.Buffer
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *RedisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply from redis")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '-':
+		return nil, RedisError(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("redis: unexpected reply " + line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("redis: unexpected reply " + line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		replies := make([]interface{}, count)
+		for i := range replies {
+			if replies[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, errors.New("redis: unexpected reply " + line)
+}
@@ -0,0 +1,126 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operations that a signed file id url can be used for.
+const (
+	SignedRead   = "read"
+	SignedWrite  = "write"
+	SignedDelete = "delete"
+	// a write keeping the last modified time of its ts parameter, only signed
+	// by the holders of the key, e.g. the replicas, never handed to clients
+	SignedWriteAt = "write_at"
+	// a write_at sent by another replica, which checked the upload policy of
+	// the collection already, only signed by the volume servers
+	SignedReplicate = "replicate"
+)
+
+var ErrSignatureExpired = errors.New("Signature expired")
+var ErrSignatureInvalid = errors.New("Signature invalid")
+
+// SignFileId returns the query string, with op, expires and sig parameters,
+// that lets the holder run op on the file id until the expires unix time.
+// The signature only covers that exact file id, not its sub file ids.
+func SignFileId(key string, op string, fid string, expires int64) string {
+	return SignFileIds(key, op, fid, 1, expires)
+}
+
+// SignFileIds is SignFileId covering the count file ids assigned together
+// from fid, i.e. fid and its sub file ids "3,01637037d6_1" to "_<count-1>".
+func SignFileIds(key string, op string, fid string, count int, expires int64) string {
+	values := make(url.Values)
+	values.Set("op", op)
+	values.Set("expires", strconv.FormatInt(expires, 10))
+	if count > 1 {
+		values.Set("count", strconv.Itoa(count))
+	}
+	values.Set("sig", fileIdSignature(key, op, fid, count, expires))
+	return values.Encode()
+}
+
+// VerifyFileIdSignature checks the op, expires and sig parameters of a request
+// on the file id, and with a count parameter that the file id is one of them.
+func VerifyFileIdSignature(key string, op string, fid string, values url.Values) error {
+	if values.Get("op") != op {
+		return ErrSignatureInvalid
+	}
+	expires, err := strconv.ParseInt(values.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	count := 1
+	if values.Get("count") != "" {
+		if count, err = strconv.Atoi(values.Get("count")); err != nil || count <= 1 {
+			return ErrSignatureInvalid
+		}
+		if deltaIndex := strings.LastIndex(fid, "_"); deltaIndex > 0 {
+			delta, err := strconv.Atoi(fid[deltaIndex+1:])
+			if err != nil || delta < 0 || delta >= count {
+				return ErrSignatureInvalid
+			}
+			fid = fid[:deltaIndex]
+		}
+	}
+	expected := fileIdSignature(key, op, fid, count, expires)
+	if !hmac.Equal([]byte(expected), []byte(values.Get("sig"))) {
+		return ErrSignatureInvalid
+	}
+	if time.Now().Unix() > expires {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func fileIdSignature(key string, op string, fid string, count int, expires int64) string {
+	signed := op + ":" + fid + ":" + strconv.FormatInt(expires, 10)
+	if count > 1 {
+		signed = op + ":" + fid + ":" + strconv.Itoa(count) + ":" + strconv.FormatInt(expires, 10)
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signed))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignValues adds a sig parameter to the form values, signing all of them, so
+// the receiver sharing the key knows they come from the cluster. The values
+// should have a time parameter, with the unix time they are sent at.
+func SignValues(key string, values url.Values) {
+	values.Set("sig", valuesSignature(key, values))
+}
+
+// VerifyValuesSignature checks the sig parameter of the form values, and that
+// they were sent within maxSkew of now.
+func VerifyValuesSignature(key string, values url.Values, maxSkew time.Duration) error {
+	if !hmac.Equal([]byte(valuesSignature(key, values)), []byte(values.Get("sig"))) {
+		return ErrSignatureInvalid
+	}
+	sentAt, err := strconv.ParseInt(values.Get("time"), 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	if skew := time.Since(time.Unix(sentAt, 0)); skew > maxSkew || skew < -maxSkew {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func valuesSignature(key string, values url.Values) string {
+	signed := make(url.Values)
+	for name, v := range values {
+		if name != "sig" {
+			signed[name] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signed.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignValues(t *testing.T) {
+	values := url.Values{"port": {"8080"}, "time": {strconv.FormatInt(time.Now().Unix(), 10)}}
+	SignValues("secret", values)
+	if err := VerifyValuesSignature("secret", values, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyValuesSignature("other", values, time.Minute); err != ErrSignatureInvalid {
+		t.Fatal("expecting", ErrSignatureInvalid, "with another key, got", err)
+	}
+	values.Set("port", "8081")
+	if err := VerifyValuesSignature("secret", values, time.Minute); err != ErrSignatureInvalid {
+		t.Fatal("expecting", ErrSignatureInvalid, "for changed values, got", err)
+	}
+	values.Set("time", strconv.FormatInt(time.Now().Unix()-120, 10))
+	SignValues("secret", values)
+	if err := VerifyValuesSignature("secret", values, time.Minute); err != ErrSignatureExpired {
+		t.Fatal("expecting", ErrSignatureExpired, "for old values, got", err)
+	}
+}
+
+func TestSignFileId(t *testing.T) {
+	expires := time.Now().Unix() + 60
+	values, _ := url.ParseQuery(SignFileId("secret", SignedWrite, "3,01637037d6", expires))
+	if err := VerifyFileIdSignature("secret", SignedWrite, "3,01637037d6", values); err != nil {
+		t.Fatal(err)
+	}
+	for _, fid := range []string{"3,01637037d6_2", "3,01637037d6_0", "3,01637037d6_x"} {
+		if err := VerifyFileIdSignature("secret", SignedWrite, fid, values); err != ErrSignatureInvalid {
+			t.Fatal("expecting", ErrSignatureInvalid, "for the sub file id", fid, "got", err)
+		}
+	}
+	if err := VerifyFileIdSignature("secret", SignedDelete, "3,01637037d6", values); err != ErrSignatureInvalid {
+		t.Fatal("expecting", ErrSignatureInvalid, "for another op, got", err)
+	}
+	if err := VerifyFileIdSignature("secret", SignedWrite, "3,01637037d7", values); err != ErrSignatureInvalid {
+		t.Fatal("expecting", ErrSignatureInvalid, "for another file id, got", err)
+	}
+	if err := VerifyFileIdSignature("other", SignedWrite, "3,01637037d6", values); err != ErrSignatureInvalid {
+		t.Fatal("expecting", ErrSignatureInvalid, "with another key, got", err)
+	}
+	values.Set("expires", strconv.FormatInt(expires+3600, 10))
+	if err := VerifyFileIdSignature("secret", SignedWrite, "3,01637037d6", values); err != ErrSignatureInvalid {
+		t.Fatal("expecting", ErrSignatureInvalid, "for a changed expiry, got", err)
+	}
+	values, _ = url.ParseQuery(SignFileId("secret", SignedRead, "3,01637037d6", time.Now().Unix()-1))
+	if err := VerifyFileIdSignature("secret", SignedRead, "3,01637037d6", values); err != ErrSignatureExpired {
+		t.Fatal("expecting", ErrSignatureExpired, "for an expired url, got", err)
+	}
+}
+
+func TestSignFileIds(t *testing.T) {
+	values, _ := url.ParseQuery(SignFileIds("secret", SignedWrite, "3,01637037d6", 3, time.Now().Unix()+60))
+	for _, fid := range []string{"3,01637037d6", "3,01637037d6_1", "3,01637037d6_2"} {
+		if err := VerifyFileIdSignature("secret", SignedWrite, fid, values); err != nil {
+			t.Fatal("expecting the signature to cover", fid, "got", err)
+		}
+	}
+	for _, fid := range []string{"3,01637037d6_3", "3,01637037d6_1000", "3,01637037d6_-1", "3,01637037d7_1"} {
+		if err := VerifyFileIdSignature("secret", SignedWrite, fid, values); err != ErrSignatureInvalid {
+			t.Fatal("expecting", ErrSignatureInvalid, "for", fid, "past the count, got", err)
+		}
+	}
+	values.Set("count", "4")
+	if err := VerifyFileIdSignature("secret", SignedWrite, "3,01637037d6_3", values); err != ErrSignatureInvalid {
+		t.Fatal("expecting", ErrSignatureInvalid, "for a changed count, got", err)
+	}
+	values.Del("count")
+	if err := VerifyFileIdSignature("secret", SignedWrite, "3,01637037d6", values); err != ErrSignatureInvalid {
+		t.Fatal("expecting", ErrSignatureInvalid, "without the count, got", err)
+	}
+	if SignFileIds("secret", SignedWrite, "3,01637037d6", 1, 100) != SignFileId("secret", SignedWrite, "3,01637037d6", 100) {
+		t.Fatal("a count of 1 should sign the exact file id")
+	}
+}
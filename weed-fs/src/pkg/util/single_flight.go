@@ -0,0 +1,60 @@
+package util
+
+import (
+	"sync"
+)
+
+type flightCall struct {
+	done  sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// SingleFlight runs one call at a time for each key. The callers coming while a
+// call of their key is in flight wait for it and share its result, e.g. the
+// reads of one popular file hit by a stampede. The zero value is ready to use.
+type SingleFlight struct {
+	calls map[string]*flightCall
+	lock  sync.Mutex
+
+	count, coalesced int64
+}
+
+// Do runs fn for the key, or waits for the call of the key in flight, and
+// returns its result. shared tells if the result came from another caller's call.
+func (f *SingleFlight) Do(key string, fn func() (interface{}, error)) (value interface{}, shared bool, err error) {
+	f.lock.Lock()
+	if c, ok := f.calls[key]; ok {
+		f.coalesced++
+		f.lock.Unlock()
+		c.done.Wait()
+		return c.value, true, c.err
+	}
+	if f.calls == nil {
+		f.calls = make(map[string]*flightCall)
+	}
+	c := new(flightCall)
+	c.done.Add(1)
+	f.calls[key] = c
+	f.count++
+	f.lock.Unlock()
+
+	defer func() {
+		f.lock.Lock()
+		delete(f.calls, key)
+		f.lock.Unlock()
+		c.done.Done()
+	}()
+	c.value, c.err = fn()
+	return c.value, false, c.err
+}
+
+func (f *SingleFlight) ToMap() map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return map[string]interface{}{
+		"Calls":     f.count,
+		"Coalesced": f.coalesced,
+		"InFlight":  len(f.calls),
+	}
+}
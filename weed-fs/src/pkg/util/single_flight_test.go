@@ -0,0 +1,56 @@
+package util
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSingleFlightSharesTheCallInFlight(t *testing.T) {
+	var f SingleFlight
+	release, started := make(chan bool), make(chan bool)
+	calls := 0
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _, _ = f.Do("3,01", func() (interface{}, error) {
+			calls++
+			started <- true
+			<-release
+			return "content", nil
+		})
+	}()
+	<-started
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var shared bool
+			if results[i], shared, _ = f.Do("3,01", nil); !shared {
+				t.Error("the call in flight should be shared")
+			}
+		}(i)
+	}
+	for f.ToMap()["Coalesced"].(int64) < int64(len(results)-1) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	for _, result := range results {
+		if result != "content" {
+			t.Fatal("unexpected results", results)
+		}
+	}
+
+	// once done, the next call of the key runs again
+	_, shared, err := f.Do("3,01", func() (interface{}, error) { calls++; return nil, errors.New("Not Found") })
+	if shared || err == nil || calls != 2 {
+		t.Fatal("the key should be called again", shared, err, calls)
+	}
+	if m := f.ToMap(); m["Calls"].(int64) != 2 || m["InFlight"].(int) != 0 {
+		t.Fatal("unexpected stats", m)
+	}
+}
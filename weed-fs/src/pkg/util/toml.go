@@ -0,0 +1,117 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ParseToml reads the simple TOML used by the weed.toml configuration file:
+// [sections] of key = value lines, with "strings", 'literal strings', numbers,
+// booleans and arrays of them, and # comments. Arrays are joined with commas,
+// the way the comma separated flags take them. Keys before any section are in
+// the "" section.
+//
+//	[volume]
+//	port = 8080
+//	dir = ["/data1", "/data2"]   # same as -dir=/data1,/data2
+func ParseToml(data []byte) (map[string]map[string]string, error) {
+	sections := map[string]map[string]string{"": make(map[string]string)}
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lineError := func(message string) error {
+			return errors.New("Line " + strconv.Itoa(lineNumber) + ": " + message)
+		}
+		if line[0] == '[' {
+			end := strings.Index(line, "]")
+			if end < 0 || strings.TrimSpace(stripTomlComment(line[end+1:])) != "" {
+				return nil, lineError("invalid section " + line)
+			}
+			section = strings.TrimSpace(line[1:end])
+			if _, ok := sections[section]; !ok {
+				sections[section] = make(map[string]string)
+			}
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, lineError("expecting key = value")
+		}
+		key := strings.Trim(strings.TrimSpace(line[:i]), "\"")
+		value, rest, err := parseTomlValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, lineError(err.Error())
+		}
+		if strings.TrimSpace(stripTomlComment(rest)) != "" {
+			return nil, lineError("unexpected " + rest)
+		}
+		if _, ok := sections[section][key]; ok {
+			return nil, lineError("duplicate key " + key)
+		}
+		sections[section][key] = value
+	}
+	return sections, scanner.Err()
+}
+
+// parseTomlValue reads the value at the start of s, and returns what follows it.
+func parseTomlValue(s string) (value string, rest string, err error) {
+	switch {
+	case s == "":
+		return "", "", errors.New("missing value")
+	case s[0] == '"':
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				value, err = strconv.Unquote(s[:i+1])
+				return value, s[i+1:], err
+			}
+		}
+		return "", "", errors.New("unterminated string " + s)
+	case s[0] == '\'':
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", "", errors.New("unterminated string " + s)
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case s[0] == '[':
+		var values []string
+		rest = strings.TrimSpace(s[1:])
+		for !strings.HasPrefix(rest, "]") {
+			if value, rest, err = parseTomlValue(rest); err != nil {
+				return "", "", err
+			}
+			values = append(values, value)
+			rest = strings.TrimSpace(rest)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return "", "", errors.New("expecting , or ] in array")
+			}
+		}
+		return strings.Join(values, ","), rest[1:], nil
+	}
+	end := strings.IndexAny(s, ",]#")
+	if end < 0 {
+		end = len(s)
+	}
+	value = strings.TrimSpace(s[:end])
+	if value == "" || strings.ContainsAny(value, " \t\"'") {
+		return "", "", errors.New("invalid value " + s)
+	}
+	return value, s[end:], nil
+}
+
+func stripTomlComment(s string) string {
+	if i := strings.Index(s, "#"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
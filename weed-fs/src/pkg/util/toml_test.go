@@ -0,0 +1,56 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestParseToml(t *testing.T) {
+	sections, err := ParseToml([]byte(`
+# weed.toml
+debug = true
+
+[master]
+port = 9333          # the http port
+mdir = "/data/master # not a comment"
+garbageThreshold = 0.3
+
+[volume]
+dir = ["/data1", '/data2']
+publicUrl = "example.com:8080"
+secureKey = "a\"b"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]string{
+		"":       {"debug": "true"},
+		"master": {"port": "9333", "mdir": "/data/master # not a comment", "garbageThreshold": "0.3"},
+		"volume": {"dir": "/data1,/data2", "publicUrl": "example.com:8080", "secureKey": "a\"b"},
+	}
+	for section, keys := range expected {
+		for key, value := range keys {
+			if sections[section][key] != value {
+				t.Fatalf("[%s] %s = %q, expecting %q", section, key, sections[section][key], value)
+			}
+		}
+		if len(sections[section]) != len(keys) {
+			t.Fatal("unexpected keys in section", section, sections[section])
+		}
+	}
+}
+
+func TestParseTomlErrors(t *testing.T) {
+	for _, data := range []string{
+		"port",
+		"port =",
+		"[master",
+		"mdir = \"/data",
+		"dir = [\"/a\" \"/b\"]",
+		"mdir = /data master",
+		"port = 1\nport = 2",
+	} {
+		if _, err := ParseToml([]byte(data)); err == nil {
+			t.Fatalf("expecting an error for %q", data)
+		}
+	}
+}